@@ -0,0 +1,176 @@
+// agent is a guest agent for driving the guest from the host with hv (see
+// hv/main.go): it runs commands, reads and writes files, sets the clock from
+// the RTC, and shuts down the guest. Boot it as init (init=/bin/agent) or start it from one.
+//
+// It listens on vsock port 1234, which run.sh bridges to vsock.sock on the
+// host. Each connection carries one request and one response, both a line
+// of JSON.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	afVsock      = 40
+	vmaddrCidAny = 0xffffffff
+	agentPort    = 1234
+	rtcRdTime    = 0x80247009 // _IOR('p', 0x09, struct rtc_time)
+)
+
+// struct sockaddr_vm. The syscall package doesn't support AF_VSOCK.
+type sockaddrVM struct {
+	family   uint16
+	reserved uint16
+	port     uint32
+	cid      uint32
+	zero     [4]uint8
+}
+
+// struct rtc_time.
+type rtcTime struct {
+	sec, min, hour, mday, mon, year, wday, yday, isdst int32
+}
+
+type request struct {
+	Op   string   `json:"op"` // "exec", "read", "write", "sync-time", or "shutdown"
+	Args []string `json:"args,omitempty"`
+	Path string   `json:"path,omitempty"`
+	Data []byte   `json:"data,omitempty"`
+	Mode uint32   `json:"mode,omitempty"`
+}
+
+type response struct {
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status"`
+	Output []byte `json:"output,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+func listen(port uint32) (int, error) {
+	fd, err := syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("socket: %w", err)
+	}
+
+	sa := sockaddrVM{family: afVsock, port: port, cid: vmaddrCidAny}
+	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+	if errno != 0 {
+		return -1, fmt.Errorf("bind: %w", errno)
+	}
+
+	if err := syscall.Listen(fd, 1); err != nil {
+		return -1, fmt.Errorf("listen: %w", err)
+	}
+
+	return fd, nil
+}
+
+// syncTime sets the system clock from the RTC (the hypervisor's -rtc), which
+// keeps the host's time while the VM is saved or migrated.
+func syncTime() error {
+	f, err := os.Open("/dev/rtc0")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var t rtcTime
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), rtcRdTime, uintptr(unsafe.Pointer(&t)))
+	if errno != 0 {
+		return fmt.Errorf("RTC_RD_TIME: %w", errno)
+	}
+
+	now := time.Date(int(t.year)+1900, time.Month(t.mon+1), int(t.mday), int(t.hour), int(t.min), int(t.sec), 0, time.UTC)
+	tv := syscall.NsecToTimeval(now.UnixNano())
+	return syscall.Settimeofday(&tv)
+}
+
+func handle(req *request) (resp response) {
+	switch req.Op {
+	case "exec":
+		if len(req.Args) == 0 {
+			resp.Error = "exec: no command"
+			return
+		}
+
+		output, err := exec.Command(req.Args[0], req.Args[1:]...).CombinedOutput()
+		resp.Output = output
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			resp.Status = exitErr.ExitCode()
+		} else if err != nil {
+			resp.Error = err.Error()
+		}
+	case "read":
+		data, err := os.ReadFile(req.Path)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Data = data
+	case "write":
+		mode := os.FileMode(req.Mode)
+		if mode == 0 {
+			mode = 0o644
+		}
+
+		if err := os.WriteFile(req.Path, req.Data, mode); err != nil {
+			resp.Error = err.Error()
+		}
+	case "sync-time":
+		if err := syncTime(); err != nil {
+			resp.Error = err.Error()
+		}
+	case "shutdown":
+		// Powered off after the response is sent.
+	default:
+		resp.Error = fmt.Sprintf("unknown op: %q", req.Op)
+	}
+	return
+}
+
+func serve(conn *os.File) {
+	defer conn.Close()
+
+	var req request
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		fmt.Fprintf(os.Stderr, "agent: invalid request: %v\n", err)
+		return
+	}
+
+	resp := handle(&req)
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		fmt.Fprintf(os.Stderr, "agent: failed to send the response: %v\n", err)
+	}
+
+	if req.Op == "shutdown" && resp.Error == "" {
+		syscall.Sync()
+		syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+	}
+}
+
+func main() {
+	fd, err := listen(agentPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "agent: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("agent: listening on vsock port %d\n", agentPort)
+	for {
+		nfd, _, errno := syscall.Syscall6(syscall.SYS_ACCEPT4, uintptr(fd), 0, 0, syscall.SOCK_CLOEXEC, 0, 0)
+		if errno != 0 {
+			fmt.Fprintf(os.Stderr, "agent: accept: %v\n", errno)
+			continue
+		}
+
+		// One at a time: the hypervisor bridges one connection per port.
+		serve(os.NewFile(nfd, "vsock"))
+	}
+}
@@ -1,15 +1,27 @@
 #!/bin/bash
 cd "$(dirname "$0")"
 
+# Build catsay, and pack it into an initramfs (initrd.cpio).
+GOOS=linux GOARCH=riscv64 CGO_ENABLED=0 go build -o catsay.bin catsay.go
+go run mkinitrd/main.go -o initrd.cpio -name catsay catsay.bin
+
+# Build the guest agent for hv (boot with init=/bin/agent).
+GOOS=linux GOARCH=riscv64 CGO_ENABLED=0 go build -o agent.bin ./agent
+
 docker build -t guest-linux-builder -f Dockerfile .
 
-# Build Linux kernel, and copy the Image to this directory.
+# Build Linux kernel, and copy the Image to this directory. With
+# EMBED_INITRD=1, initrd.cpio is built into the kernel image.
+if [ "$EMBED_INITRD" = 1 ]; then
+    initramfs_source=/linux/initrd.cpio
+fi
 docker run -v $PWD:/linux -it guest-linux-builder \
-    bash -c 'make -j$(nproc) Image && cp arch/riscv/boot/Image /linux/Image && cp vmlinux /linux/vmlinux'
+    bash -c "scripts/config --set-str INITRAMFS_SOURCE '$initramfs_source' && make olddefconfig && make -j\$(nproc) Image && cp arch/riscv/boot/Image /linux/Image && cp vmlinux /linux/vmlinux"
 
 # Build rootfs with catsay
 rm -rf rootfs rootfs.squashfs
 mkdir -p rootfs/dev # auto mounted by CONFIG_DEVTMPFS_MOUNT
 mkdir -p rootfs/bin
-GOOS=linux GOARCH=riscv64 go build -o rootfs/bin/catsay catsay.go
+cp catsay.bin rootfs/bin/catsay
+cp agent.bin rootfs/bin/agent
 mksquashfs rootfs/ rootfs.squashfs -comp xz -b 1M -no-xattrs -noappend
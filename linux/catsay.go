@@ -3,9 +3,18 @@ package main
 import (
 	"fmt"
 	"time"
+
+	"github.com/nuta/hypervisor-in-1000-lines/linux/hvtrace"
 )
 
 func main() {
+	// Marks the greeting in the hypervisor's trace (-trace-guest) if any,
+	// to tell its VM exits apart from the others.
+	trace, err := hvtrace.Open()
+	if err == nil {
+		trace.Write("catsay: printing")
+	}
+
 	// ASCII art cat saying "Hello World!"
 	fmt.Println()
 	fmt.Println("\033[33m     /\\_/\\  \033[0m")
@@ -14,6 +23,9 @@ func main() {
 	fmt.Println()
 	fmt.Println("\033[32m   Hello World!\033[0m")
 	fmt.Println()
+	if trace != nil {
+		trace.Write("catsay: printed")
+	}
 
 	for {
 		time.Sleep(1 * time.Second)
@@ -0,0 +1,3 @@
+module github.com/nuta/hypervisor-in-1000-lines/linux
+
+go 1.21
@@ -0,0 +1,249 @@
+// hv boots VMs with named profiles of run.sh's options, and drives the
+// guest through the guest agent (agent/main.go) from the host:
+//
+//	go run ./hv run linux-demo
+//	go run ./hv run linux-demo -seed 42 -device blk,disable-feature=indirect
+//	go run ./hv create -from linux-demo -description "with a trace" traced -trace-guest
+//	go run ./hv attach
+//	go run ./hv exec uname -a
+//	go run ./hv cp host:result.txt guest:/tmp/result.txt
+//	go run ./hv cp guest:/tmp/log.txt host:log.txt
+//	go run ./hv sync-time
+//	go run ./hv shutdown
+//
+// run execs run.sh (found in the current directory or a parent) with the
+// profile's options. The profiles are the built-in ones (default and
+// linux-demo) and the ones saved by create in hv.json next to run.sh.
+// attach runs the monitor's commands (e.g. `info status`) of a running VM.
+//
+// The agent's commands connect to vsock.sock, which the hypervisor bridges
+// to vsock port 1234 in the guest (see run.sh).
+//
+// decrypt-dump works offline: it decrypts a memory dump written with
+// -snapshot-key into an ELF core file for crash or GDB:
+//
+//	go run ./hv -key ../snapshot.key decrypt-dump ../dump.img dump.elf
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+type request struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+	Path string   `json:"path,omitempty"`
+	Data []byte   `json:"data,omitempty"`
+	Mode uint32   `json:"mode,omitempty"`
+}
+
+type response struct {
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status"`
+	Output []byte `json:"output,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+var socket = flag.String("sock", "vsock.sock", "the UNIX socket bridged to the guest agent")
+var keyFile = flag.String("key", "", "the file of the snapshot key in hex (default: $SNAPSHOT_KEY)")
+
+// The layout of encrypted dumps (see src/core_dump.rs and src/encryption.rs).
+const (
+	dumpMagic      = "HVDUMPEN"
+	dumpVersion    = 1
+	dumpHeaderSize = 36
+	chunkSize      = 1024 * 1024
+	sectorSize     = 512
+)
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "hv: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func call(req *request) *response {
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		fatalf("failed to send the request: %v", err)
+	}
+
+	var resp response
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		fatalf("no response from the agent: %v", err)
+	}
+
+	if resp.Error != "" {
+		fatalf("%s: %s", req.Op, resp.Error)
+	}
+	return &resp
+}
+
+// cp copies a file between host:<path> and guest:<path>.
+func cp(src, dst string) {
+	switch {
+	case strings.HasPrefix(src, "host:") && strings.HasPrefix(dst, "guest:"):
+		path := strings.TrimPrefix(src, "host:")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fatalf("%v", err)
+		}
+
+		mode := uint32(0o644)
+		if info, err := os.Stat(path); err == nil {
+			mode = uint32(info.Mode().Perm())
+		}
+		call(&request{Op: "write", Path: strings.TrimPrefix(dst, "guest:"), Data: data, Mode: mode})
+	case strings.HasPrefix(src, "guest:") && strings.HasPrefix(dst, "host:"):
+		resp := call(&request{Op: "read", Path: strings.TrimPrefix(src, "guest:")})
+		if err := os.WriteFile(strings.TrimPrefix(dst, "host:"), resp.Data, 0o644); err != nil {
+			fatalf("%v", err)
+		}
+	default:
+		fatalf("cp: expected host:<file> guest:<path> or guest:<path> host:<file>")
+	}
+}
+
+func loadKey() []byte {
+	text := os.Getenv("SNAPSHOT_KEY")
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		text = string(data)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(key) != 32 {
+		fatalf("the key must be 64 hex digits (-key or $SNAPSHOT_KEY)")
+	}
+	return key
+}
+
+// decryptDump decrypts chunk by chunk: the ELF headers, then the guest RAM.
+func decryptDump(src, dst string) {
+	block, err := aes.NewCipher(loadKey())
+	if err != nil {
+		fatalf("%v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer in.Close()
+
+	header := make([]byte, dumpHeaderSize)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:8]) != dumpMagic {
+		fatalf("%s: not an encrypted dump", src)
+	}
+	if version := binary.LittleEndian.Uint32(header[8:12]); version != dumpVersion {
+		fatalf("%s: unsupported version %d", src, version)
+	}
+
+	headersSize := int(binary.LittleEndian.Uint64(header[12:20]))
+	memorySize := int(binary.LittleEndian.Uint64(header[20:28]))
+	noncePrefix := header[28:36]
+	sizes := []int{headersSize}
+	for offset := 0; offset < memorySize; offset += chunkSize {
+		sizes = append(sizes, min(memorySize-offset, chunkSize))
+	}
+
+	tags := make([]byte, len(sizes)*gcm.Overhead())
+	if _, err := io.ReadFull(in, tags); err != nil {
+		fatalf("%s: %v", src, err)
+	}
+	headerSize := (dumpHeaderSize + len(tags) + sectorSize - 1) / sectorSize * sectorSize
+	if _, err := in.Seek(int64(headerSize), io.SeekStart); err != nil {
+		fatalf("%s: %v", src, err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer out.Close()
+
+	buf := make([]byte, max(headersSize, chunkSize)+gcm.Overhead())
+	for i, size := range sizes {
+		if _, err := io.ReadFull(in, buf[:size]); err != nil {
+			fatalf("%s: %v", src, err)
+		}
+		copy(buf[size:], tags[i*gcm.Overhead():(i+1)*gcm.Overhead()])
+
+		nonce := binary.BigEndian.AppendUint32(append([]byte{}, noncePrefix...), uint32(i))
+		plain, err := gcm.Open(buf[:0], nonce, buf[:size+gcm.Overhead()], nil)
+		if err != nil {
+			fatalf("%s: chunk %d is broken or tampered with (or the key is wrong)", src, i)
+		}
+		if _, err := out.Write(plain); err != nil {
+			fatalf("%v", err)
+		}
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: hv run <profile> [-<option> [<value>]...]\n")
+		fmt.Fprintf(os.Stderr, "       hv create [-from <profile>] [-description <text>] <name> [-<option> [<value>]...]\n")
+		fmt.Fprintf(os.Stderr, "       hv attach [-sock monitor.sock]\n")
+		fmt.Fprintf(os.Stderr, "       hv [-sock vsock.sock] exec <cmd> [args...]\n")
+		fmt.Fprintf(os.Stderr, "       hv [-sock vsock.sock] cp <src> <dst>\n")
+		fmt.Fprintf(os.Stderr, "       hv [-sock vsock.sock] sync-time\n")
+		fmt.Fprintf(os.Stderr, "       hv [-sock vsock.sock] shutdown\n")
+		fmt.Fprintf(os.Stderr, "       hv [-key snapshot.key] decrypt-dump <dump.img> <dump.elf>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch {
+	case args[0] == "run":
+		run(args[1:])
+	case args[0] == "create":
+		create(args[1:])
+	case args[0] == "attach":
+		attach(args[1:])
+	case args[0] == "exec" && len(args) >= 2:
+		resp := call(&request{Op: "exec", Args: args[1:]})
+		os.Stdout.Write(resp.Output)
+		os.Exit(resp.Status)
+	case args[0] == "cp" && len(args) == 3:
+		cp(args[1], args[2])
+	case args[0] == "sync-time" && len(args) == 1:
+		// e.g. after restoring a snapshot: the guest's clock has stopped
+		// while it was saved.
+		call(&request{Op: "sync-time"})
+	case args[0] == "shutdown" && len(args) == 1:
+		call(&request{Op: "shutdown"})
+	case args[0] == "decrypt-dump" && len(args) == 3:
+		decryptDump(args[1], args[2])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// profilesFile keeps the profiles made with `hv create`, next to run.sh.
+const profilesFile = "hv.json"
+
+// profile is a named set of run.sh options, e.g. {"kernel": "linux/Image"}.
+// Paths are relative to the directory of run.sh.
+type profile struct {
+	Description string            `json:"description,omitempty"`
+	Options     map[string]string `json:"options"`
+}
+
+// builtinProfiles are available without hv.json (which may override them).
+var builtinProfiles = map[string]profile{
+	"default": {
+		Description: "the built-in kernel (linux/Image) with run.sh's defaults",
+		Options:     map[string]string{},
+	},
+	"linux-demo": {
+		Description: "Linux (linux/Image) with the catsay initramfs (see linux/build.sh)",
+		Options: map[string]string{
+			"kernel": "linux/Image",
+			"initrd": "linux/initrd.cpio",
+			"append": "console=hvc earlycon=sbi panic=-1 rdinit=/init",
+		},
+	},
+}
+
+// runOption is an option of `hv run` and `hv create`: -<name> sets the
+// environment variable env of run.sh, which documents them.
+type runOption struct {
+	name  string
+	env   string
+	value string // e.g. "<file>", or "" for a switch
+	help  string
+}
+
+var runOptions = []runOption{
+	{"name", "NAME", "<name>", "the VM's name, which its UUID, serial number, and MAC address derive from"},
+	{"kernel", "KERNEL", "<file>", "the guest kernel (Image, Image.gz, vmlinuz.efi, or an ELF)"},
+	{"initrd", "INITRD", "<file>", "the initrd"},
+	{"append", "APPEND", "<cmdline>", "the kernel command line"},
+	{"firmware", "FIRMWARE", "<file>", "an S-mode firmware to boot first (e.g. U-Boot)"},
+	{"machine", "MACHINE", "<file>", "the guest's memory map (machine.json)"},
+	{"symbols", "SYMBOLS", "<file>", "System.map or vmlinux for the guest's symbols"},
+	{"dtb-overlay", "DTB_OVERLAY", "<file>", "a device tree overlay"},
+	{"snapshot-key-file", "SNAPSHOT_KEY_FILE", "<file>", "encrypts snapshots and dumps with this key"},
+	{"measure", "MEASURE", "", "measures the boot images"},
+	{"verify", "VERIFY", "<pubkey.pem>", "refuses to boot unsigned images"},
+	{"overlay", "OVERLAY", "<file>", "writes to a copy-on-write overlay of disk.img"},
+	{"queues", "QUEUES", "<n>", "virtio-net and virtio-blk queues"},
+	{"disk-throttle", "DISK_THROTTLE", "iops=<n>,bps=<n>", "simulates a slow disk"},
+	{"net-throttle", "NET_THROTTLE", "pps=<n>,bps=<n>", "simulates a slow link"},
+	{"hostfwd", "HOSTFWD", "<rules>", "forwards host ports, e.g. tcp::2222-:22"},
+	{"pcap", "PCAP", "<file>", "captures the frames of virtio-net"},
+	{"pprof", "PPROF", "", "serves a profile of the VM exits on pprof.sock"},
+	{"watchdog-action", "WATCHDOG_ACTION", "<action>", "reset, poweroff, pause, or none"},
+	{"input", "INPUT", "", "a keyboard and a tablet instead of virtio-rng and virtio-balloon"},
+	{"pci", "PCI", "", "virtio-pci instead of virtio-mmio"},
+	{"hotplug", "HOTPLUG", "<file>", "a disk for device_add in the monitor"},
+	{"incoming", "INCOMING", "", "waits for a live migration"},
+	{"mem-file", "MEM_FILE", "<file>", "backs QEMU's RAM with a file"},
+	{"loadvm", "LOADVM", "", "restores the snapshot at boot"},
+	{"share-dir", "SHARE_DIR", "<dir>", "the directory shared with the guest"},
+	{"virtiofs", "VIRTIOFS", "", "shares it over virtio-fs instead of virtio-9p"},
+	{"test-finisher", "TEST_FINISHER", "", "QEMU's test device to exit with a code"},
+	{"pvpanic", "PVPANIC", "", "a pvpanic device"},
+	{"crash-dump", "CRASH_DUMP", "", "dumps the guest memory into dump.img on a crash"},
+	{"trace-guest", "TRACE_GUEST", "", "traces the VM exits and the guest's events"},
+	{"clock-scale", "CLOCK_SCALE", "<factor>", "the speed of the guest's time"},
+	{"device", "DEVICE", "<device>,disable-feature=<feature>", "hides virtio features"},
+	{"prealloc", "PREALLOC", "", "maps the whole guest RAM on boot"},
+	{"boot-time", "BOOT_TIME", "", "prints the boot time breakdown at shutdown"},
+	{"nested", "NESTED", "", "exposes the H extension to the guest"},
+	{"reserved-mem", "RESERVED_MEM", "<name>,size=<size>[,...]", "reserved memory"},
+	{"virtio-mem", "VIRTIO_MEM", "<size>", "memory to plug with mem-resize"},
+	{"async-console", "ASYNC_CONSOLE", "<size>[,<policy>]", "buffers the console output"},
+	{"maxcpus", "MAXCPUS", "<n>", "vCPUs up to n for cpu-add"},
+	{"fault-inject", "FAULT_INJECT", "<faults>", "e.g. blk-error=0.01,net-drop=0.05"},
+	{"seed", "SEED", "<n>", "makes randomness and start times reproducible"},
+	{"cpu", "CPU", "<isa>", "hides ISA extensions, e.g. rv64gc,-f,-d"},
+	{"memcheck", "MEMCHECK", "", "reports bad accesses by the device models"},
+	{"log", "LOG", "<levels>", "e.g. warn,virtio=debug"},
+	{"log-json", "LOG_JSON", "", "writes the logs to log.jsonl"},
+	{"serial", "SERIAL", "<sinks>", "e.g. raw,port:serial"},
+}
+
+// virtioDevices are the names of -device (see src/virtio_features.rs).
+var virtioDevices = []string{"net", "blk", "console", "rng", "balloon", "9p", "input", "vsock", "mem", "fs"}
+
+func lookupOption(name string) *runOption {
+	for i := range runOptions {
+		if runOptions[i].name == name {
+			return &runOptions[i]
+		}
+	}
+	return nil
+}
+
+func printOptions() {
+	fmt.Fprintf(os.Stderr, "options (see run.sh):\n")
+	for _, option := range runOptions {
+		fmt.Fprintf(os.Stderr, "  -%-38s %s\n", strings.TrimSpace(option.name+" "+option.value), option.help)
+	}
+}
+
+// parseOptions parses -<name> [<value>] pairs into options.
+func parseOptions(args []string, options map[string]string) error {
+	for len(args) > 0 {
+		name := strings.TrimLeft(args[0], "-")
+		value, hasValue := "", false
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value, hasValue = name[:i], name[i+1:], true
+		}
+
+		option := lookupOption(name)
+		if !strings.HasPrefix(args[0], "-") || option == nil {
+			return fmt.Errorf("unknown option %s (hv run -h lists them)", args[0])
+		}
+		args = args[1:]
+
+		switch {
+		case option.value == "" && hasValue:
+			return fmt.Errorf("-%s takes no value", name)
+		case option.value == "":
+			value = "1"
+		case !hasValue && len(args) == 0:
+			return fmt.Errorf("-%s: expected %s", name, option.value)
+		case !hasValue:
+			value, args = args[0], args[1:]
+		}
+
+		if name == "device" {
+			device, _, _ := strings.Cut(value, ",")
+			if !contains(virtioDevices, device) {
+				return fmt.Errorf("-device: unknown device %q (valid devices: %s)", device, strings.Join(virtioDevices, ", "))
+			}
+		}
+		options[name] = value
+	}
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, other := range names {
+		if other == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findRoot returns the directory of run.sh: the current one or a parent.
+func findRoot() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "run.sh")); err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			fatalf("run.sh not found in the current directory or its parents")
+		}
+		dir = parent
+	}
+}
+
+func loadProfiles(root string) map[string]profile {
+	profiles := map[string]profile{}
+	for name, p := range builtinProfiles {
+		profiles[name] = p
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, profilesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return profiles
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	var saved map[string]profile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		fatalf("%s: %v", profilesFile, err)
+	}
+	for name, p := range saved {
+		for option := range p.Options {
+			if lookupOption(option) == nil {
+				fatalf("%s: %s: unknown option -%s", profilesFile, name, option)
+			}
+		}
+		profiles[name] = p
+	}
+	return profiles
+}
+
+func profileNames(profiles map[string]profile) string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// run boots a profile with run.sh, which replaces hv.
+func run(args []string) {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" {
+		root := findRoot()
+		fmt.Fprintf(os.Stderr, "usage: hv run <profile> [-<option> [<value>]...]\n")
+		fmt.Fprintf(os.Stderr, "profiles: %s\n", profileNames(loadProfiles(root)))
+		printOptions()
+		os.Exit(2)
+	}
+
+	root := findRoot()
+	profiles := loadProfiles(root)
+	p, ok := profiles[args[0]]
+	if !ok {
+		fatalf("run: unknown profile %q (available: %s; hv create makes one)", args[0], profileNames(profiles))
+	}
+
+	options := map[string]string{}
+	for name, value := range p.Options {
+		options[name] = value
+	}
+	if err := parseOptions(args[1:], options); err != nil {
+		fatalf("run: %v", err)
+	}
+
+	env := os.Environ()
+	for name, value := range options {
+		env = append(env, lookupOption(name).env+"="+value)
+	}
+
+	if err := os.Chdir(root); err != nil {
+		fatalf("%v", err)
+	}
+	err := syscall.Exec("/bin/sh", []string{"sh", "./run.sh"}, env)
+	fatalf("run: %v", err)
+}
+
+// create saves a profile into hv.json, replacing the one with the same name.
+func create(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	description := flags.String("description", "", "what the profile is for")
+	base := flags.String("from", "", "a profile to start from")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: hv create [-from <profile>] [-description <text>] <name> [-<option> [<value>]...]\n")
+		flags.PrintDefaults()
+		printOptions()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	root := findRoot()
+	name := flags.Arg(0)
+	p := profile{Description: *description, Options: map[string]string{}}
+	if *base != "" {
+		profiles := loadProfiles(root)
+		from, ok := profiles[*base]
+		if !ok {
+			fatalf("create: unknown profile %q (available: %s)", *base, profileNames(profiles))
+		}
+		for option, value := range from.Options {
+			p.Options[option] = value
+		}
+	}
+	if err := parseOptions(flags.Args()[1:], p.Options); err != nil {
+		fatalf("create: %v", err)
+	}
+
+	path := filepath.Join(root, profilesFile)
+	saved := map[string]profile{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			fatalf("%s: %v", profilesFile, err)
+		}
+	}
+	saved[name] = p
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Printf("saved %s in %s: hv run %s\n", name, path, name)
+}
+
+// attach runs the monitor's human-readable commands (e.g. `info status`)
+// on monitor.sock of a running VM, line by line.
+func attach(args []string) {
+	flags := flag.NewFlagSet("attach", flag.ExitOnError)
+	socket := flags.String("sock", "", "the monitor's socket (default: monitor.sock next to run.sh)")
+	flags.Parse(args)
+	if *socket == "" {
+		*socket = filepath.Join(findRoot(), "monitor.sock")
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		fatalf("attach: %v (is the VM running?)", err)
+	}
+	defer conn.Close()
+
+	replies := json.NewDecoder(bufio.NewReader(conn))
+	// The greeting.
+	var greeting map[string]any
+	if err := replies.Decode(&greeting); err != nil {
+		fatalf("attach: no greeting from the monitor: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "attached to %s (help lists the commands, Ctrl-D detaches)\n", *socket)
+	input := bufio.NewScanner(os.Stdin)
+	for fmt.Print("(hv) "); input.Scan(); fmt.Print("(hv) ") {
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			continue
+		}
+
+		cmd := map[string]any{"execute": "human-monitor-command", "arguments": map[string]string{"command-line": line}}
+		if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+			fatalf("attach: %v", err)
+		}
+
+		for {
+			var reply struct {
+				Return *string                `json:"return"`
+				Error  *struct{ Desc string } `json:"error"`
+				Event  string                 `json:"event"`
+			}
+			if err := replies.Decode(&reply); err != nil {
+				fatalf("attach: disconnected: %v", err)
+			}
+
+			if reply.Event != "" {
+				fmt.Fprintf(os.Stderr, "event: %s\n", reply.Event)
+				continue
+			}
+			if reply.Error != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", reply.Error.Desc)
+			} else if reply.Return != nil && *reply.Return != "" {
+				fmt.Println(strings.TrimRight(*reply.Return, "\n"))
+			}
+			break
+		}
+	}
+	fmt.Println()
+}
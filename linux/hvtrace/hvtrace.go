@@ -0,0 +1,105 @@
+// Package hvtrace writes events into the hypervisor's trace buffer
+// (-trace-guest), which merges them with the VM exits into one timeline:
+//
+//	trace, err := hvtrace.Open()
+//	if err == nil {
+//		trace.Printf("request %d: start", id)
+//	}
+//
+// See src/guest_trace.rs for the layout of the buffer. Writing an event
+// doesn't exit to the hypervisor: it reads the buffer on the next VM exit.
+package hvtrace
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	magic      = 0x52545648 // "HVTR"
+	version    = 1
+	headerSize = 64
+	entrySize  = 64
+	headOffset = 16
+	textOffset = 24
+	// The hv-trace region in /reserved-memory, mapped through /dev/mem.
+	regPattern = "/proc/device-tree/reserved-memory/hv-trace@*/reg"
+)
+
+// Buffer is the mapped trace buffer. It is safe for concurrent use.
+type Buffer struct {
+	mem     []byte
+	entries uint64
+}
+
+// Open maps the trace buffer. It fails unless the hypervisor runs with
+// -trace-guest.
+func Open() (*Buffer, error) {
+	paths, _ := filepath.Glob(regPattern)
+	if len(paths) == 0 {
+		return nil, errors.New("hvtrace: no trace buffer (-trace-guest)")
+	}
+
+	reg, err := os.ReadFile(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(reg) != 16 {
+		return nil, fmt.Errorf("hvtrace: unexpected reg: %x", reg)
+	}
+	base := binary.BigEndian.Uint64(reg[0:8])
+	size := binary.BigEndian.Uint64(reg[8:16])
+
+	f, err := os.OpenFile("/dev/mem", os.O_RDWR|os.O_SYNC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mem, err := syscall.Mmap(int(f.Fd()), int64(base), int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("hvtrace: mmap: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(mem[0:4]) != magic || binary.LittleEndian.Uint32(mem[4:8]) != version {
+		syscall.Munmap(mem)
+		return nil, errors.New("hvtrace: unknown trace buffer")
+	}
+
+	return &Buffer{mem: mem, entries: uint64(binary.LittleEndian.Uint32(mem[8:12]))}, nil
+}
+
+func (b *Buffer) word(offset uint64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&b.mem[offset]))
+}
+
+// Write records an event. The text is truncated to 40 bytes.
+func (b *Buffer) Write(text string) {
+	time := rdtime()
+	seq := atomic.AddUint64(b.word(headOffset), 1) - 1
+	entry := headerSize + seq%b.entries*entrySize
+
+	// Uncommit the entry while it's being overwritten.
+	atomic.StoreUint64(b.word(entry), 0)
+	binary.LittleEndian.PutUint64(b.mem[entry+8:], time)
+	binary.LittleEndian.PutUint32(b.mem[entry+16:], uint32(syscall.Gettid()))
+	n := copy(b.mem[entry+textOffset:entry+entrySize], text)
+	binary.LittleEndian.PutUint32(b.mem[entry+20:], uint32(n))
+	atomic.StoreUint64(b.word(entry), seq+1)
+}
+
+// Printf records an event formatted as fmt.Sprintf does.
+func (b *Buffer) Printf(format string, args ...any) {
+	b.Write(fmt.Sprintf(format, args...))
+}
+
+// Close unmaps the buffer.
+func (b *Buffer) Close() error {
+	return syscall.Munmap(b.mem)
+}
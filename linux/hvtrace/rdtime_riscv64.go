@@ -0,0 +1,5 @@
+package hvtrace
+
+// rdtime reads the time CSR, as the hypervisor converts it into its time
+// (rdtime_riscv64.s).
+func rdtime() uint64
@@ -0,0 +1,7 @@
+#include "textflag.h"
+
+// func rdtime() uint64
+TEXT ·rdtime(SB), NOSPLIT, $0-8
+	RDTIME	A0
+	MOV	A0, ret+0(FP)
+	RET
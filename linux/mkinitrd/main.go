@@ -0,0 +1,100 @@
+// mkinitrd packs a statically-linked program into a cpio initramfs (the
+// "newc" format Linux expects) without external cpio/busybox tooling:
+//
+//	go run mkinitrd/main.go -o initrd.cpio rootfs/bin/catsay
+//
+// The program is placed at /bin/<name> and /init is a symlink to it, so the
+// kernel runs it as the first process. build.sh builds it into the kernel
+// image (CONFIG_INITRAMFS_SOURCE) with EMBED_INITRD=1.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	modeDir     = 0o040000
+	modeFile    = 0o100000
+	modeSymlink = 0o120000
+	modeCharDev = 0o020000
+)
+
+type writer struct {
+	buf bytes.Buffer
+	ino uint32
+}
+
+func (w *writer) pad() {
+	for w.buf.Len()%4 != 0 {
+		w.buf.WriteByte(0)
+	}
+}
+
+// entry appends a file with a "newc" header.
+func (w *writer) entry(name string, mode uint32, data []byte, rdevMajor, rdevMinor uint32) {
+	w.ino++
+	nlink := uint32(1)
+	if mode&0o170000 == modeDir {
+		nlink = 2
+	}
+
+	fmt.Fprintf(&w.buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		w.ino, mode, 0, 0, nlink, 0, len(data), 0, 0, rdevMajor, rdevMinor, len(name)+1, 0)
+	w.buf.WriteString(name)
+	w.buf.WriteByte(0)
+	w.pad()
+	w.buf.Write(data)
+	w.pad()
+}
+
+func main() {
+	output := flag.String("o", "initrd.cpio", "output file")
+	name := flag.String("name", "", "program name in /bin (default: the file name)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: mkinitrd [-o initrd.cpio] [-name name] <static binary>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	program, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkinitrd: %v\n", err)
+		os.Exit(1)
+	}
+
+	// A dynamically-linked program would fail with a confusing ENOENT.
+	if bytes.Contains(program, []byte("/lib/ld-linux")) {
+		fmt.Fprintf(os.Stderr, "mkinitrd: %s seems to be dynamically linked\n", flag.Arg(0))
+		os.Exit(1)
+	}
+
+	if *name == "" {
+		*name = filepath.Base(flag.Arg(0))
+	}
+
+	var w writer
+	for _, dir := range []string{"bin", "dev", "proc", "sys", "tmp"} {
+		w.entry(dir, modeDir|0o755, nil, 0, 0)
+	}
+	// The kernel opens /dev/console for the init's stdio before devtmpfs
+	// is mounted.
+	w.entry("dev/console", modeCharDev|0o600, nil, 5, 1)
+	w.entry("bin/"+*name, modeFile|0o755, program, 0, 0)
+	w.entry("init", modeSymlink|0o777, []byte("bin/"+*name), 0, 0)
+	w.entry("TRAILER!!!", 0, nil, 0, 0)
+
+	if err := os.WriteFile(*output, w.buf.Bytes(), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "mkinitrd: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("mkinitrd: wrote %s (%d KB): /init -> /bin/%s\n", *output, w.buf.Len()/1024, *name)
+}
@@ -8,19 +8,404 @@ $(brew --prefix llvm)/bin/clang \
 
 $(brew --prefix llvm)/bin/llvm-objcopy -O binary guest.elf guest.bin
 
-RUSTFLAGS="-C link-arg=-Thypervisor.ld -C linker=rust-lld" \
+# MEMCHECK=1 needs frame pointers for the backtraces.
+RUSTFLAGS="-C link-arg=-Thypervisor.ld -C linker=rust-lld${MEMCHECK:+ -C force-frame-pointers=yes}" \
   cargo build --bin hypervisor --target riscv64gc-unknown-none-elf
 
 cp target/riscv64gc-unknown-none-elf/debug/hypervisor hypervisor.elf
 
+[ -f disk.img ] || dd if=/dev/zero of=disk.img bs=1M count=64
+[ -f snapshot.img ] || dd if=/dev/zero of=snapshot.img bs=1M count=264
+[ -f dump.img ] || dd if=/dev/zero of=dump.img bs=1M count=257
+SHARE_DIR=${SHARE_DIR:-./share}
+mkdir -p "$SHARE_DIR"
+
+# Optionally boot another kernel and/or an initrd, e.g.
+# KERNEL=linux/Image INITRD=linux/initrd.cpio APPEND="console=hvc rdinit=/init" ./run.sh
+# or with a profile of these variables (see linux/hv/profile.go), e.g.
+# (cd linux && go run ./hv run linux-demo -seed 42)
+# KERNEL may be a flat Image, with or without the EFI stub, gzip-compressed
+# (Image.gz), or an EFI zboot image (vmlinuz.efi with CONFIG_EFI_ZBOOT and gzip).
+# It may also be a bare-metal ELF executable running in S-mode on SBI.
+FW_CFG_ARGS=""
+GUEST_ARGS=""
+if [ -n "$KERNEL" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/kernel,file=$KERNEL"
+    GUEST_ARGS="$GUEST_ARGS -kernel opt/hypervisor/kernel"
+fi
+if [ -n "$INITRD" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/initrd,file=$INITRD"
+    GUEST_ARGS="$GUEST_ARGS -initrd opt/hypervisor/initrd"
+fi
+# FIRMWARE boots an S-mode firmware (up to 2MB, e.g. u-boot.bin of U-Boot's
+# qemu-riscv64_smode_defconfig) first, with the kernel at 0x80200000.
+if [ -n "$FIRMWARE" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/firmware,file=$FIRMWARE"
+    GUEST_ARGS="$GUEST_ARGS -firmware opt/hypervisor/firmware"
+fi
+# MACHINE=machine.json changes the guest's memory map (see src/machine.rs).
+if [ -n "$MACHINE" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/machine,file=$MACHINE"
+    GUEST_ARGS="$GUEST_ARGS -machine opt/hypervisor/machine"
+fi
+# SYMBOLS=linux/System.map (or linux/vmlinux) shows the guest kernel's
+# symbols in error messages, e.g. guest PC 0xffffffff800134aa <do_page_fault+0x3e>.
+if [ -n "$SYMBOLS" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/symbols,file=$SYMBOLS"
+    GUEST_ARGS="$GUEST_ARGS -symbols opt/hypervisor/symbols"
+fi
+# DTB_OVERLAY=extra.dtbo merges a device tree overlay into the guest's (see
+# src/dt_overlay.rs), e.g. from `dtc -@ -I dts -O dtb -o extra.dtbo extra.dts`.
+if [ -n "$DTB_OVERLAY" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/dtb-overlay,file=$DTB_OVERLAY"
+    GUEST_ARGS="$GUEST_ARGS -dtb-overlay opt/hypervisor/dtb-overlay"
+fi
+# SNAPSHOT_KEY_FILE=snapshot.key, or SNAPSHOT_KEY (e.g. from a KMS), encrypts
+# snapshots and memory dumps with a key of 64 hex digits, e.g. from
+# `openssl rand -hex 32`. (cd linux && go run ./hv decrypt-dump ...)
+# decrypts dumps.
+if [ -n "$SNAPSHOT_KEY_FILE" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/snapshot-key,file=$SNAPSHOT_KEY_FILE"
+    GUEST_ARGS="$GUEST_ARGS -snapshot-key opt/hypervisor/snapshot-key"
+elif [ -n "$SNAPSHOT_KEY" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/snapshot-key,string=$SNAPSHOT_KEY"
+    GUEST_ARGS="$GUEST_ARGS -snapshot-key opt/hypervisor/snapshot-key"
+fi
+# MEASURE=1 measures the firmware, the kernel, the initrd, and the device
+# tree into an event log (`info measurements` in the monitor). VERIFY=pubkey.pem
+# also refuses to boot them unless KERNEL.sig, INITRD.sig, and FIRMWARE.sig,
+# e.g. from `openssl dgst -sha256 -sign key.pem -out linux/Image.sig linux/Image`,
+# are valid signatures.
+if [ -n "$VERIFY" ]; then
+    FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/verify-key,file=$VERIFY"
+    GUEST_ARGS="$GUEST_ARGS -verify opt/hypervisor/verify-key"
+    for image in kernel:$KERNEL initrd:$INITRD firmware:$FIRMWARE; do
+        file=${image#*:}
+        if [ -n "$file" ]; then
+            FW_CFG_ARGS="$FW_CFG_ARGS -fw_cfg name=opt/hypervisor/${image%%:*}.sig,file=$file.sig"
+        fi
+    done
+elif [ -n "$MEASURE" ]; then
+    GUEST_ARGS="$GUEST_ARGS -measure"
+fi
+
+# Optionally keep disk.img untouched and write to a copy-on-write overlay
+# instead, e.g. OVERLAY=guest1.img ./run.sh
+DISK_ARGS="-drive file=disk.img,format=raw,if=none,id=disk0"
+DISK_BACKEND=host
+if [ -n "$OVERLAY" ]; then
+    # A sparse file: 1MB larger than disk.img for the header and the bitmap.
+    [ -f "$OVERLAY" ] || dd if=/dev/zero of="$OVERLAY" bs=1M count=0 seek=$(( $(wc -c < disk.img) / 1048576 + 1 ))
+    DISK_ARGS="$DISK_ARGS,readonly=on -drive file=$OVERLAY,format=raw,if=none,id=overlay0"
+    DISK_ARGS="$DISK_ARGS -device virtio-blk-device,drive=overlay0,serial=overlay"
+    DISK_BACKEND=cow
+fi
+
+# QUEUES=2 gives virtio-net and virtio-blk a queue (pair) per vCPU, so that
+# the vCPUs don't contend for one. The host's NIC and disk are still one each.
+NET_ARGS="host"
+if [ -n "$QUEUES" ]; then
+    NET_ARGS="$NET_ARGS,queues=$QUEUES"
+    DISK_BACKEND="$DISK_BACKEND,queues=$QUEUES"
+fi
+
+# DISK_THROTTLE=iops=100,bps=1048576 and NET_THROTTLE=pps=1000,bps=125000
+# simulate a slow disk and a slow link. `throttle blk iops=50` in the
+# monitor changes them at runtime.
+if [ -n "$DISK_THROTTLE" ]; then
+    DISK_BACKEND="$DISK_BACKEND,$DISK_THROTTLE"
+fi
+if [ -n "$NET_THROTTLE" ]; then
+    NET_ARGS="$NET_ARGS,$NET_THROTTLE"
+fi
+
+# The guest's frames go to QEMU's user-mode network (SLIRP): NAT, DHCP and
+# DNS without root or TAP devices. HOSTFWD=tcp::2222-:22 forwards host ports
+# to the guest (comma-separated), e.g. `ssh -p 2222 root@127.0.0.1`.
+NETDEV_ARGS="user,id=net0"
+if [ -n "$HOSTFWD" ]; then
+    for rule in $(echo "$HOSTFWD" | tr ',' ' '); do
+        NETDEV_ARGS="$NETDEV_ARGS,hostfwd=$rule"
+    done
+fi
+
+# PCAP=out.pcap captures the frames of virtio-net (both directions) to a
+# file, e.g. for Wireshark. Dropped received packets are not in it.
+PCAP_ARGS=""
+if [ -n "$PCAP" ]; then
+    PCAP_ARGS="-chardev file,id=pcap0,path=$PCAP -device virtserialport,chardev=pcap0,name=pcap"
+    NET_ARGS="$NET_ARGS,pcap=pcap"
+fi
+
+# Prometheus metrics are served on metrics.sock. To scrape them over TCP:
+# socat TCP-LISTEN:9090,fork,reuseaddr UNIX-CONNECT:metrics.sock
+
+# PPROF=1 serves a profile of the VM exits by vCPU and device on pprof.sock:
+# socat TCP-LISTEN:6060,fork,reuseaddr UNIX-CONNECT:pprof.sock
+# go tool pprof -http=: http://localhost:6060/debug/pprof/profile
+PPROF_ARGS=""
+if [ -n "$PPROF" ]; then
+    PPROF_ARGS="-chardev socket,id=pprof0,path=pprof.sock,server=on,wait=off -device virtserialport,chardev=pprof0,name=pprof"
+    GUEST_ARGS="$GUEST_ARGS -pprof"
+fi
+
+# vsock port 1234 is bridged to vsock.sock: the guest connects to CID 2 port
+# 1234, or `socat - UNIX-CONNECT:vsock.sock` connects to port 1234 in the guest.
+# The guest agent (linux/agent, init=/bin/agent) listens on it, e.g.
+# (cd linux && go run ./hv -sock ../vsock.sock exec uname -a)
+
+# The watchdog runs once the guest opens /dev/watchdog (e.g. busybox
+# watchdog). If the guest stops petting it, WATCHDOG_ACTION is taken:
+# reset (default), poweroff, pause, or none.
+WATCHDOG_ACTION=${WATCHDOG_ACTION:-reset}
+
+# The guest's RTC (-rtc) follows QEMU's, i.e. the host's time. After loadvm or
+# a migration, (cd linux && go run ./hv -sock ../vsock.sock sync-time)
+# corrects the guest's clock.
+
+# The guest's framebuffer is shown on ramfb: connect a VNC client to :5900.
+# QEMU's virt machine has only 8 virtio-mmio slots, so INPUT=1 replaces the
+# virtio-rng and virtio-balloon devices with a keyboard and a tablet for it.
+DEVICE_ARGS="-device virtio-rng-device -device virtio-balloon-device,free-page-reporting=on"
+DEVICE_FLAGS="-rng host -balloon"
+if [ -n "$INPUT" ]; then
+    DEVICE_ARGS="-device virtio-keyboard-device -device virtio-tablet-device"
+    DEVICE_FLAGS="-input"
+fi
+
+# PCI=1 shows the guest's virtio devices as virtio-pci ones on a PCI host
+# bridge (lspci in the guest) instead of virtio-mmio.
+if [ -n "$PCI" ]; then
+    GUEST_ARGS="$GUEST_ARGS -pci"
+fi
+
+# Optionally provide a disk for device_add in the monitor, e.g.
+# HOTPLUG=extra.img ./run.sh, then {"execute": "device_add", "arguments":
+# {"driver": "virtio-blk-device", "id": "hotplug0"}}
+if [ -n "$HOTPLUG" ]; then
+    DISK_ARGS="$DISK_ARGS -drive file=$HOTPLUG,format=raw,if=none,id=hotplug0"
+    DISK_ARGS="$DISK_ARGS -device virtio-blk-device,drive=hotplug0,serial=hotplug0"
+    GUEST_ARGS="$GUEST_ARGS -hotplug-slots 1"
+fi
+
+# Live migration: start the destination with INCOMING=1 in another directory,
+# connect migration.sock of both sides over TCP, and send the VM with
+# {"execute": "migrate"} in the source's monitor:
+#   (destination) socat TCP-LISTEN:4444,reuseaddr UNIX-CONNECT:migration.sock
+#   (source)      socat UNIX-CONNECT:migration.sock TCP:<destination>:4444
+if [ -n "$INCOMING" ]; then
+    GUEST_ARGS="$GUEST_ARGS -incoming"
+fi
+
+# MEM_FILE=ram.img backs QEMU's RAM with a file, where the guest RAM is at the
+# offset in the log (e.g. for inspecting it while the guest runs). savevm in
+# GDB then saves the state only and shuts down the VM, and LOADVM=1 restores
+# the snapshot at boot, instantly with the same MEM_FILE.
+MEM_ARGS=""
+if [ -n "$MEM_FILE" ]; then
+    MEM_ARGS="-object memory-backend-file,id=ram0,size=512M,mem-path=$MEM_FILE,share=on -machine memory-backend=ram0"
+    GUEST_ARGS="$GUEST_ARGS -mem-file"
+fi
+if [ -n "$LOADVM" ]; then
+    GUEST_ARGS="$GUEST_ARGS -loadvm"
+fi
+
+# VIRTIOFS=1 shares SHARE_DIR over virtio-fs instead of virtio-9p, served by
+# virtiofsd (in PATH): mount -t virtiofs share /mnt in the guest. virtiofsd
+# accesses QEMU's RAM directly, so it must be shared (memfd unless MEM_FILE).
+SHARE_ARGS="-fsdev local,id=share0,path=$SHARE_DIR,security_model=none -device virtio-9p-device,fsdev=share0,mount_tag=share"
+SHARE_FLAGS="-share share"
+if [ -n "$VIRTIOFS" ]; then
+    rm -f virtiofs.sock
+    virtiofsd --socket-path=virtiofs.sock --shared-dir "$SHARE_DIR" --cache auto &
+    while [ ! -S virtiofs.sock ]; do sleep 0.1; done
+    SHARE_ARGS="-chardev socket,id=fs0,path=virtiofs.sock -device vhost-user-fs-device,chardev=fs0,tag=share"
+    SHARE_FLAGS="-fs share"
+    if [ -z "$MEM_ARGS" ]; then
+        MEM_ARGS="-object memory-backend-memfd,id=ram0,size=512M,share=on -machine memory-backend=ram0"
+    fi
+fi
+
+# The last 64KB of the guest console is kept for `info console` (or
+# {"execute": "query-console"}) in the monitor and for crash reports, even with
+# nothing attached to the console. -console-buffer <size> changes it.
+
+# QEMU (and this script) exits with the guest's status: 0 on poweroff, init's
+# exit code if it exits, or 1 on a crash. TEST_FINISHER=1 gives the guest
+# QEMU's test device (sifive,test1) to exit with a code of its own, e.g. for
+# bare-metal tests.
+if [ -n "$TEST_FINISHER" ]; then
+    GUEST_ARGS="$GUEST_ARGS -test-finisher"
+fi
+
+# PVPANIC=1 gives the guest a pvpanic device: Linux reports a panic through
+# it right away, instead of us waiting for the panic message. CRASH_DUMP=1
+# dumps the guest memory into dump.img on a crash.
+if [ -n "$PVPANIC" ]; then
+    GUEST_ARGS="$GUEST_ARGS -pvpanic"
+fi
+if [ -n "$CRASH_DUMP" ]; then
+    GUEST_ARGS="$GUEST_ARGS -crash-dump"
+fi
+
+# TRACE_GUEST=1 traces the VM exits into trace.jsonl, together with the events
+# the guest writes into its 64KB trace buffer (linux/hvtrace, e.g. catsay).
+if [ -n "$TRACE_GUEST" ]; then
+    GUEST_ARGS="$GUEST_ARGS -trace-guest 64k"
+fi
+
+# NAME=vm1 gives the guest an identity of its own, derived from the name: a
+# UUID and a serial number in the device tree, and the MAC address of
+# virtio-net (see src/identity.rs). Use distinct names for guests on one host.
+if [ -n "$NAME" ]; then
+    GUEST_ARGS="$GUEST_ARGS -name $NAME"
+fi
+
+# CLOCK_SCALE=0.1 runs the guest's time at a tenth of the host's (or faster,
+# e.g. 2), and `clock_scale <factor>` in the monitor changes it on the fly.
+if [ -n "$CLOCK_SCALE" ]; then
+    GUEST_ARGS="$GUEST_ARGS -clock-scale $CLOCK_SCALE"
+fi
+
+# DEVICE=blk,disable-feature=indirect hides virtio features from the guest's
+# drivers, e.g. to test them without indirect descriptors (see
+# src/virtio_features.rs for the names).
+if [ -n "$DEVICE" ]; then
+    GUEST_ARGS="$GUEST_ARGS -device $DEVICE"
+fi
+
+# PREALLOC=1 maps the whole guest RAM on boot instead of on the first access
+# to each page: slower to start, but no faults later.
+if [ -n "$PREALLOC" ]; then
+    GUEST_ARGS="$GUEST_ARGS -prealloc"
+fi
+
+# BOOT_TIME=1 prints how long each phase of the boot took at shutdown (also
+# `info boottime` in the monitor).
+if [ -n "$BOOT_TIME" ]; then
+    GUEST_ARGS="$GUEST_ARGS -boot-time"
+fi
+
+# NESTED=1 exposes the H extension to the guest, to run a hypervisor (e.g.
+# this one) inside.
+if [ -n "$NESTED" ]; then
+    GUEST_ARGS="$GUEST_ARGS -nested"
+fi
+
+# RESERVED_MEM=cma,size=16m,align=4m,compatible=shared-dma-pool,reusable,default
+# carves a region out of the guest RAM for CMA, a DMA pool, or a firmware
+# (see src/reserved_mem.rs).
+if [ -n "$RESERVED_MEM" ]; then
+    GUEST_ARGS="$GUEST_ARGS -reserved-mem $RESERVED_MEM"
+fi
+
+# VIRTIO_MEM=128m gives the guest memory to plug with `mem-resize 128m` in the
+# monitor (see src/virtio_mem.rs). It must fit in QEMU's -m along with the
+# 256MB of RAM.
+if [ -n "$VIRTIO_MEM" ]; then
+    GUEST_ARGS="$GUEST_ARGS -virtio-mem $VIRTIO_MEM"
+fi
+
+# ASYNC_CONSOLE=64k,drop-oldest buffers the console output so that the guest
+# doesn't wait when stdout is piped to a slow consumer (see src/host_uart.rs).
+if [ -n "$ASYNC_CONSOLE" ]; then
+    GUEST_ARGS="$GUEST_ARGS -async-console $ASYNC_CONSOLE"
+fi
+
+# MAXCPUS=4 leaves vCPUs 2-3 to `cpu-add` in the monitor: QEMU needs a hart for
+# each of them.
+HOST_SMP=2
+GUEST_SMP=2
+if [ -n "$MAXCPUS" ]; then
+    HOST_SMP=$MAXCPUS
+    GUEST_SMP="2,maxcpus=$MAXCPUS"
+fi
+
+# FAULT_INJECT=blk-error=0.01,net-drop=0.05 makes devices fail now and then,
+# to test the guest drivers' error paths (see src/fault_inject.rs).
+if [ -n "$FAULT_INJECT" ]; then
+    GUEST_ARGS="$GUEST_ARGS -fault-inject $FAULT_INJECT"
+fi
+
+# SEED=42 makes virtio-rng and the guest's start times (the time CSR and
+# the RTC) reproducible, to rerun a flaky test the same way.
+if [ -n "$SEED" ]; then
+    GUEST_ARGS="$GUEST_ARGS -deterministic $SEED"
+fi
+
+# CPU=rv64gc,-f,-d hides ISA extensions from the guest (see src/isa.rs), to
+# test a guest kernel against other CPUs.
+if [ -n "$CPU" ]; then
+    GUEST_ARGS="$GUEST_ARGS -cpu $CPU"
+fi
+
+# MEMCHECK=1 reports bad accesses to the guest memory by the device models,
+# with backtraces: resolve them with llvm-addr2line -e hypervisor.elf.
+if [ -n "$MEMCHECK" ]; then
+    GUEST_ARGS="$GUEST_ARGS -memcheck"
+fi
+
+# Hypervisor logs: LOG sets the levels, e.g. LOG=warn,virtio=debug,vcpu=trace,
+# and LOG_JSON=1 writes them to log.jsonl instead of the console.
+LOG=${LOG:-info}
+if [ -n "$LOG_JSON" ]; then
+    GUEST_ARGS="$GUEST_ARGS -log-json"
+fi
+
+# -append must be the last one.
+if [ -n "$APPEND" ]; then
+    GUEST_ARGS="$GUEST_ARGS -append $APPEND"
+fi
+
+# Ctrl-A is the hypervisor's escape key (Ctrl-A x to quit, Ctrl-A c for the
+# monitor prompt), so QEMU's is Ctrl-T (-echr). SERIAL=raw,port:serial makes
+# the console interactive.
+SERIAL=${SERIAL:-stdio,port:serial}
+
 qemu-system-riscv64 \
     -machine virt \
     -cpu rv64,h=true \
     -bios default \
-    -smp 1 \
-    -m 128M \
+    -smp $HOST_SMP \
+    -m 512M \
+    $MEM_ARGS \
     -nographic \
     -d cpu_reset,unimp,guest_errors,int -D qemu.log \
     -serial mon:stdio \
+    -echr 0x14 \
     --no-reboot \
-    -kernel hypervisor.elf
+    -global virtio-mmio.force-legacy=false \
+    -netdev $NETDEV_ARGS \
+    -device virtio-net-device,netdev=net0 \
+    $DISK_ARGS \
+    -device virtio-blk-device,drive=disk0,serial=disk \
+    -drive file=snapshot.img,format=raw,if=none,id=snapshot0 \
+    -device virtio-blk-device,drive=snapshot0,serial=snapshot \
+    -drive file=dump.img,format=raw,if=none,id=dump0 \
+    -device virtio-blk-device,drive=dump0,serial=dump \
+    -device virtio-serial-device \
+    -chardev socket,id=gdb0,host=127.0.0.1,port=1234,server=on,wait=off \
+    -device virtserialport,chardev=gdb0,name=gdb \
+    -chardev socket,id=monitor0,path=monitor.sock,server=on,wait=off \
+    -device virtserialport,chardev=monitor0,name=monitor \
+    -chardev pty,id=serial0 \
+    -device virtserialport,chardev=serial0,name=serial \
+    -chardev file,id=trace0,path=trace.jsonl \
+    -device virtserialport,chardev=trace0,name=trace \
+    -chardev socket,id=metrics0,path=metrics.sock,server=on,wait=off \
+    -device virtserialport,chardev=metrics0,name=metrics \
+    -chardev socket,id=vsock0,path=vsock.sock,server=on,wait=off \
+    -device virtserialport,chardev=vsock0,name=vsock \
+    -chardev socket,id=migration0,path=migration.sock,server=on,wait=off \
+    -device virtserialport,chardev=migration0,name=migration \
+    -chardev file,id=log0,path=log.jsonl \
+    -device virtserialport,chardev=log0,name=log \
+    $PCAP_ARGS \
+    $PPROF_ARGS \
+    $SHARE_ARGS \
+    $DEVICE_ARGS \
+    -device ramfb \
+    -vnc 127.0.0.1:0 \
+    $FW_CFG_ARGS \
+    -kernel hypervisor.elf \
+    -append "-smp $GUEST_SMP -mem 256m -hugepages -net $NET_ARGS -disk $DISK_BACKEND -console console,log,agent $SHARE_FLAGS $DEVICE_FLAGS -serial $SERIAL -vsock 3,1234:vsock -watchdog -watchdog-action $WATCHDOG_ACTION -rtc -fb 800x600 -gdb -monitor -metrics -log $LOG$GUEST_ARGS"
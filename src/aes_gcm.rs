@@ -0,0 +1,197 @@
+//! AES-256-GCM (NIST SP 800-38D) with 96-bit nonces and 128-bit tags, in
+//! software: table-based AES, and GHASH with 4-bit tables.
+const NUM_ROUNDS: usize = 14;
+pub const KEY_LEN: usize = 32;
+pub const NONCE_LEN: usize = 12;
+pub const TAG_LEN: usize = 16;
+const BLOCK_LEN: usize = 16;
+
+const SBOX: [u8; 256] = [
+    0x63, 0x7c, 0x77, 0x7b, 0xf2, 0x6b, 0x6f, 0xc5, 0x30, 0x01, 0x67, 0x2b, 0xfe, 0xd7, 0xab, 0x76, //
+    0xca, 0x82, 0xc9, 0x7d, 0xfa, 0x59, 0x47, 0xf0, 0xad, 0xd4, 0xa2, 0xaf, 0x9c, 0xa4, 0x72, 0xc0, //
+    0xb7, 0xfd, 0x93, 0x26, 0x36, 0x3f, 0xf7, 0xcc, 0x34, 0xa5, 0xe5, 0xf1, 0x71, 0xd8, 0x31, 0x15, //
+    0x04, 0xc7, 0x23, 0xc3, 0x18, 0x96, 0x05, 0x9a, 0x07, 0x12, 0x80, 0xe2, 0xeb, 0x27, 0xb2, 0x75, //
+    0x09, 0x83, 0x2c, 0x1a, 0x1b, 0x6e, 0x5a, 0xa0, 0x52, 0x3b, 0xd6, 0xb3, 0x29, 0xe3, 0x2f, 0x84, //
+    0x53, 0xd1, 0x00, 0xed, 0x20, 0xfc, 0xb1, 0x5b, 0x6a, 0xcb, 0xbe, 0x39, 0x4a, 0x4c, 0x58, 0xcf, //
+    0xd0, 0xef, 0xaa, 0xfb, 0x43, 0x4d, 0x33, 0x85, 0x45, 0xf9, 0x02, 0x7f, 0x50, 0x3c, 0x9f, 0xa8, //
+    0x51, 0xa3, 0x40, 0x8f, 0x92, 0x9d, 0x38, 0xf5, 0xbc, 0xb6, 0xda, 0x21, 0x10, 0xff, 0xf3, 0xd2, //
+    0xcd, 0x0c, 0x13, 0xec, 0x5f, 0x97, 0x44, 0x17, 0xc4, 0xa7, 0x7e, 0x3d, 0x64, 0x5d, 0x19, 0x73, //
+    0x60, 0x81, 0x4f, 0xdc, 0x22, 0x2a, 0x90, 0x88, 0x46, 0xee, 0xb8, 0x14, 0xde, 0x5e, 0x0b, 0xdb, //
+    0xe0, 0x32, 0x3a, 0x0a, 0x49, 0x06, 0x24, 0x5c, 0xc2, 0xd3, 0xac, 0x62, 0x91, 0x95, 0xe4, 0x79, //
+    0xe7, 0xc8, 0x37, 0x6d, 0x8d, 0xd5, 0x4e, 0xa9, 0x6c, 0x56, 0xf4, 0xea, 0x65, 0x7a, 0xae, 0x08, //
+    0xba, 0x78, 0x25, 0x2e, 0x1c, 0xa6, 0xb4, 0xc6, 0xe8, 0xdd, 0x74, 0x1f, 0x4b, 0xbd, 0x8b, 0x8a, //
+    0x70, 0x3e, 0xb5, 0x66, 0x48, 0x03, 0xf6, 0x0e, 0x61, 0x35, 0x57, 0xb9, 0x86, 0xc1, 0x1d, 0x9e, //
+    0xe1, 0xf8, 0x98, 0x11, 0x69, 0xd9, 0x8e, 0x94, 0x9b, 0x1e, 0x87, 0xe9, 0xce, 0x55, 0x28, 0xdf, //
+    0x8c, 0xa1, 0x89, 0x0d, 0xbf, 0xe6, 0x42, 0x68, 0x41, 0x99, 0x2d, 0x0f, 0xb0, 0x54, 0xbb, 0x16, //
+];
+
+/// SubBytes and MixColumns of a byte in the first row: (2s, s, s, 3s). The
+/// other rows are rotations of it.
+const TE: [u32; 256] = {
+    let mut table = [0; 256];
+    let mut i = 0;
+    while i < 256 {
+        let s = SBOX[i] as u32;
+        let s2 = (s << 1) ^ if s & 0x80 != 0 { 0x11b } else { 0 };
+        table[i] = (s2 << 24) | (s << 16) | (s << 8) | (s2 ^ s);
+        i += 1;
+    }
+    table
+};
+
+/// The GHASH reduction polynomial, in the bit-reflected order.
+const R: u128 = 0xe1 << 120;
+
+/// Multiplies by x in GF(2^128). Bit 127 is the coefficient of x^0.
+const fn mul_x(v: u128) -> u128 {
+    if v & 1 != 0 { (v >> 1) ^ R } else { v >> 1 }
+}
+
+/// The reduction of the 4 bits shifted out when multiplying by x^4.
+const REDUCE4: [u128; 16] = {
+    let mut table = [0; 16];
+    let mut i = 0;
+    while i < 16 {
+        table[i] = mul_x(mul_x(mul_x(mul_x(i as u128))));
+        i += 1;
+    }
+    table
+};
+
+fn sub_word(w: u32) -> u32 {
+    u32::from_be_bytes(w.to_be_bytes().map(|b| SBOX[b as usize]))
+}
+
+pub struct Aes256Gcm {
+    round_keys: [u32; 4 * (NUM_ROUNDS + 1)],
+    /// The hash key H multiplied by each 4-bit polynomial.
+    h_table: [u128; 16],
+}
+
+impl Aes256Gcm {
+    pub fn new(key: &[u8; KEY_LEN]) -> Aes256Gcm {
+        let mut round_keys = [0; 4 * (NUM_ROUNDS + 1)];
+        for (i, word) in key.chunks_exact(4).enumerate() {
+            round_keys[i] = u32::from_be_bytes(word.try_into().unwrap());
+        }
+
+        let mut rcon = 1u32;
+        for i in 8..round_keys.len() {
+            let mut temp = round_keys[i - 1];
+            if i % 8 == 0 {
+                temp = sub_word(temp.rotate_left(8)) ^ (rcon << 24);
+                rcon = (rcon << 1) ^ if rcon & 0x80 != 0 { 0x11b } else { 0 };
+            } else if i % 8 == 4 {
+                temp = sub_word(temp);
+            }
+            round_keys[i] = round_keys[i - 8] ^ temp;
+        }
+
+        let mut aes = Aes256Gcm { round_keys, h_table: [0; 16] };
+        // Bit 3 of the index is the coefficient of x^0.
+        let mut h = u128::from_be_bytes(aes.encrypt_block([0; BLOCK_LEN]));
+        for bit in (0..4).rev() {
+            for i in 0..16 {
+                if i & (1 << bit) != 0 {
+                    aes.h_table[i] ^= h;
+                }
+            }
+            h = mul_x(h);
+        }
+        aes
+    }
+
+    fn encrypt_block(&self, block: [u8; BLOCK_LEN]) -> [u8; BLOCK_LEN] {
+        let rk = &self.round_keys;
+        let mut s = [0u32; 4];
+        for (i, word) in block.chunks_exact(4).enumerate() {
+            s[i] = u32::from_be_bytes(word.try_into().unwrap()) ^ rk[i];
+        }
+
+        for round in 1..NUM_ROUNDS {
+            let mut t = [0u32; 4];
+            for (i, t) in t.iter_mut().enumerate() {
+                // ShiftRows: row r of column i comes from column i + r.
+                *t = TE[(s[i] >> 24) as usize]
+                    ^ TE[((s[(i + 1) % 4] >> 16) & 0xff) as usize].rotate_right(8)
+                    ^ TE[((s[(i + 2) % 4] >> 8) & 0xff) as usize].rotate_right(16)
+                    ^ TE[(s[(i + 3) % 4] & 0xff) as usize].rotate_right(24)
+                    ^ rk[4 * round + i];
+            }
+            s = t;
+        }
+
+        // The last round has no MixColumns.
+        let mut out = [0; BLOCK_LEN];
+        for i in 0..4 {
+            let word = (SBOX[(s[i] >> 24) as usize] as u32) << 24
+                | (SBOX[((s[(i + 1) % 4] >> 16) & 0xff) as usize] as u32) << 16
+                | (SBOX[((s[(i + 2) % 4] >> 8) & 0xff) as usize] as u32) << 8
+                | SBOX[(s[(i + 3) % 4] & 0xff) as usize] as u32;
+            out[4 * i..4 * i + 4].copy_from_slice(&(word ^ rk[4 * NUM_ROUNDS + i]).to_be_bytes());
+        }
+        out
+    }
+
+    /// Multiplies by H, a nibble at a time from the highest-degree end.
+    fn mul_h(&self, x: u128) -> u128 {
+        let mut z = 0;
+        for i in 0..32 {
+            let nibble = (x >> (4 * i)) & 0xf;
+            z = (z >> 4) ^ REDUCE4[(z & 0xf) as usize] ^ self.h_table[nibble as usize];
+        }
+        z
+    }
+
+    fn ghash(&self, aad: &[u8], ciphertext: &[u8]) -> u128 {
+        let mut y = 0;
+        for data in [aad, ciphertext] {
+            for chunk in data.chunks(BLOCK_LEN) {
+                let mut block = [0; BLOCK_LEN];
+                block[..chunk.len()].copy_from_slice(chunk);
+                y = self.mul_h(y ^ u128::from_be_bytes(block));
+            }
+        }
+
+        let lengths = ((aad.len() as u128 * 8) << 64) | (ciphertext.len() as u128 * 8);
+        self.mul_h(y ^ lengths)
+    }
+
+    /// CTR mode from the block after J0.
+    fn ctr(&self, nonce: &[u8; NONCE_LEN], data: &mut [u8]) {
+        let mut counter = [0; BLOCK_LEN];
+        counter[..NONCE_LEN].copy_from_slice(nonce);
+        for (i, chunk) in data.chunks_mut(BLOCK_LEN).enumerate() {
+            counter[NONCE_LEN..].copy_from_slice(&(i as u32 + 2).to_be_bytes());
+            for (byte, key) in chunk.iter_mut().zip(self.encrypt_block(counter)) {
+                *byte ^= key;
+            }
+        }
+    }
+
+    fn tag(&self, nonce: &[u8; NONCE_LEN], aad: &[u8], ciphertext: &[u8]) -> [u8; TAG_LEN] {
+        let mut j0 = [0; BLOCK_LEN];
+        j0[..NONCE_LEN].copy_from_slice(nonce);
+        j0[BLOCK_LEN - 1] = 1;
+        (self.ghash(aad, ciphertext) ^ u128::from_be_bytes(self.encrypt_block(j0))).to_be_bytes()
+    }
+
+    /// Encrypts `data` in place. Returns the tag.
+    pub fn seal(&self, nonce: &[u8; NONCE_LEN], aad: &[u8], data: &mut [u8]) -> [u8; TAG_LEN] {
+        self.ctr(nonce, data);
+        self.tag(nonce, aad, data)
+    }
+
+    /// Decrypts `data` in place. Returns false, leaving `data` as is, if it
+    /// or `aad` has been tampered with.
+    pub fn open(&self, nonce: &[u8; NONCE_LEN], aad: &[u8], data: &mut [u8], tag: &[u8; TAG_LEN]) -> bool {
+        // Compare in constant time.
+        let expected = self.tag(nonce, aad, data);
+        if expected.iter().zip(tag).fold(0, |diff, (a, b)| diff | (a ^ b)) != 0 {
+            return false;
+        }
+
+        self.ctr(nonce, data);
+        true
+    }
+}
@@ -22,6 +22,19 @@ impl BumpAllocator {
             end: end as usize,
         });
     }
+
+    /// Allocates memory from the end of the heap: its address doesn't depend
+    /// on other allocations.
+    fn alloc_at_end(&self, layout: Layout) -> *mut u8 {
+        let mut mutable_lock = self.mutable.lock();
+        let mutable = mutable_lock.as_mut().expect("allocator not initialized");
+
+        let addr = mutable.end.saturating_sub(layout.size()) & !(layout.align() - 1);
+        assert!(addr >= mutable.next, "out of memory");
+
+        mutable.end = addr;
+        addr as *mut u8
+    }
 }
 
 unsafe impl GlobalAlloc for BumpAllocator {
@@ -46,3 +59,15 @@ pub fn alloc_pages(len: usize) -> *mut u8 {
     let layout = Layout::from_size_align(len, 0x1000).unwrap();
     unsafe { GLOBAL_ALLOCATOR.alloc_zeroed(layout) as *mut u8 }
 }
+
+/// Allocates pages aligned to `align` without zero-filling them.
+pub fn alloc_pages_uninit(len: usize, align: usize) -> *mut u8 {
+    let layout = Layout::from_size_align(len, align.max(0x1000)).unwrap();
+    unsafe { GLOBAL_ALLOCATOR.alloc(layout) as *mut u8 }
+}
+
+/// Like `alloc_pages_uninit`, but at the end of the heap.
+pub fn alloc_pages_at_end(len: usize, align: usize) -> *mut u8 {
+    let layout = Layout::from_size_align(len, align.max(0x1000)).unwrap();
+    GLOBAL_ALLOCATOR.alloc_at_end(layout)
+}
@@ -0,0 +1,102 @@
+//! Boot time breakdown (`info boottime`, and at shutdown with `-boot-time`).
+//! We record when the first boot reaches each milestone, in the host time
+//! since QEMU has started the machine (the time CSR starts at 0):
+//!
+//! ```text
+//! hypervisor  OpenSBI has jumped to us
+//! kernel      the kernel image (and the initrd) is in the guest memory
+//! dtb         the device tree is built
+//! guest       the boot vCPU runs the first instruction of the guest
+//! console     the first line on the guest console
+//! init        Linux runs init ("Run /init as init process")
+//! ```
+use alloc::{format, string::String, vec::Vec};
+use core::sync::atomic::{AtomicU64, Ordering};
+
+use crate::timer::{self, TIMEBASE_FREQ};
+
+
+#[derive(Clone, Copy)]
+pub enum Milestone {
+    Hypervisor,
+    Kernel,
+    DeviceTree,
+    Guest,
+    Console,
+    Init,
+}
+
+/// The name of each milestone, and of the phase which ends with it.
+const MILESTONES: [(&str, &str); 6] = [
+    ("hypervisor", "firmware"),
+    ("kernel", "image load"),
+    ("dtb", "dtb build"),
+    ("guest", "device setup"),
+    ("console", "first output"),
+    ("init", "kernel boot"),
+];
+
+/// The host time of each milestone, or 0 if not reached yet.
+static REACHED_AT: [AtomicU64; MILESTONES.len()] = [const { AtomicU64::new(0) }; MILESTONES.len()];
+
+/// Records the milestone if it's the first time, i.e. not on restarts.
+pub fn record(milestone: Milestone) {
+    let _ = REACHED_AT[milestone as usize].compare_exchange(0, timer::now(), Ordering::AcqRel, Ordering::Relaxed);
+}
+
+/// Looks for the milestones in a line of the guest console.
+pub fn scan_console_line(line: &[u8]) {
+    record(Milestone::Console);
+    let pattern = b" as init process";
+    if line.windows(pattern.len()).any(|window| window == pattern) {
+        record(Milestone::Init);
+    }
+}
+
+fn reached_at(index: usize) -> Option<u64> {
+    Some(REACHED_AT[index].load(Ordering::Acquire)).filter(|&ticks| ticks != 0)
+}
+
+/// In milliseconds with a decimal place.
+fn format_ms(ticks: u64) -> String {
+    let tenths = ticks / (TIMEBASE_FREQ / 10_000);
+    format!("{}.{}", tenths / 10, tenths % 10)
+}
+
+/// `info boottime`: the phases, each from the previous milestone.
+pub fn report() -> String {
+    let mut lines = Vec::new();
+    let mut prev = Some(0);
+    for (index, (name, phase)) in MILESTONES.iter().enumerate() {
+        let at = reached_at(index);
+        let line = match (prev, at) {
+            (Some(prev), Some(at)) => {
+                format!("{:<13} {:>9} ms  ({} at {} ms)", phase, format_ms(at - prev), name, format_ms(at))
+            }
+            (None, Some(at)) => format!("{:<13} {:>9}     ({} at {} ms)", phase, "-", name, format_ms(at)),
+            (_, None) => format!("{:<13} {:>9}     ({} not reached)", phase, "-", name),
+        };
+        lines.push(line);
+        prev = at;
+    }
+    lines.join("\n")
+}
+
+/// `query-boottime`: the time of each milestone in ms, or null.
+pub fn report_json() -> String {
+    let entries: Vec<String> = MILESTONES
+        .iter()
+        .enumerate()
+        .map(|(index, (name, _))| match reached_at(index) {
+            Some(at) => format!("\"{}\": {}", name, format_ms(at)),
+            None => format!("\"{}\": null", name),
+        })
+        .collect();
+    format!("{{{}}}", entries.join(", "))
+}
+
+pub fn print_report() {
+    for line in report().lines() {
+        println!("[boot-time] {}", line);
+    }
+}
@@ -0,0 +1,866 @@
+use alloc::{string::String, vec, vec::Vec};
+use spin::Once;
+
+use crate::{guest_trace, hotplug::MAX_HOTPLUG_SLOTS, isa::Isa, smp::MAX_VCPUS, throttle::{Limits, MAX_RATE}, virtio_features};
+
+pub enum NetBackendKind {
+    /// The NIC provided by QEMU (`-device virtio-net-device`).
+    Host,
+}
+
+pub struct NetConfig {
+    pub backend: NetBackendKind,
+    /// None to derive it from `-name` (see identity.rs).
+    pub mac: Option<[u8; 6]>,
+    /// The number of receive/transmit queue pairs.
+    pub queues: usize,
+    /// Packets and bytes per second in each direction (see throttle.rs).
+    pub throttle: Limits,
+    /// The host virtio console port to capture frames to (see pcap.rs).
+    pub pcap: Option<String>,
+}
+
+pub enum DiskBackendKind {
+    /// The disk provided by QEMU (`-drive` and `-device virtio-blk-device`).
+    Host,
+    /// A read-only base image and a copy-on-write overlay, both provided by QEMU.
+    Cow,
+}
+
+pub struct DiskConfig {
+    pub backend: DiskBackendKind,
+    /// The number of request queues.
+    pub queues: usize,
+    /// Requests and bytes per second (see throttle.rs).
+    pub throttle: Limits,
+}
+
+pub enum RngBackendKind {
+    /// The virtio-rng device provided by QEMU (`-device virtio-rng-device`).
+    Host,
+}
+
+pub struct RngConfig {
+    pub backend: RngBackendKind,
+}
+
+pub enum SerialSink {
+    /// The hypervisor's console.
+    Stdio,
+    /// The hypervisor's console, unbuffered and without the prefix.
+    Raw,
+    /// A port of the host virtio console (`-device virtserialport,name=<name>`).
+    Port(String),
+}
+
+pub struct SerialConfig {
+    pub sinks: Vec<SerialSink>,
+}
+
+/// What to do when the ring of `-async-console` is full.
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub enum ConsoleOverflow {
+    /// Drop the oldest output: the guest never waits for the host.
+    DropOldest,
+    /// Wait for the UART: nothing is lost, but the vCPU blocks.
+    Backpressure,
+}
+
+pub struct AsyncConsoleConfig {
+    /// The size of the ring in bytes.
+    pub size: usize,
+    pub overflow: ConsoleOverflow,
+}
+
+/// What to do when the guest crashes (`-on-crash`).
+pub enum CrashAction {
+    /// Shut down the machine with a failure status.
+    Exit,
+    /// Reload the kernel and boot the guest again.
+    Restart,
+    /// Keep the VM paused for GDB and the monitor.
+    Pause,
+}
+
+/// The severity of a log message: the less severe, the larger.
+#[derive(Clone, Copy, PartialEq, PartialOrd)]
+pub enum LogLevel {
+    Error,
+    Warn,
+    Info,
+    Debug,
+    Trace,
+}
+
+pub struct LogConfig {
+    /// The level of components not in `components`.
+    pub default: LogLevel,
+    /// (component, level) pairs, e.g. ("virtio", Debug).
+    pub components: Vec<(String, LogLevel)>,
+    /// The most verbose level of all.
+    pub max: LogLevel,
+    /// Whether to write JSON lines to the "log" port instead of the console.
+    pub json: bool,
+}
+
+/// What to do when the watchdog expires (`-watchdog-action`).
+pub enum WatchdogAction {
+    /// Reload the kernel and boot the guest again.
+    Reset,
+    /// Shut down the machine with a failure status.
+    Poweroff,
+    /// Keep the VM paused for GDB and the monitor.
+    Pause,
+    /// Only report it.
+    None,
+}
+
+pub struct ConsoleConfig {
+    /// The port names. The first one is the console (hvc).
+    pub ports: Vec<String>,
+}
+
+pub struct VsockConfig {
+    /// The guest's context ID (3 or larger).
+    pub guest_cid: u64,
+    /// (vsock port, host virtio console port).
+    pub ports: Vec<(u32, String)>,
+}
+
+pub struct FramebufferConfig {
+    pub width: u32,
+    pub height: u32,
+}
+
+pub struct ShareConfig {
+    /// The mount tag of the virtio-9p device provided by QEMU.
+    pub tag: String,
+}
+
+pub struct FsConfig {
+    /// The tag of the vhost-user-fs device provided by QEMU.
+    pub tag: String,
+}
+
+/// A region carved out of the end of the guest RAM (see reserved_mem.rs).
+pub struct ReservedMemConfig {
+    /// The node name in /reserved-memory, e.g. `cma`.
+    pub name: String,
+    pub size: u64,
+    pub align: u64,
+    /// e.g. `shared-dma-pool`.
+    pub compatible: Option<String>,
+    /// Not mapped by the guest kernel (`no-map`).
+    pub no_map: bool,
+    /// The kernel may use it until a driver takes it, as CMA does (`reusable`).
+    pub reusable: bool,
+    /// The default pool (`linux,cma-default` or `linux,dma-default`).
+    pub default: bool,
+}
+
+/// The hotpluggable memory of virtio-mem (see virtio_mem.rs).
+pub struct VirtioMemConfig {
+    /// The size of the region, the most the guest can have plugged.
+    pub size: usize,
+    /// The unit in which the guest plugs and unplugs the memory.
+    pub block_size: usize,
+}
+
+pub struct Config {
+    /// The VM's name, which its identity is derived from (see identity.rs).
+    pub name: Option<String>,
+    /// The vCPUs on boot.
+    pub num_vcpus: usize,
+    /// The vCPUs on boot and those `cpu-add` can add (`maxcpus=`).
+    pub max_vcpus: usize,
+    /// The guest RAM size in bytes.
+    pub memory_size: usize,
+    /// Regions at the end of the guest RAM, from the top.
+    pub reserved_mem: Vec<ReservedMemConfig>,
+    /// Whether to map the guest RAM with 2MB pages.
+    pub hugepages: bool,
+    /// Whether to map (and make QEMU allocate) the whole guest RAM on boot,
+    /// rather than on the first access to each page.
+    pub prealloc: bool,
+    /// Whether the host RAM is QEMU's memory file, which keeps the guest RAM.
+    pub mem_file: bool,
+    /// The percentage of time each vCPU may spend in the guest.
+    pub cpu_quota: Option<u64>,
+    /// Whether to expose the H extension to the guest (see nested.rs).
+    pub nested: bool,
+    /// The guest's ISA extensions (see isa.rs).
+    pub isa: Isa,
+    /// The seed of the guest's randomness and start times (see
+    /// deterministic.rs).
+    pub deterministic: Option<u64>,
+    /// (vCPU ID, physical hart ID) pairs from `-cpu-affinity`.
+    pub cpu_affinity: Vec<(u64, u64)>,
+    pub net: Option<NetConfig>,
+    pub disk: Option<DiskConfig>,
+    pub console: Option<ConsoleConfig>,
+    pub share: Option<ShareConfig>,
+    pub fs: Option<FsConfig>,
+    pub rng: Option<RngConfig>,
+    pub vsock: Option<VsockConfig>,
+    pub framebuffer: Option<FramebufferConfig>,
+    /// Where the SBI console goes.
+    pub serial: SerialConfig,
+    /// How much of the guest console output to keep for the monitor and
+    /// crash reports, in bytes.
+    pub console_buffer_size: usize,
+    /// Whether to write the hypervisor's console to the UART without
+    /// blocking, through a ring.
+    pub async_console: Option<AsyncConsoleConfig>,
+    /// Whether to enable virtio-balloon.
+    pub balloon: bool,
+    /// Memory the guest plugs and unplugs at runtime with virtio-mem.
+    pub virtio_mem: Option<VirtioMemConfig>,
+    /// Whether to forward QEMU's keyboard and tablet with virtio-input.
+    pub input: bool,
+    /// Whether to enable the GDB stub.
+    pub gdb: bool,
+    /// Whether to enable the QMP-like monitor.
+    pub monitor: bool,
+    /// Whether to record every VM exit.
+    pub trace: bool,
+    /// The size of the guest's trace buffer (see guest_trace.rs).
+    pub trace_guest: Option<u64>,
+    /// Whether to print the boot time breakdown at shutdown.
+    pub boot_time: bool,
+    /// Whether to collect guest-page fault statistics.
+    pub fault_stats: bool,
+    /// Whether to check the hypervisor's accesses to the guest memory.
+    pub memcheck: bool,
+    /// Whether to serve Prometheus metrics on the "metrics" port.
+    pub metrics: bool,
+    /// Whether to serve a pprof profile of the VM exits on the "pprof" port.
+    pub pprof: bool,
+    pub log: LogConfig,
+    pub on_crash: CrashAction,
+    /// Whether to enable the watchdog.
+    pub watchdog: bool,
+    pub watchdog_action: WatchdogAction,
+    /// Whether to enable the RTC.
+    pub rtc: bool,
+    /// How fast the guest time runs relative to the host's, as a fraction.
+    /// None if not scaled.
+    pub clock_scale: Option<(u64, u64)>,
+    /// Whether to give the guest a test device to exit with a status.
+    pub test_finisher: bool,
+    /// Whether to give the guest a pvpanic device to report panics.
+    pub pvpanic: bool,
+    /// Whether to dump the guest memory on a crash.
+    pub crash_dump: bool,
+    /// Virtio features not to offer: (device ID, feature bit).
+    pub disabled_features: Vec<(u32, u64)>,
+    /// How long to hold the interrupts of virtio-net and virtio-blk to batch
+    /// them, in microseconds. 0 if disabled.
+    pub irq_coalesce_us: u64,
+    /// The faults to inject into the devices (see fault_inject.rs).
+    pub fault_inject: Option<String>,
+    /// Whether to put the virtio devices on the PCI bus instead of
+    /// virtio-mmio (except hotplug slots and -input).
+    pub pci: bool,
+    /// Whether to wait for a migration instead of booting the kernel.
+    pub incoming: bool,
+    /// Whether to restore the snapshot instead of booting the kernel.
+    pub loadvm: bool,
+    /// The number of empty virtio-mmio slots for `device_add`.
+    pub hotplug_slots: usize,
+    /// The fw_cfg file name of the kernel Image. The built-in one if None.
+    pub kernel: Option<String>,
+    /// The fw_cfg file name of the initrd.
+    pub initrd: Option<String>,
+    /// The fw_cfg file name of the machine description (see machine.rs).
+    pub machine: Option<String>,
+    /// The fw_cfg file name of the key to encrypt snapshots and dumps with
+    /// (see encryption.rs).
+    pub snapshot_key: Option<String>,
+    /// The fw_cfg file name of an S-mode firmware (e.g. U-Boot) booted
+    /// before the kernel.
+    pub firmware: Option<String>,
+    /// The fw_cfg file name of the guest kernel's System.map or vmlinux
+    /// (see symbols.rs).
+    pub symbols: Option<String>,
+    /// The fw_cfg file name of a device tree overlay merged into the
+    /// generated one (see dt_overlay.rs).
+    pub dtb_overlay: Option<String>,
+    /// Whether to measure the images into the event log (see measured_boot.rs).
+    pub measure: bool,
+    /// The fw_cfg file name of the public key to verify the images with
+    /// (see measured_boot.rs). Implies `measure`.
+    pub verify: Option<String>,
+    /// The kernel command line.
+    pub cmdline: String,
+}
+
+static CONFIG: Once<Config> = Once::new();
+
+fn parse_mac(s: &str) -> [u8; 6] {
+    let mut mac = [0; 6];
+    let mut octets = s.split(':');
+    for byte in mac.iter_mut() {
+        let octet = octets.next().unwrap_or_else(|| panic!("invalid MAC address: {}", s));
+        *byte = u8::from_str_radix(octet, 16).unwrap_or_else(|_| panic!("invalid MAC address: {}", s));
+    }
+
+    assert!(octets.next().is_none(), "invalid MAC address: {}", s);
+    mac
+}
+
+/// Parses a size like `256m` or `2g`.
+pub fn parse_size(s: &str) -> Option<usize> {
+    let (number, shift) = match s.as_bytes().last()? {
+        b'k' | b'K' => (&s[..s.len() - 1], 10),
+        b'm' | b'M' => (&s[..s.len() - 1], 20),
+        b'g' | b'G' => (&s[..s.len() - 1], 30),
+        _ => (s, 0),
+    };
+
+    number.parse::<usize>().ok()?.checked_mul(1 << shift)
+}
+
+/// Parses a factor of `-clock-scale`: a decimal (`0.25`) or a fraction
+/// (`1/3`). Returns (numerator, denominator).
+pub fn parse_clock_scale(value: &str) -> Option<(u64, u64)> {
+    let (num, den) = match (value.split_once('/'), value.split_once('.')) {
+        (Some((num, den)), _) => (num.parse().ok()?, den.parse().ok()?),
+        (None, Some((int, frac))) if (1..=6).contains(&frac.len()) => {
+            let den = 10u64.pow(frac.len() as u32);
+            (int.parse::<u64>().ok()?.checked_mul(den)?.checked_add(frac.parse().ok()?)?, den)
+        }
+        _ => (value.parse().ok()?, 1),
+    };
+
+    (num > 0 && den > 0).then_some((num, den))
+}
+
+/// Parses `queues=<n>` of `-net` and `-disk`: up to a queue per vCPU.
+fn parse_queues(option: &str, value: &str) -> usize {
+    match value.parse() {
+        Ok(queues) if (1..=MAX_VCPUS).contains(&queues) => queues,
+        _ => panic!("{}: queues must be 1-{}", option, MAX_VCPUS),
+    }
+}
+
+/// Parses a throttle limit per second. 0 means no limit.
+fn parse_rate(option: &str, value: &str) -> u64 {
+    match value.parse() {
+        Ok(rate) if rate <= MAX_RATE => rate,
+        _ => panic!("{}: invalid rate (0-{}): {}", option, MAX_RATE, value),
+    }
+}
+
+/// Parses `-net <backend>[,mac=<MAC>][,queues=<n>][,pps=<n>][,bps=<n>][,pcap=<port>]`.
+fn parse_net(value: &str) -> NetConfig {
+    let mut options = value.split(',');
+    let backend = match options.next() {
+        Some("host") => NetBackendKind::Host,
+        _ => panic!("-net: unknown backend: {} (available: host)", value),
+    };
+
+    let mut net = NetConfig {
+        backend,
+        mac: None,
+        queues: 1,
+        throttle: Limits::default(),
+        pcap: None,
+    };
+    for option in options {
+        match option.split_once('=') {
+            Some(("mac", mac)) => net.mac = Some(parse_mac(mac)),
+            Some(("queues", queues)) => net.queues = parse_queues("-net", queues),
+            Some(("pps", pps)) => net.throttle.ops = parse_rate("-net", pps),
+            Some(("bps", bps)) => net.throttle.bytes = parse_rate("-net", bps),
+            Some(("pcap", port)) => net.pcap = Some(String::from(port)),
+            _ => panic!("-net: unknown option: {}", option),
+        }
+    }
+
+    net
+}
+
+/// Parses `-disk <backend>[,queues=<n>][,iops=<n>][,bps=<n>]`.
+fn parse_disk(value: &str) -> DiskConfig {
+    let mut options = value.split(',');
+    let backend = match options.next() {
+        Some("host") => DiskBackendKind::Host,
+        Some("cow") => DiskBackendKind::Cow,
+        _ => panic!("-disk: unknown backend: {} (available: host, cow)", value),
+    };
+
+    let mut disk = DiskConfig { backend, queues: 1, throttle: Limits::default() };
+    for option in options {
+        match option.split_once('=') {
+            Some(("queues", queues)) => disk.queues = parse_queues("-disk", queues),
+            Some(("iops", iops)) => disk.throttle.ops = parse_rate("-disk", iops),
+            Some(("bps", bps)) => disk.throttle.bytes = parse_rate("-disk", bps),
+            _ => panic!("-disk: unknown option: {}", option),
+        }
+    }
+
+    disk
+}
+
+/// Parses `-rng <backend>`.
+fn parse_rng(value: &str) -> RngConfig {
+    let backend = match value {
+        "host" => RngBackendKind::Host,
+        _ => panic!("-rng: unknown backend: {} (available: host)", value),
+    };
+
+    RngConfig { backend }
+}
+
+/// Parses `-fb <width>x<height>`, e.g. `-fb 800x600`.
+fn parse_framebuffer(value: &str) -> FramebufferConfig {
+    let size = value.split_once('x').and_then(|(width, height)| Some((width.parse().ok()?, height.parse().ok()?)));
+    let Some((width, height)) = size.filter(|&(width, height): &(u32, u32)| width > 0 && height > 0) else {
+        panic!("-fb: expected <width>x<height>: {}", value);
+    };
+
+    assert!(width <= 4096 && height <= 4096, "-fb: at most 4096x4096: {}", value);
+    FramebufferConfig { width, height }
+}
+
+/// Parses `-reserved-mem <name>,size=<size>[,align=<size>][,compatible=<string>]
+/// [,no-map][,reusable][,default]`, e.g.
+/// `-reserved-mem cma,size=16m,align=4m,compatible=shared-dma-pool,reusable,default`.
+fn parse_reserved_mem(value: &str) -> ReservedMemConfig {
+    let mut options = value.split(',');
+    let name = options
+        .next()
+        .filter(|name| !name.is_empty() && !name.contains('='))
+        .unwrap_or_else(|| panic!("-reserved-mem: expected <name>,size=<size>: {}", value));
+
+    let size = |s: &str| {
+        let size = parse_size(s).unwrap_or_else(|| panic!("-reserved-mem: invalid size: {}", s)) as u64;
+        assert!(size > 0 && size % 0x1000 == 0, "-reserved-mem: must be a multiple of 4KB: {}", s);
+        size
+    };
+
+    let mut region = ReservedMemConfig {
+        name: String::from(name),
+        size: 0,
+        align: 0x20_0000,
+        compatible: None,
+        no_map: false,
+        reusable: false,
+        default: false,
+    };
+    for option in options {
+        match option.split_once('=') {
+            Some(("size", value)) => region.size = size(value),
+            Some(("align", value)) => region.align = size(value),
+            Some(("compatible", value)) => region.compatible = Some(String::from(value)),
+            None if option == "no-map" => region.no_map = true,
+            None if option == "reusable" => region.reusable = true,
+            None if option == "default" => region.default = true,
+            _ => panic!("-reserved-mem: unknown option: {}", option),
+        }
+    }
+
+    assert!(region.size > 0, "-reserved-mem: {}: missing size=", name);
+    assert!(region.align.is_power_of_two(), "-reserved-mem: {}: align must be a power of two", name);
+    assert!(!(region.no_map && region.reusable), "-reserved-mem: {}: no-map and reusable are exclusive", name);
+    region
+}
+
+/// Parses `-virtio-mem <size>[,block=<size>]`, e.g. `-virtio-mem 1g,block=2m`.
+fn parse_virtio_mem(value: &str) -> VirtioMemConfig {
+    let size = |s: &str| parse_size(s).unwrap_or_else(|| panic!("-virtio-mem: invalid size: {}", s));
+    let mut options = value.split(',');
+    let mut mem = VirtioMemConfig { size: size(options.next().unwrap_or_default()), block_size: 0x20_0000 };
+    for option in options {
+        match option.split_once('=') {
+            Some(("block", value)) => mem.block_size = size(value),
+            _ => panic!("-virtio-mem: unknown option: {}", option),
+        }
+    }
+
+    assert!(
+        mem.block_size.is_power_of_two() && (0x1000..=0x4000_0000).contains(&mem.block_size),
+        "-virtio-mem: the block size must be a power of two from 4KB to 1GB"
+    );
+    assert!(
+        mem.size > 0 && mem.size % mem.block_size == 0,
+        "-virtio-mem: the size must be a non-zero multiple of the block size"
+    );
+    mem
+}
+
+/// Parses `-serial <sink>[,<sink>...]`, e.g. `-serial stdio,port:serial`.
+fn parse_serial(value: &str) -> SerialConfig {
+    let sinks = value
+        .split(',')
+        .map(|sink| match sink.split_once(':') {
+            None if sink == "stdio" => SerialSink::Stdio,
+            None if sink == "raw" => SerialSink::Raw,
+            Some(("port", name)) if !name.is_empty() => SerialSink::Port(String::from(name)),
+            _ => panic!("-serial: unknown sink: {} (available: stdio, raw, port:<name>)", sink),
+        })
+        .collect();
+
+    SerialConfig { sinks }
+}
+
+/// Parses `-async-console <size>[,drop-oldest|backpressure]`, e.g.
+/// `-async-console 64k,drop-oldest`.
+fn parse_async_console(value: &str) -> AsyncConsoleConfig {
+    let (size, overflow) = value.split_once(',').unwrap_or((value, "backpressure"));
+    let size = parse_size(size)
+        .filter(|&size| size > 0)
+        .unwrap_or_else(|| panic!("-async-console: invalid size: {}", size));
+    let overflow = match overflow {
+        "drop-oldest" => ConsoleOverflow::DropOldest,
+        "backpressure" => ConsoleOverflow::Backpressure,
+        _ => panic!("-async-console: unknown overflow policy: {} (available: drop-oldest, backpressure)", overflow),
+    };
+
+    AsyncConsoleConfig { size, overflow }
+}
+
+/// Parses `-on-crash <action>`.
+fn parse_watchdog_action(value: &str) -> WatchdogAction {
+    match value {
+        "reset" => WatchdogAction::Reset,
+        "poweroff" => WatchdogAction::Poweroff,
+        "pause" => WatchdogAction::Pause,
+        "none" => WatchdogAction::None,
+        _ => panic!("-watchdog-action: unknown action: {} (available: reset, poweroff, pause, none)", value),
+    }
+}
+
+/// Parses `-device <type>,disable-feature=<feature>[,...]`, e.g. `-device
+/// blk,disable-feature=indirect`. See virtio_features.rs for the names.
+fn parse_device(value: &str, disabled_features: &mut Vec<(u32, u64)>) {
+    let mut options = value.split(',');
+    let device = options.next().unwrap();
+    for option in options {
+        let feature = option
+            .strip_prefix("disable-feature=")
+            .unwrap_or_else(|| panic!("-device: unknown option: {}", option));
+        let disabled = virtio_features::lookup(device, feature).unwrap_or_else(|err| panic!("-device: {}", err));
+        disabled_features.push(disabled);
+    }
+}
+
+fn parse_log_level(value: &str) -> LogLevel {
+    match value {
+        "error" => LogLevel::Error,
+        "warn" => LogLevel::Warn,
+        "info" => LogLevel::Info,
+        "debug" => LogLevel::Debug,
+        "trace" => LogLevel::Trace,
+        _ => panic!("-log: unknown level: {} (available: error, warn, info, debug, trace)", value),
+    }
+}
+
+/// Parses `-log [<level>,][<component>=<level>,...]`, e.g.
+/// `-log warn,virtio=debug,vcpu=trace`.
+fn parse_log(value: &str, log: &mut LogConfig) {
+    for part in value.split(',') {
+        match part.split_once('=') {
+            Some((component, level)) if !component.is_empty() => {
+                log.components.retain(|(other, _)| other != component);
+                log.components.push((String::from(component), parse_log_level(level)));
+            }
+            Some(_) => panic!("-log: expected <component>=<level>: {}", part),
+            None => log.default = parse_log_level(part),
+        }
+    }
+
+    log.max = log.components.iter().map(|&(_, level)| level).fold(log.default, |max, level| {
+        if level > max { level } else { max }
+    });
+}
+
+fn parse_on_crash(value: &str) -> CrashAction {
+    match value {
+        "exit" => CrashAction::Exit,
+        "restart" => CrashAction::Restart,
+        "pause" => CrashAction::Pause,
+        _ => panic!("-on-crash: unknown action: {} (available: exit, restart, pause)", value),
+    }
+}
+
+/// Parses `-console <name>[,<name>...]`, e.g. `-console console,log,agent`.
+fn parse_console(value: &str) -> ConsoleConfig {
+    let ports: Vec<String> = value.split(',').map(String::from).collect();
+    if ports.iter().any(|name| name.is_empty()) {
+        panic!("-console: empty port name: {}", value);
+    }
+
+    ConsoleConfig { ports }
+}
+
+/// Parses `-vsock <guest-cid>[,<port>:<console-port>...]`, e.g. `-vsock 3,1234:vsock`.
+fn parse_vsock(value: &str) -> VsockConfig {
+    let mut parts = value.split(',');
+    let guest_cid = parts.next().unwrap().parse::<u64>().ok().filter(|cid| *cid >= 3);
+    let guest_cid = guest_cid.unwrap_or_else(|| panic!("-vsock: the guest CID must be 3 or larger: {}", value));
+    let ports: Vec<(u32, String)> = parts
+        .map(|part| match part.split_once(':') {
+            Some((port, console)) if !console.is_empty() => {
+                let port = port.parse().unwrap_or_else(|_| panic!("-vsock: invalid port: {}", port));
+                (port, String::from(console))
+            }
+            _ => panic!("-vsock: expected <port>:<console-port>: {}", part),
+        })
+        .collect();
+
+    for (i, (port, _)) in ports.iter().enumerate() {
+        assert!(ports[..i].iter().all(|(other, _)| other != port), "-vsock: duplicate port: {}", port);
+    }
+
+    VsockConfig { guest_cid, ports }
+}
+
+/// Parses `-cpu-affinity <vcpu>:<hart>[,<vcpu>:<hart>...]`, e.g.
+/// `-cpu-affinity 1:3,2:5`.
+fn parse_cpu_affinity(value: &str) -> Vec<(u64, u64)> {
+    let pairs: Vec<(u64, u64)> = value
+        .split(',')
+        .map(|part| {
+            let pair = part.split_once(':').and_then(|(vcpu, hart)| Some((vcpu.parse().ok()?, hart.parse().ok()?)));
+            pair.unwrap_or_else(|| panic!("-cpu-affinity: expected <vcpu>:<hart>: {}", part))
+        })
+        .collect();
+
+    for (i, (vcpu, _)) in pairs.iter().enumerate() {
+        assert!(pairs[..i].iter().all(|(other, _)| other != vcpu), "-cpu-affinity: duplicate vCPU: {}", vcpu);
+    }
+
+    pairs
+}
+
+/// Parses the hypervisor's command line, e.g. `-smp 2`.
+pub fn init(cmdline: &str) {
+    let mut config = Config {
+        name: None,
+        num_vcpus: 1,
+        max_vcpus: 1,
+        memory_size: 64 * 1024 * 1024,
+        reserved_mem: Vec::new(),
+        hugepages: false,
+        prealloc: false,
+        mem_file: false,
+        cpu_quota: None,
+        nested: false,
+        isa: Isa::default(false),
+        deterministic: None,
+        cpu_affinity: Vec::new(),
+        net: None,
+        disk: None,
+        console: None,
+        share: None,
+        fs: None,
+        rng: None,
+        vsock: None,
+        framebuffer: None,
+        serial: SerialConfig { sinks: vec![SerialSink::Stdio] },
+        console_buffer_size: 64 * 1024,
+        async_console: None,
+        balloon: false,
+        virtio_mem: None,
+        input: false,
+        gdb: false,
+        monitor: false,
+        trace: false,
+        trace_guest: None,
+        boot_time: false,
+        fault_stats: false,
+        memcheck: false,
+        metrics: false,
+        pprof: false,
+        log: LogConfig { default: LogLevel::Info, components: Vec::new(), max: LogLevel::Info, json: false },
+        on_crash: CrashAction::Exit,
+        watchdog: false,
+        watchdog_action: WatchdogAction::Reset,
+        rtc: false,
+        clock_scale: None,
+        test_finisher: false,
+        pvpanic: false,
+        crash_dump: false,
+        disabled_features: Vec::new(),
+        irq_coalesce_us: 0,
+        fault_inject: None,
+        pci: false,
+        incoming: false,
+        loadvm: false,
+        hotplug_slots: 0,
+        kernel: None,
+        initrd: None,
+        firmware: None,
+        machine: None,
+        snapshot_key: None,
+        symbols: None,
+        dtb_overlay: None,
+        measure: false,
+        verify: None,
+        cmdline: String::from("console=hvc earlycon=sbi panic=-1 root=/dev/vda"),
+    };
+
+    let mut cpu = None;
+    let mut args = cmdline.split_whitespace();
+    while let Some(arg) = args.next() {
+        let mut value = || args.next().unwrap_or_else(|| panic!("{}: missing value", arg));
+        match arg {
+            // -smp <n>[,maxcpus=<m>]: vCPUs n to m-1 are hotpluggable.
+            "-smp" => {
+                let value = value();
+                let (num, max) = match value.split_once(",maxcpus=") {
+                    Some((num, max)) => (num, Some(max)),
+                    None => (value, None),
+                };
+                config.num_vcpus = num.parse().expect("-smp: invalid number");
+                config.max_vcpus = max.map_or(config.num_vcpus, |max| max.parse().expect("-smp: invalid maxcpus"));
+                assert!(
+                    (1..=MAX_VCPUS).contains(&config.num_vcpus),
+                    "-smp: must be between 1 and {}",
+                    MAX_VCPUS
+                );
+                assert!(
+                    (config.num_vcpus..=MAX_VCPUS).contains(&config.max_vcpus),
+                    "-smp: maxcpus must be between {} and {}",
+                    config.num_vcpus,
+                    MAX_VCPUS
+                );
+            }
+            "-mem" => {
+                let value = value();
+                config.memory_size = parse_size(value).unwrap_or_else(|| panic!("-mem: invalid size: {}", value));
+                assert!(
+                    config.memory_size > 0 && config.memory_size % (2 * 1024 * 1024) == 0,
+                    "-mem: must be a multiple of 2MB"
+                );
+            }
+            "-reserved-mem" => config.reserved_mem.push(parse_reserved_mem(value())),
+            // Back QEMU's memory with huge pages too for the full benefit
+            // (e.g. `-mem-path /dev/hugepages`).
+            "-hugepages" => config.hugepages = true,
+            // No guest-page faults on the first accesses, for latency.
+            "-prealloc" => config.prealloc = true,
+            // QEMU's RAM is a file (`-object memory-backend-file,share=on`):
+            // place the guest RAM at a fixed offset in it.
+            "-mem-file" => config.mem_file = true,
+            "-cpu-quota" => {
+                let value = value();
+                let percent = value.strip_suffix('%').unwrap_or(value).parse::<u64>().ok();
+                config.cpu_quota = percent.filter(|percent| (1..=100).contains(percent));
+                assert!(config.cpu_quota.is_some(), "-cpu-quota: must be between 1% and 100%: {}", value);
+            }
+            "-nested" => config.nested = true,
+            "-cpu" => cpu = Some(value()),
+            "-deterministic" => config.deterministic = Some(value().parse().expect("-deterministic: invalid seed")),
+            "-cpu-affinity" => config.cpu_affinity = parse_cpu_affinity(value()),
+            "-name" => config.name = Some(String::from(value())),
+            "-net" => config.net = Some(parse_net(value())),
+            "-disk" => config.disk = Some(parse_disk(value())),
+            "-console" => config.console = Some(parse_console(value())),
+            // The host directory is given to QEMU: `-fsdev local,path=<dir>`.
+            "-share" => config.share = Some(ShareConfig { tag: String::from(value()) }),
+            // virtiofsd serves the host directory: `-device vhost-user-fs-device,tag=<tag>`.
+            "-fs" => config.fs = Some(FsConfig { tag: String::from(value()) }),
+            "-serial" => config.serial = parse_serial(value()),
+            "-console-buffer" => {
+                let value = value();
+                config.console_buffer_size =
+                    parse_size(value).unwrap_or_else(|| panic!("-console-buffer: invalid size: {}", value));
+            }
+            "-async-console" => config.async_console = Some(parse_async_console(value())),
+            "-rng" => config.rng = Some(parse_rng(value())),
+            "-vsock" => config.vsock = Some(parse_vsock(value())),
+            "-fb" => config.framebuffer = Some(parse_framebuffer(value())),
+            // Needs `-device virtio-balloon-device,free-page-reporting=on` in QEMU.
+            "-balloon" => config.balloon = true,
+            "-virtio-mem" => config.virtio_mem = Some(parse_virtio_mem(value())),
+            // Needs `-device virtio-keyboard-device -device virtio-tablet-device` in QEMU.
+            "-input" => config.input = true,
+            "-gdb" => config.gdb = true,
+            "-monitor" => config.monitor = true,
+            "-trace" => config.trace = true,
+            "-trace-guest" => {
+                let size = parse_size(value()).filter(|&size| size >= 0x1000 && size % 0x1000 == 0);
+                let size = size.expect("-trace-guest: must be a multiple of 4KB") as u64;
+                config.trace = true;
+                config.trace_guest = Some(size);
+                config.reserved_mem.push(ReservedMemConfig {
+                    name: String::from(guest_trace::REGION_NAME),
+                    size,
+                    align: 0x1000,
+                    compatible: None,
+                    no_map: true,
+                    reusable: false,
+                    default: false,
+                });
+            }
+            "-boot-time" => config.boot_time = true,
+            "-fault-stats" => config.fault_stats = true,
+            // Debug builds only.
+            "-memcheck" => config.memcheck = true,
+            "-metrics" => config.metrics = true,
+            "-pprof" => config.pprof = true,
+            "-log" => parse_log(value(), &mut config.log),
+            // Needs `-device virtserialport,name=log` in QEMU.
+            "-log-json" => config.log.json = true,
+            "-on-crash" => config.on_crash = parse_on_crash(value()),
+            "-watchdog" => config.watchdog = true,
+            "-watchdog-action" => config.watchdog_action = parse_watchdog_action(value()),
+            "-rtc" => config.rtc = true,
+            "-clock-scale" => {
+                let scale = parse_clock_scale(value()).expect("-clock-scale: expected a factor, e.g. 0.1, 2, or 1/3");
+                config.clock_scale = Some(scale);
+            }
+            "-test-finisher" => config.test_finisher = true,
+            "-pvpanic" => config.pvpanic = true,
+            "-crash-dump" => config.crash_dump = true,
+            "-device" => parse_device(value(), &mut config.disabled_features),
+            "-fault-inject" => config.fault_inject = Some(String::from(value())),
+            "-irq-coalesce" => config.irq_coalesce_us = value().parse().expect("-irq-coalesce: invalid number"),
+            "-pci" => config.pci = true,
+            "-incoming" => config.incoming = true,
+            "-loadvm" => config.loadvm = true,
+            "-measure" => config.measure = true,
+            "-hotplug-slots" => {
+                config.hotplug_slots = value().parse().expect("-hotplug-slots: invalid number");
+                assert!(config.hotplug_slots <= MAX_HOTPLUG_SLOTS, "-hotplug-slots: at most {}", MAX_HOTPLUG_SLOTS);
+            }
+            // Files given to QEMU: `-fw_cfg name=<name>,file=<path>`.
+            "-kernel" => config.kernel = Some(String::from(value())),
+            "-initrd" => config.initrd = Some(String::from(value())),
+            "-firmware" => config.firmware = Some(String::from(value())),
+            "-machine" => config.machine = Some(String::from(value())),
+            "-snapshot-key" => config.snapshot_key = Some(String::from(value())),
+            "-symbols" => config.symbols = Some(String::from(value())),
+            "-dtb-overlay" => config.dtb_overlay = Some(String::from(value())),
+            "-verify" => {
+                config.verify = Some(String::from(value()));
+                config.measure = true;
+            }
+            // The rest is the kernel command line.
+            "-append" => {
+                config.cmdline = args.by_ref().collect::<Vec<_>>().join(" ");
+                assert!(!config.cmdline.is_empty(), "-append: missing value");
+            }
+            _ => panic!("unknown option: {}", arg),
+        }
+    }
+
+    // h in -cpu is the same as -nested.
+    config.isa = match cpu {
+        Some(cpu) => {
+            let isa = Isa::parse(cpu).unwrap_or_else(|err| panic!("-cpu: {}", err));
+            assert!(isa.has("h") || !config.nested, "-nested: h is disabled in -cpu");
+            config.nested = isa.has("h");
+            isa
+        }
+        None => Isa::default(config.nested),
+    };
+
+    CONFIG.call_once(|| config);
+}
+
+pub fn config() -> &'static Config {
+    CONFIG.get().expect("config not initialized")
+}
@@ -0,0 +1,51 @@
+//! The last output of the guest's console (the SBI console and hvc0), kept
+//! even if nothing captures the console itself: `info console` and
+//! `query-console` in the monitor show it, and crash reports include its
+//! tail. `-console-buffer <size>` sets the size (64K by default, 0 to
+//! disable).
+use alloc::{collections::VecDeque, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::config::config;
+
+/// The console output, oldest first. Only whole lines.
+static BUFFER: Mutex<VecDeque<u8>> = Mutex::new(VecDeque::new());
+
+/// Appends a line of the console. The oldest lines are dropped beyond the
+/// size.
+pub fn record(line: &[u8]) {
+    let size = config().console_buffer_size;
+    if size == 0 {
+        return;
+    }
+
+    let mut buffer = BUFFER.lock();
+    buffer.extend(line.strip_suffix(b"\n").unwrap_or(line));
+    buffer.push_back(b'\n');
+    if buffer.len() > size {
+        let excess = buffer.len() - size;
+        buffer.drain(..excess);
+        // Drop the rest of the line cut in the middle.
+        match buffer.iter().position(|&b| b == b'\n') {
+            Some(end) => drop(buffer.drain(..=end)),
+            None => buffer.clear(),
+        }
+    }
+}
+
+/// Returns the last `num_lines` lines (all if None).
+pub fn tail(num_lines: Option<usize>) -> String {
+    let mut buffer = BUFFER.lock();
+    let data = buffer.make_contiguous();
+    let mut start = 0;
+    if let Some(num_lines) = num_lines {
+        // Each line ends with a newline: start after the (num_lines + 1)th
+        // newline from the end.
+        let newlines: Vec<usize> = data.iter().enumerate().filter(|(_, b)| **b == b'\n').map(|(i, _)| i).collect();
+        if newlines.len() > num_lines {
+            start = newlines[newlines.len() - num_lines - 1] + 1;
+        }
+    }
+
+    String::from_utf8_lossy(&data[start..]).into_owned()
+}
@@ -0,0 +1,188 @@
+//! Guest memory dumps: `{"execute": "dump-guest-memory"}` in the monitor,
+//! or `monitor dump` in GDB.
+//!
+//! The guest RAM is written as an ELF core file into a dedicated host disk
+//! (`serial=dump`), from the first sector. Read it with crash or GDB:
+//!
+//! ```text
+//! $ crash linux/vmlinux dump.img
+//! ```
+//!
+//! With `-snapshot-key`, the ELF file is encrypted (see encryption.rs) after
+//! a header instead. `hv decrypt-dump` in linux/hv decrypts it:
+//!
+//! ```text
+//! header  | magic, version, ELF headers size, memory size, nonce prefix
+//! tags    | the tags of the ELF headers (chunk 0) and the memory chunks
+//! ELF     | the ELF headers, and the guest RAM (from the next sector)
+//! ```
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    aes_gcm::TAG_LEN,
+    encryption,
+    guest_memory::GUEST_MEMORY,
+    host_blk::{HostBlk, SECTOR_SIZE, VIRTIO_BLK_T_OUT},
+    snapshot::{disk_io, for_each_vcpu},
+    vcpu::VCpu,
+};
+
+/// `-device virtio-blk-device,serial=dump` in run.sh.
+const DUMP_DISK_SERIAL: &str = "dump";
+const ENCRYPTED_MAGIC: &[u8; 8] = b"HVDUMPEN";
+const ENCRYPTED_VERSION: u32 = 1;
+
+const EHDR_SIZE: usize = 64;
+const PHDR_SIZE: usize = 56;
+const ET_CORE: u16 = 4;
+const EM_RISCV: u16 = 243;
+const PT_LOAD: u32 = 1;
+const PT_NOTE: u32 = 4;
+const PF_RWX: u32 = 0b111;
+const NT_PRSTATUS: u32 = 1;
+/// sizeof(struct elf_prstatus) on riscv64.
+const PRSTATUS_SIZE: usize = 384;
+/// The offset of pr_reg (pc, x1-x31) in struct elf_prstatus.
+const PRSTATUS_REG_OFFSET: usize = 112;
+
+static DUMP_DISK: Mutex<Option<HostBlk>> = Mutex::new(None);
+
+fn push_u16(buf: &mut Vec<u8>, value: u16) {
+    buf.extend_from_slice(&value.to_le_bytes());
+}
+
+fn push_u32(buf: &mut Vec<u8>, value: u32) {
+    buf.extend_from_slice(&value.to_le_bytes());
+}
+
+fn push_u64(buf: &mut Vec<u8>, value: u64) {
+    buf.extend_from_slice(&value.to_le_bytes());
+}
+
+/// An NT_PRSTATUS note for a vCPU.
+fn prstatus_note(notes: &mut Vec<u8>, hart_id: u64, vcpu: &VCpu) {
+    let mut desc = [0u8; PRSTATUS_SIZE];
+    // pr_pid: 0 means the idle task in crash.
+    desc[32..36].copy_from_slice(&(hart_id as u32 + 1).to_le_bytes());
+    desc[PRSTATUS_REG_OFFSET..PRSTATUS_REG_OFFSET + 8].copy_from_slice(&vcpu.sepc.to_le_bytes());
+    for reg in 1..32 {
+        let offset = PRSTATUS_REG_OFFSET + 8 * reg;
+        desc[offset..offset + 8].copy_from_slice(&vcpu.gpr(reg as u64).to_le_bytes());
+    }
+
+    push_u32(notes, 5); // namesz
+    push_u32(notes, PRSTATUS_SIZE as u32); // descsz
+    push_u32(notes, NT_PRSTATUS);
+    notes.extend_from_slice(b"CORE\0\0\0\0"); // padded to 4 bytes
+    notes.extend_from_slice(&desc);
+}
+
+/// Builds the ELF header, program headers, and notes. The guest RAM follows
+/// them from the next sector.
+fn build_headers(notes: &[u8]) -> Vec<u8> {
+    let num_phdrs = 2;
+    let notes_offset = EHDR_SIZE + PHDR_SIZE * num_phdrs;
+    let memory_offset = (notes_offset + notes.len()).next_multiple_of(SECTOR_SIZE as usize);
+
+    let mut buf = Vec::new();
+    buf.extend_from_slice(b"\x7fELF");
+    buf.extend_from_slice(&[2 /* 64-bit */, 1 /* little-endian */, 1 /* version */]);
+    buf.resize(16, 0);
+    push_u16(&mut buf, ET_CORE);
+    push_u16(&mut buf, EM_RISCV);
+    push_u32(&mut buf, 1); // e_version
+    push_u64(&mut buf, 0); // e_entry
+    push_u64(&mut buf, EHDR_SIZE as u64); // e_phoff
+    push_u64(&mut buf, 0); // e_shoff
+    push_u32(&mut buf, 0); // e_flags
+    push_u16(&mut buf, EHDR_SIZE as u16);
+    push_u16(&mut buf, PHDR_SIZE as u16);
+    push_u16(&mut buf, num_phdrs as u16);
+    push_u16(&mut buf, 0); // e_shentsize
+    push_u16(&mut buf, 0); // e_shnum
+    push_u16(&mut buf, 0); // e_shstrndx
+
+    // p_type, p_flags, p_offset, p_vaddr, p_paddr, p_filesz, p_memsz, p_align
+    push_u32(&mut buf, PT_NOTE);
+    push_u32(&mut buf, 0);
+    push_u64(&mut buf, notes_offset as u64);
+    push_u64(&mut buf, 0);
+    push_u64(&mut buf, 0);
+    push_u64(&mut buf, notes.len() as u64);
+    push_u64(&mut buf, 0);
+    push_u64(&mut buf, 4);
+
+    let memory_size = GUEST_MEMORY.size() as u64;
+    push_u32(&mut buf, PT_LOAD);
+    push_u32(&mut buf, PF_RWX);
+    push_u64(&mut buf, memory_offset as u64);
+    push_u64(&mut buf, GUEST_MEMORY.guest_base());
+    push_u64(&mut buf, GUEST_MEMORY.guest_base());
+    push_u64(&mut buf, memory_size);
+    push_u64(&mut buf, memory_size);
+    push_u64(&mut buf, 0x1000);
+
+    buf.extend_from_slice(notes);
+    buf.resize(memory_offset, 0);
+    buf
+}
+
+/// Dumps the guest. All vCPUs except `current` must be paused.
+pub fn dump(current: &mut VCpu) -> Result<(), String> {
+    let mut notes = Vec::new();
+    for_each_vcpu(current, |hart_id, vcpu| {
+        prstatus_note(&mut notes, hart_id, vcpu);
+        Ok(())
+    })?;
+
+    let mut headers = build_headers(&notes);
+
+    let mut disk = DUMP_DISK.lock();
+    if disk.is_none() {
+        *disk = HostBlk::open(DUMP_DISK_SERIAL);
+    }
+
+    let Some(disk) = disk.as_mut() else {
+        return Err(String::from("dump disk (serial=dump) not found"));
+    };
+
+    let encrypted_header = encryption::is_enabled().then(|| encrypted_header(headers.len()));
+    let header_len = encrypted_header.as_ref().map_or(0, |header| header.len());
+    let total_size = header_len + headers.len() + GUEST_MEMORY.size();
+    if (total_size as u64).div_ceil(SECTOR_SIZE) > disk.capacity() {
+        return Err(format!("dump disk is too small (need {} KB)", total_size / 1024));
+    }
+
+    let headers_sector = header_len as u64 / SECTOR_SIZE;
+    let memory_sector = headers_sector + headers.len() as u64 / SECTOR_SIZE;
+    if let Some(mut header) = encrypted_header {
+        let nonce_prefix = encryption::new_nonce_prefix();
+        header[28..36].copy_from_slice(&nonce_prefix);
+        let mut tags = vec![encryption::seal(&nonce_prefix, 0, &[], &mut headers)];
+        tags.extend(encryption::write_memory(disk, memory_sector, &nonce_prefix, 1)?);
+        header[36..36 + tags.len() * TAG_LEN].copy_from_slice(&tags.concat());
+
+        disk_io(disk, VIRTIO_BLK_T_OUT, 0, header.as_mut_ptr(), header.len())?;
+        disk_io(disk, VIRTIO_BLK_T_OUT, headers_sector, headers.as_mut_ptr(), headers.len())?;
+    } else {
+        disk_io(disk, VIRTIO_BLK_T_OUT, 0, headers.as_mut_ptr(), headers.len())?;
+        let memory = GUEST_MEMORY.host_addr(GUEST_MEMORY.guest_base());
+        disk_io(disk, VIRTIO_BLK_T_OUT, memory_sector, memory, GUEST_MEMORY.size())?;
+    }
+
+    info!("dump", "wrote {} KB to the dump disk", total_size / 1024);
+    Ok(())
+}
+
+/// The header of an encrypted dump, without the nonce prefix and the tags.
+fn encrypted_header(headers_len: usize) -> Vec<u8> {
+    let num_tags = 1 + encryption::num_chunks(GUEST_MEMORY.size());
+    let mut header = Vec::new();
+    header.extend_from_slice(ENCRYPTED_MAGIC);
+    push_u32(&mut header, ENCRYPTED_VERSION);
+    push_u64(&mut header, headers_len as u64);
+    push_u64(&mut header, GUEST_MEMORY.size() as u64);
+    header.resize((36 + num_tags * TAG_LEN).next_multiple_of(SECTOR_SIZE as usize), 0);
+    header
+}
@@ -0,0 +1,210 @@
+//! Copy-on-write disk (`-disk cow`). Reads come from a read-only base image
+//! (`serial=disk`) until written, and writes go to an overlay
+//! (`serial=overlay`): many guests can boot from one base image, each with
+//! its own sparse overlay file.
+//!
+//! The overlay is in our own simple format, created on first use:
+//!
+//! ```text
+//! sector 0  | header: magic, version, cluster size, disk size
+//! sector 1- | bitmap: whether each cluster has been copied to the overlay
+//! data      | sector N of the disk at `data_sector + N` (from the next cluster)
+//! ```
+//!
+//! A cluster is copied from the base on its first write. Clusters never
+//! written take no space in the overlay file.
+use alloc::{boxed::Box, format, string::String, vec, vec::Vec};
+
+use crate::{
+    host_blk::{
+        HostBlk, SECTOR_SIZE, VIRTIO_BLK_S_IOERR, VIRTIO_BLK_S_OK, VIRTIO_BLK_T_FLUSH, VIRTIO_BLK_T_IN,
+        VIRTIO_BLK_T_OUT,
+    },
+    virtio_blk::BlockBackend,
+};
+
+const MAGIC: &[u8; 8] = b"HVCOWDSK";
+const FORMAT_VERSION: u32 = 1;
+/// 64KB clusters.
+const CLUSTER_SECTORS: u64 = 128;
+
+/// Splits `len` bytes from `sector` at cluster boundaries. Yields (sector,
+/// offset in the buffer, length).
+fn split_by_cluster(sector: u64, len: usize) -> impl Iterator<Item = (u64, usize, usize)> {
+    let mut offset = 0;
+    core::iter::from_fn(move || {
+        if offset >= len {
+            return None;
+        }
+
+        let chunk_sector = sector + offset as u64 / SECTOR_SIZE;
+        let cluster_end = (chunk_sector / CLUSTER_SECTORS + 1) * CLUSTER_SECTORS;
+        let chunk_len = (((cluster_end - chunk_sector) * SECTOR_SIZE) as usize).min(len - offset);
+        let chunk = (chunk_sector, offset, chunk_len);
+        offset += chunk_len;
+        Some(chunk)
+    })
+}
+
+pub struct CowBackend {
+    base: HostBlk,
+    overlay: HostBlk,
+    /// 1 bit per cluster: set if the cluster is in the overlay.
+    bitmap: Vec<u8>,
+    /// Where the disk data starts in the overlay.
+    data_sector: u64,
+}
+
+impl CowBackend {
+    /// Opens the overlay, or formats it if it's zero-filled.
+    pub fn open(base: HostBlk, mut overlay: HostBlk) -> Result<CowBackend, String> {
+        let capacity = base.capacity();
+        let num_clusters = capacity.div_ceil(CLUSTER_SECTORS);
+        let bitmap_sectors = num_clusters.div_ceil(8).div_ceil(SECTOR_SIZE);
+        let data_sector = (1 + bitmap_sectors).next_multiple_of(CLUSTER_SECTORS);
+        let required = data_sector + num_clusters * CLUSTER_SECTORS;
+        if overlay.capacity() < required {
+            return Err(format!("overlay disk is too small (need {} KB)", required * SECTOR_SIZE / 1024));
+        }
+
+        let mut header = vec![0u8; SECTOR_SIZE as usize];
+        if overlay.request(VIRTIO_BLK_T_IN, 0, header.as_mut_ptr(), header.len()) != VIRTIO_BLK_S_OK {
+            return Err(String::from("failed to read the overlay header"));
+        }
+
+        if &header[0..8] == MAGIC {
+            let version = u32::from_le_bytes(header[8..12].try_into().unwrap());
+            let cluster_sectors = u32::from_le_bytes(header[12..16].try_into().unwrap()) as u64;
+            let overlay_capacity = u64::from_le_bytes(header[16..24].try_into().unwrap());
+            if version != FORMAT_VERSION || cluster_sectors != CLUSTER_SECTORS {
+                return Err(format!("unsupported overlay (version={}, cluster={})", version, cluster_sectors));
+            }
+
+            if overlay_capacity != capacity {
+                return Err(format!("overlay is for a {} KB base image", overlay_capacity * SECTOR_SIZE / 1024));
+            }
+        } else if header.iter().all(|&byte| byte == 0) {
+            // A new overlay. The bitmap is zero-filled already.
+            header[0..8].copy_from_slice(MAGIC);
+            header[8..12].copy_from_slice(&FORMAT_VERSION.to_le_bytes());
+            header[12..16].copy_from_slice(&(CLUSTER_SECTORS as u32).to_le_bytes());
+            header[16..24].copy_from_slice(&capacity.to_le_bytes());
+            if overlay.request(VIRTIO_BLK_T_OUT, 0, header.as_mut_ptr(), header.len()) != VIRTIO_BLK_S_OK {
+                return Err(String::from("failed to format the overlay"));
+            }
+
+            info!("cow-disk", "formatted the overlay disk");
+        } else {
+            return Err(String::from("overlay disk is neither an overlay nor zero-filled"));
+        }
+
+        let mut bitmap = vec![0u8; (bitmap_sectors * SECTOR_SIZE) as usize];
+        if overlay.request(VIRTIO_BLK_T_IN, 1, bitmap.as_mut_ptr(), bitmap.len()) != VIRTIO_BLK_S_OK {
+            return Err(String::from("failed to read the overlay bitmap"));
+        }
+
+        let copied: u32 = bitmap.iter().map(|byte| byte.count_ones()).sum();
+        info!("cow-disk", "{} of {} clusters in the overlay", copied, num_clusters);
+        Ok(CowBackend { base, overlay, bitmap, data_sector })
+    }
+
+    /// Whether `len` bytes from `sector` are within the disk.
+    fn contains(&self, sector: u64, len: usize) -> bool {
+        sector.checked_add((len as u64).div_ceil(SECTOR_SIZE)).is_some_and(|end| end <= self.base.capacity())
+    }
+
+    fn is_copied(&self, cluster: u64) -> bool {
+        self.bitmap[(cluster / 8) as usize] & (1 << (cluster % 8)) != 0
+    }
+
+    /// Copies a cluster from the base to the overlay, with `data` at
+    /// `sector` written over it.
+    fn copy_cluster(&mut self, cluster: u64, sector: u64, data: &[u8]) -> u8 {
+        let start = cluster * CLUSTER_SECTORS;
+        // The last cluster may go beyond the end of the disk.
+        let num_sectors = CLUSTER_SECTORS.min(self.base.capacity() - start);
+        let mut buf = vec![0u8; (num_sectors * SECTOR_SIZE) as usize];
+        if data.len() < buf.len() {
+            let status = self.base.request(VIRTIO_BLK_T_IN, start, buf.as_mut_ptr(), buf.len());
+            if status != VIRTIO_BLK_S_OK {
+                return status;
+            }
+        }
+
+        let offset = ((sector - start) * SECTOR_SIZE) as usize;
+        buf[offset..offset + data.len()].copy_from_slice(data);
+        let status = self.overlay.request(VIRTIO_BLK_T_OUT, self.data_sector + start, buf.as_mut_ptr(), buf.len());
+        if status != VIRTIO_BLK_S_OK {
+            return status;
+        }
+
+        // Update the bitmap after the data: if we stop in between, only
+        // this write is lost.
+        self.bitmap[(cluster / 8) as usize] |= 1 << (cluster % 8);
+        let bitmap_sector = cluster / 8 / SECTOR_SIZE;
+        let bitmap_offset = (bitmap_sector * SECTOR_SIZE) as usize;
+        let bitmap = self.bitmap[bitmap_offset..].as_mut_ptr();
+        self.overlay.request(VIRTIO_BLK_T_OUT, 1 + bitmap_sector, bitmap, SECTOR_SIZE as usize)
+    }
+}
+
+impl BlockBackend for CowBackend {
+    fn capacity(&self) -> u64 {
+        self.base.capacity()
+    }
+
+    fn read(&mut self, sector: u64, buf: &mut [u8]) -> u8 {
+        if !self.contains(sector, buf.len()) {
+            return VIRTIO_BLK_S_IOERR;
+        }
+
+        for (sector, offset, len) in split_by_cluster(sector, buf.len()) {
+            let chunk = buf[offset..offset + len].as_mut_ptr();
+            let status = if self.is_copied(sector / CLUSTER_SECTORS) {
+                self.overlay.request(VIRTIO_BLK_T_IN, self.data_sector + sector, chunk, len)
+            } else {
+                self.base.request(VIRTIO_BLK_T_IN, sector, chunk, len)
+            };
+
+            if status != VIRTIO_BLK_S_OK {
+                return status;
+            }
+        }
+
+        VIRTIO_BLK_S_OK
+    }
+
+    fn write(&mut self, sector: u64, buf: &[u8]) -> u8 {
+        // copy_cluster assumes the clusters are within the disk.
+        if !self.contains(sector, buf.len()) {
+            return VIRTIO_BLK_S_IOERR;
+        }
+
+        for (sector, offset, len) in split_by_cluster(sector, buf.len()) {
+            let chunk = &buf[offset..offset + len];
+            let cluster = sector / CLUSTER_SECTORS;
+            let status = if self.is_copied(cluster) {
+                let data_sector = self.data_sector + sector;
+                self.overlay.request(VIRTIO_BLK_T_OUT, data_sector, chunk.as_ptr() as *mut u8, len)
+            } else {
+                self.copy_cluster(cluster, sector, chunk)
+            };
+
+            if status != VIRTIO_BLK_S_OK {
+                return status;
+            }
+        }
+
+        VIRTIO_BLK_S_OK
+    }
+
+    fn flush(&mut self) -> u8 {
+        // The base is never written.
+        self.overlay.request(VIRTIO_BLK_T_FLUSH, 0, core::ptr::null_mut(), 0)
+    }
+
+    fn close(self: Box<Self>) {
+        self.base.close();
+        self.overlay.close();
+    }
+}
@@ -0,0 +1,183 @@
+//! `-cpu-quota <percent>`: caps the time each vCPU spends in the guest, like
+//! the CFS bandwidth controller (cpu.max in cgroup v2). In every period a
+//! vCPU may run for `percent` of it. Once the budget is used up, the hart
+//! sleeps until the next period.
+//!
+//! The time in the guest includes its WFI: an idle vCPU uses the budget too,
+//! and its interrupts may be delayed until the next period.
+//!
+//! A vCPU throttled while holding a lock makes the others spin on it until
+//! the next period. A spinning vCPU can give the rest of its budget to the
+//! lock holder with the yield hypercall (see hypercall.rs), which also wakes
+//! the holder up if it's throttled.
+use core::arch::asm;
+use spin::Mutex;
+
+use crate::{
+    config::config,
+    sbi,
+    smp::{self, MAX_VCPUS},
+    timer::{self, NO_DEADLINE, TIMEBASE_FREQ},
+    vcpu::VCpu,
+};
+
+/// 100 ms, the default period of CFS bandwidth control.
+const PERIOD: u64 = TIMEBASE_FREQ / 10;
+
+#[derive(Clone, Copy)]
+struct Quota {
+    period_start: u64,
+    /// Time in the guest in this period, in ticks.
+    used: u64,
+    /// When the vCPU entered the guest last time. 0 if not yet.
+    entered_at: u64,
+    /// The earliest time the budget may run out.
+    deadline: u64,
+    /// Budget given by other vCPUs in this period, in ticks.
+    donated: u64,
+    /// Budget given to other vCPUs in this period, in ticks.
+    given: u64,
+    /// Whether the vCPU has yielded: it's throttled until the next period or
+    /// until another vCPU yields to it.
+    yielded: bool,
+    /// Whether the hart sleeps until the next period.
+    throttled: bool,
+}
+
+impl Quota {
+    fn start_period(&mut self, now: u64, budget: u64) {
+        self.period_start = now;
+        self.used = 0;
+        self.donated = 0;
+        self.given = 0;
+        self.yielded = false;
+        self.deadline = now + budget;
+    }
+
+    /// The time the vCPU may run in this period.
+    fn allowance(&self, budget: u64) -> u64 {
+        (budget + self.donated).saturating_sub(self.given)
+    }
+
+    fn exhausted(&self, budget: u64) -> bool {
+        self.yielded || self.used >= self.allowance(budget)
+    }
+}
+
+static QUOTAS: [Mutex<Quota>; MAX_VCPUS] = [const {
+    Mutex::new(Quota {
+        period_start: 0,
+        used: 0,
+        entered_at: 0,
+        deadline: NO_DEADLINE,
+        donated: 0,
+        given: 0,
+        yielded: false,
+        throttled: false,
+    })
+}; MAX_VCPUS];
+
+fn budget() -> Option<u64> {
+    config().cpu_quota.map(|percent| PERIOD * percent / 100)
+}
+
+/// When to preempt the vCPU to check its budget.
+pub fn deadline(vcpu_id: u64) -> u64 {
+    match budget() {
+        Some(_) => QUOTAS[vcpu_id as usize].lock().deadline,
+        None => NO_DEADLINE,
+    }
+}
+
+/// Charges the time in the guest until the VM exit at `start`, and throttles
+/// the vCPU if it has used up its budget. Call this right before returning
+/// to the guest.
+pub fn account(vcpu: &VCpu, start: u64) {
+    let Some(budget) = budget() else {
+        return;
+    };
+
+    let mut quota = QUOTAS[vcpu.hart_id as usize].lock();
+    if quota.entered_at != 0 {
+        quota.used += start - quota.entered_at;
+    }
+
+    let now = timer::now();
+    let period_end = quota.period_start + PERIOD;
+    let rearm = if now >= period_end {
+        quota.start_period(now, budget);
+        true
+    } else if quota.exhausted(budget) {
+        // Sleep until the next period or until another vCPU yields to us.
+        // Interrupts stay pending until we return to the guest.
+        quota.throttled = true;
+        drop(quota);
+        sbi::set_timer(period_end).expect("failed to set the host timer");
+        loop {
+            unsafe { asm!("wfi") };
+            let quota = QUOTAS[vcpu.hart_id as usize].lock();
+            if timer::now() >= period_end || !quota.exhausted(budget) {
+                break;
+            }
+        }
+
+        quota = QUOTAS[vcpu.hart_id as usize].lock();
+        quota.throttled = false;
+        let now = timer::now();
+        if now >= period_end {
+            quota.start_period(now, budget);
+        } else {
+            quota.deadline = now + (quota.allowance(budget) - quota.used);
+        }
+        true
+    } else if now >= quota.deadline {
+        // Exits have taken some time: the budget runs out later.
+        quota.deadline = now + (quota.allowance(budget) - quota.used);
+        true
+    } else {
+        false
+    };
+
+    quota.entered_at = timer::now();
+    drop(quota);
+    if rearm {
+        timer::rearm(vcpu);
+    }
+}
+
+/// Directed yield: gives the rest of this vCPU's budget in this period to
+/// `target` (any throttled vCPU if None), and throttles this vCPU until the
+/// next period. Returns the vCPU it has yielded to, if any. Nothing to do
+/// without `-cpu-quota`: each vCPU has a hart of its own.
+pub fn yield_to(vcpu: &VCpu, target: Option<u64>) -> Option<u64> {
+    let budget = budget()?;
+    let num_vcpus = smp::num_vcpus() as u64;
+    let target = target.or_else(|| {
+        (1..num_vcpus)
+            .map(|i| (vcpu.hart_id + i) % num_vcpus)
+            .find(|&id| QUOTAS[id as usize].lock().throttled)
+    })?;
+
+    if target == vcpu.hart_id {
+        return None;
+    }
+
+    // Don't hold both locks: the target may be yielding to us.
+    let remaining = {
+        let mut quota = QUOTAS[vcpu.hart_id as usize].lock();
+        let used = quota.used + (timer::now() - quota.entered_at);
+        let remaining = quota.allowance(budget).saturating_sub(used);
+        quota.given += remaining;
+        quota.yielded = true;
+        remaining
+    };
+
+    let mut quota = QUOTAS[target as usize].lock();
+    quota.donated += remaining;
+    quota.yielded = false;
+    debug!("cpu-quota", "vCPU {} yields {} ticks to vCPU {}", vcpu.hart_id, remaining, target);
+    if quota.throttled {
+        sbi::send_ipi(smp::physical_hart_id(target)).expect("failed to send IPI");
+    }
+    Some(target)
+}
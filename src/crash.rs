@@ -0,0 +1,234 @@
+//! Guest crash detection (`-on-crash exit|restart|pause`).
+//!
+//! The guest has crashed if it requests SBI system reset with
+//! SYSTEM_FAILURE, or if Linux prints a panic message to the console. After
+//! a panic, Linux reboots (`panic=-1`) or halts after printing the
+//! "end Kernel panic" line: we handle the crash on either. With `-pvpanic`,
+//! Linux reports the panic as soon as it happens instead (see pvpanic.rs).
+//!
+//! With `-crash-dump`, the guest memory is dumped (see core_dump.rs) before
+//! the action.
+//!
+//! With `exit`, the hypervisor exits with 1, or with the exit status of
+//! init if Linux has panicked because init has exited (see host_test.rs).
+//!
+//! With `restart`, repeated crashes wait exponentially longer before the
+//! next restart, so that a broken guest doesn't keep the host busy.
+use alloc::format;
+use core::{
+    arch::asm,
+    sync::atomic::{AtomicBool, AtomicU32, AtomicU64, Ordering},
+};
+
+use crate::{
+    config::{CrashAction, config},
+    console_log, core_dump, gdb, host_test, hotplug,
+    json::quote,
+    linux_loader::{self, GUEST_DTB_ADDR},
+    monitor, nested, pci, plic, rtc, sbi, smp, symbols,
+    timer::{self, TIMEBASE_FREQ},
+    vcpu::VCpu,
+    virtio_9p, virtio_balloon, virtio_blk, virtio_console, virtio_fs, virtio_input, virtio_mem, virtio_net, virtio_rng,
+    virtio_vsock, watchdog,
+};
+
+/// The delay before the first restart. Doubled on each crash in a row.
+const INITIAL_BACKOFF_MS: u64 = 1000;
+const MAX_BACKOFF_MS: u64 = 60 * 1000;
+/// Crashes are no longer "in a row" if the guest has run for this long.
+const STABLE_MS: u64 = 5 * 60 * 1000;
+/// The lines of the guest console in a crash report.
+const REPORT_CONSOLE_LINES: usize = 50;
+
+/// Linux has printed "Kernel panic - not syncing".
+static PANICKING: AtomicBool = AtomicBool::new(false);
+/// Linux has printed the whole panic message and halts.
+static HALTED: AtomicBool = AtomicBool::new(false);
+/// Linux has reported a panic through pvpanic.
+static REPORTED: AtomicBool = AtomicBool::new(false);
+/// The exit code of init, if it has exited. NO_EXIT_CODE if not.
+static INIT_EXIT_CODE: AtomicU32 = AtomicU32::new(NO_EXIT_CODE);
+const NO_EXIT_CODE: u32 = u32::MAX;
+static CRASHES_IN_A_ROW: AtomicU32 = AtomicU32::new(0);
+/// When the guest has been restarted last time.
+static STARTED_AT: AtomicU64 = AtomicU64::new(0);
+
+fn contains(line: &[u8], pattern: &[u8]) -> bool {
+    line.windows(pattern.len()).any(|window| window == pattern)
+}
+
+/// Parses "Attempted to kill init! exitcode=0x00000100": the wait status of
+/// init. Returns the exit code as a shell does, e.g. 128 + 9 if killed.
+fn parse_init_exit_code(line: &[u8]) -> Option<u32> {
+    const PATTERN: &[u8] = b"Attempted to kill init! exitcode=0x";
+    let start = line.windows(PATTERN.len()).position(|window| window == PATTERN)? + PATTERN.len();
+    let hex = core::str::from_utf8(line.get(start..start + 8)?).ok()?;
+    let status = u32::from_str_radix(hex, 16).ok()?;
+    Some(if status & 0x7f == 0 { (status >> 8) & 0xff } else { 128 + (status & 0x7f) })
+}
+
+/// Looks for a panic message in a line of the guest console.
+pub fn scan_console_line(line: &[u8]) {
+    if contains(line, b"---[ end Kernel panic") {
+        HALTED.store(true, Ordering::Release);
+    } else if contains(line, b"Kernel panic - not syncing") {
+        PANICKING.store(true, Ordering::Release);
+        if let Some(code) = parse_init_exit_code(line) {
+            INIT_EXIT_CODE.store(code, Ordering::Release);
+        }
+    }
+}
+
+/// Whether the guest is panicking: a system reset request means a crash.
+pub fn is_panicking() -> bool {
+    PANICKING.load(Ordering::Acquire)
+}
+
+/// Whether the guest has halted after a panic, or has reported one.
+pub fn has_halted() -> bool {
+    HALTED.load(Ordering::Acquire) || REPORTED.load(Ordering::Acquire)
+}
+
+/// The guest has panicked, says pvpanic.
+pub fn report_panic() {
+    REPORTED.store(true, Ordering::Release);
+}
+
+/// Handles a crash of the guest as specified by `-on-crash`.
+pub fn handle(vcpu: &mut VCpu) -> ! {
+    smp::pause_others(vcpu);
+    let action = match config().on_crash {
+        CrashAction::Exit => "poweroff",
+        CrashAction::Restart => "reset",
+        CrashAction::Pause => "pause",
+    };
+
+    error!(
+        "crash",
+        "the guest has crashed on vCPU {} at guest PC {} (action: {})",
+        vcpu.hart_id,
+        symbols::describe(vcpu.sepc),
+        action
+    );
+    let console = console_log::tail(Some(REPORT_CONSOLE_LINES));
+    if !console.is_empty() {
+        error!("crash", "the last guest console output:");
+        for line in console.lines() {
+            error!("crash", "| {}", line);
+        }
+    }
+
+    let source = if REPORTED.load(Ordering::Acquire) {
+        "pvpanic"
+    } else if is_panicking() {
+        "console"
+    } else {
+        "system-failure"
+    };
+    monitor::event(
+        "GUEST_PANICKED",
+        &format!("{{\"action\": \"{}\", \"source\": \"{}\", \"console\": {}}}", action, source, quote(&console)),
+    );
+    if config().crash_dump {
+        match core_dump::dump(vcpu) {
+            Ok(()) => info!("crash", "dumped the guest memory"),
+            Err(err) => error!("crash", "failed to dump the guest memory: {}", err),
+        }
+    }
+
+    match config().on_crash {
+        CrashAction::Exit => {
+            let code = match INIT_EXIT_CODE.load(Ordering::Acquire) {
+                NO_EXIT_CODE => host_test::EXIT_FAILURE,
+                code => {
+                    info!("crash", "init has exited with code {}", code);
+                    code
+                }
+            };
+
+            monitor::event("SHUTDOWN", &format!("{{\"guest\": true, \"reason\": \"guest-panic\", \"code\": {}}}", code));
+            let result = host_test::exit(code);
+            panic!("[crash] failed to shut down: {:?}", result);
+        }
+        CrashAction::Restart => restart(vcpu),
+        CrashAction::Pause => park(vcpu),
+    }
+}
+
+/// Keeps the VM paused. GDB and the monitor can still inspect it.
+pub fn park(vcpu: &mut VCpu) -> ! {
+    info!("crash", "the VM is paused");
+    loop {
+        if config().gdb {
+            gdb::handle_interrupt(vcpu);
+        }
+
+        if config().monitor {
+            monitor::handle_interrupt(vcpu);
+        }
+
+        core::hint::spin_loop();
+    }
+}
+
+/// Waits for the backoff, and boots the guest again.
+fn restart(vcpu: &mut VCpu) -> ! {
+    let now = timer::now();
+    if now - STARTED_AT.load(Ordering::Relaxed) > STABLE_MS * (TIMEBASE_FREQ / 1000) {
+        CRASHES_IN_A_ROW.store(0, Ordering::Relaxed);
+    }
+
+    let crashes = CRASHES_IN_A_ROW.fetch_add(1, Ordering::Relaxed);
+    let backoff_ms = (INITIAL_BACKOFF_MS << crashes.min(16)).min(MAX_BACKOFF_MS);
+    warn!("crash", "restarting the guest in {} ms ({} crashes in a row)", backoff_ms, crashes + 1);
+    let deadline = now + backoff_ms * (TIMEBASE_FREQ / 1000);
+    // Sleep instead of spinning: reboot rearms the timer for the guest.
+    sbi::set_timer(deadline).expect("failed to set the host timer");
+    while timer::now() < deadline {
+        unsafe { asm!("wfi") };
+    }
+
+    reboot(vcpu, "guest-panic");
+}
+
+/// Resets the devices and the vCPUs, and boots the kernel again on this vCPU.
+/// The other vCPUs must be paused.
+pub fn reboot(vcpu: &mut VCpu, reason: &str) -> ! {
+    virtio_net::reset();
+    virtio_blk::reset();
+    virtio_console::reset();
+    virtio_9p::reset();
+    virtio_fs::reset();
+    virtio_rng::reset();
+    virtio_balloon::reset();
+    virtio_mem::reset();
+    virtio_vsock::reset();
+    virtio_input::reset();
+    hotplug::reset();
+    watchdog::reset();
+    rtc::reset();
+    pci::reset();
+    plic::reset();
+    let entry = linux_loader::reload_linux_kernel();
+    smp::stop_paused_vcpus();
+
+    PANICKING.store(false, Ordering::Release);
+    HALTED.store(false, Ordering::Release);
+    REPORTED.store(false, Ordering::Release);
+    INIT_EXIT_CODE.store(NO_EXIT_CODE, Ordering::Release);
+    STARTED_AT.store(timer::now(), Ordering::Relaxed);
+
+    nested::reset(vcpu);
+    vcpu.reset(entry);
+    vcpu.a0 = vcpu.hart_id;
+    vcpu.a1 = GUEST_DTB_ADDR;
+    vcpu.restore_vs_csrs();
+    timer::rearm(vcpu);
+    unsafe {
+        asm!("fence.i");
+    }
+
+    monitor::event("RESET", &format!("{{\"guest\": true, \"reason\": \"{}\"}}", reason));
+    smp::resume_others();
+    vcpu.run();
+}
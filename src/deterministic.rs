@@ -0,0 +1,114 @@
+//! `-deterministic <seed>`: the guest's sources of randomness and time come
+//! from a seeded PRNG, so that a flaky test fails the same way again with
+//! the same seed:
+//!
+//! - virtio-rng returns the PRNG's output instead of the host's entropy.
+//! - The guest time (the `time` CSR) starts at a value picked by the PRNG.
+//! - The RTC (and the host time hypercall) starts at a date picked by the
+//!   PRNG in 2020, and follows the guest time instead of the host's clock.
+//!
+//! Time still passes as on the host: interrupts and the guest's scheduling
+//! are not reproduced, only the values the guest reads.
+use spin::Once;
+
+use crate::{
+    snapshot::{Reader, Writer},
+    timer::{self, TIMEBASE_FREQ},
+};
+
+/// 2020-01-01T00:00:00Z.
+const RTC_EPOCH_SECS: u64 = 1_577_836_800;
+const SECS_PER_YEAR: u64 = 365 * 24 * 60 * 60;
+/// The guest time starts within its first hour.
+const MAX_START_TICKS: u64 = 60 * 60 * TIMEBASE_FREQ;
+
+struct State {
+    seed: u64,
+    /// The RTC time at guest time 0, in nanoseconds since the epoch.
+    rtc_base: u64,
+}
+
+static STATE: Once<State> = Once::new();
+
+fn splitmix64(x: &mut u64) -> u64 {
+    *x = x.wrapping_add(0x9e37_79b9_7f4a_7c15);
+    let mut z = *x;
+    z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+    z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+    z ^ (z >> 31)
+}
+
+/// xoshiro256**.
+pub struct Prng {
+    s: [u64; 4],
+}
+
+impl Prng {
+    fn new(mut seed: u64) -> Prng {
+        Prng { s: [(); 4].map(|_| splitmix64(&mut seed)) }
+    }
+
+    pub fn next_u64(&mut self) -> u64 {
+        let s = &mut self.s;
+        let result = s[1].wrapping_mul(5).rotate_left(7).wrapping_mul(9);
+        let t = s[1] << 17;
+        s[2] ^= s[0];
+        s[3] ^= s[1];
+        s[1] ^= s[2];
+        s[0] ^= s[3];
+        s[2] ^= t;
+        s[3] = s[3].rotate_left(45);
+        result
+    }
+
+    pub fn fill(&mut self, buf: &mut [u8]) {
+        for chunk in buf.chunks_mut(8) {
+            let bytes = self.next_u64().to_le_bytes();
+            chunk.copy_from_slice(&bytes[..chunk.len()]);
+        }
+    }
+
+    pub fn save(&self, w: &mut Writer) {
+        for word in self.s {
+            w.u64(word);
+        }
+    }
+
+    pub fn load(&mut self, r: &mut Reader) -> Option<()> {
+        for word in &mut self.s {
+            *word = r.u64()?;
+        }
+        Some(())
+    }
+}
+
+/// A PRNG of its own for each user (`name`), so that one doesn't shift the
+/// others' values.
+pub fn stream(seed: u64, name: &str) -> Prng {
+    // FNV-1a of the name.
+    let hash = name.bytes().fold(0xcbf2_9ce4_8422_2325u64, |h, b| (h ^ b as u64).wrapping_mul(0x100_0000_01b3));
+    Prng::new(seed ^ hash)
+}
+
+/// The PRNG for `name`, e.g. "virtio-rng". None if not enabled.
+pub fn prng(name: &str) -> Option<Prng> {
+    Some(stream(STATE.get()?.seed, name))
+}
+
+/// Picks the start times. Call this after timer::init and before the vCPUs
+/// start. A snapshot or a migration sets the guest time again.
+pub fn init(seed: u64) {
+    let rtc_base = (RTC_EPOCH_SECS + stream(seed, "rtc").next_u64() % SECS_PER_YEAR) * 1_000_000_000;
+    STATE.call_once(|| State { seed, rtc_base });
+
+    let start = stream(seed, "time").next_u64() % MAX_START_TICKS;
+    timer::set_guest_time(start);
+    info!("deterministic", "seed {}: the guest time starts at {} ticks", seed, start);
+}
+
+/// The wall-clock time for the guest in nanoseconds since the epoch: the
+/// RTC time picked by the PRNG plus the guest time. None if not enabled.
+pub fn wall_clock() -> Option<u64> {
+    let state = STATE.get()?;
+    Some(state.rtc_base + timer::ticks_to_ns(timer::guest_now()))
+}
@@ -0,0 +1,331 @@
+//! Generates the guest device tree from the configuration.
+use alloc::{format, vec::Vec};
+use vm_fdt::{Error, FdtWriter};
+
+use crate::{
+    config::{FramebufferConfig, config},
+    dt_overlay, framebuffer,
+    guest_memory::{DTB_MEMORY, GUEST_MEMORY},
+    hotplug, identity,
+    linux_loader::GUEST_FB_ADDR,
+    machine, plic, reserved_mem,
+    smp::{self, MAX_VCPUS},
+    timer::{self, TIMEBASE_FREQ},
+    virtio_input, watchdog,
+};
+
+const PLIC_PHANDLE: u32 = 1;
+
+fn cpu_intc_phandle(hart_id: u32) -> u32 {
+    PLIC_PHANDLE + 1 + hart_id
+}
+
+const WATCHDOG_CLOCK_PHANDLE: u32 = PLIC_PHANDLE + 1 + MAX_VCPUS as u32;
+
+/// The labels a device tree overlay may refer to (see dt_overlay.rs).
+pub fn label_phandle(label: &str) -> Option<u32> {
+    match label {
+        "plic" => Some(PLIC_PHANDLE),
+        _ => None,
+    }
+}
+
+/// A virtio-mmio device: (base address, end address, IRQ).
+type VirtioMmioNode = (u64, u64, u32);
+
+/// The virtio-mmio devices enabled by the command line. With `-pci`, they
+/// are on the PCI bus instead, except hotplug slots and virtio-input.
+fn virtio_mmio_nodes() -> Vec<VirtioMmioNode> {
+    let mut nodes = Vec::new();
+    if config().pci {
+        nodes.extend((0..config().hotplug_slots).map(hotplug::slot));
+        if config().input {
+            nodes.extend((0..virtio_input::NUM_INPUTS).map(virtio_input::device));
+        }
+        return nodes;
+    }
+
+    if config().net.is_some() {
+        nodes.push(machine::device_region("virtio-net"));
+    }
+
+    if config().disk.is_some() {
+        nodes.push(machine::device_region("virtio-blk"));
+    }
+
+    if config().console.is_some() {
+        nodes.push(machine::device_region("virtio-console"));
+    }
+
+    if config().share.is_some() {
+        nodes.push(machine::device_region("virtio-9p"));
+    }
+
+    if config().fs.is_some() {
+        nodes.push(machine::device_region("virtio-fs"));
+    }
+
+    if config().rng.is_some() {
+        nodes.push(machine::device_region("virtio-rng"));
+    }
+
+    if config().balloon {
+        nodes.push(machine::device_region("virtio-balloon"));
+    }
+
+    if config().virtio_mem.is_some() {
+        nodes.push(machine::device_region("virtio-mem"));
+    }
+
+    if config().vsock.is_some() {
+        nodes.push(machine::device_region("virtio-vsock"));
+    }
+
+    nodes.extend((0..config().hotplug_slots).map(hotplug::slot));
+
+    if config().input {
+        nodes.extend((0..virtio_input::NUM_INPUTS).map(virtio_input::device));
+    }
+
+    nodes
+}
+
+/// vCPUs from `num_vcpus` to `max_vcpus` are disabled until `cpu-add`.
+fn add_cpus(fdt: &mut FdtWriter, num_vcpus: u32, max_vcpus: u32) -> Result<(), Error> {
+    let cpus_node = fdt.begin_node("cpus")?;
+    fdt.property_u32("#address-cells", 0x1)?;
+    fdt.property_u32("#size-cells", 0x0)?;
+    fdt.property_u32("timebase-frequency", TIMEBASE_FREQ as u32)?;
+
+    for hart_id in 0..max_vcpus {
+        let cpu_node = fdt.begin_node(&format!("cpu@{}", hart_id))?;
+        fdt.property_string("device_type", "cpu")?;
+        fdt.property_string("compatible", "riscv")?;
+        fdt.property_u32("reg", hart_id)?;
+        fdt.property_string("status", if hart_id < num_vcpus { "okay" } else { "disabled" })?;
+        fdt.property_string("mmu-type", "riscv,sv48")?;
+        fdt.property_string("riscv,isa", &config().isa.dt_string(timer::has_sstc()))?;
+
+        let intc_node = fdt.begin_node("interrupt-controller")?;
+        fdt.property_u32("#interrupt-cells", 1)?;
+        fdt.property_null("interrupt-controller")?;
+        fdt.property_string("compatible", "riscv,cpu-intc")?;
+        fdt.property_phandle(cpu_intc_phandle(hart_id))?;
+        fdt.end_node(intc_node)?;
+
+        fdt.end_node(cpu_node)?;
+    }
+
+    fdt.end_node(cpus_node)
+}
+
+fn add_plic(fdt: &mut FdtWriter, num_vcpus: u32) -> Result<(), Error> {
+    let (addr, end, _) = machine::device_region("plic");
+    let plic_node = fdt.begin_node(&format!("plic@{:x}", addr))?;
+    fdt.property_string("compatible", "riscv,plic0")?;
+    fdt.property_u32("#interrupt-cells", 1)?;
+    fdt.property_u32("#address-cells", 0)?;
+    fdt.property_null("interrupt-controller")?;
+    fdt.property_array_u64("reg", &[addr, end - addr])?;
+    fdt.property_u32("riscv,ndev", plic::NUM_SOURCES as u32 - 1)?;
+    // M-mode and S-mode external interrupt contexts for each hart.
+    let contexts: Vec<u32> = (0..num_vcpus)
+        .flat_map(|hart_id| [cpu_intc_phandle(hart_id), 11, cpu_intc_phandle(hart_id), 9])
+        .collect();
+    fdt.property_array_u32("interrupts-extended", &contexts)?;
+    fdt.property_phandle(PLIC_PHANDLE)?;
+    fdt.end_node(plic_node)
+}
+
+fn add_virtio_mmio(fdt: &mut FdtWriter, (addr, end, irq): VirtioMmioNode) -> Result<(), Error> {
+    let node = fdt.begin_node(&format!("virtio_mmio@{:x}", addr))?;
+    fdt.property_string("compatible", "virtio,mmio")?;
+    fdt.property_array_u64("reg", &[addr, end - addr])?;
+    fdt.property_u32("interrupt-parent", PLIC_PHANDLE)?;
+    fdt.property_u32("interrupts", irq)?;
+    fdt.end_node(node)
+}
+
+fn add_pci(fdt: &mut FdtWriter) -> Result<(), Error> {
+    let (ecam, ecam_end, irq) = machine::device_region("pci-ecam");
+    let (window, window_end, _) = machine::device_region("pci-mmio");
+    let node = fdt.begin_node(&format!("pci@{:x}", ecam))?;
+    fdt.property_string("compatible", "pci-host-ecam-generic")?;
+    fdt.property_string("device_type", "pci")?;
+    fdt.property_u32("#address-cells", 3)?;
+    fdt.property_u32("#size-cells", 2)?;
+    fdt.property_u32("#interrupt-cells", 1)?;
+    fdt.property_array_u32("bus-range", &[0, 0])?;
+    fdt.property_array_u64("reg", &[ecam, ecam_end - ecam])?;
+    fdt.property_null("dma-coherent")?;
+    // 32-bit memory space, mapped 1:1: (flags, PCI address, CPU address, size).
+    let size = window_end - window;
+    fdt.property_array_u32(
+        "ranges",
+        &[0x0200_0000, (window >> 32) as u32, window as u32, (window >> 32) as u32, window as u32, (size >> 32) as u32, size as u32],
+    )?;
+    // INTA-INTD by the slot number modulo 4 (the mask), swizzled over the 4
+    // lines.
+    let mut map = Vec::new();
+    for slot in 0..4 {
+        for pin in 1..=4 {
+            map.extend_from_slice(&[slot << 11, 0, 0, pin, PLIC_PHANDLE, irq + (slot + pin - 1) % 4]);
+        }
+    }
+    fdt.property_array_u32("interrupt-map", &map)?;
+    fdt.property_array_u32("interrupt-map-mask", &[0x1800, 0, 0, 7])?;
+    fdt.end_node(node)
+}
+
+fn add_watchdog(fdt: &mut FdtWriter) -> Result<(), Error> {
+    let clock_node = fdt.begin_node("watchdog-clock")?;
+    fdt.property_string("compatible", "fixed-clock")?;
+    fdt.property_u32("#clock-cells", 0)?;
+    fdt.property_u32("clock-frequency", watchdog::CLOCK_FREQ as u32)?;
+    fdt.property_phandle(WATCHDOG_CLOCK_PHANDLE)?;
+    fdt.end_node(clock_node)?;
+
+    let (addr, end, _) = machine::device_region("watchdog");
+    let node = fdt.begin_node(&format!("watchdog@{:x}", addr))?;
+    fdt.property_string("compatible", "snps,dw-wdt")?;
+    fdt.property_array_u64("reg", &[addr, end - addr])?;
+    fdt.property_u32("clocks", WATCHDOG_CLOCK_PHANDLE)?;
+    fdt.end_node(node)
+}
+
+fn add_rtc(fdt: &mut FdtWriter) -> Result<(), Error> {
+    let (addr, end, irq) = machine::device_region("rtc");
+    let node = fdt.begin_node(&format!("rtc@{:x}", addr))?;
+    fdt.property_string("compatible", "google,goldfish-rtc")?;
+    fdt.property_array_u64("reg", &[addr, end - addr])?;
+    fdt.property_u32("interrupt-parent", PLIC_PHANDLE)?;
+    fdt.property_u32("interrupts", irq)?;
+    fdt.end_node(node)
+}
+
+fn add_reserved_memory(fdt: &mut FdtWriter) -> Result<(), Error> {
+    let regions = reserved_mem::regions();
+    if regions.is_empty() {
+        return Ok(());
+    }
+
+    let reserved_node = fdt.begin_node("reserved-memory")?;
+    fdt.property_u32("#address-cells", 0x2)?;
+    fdt.property_u32("#size-cells", 0x2)?;
+    fdt.property_null("ranges")?;
+    for region in regions {
+        let node = fdt.begin_node(&format!("{}@{:x}", region.name, region.base))?;
+        if let Some(compatible) = region.compatible {
+            fdt.property_string("compatible", compatible)?;
+        }
+        fdt.property_array_u64("reg", &[region.base, region.size])?;
+        if region.no_map {
+            fdt.property_null("no-map")?;
+        }
+        if region.reusable {
+            fdt.property_null("reusable")?;
+        }
+        if let Some(name) = region.default_property {
+            fdt.property_null(name)?;
+        }
+        fdt.end_node(node)?;
+    }
+    fdt.end_node(reserved_node)
+}
+
+fn add_test_finisher(fdt: &mut FdtWriter) -> Result<(), Error> {
+    let (addr, end, _) = machine::device_region("test");
+    let node = fdt.begin_node(&format!("test@{:x}", addr))?;
+    fdt.property_string("compatible", "sifive,test1")?;
+    fdt.property_array_u64("reg", &[addr, end - addr])?;
+    fdt.end_node(node)
+}
+
+fn add_pvpanic(fdt: &mut FdtWriter) -> Result<(), Error> {
+    let (addr, end, _) = machine::device_region("pvpanic");
+    let node = fdt.begin_node(&format!("pvpanic@{:x}", addr))?;
+    fdt.property_string("compatible", "qemu,pvpanic-mmio")?;
+    fdt.property_array_u64("reg", &[addr, end - addr])?;
+    fdt.end_node(node)
+}
+
+fn add_framebuffer(fdt: &mut FdtWriter, fb: &FramebufferConfig) -> Result<(), Error> {
+    let node = fdt.begin_node(&format!("framebuffer@{:x}", GUEST_FB_ADDR))?;
+    fdt.property_string("compatible", "simple-framebuffer")?;
+    fdt.property_array_u64("reg", &[GUEST_FB_ADDR, framebuffer::size(fb) as u64])?;
+    fdt.property_u32("width", fb.width)?;
+    fdt.property_u32("height", fb.height)?;
+    fdt.property_u32("stride", framebuffer::stride(fb))?;
+    fdt.property_string("format", framebuffer::FORMAT)?;
+    fdt.end_node(node)
+}
+
+fn build_fdt(initrd: Option<(u64, u64)>) -> Result<Vec<u8>, Error> {
+    // Hotplugged vCPUs stay after a reset.
+    let num_vcpus = smp::num_vcpus() as u32;
+    let max_vcpus = config().max_vcpus as u32;
+
+    let mut fdt = FdtWriter::new()?;
+    let root_node = fdt.begin_node("")?;
+    fdt.property_string("compatible", "riscv-virtio")?;
+    fdt.property_u32("#address-cells", 0x2)?;
+    fdt.property_u32("#size-cells", 0x2)?;
+    if let (Some(uuid), Some(serial)) = (identity::uuid(), identity::serial()) {
+        fdt.property_string("vm,uuid", &uuid)?;
+        fdt.property_string("serial-number", &serial)?;
+    }
+
+    let chosen_node = fdt.begin_node("chosen")?;
+    fdt.property_string("bootargs", &config().cmdline)?;
+    if let Some((start, end)) = initrd {
+        fdt.property_u64("linux,initrd-start", start)?;
+        fdt.property_u64("linux,initrd-end", end)?;
+    }
+    fdt.end_node(chosen_node)?;
+
+    let memory_node = fdt.begin_node(&format!("memory@{:x}", GUEST_MEMORY.guest_base()))?;
+    fdt.property_string("device_type", "memory")?;
+    fdt.property_array_u64("reg", &[GUEST_MEMORY.guest_base(), GUEST_MEMORY.size() as u64])?;
+    fdt.end_node(memory_node)?;
+    add_reserved_memory(&mut fdt)?;
+
+    add_cpus(&mut fdt, num_vcpus, max_vcpus)?;
+    add_plic(&mut fdt, max_vcpus)?;
+    for node in virtio_mmio_nodes() {
+        add_virtio_mmio(&mut fdt, node)?;
+    }
+
+    if config().pci {
+        add_pci(&mut fdt)?;
+    }
+
+    if config().watchdog {
+        add_watchdog(&mut fdt)?;
+    }
+
+    if config().rtc {
+        add_rtc(&mut fdt)?;
+    }
+
+    if config().test_finisher {
+        add_test_finisher(&mut fdt)?;
+    }
+
+    if config().pvpanic {
+        add_pvpanic(&mut fdt)?;
+    }
+
+    if let Some(fb) = &config().framebuffer {
+        add_framebuffer(&mut fdt, fb)?;
+    }
+
+    fdt.end_node(root_node)?;
+    fdt.finish()
+}
+
+/// `initrd` is the guest physical address range of the initrd.
+pub fn build(initrd: Option<(u64, u64)>) -> Vec<u8> {
+    let dtb = dt_overlay::apply(build_fdt(initrd).expect("failed to build the device tree"));
+    assert!(dtb.len() <= DTB_MEMORY.size(), "device tree is too large ({} bytes)", dtb.len());
+    dtb
+}
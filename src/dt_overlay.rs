@@ -0,0 +1,284 @@
+//! Device tree overlays (`-dtb-overlay`): merges a compiled overlay into the
+//! generated device tree, e.g. to give the guest reserved memory or extra
+//! properties in /chosen:
+//!
+//! ```text
+//! /dts-v1/;
+//! /plugin/;
+//!
+//! &{/} {
+//!     reserved-memory {
+//!         #address-cells = <2>;
+//!         #size-cells = <2>;
+//!         ranges;
+//!         carveout@8f000000 {
+//!             reg = <0x0 0x8f000000 0x0 0x1000000>;
+//!             no-map;
+//!         };
+//!     };
+//! };
+//!
+//! &{/chosen} {
+//!     stdout-path = "/soc/serial@10000000";
+//! };
+//! ```
+//!
+//! compiled with `dtc -@ -I dts -O dtb -o extra.dtbo extra.dts`. Fragments
+//! target a path (`&{/path}`), or a label of the generated tree (`&plic`,
+//! e.g. for `interrupt-parent = <&plic>` too). Phandles in the overlay are
+//! renumbered above ours.
+use alloc::{
+    format,
+    string::{String, ToString},
+    vec,
+    vec::Vec,
+};
+use spin::Once;
+use vm_fdt::{Error, FdtWriter};
+
+use crate::{
+    device_tree,
+    host_dtb::{FDT_BEGIN_NODE, FDT_END_NODE, FDT_MAGIC, FDT_NOP, FDT_PROP},
+    host_fw_cfg,
+};
+
+const MAX_OVERLAY_SIZE: usize = 64 * 1024;
+
+#[derive(Clone)]
+struct Node {
+    name: String,
+    props: Vec<(String, Vec<u8>)>,
+    children: Vec<Node>,
+}
+
+static OVERLAY: Once<Node> = Once::new();
+
+fn be32(data: &[u8], offset: usize) -> Option<u32> {
+    data.get(offset..offset + 4).map(|b| u32::from_be_bytes(b.try_into().unwrap()))
+}
+
+fn cstr(data: &[u8], offset: usize) -> Option<&str> {
+    let data = data.get(offset..)?;
+    let len = data.iter().position(|&b| b == 0)?;
+    core::str::from_utf8(&data[..len]).ok()
+}
+
+impl Node {
+    /// Parses a flattened device tree.
+    fn parse(blob: &[u8]) -> Option<Node> {
+        if be32(blob, 0)? != FDT_MAGIC {
+            return None;
+        }
+
+        let struct_off = be32(blob, 8)? as usize;
+        let strings_off = be32(blob, 12)? as usize;
+        let mut stack: Vec<Node> = Vec::new();
+        let mut offset = struct_off;
+        loop {
+            let token = be32(blob, offset)?;
+            offset += 4;
+            match token {
+                FDT_BEGIN_NODE => {
+                    let name = cstr(blob, offset)?;
+                    offset = (offset + name.len() + 1).next_multiple_of(4);
+                    stack.push(Node { name: name.to_string(), props: Vec::new(), children: Vec::new() });
+                }
+                FDT_END_NODE => {
+                    let node = stack.pop()?;
+                    match stack.last_mut() {
+                        Some(parent) => parent.children.push(node),
+                        None => return Some(node),
+                    }
+                }
+                FDT_PROP => {
+                    let len = be32(blob, offset)? as usize;
+                    let name = cstr(blob, strings_off + be32(blob, offset + 4)? as usize)?;
+                    let value = blob.get(offset + 8..offset + 8 + len)?;
+                    offset = (offset + 8 + len).next_multiple_of(4);
+                    stack.last_mut()?.props.push((name.to_string(), value.to_vec()));
+                }
+                FDT_NOP => {}
+                // FDT_END before the root node ends.
+                _ => return None,
+            }
+        }
+    }
+
+    fn write(&self, fdt: &mut FdtWriter) -> Result<(), Error> {
+        let node = fdt.begin_node(&self.name)?;
+        for (name, value) in &self.props {
+            fdt.property(name, value)?;
+        }
+        for child in &self.children {
+            child.write(fdt)?;
+        }
+        fdt.end_node(node)
+    }
+
+    fn prop(&self, name: &str) -> Option<&[u8]> {
+        self.props.iter().find(|(n, _)| n == name).map(|(_, value)| value.as_slice())
+    }
+
+    fn prop_mut(&mut self, name: &str) -> Option<&mut Vec<u8>> {
+        self.props.iter_mut().find(|(n, _)| n == name).map(|(_, value)| value)
+    }
+
+    fn child(&self, name: &str) -> Option<&Node> {
+        self.children.iter().find(|child| child.name == name)
+    }
+
+    fn child_mut(&mut self, name: &str) -> Option<&mut Node> {
+        self.children.iter_mut().find(|child| child.name == name)
+    }
+
+    /// `path` is absolute, e.g. `/chosen`.
+    fn find_path_mut(&mut self, path: &str) -> Option<&mut Node> {
+        let mut node = self;
+        for name in path.split('/').filter(|name| !name.is_empty()) {
+            node = node.child_mut(name)?;
+        }
+        Some(node)
+    }
+
+    fn find_phandle_mut(&mut self, phandle: u32) -> Option<&mut Node> {
+        if self.prop("phandle").and_then(|value| be32(value, 0)) == Some(phandle) {
+            return Some(self);
+        }
+        self.children.iter_mut().find_map(|child| child.find_phandle_mut(phandle))
+    }
+
+    fn max_phandle(&self) -> u32 {
+        let own = ["phandle", "linux,phandle"].iter().filter_map(|name| be32(self.prop(name)?, 0)).max();
+        self.children.iter().map(Node::max_phandle).chain(own).max().unwrap_or(0)
+    }
+
+    fn renumber_phandles(&mut self, delta: u32) {
+        for (name, value) in &mut self.props {
+            if (name == "phandle" || name == "linux,phandle") && value.len() == 4 {
+                let phandle = be32(value, 0).unwrap() + delta;
+                value.copy_from_slice(&phandle.to_be_bytes());
+            }
+        }
+        for child in &mut self.children {
+            child.renumber_phandles(delta);
+        }
+    }
+
+    /// Merges `overlay` into this node: its properties replace ours.
+    fn merge(&mut self, overlay: &Node) {
+        for (name, value) in &overlay.props {
+            match self.prop_mut(name) {
+                Some(ours) => ours.clone_from(value),
+                None => self.props.push((name.clone(), value.clone())),
+            }
+        }
+        for child in &overlay.children {
+            match self.child_mut(&child.name) {
+                Some(ours) => ours.merge(child),
+                None => self.children.push(child.clone()),
+            }
+        }
+    }
+}
+
+/// Replaces the big-endian cell at `offset` of a property with `f(cell)`.
+fn patch_cell(value: &mut [u8], offset: usize, f: impl Fn(u32) -> u32) -> Option<()> {
+    let cell = be32(value, offset)?;
+    value[offset..offset + 4].copy_from_slice(&f(cell).to_be_bytes());
+    Some(())
+}
+
+/// __local_fixups__ mirrors the overlay: the offsets of the phandles in each
+/// property, which move with the renumbering.
+fn apply_local_fixups(node: &mut Node, fixups: &Node, delta: u32) -> Result<(), String> {
+    for (name, offsets) in &fixups.props {
+        let missing = format!("__local_fixups__: no property {} in {}", name, node.name);
+        let value = node.prop_mut(name).ok_or(missing)?;
+        for offset in offsets.chunks_exact(4) {
+            let offset = be32(offset, 0).unwrap() as usize;
+            patch_cell(value, offset, |phandle| phandle + delta).ok_or("__local_fixups__: offset out of range")?;
+        }
+    }
+    for child in &fixups.children {
+        let node = node.child_mut(&child.name).ok_or(format!("__local_fixups__: no node {}", child.name))?;
+        apply_local_fixups(node, child, delta)?;
+    }
+    Ok(())
+}
+
+/// __fixups__: each property is a label of the generated tree, with
+/// `<path>:<property>:<offset>` strings where its phandle goes.
+fn apply_fixups(overlay: &mut Node, fixups: &Node) -> Result<(), String> {
+    for (label, refs) in &fixups.props {
+        let phandle = device_tree::label_phandle(label).ok_or(format!("unknown label: &{}", label))?;
+        for fixup in refs.split(|&b| b == 0).filter(|s| !s.is_empty()) {
+            let fixup = core::str::from_utf8(fixup).map_err(|_| "__fixups__: invalid string")?;
+            let mut fields = fixup.rsplitn(3, ':');
+            let (Some(offset), Some(prop), Some(path)) = (fields.next(), fields.next(), fields.next()) else {
+                return Err(format!("__fixups__: invalid reference: {}", fixup));
+            };
+
+            let offset = offset.parse().map_err(|_| format!("__fixups__: invalid offset: {}", fixup))?;
+            let value = overlay
+                .find_path_mut(path)
+                .and_then(|node| node.prop_mut(prop))
+                .ok_or(format!("__fixups__: {} not found", fixup))?;
+            patch_cell(value, offset, |_| phandle).ok_or("__fixups__: offset out of range")?;
+        }
+    }
+    Ok(())
+}
+
+/// Merges the overlay into `base`.
+fn apply_to(base: &mut Node, overlay: &Node) -> Result<(), String> {
+    let mut overlay = overlay.clone();
+    // Renumber the overlay's phandles above ours, then fix the references.
+    let delta = base.max_phandle();
+    overlay.renumber_phandles(delta);
+    if let Some(fixups) = overlay.child("__local_fixups__").cloned() {
+        apply_local_fixups(&mut overlay, &fixups, delta)?;
+    }
+    if let Some(fixups) = overlay.child("__fixups__").cloned() {
+        apply_fixups(&mut overlay, &fixups)?;
+    }
+
+    for fragment in overlay.children.iter().filter(|node| !node.name.starts_with("__")) {
+        let Some(contents) = fragment.child("__overlay__") else {
+            continue;
+        };
+
+        let target = if let Some(path) = fragment.prop("target-path") {
+            let path = cstr(path, 0).ok_or(format!("{}: invalid target-path", fragment.name))?;
+            base.find_path_mut(path).ok_or(format!("{}: target {} not found", fragment.name, path))?
+        } else if let Some(phandle) = fragment.prop("target").and_then(|value| be32(value, 0)) {
+            base.find_phandle_mut(phandle).ok_or(format!("{}: target phandle {} not found", fragment.name, phandle))?
+        } else {
+            return Err(format!("{}: no target or target-path", fragment.name));
+        };
+        target.merge(contents);
+    }
+    Ok(())
+}
+
+/// Reads the overlay from the fw_cfg file `name` (`-dtb-overlay`).
+pub fn init(name: &str) {
+    let mut blob = vec![0; MAX_OVERLAY_SIZE];
+    let len = host_fw_cfg::read_file(name, blob.as_mut_ptr(), blob.len())
+        .unwrap_or_else(|| panic!("-dtb-overlay: failed to read {} from fw_cfg (or too large)", name));
+    let overlay = Node::parse(&blob[..len]).unwrap_or_else(|| panic!("-dtb-overlay: {} is not a valid .dtbo", name));
+    let fragments = overlay.children.iter().filter(|node| node.child("__overlay__").is_some()).count();
+    info!("dt-overlay", "loaded {} fragments from {}", fragments, name);
+    OVERLAY.call_once(|| overlay);
+}
+
+/// Merges the overlay, if any, into the generated device tree.
+pub fn apply(dtb: Vec<u8>) -> Vec<u8> {
+    let Some(overlay) = OVERLAY.get() else {
+        return dtb;
+    };
+
+    let mut tree = Node::parse(&dtb).expect("failed to parse the generated device tree");
+    apply_to(&mut tree, overlay).unwrap_or_else(|err| panic!("-dtb-overlay: {}", err));
+    let mut fdt = FdtWriter::new().expect("failed to build the device tree");
+    tree.write(&mut fdt).and_then(|_| fdt.finish()).unwrap_or_else(|err| panic!("-dtb-overlay: {:?}", err))
+}
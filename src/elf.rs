@@ -0,0 +1,110 @@
+//! An ELF loader for bare-metal payloads (`-kernel` with an ELF executable),
+//! e.g. teaching OSes and microkernels. They boot in VS-mode like Linux: a0
+//! is the hart ID, a1 is the device tree, and SBI is available.
+use core::mem::size_of;
+
+use crate::guest_memory::GUEST_MEMORY;
+
+const ELF_MAGIC: [u8; 4] = [0x7f, b'E', b'L', b'F'];
+const ELFCLASS64: u8 = 2;
+const ELFDATA2LSB: u8 = 1;
+const ET_EXEC: u16 = 2;
+const EM_RISCV: u16 = 243;
+const PT_LOAD: u32 = 1;
+
+#[repr(C)]
+#[derive(Clone, Copy)]
+struct Elf64Header {
+    ident: [u8; 16],
+    type_: u16,
+    machine: u16,
+    version: u32,
+    entry: u64,
+    phoff: u64,
+    shoff: u64,
+    flags: u32,
+    ehsize: u16,
+    phentsize: u16,
+    phnum: u16,
+    shentsize: u16,
+    shnum: u16,
+    shstrndx: u16,
+}
+
+#[repr(C)]
+#[derive(Clone, Copy)]
+struct Elf64ProgramHeader {
+    type_: u32,
+    flags: u32,
+    offset: u64,
+    vaddr: u64,
+    paddr: u64,
+    filesz: u64,
+    memsz: u64,
+    align: u64,
+}
+
+pub fn is_elf(data: &[u8]) -> bool {
+    data.starts_with(&ELF_MAGIC)
+}
+
+fn read<T: Copy>(data: &[u8], offset: u64) -> Option<T> {
+    let bytes = data.get(offset as usize..(offset as usize).checked_add(size_of::<T>())?)?;
+    Some(unsafe { core::ptr::read_unaligned(bytes.as_ptr() as *const T) })
+}
+
+/// Copies the loadable segments to their physical addresses, below `limit`.
+/// Returns the physical entry point and the end of the highest segment.
+pub fn load(data: &[u8], limit: u64) -> (u64, u64) {
+    let header: Elf64Header = read(data, 0).expect("-kernel: truncated ELF header");
+    assert!(
+        header.ident[4] == ELFCLASS64 && header.ident[5] == ELFDATA2LSB,
+        "-kernel: not a 64-bit little-endian ELF"
+    );
+    assert_eq!(header.type_, ET_EXEC, "-kernel: not an ELF executable");
+    assert_eq!(header.machine, EM_RISCV, "-kernel: not a RISC-V ELF");
+    assert_eq!(header.phentsize as usize, size_of::<Elf64ProgramHeader>(), "-kernel: invalid program header size");
+
+    let mut entry = None;
+    let mut end = 0;
+    for i in 0..header.phnum as u64 {
+        let phdr: Elf64ProgramHeader =
+            read(data, header.phoff + i * size_of::<Elf64ProgramHeader>() as u64).expect("-kernel: truncated program header");
+        if phdr.type_ != PT_LOAD || phdr.memsz == 0 {
+            continue;
+        }
+
+        assert!(phdr.filesz <= phdr.memsz, "-kernel: invalid segment size");
+        let file = data
+            .get(phdr.offset as usize..(phdr.offset + phdr.filesz) as usize)
+            .expect("-kernel: segment out of the file");
+        let seg_end = phdr.paddr.saturating_add(phdr.memsz);
+        assert!(
+            GUEST_MEMORY.contains_range(phdr.paddr, phdr.memsz as usize) && seg_end <= limit,
+            "-kernel: segment at {:#x}-{:#x} is out of the guest memory",
+            phdr.paddr,
+            seg_end
+        );
+
+        GUEST_MEMORY.write_at(phdr.paddr, file).unwrap();
+        // Zero-fill the rest (.bss).
+        unsafe {
+            core::ptr::write_bytes(
+                GUEST_MEMORY.host_addr(phdr.paddr + phdr.filesz),
+                0,
+                (phdr.memsz - phdr.filesz) as usize,
+            )
+        };
+
+        // The entry point is a virtual address. Translate it with the segment
+        // containing it, in case the kernel is linked at a higher address.
+        if (phdr.vaddr..phdr.vaddr + phdr.memsz).contains(&header.entry) {
+            entry = Some(phdr.paddr + (header.entry - phdr.vaddr));
+        }
+
+        end = end.max(seg_end);
+        info!("elf", "loaded ELF segment: {:#x}-{:#x}", phdr.paddr, seg_end);
+    }
+
+    (entry.expect("-kernel: the entry point is not in any segment"), end)
+}
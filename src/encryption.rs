@@ -0,0 +1,131 @@
+//! Encryption at rest of snapshots and memory dumps (`-snapshot-key`), with
+//! AES-256-GCM. The key is 64 hex digits in a fw_cfg file, e.g. from a file
+//! or from an environment variable set by a KMS (see run.sh):
+//!
+//! ```text
+//! -fw_cfg name=opt/hypervisor/snapshot-key,file=snapshot.key
+//! -fw_cfg name=opt/hypervisor/snapshot-key,string=$SNAPSHOT_KEY
+//! ```
+//!
+//! A file is sealed in chunks, each with its own tag, so that a chunk is
+//! verified before it's used. The nonce of chunk N is the file's 8-byte
+//! nonce prefix followed by N (big-endian u32).
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::Once;
+
+use crate::{
+    aes_gcm::{Aes256Gcm, KEY_LEN, NONCE_LEN, TAG_LEN},
+    guest_memory::GUEST_MEMORY,
+    host_blk::{HostBlk, SECTOR_SIZE, VIRTIO_BLK_T_IN, VIRTIO_BLK_T_OUT},
+    host_fw_cfg, host_rtc,
+    snapshot::disk_io,
+};
+
+/// The guest RAM is sealed in chunks of this size.
+pub const CHUNK_SIZE: usize = 1024 * 1024;
+pub const NONCE_PREFIX_LEN: usize = 8;
+pub type Tag = [u8; TAG_LEN];
+
+static CIPHER: Once<Aes256Gcm> = Once::new();
+
+fn parse_key(text: &[u8]) -> Option<[u8; KEY_LEN]> {
+    let text = core::str::from_utf8(text).ok()?.trim();
+    if text.len() != 2 * KEY_LEN {
+        return None;
+    }
+
+    let mut key = [0; KEY_LEN];
+    for (i, byte) in key.iter_mut().enumerate() {
+        *byte = u8::from_str_radix(text.get(2 * i..2 * i + 2)?, 16).ok()?;
+    }
+    Some(key)
+}
+
+/// Reads the key from the fw_cfg file `name` (`-snapshot-key`).
+pub fn init(name: &str) {
+    let mut text = [0; 2 * KEY_LEN + 2];
+    let len = host_fw_cfg::read_file(name, text.as_mut_ptr(), text.len())
+        .unwrap_or_else(|| panic!("-snapshot-key: failed to read {} from fw_cfg (or too large)", name));
+    let key = parse_key(&text[..len]).unwrap_or_else(|| panic!("-snapshot-key: expected {} hex digits", 2 * KEY_LEN));
+    CIPHER.call_once(|| Aes256Gcm::new(&key));
+    info!("encryption", "snapshots and dumps are encrypted");
+}
+
+pub fn is_enabled() -> bool {
+    CIPHER.get().is_some()
+}
+
+fn cipher() -> &'static Aes256Gcm {
+    CIPHER.get().expect("encryption not enabled")
+}
+
+/// A nonce prefix for a new file: the host's wall-clock time in nanoseconds,
+/// which doesn't repeat as long as the host's clock doesn't go back.
+pub fn new_nonce_prefix() -> [u8; NONCE_PREFIX_LEN] {
+    host_rtc::now().to_be_bytes()
+}
+
+fn nonce(prefix: &[u8; NONCE_PREFIX_LEN], chunk: u32) -> [u8; NONCE_LEN] {
+    let mut nonce = [0; NONCE_LEN];
+    nonce[..NONCE_PREFIX_LEN].copy_from_slice(prefix);
+    nonce[NONCE_PREFIX_LEN..].copy_from_slice(&chunk.to_be_bytes());
+    nonce
+}
+
+/// Encrypts chunk `chunk` in place. Returns its tag.
+pub fn seal(prefix: &[u8; NONCE_PREFIX_LEN], chunk: u32, aad: &[u8], data: &mut [u8]) -> Tag {
+    cipher().seal(&nonce(prefix, chunk), aad, data)
+}
+
+/// Decrypts chunk `chunk` in place, if it's intact.
+pub fn open(prefix: &[u8; NONCE_PREFIX_LEN], chunk: u32, aad: &[u8], data: &mut [u8], tag: &Tag) -> Result<(), String> {
+    if !cipher().open(&nonce(prefix, chunk), aad, data, tag) {
+        return Err(format!("chunk {} is broken or tampered with (or the key is wrong)", chunk));
+    }
+    Ok(())
+}
+
+/// The number of chunks of `len` bytes of the guest RAM.
+pub fn num_chunks(len: usize) -> usize {
+    len.div_ceil(CHUNK_SIZE)
+}
+
+/// Writes the guest RAM from `sector`, as chunks `first_chunk` and later.
+/// Returns their tags.
+pub fn write_memory(
+    disk: &mut HostBlk,
+    sector: u64,
+    prefix: &[u8; NONCE_PREFIX_LEN],
+    first_chunk: u32,
+) -> Result<Vec<Tag>, String> {
+    let base = GUEST_MEMORY.guest_base();
+    let mut buf = vec![0; CHUNK_SIZE];
+    let mut tags = Vec::new();
+    for (i, offset) in (0..GUEST_MEMORY.size()).step_by(CHUNK_SIZE).enumerate() {
+        let chunk = &mut buf[..(GUEST_MEMORY.size() - offset).min(CHUNK_SIZE)];
+        GUEST_MEMORY.read_at(base + offset as u64, chunk).unwrap();
+        tags.push(seal(prefix, first_chunk + i as u32, &[], chunk));
+        disk_io(disk, VIRTIO_BLK_T_OUT, sector + (offset as u64) / SECTOR_SIZE, chunk.as_mut_ptr(), chunk.len())?;
+    }
+    Ok(tags)
+}
+
+/// Reads the guest RAM written by `write_memory`. A broken chunk stops it
+/// halfway, like a disk error.
+pub fn read_memory(
+    disk: &mut HostBlk,
+    sector: u64,
+    prefix: &[u8; NONCE_PREFIX_LEN],
+    first_chunk: u32,
+    tags: &[Tag],
+) -> Result<(), String> {
+    let base = GUEST_MEMORY.guest_base();
+    let mut buf = vec![0; CHUNK_SIZE];
+    for (i, offset) in (0..GUEST_MEMORY.size()).step_by(CHUNK_SIZE).enumerate() {
+        let chunk = &mut buf[..(GUEST_MEMORY.size() - offset).min(CHUNK_SIZE)];
+        disk_io(disk, VIRTIO_BLK_T_IN, sector + (offset as u64) / SECTOR_SIZE, chunk.as_mut_ptr(), chunk.len())?;
+        open(prefix, first_chunk + i as u32, &[], chunk, &tags[i])?;
+        GUEST_MEMORY.write_at(base + offset as u64, chunk).unwrap();
+    }
+    Ok(())
+}
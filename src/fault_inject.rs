@@ -0,0 +1,164 @@
+//! Fault injection, to test the guest drivers' error paths:
+//!
+//! ```text
+//! -fault-inject blk-error=0.01,net-drop=0.05,net-corrupt=0.001,irq-delay=2000
+//! ```
+//!
+//! - `blk-error=<p>`: virtio-blk requests fail with VIRTIO_BLK_S_IOERR (after
+//!   the data has been read or written).
+//! - `net-drop=<p>`: virtio-net drops packets, in both directions.
+//! - `net-corrupt=<p>`: virtio-net flips a bit of packets, in both
+//!   directions.
+//! - `irq-delay=<us>`: the interrupts of virtio-blk and virtio-net are held
+//!   for a while, as `-irq-coalesce` does.
+//!
+//! `<p>` is the probability for each request or packet, from 0 to 1. The
+//! `fault` command in the monitor changes them while the guest runs (e.g.
+//! `fault blk-error=1` breaks the disk, `fault blk-error=0` repairs it), and
+//! `info faults` shows how many have been injected.
+//!
+//! The faults are picked by a PRNG seeded by `-deterministic` (or a fixed
+//! seed): the same I/O in the same order gets the same faults again.
+use alloc::{format, string::String, vec::Vec};
+use core::sync::atomic::{AtomicBool, Ordering};
+use spin::Mutex;
+
+use crate::deterministic::{self, Prng};
+
+const VIRTIO_DEVICE_NET: u32 = 1;
+const VIRTIO_DEVICE_BLK: u32 = 2;
+/// The seed without `-deterministic`.
+const DEFAULT_SEED: u64 = 0;
+
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub enum Fault {
+    BlkError,
+    NetDrop,
+    NetCorrupt,
+}
+
+const FAULTS: [Fault; 3] = [Fault::BlkError, Fault::NetDrop, Fault::NetCorrupt];
+
+impl Fault {
+    fn name(self) -> &'static str {
+        match self {
+            Fault::BlkError => "blk-error",
+            Fault::NetDrop => "net-drop",
+            Fault::NetCorrupt => "net-corrupt",
+        }
+    }
+}
+
+struct State {
+    prng: Option<Prng>,
+    /// Indexed by Fault.
+    probabilities: [f64; FAULTS.len()],
+    injected: [u64; FAULTS.len()],
+    irq_delay_us: u64,
+}
+
+static STATE: Mutex<State> =
+    Mutex::new(State { prng: None, probabilities: [0.0; FAULTS.len()], injected: [0; FAULTS.len()], irq_delay_us: 0 });
+/// Whether `irq-delay` has ever been set: the devices poll for the held
+/// interrupts from then on.
+static DELAYS_INTERRUPTS: AtomicBool = AtomicBool::new(false);
+
+fn parse_probability(value: &str) -> Option<f64> {
+    value.parse::<f64>().ok().filter(|p| (0.0..=1.0).contains(p))
+}
+
+/// Sets faults: `<name>=<value>[,<name>=<value>...]`.
+pub fn set(spec: &str) -> Result<(), String> {
+    let mut state = STATE.lock();
+    for option in spec.split(',').filter(|option| !option.is_empty()) {
+        let Some((name, value)) = option.split_once('=') else {
+            return Err(format!("expected <fault>=<value>: {}", option));
+        };
+
+        if name == "irq-delay" {
+            state.irq_delay_us = value.parse().map_err(|_| format!("irq-delay: invalid number: {}", value))?;
+            if state.irq_delay_us != 0 {
+                DELAYS_INTERRUPTS.store(true, Ordering::Relaxed);
+            }
+            continue;
+        }
+
+        let Some(index) = FAULTS.iter().position(|fault| fault.name() == name) else {
+            return Err(format!("unknown fault: {} (available: blk-error, net-drop, net-corrupt, irq-delay)", name));
+        };
+
+        state.probabilities[index] =
+            parse_probability(value).ok_or_else(|| format!("{}: expected a probability from 0 to 1: {}", name, value))?;
+    }
+    Ok(())
+}
+
+/// `-fault-inject <spec>`.
+pub fn init(spec: &str) {
+    set(spec).unwrap_or_else(|err| panic!("-fault-inject: {}", err));
+    info!("fault-inject", "{}", report());
+}
+
+fn prng(state: &mut State) -> &mut Prng {
+    state.prng.get_or_insert_with(|| {
+        deterministic::prng("fault-inject").unwrap_or_else(|| deterministic::stream(DEFAULT_SEED, "fault-inject"))
+    })
+}
+
+/// Whether to inject `fault` into the current request or packet.
+pub fn inject(fault: Fault) -> bool {
+    let mut state = STATE.lock();
+    let index = fault as usize;
+    let probability = state.probabilities[index];
+    if probability == 0.0 {
+        return false;
+    }
+
+    // 53 bits, as many as an f64 has.
+    let sample = (prng(&mut state).next_u64() >> 11) as f64 / (1u64 << 53) as f64;
+    if sample >= probability {
+        return false;
+    }
+
+    state.injected[index] += 1;
+    trace!("fault-inject", "injecting {}", fault.name());
+    true
+}
+
+/// Flips a random bit in `data` on `net-corrupt`. Returns true if it did.
+pub fn corrupt(data: &mut [u8]) -> bool {
+    if data.is_empty() || !inject(Fault::NetCorrupt) {
+        return false;
+    }
+
+    let random = prng(&mut STATE.lock()).next_u64();
+    data[(random >> 3) as usize % data.len()] ^= 1 << (random & 7);
+    true
+}
+
+/// How long to hold the interrupts of a virtio device, in microseconds.
+pub fn irq_delay_us(device_id: u32) -> u64 {
+    match device_id {
+        VIRTIO_DEVICE_BLK | VIRTIO_DEVICE_NET => STATE.lock().irq_delay_us,
+        _ => 0,
+    }
+}
+
+/// Whether interrupts may have been held by `irq-delay`.
+pub fn delays_interrupts() -> bool {
+    DELAYS_INTERRUPTS.load(Ordering::Relaxed)
+}
+
+/// `info faults` in the monitor.
+pub fn report() -> String {
+    let state = STATE.lock();
+    let mut lines: Vec<String> = FAULTS
+        .iter()
+        .map(|&fault| {
+            let index = fault as usize;
+            format!("{}: {} ({} injected)", fault.name(), state.probabilities[index], state.injected[index])
+        })
+        .collect();
+    lines.push(format!("irq-delay: {} us", state.irq_delay_us));
+    lines.join("\n")
+}
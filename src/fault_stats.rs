@@ -0,0 +1,110 @@
+//! `-fault-stats`: counts guest-page faults (stage-2 translation faults) per
+//! 2MB guest physical region and their handling latency. Get the report by
+//! `{"execute": "query-fault-stats"}` in the monitor. It's also printed when
+//! the guest shuts down.
+use alloc::{collections::BTreeMap, format, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::timer::ticks_to_ns;
+
+/// The region size: the size of a stage-2 megapage.
+const REGION_SHIFT: u64 = 21;
+/// The number of regions in the report.
+const NUM_HOTTEST: usize = 10;
+
+#[derive(Default)]
+struct RegionStats {
+    faults: u64,
+    ticks: u64,
+}
+
+struct FaultStats {
+    /// Keyed by the region number (the guest physical address >> REGION_SHIFT).
+    regions: BTreeMap<u64, RegionStats>,
+    /// histogram[n] is the number of faults handled in [2^n, 2^(n+1)) ticks.
+    histogram: [u64; 64],
+    total: u64,
+}
+
+static FAULT_STATS: Mutex<FaultStats> =
+    Mutex::new(FaultStats { regions: BTreeMap::new(), histogram: [0; 64], total: 0 });
+
+/// Records a guest-page fault handled in `ticks`.
+pub fn record(guest_addr: u64, ticks: u64) {
+    let mut stats = FAULT_STATS.lock();
+    let region = stats.regions.entry(guest_addr >> REGION_SHIFT).or_default();
+    region.faults += 1;
+    region.ticks += ticks;
+    stats.histogram[63 - ticks.max(1).leading_zeros() as usize] += 1;
+    stats.total += 1;
+}
+
+impl FaultStats {
+    /// Returns the upper bound of the percentile in nanoseconds.
+    fn percentile(&self, percent: u64) -> u64 {
+        let threshold = (self.total * percent).div_ceil(100);
+        let mut count = 0;
+        for (n, faults) in self.histogram.iter().enumerate() {
+            count += faults;
+            if count >= threshold && count > 0 {
+                return ticks_to_ns(1 << (n + 1).min(63));
+            }
+        }
+        0
+    }
+
+    fn hottest(&self) -> Vec<(u64, &RegionStats)> {
+        let mut regions: Vec<(u64, &RegionStats)> = self.regions.iter().map(|(&n, s)| (n, s)).collect();
+        regions.sort_by(|a, b| b.1.faults.cmp(&a.1.faults));
+        regions.truncate(NUM_HOTTEST);
+        regions
+    }
+}
+
+/// Returns the report as a JSON object.
+pub fn report_json() -> String {
+    let stats = FAULT_STATS.lock();
+    let regions: Vec<String> = stats
+        .hottest()
+        .iter()
+        .map(|(n, region)| {
+            format!(
+                "{{\"base\": \"{:#x}\", \"faults\": {}, \"avg-ns\": {}}}",
+                n << REGION_SHIFT,
+                region.faults,
+                ticks_to_ns(region.ticks) / region.faults
+            )
+        })
+        .collect();
+
+    format!(
+        "{{\"total\": {}, \"p50-ns\": {}, \"p90-ns\": {}, \"p99-ns\": {}, \"hottest\": [{}]}}",
+        stats.total,
+        stats.percentile(50),
+        stats.percentile(90),
+        stats.percentile(99),
+        regions.join(", ")
+    )
+}
+
+/// Prints the report to the console.
+pub fn print_report() {
+    let stats = FAULT_STATS.lock();
+    println!(
+        "[fault-stats] {} guest-page faults, latency: p50<={}ns, p90<={}ns, p99<={}ns",
+        stats.total,
+        stats.percentile(50),
+        stats.percentile(90),
+        stats.percentile(99)
+    );
+
+    for (n, region) in stats.hottest() {
+        println!(
+            "[fault-stats]   {:#012x}-{:#012x}: {} faults (avg {}ns)",
+            n << REGION_SHIFT,
+            (n + 1) << REGION_SHIFT,
+            region.faults,
+            ticks_to_ns(region.ticks) / region.faults
+        );
+    }
+}
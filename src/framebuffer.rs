@@ -0,0 +1,49 @@
+//! `-fb <width>x<height>`: a linear framebuffer for the guest, described as
+//! "simple-framebuffer" in the device tree (Linux's CONFIG_FB_SIMPLE).
+//!
+//! QEMU displays it as ramfb (`-device ramfb`, e.g. in its VNC server): we
+//! point ramfb at the host memory backing the framebuffer, so whatever the
+//! guest draws is shown as is, with no copies or exits.
+use crate::{
+    config::FramebufferConfig,
+    guest_memory::FB_MEMORY,
+    guest_page_table::{GuestPageTable, PTE_R, PTE_W},
+    host_fw_cfg,
+    linux_loader::GUEST_FB_ADDR,
+};
+
+/// The pixel format in the device tree: 32-bit pixels with the most
+/// significant byte unused.
+pub const FORMAT: &str = "x8r8g8b8";
+/// DRM_FORMAT_XRGB8888 ("XR24"), the same format for ramfb.
+const DRM_FORMAT_XRGB8888: u32 = 0x3432_5258;
+const BYTES_PER_PIXEL: u32 = 4;
+
+pub fn stride(fb: &FramebufferConfig) -> u32 {
+    fb.width * BYTES_PER_PIXEL
+}
+
+pub fn size(fb: &FramebufferConfig) -> usize {
+    (stride(fb) as usize * fb.height as usize).next_multiple_of(4096)
+}
+
+/// Allocates and maps the framebuffer, and shows it on the host display.
+pub fn init(fb: &FramebufferConfig, table: &mut GuestPageTable) {
+    FB_MEMORY.init(size(fb), 0x1000);
+    FB_MEMORY.map(table, PTE_R | PTE_W);
+
+    // struct RAMFBCfg: be64 addr, be32 fourcc, be32 flags, be32 width,
+    // be32 height, be32 stride
+    let mut cfg = [0; 28];
+    cfg[0..8].copy_from_slice(&(FB_MEMORY.host_addr(GUEST_FB_ADDR) as u64).to_be_bytes());
+    cfg[8..12].copy_from_slice(&DRM_FORMAT_XRGB8888.to_be_bytes());
+    cfg[16..20].copy_from_slice(&fb.width.to_be_bytes());
+    cfg[20..24].copy_from_slice(&fb.height.to_be_bytes());
+    cfg[24..28].copy_from_slice(&stride(fb).to_be_bytes());
+    if host_fw_cfg::write_file("etc/ramfb", &cfg).is_none() {
+        warn!("framebuffer", "ramfb not found: add -device ramfb to show it");
+        return;
+    }
+
+    info!("framebuffer", "{}x{} on ramfb", fb.width, fb.height);
+}
@@ -0,0 +1,450 @@
+//! GDB remote serial protocol stub. GDB talks to us through the "gdb" port
+//! of the virtio console provided by QEMU (see run.sh).
+use alloc::{format, string::String, vec::Vec};
+use core::arch::asm;
+use spin::{Mutex, MutexGuard};
+
+use crate::{
+    core_dump, host_console, page_walk,
+    single_step::{Breakpoint, Step, insert_breakpoint, is_ebreak, remove_breakpoint},
+    smp, snapshot,
+    vcpu::VCpu,
+};
+
+/// `-device virtserialport,name=gdb` in run.sh.
+const PORT: &str = "gdb";
+
+const SIGINT: u8 = 2;
+const SIGTRAP: u8 = 5;
+
+/// The registers in the `g` packet: x0-x31 and pc.
+const NUM_REGS: usize = 33;
+
+enum Resume {
+    Continue,
+    Step,
+    Detach,
+}
+
+struct Gdb {
+    breakpoints: Vec<Breakpoint>,
+    /// The single step in progress.
+    step: Option<Step>,
+    /// The vCPU selected by `Hg`. None means the stopped one.
+    selected: Option<u64>,
+}
+
+static GDB: Mutex<Gdb> = Mutex::new(Gdb {
+    breakpoints: Vec::new(),
+    step: None,
+    selected: None,
+});
+
+fn checksum(data: &[u8]) -> u8 {
+    data.iter().fold(0, |sum, &b| sum.wrapping_add(b))
+}
+
+fn parse_hex(s: &[u8]) -> Option<u64> {
+    u64::from_str_radix(core::str::from_utf8(s).ok()?, 16).ok()
+}
+
+fn hex_encode(data: &[u8]) -> String {
+    data.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+fn hex_decode(s: &[u8]) -> Option<Vec<u8>> {
+    s.chunks(2)
+        .map(|hex| u8::from_str_radix(core::str::from_utf8(hex).ok()?, 16).ok())
+        .collect()
+}
+
+fn read_byte() -> u8 {
+    loop {
+        if let Some(byte) = host_console::read(PORT) {
+            return byte;
+        }
+
+        core::hint::spin_loop();
+    }
+}
+
+/// Receives a packet (`$<data>#<checksum>`) and acknowledges it.
+fn recv_packet() -> Vec<u8> {
+    loop {
+        while read_byte() != b'$' {}
+
+        let mut data = Vec::new();
+        loop {
+            match read_byte() {
+                b'#' => break,
+                byte => data.push(byte),
+            }
+        }
+
+        let expected = parse_hex(&[read_byte(), read_byte()]);
+        if expected == Some(checksum(&data) as u64) {
+            host_console::write(PORT, b"+");
+            return data;
+        }
+
+        host_console::write(PORT, b"-");
+    }
+}
+
+fn send_packet(data: &str) {
+    let packet = format!("${}#{:02x}", data, checksum(data.as_bytes()));
+    loop {
+        host_console::write(PORT, packet.as_bytes());
+        loop {
+            match read_byte() {
+                b'+' => return,
+                b'-' => break, // Retransmit.
+                _ => {}
+            }
+        }
+    }
+}
+
+fn read_reg(vcpu: &VCpu, reg: u64) -> Option<u64> {
+    match reg {
+        0..=31 => Some(vcpu.gpr(reg)),
+        32 => Some(vcpu.sepc),
+        _ => None,
+    }
+}
+
+fn write_reg(vcpu: &mut VCpu, reg: u64, value: u64) -> Option<()> {
+    match reg {
+        0..=31 => vcpu.set_gpr(reg, value),
+        32 => vcpu.sepc = value,
+        _ => return None,
+    }
+    Some(())
+}
+
+fn stop_reply(vcpu: &VCpu, signal: u8) -> String {
+    format!("T{:02x}thread:{:x};", signal, vcpu.hart_id + 1)
+}
+
+/// Returns the vCPU for a thread ID in GDB (vCPU ID + 1).
+fn thread_vcpu<'a>(vcpu: &'a mut VCpu, thread_id: u64) -> Option<&'a mut VCpu> {
+    let hart_id = thread_id.checked_sub(1)?;
+    if hart_id == vcpu.hart_id {
+        Some(vcpu)
+    } else {
+        smp::paused_vcpu(hart_id)
+    }
+}
+
+impl Gdb {
+    fn selected_vcpu<'a>(&self, vcpu: &'a mut VCpu) -> &'a mut VCpu {
+        match self.selected {
+            Some(thread_id) if thread_id != vcpu.hart_id + 1 => {
+                smp::paused_vcpu(thread_id - 1).unwrap_or(vcpu)
+            }
+            _ => vcpu,
+        }
+    }
+
+    fn query(&self, vcpu: &VCpu, query: &[u8]) -> String {
+        if query.starts_with(b"Supported") {
+            String::from("PacketSize=1000")
+        } else if query == b"Attached" {
+            String::from("1")
+        } else if query == b"C" {
+            format!("QC{:x}", vcpu.hart_id + 1)
+        } else if query == b"fThreadInfo" {
+            let threads: Vec<String> = (0..smp::num_vcpus() as u64)
+                .filter(|&id| smp::is_started(id))
+                .map(|id| format!("{:x}", id + 1))
+                .collect();
+            format!("m{}", threads.join(","))
+        } else if query == b"sThreadInfo" {
+            String::from("l")
+        } else {
+            String::new()
+        }
+    }
+
+    /// Handles `monitor <command>` in GDB.
+    fn monitor(&mut self, vcpu: &mut VCpu, command: &str) -> String {
+        let result = match command.trim() {
+            "savevm" => snapshot::save(vcpu, false),
+            "savevm incremental" => snapshot::save(vcpu, true),
+            "loadvm" => {
+                let result = snapshot::load(vcpu);
+                // Breakpoints might have been overwritten by the snapshot.
+                for breakpoint in &mut self.breakpoints {
+                    if !is_ebreak(vcpu, breakpoint.addr) {
+                        if let Some(new) = insert_breakpoint(vcpu, breakpoint.addr, breakpoint.len) {
+                            *breakpoint = new;
+                        }
+                    }
+                }
+                result
+            }
+            "dump" => core_dump::dump(vcpu),
+            _ => Err(String::from("unknown command (available: savevm, savevm incremental, loadvm, dump)")),
+        };
+
+        let message = match result {
+            Ok(()) => format!("{}: done\n", command),
+            Err(err) => format!("{}: {}\n", command, err),
+        };
+        send_packet(&format!("O{}", hex_encode(message.as_bytes())));
+        String::from("OK")
+    }
+
+    /// Handles a packet. Returns the reply, or how to resume the guest.
+    fn handle_packet(&mut self, vcpu: &mut VCpu, packet: &[u8], signal: u8) -> Result<String, Resume> {
+        let Some((&command, args)) = packet.split_first() else {
+            return Ok(String::new());
+        };
+
+        let reply = match command {
+            b'?' => stop_reply(vcpu, signal),
+            b'q' => match args.strip_prefix(b"Rcmd,") {
+                Some(command) => {
+                    let command = hex_decode(command).unwrap_or_default();
+                    self.monitor(vcpu, &String::from_utf8_lossy(&command))
+                }
+                None => self.query(vcpu, args),
+            },
+            b'H' => {
+                let thread_id = match args.get(1..).unwrap_or_default() {
+                    b"-1" | b"0" => None,
+                    id => parse_hex(id),
+                };
+
+                // Hc is ignored: we always resume the stopped vCPU.
+                if args.first() == Some(&b'g') {
+                    self.selected = thread_id;
+                }
+                String::from("OK")
+            }
+            b'T' => match parse_hex(args) {
+                Some(thread_id) if thread_vcpu(vcpu, thread_id).is_some() => String::from("OK"),
+                _ => String::from("E01"),
+            },
+            b'g' => {
+                let vcpu = self.selected_vcpu(vcpu);
+                (0..NUM_REGS as u64)
+                    .map(|reg| hex_encode(&read_reg(vcpu, reg).unwrap().to_le_bytes()))
+                    .collect()
+            }
+            b'G' => {
+                let vcpu = self.selected_vcpu(vcpu);
+                match hex_decode(args) {
+                    Some(data) if data.len() >= NUM_REGS * 8 => {
+                        for (reg, value) in data.chunks_exact(8).take(NUM_REGS).enumerate() {
+                            write_reg(vcpu, reg as u64, u64::from_le_bytes(value.try_into().unwrap()));
+                        }
+                        String::from("OK")
+                    }
+                    _ => String::from("E01"),
+                }
+            }
+            b'p' => {
+                let vcpu = self.selected_vcpu(vcpu);
+                match parse_hex(args).and_then(|reg| read_reg(vcpu, reg)) {
+                    Some(value) => hex_encode(&value.to_le_bytes()),
+                    // Registers we don't know (e.g. FPU registers) are unavailable.
+                    None => String::from("xxxxxxxxxxxxxxxx"),
+                }
+            }
+            b'P' => {
+                let vcpu = self.selected_vcpu(vcpu);
+                let result = args.split(|&b| b == b'=').collect::<Vec<_>>();
+                let written = match result[..] {
+                    [reg, value] => parse_hex(reg).zip(hex_decode(value)).and_then(|(reg, value)| {
+                        let value = u64::from_le_bytes(value.try_into().ok()?);
+                        write_reg(vcpu, reg, value)
+                    }),
+                    _ => None,
+                };
+                if written.is_some() { String::from("OK") } else { String::from("E01") }
+            }
+            b'm' => {
+                let mut args = args.split(|&b| b == b',');
+                let addr = args.next().and_then(parse_hex);
+                let len = args.next().and_then(parse_hex);
+                match addr.zip(len) {
+                    Some((addr, len)) => {
+                        let mut buf = alloc::vec![0; len.min(0x1000) as usize];
+                        match page_walk::read(self.selected_vcpu(vcpu), addr, &mut buf) {
+                            Some(()) => hex_encode(&buf),
+                            None => String::from("E14"), // EFAULT
+                        }
+                    }
+                    None => String::from("E01"),
+                }
+            }
+            b'M' => {
+                let (header, data) = match args.iter().position(|&b| b == b':') {
+                    Some(colon) => (&args[..colon], &args[colon + 1..]),
+                    None => return Ok(String::from("E01")),
+                };
+                let addr = header.split(|&b| b == b',').next().and_then(parse_hex);
+                match addr.zip(hex_decode(data)) {
+                    Some((addr, data)) => match page_walk::write(self.selected_vcpu(vcpu), addr, &data) {
+                        Some(()) => String::from("OK"),
+                        None => String::from("E14"), // EFAULT
+                    },
+                    None => String::from("E01"),
+                }
+            }
+            b'Z' | b'z' => {
+                let mut args = args.split(|&b| b == b',');
+                let type_ = args.next();
+                let addr = args.next().and_then(parse_hex);
+                let kind = args.next().and_then(parse_hex);
+                match (type_, addr, kind) {
+                    // Software breakpoints only.
+                    (Some(b"0"), Some(addr), Some(kind)) => {
+                        let existing = self.breakpoints.iter().position(|bp| bp.addr == addr);
+                        match (command, existing) {
+                            (b'Z', Some(_)) => String::from("OK"),
+                            (b'Z', None) => match insert_breakpoint(vcpu, addr, kind as usize) {
+                                Some(breakpoint) => {
+                                    self.breakpoints.push(breakpoint);
+                                    String::from("OK")
+                                }
+                                None => String::from("E14"),
+                            },
+                            (_, Some(index)) => {
+                                remove_breakpoint(vcpu, &self.breakpoints.swap_remove(index));
+                                String::from("OK")
+                            }
+                            (_, None) => String::from("OK"),
+                        }
+                    }
+                    _ => String::new(),
+                }
+            }
+            b'c' => {
+                if let Some(addr) = parse_hex(args) {
+                    vcpu.sepc = addr;
+                }
+                return Err(Resume::Continue);
+            }
+            b's' => {
+                if let Some(addr) = parse_hex(args) {
+                    vcpu.sepc = addr;
+                }
+
+                let breakpoints = &self.breakpoints;
+                let Some(step) = Step::start(vcpu, |addr| breakpoints.iter().any(|bp| bp.addr == addr)) else {
+                    return Ok(String::from("E14"));
+                };
+
+                self.step = Some(step);
+                return Err(Resume::Step);
+            }
+            b'D' => {
+                send_packet("OK");
+                return Err(Resume::Detach);
+            }
+            b'k' => return Err(Resume::Detach),
+            _ => String::new(), // Not supported.
+        };
+
+        Ok(reply)
+    }
+
+    /// Talks to GDB until it resumes the guest. `signal` is set if the guest
+    /// has stopped by itself (e.g. a breakpoint), otherwise GDB has sent us a
+    /// packet which is not received yet.
+    fn session(&mut self, vcpu: &mut VCpu, signal: Option<u8>) {
+        smp::pause_others(vcpu);
+        if let Some(step) = self.step.take() {
+            step.finish(vcpu);
+        }
+
+        self.selected = None;
+        if let Some(signal) = signal {
+            send_packet(&stop_reply(vcpu, signal));
+        }
+
+        let resume = loop {
+            let packet = recv_packet();
+            match self.handle_packet(vcpu, &packet, signal.unwrap_or(SIGTRAP)) {
+                Ok(reply) => send_packet(&reply),
+                Err(resume) => break resume,
+            }
+        };
+
+        match resume {
+            Resume::Continue => smp::resume_others(),
+            // Keep other vCPUs paused until the step completes.
+            Resume::Step => {}
+            Resume::Detach => {
+                for breakpoint in self.breakpoints.drain(..) {
+                    remove_breakpoint(vcpu, &breakpoint);
+                }
+                if let Some(step) = self.step.take() {
+                    step.finish(vcpu);
+                }
+                smp::resume_others();
+            }
+        }
+
+        unsafe {
+            asm!("fence.i");
+        }
+    }
+}
+
+fn lock(vcpu: &mut VCpu) -> MutexGuard<'static, Gdb> {
+    loop {
+        if let Some(gdb) = GDB.try_lock() {
+            return gdb;
+        }
+
+        // Another vCPU is talking to GDB. It will pause us.
+        smp::handle_pause(vcpu);
+        core::hint::spin_loop();
+    }
+}
+
+pub fn init() {
+    assert!(host_console::has_port(PORT), "[gdb] virtio-console port \"{}\" not found", PORT);
+    info!("gdb", "ready: attach with `target remote :1234`");
+}
+
+/// Handles an `ebreak` in the guest.
+pub fn handle_breakpoint(vcpu: &mut VCpu) {
+    let mut gdb = lock(vcpu);
+    let pc = vcpu.sepc;
+    let is_ours =
+        gdb.breakpoints.iter().any(|bp| bp.addr == pc) || gdb.step.as_ref().is_some_and(|step| step.is_done(pc));
+    if is_ours {
+        gdb.session(vcpu, Some(SIGTRAP));
+    } else if is_ebreak(vcpu, pc) {
+        // The guest's own ebreak, e.g. BUG() in Linux.
+        vcpu.inject_exception(3 /* breakpoint */, pc);
+    } else {
+        // The breakpoint has been removed while we were waiting for the lock.
+        // Just retry the instruction.
+    }
+}
+
+/// Handles data from GDB while the guest is running.
+pub fn handle_interrupt(vcpu: &mut VCpu) {
+    let signal = loop {
+        match host_console::peek(PORT) {
+            Some(0x03) /* Ctrl-C */ => {
+                host_console::read(PORT);
+                break Some(SIGINT);
+            }
+            // A packet, e.g. GDB has just connected.
+            Some(b'$') => break None,
+            // Acks and garbage.
+            Some(_) => {
+                host_console::read(PORT);
+            }
+            None => return,
+        }
+    };
+
+    lock(vcpu).session(vcpu, signal);
+}
@@ -1,27 +1,349 @@
-use crate::{guest_page_table::GuestPageTable, linux_loader::{GUEST_BASE_ADDR, GUEST_DTB_ADDR, MEMORY_SIZE}};
+use core::mem::size_of;
+use core::sync::atomic::{AtomicBool, AtomicPtr, AtomicU16, AtomicU32, AtomicU64, AtomicUsize, Ordering};
+use spin::Mutex;
 
-pub static GUEST_MEMORY: GuestMemory<MEMORY_SIZE> = GuestMemory::new(GUEST_BASE_ADDR);
-pub static DTB_MEMORY: GuestMemory<0x10000> = GuestMemory::new(GUEST_DTB_ADDR);
+use crate::{allocator::{alloc_pages, alloc_pages_at_end, alloc_pages_uninit}, config::config, guest_page_table::{GuestPageTable, MEGAPAGE_SIZE}, linux_loader::{GUEST_DTB_ADDR, GUEST_FB_ADDR}, memcheck::{self, Violation}};
 
-#[repr(C, align(4096))]
-pub struct GuestMemory<const SIZE: usize> {
-    data: [u8; SIZE],
-    guest_base: u64,
+/// Placed at `machine::ram_base()` by `relocate`.
+pub static GUEST_MEMORY: GuestMemory = GuestMemory::new(0);
+pub static DTB_MEMORY: GuestMemory = GuestMemory::new(GUEST_DTB_ADDR);
+pub static FB_MEMORY: GuestMemory = GuestMemory::new(GUEST_FB_ADDR);
+/// The region of virtio-mem (`-virtio-mem`), placed by `virtio_mem::init`.
+pub static HOTPLUG_MEMORY: GuestMemory = GuestMemory::new(0);
+
+/// The memory the guest may hand to the devices at `guest_addr`: the RAM, or
+/// the memory plugged with virtio-mem.
+pub fn ram(guest_addr: u64) -> &'static GuestMemory {
+    if HOTPLUG_MEMORY.contains(guest_addr) { &HOTPLUG_MEMORY } else { &GUEST_MEMORY }
+}
+
+/// Defines `read_uN`/`write_uN`: little-endian accesses without alignment
+/// requirements.
+macro_rules! le_accessors {
+    ($read:ident, $write:ident, $ty:ty) => {
+        pub fn $read(&self, guest_addr: u64) -> Option<$ty> {
+            let mut bytes = [0; size_of::<$ty>()];
+            self.read_at(guest_addr, &mut bytes)?;
+            Some(<$ty>::from_le_bytes(bytes))
+        }
+
+        pub fn $write(&self, guest_addr: u64, value: $ty) -> Option<()> {
+            self.write_at(guest_addr, &value.to_le_bytes())
+        }
+    };
+}
+
+/// Defines `load_uN`/`store_uN`: atomic little-endian accesses to naturally
+/// aligned values, e.g. virtqueue indices updated by other harts.
+macro_rules! atomic_accessors {
+    ($load:ident, $store:ident, $ty:ty, $atomic:ty) => {
+        pub fn $load(&self, guest_addr: u64, order: Ordering) -> Option<$ty> {
+            let ptr = self.aligned_ptr(guest_addr, size_of::<$ty>())? as *const $atomic;
+            Some(<$ty>::from_le(unsafe { (*ptr).load(order) }))
+        }
+
+        pub fn $store(&self, guest_addr: u64, value: $ty, order: Ordering) -> Option<()> {
+            let ptr = self.aligned_ptr(guest_addr, size_of::<$ty>())? as *const $atomic;
+            unsafe { (*ptr).store(value.to_le(), order) };
+            self.mark_dirty(guest_addr, size_of::<$ty>());
+            Some(())
+        }
+    };
+}
+
+/// The start of the host RAM (`/memory@80000000`), i.e. of QEMU's memory file.
+const HOST_RAM_BASE: u64 = 0x8000_0000;
+
+pub struct GuestMemory {
+    guest_base: AtomicU64,
+    host_base: AtomicUsize,
+    size: AtomicUsize,
+    /// A bit per 4KB page written since `take_dirty_pages`, while
+    /// `dirty_logging` is on.
+    dirty_bitmap: AtomicPtr<AtomicU64>,
+    dirty_logging: AtomicBool,
+    /// The number of 4KB pages mapped into the guest.
+    populated_pages: AtomicUsize,
+    /// Serializes `populate` on vCPUs faulting on the same page.
+    populate_lock: Mutex<()>,
 }
 
-impl<const SIZE: usize> GuestMemory<SIZE> {
+impl GuestMemory {
     pub const fn new(guest_base: u64) -> Self {
-        Self { data: [0; SIZE], guest_base }
+        Self {
+            guest_base: AtomicU64::new(guest_base),
+            host_base: AtomicUsize::new(0),
+            size: AtomicUsize::new(0),
+            dirty_bitmap: AtomicPtr::new(core::ptr::null_mut()),
+            dirty_logging: AtomicBool::new(false),
+            populated_pages: AtomicUsize::new(0),
+            populate_lock: Mutex::new(()),
+        }
+    }
+
+    /// Moves the memory to `guest_base` in the guest address space. Call this
+    /// before `init`.
+    pub fn relocate(&self, guest_base: u64) {
+        self.guest_base.store(guest_base, Ordering::Release);
+    }
+
+    /// The guest physical address of the memory.
+    pub fn guest_base(&self) -> u64 {
+        self.guest_base.load(Ordering::Acquire)
+    }
+
+    /// Allocates the host memory. It's not zero-filled: QEMU doesn't
+    /// allocate its memory until the guest touches it.
+    pub fn init(&self, size: usize, align: usize) {
+        assert!(size % 4096 == 0, "guest memory size must be page-aligned");
+        self.set_host_base(alloc_pages_uninit(size, align), size);
     }
 
-    pub fn write_bytes(&self, table: &mut GuestPageTable, src: &[u8], flags: u64) {
-        let raw_ptr = self.data.as_ptr() as *mut u8;
-        let slice = unsafe { core::slice::from_raw_parts_mut(raw_ptr, SIZE) };
+    /// Like `init`, but allocates the memory at the end of the host RAM, so
+    /// that it's at the same offset in QEMU's memory file every time.
+    pub fn init_at_end(&self, size: usize, align: usize) {
+        assert!(size % 4096 == 0, "guest memory size must be page-aligned");
+        let host_base = alloc_pages_at_end(size, align);
+        self.set_host_base(host_base, size);
+        info!("memory", "guest RAM is at {:#x} in QEMU's memory file", host_base as u64 - HOST_RAM_BASE);
+    }
+
+    fn set_host_base(&self, host_base: *mut u8, size: usize) {
+        self.host_base.store(host_base as usize, Ordering::Release);
+        self.size.store(size, Ordering::Release);
+    }
+
+    /// Copies `src` to the beginning of the memory.
+    pub fn write_bytes(&self, src: &[u8]) {
+        let size = self.size();
+        let raw_ptr = self.host_addr(self.guest_base());
+        let slice = unsafe { core::slice::from_raw_parts_mut(raw_ptr, size) };
         slice[..src.len()].copy_from_slice(src);
-        for off in (0..SIZE as u64).step_by(4096) {
-			let guest_addr = self.guest_base + off;
-			let host_addr = raw_ptr as u64 + off;
+    }
+
+    /// Maps the whole memory into the guest. With `-hugepages`, 2MB pages
+    /// are used where both addresses are aligned.
+    pub fn map(&self, table: &mut GuestPageTable, flags: u64) {
+        self.map_range(table, 0, self.size() as u64, flags);
+    }
+
+    /// Maps `[off, off + len)` of the memory, e.g. blocks plugged with
+    /// virtio-mem.
+    pub fn map_range(&self, table: &mut GuestPageTable, off: u64, len: u64, flags: u64) {
+        let mut page = off;
+        while page < off + len {
+            page += self.map_page(table, page, off + len, flags);
+        }
+    }
+
+    /// Unmaps `[off, off + len)` mapped by `map_range`. Flush the TLBs after
+    /// this.
+    pub fn unmap_range(&self, table: &mut GuestPageTable, off: u64, len: u64) {
+        let mut page = off;
+        while page < off + len {
+            let size = table.unmap(self.guest_base() + page).max(4096);
+            self.populated_pages.fetch_sub(size as usize / 4096, Ordering::Relaxed);
+            page += size;
+        }
+    }
+
+    /// Whether the 2MB page at `off` can be mapped with `-hugepages`, within
+    /// the offset `end`.
+    fn is_megapage(&self, off: u64, end: u64) -> bool {
+        let host_addr = self.host_base.load(Ordering::Acquire) as u64 + off;
+        config().hugepages
+            && (self.guest_base() + off) % MEGAPAGE_SIZE == 0
+            && host_addr % MEGAPAGE_SIZE == 0
+            && off + MEGAPAGE_SIZE <= end
+    }
+
+    /// Maps the page at the offset `off`, up to the offset `end`. Returns its
+    /// size.
+    fn map_page(&self, table: &mut GuestPageTable, off: u64, end: u64, flags: u64) -> u64 {
+        let guest_addr = self.guest_base() + off;
+        let host_addr = self.host_base.load(Ordering::Acquire) as u64 + off;
+        let size = if self.is_megapage(off, end) {
+            table.map_megapage(guest_addr, host_addr, flags);
+            MEGAPAGE_SIZE
+        } else {
             table.map(guest_addr, host_addr, flags);
+            4096
+        };
+
+        self.populated_pages.fetch_add(size as usize / 4096, Ordering::Relaxed);
+        size
+    }
+
+    /// Maps the page at `guest_addr` on the first access from the guest (a
+    /// guest-page fault), instead of the whole memory on boot. Returns false
+    /// if it's not in the memory. Retry the access otherwise: another vCPU
+    /// may have mapped it in the meantime.
+    pub fn populate(&self, table: &mut GuestPageTable, guest_addr: u64, flags: u64) -> bool {
+        if !self.contains(guest_addr) {
+            return false;
+        }
+
+        let _lock = self.populate_lock.lock();
+        if table.is_mapped(guest_addr) {
+            return true;
+        }
+
+        let off = guest_addr - self.guest_base();
+        let megapage_off = off & !(MEGAPAGE_SIZE - 1);
+        let end = self.size() as u64;
+        let off = if self.is_megapage(megapage_off, end) { megapage_off } else { off & !0xfff };
+        let size = self.map_page(table, off, end, flags);
+        // The guest may write to it without faults from now on.
+        self.mark_dirty(self.guest_base() + off, size as usize);
+        true
+    }
+
+    /// `-prealloc`: touches every page, so that QEMU allocates the host
+    /// memory now rather than on the guest's first access. The contents are
+    /// kept.
+    pub fn prealloc(&self) {
+        let host_base = self.host_base.load(Ordering::Acquire) as *mut u8;
+        for off in (0..self.size()).step_by(4096) {
+            unsafe {
+                let ptr = host_base.add(off);
+                ptr.write_volatile(ptr.read_volatile());
+            }
+        }
+    }
+
+    /// The number of 4KB pages mapped into the guest.
+    pub fn populated_pages(&self) -> usize {
+        self.populated_pages.load(Ordering::Relaxed)
+    }
+
+    pub fn size(&self) -> usize {
+        self.size.load(Ordering::Acquire)
+    }
+
+    pub fn contains(&self, guest_addr: u64) -> bool {
+        (self.guest_base()..self.guest_base() + self.size() as u64).contains(&guest_addr)
+    }
+
+    /// Whether `[guest_addr, guest_addr + len)` is in the memory.
+    pub fn contains_range(&self, guest_addr: u64, len: usize) -> bool {
+        let end = self.guest_base() + self.size() as u64;
+        guest_addr >= self.guest_base() && guest_addr.checked_add(len as u64).is_some_and(|range_end| range_end <= end)
+    }
+
+    /// Copies the memory at `guest_addr` into `buf`. Returns None if the range
+    /// is out of the memory.
+    pub fn read_at(&self, guest_addr: u64, buf: &mut [u8]) -> Option<()> {
+        self.check_range(guest_addr, buf.len())?;
+
+        if !buf.is_empty() {
+            unsafe { core::ptr::copy_nonoverlapping(self.host_addr(guest_addr), buf.as_mut_ptr(), buf.len()) };
+        }
+        Some(())
+    }
+
+    /// Copies `buf` into the memory at `guest_addr`. Returns None if the range
+    /// is out of the memory.
+    pub fn write_at(&self, guest_addr: u64, buf: &[u8]) -> Option<()> {
+        self.check_range(guest_addr, buf.len())?;
+
+        if !buf.is_empty() {
+            unsafe { core::ptr::copy_nonoverlapping(buf.as_ptr(), self.host_addr(guest_addr), buf.len()) };
+            self.mark_dirty(guest_addr, buf.len());
+        }
+        Some(())
+    }
+
+    /// `contains_range` for an access: reports it with `-memcheck`.
+    fn check_range(&self, guest_addr: u64, len: usize) -> Option<()> {
+        if !self.contains_range(guest_addr, len) {
+            memcheck::report(Violation::OutOfBounds, guest_addr, len);
+            return None;
         }
+
+        memcheck::check_access(guest_addr, len);
+        Some(())
+    }
+
+    fn dirty_bitmap(&self) -> &[AtomicU64] {
+        let len = (self.size() / 4096).div_ceil(64);
+        let mut bitmap = self.dirty_bitmap.load(Ordering::Acquire);
+        if bitmap.is_null() {
+            // Kept after `stop_dirty_log`: the allocator doesn't free memory.
+            bitmap = alloc_pages(len * size_of::<u64>()) as *mut AtomicU64;
+            self.dirty_bitmap.store(bitmap, Ordering::Release);
+        }
+
+        unsafe { core::slice::from_raw_parts(bitmap, len) }
+    }
+
+    /// Starts recording the pages written by the devices (and `mark_dirty`)
+    /// with all pages dirty. Writes by the guest are caught by the caller.
+    pub fn start_dirty_log(&self) {
+        for (i, word) in self.dirty_bitmap().iter().enumerate() {
+            let remaining = self.size() / 4096 - i * 64;
+            word.store(if remaining >= 64 { u64::MAX } else { (1 << remaining) - 1 }, Ordering::Relaxed);
+        }
+
+        self.dirty_logging.store(true, Ordering::Release);
+    }
+
+    pub fn stop_dirty_log(&self) {
+        self.dirty_logging.store(false, Ordering::Release);
+    }
+
+    /// Marks `[guest_addr, guest_addr + len)` as written. Call this after
+    /// writing to the host address of the memory.
+    pub fn mark_dirty(&self, guest_addr: u64, len: usize) {
+        if !self.dirty_logging.load(Ordering::Acquire) || len == 0 || !self.contains_range(guest_addr, len) {
+            return;
+        }
+
+        let bitmap = self.dirty_bitmap();
+        let first = (guest_addr - self.guest_base()) / 4096;
+        let last = (guest_addr - self.guest_base() + len as u64 - 1) / 4096;
+        for page in first..=last {
+            bitmap[page as usize / 64].fetch_or(1 << (page % 64), Ordering::AcqRel);
+        }
+    }
+
+    /// Clears the dirty bit of the page at `guest_addr`. Returns whether it
+    /// was set.
+    pub fn take_dirty(&self, guest_addr: u64) -> bool {
+        let page = (guest_addr - self.guest_base()) / 4096;
+        let bit = 1 << (page % 64);
+        self.dirty_bitmap()[page as usize / 64].fetch_and(!bit, Ordering::AcqRel) & bit != 0
+    }
+
+    /// The number of dirty pages.
+    pub fn count_dirty(&self) -> usize {
+        self.dirty_bitmap().iter().map(|word| word.load(Ordering::Acquire).count_ones() as usize).sum()
+    }
+
+    le_accessors!(read_u16, write_u16, u16);
+    le_accessors!(read_u32, write_u32, u32);
+    le_accessors!(read_u64, write_u64, u64);
+    atomic_accessors!(load_u16, store_u16, u16, AtomicU16);
+    atomic_accessors!(load_u32, store_u32, u32, AtomicU32);
+    atomic_accessors!(load_u64, store_u64, u64, AtomicU64);
+
+    fn aligned_ptr(&self, guest_addr: u64, len: usize) -> Option<*mut u8> {
+        if guest_addr % len as u64 != 0 {
+            memcheck::report(Violation::Unaligned, guest_addr, len);
+            return None;
+        }
+
+        self.check_range(guest_addr, len)?;
+        Some(self.host_addr(guest_addr))
+    }
+
+    /// Returns the host address of the guest physical address.
+    pub fn host_addr(&self, guest_addr: u64) -> *mut u8 {
+        if !self.contains(guest_addr) {
+            memcheck::report(Violation::OutOfBounds, guest_addr, 0);
+        }
+
+        assert!(self.contains(guest_addr), "{:#x} is not in guest memory", guest_addr);
+        let host_base = self.host_base.load(Ordering::Acquire) as *mut u8;
+        unsafe { host_base.add((guest_addr - self.guest_base()) as usize) }
     }
 }
@@ -1,3 +1,4 @@
+use alloc::vec::Vec;
 use core::mem::size_of;
 
 pub const PTE_R: u64 = 1 << 1; /* Readable */
@@ -6,6 +7,7 @@ pub const PTE_X: u64 = 1 << 3; /* Executable */
 const PTE_V: u64 = 1 << 0; /* Valid */
 const PTE_U: u64 = 1 << 4; /* User */
 const PPN_SHIFT: usize = 12;
+pub const MEGAPAGE_SIZE: u64 = 2 * 1024 * 1024;
 const PTE_PPN_SHIFT: usize = 10;
 
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
@@ -27,6 +29,44 @@ impl Entry {
     }
 }
 
+/// `rwx`, with `-` for the unset bits.
+pub fn perms_str(flags: u64) -> [char; 3] {
+    let bit = |mask, c| if flags & mask != 0 { c } else { '-' };
+    [bit(PTE_R, 'r'), bit(PTE_W, 'w'), bit(PTE_X, 'x')]
+}
+
+/// An entry on the walk for a guest physical address (`info stage2`).
+pub struct WalkStep {
+    /// 3 for the root table, 0 for 4KB pages.
+    pub level: usize,
+    pub index: u64,
+    pub pte: u64,
+}
+
+impl WalkStep {
+    pub fn is_valid(&self) -> bool {
+        Entry(self.pte).is_valid()
+    }
+
+    pub fn is_leaf(&self) -> bool {
+        self.pte & (PTE_R | PTE_W | PTE_X) != 0
+    }
+
+    /// The next table, or the page.
+    pub fn paddr(&self) -> u64 {
+        Entry(self.pte).paddr()
+    }
+}
+
+/// A leaf entry (`info gmap`).
+pub struct Leaf {
+    pub guest_paddr: u64,
+    pub host_paddr: u64,
+    pub size: u64,
+    /// PTE_R, PTE_W, and PTE_X.
+    pub flags: u64,
+}
+
 #[repr(transparent)]
 struct Table([Entry; 512]);
 
@@ -52,13 +92,156 @@ impl GuestPageTable {
         }
     }
 
+    /// The table a vCPU uses.
+    pub fn from_hgatp(hgatp: u64) -> Self {
+        Self {
+            table: ((hgatp & ((1 << 44) - 1)) << PPN_SHIFT) as *mut Table,
+        }
+    }
+
+    /// The address of the root table.
+    pub fn root(&self) -> u64 {
+        self.table as u64
+    }
+
     pub fn hgatp(&self) -> u64 {
         (9u64 << 60/* Sv48x4 */) | (self.table as u64 >> PPN_SHIFT)
     }
 
-    pub fn map(&mut self, guest_paddr: u64, host_paddr: u64, flags: u64) {
+    /// Sets or clears PTE_W of the page mapping `guest_paddr`. Returns the
+    /// size of the page, or None if it's not mapped. Flush the TLBs after
+    /// clearing it.
+    pub fn set_writable(&mut self, guest_paddr: u64, writable: bool) -> Option<u64> {
+        let mut table = unsafe { &mut *self.table };
+        for level in (0..=3).rev() {
+            let entry = table.entry_by_addr(guest_paddr, level);
+            if !entry.is_valid() {
+                return None;
+            }
+
+            if entry.0 & (PTE_R | PTE_W | PTE_X) != 0 {
+                entry.0 = if writable { entry.0 | PTE_W } else { entry.0 & !PTE_W };
+                return Some(4096 << (9 * level));
+            }
+
+            table = unsafe { &mut *(entry.paddr() as *mut Table) };
+        }
+        None
+    }
+
+    /// Whether a page (of any size) maps `guest_paddr`.
+    pub fn is_mapped(&self, guest_paddr: u64) -> bool {
+        let mut table = unsafe { &mut *self.table };
+        for level in (0..=3).rev() {
+            let entry = table.entry_by_addr(guest_paddr, level);
+            if !entry.is_valid() {
+                return false;
+            }
+
+            if entry.0 & (PTE_R | PTE_W | PTE_X) != 0 {
+                return true;
+            }
+
+            table = unsafe { &mut *(entry.paddr() as *mut Table) };
+        }
+        false
+    }
+
+    /// The entries from the root table to the leaf (or the invalid entry)
+    /// for `guest_paddr`.
+    pub fn walk(&self, guest_paddr: u64) -> Vec<WalkStep> {
+        let mut steps = Vec::new();
+        let mut table = unsafe { &mut *self.table };
+        for level in (0..=3).rev() {
+            let index = (guest_paddr >> (12 + 9 * level)) & 0x1ff;
+            let entry = *table.entry_by_addr(guest_paddr, level);
+            steps.push(WalkStep { level, index, pte: entry.0 });
+            if !entry.is_valid() || entry.0 & (PTE_R | PTE_W | PTE_X) != 0 {
+                break;
+            }
+
+            table = unsafe { &mut *(entry.paddr() as *mut Table) };
+        }
+        steps
+    }
+
+    /// All leaf entries, in the order of the guest physical addresses.
+    pub fn leaves(&self) -> Vec<Leaf> {
+        fn collect(table: &Table, level: usize, base: u64, leaves: &mut Vec<Leaf>) {
+            for (index, entry) in table.0.iter().enumerate().filter(|(_, entry)| entry.is_valid()) {
+                let guest_paddr = base | (index as u64) << (12 + 9 * level);
+                if level == 0 || entry.0 & (PTE_R | PTE_W | PTE_X) != 0 {
+                    let size = 4096 << (9 * level);
+                    let flags = entry.0 & (PTE_R | PTE_W | PTE_X);
+                    leaves.push(Leaf { guest_paddr, host_paddr: entry.paddr(), size, flags });
+                } else {
+                    collect(unsafe { &*(entry.paddr() as *const Table) }, level - 1, guest_paddr, leaves);
+                }
+            }
+        }
+
+        let mut leaves = Vec::new();
+        collect(unsafe { &*self.table }, 3, 0, &mut leaves);
+        leaves
+    }
+
+    /// Removes the page mapping `guest_paddr` if any, a 2MB one too. Returns
+    /// its size (0 if not mapped). Flush the TLBs after this.
+    pub fn unmap(&mut self, guest_paddr: u64) -> u64 {
         let mut table = unsafe { &mut *self.table };
         for level in (1..=3).rev() {
+            let entry = table.entry_by_addr(guest_paddr, level);
+            if !entry.is_valid() {
+                return 0;
+            }
+
+            if entry.0 & (PTE_R | PTE_W | PTE_X) != 0 {
+                *entry = Entry(0);
+                return 4096 << (9 * level);
+            }
+
+            table = unsafe { &mut *(entry.paddr() as *mut Table) };
+        }
+
+        let entry = table.entry_by_addr(guest_paddr, 0);
+        if !entry.is_valid() {
+            return 0;
+        }
+
+        *entry = Entry(0);
+        4096
+    }
+
+    /// Removes all mappings. The intermediate tables are kept for the next
+    /// mappings: pages are never freed.
+    pub fn unmap_all(&mut self) {
+        fn clear(table: &mut Table, level: usize) {
+            for entry in table.0.iter_mut().filter(|entry| entry.is_valid()) {
+                if level == 0 || entry.0 & (PTE_R | PTE_W | PTE_X) != 0 {
+                    *entry = Entry(0);
+                } else {
+                    clear(unsafe { &mut *(entry.paddr() as *mut Table) }, level - 1);
+                }
+            }
+        }
+
+        clear(unsafe { &mut *self.table }, 3);
+    }
+
+    pub fn map(&mut self, guest_paddr: u64, host_paddr: u64, flags: u64) {
+        self.map_at_level(guest_paddr, host_paddr, flags, 0);
+    }
+
+    /// Maps a 2MB page. Both addresses must be 2MB-aligned.
+    pub fn map_megapage(&mut self, guest_paddr: u64, host_paddr: u64, flags: u64) {
+        assert!(guest_paddr % MEGAPAGE_SIZE == 0 && host_paddr % MEGAPAGE_SIZE == 0);
+        self.map_at_level(guest_paddr, host_paddr, flags, 1);
+    }
+
+    /// Creates a leaf entry at `leaf_level` (0 for a 4KB page, 1 for a 2MB page).
+    fn map_at_level(&mut self, guest_paddr: u64, host_paddr: u64, flags: u64, leaf_level: usize) {
+        let mut table = unsafe { &mut *self.table };
+        for level in (leaf_level + 1..=3).rev() {
             let entry = table.entry_by_addr(guest_paddr, level);
             if !entry.is_valid() {
                 let new_table_ptr = Table::alloc();
@@ -68,7 +251,7 @@ impl GuestPageTable {
             table = unsafe { &mut *(entry.paddr() as *mut Table) };
         }
 
-        let entry = table.entry_by_addr(guest_paddr, 0);
+        let entry = table.entry_by_addr(guest_paddr, leaf_level);
         assert!(!entry.is_valid(), "already mapped");
         *entry = Entry::new(host_paddr, flags | PTE_V | PTE_U);
     }
@@ -0,0 +1,124 @@
+//! `-trace-guest <size>`: a ring buffer in the guest RAM which the guest
+//! writes its own events into (linux/hvtrace), merged with the VM exits of
+//! `-trace` into one timeline:
+//!
+//! ```text
+//! {"guest": "catsay: printing", "tid": 61, "time": 1834412300}
+//! {"vcpu": 0, "reason": "store guest-page fault", "scause": "0x17", "pc": "0xffffffff80400a2c", "addr": "0x10000000", "mmio": "uart", "time": 1834413100, "ns": 2100}
+//! ```
+//!
+//! `time` is the host time in nanoseconds for both. The events written since
+//! the previous VM exit come before its record; sort by `time` for the exact
+//! order.
+//!
+//! The buffer is the `hv-trace` region in /reserved-memory (`no-map`), which
+//! the guest maps through /dev/mem. All fields are little-endian:
+//!
+//! ```text
+//! header (64 bytes): magic "HVTR" (u32), version (u32), number of entries (u32),
+//!                    reserved (u32), head (u64): the number of entries claimed
+//! entry  (64 bytes): seq (u64), guest time (u64), tid (u32), length (u32), text (40 bytes)
+//! ```
+//!
+//! A writer claims the entry `head % entries` by incrementing `head`
+//! atomically, clears its `seq`, fills it, and then sets `seq` to the claimed
+//! `head` + 1 to commit it. Entries overwritten before we read them are
+//! reported as lost.
+use alloc::{format, string::String};
+use core::sync::atomic::Ordering;
+use spin::{Mutex, Once};
+
+use crate::{guest_memory::GUEST_MEMORY, json, reserved_mem, timer::{self, ticks_to_ns}, trace};
+
+/// The name of the region in /reserved-memory.
+pub const REGION_NAME: &str = "hv-trace";
+const MAGIC: u32 = 0x5254_5648; // "HVTR"
+const VERSION: u32 = 1;
+const HEADER_SIZE: u64 = 64;
+const ENTRY_SIZE: u64 = 64;
+const HEAD_OFFSET: u64 = 16;
+const TEXT_OFFSET: u64 = 24;
+const MAX_TEXT_LEN: usize = (ENTRY_SIZE - TEXT_OFFSET) as usize;
+
+struct Ring {
+    base: u64,
+    entries: u64,
+}
+
+static RING: Once<Ring> = Once::new();
+/// The number of entries read (or lost) so far.
+static TAIL: Mutex<u64> = Mutex::new(0);
+
+/// Writes the header. Call this before the guest boots.
+pub fn init() {
+    let region = reserved_mem::regions().into_iter().find(|region| region.name == REGION_NAME).unwrap();
+    let entries = (region.size - HEADER_SIZE) / ENTRY_SIZE;
+    GUEST_MEMORY.write_at(region.base, &[0; HEADER_SIZE as usize]).unwrap();
+    GUEST_MEMORY.write_u32(region.base, MAGIC).unwrap();
+    GUEST_MEMORY.write_u32(region.base + 4, VERSION).unwrap();
+    GUEST_MEMORY.write_u32(region.base + 8, entries as u32).unwrap();
+    RING.call_once(|| Ring { base: region.base, entries });
+    info!("trace", "guest trace buffer at {:#x} ({} entries)", region.base, entries);
+}
+
+fn host_ns(guest_time: u64) -> u64 {
+    ticks_to_ns(timer::to_host_time(guest_time))
+}
+
+/// Writes out the events committed since the last call. Called before each
+/// VM exit record.
+pub fn drain() {
+    let Some(ring) = RING.get() else {
+        return;
+    };
+
+    let mut tail = TAIL.lock();
+    let Some(head) = GUEST_MEMORY.load_u64(ring.base + HEAD_OFFSET, Ordering::Acquire) else {
+        return;
+    };
+
+    // The header has been rewritten, e.g. by loading an older snapshot.
+    if head < *tail {
+        *tail = head;
+    }
+
+    let mut lost = head.saturating_sub(ring.entries).saturating_sub(*tail);
+    *tail += lost;
+    while *tail < head {
+        let entry = ring.base + HEADER_SIZE + (*tail % ring.entries) * ENTRY_SIZE;
+        let seq = GUEST_MEMORY.load_u64(entry, Ordering::Acquire).unwrap_or(0);
+        if seq < *tail + 1 {
+            // Claimed but not committed yet (cleared, or still the previous
+            // round's).
+            break;
+        }
+
+        let event = read_entry(entry);
+        if seq != *tail + 1 || GUEST_MEMORY.load_u64(entry, Ordering::Acquire) != Some(seq) {
+            // Overwritten by a writer which went around the ring.
+            lost += 1;
+        } else if let Some(line) = event {
+            trace::write(line);
+        }
+        *tail += 1;
+    }
+
+    if lost > 0 {
+        let now = ticks_to_ns(trace::now());
+        trace::write(format!("{{\"guest_lost\": {}, \"time\": {}}}", lost, now));
+    }
+}
+
+fn read_entry(entry: u64) -> Option<String> {
+    let time = GUEST_MEMORY.read_u64(entry + 8)?;
+    let tid = GUEST_MEMORY.read_u32(entry + 16)?;
+    let len = (GUEST_MEMORY.read_u32(entry + 20)? as usize).min(MAX_TEXT_LEN);
+    let mut text = [0; MAX_TEXT_LEN];
+    GUEST_MEMORY.read_at(entry + TEXT_OFFSET, &mut text[..len])?;
+    Some(format!(
+        "{{\"guest\": {}, \"tid\": {}, \"time\": {}}}",
+        json::quote(&String::from_utf8_lossy(&text[..len])),
+        tid,
+        host_ns(time)
+    ))
+}
@@ -0,0 +1,85 @@
+use alloc::{string::String, vec::Vec};
+
+use crate::{
+    allocator::alloc_pages,
+    host_virtio::{HostDevice, HostQueue, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_NEXT, VIRTQ_DESC_F_WRITE},
+};
+
+const VIRTIO_DEVICE_9P: u32 = 9;
+pub const VIRTIO_9P_MOUNT_TAG: u64 = 1 << 0;
+
+/// The maximum message size. Tversion from the guest is clamped to this.
+pub const MAX_MSIZE: usize = 512 * 1024;
+
+/// A virtio-9p device provided by QEMU (`-device virtio-9p-device`).
+pub struct Host9p {
+    device: HostDevice,
+    queue: HostQueue,
+    request: *mut u8,
+    response: *mut u8,
+}
+
+// Pointers in Host9p are owned by Host9p.
+unsafe impl Send for Host9p {}
+
+impl Host9p {
+    fn probe() -> Option<Host9p> {
+        let device = HostDevice::probe(VIRTIO_DEVICE_9P, VIRTIO_F_VERSION_1 | VIRTIO_9P_MOUNT_TAG)?;
+        let queue = HostQueue::new(&device, 0);
+        device.driver_ok();
+
+        let request = alloc_pages(MAX_MSIZE);
+        let response = alloc_pages(MAX_MSIZE);
+        Some(Host9p { device, queue, request, response })
+    }
+
+    /// Looks for the device with the tag (`-device virtio-9p-device,mount_tag=<tag>`).
+    pub fn open(tag: &str) -> Option<Host9p> {
+        let mut others = Vec::new();
+        let mut found = None;
+        while let Some(p9) = Host9p::probe() {
+            if p9.mount_tag() == tag {
+                found = Some(p9);
+                break;
+            }
+
+            others.push(p9);
+        }
+
+        for p9 in others {
+            p9.device.release();
+        }
+
+        let p9 = found?;
+        info!("host-9p", "found virtio-9p \"{}\" at {:#x}", tag, p9.device.base);
+        Some(p9)
+    }
+
+    fn mount_tag(&self) -> String {
+        // struct virtio_9p_config: le16 tag_len, u8 tag[tag_len]
+        let len: u16 = self.device.read_config(0);
+        let tag: Vec<u8> = (0..len as u64).map(|i| self.device.read_config(2 + i)).collect();
+        String::from_utf8_lossy(&tag).into_owned()
+    }
+
+    /// Sends a T-message and waits for the R-message.
+    pub fn request(&mut self, msg: &[u8]) -> &[u8] {
+        assert!(msg.len() <= MAX_MSIZE);
+        unsafe {
+            core::ptr::copy_nonoverlapping(msg.as_ptr(), self.request, msg.len());
+        }
+
+        self.queue.set_desc(0, self.request as u64, msg.len() as u32, VIRTQ_DESC_F_NEXT, 1);
+        self.queue.set_desc(1, self.response as u64, MAX_MSIZE as u32, VIRTQ_DESC_F_WRITE, 0);
+        self.queue.submit(0);
+        self.device.notify(0);
+        while self.queue.pop_used().is_none() {
+            core::hint::spin_loop();
+        }
+
+        // The message starts with size[4].
+        let header = unsafe { core::slice::from_raw_parts(self.response, 4) };
+        let len = (u32::from_le_bytes(header.try_into().unwrap()) as usize).min(MAX_MSIZE);
+        unsafe { core::slice::from_raw_parts(self.response, len) }
+    }
+}
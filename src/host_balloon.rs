@@ -0,0 +1,44 @@
+//! virtio-balloon provided by QEMU (`-device virtio-balloon-device,free-page-reporting=on`).
+//! We only use free page reporting to return unused memory to the host.
+use crate::host_virtio::{HostDevice, HostQueue, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_WRITE};
+
+const VIRTIO_DEVICE_BALLOON: u32 = 5;
+/// QEMU always creates the stats queue: negotiate it to agree on the queue
+/// indices.
+const VIRTIO_BALLOON_F_STATS_VQ: u64 = 1 << 1;
+const VIRTIO_BALLOON_F_REPORTING: u64 = 1 << 5;
+/// inflateq, deflateq, statsq, then reporting_vq.
+const REPORTING_QUEUE: u32 = 3;
+/// QEMU's reporting_vq has 32 entries.
+const REPORTING_QUEUE_SIZE: u16 = 32;
+
+pub struct HostBalloon {
+    device: HostDevice,
+    queue: HostQueue,
+}
+
+// Pointers in HostBalloon are owned by HostBalloon.
+unsafe impl Send for HostBalloon {}
+
+impl HostBalloon {
+    pub fn open() -> Option<HostBalloon> {
+        let features = VIRTIO_F_VERSION_1 | VIRTIO_BALLOON_F_STATS_VQ | VIRTIO_BALLOON_F_REPORTING;
+        let device = HostDevice::probe(VIRTIO_DEVICE_BALLOON, features)?;
+        let queue = HostQueue::with_size(&device, REPORTING_QUEUE, REPORTING_QUEUE_SIZE);
+        device.driver_ok();
+
+        info!("host-balloon", "found virtio-balloon at {:#x}", device.base);
+        Some(HostBalloon { device, queue })
+    }
+
+    /// Reports unused memory. QEMU discards it (MADV_DONTNEED), and it
+    /// reads as zeros when it's touched again.
+    pub fn report(&mut self, host_addr: u64, len: u32) {
+        self.queue.set_desc(0, host_addr, len, VIRTQ_DESC_F_WRITE, 0);
+        self.queue.submit(0);
+        self.device.notify(REPORTING_QUEUE);
+        while self.queue.pop_used().is_none() {
+            core::hint::spin_loop();
+        }
+    }
+}
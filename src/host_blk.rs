@@ -0,0 +1,181 @@
+use alloc::{string::String, vec::Vec};
+
+use crate::{
+    allocator::alloc_pages,
+    host_plic,
+    host_virtio::{HostDevice, HostQueue, QUEUE_SIZE, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_NEXT, VIRTQ_DESC_F_WRITE},
+};
+
+const VIRTIO_DEVICE_BLK: u32 = 2;
+pub const VIRTIO_BLK_F_FLUSH: u64 = 1 << 9;
+
+pub const SECTOR_SIZE: u64 = 512;
+
+pub const VIRTIO_BLK_T_IN: u32 = 0;
+pub const VIRTIO_BLK_T_OUT: u32 = 1;
+pub const VIRTIO_BLK_T_FLUSH: u32 = 4;
+pub const VIRTIO_BLK_T_GET_ID: u32 = 8;
+pub const VIRTIO_BLK_ID_BYTES: usize = 20;
+
+pub const VIRTIO_BLK_S_OK: u8 = 0;
+pub const VIRTIO_BLK_S_IOERR: u8 = 1;
+pub const VIRTIO_BLK_S_UNSUPP: u8 = 2;
+
+#[repr(C)]
+struct RequestHeader {
+    type_: u32,
+    reserved: u32,
+    sector: u64,
+}
+
+/// The device-readable header and the device-writable status of a request.
+#[repr(C)]
+struct Request {
+    header: RequestHeader,
+    status: u8,
+}
+
+/// A virtio-blk device provided by QEMU (`-device virtio-blk-device`).
+pub struct HostBlk {
+    device: HostDevice,
+    queue: HostQueue,
+    /// Indexed by the head descriptor of the request.
+    requests: *mut Request,
+    free_descs: Vec<u16>,
+    /// The disk size in sectors.
+    capacity: u64,
+}
+
+// Pointers in HostBlk are owned by HostBlk.
+unsafe impl Send for HostBlk {}
+
+impl HostBlk {
+    fn probe() -> Option<HostBlk> {
+        let device = HostDevice::probe(VIRTIO_DEVICE_BLK, VIRTIO_F_VERSION_1 | VIRTIO_BLK_F_FLUSH)?;
+        let queue = HostQueue::new(&device, 0);
+        device.driver_ok();
+
+        // struct virtio_blk_config: le64 capacity, ...
+        let capacity: u64 = device.read_config(0);
+        let requests = alloc_pages(QUEUE_SIZE as usize * size_of::<Request>()) as *mut Request;
+        let free_descs = (0..QUEUE_SIZE).rev().collect();
+        Some(HostBlk { device, queue, requests, free_descs, capacity })
+    }
+
+    /// Looks for the disk with the serial (`-device virtio-blk-device,serial=<serial>`).
+    pub fn open(serial: &str) -> Option<HostBlk> {
+        let mut others = Vec::new();
+        let mut found = None;
+        while let Some(mut blk) = HostBlk::probe() {
+            if blk.serial() == serial {
+                found = Some(blk);
+                break;
+            }
+
+            others.push(blk);
+        }
+
+        for blk in others {
+            blk.device.release();
+        }
+
+        let blk = found?;
+        info!(
+            "host-blk",
+            "found virtio-blk \"{}\" at {:#x} ({} KB)",
+            serial,
+            blk.device.base,
+            blk.capacity * SECTOR_SIZE / 1024
+        );
+        Some(blk)
+    }
+
+    pub fn capacity(&self) -> u64 {
+        self.capacity
+    }
+
+    /// Gives the device back: HostBlk::open can find it again.
+    pub fn close(self) {
+        self.device.release();
+    }
+
+    fn serial(&mut self) -> String {
+        let mut id = [0u8; VIRTIO_BLK_ID_BYTES];
+        if self.request(VIRTIO_BLK_T_GET_ID, 0, id.as_mut_ptr(), id.len()) != VIRTIO_BLK_S_OK {
+            return String::new();
+        }
+
+        let len = id.iter().position(|&b| b == 0).unwrap_or(id.len());
+        String::from_utf8_lossy(&id[..len]).into_owned()
+    }
+
+    /// Issues a request and waits for its completion. `buf` is a host address.
+    /// No other requests may be in flight.
+    pub fn request(&mut self, type_: u32, sector: u64, buf: *mut u8, len: usize) -> u8 {
+        let bufs = if len > 0 { &[(buf, len)][..] } else { &[] };
+        let id = self.submit(type_, sector, bufs).expect("[host-blk] no free descriptors");
+        loop {
+            if let Some((done, status)) = self.poll() {
+                assert_eq!(done, id, "[host-blk] another request is in flight");
+                return status;
+            }
+
+            core::hint::spin_loop();
+        }
+    }
+
+    /// Starts a request without waiting for it. `bufs` are (host address,
+    /// length). Returns the ID for `poll`, or None if the queue is full.
+    pub fn submit(&mut self, type_: u32, sector: u64, bufs: &[(*mut u8, usize)]) -> Option<u16> {
+        if self.free_descs.len() < bufs.len() + 2 {
+            return None;
+        }
+
+        let descs: Vec<u16> = (0..bufs.len() + 2).map(|_| self.free_descs.pop().unwrap()).collect();
+        let head = descs[0];
+        let request = unsafe { self.requests.add(head as usize) };
+        unsafe {
+            (&raw mut (*request).header).write_volatile(RequestHeader { type_, reserved: 0, sector });
+            (&raw mut (*request).status).write_volatile(0xff);
+        }
+
+        let header_len = size_of::<RequestHeader>() as u32;
+        self.queue.set_desc(head, request as u64, header_len, VIRTQ_DESC_F_NEXT, descs[1]);
+        let data_flags = if type_ == VIRTIO_BLK_T_OUT { 0 } else { VIRTQ_DESC_F_WRITE };
+        for (i, &(buf, len)) in bufs.iter().enumerate() {
+            self.queue.set_desc(descs[i + 1], buf as u64, len as u32, data_flags | VIRTQ_DESC_F_NEXT, descs[i + 2]);
+        }
+
+        let status = unsafe { &raw mut (*request).status };
+        self.queue.set_desc(descs[bufs.len() + 1], status as u64, 1, VIRTQ_DESC_F_WRITE, 0);
+        self.queue.submit(head);
+        self.device.notify(0);
+        Some(head)
+    }
+
+    /// Takes a completed request: (ID, status).
+    pub fn poll(&mut self) -> Option<(u16, u8)> {
+        let (head, _) = self.queue.pop_used()?;
+        let status = unsafe { (&raw const (*self.requests.add(head as usize)).status).read_volatile() };
+        let mut index = Some(head);
+        while let Some(desc) = index {
+            index = self.queue.next_desc(desc);
+            self.free_descs.push(desc);
+        }
+
+        Some((head, status))
+    }
+
+    /// Routes the completion interrupt to the (physical) hart.
+    pub fn enable_interrupt(&self, hart_id: u64) {
+        host_plic::enable(self.device.irq, hart_id);
+    }
+
+    pub fn irq(&self) -> u32 {
+        self.device.irq
+    }
+
+    pub fn ack_interrupt(&self) {
+        self.device.ack_interrupt();
+    }
+}
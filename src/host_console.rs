@@ -0,0 +1,295 @@
+//! virtio-console provided by QEMU (`-device virtio-serial-device`) with
+//! named ports (`-device virtserialport,name=<name>`).
+use alloc::{collections::VecDeque, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    allocator::alloc_pages,
+    host_plic,
+    host_virtio::{HostDevice, HostQueue, QUEUE_SIZE, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_WRITE},
+};
+
+const VIRTIO_DEVICE_CONSOLE: u32 = 3;
+const VIRTIO_CONSOLE_F_MULTIPORT: u64 = 1 << 1;
+
+// Queue 0/1 are for port 0, 2/3 are for control messages, and 4/5 are for
+// port 1, and so on.
+const CONTROL_RX_QUEUE: u32 = 2;
+const CONTROL_TX_QUEUE: u32 = 3;
+const BUFFER_SIZE: usize = 64;
+/// The number of ports we use. virtserialport starts from port 1.
+const MAX_PORTS: u32 = 8;
+
+const VIRTIO_CONSOLE_DEVICE_READY: u16 = 0;
+const VIRTIO_CONSOLE_DEVICE_ADD: u16 = 1;
+const VIRTIO_CONSOLE_DEVICE_REMOVE: u16 = 2;
+const VIRTIO_CONSOLE_PORT_READY: u16 = 3;
+const VIRTIO_CONSOLE_PORT_OPEN: u16 = 6;
+const VIRTIO_CONSOLE_PORT_NAME: u16 = 7;
+
+fn rx_queue_index(port: u32) -> u32 {
+    if port == 0 { 0 } else { 2 + 2 * port }
+}
+
+/// A virtqueue where descriptor N always points to buffer N.
+struct RxQueue {
+    queue: HostQueue,
+    buffers: *mut u8,
+}
+
+impl RxQueue {
+    fn new(device: &HostDevice, index: u32) -> Self {
+        let mut queue = HostQueue::new(device, index);
+        let buffers = alloc_pages(QUEUE_SIZE as usize * BUFFER_SIZE);
+        for i in 0..QUEUE_SIZE {
+            let addr = unsafe { buffers.add(i as usize * BUFFER_SIZE) } as u64;
+            queue.set_desc(i, addr, BUFFER_SIZE as u32, VIRTQ_DESC_F_WRITE, 0);
+            queue.submit(i);
+        }
+
+        Self { queue, buffers }
+    }
+
+    /// Takes a received buffer and returns it to the device.
+    fn pop(&mut self) -> Option<Vec<u8>> {
+        let (index, len) = self.queue.pop_used()?;
+        let buffer = unsafe { self.buffers.add(index as usize * BUFFER_SIZE) };
+        let data = unsafe { core::slice::from_raw_parts(buffer, (len as usize).min(BUFFER_SIZE)) }.to_vec();
+        self.queue.submit(index);
+        Some(data)
+    }
+}
+
+struct TxQueue {
+    queue: HostQueue,
+    buffer: *mut u8,
+}
+
+impl TxQueue {
+    fn new(device: &HostDevice, index: u32) -> Self {
+        Self { queue: HostQueue::new(device, index), buffer: alloc_pages(0x1000) }
+    }
+
+    /// Writes data and waits for the device to consume it.
+    fn write(&mut self, device: &HostDevice, index: u32, data: &[u8]) {
+        for chunk in data.chunks(0x1000) {
+            unsafe {
+                core::ptr::copy_nonoverlapping(chunk.as_ptr(), self.buffer, chunk.len());
+            }
+
+            self.queue.set_desc(0, self.buffer as u64, chunk.len() as u32, 0, 0);
+            self.queue.submit(0);
+            device.notify(index);
+            while self.queue.pop_used().is_none() {
+                core::hint::spin_loop();
+            }
+        }
+    }
+}
+
+struct Port {
+    id: u32,
+    /// Set by VIRTIO_CONSOLE_PORT_NAME.
+    name: Option<String>,
+    /// Whether a program is connected to the host side (e.g. a socket client).
+    host_connected: bool,
+    rx: RxQueue,
+    tx: TxQueue,
+    /// Received bytes not read yet.
+    received: VecDeque<u8>,
+}
+
+struct HostConsole {
+    device: HostDevice,
+    control_rx: RxQueue,
+    control_tx: TxQueue,
+    ports: Vec<Port>,
+}
+
+// Pointers in HostConsole are owned by HostConsole.
+unsafe impl Send for HostConsole {}
+
+impl HostConsole {
+    fn send_control(&mut self, id: u32, event: u16, value: u16) {
+        // struct virtio_console_control: le32 id, le16 event, le16 value
+        let mut msg = [0; 8];
+        msg[0..4].copy_from_slice(&id.to_le_bytes());
+        msg[4..6].copy_from_slice(&event.to_le_bytes());
+        msg[6..8].copy_from_slice(&value.to_le_bytes());
+        self.control_tx.write(&self.device, CONTROL_TX_QUEUE, &msg);
+    }
+
+    /// Handles control messages from the device.
+    fn poll_control(&mut self) {
+        let mut used = false;
+        while let Some(msg) = self.control_rx.pop() {
+            used = true;
+            if msg.len() < 8 {
+                continue;
+            }
+
+            let id = u32::from_le_bytes(msg[0..4].try_into().unwrap());
+            let event = u16::from_le_bytes(msg[4..6].try_into().unwrap());
+            let value = u16::from_le_bytes(msg[6..8].try_into().unwrap());
+            let port = self.ports.iter_mut().find(|port| port.id == id);
+            match (event, port) {
+                (VIRTIO_CONSOLE_DEVICE_ADD, Some(_)) => {
+                    // The guest (we) is ready and connected.
+                    self.send_control(id, VIRTIO_CONSOLE_PORT_READY, 1);
+                    self.send_control(id, VIRTIO_CONSOLE_PORT_OPEN, 1);
+                }
+                (VIRTIO_CONSOLE_DEVICE_ADD, None) => {
+                    warn!("host-console", "ignoring port {} (only {} ports supported)", id, MAX_PORTS);
+                    self.send_control(id, VIRTIO_CONSOLE_PORT_READY, 0);
+                }
+                (VIRTIO_CONSOLE_PORT_NAME, Some(port)) => {
+                    port.name = Some(String::from_utf8_lossy(&msg[8..]).into_owned());
+                }
+                (VIRTIO_CONSOLE_PORT_OPEN, Some(port)) => port.host_connected = value == 1,
+                (VIRTIO_CONSOLE_DEVICE_REMOVE, Some(port)) => port.name = None,
+                _ => {}
+            }
+        }
+
+        if used {
+            self.device.notify(CONTROL_RX_QUEUE);
+        }
+    }
+
+    /// Moves received data into `received` of each port.
+    fn poll(&mut self) {
+        self.poll_control();
+        for port in &mut self.ports {
+            let mut used = false;
+            while let Some(data) = port.rx.pop() {
+                port.received.extend(data);
+                used = true;
+            }
+
+            if used {
+                self.device.notify(rx_queue_index(port.id));
+            }
+        }
+    }
+
+    fn port(&mut self, name: &str) -> Option<&mut Port> {
+        self.ports.iter_mut().find(|port| port.name.as_deref() == Some(name))
+    }
+}
+
+static HOST_CONSOLE: Mutex<Option<HostConsole>> = Mutex::new(None);
+
+pub fn init(hart_id: u64) {
+    let Some(device) = HostDevice::probe(VIRTIO_DEVICE_CONSOLE, VIRTIO_F_VERSION_1 | VIRTIO_CONSOLE_F_MULTIPORT)
+    else {
+        warn!("host-console", "virtio-console device not found");
+        return;
+    };
+
+    // struct virtio_console_config: le16 cols, le16 rows, le32 max_nr_ports, ...
+    let max_nr_ports: u32 = device.read_config(4);
+    let ports: Vec<Port> = (0..max_nr_ports.min(MAX_PORTS))
+        .map(|id| Port {
+            id,
+            name: None,
+            host_connected: false,
+            rx: RxQueue::new(&device, rx_queue_index(id)),
+            tx: TxQueue::new(&device, rx_queue_index(id) + 1),
+            received: VecDeque::new(),
+        })
+        .collect();
+
+    let control_rx = RxQueue::new(&device, CONTROL_RX_QUEUE);
+    let control_tx = TxQueue::new(&device, CONTROL_TX_QUEUE);
+    device.driver_ok();
+    for port in &ports {
+        device.notify(rx_queue_index(port.id));
+    }
+    device.notify(CONTROL_RX_QUEUE);
+
+    let mut console = HostConsole { device, control_rx, control_tx, ports };
+
+    // QEMU handles control messages synchronously: ports are added and named
+    // when these calls return.
+    console.send_control(0, VIRTIO_CONSOLE_DEVICE_READY, 1);
+    console.poll_control();
+
+    host_plic::enable(console.device.irq, hart_id);
+    info!("host-console", "found virtio-console at {:#x} (irq={})", console.device.base, console.device.irq);
+    for port in &console.ports {
+        if let Some(name) = &port.name {
+            info!("host-console", "port {}: \"{}\"", port.id, name);
+        }
+    }
+
+    *HOST_CONSOLE.lock() = Some(console);
+}
+
+pub fn irq() -> Option<u32> {
+    HOST_CONSOLE.lock().as_ref().map(|console| console.device.irq)
+}
+
+/// Returns true if the port exists (`-device virtserialport,name=<name>`).
+pub fn has_port(name: &str) -> bool {
+    HOST_CONSOLE.lock().as_mut().is_some_and(|console| console.port(name).is_some())
+}
+
+pub fn is_connected(name: &str) -> bool {
+    let mut lock = HOST_CONSOLE.lock();
+    let Some(console) = lock.as_mut() else {
+        return false;
+    };
+
+    console.poll_control();
+    console.port(name).is_some_and(|port| port.host_connected)
+}
+
+/// Writes data and waits for the device to consume it.
+pub fn write(name: &str, data: &[u8]) {
+    let mut lock = HOST_CONSOLE.lock();
+    let console = lock.as_mut().expect("[host-console] not initialized");
+    let device = &console.device;
+    let Some(port) = console.ports.iter_mut().find(|port| port.name.as_deref() == Some(name)) else {
+        return;
+    };
+
+    port.tx.write(device, rx_queue_index(port.id) + 1, data);
+}
+
+/// Returns the next received byte without consuming it.
+pub fn peek(name: &str) -> Option<u8> {
+    let mut lock = HOST_CONSOLE.lock();
+    let console = lock.as_mut().expect("[host-console] not initialized");
+    console.poll();
+    console.port(name)?.received.front().copied()
+}
+
+pub fn read(name: &str) -> Option<u8> {
+    let mut lock = HOST_CONSOLE.lock();
+    let console = lock.as_mut().expect("[host-console] not initialized");
+    console.poll();
+    console.port(name)?.received.pop_front()
+}
+
+/// Reads received bytes into `buf`. Returns the number of bytes read.
+pub fn read_bytes(name: &str, buf: &mut [u8]) -> usize {
+    let mut lock = HOST_CONSOLE.lock();
+    let console = lock.as_mut().expect("[host-console] not initialized");
+    console.poll();
+    let Some(port) = console.port(name) else {
+        return 0;
+    };
+
+    let len = buf.len().min(port.received.len());
+    for (dst, src) in buf.iter_mut().zip(port.received.drain(..len)) {
+        *dst = src;
+    }
+    len
+}
+
+pub fn handle_interrupt() {
+    let mut lock = HOST_CONSOLE.lock();
+    let console = lock.as_mut().expect("[host-console] not initialized");
+    console.device.ack_interrupt();
+    console.poll();
+}
@@ -0,0 +1,107 @@
+use spin::Once;
+
+pub const FDT_MAGIC: u32 = 0xd00dfeed;
+pub const FDT_BEGIN_NODE: u32 = 1;
+pub const FDT_END_NODE: u32 = 2;
+pub const FDT_PROP: u32 = 3;
+pub const FDT_NOP: u32 = 4;
+const FDT_END: u32 = 9;
+
+static HOST_DTB: Once<&'static [u8]> = Once::new();
+
+fn read_u32(dtb: &[u8], offset: usize) -> u32 {
+    u32::from_be_bytes(dtb[offset..offset + 4].try_into().unwrap())
+}
+
+fn read_cstr(dtb: &[u8], offset: usize) -> &str {
+    let len = dtb[offset..].iter().position(|&b| b == 0).unwrap();
+    core::str::from_utf8(&dtb[offset..offset + len]).unwrap_or("")
+}
+
+pub fn init(dtb_addr: u64) {
+    let header = unsafe { core::slice::from_raw_parts(dtb_addr as *const u8, 8) };
+    assert_eq!(read_u32(header, 0), FDT_MAGIC, "invalid device tree magic");
+    let total_size = read_u32(header, 4) as usize;
+    let dtb = unsafe { core::slice::from_raw_parts(dtb_addr as *const u8, total_size) };
+    HOST_DTB.call_once(|| dtb);
+}
+
+/// Looks for a property in the node at `node_path`, e.g. `/chosen`.
+pub fn find_property(node_path: &str, prop_name: &str) -> Option<&'static [u8]> {
+    let dtb = *HOST_DTB.get().expect("host device tree not initialized");
+    let struct_off = read_u32(dtb, 8) as usize;
+    let strings_off = read_u32(dtb, 12) as usize;
+
+    // The root node has an empty name, so "/chosen" is split into ["", "chosen"].
+    let path = node_path.trim_end_matches('/');
+    let num_components = path.split('/').count();
+
+    let mut offset = struct_off;
+    let mut depth = 0;
+    let mut matched = 0;
+    loop {
+        let token = read_u32(dtb, offset);
+        offset += 4;
+        match token {
+            FDT_BEGIN_NODE => {
+                let name = read_cstr(dtb, offset);
+                offset = (offset + name.len() + 1).next_multiple_of(4);
+                if matched == depth && path.split('/').nth(depth) == Some(name) {
+                    matched += 1;
+                }
+                depth += 1;
+            }
+            FDT_END_NODE => {
+                depth -= 1;
+                matched = matched.min(depth);
+            }
+            FDT_PROP => {
+                let len = read_u32(dtb, offset) as usize;
+                let name_off = read_u32(dtb, offset + 4) as usize;
+                let value = &dtb[offset + 8..offset + 8 + len];
+                offset = (offset + 8 + len).next_multiple_of(4);
+                if matched == num_components
+                    && depth == num_components
+                    && read_cstr(dtb, strings_off + name_off) == prop_name
+                {
+                    return Some(value);
+                }
+            }
+            FDT_NOP => {}
+            FDT_END => return None,
+            _ => panic!("invalid device tree token: {:#x}", token),
+        }
+    }
+}
+
+/// Returns the end address of the RAM (`/memory@80000000`).
+pub fn ram_end() -> Option<u64> {
+    // #address-cells and #size-cells are 2 in QEMU virt.
+    let reg = find_property("/memory@80000000", "reg")?;
+    let base = u64::from_be_bytes(reg.get(0..8)?.try_into().unwrap());
+    let size = u64::from_be_bytes(reg.get(8..16)?.try_into().unwrap());
+    Some(base + size)
+}
+
+/// Returns true if the host CPU has a multi-letter ISA extension, e.g. `sstc`.
+pub fn has_isa_extension(name: &str) -> bool {
+    find_property("/cpus/cpu@0", "riscv,isa")
+        .and_then(|value| core::str::from_utf8(value).ok())
+        .is_some_and(|isa| isa.trim_end_matches('\0').split('_').skip(1).any(|ext| ext == name))
+}
+
+/// Returns true if the host CPU has a single-letter ISA extension, e.g. `v`.
+pub fn has_isa_letter(letter: char) -> bool {
+    find_property("/cpus/cpu@0", "riscv,isa")
+        .and_then(|value| core::str::from_utf8(value).ok())
+        .and_then(|isa| isa.trim_end_matches('\0').split('_').next()?.strip_prefix("rv64"))
+        .is_some_and(|letters| letters.contains(letter))
+}
+
+/// Returns the command line given by `qemu-system-riscv64 -append`.
+pub fn bootargs() -> &'static str {
+    find_property("/chosen", "bootargs")
+        .and_then(|value| core::str::from_utf8(value).ok())
+        .map(|s| s.trim_end_matches('\0'))
+        .unwrap_or("")
+}
@@ -0,0 +1,135 @@
+use alloc::{string::String, vec::Vec};
+
+use crate::{
+    allocator::alloc_pages,
+    host_virtio::{HostDevice, HostQueue, QUEUE_SIZE, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_NEXT, VIRTQ_DESC_F_WRITE},
+};
+
+const VIRTIO_DEVICE_FS: u32 = 26;
+const HIPRIO_QUEUE: u32 = 0;
+const REQUEST_QUEUE: u32 = 1;
+/// The length of `tag` in struct virtio_fs_config.
+pub const TAG_LEN: usize = 36;
+
+/// The maximum request or reply copied through the bounce buffers.
+pub const MAX_MESSAGE: usize = 1024 * 1024;
+/// The maximum buffers in a request passed in place.
+pub const MAX_BUFFERS: usize = QUEUE_SIZE as usize;
+
+/// A virtio-fs device provided by QEMU (`-device vhost-user-fs-device`),
+/// which forwards FUSE requests to virtiofsd over vhost-user.
+pub struct HostFs {
+    device: HostDevice,
+    hiprio: HostQueue,
+    requests: HostQueue,
+    request: *mut u8,
+    reply: *mut u8,
+}
+
+// Pointers in HostFs are owned by HostFs.
+unsafe impl Send for HostFs {}
+
+impl HostFs {
+    fn probe() -> Option<HostFs> {
+        let device = HostDevice::probe(VIRTIO_DEVICE_FS, VIRTIO_F_VERSION_1)?;
+        let hiprio = HostQueue::new(&device, HIPRIO_QUEUE);
+        let requests = HostQueue::new(&device, REQUEST_QUEUE);
+        device.driver_ok();
+
+        let request = alloc_pages(MAX_MESSAGE);
+        let reply = alloc_pages(MAX_MESSAGE);
+        Some(HostFs { device, hiprio, requests, request, reply })
+    }
+
+    /// Looks for the device with the tag (`-device vhost-user-fs-device,tag=<tag>`).
+    pub fn open(tag: &str) -> Option<HostFs> {
+        let mut others = Vec::new();
+        let mut found = None;
+        while let Some(fs) = HostFs::probe() {
+            if fs.tag() == tag {
+                found = Some(fs);
+                break;
+            }
+
+            others.push(fs);
+        }
+
+        for fs in others {
+            fs.device.release();
+        }
+
+        let fs = found?;
+        info!("host-fs", "found virtio-fs \"{}\" at {:#x}", tag, fs.device.base);
+        Some(fs)
+    }
+
+    fn tag(&self) -> String {
+        // struct virtio_fs_config: u8 tag[36] (NUL-padded), le32 num_request_queues
+        let tag: Vec<u8> =
+            (0..TAG_LEN as u64).map(|i| self.device.read_config::<u8>(i)).take_while(|&c| c != 0).collect();
+        String::from_utf8_lossy(&tag).into_owned()
+    }
+
+    fn copy_request(&mut self, msg: &[u8]) {
+        assert!(msg.len() <= MAX_MESSAGE);
+        unsafe {
+            core::ptr::copy_nonoverlapping(msg.as_ptr(), self.request, msg.len());
+        }
+    }
+
+    fn wait_reply(&mut self) -> u32 {
+        loop {
+            if let Some((_, len)) = self.requests.pop_used() {
+                return len;
+            }
+
+            core::hint::spin_loop();
+        }
+    }
+
+    /// Sends a FUSE request in place, and waits for the reply. `bufs` are
+    /// (host address, length, device-writable), the device-readable ones
+    /// first. Returns the length of the reply.
+    pub fn request(&mut self, bufs: &[(*mut u8, u32, bool)]) -> u32 {
+        assert!(!bufs.is_empty() && bufs.len() <= MAX_BUFFERS);
+        for (i, &(addr, len, writable)) in bufs.iter().enumerate() {
+            let mut flags = if writable { VIRTQ_DESC_F_WRITE } else { 0 };
+            let mut next = 0;
+            if i + 1 < bufs.len() {
+                flags |= VIRTQ_DESC_F_NEXT;
+                next = i as u16 + 1;
+            }
+
+            self.requests.set_desc(i as u16, addr as u64, len, flags, next);
+        }
+
+        self.requests.submit(0);
+        self.device.notify(REQUEST_QUEUE);
+        self.wait_reply()
+    }
+
+    /// Sends a FUSE request through the bounce buffers, and waits for the
+    /// reply, up to `reply_len` bytes.
+    pub fn request_copied(&mut self, msg: &[u8], reply_len: usize) -> &[u8] {
+        self.copy_request(msg);
+        let reply_len = reply_len.min(MAX_MESSAGE);
+        self.requests.set_desc(0, self.request as u64, msg.len() as u32, VIRTQ_DESC_F_NEXT, 1);
+        self.requests.set_desc(1, self.reply as u64, reply_len as u32, VIRTQ_DESC_F_WRITE, 0);
+        self.requests.submit(0);
+        self.device.notify(REQUEST_QUEUE);
+        let written = (self.wait_reply() as usize).min(reply_len);
+        unsafe { core::slice::from_raw_parts(self.reply, written) }
+    }
+
+    /// Sends a request without a reply (FUSE_FORGET and FUSE_INTERRUPT) on the
+    /// high priority queue.
+    pub fn request_hiprio(&mut self, msg: &[u8]) {
+        self.copy_request(msg);
+        self.hiprio.set_desc(0, self.request as u64, msg.len() as u32, 0, 0);
+        self.hiprio.submit(0);
+        self.device.notify(HIPRIO_QUEUE);
+        while self.hiprio.pop_used().is_none() {
+            core::hint::spin_loop();
+        }
+    }
+}
@@ -0,0 +1,158 @@
+//! fw_cfg provided by QEMU: reads files given by `-fw_cfg name=<name>,file=<path>`,
+//! and writes the ones QEMU devices are configured with (e.g. etc/ramfb).
+use core::sync::atomic::{Ordering, fence};
+
+// fw_cfg of the QEMU virt machine.
+const FW_CFG_ADDR: u64 = 0x1010_0000;
+const FW_CFG_DATA: u64 = FW_CFG_ADDR;
+const FW_CFG_SELECTOR: u64 = FW_CFG_ADDR + 0x8;
+const FW_CFG_DMA: u64 = FW_CFG_ADDR + 0x10;
+
+const FW_CFG_SIGNATURE: u16 = 0x0000;
+const FW_CFG_ID: u16 = 0x0001;
+const FW_CFG_FILE_DIR: u16 = 0x0019;
+const FW_CFG_VERSION_DMA: u32 = 1 << 1;
+
+const FW_CFG_DMA_CTL_ERROR: u32 = 1 << 0;
+const FW_CFG_DMA_CTL_READ: u32 = 1 << 1;
+const FW_CFG_DMA_CTL_SKIP: u32 = 1 << 2;
+const FW_CFG_DMA_CTL_SELECT: u32 = 1 << 3;
+const FW_CFG_DMA_CTL_WRITE: u32 = 1 << 4;
+
+/// struct FWCfgDmaAccess. All fields are big-endian.
+#[repr(C)]
+struct DmaAccess {
+    control: u32,
+    length: u32,
+    address: u64,
+}
+
+fn select(selector: u16) {
+    unsafe { core::ptr::write_volatile(FW_CFG_SELECTOR as *mut u16, selector.to_be()) }
+}
+
+fn read_bytes(buf: &mut [u8]) {
+    for byte in buf {
+        *byte = unsafe { core::ptr::read_volatile(FW_CFG_DATA as *const u8) };
+    }
+}
+
+fn read_be32() -> u32 {
+    let mut buf = [0; 4];
+    read_bytes(&mut buf);
+    u32::from_be_bytes(buf)
+}
+
+fn is_available() -> bool {
+    select(FW_CFG_SIGNATURE);
+    let mut signature = [0; 4];
+    read_bytes(&mut signature);
+    if &signature != b"QEMU" {
+        return false;
+    }
+
+    // Unlike others, the feature bitmap is little-endian.
+    select(FW_CFG_ID);
+    let mut features = [0; 4];
+    read_bytes(&mut features);
+    u32::from_le_bytes(features) & FW_CFG_VERSION_DMA != 0
+}
+
+/// Looks for a file in the directory. Returns (selector, size).
+fn find(name: &str) -> Option<(u16, usize)> {
+    if !is_available() {
+        warn!("host-fw-cfg", "fw_cfg with DMA not found");
+        return None;
+    }
+
+    // struct FWCfgFile: be32 size, be16 select, be16 reserved, char name[56]
+    select(FW_CFG_FILE_DIR);
+    let count = read_be32();
+    for _ in 0..count {
+        let mut entry = [0; 64];
+        read_bytes(&mut entry);
+        let size = u32::from_be_bytes(entry[0..4].try_into().unwrap()) as usize;
+        let selector = u16::from_be_bytes(entry[4..6].try_into().unwrap());
+        let len = entry[8..].iter().position(|&b| b == 0).unwrap_or(56);
+        if &entry[8..8 + len] == name.as_bytes() {
+            return Some((selector, size));
+        }
+    }
+
+    None
+}
+
+/// Returns the size of a file.
+pub fn file_size(name: &str) -> Option<usize> {
+    find(name).map(|(_, size)| size)
+}
+
+/// Selects the file (unless None: continues at the current offset) and
+/// transfers `len` bytes at `buf` by DMA.
+fn dma(name: &str, selector: Option<u16>, control: u32, buf: *mut u8, len: usize) -> Option<()> {
+    let select = selector.map_or(0, |selector| (selector as u32) << 16 | FW_CFG_DMA_CTL_SELECT);
+    let mut access = DmaAccess {
+        control: (select | control).to_be(),
+        length: (len as u32).to_be(),
+        address: (buf as u64).to_be(),
+    };
+
+    // Writing the lower half of the address starts the transfer.
+    let access_addr = &raw mut access as u64;
+    fence(Ordering::SeqCst);
+    unsafe {
+        core::ptr::write_volatile(FW_CFG_DMA as *mut u32, ((access_addr >> 32) as u32).to_be());
+        core::ptr::write_volatile((FW_CFG_DMA + 4) as *mut u32, (access_addr as u32).to_be());
+    }
+
+    loop {
+        let control = u32::from_be(unsafe { core::ptr::read_volatile(&raw const access.control) });
+        if control & FW_CFG_DMA_CTL_ERROR != 0 {
+            error!("host-fw-cfg", "DMA error while accessing {}", name);
+            return None;
+        }
+
+        if control == 0 {
+            break;
+        }
+
+        core::hint::spin_loop();
+    }
+
+    fence(Ordering::SeqCst);
+    Some(())
+}
+
+/// Reads a file into `buf` by DMA. Returns the size, or None if the file
+/// doesn't exist or is larger than `len`.
+pub fn read_file(name: &str, buf: *mut u8, len: usize) -> Option<usize> {
+    let (selector, size) = find(name)?;
+    if size > len {
+        return None;
+    }
+
+    dma(name, Some(selector), FW_CFG_DMA_CTL_READ, buf, size)?;
+    Some(size)
+}
+
+/// Reads up to `len` bytes at `offset` of a file into `buf` by DMA, for
+/// files too large to read at once. Returns the bytes read.
+pub fn read_file_at(name: &str, offset: usize, buf: *mut u8, len: usize) -> Option<usize> {
+    let (selector, size) = find(name)?;
+    let len = len.min(size.saturating_sub(offset));
+    dma(name, Some(selector), FW_CFG_DMA_CTL_SKIP, core::ptr::null_mut(), offset)?;
+    dma(name, None, FW_CFG_DMA_CTL_READ, buf, len)?;
+    Some(len)
+}
+
+/// Writes `data` to a file by DMA. Returns None if the file doesn't exist or
+/// has a different size.
+pub fn write_file(name: &str, data: &[u8]) -> Option<()> {
+    let (selector, size) = find(name)?;
+    if size != data.len() {
+        return None;
+    }
+
+    // QEMU doesn't modify the buffer on writes.
+    dma(name, Some(selector), FW_CFG_DMA_CTL_WRITE, data.as_ptr() as *mut u8, data.len())
+}
@@ -0,0 +1,80 @@
+//! virtio-input provided by QEMU (`-device virtio-keyboard-device`,
+//! `-device virtio-tablet-device`), which receives the keyboard and the
+//! mouse of QEMU's display (e.g. a VNC client).
+use alloc::vec::Vec;
+
+use crate::{
+    allocator::alloc_pages,
+    host_plic,
+    host_virtio::{HostDevice, HostQueue, QUEUE_SIZE, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_WRITE},
+};
+
+const VIRTIO_DEVICE_INPUT: u32 = 18;
+const EVENT_QUEUE: u32 = 0;
+/// struct virtio_input_event: le16 type, le16 code, le32 value.
+pub const EVENT_LEN: usize = 8;
+
+pub struct HostInput {
+    device: HostDevice,
+    events: HostQueue,
+    /// Descriptor N always points to event N.
+    buffers: *mut u8,
+}
+
+// Pointers in HostInput are owned by HostInput.
+unsafe impl Send for HostInput {}
+
+impl HostInput {
+    pub fn open(hart_id: u64) -> Option<HostInput> {
+        let device = HostDevice::probe(VIRTIO_DEVICE_INPUT, VIRTIO_F_VERSION_1)?;
+        let mut events = HostQueue::new(&device, EVENT_QUEUE);
+        let buffers = alloc_pages(QUEUE_SIZE as usize * EVENT_LEN);
+        device.driver_ok();
+
+        for i in 0..QUEUE_SIZE {
+            let addr = unsafe { buffers.add(i as usize * EVENT_LEN) } as u64;
+            events.set_desc(i, addr, EVENT_LEN as u32, VIRTQ_DESC_F_WRITE, 0);
+            events.submit(i);
+        }
+        device.notify(EVENT_QUEUE);
+
+        host_plic::enable(device.irq, hart_id);
+        info!("host-input", "found virtio-input at {:#x} (irq={})", device.base, device.irq);
+        Some(HostInput { device, events, buffers })
+    }
+
+    pub fn irq(&self) -> u32 {
+        self.device.irq
+    }
+
+    /// The configuration space is the host device's: the guest selects and
+    /// reads the name, the event types and the axes of QEMU's device.
+    pub fn read_config(&self, offset: u64) -> u8 {
+        self.device.read_config(offset)
+    }
+
+    pub fn write_config(&self, offset: u64, value: u8) {
+        self.device.write_config(offset, value);
+    }
+
+    /// Handles the interrupt from the device. Returns received events.
+    pub fn handle_interrupt(&mut self) -> Vec<[u8; EVENT_LEN]> {
+        self.device.ack_interrupt();
+
+        let mut events = Vec::new();
+        while let Some((index, len)) = self.events.pop_used() {
+            if len as usize == EVENT_LEN {
+                let mut event = [0; EVENT_LEN];
+                unsafe {
+                    core::ptr::copy_nonoverlapping(self.buffers.add(index as usize * EVENT_LEN), event.as_mut_ptr(), EVENT_LEN);
+                }
+                events.push(event);
+            }
+
+            self.events.submit(index);
+        }
+
+        self.device.notify(EVENT_QUEUE);
+        events
+    }
+}
@@ -0,0 +1,141 @@
+use alloc::vec::Vec;
+use spin::Mutex;
+
+use crate::{
+    allocator::alloc_pages,
+    host_plic,
+    host_virtio::{HostDevice, HostQueue, QUEUE_SIZE, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_WRITE},
+};
+
+const VIRTIO_DEVICE_NET: u32 = 1;
+
+const RX_QUEUE: u32 = 0;
+const TX_QUEUE: u32 = 1;
+const BUFFER_SIZE: usize = 2048;
+/// struct virtio_net_hdr (with VIRTIO_F_VERSION_1).
+pub const VIRTIO_NET_HDR_LEN: usize = 12;
+
+/// A virtqueue where descriptor N always points to buffer N.
+struct NetQueue {
+    queue: HostQueue,
+    buffers: *mut u8,
+}
+
+impl NetQueue {
+    fn new(device: &HostDevice, index: u32, device_writable: bool) -> Self {
+        let mut queue = HostQueue::new(device, index);
+        let buffers = alloc_pages(QUEUE_SIZE as usize * BUFFER_SIZE);
+        let flags = if device_writable { VIRTQ_DESC_F_WRITE } else { 0 };
+        for i in 0..QUEUE_SIZE {
+            let addr = unsafe { buffers.add(i as usize * BUFFER_SIZE) } as u64;
+            queue.set_desc(i, addr, BUFFER_SIZE as u32, flags, 0);
+        }
+
+        Self { queue, buffers }
+    }
+
+    fn buffer(&self, index: u16) -> *mut u8 {
+        unsafe { self.buffers.add(index as usize * BUFFER_SIZE) }
+    }
+
+    fn submit(&mut self, index: u16, len: u32, device_writable: bool) {
+        let flags = if device_writable { VIRTQ_DESC_F_WRITE } else { 0 };
+        self.queue.set_desc(index, self.buffer(index) as u64, len, flags, 0);
+        self.queue.submit(index);
+    }
+}
+
+struct HostNet {
+    device: HostDevice,
+    rx: NetQueue,
+    tx: NetQueue,
+    tx_next: u16,
+    tx_in_flight: u16,
+}
+
+// Pointers in NetQueue are owned by HostNet.
+unsafe impl Send for HostNet {}
+
+static HOST_NET: Mutex<Option<HostNet>> = Mutex::new(None);
+
+/// Looks for a virtio-net device provided by QEMU (`-device virtio-net-device`).
+pub fn init(hart_id: u64) {
+    let device = HostDevice::probe(VIRTIO_DEVICE_NET, VIRTIO_F_VERSION_1)
+        .expect("[host-net] virtio-net device not found");
+
+    let mut rx = NetQueue::new(&device, RX_QUEUE, true);
+    let tx = NetQueue::new(&device, TX_QUEUE, false);
+    device.driver_ok();
+
+    for i in 0..QUEUE_SIZE {
+        rx.submit(i, BUFFER_SIZE as u32, true);
+    }
+    device.notify(RX_QUEUE);
+
+    host_plic::enable(device.irq, hart_id);
+    info!("host-net", "found virtio-net at {:#x} (irq={})", device.base, device.irq);
+
+    *HOST_NET.lock() = Some(HostNet { device, rx, tx, tx_next: 0, tx_in_flight: 0 });
+}
+
+pub fn irq() -> Option<u32> {
+    HOST_NET.lock().as_ref().map(|net| net.device.irq)
+}
+
+pub fn send(frame: &[u8]) {
+    let mut lock = HOST_NET.lock();
+    let net = lock.as_mut().expect("[host-net] not initialized");
+    if frame.len() > BUFFER_SIZE - VIRTIO_NET_HDR_LEN {
+        warn!("host-net", "dropping too large frame ({} bytes)", frame.len());
+        return;
+    }
+
+    // Wait for a free buffer.
+    loop {
+        while net.tx.queue.pop_used().is_some() {
+            net.tx_in_flight -= 1;
+        }
+
+        if net.tx_in_flight < QUEUE_SIZE {
+            break;
+        }
+
+        core::hint::spin_loop();
+    }
+
+    let index = net.tx_next;
+    let buffer = net.tx.buffer(index);
+    unsafe {
+        core::ptr::write_bytes(buffer, 0, VIRTIO_NET_HDR_LEN);
+        core::ptr::copy_nonoverlapping(frame.as_ptr(), buffer.add(VIRTIO_NET_HDR_LEN), frame.len());
+    }
+
+    net.tx.submit(index, (VIRTIO_NET_HDR_LEN + frame.len()) as u32, false);
+    net.tx_next = (net.tx_next + 1) % QUEUE_SIZE;
+    net.tx_in_flight += 1;
+    net.device.notify(TX_QUEUE);
+}
+
+/// Handles the interrupt from the device. Returns received frames.
+pub fn handle_interrupt() -> Vec<Vec<u8>> {
+    let mut lock = HOST_NET.lock();
+    let net = lock.as_mut().expect("[host-net] not initialized");
+    net.device.ack_interrupt();
+
+    let mut frames = Vec::new();
+    while let Some((index, len)) = net.rx.queue.pop_used() {
+        let len = len as usize;
+        if len > VIRTIO_NET_HDR_LEN {
+            let buffer = net.rx.buffer(index);
+            let frame = unsafe {
+                core::slice::from_raw_parts(buffer.add(VIRTIO_NET_HDR_LEN), len - VIRTIO_NET_HDR_LEN)
+            };
+            frames.push(frame.to_vec());
+        }
+
+        net.rx.submit(index, BUFFER_SIZE as u32, true);
+    }
+
+    net.device.notify(RX_QUEUE);
+    frames
+}
@@ -0,0 +1,36 @@
+use core::arch::asm;
+
+// The PLIC of the QEMU virt machine.
+const HOST_PLIC_ADDR: u64 = 0x0c00_0000;
+
+fn s_mode_context(hart_id: u64) -> u64 {
+    2 * hart_id + 1
+}
+
+fn write_reg(offset: u64, value: u32) {
+    unsafe { core::ptr::write_volatile((HOST_PLIC_ADDR + offset) as *mut u32, value) }
+}
+
+fn read_reg(offset: u64) -> u32 {
+    unsafe { core::ptr::read_volatile((HOST_PLIC_ADDR + offset) as *const u32) }
+}
+
+/// Routes a host interrupt to the S-mode context of the (physical) hart.
+pub fn enable(irq: u32, hart_id: u64) {
+    let context = s_mode_context(hart_id);
+    let enable_offset = 0x2000 + 0x80 * context + 4 * (irq as u64 / 32);
+    write_reg(4 * irq as u64, 1); // priority
+    write_reg(enable_offset, read_reg(enable_offset) | (1 << (irq % 32)));
+    write_reg(0x200000 + 0x1000 * context, 0); // threshold
+    unsafe {
+        asm!("csrs sie, {}", in(reg) 1 << 9 /* SEIE */);
+    }
+}
+
+pub fn claim(hart_id: u64) -> u32 {
+    read_reg(0x200004 + 0x1000 * s_mode_context(hart_id))
+}
+
+pub fn complete(hart_id: u64, irq: u32) {
+    write_reg(0x200004 + 0x1000 * s_mode_context(hart_id), irq);
+}
@@ -0,0 +1,46 @@
+//! virtio-rng provided by QEMU (`-device virtio-rng-device`).
+use crate::{
+    allocator::alloc_pages,
+    host_virtio::{HostDevice, HostQueue, VIRTIO_F_VERSION_1, VIRTQ_DESC_F_WRITE},
+};
+
+const VIRTIO_DEVICE_RNG: u32 = 4;
+pub const BUFFER_SIZE: usize = 4096;
+
+pub struct HostRng {
+    device: HostDevice,
+    queue: HostQueue,
+    buffer: *mut u8,
+}
+
+// Pointers in HostRng are owned by HostRng.
+unsafe impl Send for HostRng {}
+
+impl HostRng {
+    pub fn open() -> Option<HostRng> {
+        let device = HostDevice::probe(VIRTIO_DEVICE_RNG, VIRTIO_F_VERSION_1)?;
+        let queue = HostQueue::new(&device, 0);
+        device.driver_ok();
+
+        info!("host-rng", "found virtio-rng at {:#x}", device.base);
+        let buffer = alloc_pages(BUFFER_SIZE);
+        Some(HostRng { device, queue, buffer })
+    }
+
+    /// Reads up to `len` random bytes (at most BUFFER_SIZE).
+    pub fn read(&mut self, len: usize) -> &[u8] {
+        let len = len.min(BUFFER_SIZE);
+        self.queue.set_desc(0, self.buffer as u64, len as u32, VIRTQ_DESC_F_WRITE, 0);
+        self.queue.submit(0);
+        self.device.notify(0);
+        let written = loop {
+            if let Some((_, written)) = self.queue.pop_used() {
+                break written as usize;
+            }
+
+            core::hint::spin_loop();
+        };
+
+        unsafe { core::slice::from_raw_parts(self.buffer, written.min(len)) }
+    }
+}
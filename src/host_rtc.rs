@@ -0,0 +1,18 @@
+//! The Goldfish RTC of the QEMU virt machine: the host's wall-clock time,
+//! which keeps running while the VM is paused (and the host is suspended).
+const HOST_RTC_ADDR: u64 = 0x10_1000;
+
+const TIME_LOW: u64 = 0x00;
+const TIME_HIGH: u64 = 0x04;
+
+fn read_reg(offset: u64) -> u32 {
+    unsafe { core::ptr::read_volatile((HOST_RTC_ADDR + offset) as *const u32) }
+}
+
+/// Nanoseconds since the UNIX epoch.
+pub fn now() -> u64 {
+    // Reading TIME_LOW latches TIME_HIGH.
+    let low = read_reg(TIME_LOW) as u64;
+    let high = read_reg(TIME_HIGH) as u64;
+    (high << 32) | low
+}
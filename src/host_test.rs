@@ -0,0 +1,51 @@
+//! The SiFive test device ("finisher") of the QEMU virt machine, which makes
+//! QEMU exit with a status: the hypervisor exits with the guest's, so that
+//! CI can tell pass from fail without reading the console.
+//!
+//! ```text
+//! 0    the guest has powered off (SBI system reset), or `quit` in the monitor
+//! 1    failure: a shutdown with SYSTEM_FAILURE, a crash, or the watchdog
+//! N    the exit hypercall, the guest's test device (-test-finisher), or the
+//!      exit status of Linux's init (-on-crash exit)
+//! ```
+//!
+//! OpenSBI may keep the device to itself (it's disabled in the device tree
+//! then): we fall back to SBI system reset, which tells QEMU only success
+//! or failure.
+use core::sync::atomic::{AtomicBool, Ordering};
+
+use crate::{host_dtb, host_uart, sbi};
+
+const HOST_TEST_ADDR: u64 = 0x10_0000;
+const HOST_TEST_NODE: &str = "/soc/test@100000";
+
+pub const FINISHER_FAIL: u32 = 0x3333;
+pub const FINISHER_PASS: u32 = 0x5555;
+pub const FINISHER_RESET: u32 = 0x7777;
+
+pub const EXIT_FAILURE: u32 = 1;
+
+static AVAILABLE: AtomicBool = AtomicBool::new(false);
+
+pub fn init() {
+    let present = host_dtb::find_property(HOST_TEST_NODE, "compatible").is_some();
+    let disabled = host_dtb::find_property(HOST_TEST_NODE, "status").is_some_and(|status| status.starts_with(b"disabled"));
+    AVAILABLE.store(present && !disabled, Ordering::Relaxed);
+}
+
+/// Shuts down the machine, and QEMU exits with `code` (16 bits). Returns
+/// only if that failed.
+pub fn exit(code: u32) -> Result<u64, i64> {
+    if AVAILABLE.load(Ordering::Relaxed) {
+        host_uart::flush();
+        let value = if code == 0 { FINISHER_PASS } else { ((code & 0xffff) << 16) | FINISHER_FAIL };
+        unsafe { core::ptr::write_volatile(HOST_TEST_ADDR as *mut u32, value) };
+        // QEMU exits asynchronously.
+        loop {
+            core::hint::spin_loop();
+        }
+    }
+
+    let reason = if code == 0 { sbi::RESET_REASON_NONE } else { sbi::RESET_REASON_SYSTEM_FAILURE };
+    sbi::system_reset(sbi::RESET_TYPE_SHUTDOWN, reason)
+}
@@ -0,0 +1,181 @@
+//! The UART (ns16550a) of the QEMU virt machine, i.e. the hypervisor's
+//! console. OpenSBI writes to it for us; we take over the input to get an
+//! interrupt on each keystroke instead of polling SBI getchar.
+//!
+//! With `-async-console <size>[,drop-oldest|backpressure]`, we take over the
+//! output too. SBI putchar waits while QEMU can't write to the host (e.g.
+//! stdout piped to a slow consumer), and so does the vCPU writing to the
+//! console. Instead, the output goes to a ring, and the UART takes from it
+//! as long as its transmitter is empty. The rest is written on the
+//! "transmitter empty" interrupt. When the ring is full, either the oldest
+//! output is dropped (`drop-oldest`), or the writer waits for the UART as
+//! before (`backpressure`, the default).
+use alloc::{collections::VecDeque, format, string::String};
+use core::sync::atomic::{AtomicBool, Ordering};
+use spin::Mutex;
+
+use crate::{
+    config::{AsyncConsoleConfig, ConsoleOverflow},
+    host_plic,
+};
+
+const HOST_UART_ADDR: u64 = 0x1000_0000;
+const HOST_UART_IRQ: u32 = 10;
+
+const RBR: u64 = 0; // Receiver Buffer Register
+const THR: u64 = 0; // Transmitter Holding Register
+const IER: u64 = 1; // Interrupt Enable Register
+const MCR: u64 = 4; // Modem Control Register
+const LSR: u64 = 5; // Line Status Register
+
+const IER_RX_AVAILABLE: u8 = 1 << 0;
+const IER_THR_EMPTY: u8 = 1 << 1;
+const MCR_OUT2: u8 = 1 << 3; // Gates the interrupt output.
+const LSR_DATA_READY: u8 = 1 << 0;
+const LSR_THR_EMPTY: u8 = 1 << 5;
+
+static ENABLED: AtomicBool = AtomicBool::new(false);
+/// Whether the output goes through TX (`-async-console`).
+static ASYNC: AtomicBool = AtomicBool::new(false);
+
+struct Tx {
+    /// The output not written to the UART yet.
+    buf: VecDeque<u8>,
+    size: usize,
+    overflow: ConsoleOverflow,
+    /// Bytes dropped by `drop-oldest`.
+    dropped: u64,
+}
+
+static TX: Mutex<Tx> =
+    Mutex::new(Tx { buf: VecDeque::new(), size: 0, overflow: ConsoleOverflow::Backpressure, dropped: 0 });
+
+fn read_reg(offset: u64) -> u8 {
+    unsafe { core::ptr::read_volatile((HOST_UART_ADDR + offset) as *const u8) }
+}
+
+fn write_reg(offset: u64, value: u8) {
+    unsafe { core::ptr::write_volatile((HOST_UART_ADDR + offset) as *mut u8, value) }
+}
+
+fn enable_interrupt(hart_id: u64, ier: u8) {
+    write_reg(MCR, read_reg(MCR) | MCR_OUT2);
+    write_reg(IER, read_reg(IER) | ier);
+    if !ENABLED.swap(true, Ordering::Relaxed) {
+        host_plic::enable(HOST_UART_IRQ, hart_id);
+    }
+}
+
+pub fn init(hart_id: u64) {
+    enable_interrupt(hart_id, IER_RX_AVAILABLE);
+}
+
+/// Takes over the output (`-async-console`).
+pub fn init_tx(config: &AsyncConsoleConfig, hart_id: u64) {
+    let mut tx = TX.lock();
+    tx.buf = VecDeque::with_capacity(config.size);
+    tx.size = config.size;
+    tx.overflow = config.overflow;
+    enable_interrupt(hart_id, 0);
+    ASYNC.store(true, Ordering::Relaxed);
+}
+
+pub fn irq() -> Option<u32> {
+    ENABLED.load(Ordering::Relaxed).then_some(HOST_UART_IRQ)
+}
+
+/// Returns a received byte. Reading it clears the interrupt.
+pub fn read() -> Option<u8> {
+    (read_reg(LSR) & LSR_DATA_READY != 0).then(|| read_reg(RBR))
+}
+
+pub fn is_async() -> bool {
+    ASYNC.load(Ordering::Relaxed)
+}
+
+/// Writes the ring to the UART until its transmitter is busy. The interrupt
+/// is enabled while something is left.
+fn drain(tx: &mut Tx) {
+    while !tx.buf.is_empty() && read_reg(LSR) & LSR_THR_EMPTY != 0 {
+        write_reg(THR, tx.buf.pop_front().unwrap());
+    }
+
+    let ier = read_reg(IER);
+    let new_ier = if tx.buf.is_empty() { ier & !IER_THR_EMPTY } else { ier | IER_THR_EMPTY };
+    if new_ier != ier {
+        write_reg(IER, new_ier);
+    }
+}
+
+/// Writes to the hypervisor's console without blocking, unless the ring is
+/// full with `backpressure`.
+pub fn write(data: &[u8]) {
+    let mut tx = TX.lock();
+    for &byte in data {
+        if tx.buf.len() >= tx.size {
+            match tx.overflow {
+                ConsoleOverflow::DropOldest => {
+                    tx.buf.pop_front();
+                    tx.dropped += 1;
+                }
+                ConsoleOverflow::Backpressure => {
+                    while tx.buf.len() >= tx.size {
+                        drain(&mut tx);
+                        core::hint::spin_loop();
+                    }
+                }
+            }
+        }
+        tx.buf.push_back(byte);
+    }
+    drain(&mut tx);
+}
+
+/// The transmitter is empty: writes more of the ring.
+pub fn handle_tx_interrupt() {
+    if is_async() {
+        drain(&mut TX.lock());
+    }
+}
+
+/// Writes all of the ring, waiting for the UART, e.g. before shutting down.
+pub fn flush() {
+    if !is_async() {
+        return;
+    }
+
+    let mut tx = TX.lock();
+    while !tx.buf.is_empty() {
+        drain(&mut tx);
+        core::hint::spin_loop();
+    }
+}
+
+/// Flushes the ring and gives the output back to SBI putchar, on a panic.
+/// The ring is left as is if the panic was in the middle of a write.
+pub fn stop_async() {
+    if !ASYNC.swap(false, Ordering::Relaxed) {
+        return;
+    }
+
+    if let Some(mut tx) = TX.try_lock() {
+        while !tx.buf.is_empty() {
+            drain(&mut tx);
+            core::hint::spin_loop();
+        }
+    }
+}
+
+/// `info uart` in the monitor.
+pub fn report() -> String {
+    if !is_async() {
+        return String::from("the console is written by SBI putchar (-async-console is not enabled)");
+    }
+
+    let tx = TX.lock();
+    let overflow = match tx.overflow {
+        ConsoleOverflow::DropOldest => "drop-oldest",
+        ConsoleOverflow::Backpressure => "backpressure",
+    };
+    format!("ring: {}/{} bytes pending, overflow: {}, dropped: {} bytes", tx.buf.len(), tx.size, overflow, tx.dropped)
+}
@@ -0,0 +1,192 @@
+use core::sync::atomic::{AtomicU32, Ordering, fence};
+
+use crate::allocator::alloc_pages;
+
+// virtio-mmio slots on the QEMU virt machine.
+const VIRTIO_MMIO_BASE: u64 = 0x1000_1000;
+const VIRTIO_MMIO_STRIDE: u64 = 0x1000;
+const VIRTIO_MMIO_NUM_SLOTS: u64 = 8;
+const VIRTIO_MMIO_IRQ_BASE: u32 = 1;
+
+/// A bitmap of slots in use.
+static CLAIMED_SLOTS: AtomicU32 = AtomicU32::new(0);
+
+pub const VIRTIO_F_VERSION_1: u64 = 1 << 32;
+
+const STATUS_ACK: u32 = 1;
+const STATUS_DRIVER: u32 = 2;
+const STATUS_DRIVER_OK: u32 = 4;
+const STATUS_FEATURES_OK: u32 = 8;
+
+pub const QUEUE_SIZE: u16 = 64;
+
+pub const VIRTQ_DESC_F_NEXT: u16 = 1;
+pub const VIRTQ_DESC_F_WRITE: u16 = 2;
+
+#[repr(C)]
+struct Descriptor {
+    addr: u64,
+    len: u32,
+    flags: u16,
+    next: u16,
+}
+
+#[repr(C)]
+struct AvailRing {
+    flags: u16,
+    idx: u16,
+    ring: [u16; QUEUE_SIZE as usize],
+}
+
+#[repr(C)]
+struct UsedElem {
+    id: u32,
+    len: u32,
+}
+
+#[repr(C)]
+struct UsedRing {
+    flags: u16,
+    idx: u16,
+    ring: [UsedElem; QUEUE_SIZE as usize],
+}
+
+pub fn read_reg(base: u64, offset: u64) -> u32 {
+    unsafe { core::ptr::read_volatile((base + offset) as *const u32) }
+}
+
+pub fn write_reg(base: u64, offset: u64, value: u32) {
+    unsafe { core::ptr::write_volatile((base + offset) as *mut u32, value) }
+}
+
+/// A virtio-mmio device provided by QEMU (e.g. `-device virtio-net-device`).
+pub struct HostDevice {
+    pub base: u64,
+    pub irq: u32,
+}
+
+impl HostDevice {
+    /// Looks for a device not in use and negotiates features.
+    pub fn probe(device_id: u32, features: u64) -> Option<HostDevice> {
+        let slot = (0..VIRTIO_MMIO_NUM_SLOTS).find(|slot| {
+            let base = VIRTIO_MMIO_BASE + slot * VIRTIO_MMIO_STRIDE;
+            read_reg(base, 0x000) == 0x74726976
+                && read_reg(base, 0x008) == device_id
+                && CLAIMED_SLOTS.fetch_or(1 << slot, Ordering::AcqRel) & (1 << slot) == 0
+        })?;
+
+        let base = VIRTIO_MMIO_BASE + slot * VIRTIO_MMIO_STRIDE;
+        assert_eq!(read_reg(base, 0x004), 2, "[host-virtio] legacy virtio-mmio is not supported");
+
+        write_reg(base, 0x070, 0); // reset
+        write_reg(base, 0x070, STATUS_ACK | STATUS_DRIVER);
+        for sel in 0..2 {
+            write_reg(base, 0x024, sel); // DriverFeaturesSel
+            write_reg(base, 0x020, (features >> (32 * sel)) as u32);
+        }
+        write_reg(base, 0x070, STATUS_ACK | STATUS_DRIVER | STATUS_FEATURES_OK);
+        assert!(read_reg(base, 0x070) & STATUS_FEATURES_OK != 0, "[host-virtio] features not accepted");
+
+        let irq = VIRTIO_MMIO_IRQ_BASE + slot as u32;
+        Some(HostDevice { base, irq })
+    }
+
+    /// Resets the device and makes it available to `probe` again.
+    pub fn release(self) {
+        write_reg(self.base, 0x070, 0);
+        let slot = (self.base - VIRTIO_MMIO_BASE) / VIRTIO_MMIO_STRIDE;
+        CLAIMED_SLOTS.fetch_and(!(1 << slot), Ordering::AcqRel);
+    }
+
+    pub fn driver_ok(&self) {
+        write_reg(self.base, 0x070, STATUS_ACK | STATUS_DRIVER | STATUS_FEATURES_OK | STATUS_DRIVER_OK);
+    }
+
+    pub fn notify(&self, queue: u32) {
+        write_reg(self.base, 0x050, queue);
+    }
+
+    pub fn ack_interrupt(&self) {
+        let status = read_reg(self.base, 0x060);
+        write_reg(self.base, 0x064, status);
+    }
+
+    pub fn read_config<T: Copy>(&self, offset: u64) -> T {
+        unsafe { core::ptr::read_volatile((self.base + 0x100 + offset) as *const T) }
+    }
+
+    pub fn write_config<T: Copy>(&self, offset: u64, value: T) {
+        unsafe { core::ptr::write_volatile((self.base + 0x100 + offset) as *mut T, value) }
+    }
+}
+
+pub struct HostQueue {
+    desc: *mut Descriptor,
+    avail: *mut AvailRing,
+    used: *mut UsedRing,
+    /// The queue size: QUEUE_SIZE or less.
+    num: u16,
+    last_used_idx: u16,
+}
+
+impl HostQueue {
+    pub fn new(device: &HostDevice, index: u32) -> Self {
+        Self::with_size(device, index, QUEUE_SIZE)
+    }
+
+    /// Creates a queue with `num` descriptors, for devices with a smaller
+    /// maximum queue size.
+    pub fn with_size(device: &HostDevice, index: u32, num: u16) -> Self {
+        assert!(num <= QUEUE_SIZE);
+        let desc = alloc_pages(0x1000) as *mut Descriptor;
+        let avail = alloc_pages(0x1000) as *mut AvailRing;
+        let used = alloc_pages(0x1000) as *mut UsedRing;
+
+        let base = device.base;
+        write_reg(base, 0x030, index); // QueueSel
+        assert!(read_reg(base, 0x034) >= num as u32, "host virtqueue too small");
+        write_reg(base, 0x038, num as u32); // QueueNum
+        for (offset, addr) in [(0x080, desc as u64), (0x090, avail as u64), (0x0a0, used as u64)] {
+            write_reg(base, offset, addr as u32);
+            write_reg(base, offset + 4, (addr >> 32) as u32);
+        }
+        write_reg(base, 0x044, 1); // QueueReady
+
+        Self { desc, avail, used, num, last_used_idx: 0 }
+    }
+
+    pub fn set_desc(&mut self, index: u16, addr: u64, len: u32, flags: u16, next: u16) {
+        unsafe {
+            self.desc.add(index as usize).write_volatile(Descriptor { addr, len, flags, next });
+        }
+    }
+
+    /// The next descriptor in the chain.
+    pub fn next_desc(&self, index: u16) -> Option<u16> {
+        let desc = unsafe { self.desc.add(index as usize).read_volatile() };
+        (desc.flags & VIRTQ_DESC_F_NEXT != 0).then_some(desc.next)
+    }
+
+    /// Makes the descriptor chain starting at `head` available to the device.
+    pub fn submit(&mut self, head: u16) {
+        unsafe {
+            let avail_idx = (*self.avail).idx;
+            (*self.avail).ring[(avail_idx % self.num) as usize] = head;
+            fence(Ordering::SeqCst);
+            core::ptr::write_volatile(&mut (*self.avail).idx, avail_idx.wrapping_add(1));
+        }
+    }
+
+    /// Takes a used buffer: (descriptor index, written length).
+    pub fn pop_used(&mut self) -> Option<(u16, u32)> {
+        let used_idx = unsafe { core::ptr::read_volatile(&(*self.used).idx) };
+        if self.last_used_idx == used_idx {
+            return None;
+        }
+
+        fence(Ordering::SeqCst);
+        let elem = unsafe { &(*self.used).ring[(self.last_used_idx % self.num) as usize] };
+        self.last_used_idx = self.last_used_idx.wrapping_add(1);
+        Some((elem.id as u16, elem.len))
+    }
+}
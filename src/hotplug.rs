@@ -0,0 +1,152 @@
+//! Disk hotplug (`-hotplug-slots <n>`): `device_add` and `device_del` in the
+//! monitor.
+//!
+//! virtio-mmio has no hotplug notification. Instead, the device tree has
+//! empty slots, which Linux skips as they read as device ID 0. After
+//! `device_add`, bind the driver in the guest:
+//!
+//! ```text
+//! # echo 10008000.virtio_mmio > /sys/bus/platform/drivers/virtio-mmio/bind
+//! ```
+//!
+//! `device_del` empties the disk and tells the driver by a configuration
+//! change interrupt. The slot is freed when the driver resets the device,
+//! e.g. on `unbind`, with a DEVICE_DELETED event.
+use alloc::{format, string::String};
+use spin::Mutex;
+
+use crate::{
+    config::config,
+    machine,
+    mmio_bus::{self, ReadFn, WriteFn},
+    monitor,
+    virtio::{VIRTIO_MAGIC, VIRTIO_VENDOR_ID, VirtioMmio},
+    virtio_blk::VirtioBlk,
+};
+
+pub const MAX_HOTPLUG_SLOTS: usize = 4;
+const SLOT_SIZE: u64 = 0x1000;
+const SLOT_NAMES: [&str; MAX_HOTPLUG_SLOTS] = ["hotplug0", "hotplug1", "hotplug2", "hotplug3"];
+const SLOT_READS: [ReadFn; MAX_HOTPLUG_SLOTS] = [mmio_read::<0>, mmio_read::<1>, mmio_read::<2>, mmio_read::<3>];
+const SLOT_WRITES: [WriteFn; MAX_HOTPLUG_SLOTS] = [mmio_write::<0>, mmio_write::<1>, mmio_write::<2>, mmio_write::<3>];
+
+struct Device {
+    /// The name in `device_add` and `device_del`.
+    id: String,
+    mmio: VirtioMmio<VirtioBlk>,
+    /// `device_del` has been requested, and we're waiting for the driver to
+    /// release it.
+    removing: bool,
+}
+
+static SLOTS: [Mutex<Option<Device>>; MAX_HOTPLUG_SLOTS] = [const { Mutex::new(None) }; MAX_HOTPLUG_SLOTS];
+
+/// The address and IRQ of a slot.
+pub fn slot(index: usize) -> (u64, u64, u32) {
+    let (base, _, irq) = machine::device_region("hotplug");
+    let addr = base + index as u64 * SLOT_SIZE;
+    (addr, addr + SLOT_SIZE, irq + index as u32)
+}
+
+pub fn init() {
+    for index in 0..config().hotplug_slots {
+        let (addr, end, _) = slot(index);
+        mmio_bus::register(SLOT_NAMES[index], addr, end, SLOT_READS[index], SLOT_WRITES[index]);
+    }
+}
+
+fn mmio_read<const SLOT: usize>(offset: u64, width: u64) -> u64 {
+    match SLOTS[SLOT].lock().as_mut() {
+        Some(device) => device.mmio.mmio_read(offset, width),
+        None => match offset {
+            0x000 => VIRTIO_MAGIC as u64,
+            0x004 => 2, // Version
+            0x00c => VIRTIO_VENDOR_ID as u64,
+            // Device ID 0: no device.
+            _ => 0,
+        },
+    }
+}
+
+fn mmio_write<const SLOT: usize>(offset: u64, value: u64, width: u64) {
+    let mut slot = SLOTS[SLOT].lock();
+    let Some(device) = slot.as_mut() else {
+        return;
+    };
+
+    device.mmio.mmio_write(offset, value, width);
+    // The driver has reset the removed device: it no longer uses it.
+    if device.removing && offset == 0x070 && value == 0 {
+        let device = slot.take().unwrap();
+        deleted(&device.id);
+    }
+}
+
+fn deleted(id: &str) {
+    info!("hotplug", "{} has been removed", id);
+    monitor::event("DEVICE_DELETED", &format!("{{\"device\": \"{}\"}}", id));
+}
+
+/// Attaches the host disk `serial` to a free slot as `id`. Returns the
+/// address of the slot.
+pub fn add(id: &str, serial: &str) -> Result<u64, String> {
+    let slots = &SLOTS[..config().hotplug_slots];
+    if slots.iter().any(|slot| slot.lock().as_ref().is_some_and(|device| device.id == id)) {
+        return Err(format!("duplicate device ID: {}", id));
+    }
+
+    let Some(index) = slots.iter().position(|slot| slot.lock().is_none()) else {
+        return Err(String::from("no free hotplug slots (-hotplug-slots)"));
+    };
+
+    let disk = VirtioBlk::open_host_disk(serial).ok_or_else(|| format!("host disk \"{}\" not found", serial))?;
+    let (addr, _, irq) = slot(index);
+    *slots[index].lock() = Some(Device { id: String::from(id), mmio: VirtioMmio::new(disk, irq), removing: false });
+    info!("hotplug", "{} in slot {}: bind {:x}.virtio_mmio in the guest", id, index, addr);
+    Ok(addr)
+}
+
+/// Detaches the device `id`. The slot is freed once the driver releases it.
+pub fn remove(id: &str) -> Result<(), String> {
+    for slot in &SLOTS[..config().hotplug_slots] {
+        let mut slot = slot.lock();
+        let Some(device) = slot.as_mut().filter(|device| device.id == id) else {
+            continue;
+        };
+
+        if device.removing {
+            return Err(format!("{} is already being removed", id));
+        }
+
+        device.mmio.device.eject();
+        if device.mmio.is_in_use() {
+            device.removing = true;
+            device.mmio.notify_config();
+        } else {
+            slot.take();
+            deleted(id);
+        }
+
+        return Ok(());
+    }
+
+    Err(format!("device {} not found", id))
+}
+
+/// Whether no devices are hotplugged.
+pub fn is_empty() -> bool {
+    SLOTS.iter().all(|slot| slot.lock().is_none())
+}
+
+/// Resets the devices for a reboot. Removed ones are freed.
+pub fn reset() {
+    for slot in &SLOTS {
+        let mut slot = slot.lock();
+        if slot.as_ref().is_some_and(|device| device.removing) {
+            let device = slot.take().unwrap();
+            deleted(&device.id);
+        } else if let Some(device) = slot.as_mut() {
+            device.mmio.reset();
+        }
+    }
+}
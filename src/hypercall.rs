@@ -0,0 +1,123 @@
+//! Paravirtual services for the guest: an SBI extension of our own in the
+//! firmware-specific range (EID 0x0A485643, "HVC"), with the function ID in
+//! a6 and the arguments in a0-a5, like any SBI call:
+//!
+//! ```text
+//! FID 0  get host time   returns the host's wall-clock time in ns since the UNIX epoch
+//! FID 1  log string      a0 = the length (up to 1024), a1 = the guest physical address
+//! FID 2  exit            a0 = the exit code: shuts down the VM, and QEMU exits with it
+//! FID 3  yield           a0 = the vCPU to yield to, or -1 for any: for spin locks under
+//!                        -cpu-quota (see cpu_quota.rs). Returns the vCPU, or -1 if none
+//! ```
+//!
+//! The guest checks for it with the Probe SBI extension call. More
+//! hypercalls can be added with `register` from anywhere during boot, e.g.:
+//!
+//! ```text
+//! hypercall::register(0x100, "add", |vcpu| Ok((vcpu.a0 + vcpu.a1) as i64));
+//! ```
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::RwLock;
+
+use crate::{boot_time, config::config, cpu_quota, fault_stats, guest_memory::GUEST_MEMORY, host_test, monitor, rtc, smp, vcpu::VCpu};
+
+pub const EID: u64 = 0x0A48_5643;
+
+const FID_GET_HOST_TIME: u64 = 0;
+const FID_LOG: u64 = 1;
+const FID_EXIT: u64 = 2;
+const FID_YIELD: u64 = 3;
+
+const MAX_LOG_LEN: u64 = 1024;
+
+const SBI_ERR_NOT_SUPPORTED: i64 = -2;
+const SBI_ERR_INVALID_PARAM: i64 = -3;
+
+/// Handles a hypercall: the arguments are in a0-a5. Returns the value (a1)
+/// or the SBI error (a0).
+pub type HandlerFn = fn(&mut VCpu) -> Result<i64, i64>;
+
+#[derive(Clone, Copy)]
+struct Hypercall {
+    fid: u64,
+    name: &'static str,
+    handler: HandlerFn,
+}
+
+/// Sorted by the function ID.
+static HYPERCALLS: RwLock<Vec<Hypercall>> = RwLock::new(Vec::new());
+
+/// Adds a hypercall with the function ID `fid`.
+pub fn register(fid: u64, name: &'static str, handler: HandlerFn) {
+    let mut hypercalls = HYPERCALLS.write();
+    match hypercalls.binary_search_by_key(&fid, |hypercall| hypercall.fid) {
+        Ok(index) => panic!("[hypercall] {}: FID {:#x} is already used by {}", name, fid, hypercalls[index].name),
+        Err(index) => hypercalls.insert(index, Hypercall { fid, name, handler }),
+    }
+}
+
+/// Registers the built-in hypercalls.
+pub fn init() {
+    register(FID_GET_HOST_TIME, "get_host_time", |_| Ok(rtc::host_time() as i64));
+    register(FID_LOG, "log", log);
+    register(FID_EXIT, "exit", exit);
+    register(FID_YIELD, "yield", yield_to);
+}
+
+pub fn handle_sbi_call(vcpu: &mut VCpu, fid: u64) -> Result<i64, i64> {
+    // Don't hold the lock while the handler runs.
+    let hypercall = {
+        let hypercalls = HYPERCALLS.read();
+        match hypercalls.binary_search_by_key(&fid, |hypercall| hypercall.fid) {
+            Ok(index) => hypercalls[index],
+            Err(_) => {
+                warn!("hypercall", "vCPU {}: unknown hypercall: fid={:#x}", vcpu.hart_id, fid);
+                return Err(SBI_ERR_NOT_SUPPORTED);
+            }
+        }
+    };
+
+    trace!("hypercall", "vCPU {}: {} (a0={:#x}, a1={:#x})", vcpu.hart_id, hypercall.name, vcpu.a0, vcpu.a1);
+    (hypercall.handler)(vcpu)
+}
+
+fn log(vcpu: &mut VCpu) -> Result<i64, i64> {
+    let (len, addr) = (vcpu.a0, vcpu.a1);
+    if len > MAX_LOG_LEN || !GUEST_MEMORY.contains_range(addr, len as usize) {
+        return Err(SBI_ERR_INVALID_PARAM);
+    }
+
+    let mut buf = vec![0; len as usize];
+    GUEST_MEMORY.read_at(addr, &mut buf).ok_or(SBI_ERR_INVALID_PARAM)?;
+    let text = String::from_utf8_lossy(&buf);
+    info!("guest", "vCPU {}: {}", vcpu.hart_id, text.trim_end());
+    Ok(0)
+}
+
+fn exit(vcpu: &mut VCpu) -> Result<i64, i64> {
+    let code = vcpu.a0 as i32;
+    smp::pause_others(vcpu);
+    info!("hypercall", "the guest exited with code {}", code);
+    if config().boot_time {
+        boot_time::print_report();
+    }
+
+    if config().fault_stats {
+        fault_stats::print_report();
+    }
+
+    monitor::event("SHUTDOWN", &format!("{{\"guest\": true, \"reason\": \"guest-exit\", \"code\": {}}}", code));
+    let result = host_test::exit(code as u32);
+    smp::resume_others();
+    result.map(|value| value as i64)
+}
+
+fn yield_to(vcpu: &mut VCpu) -> Result<i64, i64> {
+    let target = match vcpu.a0 {
+        u64::MAX => None,
+        id if id < smp::num_vcpus() as u64 => Some(id),
+        _ => return Err(SBI_ERR_INVALID_PARAM),
+    };
+
+    Ok(cpu_quota::yield_to(vcpu, target).map_or(-1, |id| id as i64))
+}
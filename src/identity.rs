@@ -0,0 +1,87 @@
+//! `-name <name>`: the VM's identity, derived from its name so that each
+//! guest on the host gets its own and keeps it across boots:
+//!
+//! - UUID: `vm,uuid` in the device tree's root (as QEMU's pseries machine
+//!   does), and `query-uuid` in the monitor.
+//! - Serial number: `serial-number` in the root (/proc/device-tree/serial-number
+//!   in the guest).
+//! - MAC address of virtio-net, unless `-net host,mac=<MAC>` is given: in the
+//!   locally administered range 52:54:00:xx:xx:xx, as QEMU's.
+//!
+//! Each one is the SHA-256 of the name and what it is for, e.g. `uuid:vm1`.
+//! Without `-name`, there's no UUID nor serial number, and the MAC address
+//! is 52:54:00:12:34:56.
+use alloc::{format, string::String, vec::Vec};
+
+use crate::{config::config, sha256::sha256};
+
+const DEFAULT_MAC: [u8; 6] = [0x52, 0x54, 0x00, 0x12, 0x34, 0x56];
+
+fn hash(purpose: &str, name: &str) -> [u8; 32] {
+    sha256(format!("{}:{}", purpose, name).as_bytes())
+}
+
+/// Version 8 (vendor-specific, RFC 9562) with the variant of RFC 9562.
+fn uuid_bytes(name: &str) -> [u8; 16] {
+    let mut uuid: [u8; 16] = hash("uuid", name)[..16].try_into().unwrap();
+    uuid[6] = (uuid[6] & 0x0f) | 0x80;
+    uuid[8] = (uuid[8] & 0x3f) | 0x80;
+    uuid
+}
+
+/// e.g. `6b1f3c0e-2a4d-8e5f-9c1b-3d7e0a2f4b6c`.
+pub fn uuid() -> Option<String> {
+    let uuid = uuid_bytes(config().name.as_deref()?);
+    let hex: Vec<String> = uuid.iter().map(|b| format!("{:02x}", b)).collect();
+    Some(format!(
+        "{}-{}-{}-{}-{}",
+        hex[0..4].concat(),
+        hex[4..6].concat(),
+        hex[6..8].concat(),
+        hex[8..10].concat(),
+        hex[10..16].concat()
+    ))
+}
+
+/// e.g. `HV-3D7E0A2F4B6C`.
+pub fn serial() -> Option<String> {
+    let hash = hash("serial", config().name.as_deref()?);
+    Some(format!("HV-{}", hash[..6].iter().map(|b| format!("{:02X}", b)).collect::<String>()))
+}
+
+/// The MAC address of virtio-net without `mac=`.
+pub fn mac() -> [u8; 6] {
+    let Some(name) = config().name.as_deref() else {
+        return DEFAULT_MAC;
+    };
+
+    let hash = hash("mac", name);
+    [DEFAULT_MAC[0], DEFAULT_MAC[1], DEFAULT_MAC[2], hash[0], hash[1], hash[2]]
+}
+
+fn format_mac(mac: &[u8; 6]) -> String {
+    mac.iter().map(|b| format!("{:02x}", b)).collect::<Vec<_>>().join(":")
+}
+
+/// `info name` in the monitor.
+pub fn report() -> String {
+    let Some(name) = config().name.as_deref() else {
+        return String::from("no name (-name)");
+    };
+
+    let mac = config().net.as_ref().map(|net| net.mac.unwrap_or_else(mac));
+    format!(
+        "name: {}\nuuid: {}\nserial: {}\nmac: {}",
+        name,
+        uuid().unwrap(),
+        serial().unwrap(),
+        mac.as_ref().map_or(String::from("none (no -net)"), format_mac)
+    )
+}
+
+/// Prints the identity at boot.
+pub fn init() {
+    for line in report().lines() {
+        info!("identity", "{}", line);
+    }
+}
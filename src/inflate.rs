@@ -0,0 +1,275 @@
+//! A decompressor for gzip-compressed (RFC 1952) kernel images. It's a
+//! straightforward DEFLATE (RFC 1951) decoder: slow, but small.
+const MAX_BITS: usize = 15;
+const LENGTH_BASE: [u16; 29] = [
+    3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258,
+];
+const LENGTH_EXTRA: [u8; 29] = [0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0];
+const DIST_BASE: [u16; 30] = [
+    1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145,
+    8193, 12289, 16385, 24577,
+];
+const DIST_EXTRA: [u8; 30] = [0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13];
+/// The order of code length code lengths in a dynamic block header.
+const CODE_LENGTH_ORDER: [usize; 19] = [16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15];
+
+const GZIP_MAGIC: [u8; 2] = [0x1f, 0x8b];
+const GZIP_FHCRC: u8 = 1 << 1;
+const GZIP_FEXTRA: u8 = 1 << 2;
+const GZIP_FNAME: u8 = 1 << 3;
+const GZIP_FCOMMENT: u8 = 1 << 4;
+
+type Result<T> = core::result::Result<T, &'static str>;
+
+pub fn is_gzip(data: &[u8]) -> bool {
+    data.starts_with(&GZIP_MAGIC)
+}
+
+struct BitReader<'a> {
+    data: &'a [u8],
+    pos: usize,
+    bit_buf: u32,
+    bit_count: u32,
+}
+
+impl BitReader<'_> {
+    fn bits(&mut self, n: u32) -> Result<u32> {
+        while self.bit_count < n {
+            let byte = *self.data.get(self.pos).ok_or("unexpected end of data")?;
+            self.bit_buf |= (byte as u32) << self.bit_count;
+            self.bit_count += 8;
+            self.pos += 1;
+        }
+
+        let value = self.bit_buf & ((1u64 << n) - 1) as u32;
+        self.bit_buf >>= n;
+        self.bit_count -= n;
+        Ok(value)
+    }
+
+    /// Skips to the next byte boundary. Returns the byte offset.
+    fn align(&mut self) -> usize {
+        let unused = self.bit_count % 8;
+        self.bit_buf >>= unused;
+        self.bit_count -= unused;
+        self.pos - (self.bit_count / 8) as usize
+    }
+}
+
+/// A canonical Huffman code.
+struct Huffman {
+    /// The number of codes of each length.
+    counts: [u16; MAX_BITS + 1],
+    /// Symbols ordered by their codes.
+    symbols: [u16; 288],
+}
+
+impl Huffman {
+    fn new(lengths: &[u8]) -> Huffman {
+        let mut counts = [0u16; MAX_BITS + 1];
+        for &len in lengths {
+            counts[len as usize] += 1;
+        }
+        counts[0] = 0;
+
+        let mut offsets = [0u16; MAX_BITS + 2];
+        for len in 1..=MAX_BITS {
+            offsets[len + 1] = offsets[len] + counts[len];
+        }
+
+        let mut symbols = [0u16; 288];
+        for (symbol, &len) in lengths.iter().enumerate().filter(|(_, len)| **len != 0) {
+            symbols[offsets[len as usize] as usize] = symbol as u16;
+            offsets[len as usize] += 1;
+        }
+
+        Huffman { counts, symbols }
+    }
+
+    /// Reads a code bit by bit: codes of the same length are consecutive.
+    fn decode(&self, r: &mut BitReader) -> Result<u16> {
+        let mut code = 0i32;
+        let mut first = 0i32;
+        let mut index = 0i32;
+        for len in 1..=MAX_BITS {
+            code |= r.bits(1)? as i32;
+            let count = self.counts[len] as i32;
+            if code - first < count {
+                return Ok(self.symbols[(index + code - first) as usize]);
+            }
+
+            index += count;
+            first = (first + count) << 1;
+            code <<= 1;
+        }
+
+        Err("invalid Huffman code")
+    }
+}
+
+struct Inflater<'a, 'b> {
+    r: BitReader<'a>,
+    out: &'b mut [u8],
+    out_len: usize,
+}
+
+impl Inflater<'_, '_> {
+    fn push(&mut self, byte: u8) -> Result<()> {
+        *self.out.get_mut(self.out_len).ok_or("decompressed data is too large")? = byte;
+        self.out_len += 1;
+        Ok(())
+    }
+
+    fn stored_block(&mut self) -> Result<()> {
+        self.r.align();
+        let len = self.r.bits(16)?;
+        let nlen = self.r.bits(16)?;
+        if len != !nlen & 0xffff {
+            return Err("invalid stored block length");
+        }
+
+        for _ in 0..len {
+            let byte = self.r.bits(8)? as u8;
+            self.push(byte)?;
+        }
+        Ok(())
+    }
+
+    fn fixed_block(&mut self) -> Result<()> {
+        let mut lengths = [0u8; 288 + 30];
+        lengths[0..144].fill(8);
+        lengths[144..256].fill(9);
+        lengths[256..280].fill(7);
+        lengths[280..288].fill(8);
+        lengths[288..].fill(5);
+        self.codes(&Huffman::new(&lengths[..288]), &Huffman::new(&lengths[288..]))
+    }
+
+    fn dynamic_block(&mut self) -> Result<()> {
+        let num_lit = self.r.bits(5)? as usize + 257;
+        let num_dist = self.r.bits(5)? as usize + 1;
+        let num_code_lengths = self.r.bits(4)? as usize + 4;
+        if num_lit > 286 || num_dist > 30 {
+            return Err("invalid dynamic block header");
+        }
+
+        let mut code_lengths = [0u8; 19];
+        for &index in &CODE_LENGTH_ORDER[..num_code_lengths] {
+            code_lengths[index] = self.r.bits(3)? as u8;
+        }
+
+        let code_length_code = Huffman::new(&code_lengths);
+        let mut lengths = [0u8; 286 + 30];
+        let mut i = 0;
+        while i < num_lit + num_dist {
+            let symbol = code_length_code.decode(&mut self.r)?;
+            let (value, repeat) = match symbol {
+                0..=15 => (symbol as u8, 1),
+                16 if i > 0 => (lengths[i - 1], 3 + self.r.bits(2)? as usize),
+                17 => (0, 3 + self.r.bits(3)? as usize),
+                18 => (0, 11 + self.r.bits(7)? as usize),
+                _ => return Err("invalid code length"),
+            };
+
+            if i + repeat > num_lit + num_dist {
+                return Err("too many code lengths");
+            }
+
+            lengths[i..i + repeat].fill(value);
+            i += repeat;
+        }
+
+        let lit = Huffman::new(&lengths[..num_lit]);
+        let dist = Huffman::new(&lengths[num_lit..num_lit + num_dist]);
+        self.codes(&lit, &dist)
+    }
+
+    /// Decodes literals and back references until the end of the block.
+    fn codes(&mut self, lit: &Huffman, dist: &Huffman) -> Result<()> {
+        loop {
+            let symbol = lit.decode(&mut self.r)? as usize;
+            if symbol < 256 {
+                self.push(symbol as u8)?;
+                continue;
+            }
+
+            if symbol == 256 {
+                return Ok(());
+            }
+
+            let index = symbol - 257;
+            if index >= LENGTH_BASE.len() {
+                return Err("invalid length symbol");
+            }
+
+            let len = LENGTH_BASE[index] as usize + self.r.bits(LENGTH_EXTRA[index] as u32)? as usize;
+            let index = dist.decode(&mut self.r)? as usize;
+            if index >= DIST_BASE.len() {
+                return Err("invalid distance symbol");
+            }
+
+            let distance = DIST_BASE[index] as usize + self.r.bits(DIST_EXTRA[index] as u32)? as usize;
+            if distance > self.out_len {
+                return Err("distance too far back");
+            }
+
+            // The source may overlap the destination: copy byte by byte.
+            for _ in 0..len {
+                let byte = self.out[self.out_len - distance];
+                self.push(byte)?;
+            }
+        }
+    }
+}
+
+/// Decompresses a gzip stream into `out`. Returns the decompressed size.
+pub fn gunzip(data: &[u8], out: &mut [u8]) -> Result<usize> {
+    if !is_gzip(data) || data.len() < 10 || data[2] != 8 {
+        return Err("not a gzip stream");
+    }
+
+    // Skip the header: magic, method, flags, mtime, xfl, os, and optional fields.
+    let flags = data[3];
+    let mut pos = 10;
+    if flags & GZIP_FEXTRA != 0 {
+        let xlen = u16::from_le_bytes([*data.get(pos).ok_or("truncated")?, *data.get(pos + 1).ok_or("truncated")?]);
+        pos += 2 + xlen as usize;
+    }
+
+    for flag in [GZIP_FNAME, GZIP_FCOMMENT] {
+        if flags & flag != 0 {
+            let len = data.get(pos..).and_then(|rest| rest.iter().position(|&b| b == 0)).ok_or("truncated")?;
+            pos += len + 1;
+        }
+    }
+
+    if flags & GZIP_FHCRC != 0 {
+        pos += 2;
+    }
+
+    let r = BitReader { data: data.get(pos..).ok_or("truncated")?, pos: 0, bit_buf: 0, bit_count: 0 };
+    let mut inflater = Inflater { r, out, out_len: 0 };
+    loop {
+        let is_last = inflater.r.bits(1)? == 1;
+        match inflater.r.bits(2)? {
+            0 => inflater.stored_block()?,
+            1 => inflater.fixed_block()?,
+            2 => inflater.dynamic_block()?,
+            _ => return Err("invalid block type"),
+        }
+
+        if is_last {
+            break;
+        }
+    }
+
+    // The trailer: CRC-32 and the size modulo 2^32.
+    let end = inflater.r.align();
+    let trailer = inflater.r.data.get(end..end + 8).ok_or("truncated")?;
+    let size = u32::from_le_bytes(trailer[4..8].try_into().unwrap());
+    if size != inflater.out_len as u32 {
+        return Err("size mismatch");
+    }
+
+    Ok(inflater.out_len)
+}
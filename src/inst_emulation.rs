@@ -0,0 +1,128 @@
+//! Emulates instructions which raise virtual instruction exceptions, i.e.
+//! valid in S-mode but not allowed in VS-mode by the hypervisor's settings
+//! (wfi with VTW, counters not in hcounteren, cache-block operations not
+//! enabled in henvcfg, ...).
+//!
+//! What we can't emulate (e.g. the hypervisor's own CSRs and instructions
+//! without `-nested`, or counters disabled by `-cpu`) gets an illegal
+//! instruction exception, as on a CPU without them.
+use core::arch::asm;
+
+use crate::{config::config, metrics, nested, page_walk, symbols, timer, vcpu::VCpu};
+
+const OPCODE_SYSTEM: u32 = 0x73;
+const OPCODE_MISC_MEM: u32 = 0x0f;
+const WFI: u32 = 0x1050_0073;
+
+const CSR_CYCLE: u32 = 0xc00;
+const CSR_TIME: u32 = 0xc01;
+const CSR_INSTRET: u32 = 0xc02;
+const CSR_HPMCOUNTER31: u32 = 0xc1f;
+
+/// The cache block size of QEMU (`riscv,cbo*-block-size`).
+const CACHE_BLOCK_SIZE: u64 = 64;
+
+const SCAUSE_ILLEGAL_INSTRUCTION: u64 = 2;
+const SCAUSE_STORE_PAGE_FAULT: u64 = 15;
+
+/// Reads a counter on behalf of the guest. hpmcounter3-31 read as zero, as
+/// when they are not implemented.
+fn read_counter(csr: u32) -> u64 {
+    let value: u64;
+    unsafe {
+        match csr {
+            CSR_CYCLE => asm!("csrr {}, cycle", out(reg) value),
+            CSR_INSTRET => asm!("csrr {}, instret", out(reg) value),
+            CSR_TIME => value = timer::guest_now(),
+            _ => value = 0,
+        }
+    }
+    value
+}
+
+/// Emulates a CSR instruction. Returns false if it's not allowed.
+fn emulate_csr(vcpu: &mut VCpu, inst: u32) -> bool {
+    let csr = inst >> 20;
+    let funct3 = (inst >> 12) & 0x7;
+    let rd = ((inst >> 7) & 0x1f) as u64;
+    let rs1 = (inst >> 15) & 0x1f;
+
+    // Counters are read-only: only csrrs/csrrc (and their immediate forms)
+    // with x0 or zero can read them.
+    let is_read_only = matches!(funct3, 0b010 | 0b011 | 0b110 | 0b111) && rs1 == 0;
+    if !(CSR_CYCLE..=CSR_HPMCOUNTER31).contains(&csr) || !is_read_only || !config().isa.has_counter(csr) {
+        return false;
+    }
+
+    if rd != 0 {
+        vcpu.set_gpr(rd, read_counter(csr));
+    }
+    true
+}
+
+/// Emulates a cache-block operation (Zicbom and Zicboz). Returns the
+/// exception to inject if any.
+fn emulate_cbo(vcpu: &mut VCpu, inst: u32) -> Result<(), (u64, u64)> {
+    let rs1 = ((inst >> 15) & 0x1f) as u64;
+    match inst >> 20 {
+        // cbo.inval, cbo.clean, and cbo.flush: the guest memory is normal,
+        // coherent memory.
+        0 | 1 | 2 => Ok(()),
+        // cbo.zero
+        4 => {
+            let addr = vcpu.gpr(rs1) & !(CACHE_BLOCK_SIZE - 1);
+            page_walk::write(vcpu, addr, &[0; CACHE_BLOCK_SIZE as usize]).ok_or((SCAUSE_STORE_PAGE_FAULT, addr))
+        }
+        _ => Err((SCAUSE_ILLEGAL_INSTRUCTION, inst as u64)),
+    }
+}
+
+/// Handles a virtual instruction exception. `stval` has the instruction if
+/// the hardware provides one.
+pub fn handle_virtual_instruction(vcpu: &mut VCpu, sepc: u64, stval: u64) {
+    let inst = if stval != 0 {
+        Some(stval as u32)
+    } else {
+        let mut bytes = [0; 4];
+        page_walk::read(vcpu, sepc, &mut bytes).map(|_| u32::from_le_bytes(bytes))
+    };
+
+    // The H extension for the guest hypervisor: it updates sepc.
+    if let Some(inst) = inst.filter(|_| config().nested) {
+        if nested::emulate(vcpu, inst, sepc) {
+            metrics::record_emulated_instruction("nested");
+            return;
+        }
+    }
+
+    // Only 32-bit instructions raise virtual instruction exceptions.
+    let result = match inst {
+        // The timer or an interrupt wakes the guest anyway.
+        Some(WFI) => Ok("wfi"),
+        Some(inst) if inst & 0x7f == OPCODE_SYSTEM && emulate_csr(vcpu, inst) => Ok("csr"),
+        Some(inst) if inst & 0x7f == OPCODE_MISC_MEM && (inst >> 12) & 0x7 == 0b010 => {
+            emulate_cbo(vcpu, inst).map(|_| "cbo")
+        }
+        Some(inst) => Err((SCAUSE_ILLEGAL_INSTRUCTION, inst as u64)),
+        None => Err((SCAUSE_ILLEGAL_INSTRUCTION, 0)),
+    };
+
+    match result {
+        Ok(kind) => {
+            metrics::record_emulated_instruction(kind);
+            vcpu.sepc = sepc + 4;
+        }
+        Err((scause, stval)) => {
+            debug!(
+                "vcpu",
+                "vCPU {}: injecting scause={} for the instruction at guest PC {}",
+                vcpu.hart_id,
+                scause,
+                symbols::describe(sepc)
+            );
+            metrics::record_emulated_instruction("exception");
+            vcpu.sepc = sepc;
+            vcpu.inject_exception(scause, stval);
+        }
+    }
+}
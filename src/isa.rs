@@ -0,0 +1,162 @@
+//! The guest's ISA extensions (`-cpu`), e.g. to test a guest kernel on a
+//! CPU without some of them:
+//!
+//! ```text
+//! -cpu rv64gc,-f,-d    # no floating point
+//! -cpu max,-v,-h       # all the host's extensions but V and H
+//! -cpu rv64imafdc,-sstc,-zihpm
+//! ```
+//!
+//! The base is `rv64<letters>` (`g` is `imafd`) or `max`, followed by
+//! `+<ext>` or `-<ext>`. The guest learns the ISA from the device tree
+//! (misa is not accessible in S-mode). Disabled extensions are also
+//! enforced where the hardware lets us:
+//!
+//! - f/d and v: floating point and vector instructions raise illegal
+//!   instruction exceptions (sstatus.FS and sstatus.VS are Off in HS-mode).
+//! - h: the guest hypervisor (see nested.rs).
+//! - sstc: stimecmp traps and fails (henvcfg.STCE is 0).
+//! - zicntr and zihpm: cycle, time, and instret, and hpmcounter3-31 trap
+//!   and fail (hcounteren).
+//! - m, a, and c are only hidden: there's no way to trap them.
+use alloc::{format, string::String, vec::Vec};
+
+use crate::host_dtb;
+
+/// The extensions we know of, in the canonical order of the ISA string.
+const EXTENSIONS: [&str; 11] = ["i", "m", "a", "f", "d", "c", "v", "h", "zicntr", "zihpm", "sstc"];
+/// The extensions without `-cpu` (`-nested` adds h). `max` is all of them
+/// the host has.
+const DEFAULT: [&str; 9] = ["i", "m", "a", "f", "d", "c", "zicntr", "zihpm", "sstc"];
+
+const HCOUNTEREN_ZICNTR: u64 = 0b111;
+const HCOUNTEREN_ZIHPM: u64 = 0xffff_fff8;
+
+const SSTATUS_VS_INITIAL: u64 = 1 << 9;
+const SSTATUS_FS_INITIAL: u64 = 1 << 13;
+
+const CSR_CYCLE: u32 = 0xc00;
+const CSR_INSTRET: u32 = 0xc02;
+
+pub struct Isa {
+    /// Indices in EXTENSIONS.
+    enabled: u32,
+}
+
+fn index(name: &str) -> Result<usize, String> {
+    EXTENSIONS
+        .iter()
+        .position(|&ext| ext == name)
+        .ok_or_else(|| format!("unknown extension: {} (available: {})", name, EXTENSIONS.join(", ")))
+}
+
+/// Whether the host CPU has a single-letter extension, which the hypervisor
+/// doesn't take for itself.
+fn host_has_letter(letter: &str) -> bool {
+    match letter {
+        "v" => host_dtb::has_isa_letter('v'),
+        // The H extension for the guest is emulated.
+        _ => true,
+    }
+}
+
+impl Isa {
+    fn from_names(names: &[&str]) -> Isa {
+        let mut isa = Isa { enabled: 0 };
+        for name in names {
+            isa.enabled |= 1 << index(name).unwrap();
+        }
+        isa
+    }
+
+    /// The ISA without `-cpu`.
+    pub fn default(nested: bool) -> Isa {
+        let mut isa = Isa::from_names(&DEFAULT);
+        if nested {
+            isa.enabled |= 1 << index("h").unwrap();
+        }
+        isa
+    }
+
+    /// Parses `-cpu <base>[,+<ext>|-<ext>...]`.
+    pub fn parse(value: &str) -> Result<Isa, String> {
+        let mut options = value.split(',');
+        let base = options.next().unwrap_or_default();
+        let mut isa = match base {
+            "max" => Isa::from_names(&EXTENSIONS.into_iter().filter(|ext| host_has_letter(ext)).collect::<Vec<_>>()),
+            _ => {
+                let letters = base.strip_prefix("rv64").ok_or_else(|| format!("expected rv64<letters> or max: {}", base))?;
+                // rv64gc doesn't name the multi-letter ones: they are on
+                // unless disabled.
+                let mut isa = Isa::from_names(&["zicntr", "zihpm", "sstc"]);
+                for letter in letters.replace('g', "imafd").chars() {
+                    isa.enabled |= 1 << index(letter.encode_utf8(&mut [0; 4]))?;
+                }
+                isa
+            }
+        };
+
+        for option in options {
+            let (enable, name) = match option.split_at_checked(1) {
+                Some(("+", name)) => (true, name),
+                Some(("-", name)) => (false, name),
+                _ => return Err(format!("expected +<ext> or -<ext>: {}", option)),
+            };
+
+            let bit = 1 << index(name)?;
+            if enable {
+                isa.enabled |= bit;
+            } else {
+                isa.enabled &= !bit;
+            }
+        }
+
+        if !isa.has("i") {
+            return Err(String::from("i can't be disabled"));
+        }
+        if isa.has("d") && !isa.has("f") {
+            return Err(String::from("d needs f"));
+        }
+        if isa.has("v") && !host_has_letter("v") {
+            return Err(String::from("the host CPU has no v (e.g. `-cpu rv64,h=true,v=true` in QEMU)"));
+        }
+        Ok(isa)
+    }
+
+    pub fn has(&self, name: &str) -> bool {
+        self.enabled & (1 << index(name).unwrap()) != 0
+    }
+
+    /// `riscv,isa` in the device tree, e.g. `rv64imafdc_sstc`. The counters
+    /// are not in it: Linux takes them for granted.
+    pub fn dt_string(&self, sstc: bool) -> String {
+        let mut isa = String::from("rv64");
+        for letter in EXTENSIONS.iter().filter(|ext| ext.len() == 1 && self.has(ext)) {
+            isa += letter;
+        }
+        if sstc {
+            isa += "_sstc";
+        }
+        isa
+    }
+
+    /// The FS and VS fields of sstatus in HS-mode while the guest runs.
+    pub fn sstatus(&self) -> u64 {
+        let fs = if self.has("f") { SSTATUS_FS_INITIAL } else { 0 };
+        let vs = if self.has("v") { SSTATUS_VS_INITIAL } else { 0 };
+        fs | vs
+    }
+
+    /// The counters the guest may read.
+    pub fn hcounteren(&self) -> u64 {
+        let zicntr = if self.has("zicntr") { HCOUNTEREN_ZICNTR } else { 0 };
+        let zihpm = if self.has("zihpm") { HCOUNTEREN_ZIHPM } else { 0 };
+        zicntr | zihpm
+    }
+
+    /// Whether the guest may read the counter CSR `csr` (cycle to
+    /// hpmcounter31).
+    pub fn has_counter(&self, csr: u32) -> bool {
+        if (CSR_CYCLE..=CSR_INSTRET).contains(&csr) { self.has("zicntr") } else { self.has("zihpm") }
+    }
+}
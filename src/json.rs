@@ -0,0 +1,175 @@
+//! A minimal JSON parser and serializer, for the monitor and `-machine`.
+use alloc::{format, string::String, vec::Vec};
+
+pub enum Json {
+    Null,
+    Bool(bool),
+    Number(i64),
+    String(String),
+    Array(Vec<Json>),
+    Object(Vec<(String, Json)>),
+}
+
+impl Json {
+    pub fn get(&self, key: &str) -> Option<&Json> {
+        match self {
+            Json::Object(members) => members.iter().find(|(k, _)| k == key).map(|(_, v)| v),
+            _ => None,
+        }
+    }
+
+    pub fn as_i64(&self) -> Option<i64> {
+        match self {
+            Json::Number(value) => Some(*value),
+            _ => None,
+        }
+    }
+
+    pub fn as_str(&self) -> Option<&str> {
+        match self {
+            Json::String(s) => Some(s),
+            _ => None,
+        }
+    }
+
+    pub fn serialize(&self) -> String {
+        match self {
+            Json::Null => String::from("null"),
+            Json::Bool(value) => format!("{}", value),
+            Json::Number(value) => format!("{}", value),
+            Json::String(s) => quote(s),
+            Json::Array(values) => {
+                let values: Vec<String> = values.iter().map(Json::serialize).collect();
+                format!("[{}]", values.join(", "))
+            }
+            Json::Object(members) => {
+                let members: Vec<String> =
+                    members.iter().map(|(k, v)| format!("{}: {}", quote(k), v.serialize())).collect();
+                format!("{{{}}}", members.join(", "))
+            }
+        }
+    }
+}
+
+/// Serializes a JSON string.
+pub fn quote(s: &str) -> String {
+    let mut quoted = String::from("\"");
+    for ch in s.chars() {
+        match ch {
+            '"' => quoted.push_str("\\\""),
+            '\\' => quoted.push_str("\\\\"),
+            '\n' => quoted.push_str("\\n"),
+            ch if (ch as u32) < 0x20 => quoted.push_str(&format!("\\u{:04x}", ch as u32)),
+            ch => quoted.push(ch),
+        }
+    }
+    quoted.push('"');
+    quoted
+}
+
+struct Parser<'a> {
+    input: &'a [u8],
+    pos: usize,
+}
+
+impl Parser<'_> {
+    fn skip_whitespace(&mut self) {
+        while self.input.get(self.pos).is_some_and(|b| b.is_ascii_whitespace()) {
+            self.pos += 1;
+        }
+    }
+
+    fn consume(&mut self, expected: &[u8]) -> Option<()> {
+        self.skip_whitespace();
+        let end = self.pos + expected.len();
+        (self.input.get(self.pos..end)? == expected).then(|| self.pos = end)
+    }
+
+    fn parse_value(&mut self) -> Option<Json> {
+        self.skip_whitespace();
+        match *self.input.get(self.pos)? {
+            b'n' => self.consume(b"null").map(|_| Json::Null),
+            b't' => self.consume(b"true").map(|_| Json::Bool(true)),
+            b'f' => self.consume(b"false").map(|_| Json::Bool(false)),
+            b'"' => self.parse_string().map(Json::String),
+            b'[' => {
+                self.pos += 1;
+                let mut values = Vec::new();
+                if self.consume(b"]").is_some() {
+                    return Some(Json::Array(values));
+                }
+
+                loop {
+                    values.push(self.parse_value()?);
+                    if self.consume(b"]").is_some() {
+                        return Some(Json::Array(values));
+                    }
+                    self.consume(b",")?;
+                }
+            }
+            b'{' => {
+                self.pos += 1;
+                let mut members = Vec::new();
+                if self.consume(b"}").is_some() {
+                    return Some(Json::Object(members));
+                }
+
+                loop {
+                    self.skip_whitespace();
+                    let key = self.parse_string()?;
+                    self.consume(b":")?;
+                    members.push((key, self.parse_value()?));
+                    if self.consume(b"}").is_some() {
+                        return Some(Json::Object(members));
+                    }
+                    self.consume(b",")?;
+                }
+            }
+            _ => {
+                let start = self.pos;
+                while self.input.get(self.pos).is_some_and(|&b| b == b'-' || b.is_ascii_digit()) {
+                    self.pos += 1;
+                }
+                core::str::from_utf8(&self.input[start..self.pos]).ok()?.parse().ok().map(Json::Number)
+            }
+        }
+    }
+
+    fn parse_string(&mut self) -> Option<String> {
+        if self.input.get(self.pos) != Some(&b'"') {
+            return None;
+        }
+
+        self.pos += 1;
+        let mut bytes = Vec::new();
+        loop {
+            let byte = *self.input.get(self.pos)?;
+            self.pos += 1;
+            match byte {
+                b'"' => return String::from_utf8(bytes).ok(),
+                b'\\' => {
+                    let escaped = *self.input.get(self.pos)?;
+                    self.pos += 1;
+                    match escaped {
+                        b'n' => bytes.push(b'\n'),
+                        b't' => bytes.push(b'\t'),
+                        b'r' => bytes.push(b'\r'),
+                        b'u' => {
+                            let hex = core::str::from_utf8(self.input.get(self.pos..self.pos + 4)?).ok()?;
+                            let ch = char::from_u32(u32::from_str_radix(hex, 16).ok()?)?;
+                            bytes.extend_from_slice(ch.encode_utf8(&mut [0; 4]).as_bytes());
+                            self.pos += 4;
+                        }
+                        other => bytes.push(other),
+                    }
+                }
+                byte => bytes.push(byte),
+            }
+        }
+    }
+}
+
+/// Parses a JSON value at the beginning of `input`.
+pub fn parse(input: &[u8]) -> Option<Json> {
+    Parser { input, pos: 0 }.parse_value()
+}
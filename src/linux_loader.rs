@@ -1,6 +1,4 @@
-use crate::{guest_memory::{DTB_MEMORY, GUEST_MEMORY}, guest_page_table::{GuestPageTable, PTE_R, PTE_W, PTE_X}};
-use alloc::vec::Vec;
-use alloc::format;
+use crate::{boot_time::{self, Milestone}, config::config, device_tree, guest_memory::{DTB_MEMORY, GUEST_MEMORY}, guest_page_table::{GuestPageTable, PTE_R, PTE_W, PTE_X}, elf, host_fw_cfg, inflate, measured_boot::{self, Image}, reserved_mem};
 use core::mem::size_of;
 
 #[repr(C)]
@@ -18,76 +16,176 @@ struct RiscvImageHeader {
     reserved3: u32,
 }
 
+pub const GUEST_FB_ADDR: u64 = 0x6000_0000;
 pub const GUEST_DTB_ADDR: u64 = 0x7000_0000;
-pub const GUEST_BASE_ADDR: u64 = 0x8000_0000;
-pub const PLIC_ADDR: u64 = 0x0c00_0000;
-pub const PLIC_END: u64 = PLIC_ADDR + 0x400000;
-pub const MEMORY_SIZE: usize = 64 * 1024 * 1024;
 
-pub fn load_linux_kernel(table: &mut GuestPageTable, image: &[u8]) {
-    assert!(image.len() >= size_of::<RiscvImageHeader>());
-    let header = unsafe { &*(image.as_ptr() as *const RiscvImageHeader) };
-    assert_eq!(u32::from_le(header.magic2), 0x05435352, "invalid magic");
+const BUILTIN_IMAGE: &[u8] = include_bytes!("../linux/Image");
+const ZSTD_MAGIC: [u8; 4] = [0x28, 0xb5, 0x2f, 0xfd];
+/// With `-firmware`, the firmware is loaded at the start of the memory and
+/// the kernel right after it, where OpenSBI's fw_jump expects it.
+const FIRMWARE_SIZE: u64 = 0x20_0000;
 
-    let kernel_size = u64::from_le(header.image_size);
-    assert!(image.len() <= MEMORY_SIZE);
-    GUEST_MEMORY.write_bytes(table, image, PTE_R | PTE_W | PTE_X);
+/// The PE header of an EFI zboot image (CONFIG_EFI_ZBOOT) has "zimg" at this
+/// offset, followed by the payload offset and size, and the compression type.
+const ZBOOT_MAGIC_OFFSET: usize = 4;
+const ZBOOT_COMP_TYPE_OFFSET: usize = 24;
 
-    let dtb = build_device_tree().unwrap();
-    DTB_MEMORY.write_bytes(table, &dtb, PTE_R);
+/// Loads the kernel and the device tree into the guest memory, and maps the
+/// device tree (and the RAM with `-prealloc`).
+/// Returns the entry point.
+pub fn load_linux_kernel(table: &mut GuestPageTable) -> u64 {
+    let entry = if config().loadvm {
+        // The memory comes from the snapshot (or is already in QEMU's memory
+        // file), and so does the entry point.
+        DTB_MEMORY.write_bytes(&device_tree::build(None));
+        boot_time::record(Milestone::DeviceTree);
+        GUEST_MEMORY.guest_base()
+    } else {
+        load_images()
+    };
+    // Otherwise the guest RAM is mapped on the first access to each page
+    // (see trap.rs).
+    if config().prealloc {
+        GUEST_MEMORY.prealloc();
+        GUEST_MEMORY.map(table, PTE_R | PTE_W | PTE_X);
+    }
+    DTB_MEMORY.map(table, PTE_R);
+    entry
+}
+
+/// Loads the kernel and the device tree again to restart the guest. The
+/// memory is already mapped. Returns the entry point.
+pub fn reload_linux_kernel() -> u64 {
+    load_images()
+}
+
+/// Loads the kernel (`-kernel`, or the built-in one by default), the initrd
+/// (`-initrd`), and the firmware (`-firmware`) into the guest memory, and
+/// builds the device tree. Returns the entry point: the firmware's if any.
+fn load_images() -> u64 {
+    let base = GUEST_MEMORY.guest_base();
+    let kernel_addr = if config().firmware.is_some() { base + FIRMWARE_SIZE } else { base };
+    let memory = GUEST_MEMORY.host_addr(kernel_addr);
+    let max_len = GUEST_MEMORY.size() - (kernel_addr - base) as usize;
+    let image_len = match &config().kernel {
+        Some(name) => host_fw_cfg::read_file(name, memory, max_len)
+            .unwrap_or_else(|| panic!("-kernel: failed to read {} from fw_cfg (or too large)", name)),
+        None => {
+            assert!(BUILTIN_IMAGE.len() <= max_len, "kernel image is larger than guest memory");
+            unsafe { core::ptr::copy_nonoverlapping(BUILTIN_IMAGE.as_ptr(), memory, BUILTIN_IMAGE.len()) };
+            BUILTIN_IMAGE.len()
+        }
+    };
+    // As signed: before decompressing it.
+    measured_boot::reset();
+    measured_boot::measure(Image::Kernel, config().kernel.as_deref(), unsafe {
+        core::slice::from_raw_parts(memory, image_len)
+    });
+
+    let image_len = unpack(memory, image_len);
+    let image = unsafe { core::slice::from_raw_parts(memory, image_len) };
+    let (entry, kernel_end) = if elf::is_elf(image) {
+        // ELF segments have their own addresses, which may be the firmware's.
+        assert!(config().firmware.is_none(), "-firmware: the kernel must be an Image, not an ELF executable");
+
+        // Segments may overlap the file: load them from a copy.
+        let image = move_to_end(image);
+        let limit = base + (image.as_ptr() as u64 - memory as u64);
+        elf::load(image, limit)
+    } else {
+        assert!(image_len >= size_of::<RiscvImageHeader>());
+        // A kernel with the EFI stub (CONFIG_EFI_STUB) starts with "MZ", but
+        // the rest of the header is the same: we boot it as a flat Image.
+        let header = unsafe { &*(memory as *const RiscvImageHeader) };
+        assert_eq!(u32::from_le(header.magic2), 0x05435352, "invalid magic (not an Image or ELF)");
+        (kernel_addr, kernel_addr + u64::from_le(header.image_size))
+    };
+
+    // Place the initrd at the end of the memory (below -reserved-mem), away
+    // from the kernel.
+    let usable_end = reserved_mem::usable_end();
+    assert!(kernel_end <= usable_end, "-reserved-mem: the kernel overlaps the reserved memory");
+    let initrd = config().initrd.as_ref().map(|name| {
+        let size = host_fw_cfg::file_size(name)
+            .unwrap_or_else(|| panic!("-initrd: {} not found in fw_cfg", name)) as u64;
+        let start = usable_end.saturating_sub(size) & !0xfff;
+        assert!(start >= kernel_end, "-initrd: too large for the guest memory");
+        host_fw_cfg::read_file(name, GUEST_MEMORY.host_addr(start), size as usize)
+            .unwrap_or_else(|| panic!("-initrd: failed to read {}", name));
+        measured_boot::measure(Image::Initrd, Some(name), unsafe {
+            core::slice::from_raw_parts(GUEST_MEMORY.host_addr(start), size as usize)
+        });
+        info!("loader", "loaded initrd: size={}KB", size / 1024);
+        (start, start + size)
+    });
 
-    println!("loaded kernel: size={}KB", kernel_size / 1024);
+    boot_time::record(Milestone::Kernel);
+    let dtb = device_tree::build(initrd);
+    DTB_MEMORY.write_bytes(&dtb);
+    measured_boot::measure(Image::DeviceTree, None, &dtb);
+    boot_time::record(Milestone::DeviceTree);
+
+    info!("loader", "loaded kernel: size={}KB, entry={:#x}", (kernel_end - kernel_addr) / 1024, entry);
+
+    // The firmware gets a0 (hart ID) and a1 (the device tree) as the kernel
+    // would, and boots the kernel at 0x80200000 (by default) by itself, e.g.
+    // U-Boot (built for S-mode) with `booti 0x80200000 - ${fdtcontroladdr}`.
+    let Some(name) = &config().firmware else {
+        return entry;
+    };
+
+    let len = host_fw_cfg::read_file(name, GUEST_MEMORY.host_addr(base), FIRMWARE_SIZE as usize)
+        .unwrap_or_else(|| panic!("-firmware: failed to read {} from fw_cfg (or larger than {}KB)", name, FIRMWARE_SIZE / 1024));
+    measured_boot::measure(Image::Firmware, Some(name), unsafe {
+        core::slice::from_raw_parts(GUEST_MEMORY.host_addr(base), len)
+    });
+    info!("loader", "loaded firmware: size={}KB, entry={:#x}", len / 1024, base);
+    base
 }
 
-fn build_device_tree() -> Result<Vec<u8>, vm_fdt::Error> {
-    let mut fdt = vm_fdt::FdtWriter::new()?;
-    let root_node = fdt.begin_node("")?;
-    fdt.property_string("compatible", "riscv-virtio")?;
-    fdt.property_u32("#address-cells", 0x2)?;
-    fdt.property_u32("#size-cells", 0x2)?;
-
-    let chosen_node = fdt.begin_node("chosen")?;
-    fdt.property_string("bootargs", "console=hvc earlycon=sbi panic=-1 root=/dev/vda")?;
-    fdt.end_node(chosen_node)?;
-
-    let memory_node = fdt.begin_node(&format!("memory@{}", GUEST_BASE_ADDR))?;
-    fdt.property_string("device_type", "memory")?;
-    fdt.property_array_u64("reg", &[GUEST_BASE_ADDR, MEMORY_SIZE as u64])?;
-    fdt.end_node(memory_node)?;
-
-    let cpus_node = fdt.begin_node("cpus")?;
-    fdt.property_u32("#address-cells", 0x1)?;
-    fdt.property_u32("#size-cells", 0x0)?;
-    fdt.property_u32("timebase-frequency", 10000000)?;
-
-    let cpu_node = fdt.begin_node("cpu@0")?;
-    fdt.property_string("device_type", "cpu")?;
-    fdt.property_string("compatible", "riscv")?;
-    fdt.property_u32("reg", 0)?;
-    fdt.property_string("status", "okay")?;
-    fdt.property_string("mmu-type", "riscv,sv48")?;
-    fdt.property_string("riscv,isa", "rv64imafdc")?;
-
-    let intc_node = fdt.begin_node("interrupt-controller")?;
-    fdt.property_u32("#interrupt-cells", 1)?;
-    fdt.property_null("interrupt-controller")?;
-    fdt.property_string("compatible", "riscv,cpu-intc")?;
-    fdt.property_phandle(1)?;
-    fdt.end_node(intc_node)?;
-
-    fdt.end_node(cpu_node)?;
-    fdt.end_node(cpus_node)?;
-
-    let plic_node = fdt.begin_node("plic@c000000")?;
-    fdt.property_string("compatible", "riscv,plic0")?;
-    fdt.property_u32("#interrupt-cells", 1)?;
-    fdt.property_null("interrupt-controller")?;
-    fdt.property_array_u64("reg", &[PLIC_ADDR, 0x4000000])?;
-    fdt.property_u32("riscv,ndev", 3)?;
-    fdt.property_array_u32("interrupts-extended", &[1, 11, 1, 9])?;
-    fdt.property_phandle(2)?;
-    fdt.end_node(plic_node)?;
-
-    fdt.end_node(root_node)?;
-    fdt.finish()
+/// Moves `data` in the guest memory to the end of it. Returns the new location.
+fn move_to_end(data: &[u8]) -> &'static [u8] {
+    let memory = GUEST_MEMORY.host_addr(GUEST_MEMORY.guest_base());
+    let start = (GUEST_MEMORY.size() - data.len()) & !0xfff;
+    unsafe {
+        core::ptr::copy(data.as_ptr(), memory.add(start), data.len());
+        core::slice::from_raw_parts(memory.add(start), data.len())
+    }
+}
+
+/// Decompresses the kernel at the start of the guest memory in place if it's
+/// compressed: a gzip-compressed Image, or an EFI zboot image. Returns the
+/// size of the flat Image.
+fn unpack(memory: *mut u8, image_len: usize) -> usize {
+    let image = unsafe { core::slice::from_raw_parts(memory, image_len) };
+    let (payload, comp_type): (&[u8], &[u8]) = if image.starts_with(b"MZ")
+        && image.get(ZBOOT_MAGIC_OFFSET..ZBOOT_MAGIC_OFFSET + 4) == Some(b"zimg")
+    {
+        let field = |offset: usize| u32::from_le_bytes(image[offset..offset + 4].try_into().unwrap()) as usize;
+        let (offset, size) = (field(ZBOOT_MAGIC_OFFSET + 4), field(ZBOOT_MAGIC_OFFSET + 8));
+        let payload = image.get(offset..offset + size).expect("-kernel: invalid EFI zboot header");
+        let comp_type = &image[ZBOOT_COMP_TYPE_OFFSET..ZBOOT_COMP_TYPE_OFFSET + 32];
+        (payload, comp_type.split(|&b| b == 0).next().unwrap())
+    } else if inflate::is_gzip(image) {
+        (image, b"gzip")
+    } else if image.starts_with(&ZSTD_MAGIC) {
+        (image, b"zstd")
+    } else {
+        return image_len;
+    };
+
+    if comp_type != b"gzip" {
+        panic!(
+            "-kernel: {}-compressed kernels are not supported: decompress it or use gzip",
+            core::str::from_utf8(comp_type).unwrap_or("unknown")
+        );
+    }
+
+    // Move the compressed data to the end of the memory, and decompress it
+    // into the start.
+    let compressed = move_to_end(payload);
+    let out = unsafe { core::slice::from_raw_parts_mut(memory, compressed.as_ptr() as usize - memory as usize) };
+    let len = inflate::gunzip(compressed, out).unwrap_or_else(|err| panic!("-kernel: failed to decompress: {}", err));
+    info!("loader", "decompressed kernel: {}KB -> {}KB", payload.len() / 1024, len / 1024);
+    len
 }
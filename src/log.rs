@@ -0,0 +1,113 @@
+//! Leveled logging (`-log [<level>,][<component>=<level>,...]`), e.g.
+//! `-log warn,virtio=debug,vcpu=trace`. The default level is info.
+//!
+//! The component is the prefix of the message, e.g. "virtio-blk" in
+//! `[virtio-blk] ...`. A component also sets the level of its
+//! sub-components: "virtio" is for "virtio-blk" too, unless it has its own.
+//!
+//! With `-log-json`, messages go to the "log" port of the host virtio
+//! console (`-device virtserialport,name=log`) as JSON lines, e.g.
+//!
+//! ```text
+//! {"level": "info", "component": "host-net", "message": "found virtio-net at 0x10001000 (irq=1)", "timestamp": {"seconds": 1, "microseconds": 20351}}
+//! ```
+use alloc::format;
+use core::fmt;
+use spin::Once;
+
+use crate::{
+    config::{LogLevel, config},
+    host_console, json, monitor,
+};
+
+/// `-device virtserialport,name=log` in run.sh.
+const PORT: &str = "log";
+
+static USE_PORT: Once<bool> = Once::new();
+
+macro_rules! log {
+    ($level:expr, $component:expr, $($arg:tt)*) => {{
+        if $crate::log::enabled($level, $component) {
+            $crate::log::write($level, $component, format_args!($($arg)*));
+        }
+    }};
+}
+
+macro_rules! error {
+    ($component:expr, $($arg:tt)*) => { log!($crate::config::LogLevel::Error, $component, $($arg)*) };
+}
+
+macro_rules! warn {
+    ($component:expr, $($arg:tt)*) => { log!($crate::config::LogLevel::Warn, $component, $($arg)*) };
+}
+
+macro_rules! info {
+    ($component:expr, $($arg:tt)*) => { log!($crate::config::LogLevel::Info, $component, $($arg)*) };
+}
+
+macro_rules! debug {
+    ($component:expr, $($arg:tt)*) => { log!($crate::config::LogLevel::Debug, $component, $($arg)*) };
+}
+
+macro_rules! trace {
+    ($component:expr, $($arg:tt)*) => { log!($crate::config::LogLevel::Trace, $component, $($arg)*) };
+}
+
+/// Call this after the host console so that messages go to the "log" port.
+pub fn init() {
+    if !config().log.json {
+        return;
+    }
+
+    let use_port = host_console::has_port(PORT);
+    USE_PORT.call_once(|| use_port);
+    if !use_port {
+        warn!("log", "\"log\" port not found: writing to the console");
+    }
+}
+
+fn level_name(level: LogLevel) -> &'static str {
+    match level {
+        LogLevel::Error => "error",
+        LogLevel::Warn => "warn",
+        LogLevel::Info => "info",
+        LogLevel::Debug => "debug",
+        LogLevel::Trace => "trace",
+    }
+}
+
+/// The level of the component: the one of the longest matching prefix.
+fn component_level(component: &str) -> LogLevel {
+    let matches = |prefix: &str| {
+        component.strip_prefix(prefix).is_some_and(|rest| rest.is_empty() || rest.starts_with('-'))
+    };
+
+    let log = &config().log;
+    log.components
+        .iter()
+        .filter(|(prefix, _)| matches(prefix))
+        .max_by_key(|(prefix, _)| prefix.len())
+        .map(|&(_, level)| level)
+        .unwrap_or(log.default)
+}
+
+pub fn enabled(level: LogLevel, component: &str) -> bool {
+    // Most messages are filtered out here: this is called on every VM exit.
+    level <= config().log.max && level <= component_level(component)
+}
+
+pub fn write(level: LogLevel, component: &str, args: fmt::Arguments) {
+    // host-console logs with its lock held.
+    if USE_PORT.get() == Some(&true) && component != "host-console" {
+        let line = format!(
+            "{{\"level\": \"{}\", \"component\": {}, \"message\": {}, \"timestamp\": {}}}\n",
+            level_name(level),
+            json::quote(component),
+            json::quote(&format!("{}", args)),
+            monitor::timestamp()
+        );
+        host_console::write(PORT, line.as_bytes());
+    } else {
+        println!("[{}] {}", component, args);
+    }
+}
@@ -0,0 +1,253 @@
+//! The guest's memory map. `-machine <fw_cfg name>` overrides the default
+//! one with a JSON file, e.g. `-fw_cfg name=opt/hypervisor/machine,file=...`:
+//!
+//! ```text
+//! {
+//!     "ram": {"base": "0x40000000", "size": "0x20000000"},
+//!     "devices": {
+//!         "plic": {"addr": "0x8000000"},
+//!         "virtio-net": {"addr": "0x20000000", "irq": 20}
+//!     }
+//! }
+//! ```
+//!
+//! Addresses are numbers or strings in hex. Both the MMIO bus and the device
+//! tree are laid out by it. The RAM size overrides `-mem`, and the device
+//! tree and the framebuffer stay at GUEST_DTB_ADDR and GUEST_FB_ADDR.
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::Once;
+
+use crate::{
+    config::config,
+    framebuffer, host_fw_cfg,
+    hotplug::MAX_HOTPLUG_SLOTS,
+    json::{self, Json},
+    linux_loader::{GUEST_DTB_ADDR, GUEST_FB_ADDR},
+    plic::NUM_SOURCES,
+    virtio_input::NUM_INPUTS,
+};
+
+const DEFAULT_RAM_BASE: u64 = 0x8000_0000;
+/// The largest file we read.
+const MAX_FILE_SIZE: usize = 64 * 1024;
+/// The size of DTB_MEMORY.
+const DTB_SIZE: u64 = 0x10000;
+/// Linux hotplugs memory in 128MB sections on RISC-V: the virtio-mem region
+/// starts at one.
+const VIRTIO_MEM_ALIGN: u64 = 0x800_0000;
+
+struct Device {
+    name: &'static str,
+    addr: u64,
+    size: u64,
+    /// The first PLIC source. 0 if the device has no interrupts.
+    irq: u32,
+    num_irqs: u32,
+}
+
+const fn device(name: &'static str, addr: u64, size: u64, irq: u32, num_irqs: u32) -> Device {
+    Device { name, addr, size, irq, num_irqs }
+}
+
+/// The default memory map.
+const DEFAULT_DEVICES: [Device; 18] = [
+    device("plic", 0x0c00_0000, 0x40_0000, 0, 0),
+    device("virtio-net", 0x1000_1000, 0x1000, 1, 1),
+    device("virtio-blk", 0x1000_2000, 0x1000, 2, 1),
+    device("virtio-console", 0x1000_3000, 0x1000, 3, 1),
+    device("virtio-9p", 0x1000_4000, 0x1000, 4, 1),
+    device("virtio-rng", 0x1000_5000, 0x1000, 5, 1),
+    device("virtio-balloon", 0x1000_6000, 0x1000, 6, 1),
+    device("virtio-vsock", 0x1000_7000, 0x1000, 7, 1),
+    // A slot per 4KB and an IRQ per slot.
+    device("hotplug", 0x1000_8000, MAX_HOTPLUG_SLOTS as u64 * 0x1000, 8, MAX_HOTPLUG_SLOTS as u32),
+    device("virtio-input", 0x1000_c000, NUM_INPUTS as u64 * 0x1000, 12, NUM_INPUTS as u32),
+    device("virtio-fs", 0x1000_e000, 0x1000, 15, 1),
+    device("virtio-mem", 0x1000_f000, 0x1000, 20, 1),
+    device("watchdog", 0x1010_0000, 0x1000, 0, 0),
+    device("rtc", 0x1010_1000, 0x1000, 14, 1),
+    device("pvpanic", 0x1010_2000, 0x1000, 0, 0),
+    device("test", 0x10_0000, 0x1000, 0, 0),
+    // Bus 0 only, and INTA-INTD.
+    device("pci-ecam", 0x3000_0000, 0x10_0000, 16, 4),
+    // BARs.
+    device("pci-mmio", 0x4000_0000, 0x1000_0000, 0, 0),
+];
+
+struct Machine {
+    ram_base: u64,
+    ram_size: usize,
+    devices: Vec<Device>,
+}
+
+static MACHINE: Once<Machine> = Once::new();
+
+fn machine() -> &'static Machine {
+    MACHINE.get().expect("machine not initialized")
+}
+
+/// The start of the guest RAM.
+pub fn ram_base() -> u64 {
+    machine().ram_base
+}
+
+/// The size of the guest RAM.
+pub fn ram_size() -> usize {
+    machine().ram_size
+}
+
+/// Where the memory of virtio-mem starts: above the RAM.
+pub fn virtio_mem_base() -> u64 {
+    machine().virtio_mem_base()
+}
+
+/// Returns the base address, the end address, and the first IRQ (0 if none)
+/// of a device.
+pub fn device_region(name: &str) -> (u64, u64, u32) {
+    let device = machine().devices.iter().find(|device| device.name == name).expect("unknown device");
+    (device.addr, device.addr + device.size, device.irq)
+}
+
+/// A number, or a string in hex (`0x...`) or in decimal.
+fn parse_number(value: &Json) -> Option<u64> {
+    match value {
+        Json::Number(value) => u64::try_from(*value).ok(),
+        Json::String(s) => match s.strip_prefix("0x") {
+            Some(hex) => u64::from_str_radix(hex, 16).ok(),
+            None => s.parse().ok(),
+        },
+        _ => None,
+    }
+}
+
+fn overlaps(a: (u64, u64), b: (u64, u64)) -> bool {
+    a.0 < b.1 && b.0 < a.1
+}
+
+fn parse(text: &[u8]) -> Result<Machine, String> {
+    let Some(Json::Object(members)) = json::parse(text) else {
+        return Err(String::from("not a JSON object"));
+    };
+
+    let mut machine = Machine::default();
+    for (key, value) in &members {
+        match (key.as_str(), value) {
+            ("ram", ram) => {
+                if let Some(base) = ram.get("base") {
+                    machine.ram_base = parse_number(base).ok_or("ram.base: invalid address")?;
+                }
+
+                if let Some(size) = ram.get("size") {
+                    machine.ram_size = parse_number(size).ok_or("ram.size: invalid number")? as usize;
+                }
+            }
+            ("devices", Json::Object(devices)) => {
+                for (name, value) in devices {
+                    let Some(device) = machine.devices.iter_mut().find(|device| device.name == name) else {
+                        let names: Vec<&str> = DEFAULT_DEVICES.iter().map(|device| device.name).collect();
+                        return Err(format!("unknown device \"{}\" (expected one of {})", name, names.join(", ")));
+                    };
+
+                    if let Some(addr) = value.get("addr") {
+                        device.addr = parse_number(addr).ok_or(format!("{}.addr: invalid address", name))?;
+                    }
+
+                    if let Some(irq) = value.get("irq") {
+                        if device.num_irqs == 0 {
+                            return Err(format!("{} has no interrupts", name));
+                        }
+                        device.irq = parse_number(irq)
+                            .and_then(|irq| u32::try_from(irq).ok())
+                            .ok_or(format!("{}.irq: invalid number", name))?;
+                    }
+                }
+            }
+            _ => return Err(format!("unknown or invalid key \"{}\"", key)),
+        }
+    }
+
+    Ok(machine)
+}
+
+impl Machine {
+    fn default() -> Machine {
+        Machine { ram_base: DEFAULT_RAM_BASE, ram_size: config().memory_size, devices: Vec::from(DEFAULT_DEVICES) }
+    }
+
+    fn virtio_mem_base(&self) -> u64 {
+        (self.ram_base + self.ram_size as u64).next_multiple_of(VIRTIO_MEM_ALIGN)
+    }
+
+    /// Checks that regions and IRQs don't collide.
+    fn validate(&self) -> Result<(), String> {
+        if self.ram_base % 0x20_0000 != 0 {
+            return Err(String::from("ram.base must be 2MB-aligned"));
+        }
+
+        if self.ram_size == 0 || self.ram_size % 0x20_0000 != 0 {
+            return Err(String::from("ram.size must be a non-zero multiple of 2MB"));
+        }
+
+        let fb_size = config().framebuffer.as_ref().map_or(0, |fb| framebuffer::size(fb) as u64);
+        let ram_end = self.ram_base.checked_add(self.ram_size as u64).ok_or("ram: out of the address space")?;
+        let mut regions = vec![
+            ("ram", self.ram_base, ram_end),
+            ("device tree", GUEST_DTB_ADDR, GUEST_DTB_ADDR + DTB_SIZE),
+            ("framebuffer", GUEST_FB_ADDR, GUEST_FB_ADDR + fb_size),
+        ];
+
+        if let Some(mem) = &config().virtio_mem {
+            let base = self.virtio_mem_base();
+            let end = base.checked_add(mem.size as u64).ok_or("virtio-mem: out of the address space")?;
+            regions.push(("virtio-mem memory", base, end));
+        }
+
+        let mut used_irqs = vec![false; NUM_SOURCES];
+        for device in &self.devices {
+            if device.addr % 0x1000 != 0 {
+                return Err(format!("{}.addr must be 4KB-aligned", device.name));
+            }
+
+            regions.push((device.name, device.addr, device.addr.checked_add(device.size).ok_or("out of the address space")?));
+            let irqs = device.irq as usize..device.irq as usize + device.num_irqs as usize;
+            if device.num_irqs > 0 && (irqs.start == 0 || irqs.end > NUM_SOURCES) {
+                return Err(format!("{}.irq must be in 1-{}", device.name, NUM_SOURCES - device.num_irqs as usize));
+            }
+
+            for irq in irqs {
+                if core::mem::replace(&mut used_irqs[irq], true) {
+                    return Err(format!("IRQ {} is used by {} and another device", irq, device.name));
+                }
+            }
+        }
+
+        for (i, a) in regions.iter().enumerate() {
+            if let Some(b) = regions[i + 1..].iter().find(|b| overlaps((a.1, a.2), (b.1, b.2))) {
+                return Err(format!("{} ({:#x}-{:#x}) overlaps {} ({:#x}-{:#x})", a.0, a.1, a.2, b.0, b.1, b.2));
+            }
+        }
+
+        Ok(())
+    }
+}
+
+/// Loads the machine description (`-machine`), or the default one.
+pub fn init() {
+    let machine = match &config().machine {
+        Some(name) => {
+            let mut text = vec![0; MAX_FILE_SIZE];
+            let len = host_fw_cfg::read_file(name, text.as_mut_ptr(), text.len())
+                .unwrap_or_else(|| panic!("-machine: failed to read {} from fw_cfg (or too large)", name));
+            let machine = parse(&text[..len]).unwrap_or_else(|err| panic!("-machine: {}", err));
+            info!("machine", "loaded {}: {}MB RAM at {:#x}", name, machine.ram_size / 1024 / 1024, machine.ram_base);
+            machine
+        }
+        None => Machine::default(),
+    };
+
+    if let Err(err) = machine.validate() {
+        panic!("-machine: {}", err);
+    }
+
+    MACHINE.call_once(|| machine);
+}
@@ -5,18 +5,106 @@ extern crate alloc;
 
 #[macro_use]
 mod print;
+#[macro_use]
+mod log;
 mod allocator;
 mod guest_page_table;
 mod trap;
 mod vcpu;
 mod linux_loader;
+mod machine;
+mod inflate;
+mod elf;
+mod device_tree;
+mod dt_overlay;
 mod guest_memory;
+mod memcheck;
+mod reserved_mem;
+mod host_dtb;
+mod config;
+mod identity;
+mod sbi;
+mod isa;
+mod pmu;
+mod profile;
+mod hypercall;
+mod smp;
+mod nested;
+mod vm;
+mod plic;
+mod host_plic;
+mod pci;
+mod virtio;
+mod virtio_features;
+mod virtio_net;
+mod virtio_blk;
+mod virtio_console;
+mod virtio_9p;
+mod virtio_fs;
+mod virtio_rng;
+mod virtio_balloon;
+mod virtio_mem;
+mod virtio_vsock;
+mod virtio_input;
+mod hotplug;
+mod watchdog;
+mod rtc;
+mod test_finisher;
+mod pvpanic;
+mod framebuffer;
+mod migration;
+mod host_virtio;
+mod host_net;
+mod host_blk;
+mod cow_disk;
+mod host_9p;
+mod host_fs;
+mod host_rng;
+mod host_balloon;
+mod host_console;
+mod host_input;
+mod host_uart;
+mod host_rtc;
+mod host_test;
+mod host_fw_cfg;
+mod gdb;
+mod single_step;
+mod json;
+mod monitor;
+mod trace;
+mod guest_trace;
+mod serial;
+mod console_log;
+mod boot_time;
+mod fault_inject;
+mod fault_stats;
+mod metrics;
+mod page_walk;
+mod mmio_decode;
+mod symbols;
+mod inst_emulation;
+mod mmio_bus;
+mod timer;
+mod deterministic;
+mod cpu_quota;
+mod throttle;
+mod pcap;
+mod snapshot;
+mod zstd;
+mod aes_gcm;
+mod encryption;
+mod sha256;
+mod rsa;
+mod measured_boot;
+mod core_dump;
+mod crash;
 
+use alloc::boxed::Box;
 use core::arch::asm;
 use core::panic::PanicInfo;
 
 use crate::{
-    guest_page_table::GuestPageTable, linux_loader::{GUEST_BASE_ADDR, GUEST_DTB_ADDR}, vcpu::VCpu
+    config::config, guest_memory::{DTB_MEMORY, GUEST_MEMORY}, guest_page_table::{GuestPageTable, MEGAPAGE_SIZE}, linux_loader::GUEST_DTB_ADDR, vcpu::VCpu
 };
 
 #[unsafe(no_mangle)]
@@ -39,7 +127,8 @@ unsafe extern "C" {
     static mut __heap_end: u8;
 }
 
-fn main() -> ! {
+// a0 and a1 are set by OpenSBI: the boot hart ID and the device tree address.
+extern "C" fn main(hart_id: u64, dtb_addr: u64) -> ! {
     unsafe {
         let bss_start = &raw mut __bss;
         let bss_size = (&raw mut __bss_end as usize) - (&raw mut __bss as usize);
@@ -48,22 +137,210 @@ fn main() -> ! {
         asm!("csrw stvec, {}", in(reg) trap::trap_handler as usize);
     }
 
+    boot_time::record(boot_time::Milestone::Hypervisor);
     println!("\nBooting hypervisor...");
 
-    allocator::GLOBAL_ALLOCATOR.init(&raw mut __heap, &raw mut __heap_end);
+    // Use the rest of the RAM as the heap, except the host device tree
+    // placed by OpenSBI near the end of the RAM.
+    host_dtb::init(dtb_addr);
+    let heap_start = &raw mut __heap as u64;
+    let mut heap_end = host_dtb::ram_end().unwrap_or(&raw mut __heap_end as u64);
+    if (heap_start..heap_end).contains(&dtb_addr) {
+        heap_end = dtb_addr;
+    }
+    allocator::GLOBAL_ALLOCATOR.init(heap_start as *mut u8, heap_end as *mut u8);
+    config::init(host_dtb::bootargs());
+    if config().name.is_some() {
+        identity::init();
+    }
+    timer::init();
+    if let Some(seed) = config().deterministic {
+        deterministic::init(seed);
+    }
+    if let Some(spec) = &config().fault_inject {
+        fault_inject::init(spec);
+    }
+    smp::init(hart_id);
+    pmu::init();
+    host_test::init();
+    hypercall::init();
+    machine::init();
+
+    GUEST_MEMORY.relocate(machine::ram_base());
+    let align = if config().hugepages { MEGAPAGE_SIZE as usize } else { 0x1000 };
+    if config().mem_file {
+        GUEST_MEMORY.init_at_end(machine::ram_size(), align);
+    } else {
+        GUEST_MEMORY.init(machine::ram_size(), align);
+    }
+    DTB_MEMORY.init(0x10000, 0x1000);
+    if config().memcheck {
+        memcheck::init();
+    }
+
+    if config().measure {
+        measured_boot::init(config().verify.as_deref());
+    }
+
+    if let Some(name) = &config().dtb_overlay {
+        dt_overlay::init(name);
+    }
 
-    let kernel_image = include_bytes!("../linux/Image");
     let mut table = GuestPageTable::new();
-    linux_loader::load_linux_kernel(&mut table, kernel_image);
-    let mut vcpu = VCpu::new(&table, GUEST_BASE_ADDR);
+    let entry = linux_loader::load_linux_kernel(&mut table);
+    if let Some(fb) = &config().framebuffer {
+        framebuffer::init(fb, &mut table);
+    }
+
+    plic::init();
+    if config().pci {
+        pci::init();
+    }
+
+    if let Some(net) = &config().net {
+        host_net::init(hart_id);
+        virtio_net::init(net);
+    }
+
+    if let Some(disk) = &config().disk {
+        virtio_blk::init(disk, hart_id);
+    }
+
+    if let Some(console) = &config().console {
+        virtio_console::init(console);
+    }
+
+    if let Some(share) = &config().share {
+        virtio_9p::init(share);
+    }
+
+    if let Some(fs) = &config().fs {
+        virtio_fs::init(fs);
+    }
+
+    if let Some(rng) = &config().rng {
+        virtio_rng::init(rng);
+    }
+
+    if config().balloon {
+        virtio_balloon::init();
+    }
+
+    if let Some(mem) = &config().virtio_mem {
+        virtio_mem::init(mem, &table);
+    }
+
+    if config().input {
+        virtio_input::init(hart_id);
+    }
+
+    hotplug::init();
+
+    if config().watchdog {
+        watchdog::init();
+    }
+
+    if config().rtc {
+        rtc::init();
+    }
+
+    if config().test_finisher {
+        test_finisher::init();
+    }
+
+    if config().pvpanic {
+        pvpanic::init();
+    }
+
+    if let Some(key) = &config().snapshot_key {
+        encryption::init(key);
+    }
+
+    if let Some(name) = &config().symbols {
+        symbols::init(name);
+    }
+
+    let uses_host_console = config().gdb
+        || config().monitor
+        || config().trace
+        || config().metrics
+        || config().pprof
+        || config().vsock.is_some()
+        || config().incoming
+        || config().log.json
+        || config().net.as_ref().is_some_and(|net| net.pcap.is_some())
+        || serial::uses_ports();
+    if uses_host_console {
+        host_console::init(hart_id);
+    }
+
+    log::init();
+
+    serial::init(hart_id);
+
+    // After the host console: vsock ports are bridged to its ports.
+    if let Some(vsock) = &config().vsock {
+        virtio_vsock::init(vsock);
+    }
+
+    if config().gdb {
+        gdb::init();
+    }
+
+    if config().monitor {
+        monitor::init();
+    }
+
+    if config().trace {
+        trace::init();
+    }
+
+    if config().trace_guest.is_some() {
+        guest_trace::init();
+    }
+
+    if config().metrics {
+        metrics::init();
+    }
+
+    if config().pprof {
+        profile::init();
+    }
+
+    if let Some(port) = config().net.as_ref().and_then(|net| net.pcap.as_deref()) {
+        pcap::init(port);
+    }
+
+    for hart_id in 1..config().num_vcpus as u64 {
+        let vcpu = Box::leak(Box::new(VCpu::new(&table, GUEST_MEMORY.guest_base())));
+        vcpu.hart_id = hart_id;
+        smp::start_secondary_hart(vcpu);
+    }
+
+    let mut vcpu = VCpu::new(&table, entry);
     vcpu.a0 = 0; // hart ID
     vcpu.a1 = GUEST_DTB_ADDR; // device tree address
+    if config().incoming {
+        // Overwrites the memory and the vCPUs with the ones from the source.
+        migration::incoming(&mut vcpu);
+    }
+
+    if config().loadvm {
+        // Overwrites the vCPUs, the devices, and the memory (unless it's in
+        // QEMU's memory file) with the snapshot.
+        snapshot::load_at_boot(&mut vcpu);
+    }
+
+    boot_time::record(boot_time::Milestone::Guest);
     vcpu.run();
 }
 
 #[panic_handler]
 pub fn panic_handler(info: &PanicInfo) -> ! {
+    host_uart::stop_async();
     println!("panic: {}", info);
+    // Let QEMU exit with 1 (see run.sh). Spin if we couldn't.
+    let _ = host_test::exit(host_test::EXIT_FAILURE);
     loop {
         unsafe {
             core::arch::asm!("wfi");
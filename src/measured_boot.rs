@@ -0,0 +1,195 @@
+//! Measured boot (`-measure`) and image verification (`-verify`).
+//!
+//! The firmware, the kernel, the initrd, and the device tree (with the
+//! kernel command line in it) are hashed with SHA-256 before the guest
+//! starts, and extended into software PCRs as a TPM would: PCR := SHA-256(PCR
+//! || digest). The event log is printed and is in `info measurements` in the
+//! monitor:
+//!
+//! ```text
+//! [measure] PCR4 EV_IPL sha256:5f2b...e1 kernel opt/hypervisor/kernel (signature ok)
+//! ```
+//!
+//! With `-verify <public key>`, an RSA key in PEM, the fw_cfg files of the
+//! firmware, the kernel, and the initrd must be signed: `<name>.sig` is the
+//! signature of `<name>` (see run.sh). The guest doesn't boot otherwise. The
+//! built-in kernel is part of the hypervisor, and the device tree is built by
+//! it: they are measured but have no signatures.
+//!
+//! ```text
+//! openssl genpkey -algorithm RSA -pkeyopt rsa_keygen_bits:3072 -out key.pem
+//! openssl pkey -in key.pem -pubout -out pubkey.pem
+//! openssl dgst -sha256 -sign key.pem -out Image.sig Image
+//! ```
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::{Mutex, Once};
+
+use crate::{
+    host_fw_cfg,
+    rsa::{self, PublicKey},
+    sha256::{self, DIGEST_LEN},
+};
+
+const NUM_PCRS: usize = 24;
+const MAX_KEY_FILE: usize = 16 * 1024;
+
+/// What is measured, with the PCR and the event type of the TCG PC Client
+/// event log.
+#[derive(Clone, Copy)]
+pub enum Image {
+    Firmware,
+    Kernel,
+    Initrd,
+    DeviceTree,
+}
+
+impl Image {
+    fn name(self) -> &'static str {
+        match self {
+            Image::Firmware => "firmware",
+            Image::Kernel => "kernel",
+            Image::Initrd => "initrd",
+            Image::DeviceTree => "device-tree",
+        }
+    }
+
+    fn pcr(self) -> usize {
+        match self {
+            Image::Firmware => 0,
+            Image::DeviceTree => 1,
+            Image::Kernel => 4,
+            Image::Initrd => 9,
+        }
+    }
+
+    fn event_type(self) -> &'static str {
+        match self {
+            Image::Firmware => "EV_POST_CODE",
+            Image::DeviceTree => "EV_TABLE_OF_DEVICES",
+            Image::Kernel | Image::Initrd => "EV_IPL",
+        }
+    }
+}
+
+struct Event {
+    image: Image,
+    digest: [u8; DIGEST_LEN],
+    /// The fw_cfg file name, if any.
+    file: Option<String>,
+    verified: bool,
+}
+
+struct State {
+    pcrs: [[u8; DIGEST_LEN]; NUM_PCRS],
+    events: Vec<Event>,
+}
+
+static KEY: Once<Option<PublicKey>> = Once::new();
+static STATE: Mutex<State> = Mutex::new(State { pcrs: [[0; DIGEST_LEN]; NUM_PCRS], events: Vec::new() });
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// Enables the measurements, and reads the public key from the fw_cfg file
+/// `key` (`-verify`) if any.
+pub fn init(key: Option<&str>) {
+    let key = key.map(|name| {
+        let mut pem = vec![0; MAX_KEY_FILE];
+        let len = host_fw_cfg::read_file(name, pem.as_mut_ptr(), pem.len())
+            .unwrap_or_else(|| panic!("-verify: failed to read {} from fw_cfg (or too large)", name));
+        let key = PublicKey::from_pem(&pem[..len]).unwrap_or_else(|| {
+            panic!("-verify: {} is not an RSA public key in PEM ({} to {} bits)", name, rsa::MIN_BITS, rsa::MAX_BITS)
+        });
+        info!("measure", "verifying images with a {}-bit RSA key", key.bits());
+        key
+    });
+    KEY.call_once(|| key);
+}
+
+pub fn is_enabled() -> bool {
+    KEY.get().is_some()
+}
+
+/// Clears the PCRs and the event log, before loading the images of a boot.
+pub fn reset() {
+    let mut state = STATE.lock();
+    state.pcrs = [[0; DIGEST_LEN]; NUM_PCRS];
+    state.events.clear();
+}
+
+/// Reads and checks the signature of the fw_cfg file `file`.
+fn verify(key: &PublicKey, image: Image, file: &str, digest: &[u8; DIGEST_LEN]) {
+    let sig_file = format!("{}.sig", file);
+    let mut signature = vec![0; rsa::MAX_BITS / 8];
+    let len = host_fw_cfg::read_file(&sig_file, signature.as_mut_ptr(), signature.len())
+        .unwrap_or_else(|| panic!("-verify: the {} has no signature: {} not found in fw_cfg", image.name(), sig_file));
+    assert!(
+        key.verify_sha256(digest, &signature[..len]),
+        "-verify: bad signature of the {} ({}): refusing to boot",
+        image.name(),
+        file
+    );
+}
+
+/// Measures `data`, loaded from the fw_cfg file `file` (None if it's built
+/// in). Panics if its signature is missing or wrong with `-verify`.
+pub fn measure(image: Image, file: Option<&str>, data: &[u8]) {
+    let Some(key) = KEY.get() else {
+        return;
+    };
+
+    let digest = sha256::sha256(data);
+    let verified = match (key, file) {
+        (Some(key), Some(file)) => {
+            verify(key, image, file, &digest);
+            true
+        }
+        _ => false,
+    };
+
+    let mut state = STATE.lock();
+    let pcr = &mut state.pcrs[image.pcr()];
+    let mut extended = Vec::with_capacity(2 * DIGEST_LEN);
+    extended.extend_from_slice(pcr);
+    extended.extend_from_slice(&digest);
+    *pcr = sha256::sha256(&extended);
+
+    let event = Event { image, digest, file: file.map(String::from), verified };
+    info!("measure", "{}", format_event(&event));
+    state.events.push(event);
+}
+
+fn format_event(event: &Event) -> String {
+    let mut line = format!(
+        "PCR{} {} sha256:{} {}",
+        event.image.pcr(),
+        event.image.event_type(),
+        hex(&event.digest),
+        event.image.name()
+    );
+    if let Some(file) = &event.file {
+        line += &format!(" {}", file);
+    }
+    if event.verified {
+        line += " (signature ok)";
+    }
+    line
+}
+
+/// `info measurements`: the event log and the PCRs extended by it.
+pub fn report() -> String {
+    if !is_enabled() {
+        return String::from("measured boot is not enabled (-measure or -verify)");
+    }
+
+    let state = STATE.lock();
+    let mut lines: Vec<String> = state.events.iter().map(format_event).collect();
+    let mut pcrs: Vec<usize> = state.events.iter().map(|event| event.image.pcr()).collect();
+    pcrs.sort();
+    pcrs.dedup();
+    for pcr in pcrs {
+        lines.push(format!("PCR{}: {}", pcr, hex(&state.pcrs[pcr])));
+    }
+    lines.join("\n")
+}
@@ -0,0 +1,134 @@
+//! `-memcheck` (debug builds only): checks every access to the guest memory
+//! by the hypervisor, to catch bugs in the device models early. It reports,
+//! with a backtrace:
+//!
+//! - accesses out of the memory,
+//! - unaligned atomic accesses (e.g. virtqueue indices),
+//! - accesses to pages in the balloon, which the host may have discarded.
+//!
+//! The backtrace needs frame pointers (`MEMCHECK=1 ./run.sh` builds with
+//! them). Resolve the addresses with
+//! `llvm-addr2line -e hypervisor.elf <addr>...`.
+use core::arch::asm;
+use core::sync::atomic::{AtomicBool, AtomicPtr, AtomicU64, Ordering};
+
+use crate::{allocator::alloc_pages, guest_memory::GUEST_MEMORY, smp};
+
+const PAGE_SIZE: u64 = 4096;
+const MAX_FRAMES: usize = 32;
+/// Reports beyond this are dropped.
+const MAX_REPORTS: u64 = 64;
+
+static ENABLED: AtomicBool = AtomicBool::new(false);
+static NUM_REPORTS: AtomicU64 = AtomicU64::new(0);
+/// A bit per 4KB page of the guest RAM in the balloon.
+static BALLOONED: AtomicPtr<AtomicU64> = AtomicPtr::new(core::ptr::null_mut());
+
+#[derive(Debug, Clone, Copy)]
+pub enum Violation {
+    OutOfBounds,
+    Unaligned,
+    Ballooned,
+}
+
+/// Call this after the guest memory is allocated.
+pub fn init() {
+    if !cfg!(debug_assertions) {
+        panic!("-memcheck is not available in release builds");
+    }
+
+    let len = (GUEST_MEMORY.size() / PAGE_SIZE as usize).div_ceil(64);
+    BALLOONED.store(alloc_pages(len * size_of::<u64>()) as *mut AtomicU64, Ordering::Release);
+    ENABLED.store(true, Ordering::Release);
+    info!("memcheck", "checking accesses to the guest memory");
+}
+
+pub fn enabled() -> bool {
+    cfg!(debug_assertions) && ENABLED.load(Ordering::Relaxed)
+}
+
+fn ballooned() -> &'static [AtomicU64] {
+    let len = (GUEST_MEMORY.size() / PAGE_SIZE as usize).div_ceil(64);
+    unsafe { core::slice::from_raw_parts(BALLOONED.load(Ordering::Acquire), len) }
+}
+
+fn page_index(guest_addr: u64) -> Option<usize> {
+    GUEST_MEMORY.contains(guest_addr).then(|| ((guest_addr - GUEST_MEMORY.guest_base()) / PAGE_SIZE) as usize)
+}
+
+/// Records a page given to (`inflated`) or taken back from the balloon.
+pub fn set_ballooned(guest_addr: u64, inflated: bool) {
+    let Some(page) = page_index(guest_addr).filter(|_| enabled()) else {
+        return;
+    };
+
+    let word = &ballooned()[page / 64];
+    let bit = 1 << (page % 64);
+    if inflated {
+        word.fetch_or(bit, Ordering::AcqRel);
+    } else {
+        word.fetch_and(!bit, Ordering::AcqRel);
+    }
+}
+
+/// The driver starts with an empty balloon after a reset.
+pub fn clear_ballooned() {
+    if enabled() {
+        ballooned().iter().for_each(|word| word.store(0, Ordering::Release));
+    }
+}
+
+/// Checks an access to `[guest_addr, guest_addr + len)`, which is in the
+/// memory.
+pub fn check_access(guest_addr: u64, len: usize) {
+    // Only the guest RAM has the balloon.
+    let Some(first) = page_index(guest_addr).filter(|_| enabled() && len > 0) else {
+        return;
+    };
+
+    let last = first + ((guest_addr % PAGE_SIZE + len as u64 - 1) / PAGE_SIZE) as usize;
+    let bitmap = ballooned();
+    if (first..=last).any(|page| bitmap[page / 64].load(Ordering::Acquire) & (1 << (page % 64)) != 0) {
+        report(Violation::Ballooned, guest_addr, len);
+    }
+}
+
+/// Reports a bad access with the backtrace of the caller.
+pub fn report(violation: Violation, guest_addr: u64, len: usize) {
+    if !enabled() {
+        return;
+    }
+
+    let n = NUM_REPORTS.fetch_add(1, Ordering::Relaxed);
+    if n >= MAX_REPORTS {
+        return;
+    }
+
+    error!("memcheck", "{:?}: {} bytes at {:#x} (hart {})", violation, len, guest_addr, smp::current_hart_id());
+    print_backtrace();
+    if n + 1 == MAX_REPORTS {
+        error!("memcheck", "too many errors: not reporting any more");
+    }
+}
+
+/// Walks the frame pointers: in each frame, the return address is at fp - 8
+/// and the caller's fp at fp - 16.
+fn print_backtrace() {
+    let mut fp: u64;
+    unsafe { asm!("mv {}, s0", out(reg) fp) };
+
+    for depth in 0..MAX_FRAMES {
+        if fp == 0 || fp % 8 != 0 {
+            break;
+        }
+
+        let (ra, prev_fp) = unsafe { (*((fp - 8) as *const u64), *((fp - 16) as *const u64)) };
+        error!("memcheck", "  #{:<2} {:#x}", depth, ra);
+        // The stack grows down: the caller's frame is above ours.
+        if prev_fp <= fp {
+            break;
+        }
+
+        fp = prev_fp;
+    }
+}
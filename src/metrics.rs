@@ -0,0 +1,310 @@
+//! `-metrics`: counters in the Prometheus text format, served over HTTP on
+//! the "metrics" port of the host virtio console. We don't have a TCP/IP
+//! stack: let socat listen on the host (see run.sh):
+//!
+//! ```text
+//! $ socat TCP-LISTEN:9090,fork,reuseaddr UNIX-CONNECT:metrics.sock
+//! $ curl http://localhost:9090/metrics
+//! hypervisor_vm_exits_total{vcpu="0",reason="load guest-page fault"} 1834
+//! ```
+use alloc::{collections::BTreeMap, format, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    config::config,
+    guest_memory::GUEST_MEMORY,
+    host_console,
+    smp::{self, MAX_VCPUS},
+    timer::TIMEBASE_FREQ,
+    trace,
+};
+
+/// `-device virtserialport,name=metrics` in run.sh.
+const PORT: &str = "metrics";
+
+#[derive(Clone, Copy, Default)]
+struct VCpuStats {
+    /// Time in the guest, in ticks.
+    guest_ticks: u64,
+    /// Time handling VM exits, in ticks.
+    exit_ticks: u64,
+    /// When the vCPU entered the guest last time. 0 if not yet.
+    entered_at: u64,
+    timer_interrupts: u64,
+    software_interrupts: u64,
+}
+
+struct Metrics {
+    vcpus: [VCpuStats; MAX_VCPUS],
+    /// Keyed by (vCPU, reason).
+    exits: BTreeMap<(u64, &'static str), u64>,
+    /// Keyed by the device name: (reads, writes).
+    mmio: BTreeMap<&'static str, (u64, u64)>,
+    /// Keyed by the PLIC source.
+    external_interrupts: BTreeMap<u32, u64>,
+    /// Keyed by the kind (see inst_emulation).
+    emulated_instructions: BTreeMap<&'static str, u64>,
+    /// Sent and suppressed by the driver.
+    virtio_interrupts: (u64, u64),
+    disk_read_bytes: u64,
+    disk_written_bytes: u64,
+    net_rx_bytes: u64,
+    net_tx_bytes: u64,
+    /// Received bytes of the HTTP request.
+    request: Vec<u8>,
+    connected: bool,
+}
+
+static METRICS: Mutex<Metrics> = Mutex::new(Metrics {
+    vcpus: [VCpuStats {
+        guest_ticks: 0,
+        exit_ticks: 0,
+        entered_at: 0,
+        timer_interrupts: 0,
+        software_interrupts: 0,
+    }; MAX_VCPUS],
+    exits: BTreeMap::new(),
+    mmio: BTreeMap::new(),
+    external_interrupts: BTreeMap::new(),
+    emulated_instructions: BTreeMap::new(),
+    virtio_interrupts: (0, 0),
+    disk_read_bytes: 0,
+    disk_written_bytes: 0,
+    net_rx_bytes: 0,
+    net_tx_bytes: 0,
+    request: Vec::new(),
+    connected: false,
+});
+
+pub fn init() {
+    assert!(host_console::has_port(PORT), "[metrics] virtio-console port \"{}\" not found", PORT);
+    info!("metrics", "ready: connect to metrics.sock");
+}
+
+/// Records a VM exit which happened at `start`. Call this right before
+/// returning to the guest.
+pub fn record_exit(vcpu_id: u64, reason: &'static str, start: u64) {
+    if !config().metrics {
+        return;
+    }
+
+    let now = trace::now();
+    let mut metrics = METRICS.lock();
+    let vcpu = &mut metrics.vcpus[vcpu_id as usize];
+    if vcpu.entered_at != 0 {
+        vcpu.guest_ticks += start - vcpu.entered_at;
+    }
+    vcpu.exit_ticks += now - start;
+    vcpu.entered_at = now;
+    *metrics.exits.entry((vcpu_id, reason)).or_default() += 1;
+}
+
+pub fn record_mmio(device: &'static str, is_write: bool) {
+    if !config().metrics {
+        return;
+    }
+
+    let mut metrics = METRICS.lock();
+    let (reads, writes) = metrics.mmio.entry(device).or_default();
+    if is_write {
+        *writes += 1;
+    } else {
+        *reads += 1;
+    }
+}
+
+/// A device has asserted its interrupt line.
+pub fn record_external_interrupt(irq: u32) {
+    if config().metrics {
+        *METRICS.lock().external_interrupts.entry(irq).or_default() += 1;
+    }
+}
+
+/// An instruction has been emulated, or has got an exception instead.
+pub fn record_emulated_instruction(kind: &'static str) {
+    if config().metrics {
+        *METRICS.lock().emulated_instructions.entry(kind).or_default() += 1;
+    }
+}
+
+/// A virtio device has used buffers: `sent` is false if the driver has
+/// suppressed the interrupt.
+pub fn record_virtio_interrupt(sent: bool) {
+    if !config().metrics {
+        return;
+    }
+
+    let mut metrics = METRICS.lock();
+    if sent {
+        metrics.virtio_interrupts.0 += 1;
+    } else {
+        metrics.virtio_interrupts.1 += 1;
+    }
+}
+
+pub fn record_timer_interrupt(vcpu_id: u64) {
+    if config().metrics {
+        METRICS.lock().vcpus[vcpu_id as usize].timer_interrupts += 1;
+    }
+}
+
+pub fn record_software_interrupt(vcpu_id: u64) {
+    if config().metrics {
+        METRICS.lock().vcpus[vcpu_id as usize].software_interrupts += 1;
+    }
+}
+
+pub fn record_disk_io(is_write: bool, bytes: u64) {
+    if !config().metrics {
+        return;
+    }
+
+    let mut metrics = METRICS.lock();
+    if is_write {
+        metrics.disk_written_bytes += bytes;
+    } else {
+        metrics.disk_read_bytes += bytes;
+    }
+}
+
+pub fn record_net_io(is_tx: bool, bytes: u64) {
+    if !config().metrics {
+        return;
+    }
+
+    let mut metrics = METRICS.lock();
+    if is_tx {
+        metrics.net_tx_bytes += bytes;
+    } else {
+        metrics.net_rx_bytes += bytes;
+    }
+}
+
+fn seconds(ticks: u64) -> String {
+    format!("{}.{:07}", ticks / TIMEBASE_FREQ, ticks % TIMEBASE_FREQ)
+}
+
+impl Metrics {
+    /// Returns the metrics in the Prometheus text format.
+    fn render(&self) -> String {
+        let mut out = String::new();
+        let mut metric = |name: &str, help: &str, samples: Vec<(String, String)>| {
+            out.push_str(&format!("# HELP {} {}\n# TYPE {} counter\n", name, help, name));
+            for (labels, value) in samples {
+                out.push_str(&format!("{}{{{}}} {}\n", name, labels, value));
+            }
+        };
+
+        let vcpus = &self.vcpus[..smp::num_vcpus()];
+        let per_vcpu = |f: &dyn Fn(&VCpuStats) -> String| -> Vec<(String, String)> {
+            vcpus.iter().enumerate().map(|(id, vcpu)| (format!("vcpu=\"{}\"", id), f(vcpu))).collect()
+        };
+
+        metric(
+            "hypervisor_vm_exits_total",
+            "VM exits by reason.",
+            self.exits
+                .iter()
+                .map(|((vcpu, reason), count)| (format!("vcpu=\"{}\",reason=\"{}\"", vcpu, reason), format!("{}", count)))
+                .collect(),
+        );
+        metric("hypervisor_guest_seconds_total", "Time spent in the guest.", per_vcpu(&|vcpu| seconds(vcpu.guest_ticks)));
+        metric("hypervisor_exit_seconds_total", "Time spent handling VM exits.", per_vcpu(&|vcpu| seconds(vcpu.exit_ticks)));
+        metric(
+            "hypervisor_mmio_accesses_total",
+            "MMIO accesses by device.",
+            self.mmio
+                .iter()
+                .flat_map(|(device, (reads, writes))| {
+                    [
+                        (format!("device=\"{}\",op=\"read\"", device), format!("{}", reads)),
+                        (format!("device=\"{}\",op=\"write\"", device), format!("{}", writes)),
+                    ]
+                })
+                .collect(),
+        );
+        metric(
+            "hypervisor_external_interrupts_total",
+            "Interrupts asserted by devices, by PLIC source.",
+            self.external_interrupts.iter().map(|(irq, count)| (format!("irq=\"{}\"", irq), format!("{}", count))).collect(),
+        );
+        metric(
+            "hypervisor_emulated_instructions_total",
+            "Instructions emulated on virtual instruction exceptions, by kind.",
+            self.emulated_instructions.iter().map(|(kind, count)| (format!("kind=\"{}\"", kind), format!("{}", count))).collect(),
+        );
+        metric(
+            "hypervisor_virtio_interrupts_total",
+            "Used buffer notifications of virtio devices, sent or suppressed by the driver.",
+            samples([("result=\"sent\"", self.virtio_interrupts.0), ("result=\"suppressed\"", self.virtio_interrupts.1)]),
+        );
+        metric(
+            "hypervisor_timer_interrupts_total",
+            "Timer interrupts injected.",
+            per_vcpu(&|vcpu| format!("{}", vcpu.timer_interrupts)),
+        );
+        metric(
+            "hypervisor_software_interrupts_total",
+            "Software interrupts (IPIs) injected.",
+            per_vcpu(&|vcpu| format!("{}", vcpu.software_interrupts)),
+        );
+        metric(
+            "hypervisor_disk_bytes_total",
+            "Bytes read from and written to the disk.",
+            samples([("op=\"read\"", self.disk_read_bytes), ("op=\"write\"", self.disk_written_bytes)]),
+        );
+        metric(
+            "hypervisor_populated_pages_total",
+            "Pages (4KB) of the guest RAM mapped on the first access, or on boot with -prealloc.",
+            samples([("", GUEST_MEMORY.populated_pages() as u64)]),
+        );
+        metric(
+            "hypervisor_net_bytes_total",
+            "Bytes received and transmitted by the NIC.",
+            samples([("direction=\"rx\"", self.net_rx_bytes), ("direction=\"tx\"", self.net_tx_bytes)]),
+        );
+        out
+    }
+
+    /// Replies to an HTTP request once it has been received.
+    fn poll(&mut self) {
+        let connected = host_console::is_connected(PORT);
+        if connected && !self.connected {
+            self.request.clear();
+        }
+        self.connected = connected;
+
+        while let Some(byte) = host_console::read(PORT) {
+            self.request.push(byte);
+        }
+
+        let Some(end) = self.request.windows(4).position(|window| window == b"\r\n\r\n") else {
+            return;
+        };
+
+        let is_metrics = self.request.starts_with(b"GET /metrics ") || self.request.starts_with(b"GET / ");
+        self.request.drain(..end + 4);
+        let (status, body) = if is_metrics {
+            ("200 OK", self.render())
+        } else {
+            ("404 Not Found", String::from("not found: try /metrics\n"))
+        };
+
+        let response = format!(
+            "HTTP/1.1 {}\r\nContent-Type: text/plain; version=0.0.4\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+            status,
+            body.len(),
+            body
+        );
+        host_console::write(PORT, response.as_bytes());
+    }
+}
+
+fn samples<const N: usize>(samples: [(&str, u64); N]) -> Vec<(String, String)> {
+    samples.iter().map(|(labels, value)| (String::from(*labels), format!("{}", value))).collect()
+}
+
+/// Handles data from the HTTP client.
+pub fn handle_interrupt() {
+    METRICS.lock().poll();
+}
@@ -0,0 +1,433 @@
+//! Pre-copy live migration: `migrate` in the monitor sends the running VM to
+//! another hypervisor started with `-incoming`, through the "migration" port
+//! of the host console on both sides. The ports are UNIX sockets: connect
+//! them over TCP with socat (see run.sh).
+//!
+//! The guest keeps running while its memory is sent. Each page is
+//! write-protected in the guest page table before it's sent, and the store
+//! guest-page fault marks it dirty again (the devices mark what they write
+//! by themselves, see GuestMemory::mark_dirty). Dirty pages are sent again
+//! in the next round, until few of them are left. Then the VM is paused for
+//! the last round: the remaining pages, and the vCPU and device state.
+//!
+//! ```text
+//! header    | magic, version, memory size
+//! PAGE      | guest address, 4KB data
+//! ZERO_PAGE | guest address
+//! STATE     | size, sections (by snapshot::save_state)
+//! ```
+use alloc::{format, string::String, vec};
+use core::{
+    arch::asm,
+    sync::atomic::{AtomicU8, AtomicU32, AtomicU64, Ordering},
+};
+use spin::Mutex;
+
+use crate::{
+    config::config,
+    crash,
+    guest_memory::GUEST_MEMORY,
+    guest_page_table::GuestPageTable,
+    host_console, hotplug,
+    monitor, smp, snapshot,
+    timer::{self, NO_DEADLINE, TIMEBASE_FREQ},
+    vcpu::VCpu,
+    virtio_mem,
+};
+
+/// `-device virtserialport,name=migration` in run.sh.
+const PORT: &str = "migration";
+const MAGIC: &[u8; 8] = b"HVMIGRAT";
+const FORMAT_VERSION: u32 = 1;
+const HEADER_SIZE: usize = 24;
+const PAGE: u8 = 1;
+const ZERO_PAGE: u8 = 2;
+const STATE: u8 = 3;
+const PAGE_SIZE: u64 = 4096;
+/// How often the vCPU running the migration stops to send pages.
+const INTERVAL: u64 = TIMEBASE_FREQ / 1000;
+/// The number of pages sent at a time.
+const BATCH_PAGES: usize = 256;
+/// Pause the VM once a round ends with this many dirty pages or fewer (4MB).
+const MAX_DOWNTIME_PAGES: usize = 1024;
+/// Pause the VM after this many rounds even if it doesn't converge.
+const MAX_ROUNDS: u32 = 30;
+
+const STATUS_NONE: u8 = 0;
+const STATUS_ACTIVE: u8 = 1;
+const STATUS_COMPLETED: u8 = 2;
+const STATUS_FAILED: u8 = 3;
+
+static STATUS: AtomicU8 = AtomicU8::new(STATUS_NONE);
+/// The vCPU sending the pages: only one does it.
+static VCPU_ID: AtomicU64 = AtomicU64::new(0);
+/// When to send the next batch, in host time.
+static NEXT_BATCH: AtomicU64 = AtomicU64::new(NO_DEADLINE);
+/// The next page to look at in this round.
+static CURSOR: AtomicU64 = AtomicU64::new(0);
+static ROUND: AtomicU32 = AtomicU32::new(0);
+static PAGES_SENT: AtomicU64 = AtomicU64::new(0);
+/// Serializes write-protecting pages and the fault handler.
+static DIRTY_LOCK: Mutex<()> = Mutex::new(());
+
+fn status_str(status: u8) -> &'static str {
+    match status {
+        STATUS_ACTIVE => "active",
+        STATUS_COMPLETED => "completed",
+        STATUS_FAILED => "failed",
+        _ => "none",
+    }
+}
+
+fn set_status(status: u8) {
+    STATUS.store(status, Ordering::Release);
+    monitor::event("MIGRATION", &format!("{{\"status\": \"{}\"}}", status_str(status)));
+}
+
+fn send_page(guest_addr: u64) {
+    let data = unsafe { core::slice::from_raw_parts(GUEST_MEMORY.host_addr(guest_addr), PAGE_SIZE as usize) };
+    let is_zero = data.iter().all(|&byte| byte == 0);
+
+    let mut header = [0; 9];
+    header[0] = if is_zero { ZERO_PAGE } else { PAGE };
+    header[1..].copy_from_slice(&guest_addr.to_le_bytes());
+    host_console::write(PORT, &header);
+    if !is_zero {
+        host_console::write(PORT, data);
+    }
+
+    PAGES_SENT.fetch_add(1, Ordering::Relaxed);
+}
+
+/// `migrate` in the monitor. The pages are sent from timer interrupts on
+/// this vCPU.
+pub fn start(vcpu: &VCpu) -> Result<(), String> {
+    if !host_console::is_connected(PORT) {
+        return Err(String::from("migration.sock is not connected to the destination"));
+    }
+
+    if !hotplug::is_empty() {
+        return Err(String::from("hotplugged devices are not supported: use device_del first"));
+    }
+
+    if virtio_mem::plugged_size() != 0 {
+        return Err(String::from("plugged virtio-mem memory is not supported: mem-resize 0 first"));
+    }
+
+    // The nested guest writes through the shadow table, which is not
+    // write-protected for the dirty log.
+    if config().nested {
+        return Err(String::from("-nested is not supported"));
+    }
+
+    let status = STATUS.load(Ordering::Acquire);
+    if status == STATUS_ACTIVE || status == STATUS_COMPLETED {
+        return Err(format!("the migration has already been {}", status_str(status)));
+    }
+
+    let mut header = [0; HEADER_SIZE];
+    header[..8].copy_from_slice(MAGIC);
+    header[8..12].copy_from_slice(&FORMAT_VERSION.to_le_bytes());
+    // 12..16 is reserved.
+    header[16..24].copy_from_slice(&(GUEST_MEMORY.size() as u64).to_le_bytes());
+    host_console::write(PORT, &header);
+
+    // All pages are dirty at first.
+    snapshot::forget_parent();
+    GUEST_MEMORY.start_dirty_log();
+    CURSOR.store(GUEST_MEMORY.guest_base(), Ordering::Relaxed);
+    ROUND.store(1, Ordering::Relaxed);
+    PAGES_SENT.store(0, Ordering::Relaxed);
+    VCPU_ID.store(vcpu.hart_id, Ordering::Relaxed);
+    NEXT_BATCH.store(timer::now(), Ordering::Release);
+    info!("migration", "sending {} KB of memory", GUEST_MEMORY.size() / 1024);
+    set_status(STATUS_ACTIVE);
+    timer::rearm(vcpu);
+    Ok(())
+}
+
+/// `query-migrate` in the monitor.
+pub fn query() -> String {
+    let status = STATUS.load(Ordering::Acquire);
+    if status == STATUS_NONE {
+        return String::from("{}");
+    }
+
+    let remaining = if status == STATUS_ACTIVE { GUEST_MEMORY.count_dirty() as u64 * PAGE_SIZE } else { 0 };
+    format!(
+        "{{\"status\": \"{}\", \"ram\": {{\"transferred\": {}, \"remaining\": {}, \"total\": {}, \"dirty-sync-count\": {}}}}}",
+        status_str(status),
+        PAGES_SENT.load(Ordering::Relaxed) * PAGE_SIZE,
+        remaining,
+        GUEST_MEMORY.size(),
+        ROUND.load(Ordering::Relaxed)
+    )
+}
+
+/// Whether pages are being sent: the dirty log is in use.
+pub fn is_active() -> bool {
+    STATUS.load(Ordering::Acquire) == STATUS_ACTIVE
+}
+
+/// When the vCPU should stop to send pages.
+pub fn deadline(vcpu_id: u64) -> u64 {
+    if VCPU_ID.load(Ordering::Relaxed) != vcpu_id {
+        return NO_DEADLINE;
+    }
+
+    NEXT_BATCH.load(Ordering::Acquire)
+}
+
+/// Sends the next batch of dirty pages. Returns true at the end of a round.
+fn send_batch(vcpu: &VCpu) -> bool {
+    let end = GUEST_MEMORY.guest_base() + GUEST_MEMORY.size() as u64;
+    let mut table = GuestPageTable::from_hgatp(vcpu.hgatp);
+    let mut pages = [0; BATCH_PAGES];
+    let mut num_pages = 0;
+    let mut cursor = CURSOR.load(Ordering::Relaxed);
+    {
+        let _lock = DIRTY_LOCK.lock();
+        while num_pages < BATCH_PAGES && cursor < end {
+            if GUEST_MEMORY.take_dirty(cursor) {
+                table.set_writable(cursor, false);
+                pages[num_pages] = cursor;
+                num_pages += 1;
+            }
+
+            cursor += PAGE_SIZE;
+        }
+    }
+
+    // Writes after the flush fault and mark the page dirty again.
+    smp::flush_guest_tlbs();
+    for &guest_addr in &pages[..num_pages] {
+        send_page(guest_addr);
+    }
+
+    CURSOR.store(cursor, Ordering::Relaxed);
+    cursor == end
+}
+
+/// Clears the dirty log and write-protects the guest RAM as `send_batch`
+/// does, so that the pages written from now on are dirty: for an incremental
+/// snapshot. All vCPUs except `vcpu` must be paused.
+pub fn track_dirty_pages(vcpu: &VCpu) {
+    GUEST_MEMORY.start_dirty_log();
+    let mut table = GuestPageTable::from_hgatp(vcpu.hgatp);
+    {
+        let _lock = DIRTY_LOCK.lock();
+        let mut guest_addr = GUEST_MEMORY.guest_base();
+        while GUEST_MEMORY.contains(guest_addr) {
+            GUEST_MEMORY.take_dirty(guest_addr);
+            table.set_writable(guest_addr, false);
+            guest_addr += PAGE_SIZE;
+        }
+    }
+
+    smp::flush_guest_tlbs();
+}
+
+/// The last round: pauses the VM and sends the rest.
+fn complete(vcpu: &mut VCpu) -> Result<(), String> {
+    let paused_at = timer::now();
+    smp::pause_others(vcpu);
+    let state = match snapshot::save_state(vcpu) {
+        Ok(state) => state,
+        Err(err) => {
+            smp::resume_others();
+            return Err(err);
+        }
+    };
+
+    // Including the pages written by the devices until save_state.
+    let mut guest_addr = GUEST_MEMORY.guest_base();
+    while GUEST_MEMORY.contains(guest_addr) {
+        if GUEST_MEMORY.take_dirty(guest_addr) {
+            send_page(guest_addr);
+        }
+
+        guest_addr += PAGE_SIZE;
+    }
+
+    let mut header = [0; 9];
+    header[0] = STATE;
+    header[1..].copy_from_slice(&(state.len() as u64).to_le_bytes());
+    host_console::write(PORT, &header);
+    host_console::write(PORT, &state);
+    GUEST_MEMORY.stop_dirty_log();
+    info!(
+        "migration",
+        "completed in {} rounds ({} KB sent, downtime {} ms)",
+        ROUND.load(Ordering::Relaxed),
+        PAGES_SENT.load(Ordering::Relaxed) * PAGE_SIZE / 1024,
+        (timer::now() - paused_at) / (TIMEBASE_FREQ / 1000)
+    );
+    Ok(())
+}
+
+fn fail(err: &str) {
+    error!("migration", "failed: {}", err);
+    GUEST_MEMORY.stop_dirty_log();
+    NEXT_BATCH.store(NO_DEADLINE, Ordering::Release);
+    set_status(STATUS_FAILED);
+}
+
+/// Sends the next batch if it's time. Called from the timer interrupt.
+pub fn poll(vcpu: &mut VCpu) {
+    if STATUS.load(Ordering::Acquire) != STATUS_ACTIVE || timer::now() < deadline(vcpu.hart_id) {
+        return;
+    }
+
+    if !host_console::is_connected(PORT) {
+        fail("the destination has disconnected");
+        return;
+    }
+
+    if !send_batch(vcpu) {
+        NEXT_BATCH.store(timer::now() + INTERVAL, Ordering::Release);
+        return;
+    }
+
+    let dirty = GUEST_MEMORY.count_dirty();
+    let round = ROUND.load(Ordering::Relaxed);
+    if dirty > MAX_DOWNTIME_PAGES && round < MAX_ROUNDS {
+        debug!("migration", "round {}: {} pages dirty", round, dirty);
+        ROUND.store(round + 1, Ordering::Relaxed);
+        CURSOR.store(GUEST_MEMORY.guest_base(), Ordering::Relaxed);
+        NEXT_BATCH.store(timer::now() + INTERVAL, Ordering::Release);
+        return;
+    }
+
+    NEXT_BATCH.store(NO_DEADLINE, Ordering::Release);
+    if let Err(err) = complete(vcpu) {
+        fail(&err);
+        return;
+    }
+
+    // The VM is now running on the destination.
+    set_status(STATUS_COMPLETED);
+    crash::park(vcpu);
+}
+
+/// Handles a store guest-page fault on a page write-protected by
+/// `send_batch` or `track_dirty_pages`. Returns false if it's not in the
+/// guest RAM (e.g. MMIO).
+pub fn handle_write_fault(vcpu: &VCpu, guest_addr: u64) -> bool {
+    if !GUEST_MEMORY.contains(guest_addr) {
+        return false;
+    }
+
+    let _lock = DIRTY_LOCK.lock();
+    let Some(page_size) = GuestPageTable::from_hgatp(vcpu.hgatp).set_writable(guest_addr, true) else {
+        return false;
+    };
+
+    // Dirty logging might have stopped: the page stays writable anyway.
+    GUEST_MEMORY.mark_dirty(guest_addr & !(page_size - 1), page_size as usize);
+    // This hart might still have the read-only mapping.
+    unsafe {
+        asm!(".option push", ".option arch, +h", "hfence.gvma", ".option pop");
+    }
+    true
+}
+
+/// Reads exactly `buf.len()` bytes from the source.
+fn recv(buf: &mut [u8]) -> Result<(), String> {
+    let mut filled = 0;
+    while filled < buf.len() {
+        let len = host_console::read_bytes(PORT, &mut buf[filled..]);
+        if len == 0 && !host_console::is_connected(PORT) {
+            return Err(String::from("the source has disconnected"));
+        }
+
+        filled += len;
+    }
+    Ok(())
+}
+
+fn recv_u64() -> Result<u64, String> {
+    let mut bytes = [0; 8];
+    recv(&mut bytes)?;
+    Ok(u64::from_le_bytes(bytes))
+}
+
+fn recv_page_addr() -> Result<u64, String> {
+    let guest_addr = recv_u64()?;
+    if guest_addr % PAGE_SIZE != 0 || !GUEST_MEMORY.contains_range(guest_addr, PAGE_SIZE as usize) {
+        return Err(format!("invalid page address {:#x}", guest_addr));
+    }
+    Ok(guest_addr)
+}
+
+fn receive(vcpu: &mut VCpu) -> Result<(), String> {
+    let mut header = [0; HEADER_SIZE];
+    recv(&mut header)?;
+    if &header[..MAGIC.len()] != MAGIC {
+        return Err(String::from("not a migration stream"));
+    }
+
+    let version = u32::from_le_bytes(header[8..12].try_into().unwrap());
+    let memory_size = u64::from_le_bytes(header[16..24].try_into().unwrap()) as usize;
+    if version != FORMAT_VERSION {
+        return Err(format!("unsupported version {}", version));
+    }
+
+    if memory_size != GUEST_MEMORY.size() {
+        return Err(format!("memory size mismatch ({} KB in the source)", memory_size / 1024));
+    }
+
+    let mut page = [0; PAGE_SIZE as usize];
+    let mut num_pages = 0;
+    loop {
+        let mut type_ = [0];
+        recv(&mut type_)?;
+        match type_[0] {
+            PAGE => {
+                let guest_addr = recv_page_addr()?;
+                recv(&mut page)?;
+                GUEST_MEMORY.write_at(guest_addr, &page).unwrap();
+                num_pages += 1;
+            }
+            ZERO_PAGE => {
+                let guest_addr = recv_page_addr()?;
+                GUEST_MEMORY.write_at(guest_addr, &[0; PAGE_SIZE as usize]).unwrap();
+                num_pages += 1;
+            }
+            STATE => break,
+            other => return Err(format!("unknown record type {}", other)),
+        }
+    }
+
+    let mut state = vec![0; recv_u64()? as usize];
+    recv(&mut state)?;
+    let sections = snapshot::parse_state(&state)?;
+    snapshot::check_vcpus(vcpu, &sections)?;
+    snapshot::load_state(vcpu, &sections)?;
+    // Others enter the guest if they were running in the source.
+    for hart_id in (0..smp::num_vcpus() as u64).filter(|&hart_id| hart_id != vcpu.hart_id) {
+        let name = format!("vcpu{}", hart_id);
+        smp::set_started(hart_id, sections.iter().any(|(n, _, _)| *n == name));
+    }
+
+    info!("migration", "received {} pages", num_pages);
+    Ok(())
+}
+
+/// `-incoming`: waits for the VM from the source, and restores it into the
+/// boot vCPU and the others.
+pub fn incoming(vcpu: &mut VCpu) {
+    assert!(host_console::has_port(PORT), "[migration] virtio-console port \"{}\" not found", PORT);
+    info!("migration", "waiting for the source on migration.sock");
+    while !host_console::is_connected(PORT) {
+        core::hint::spin_loop();
+    }
+
+    // The other vCPUs are restored while paused.
+    smp::pause_all_others(vcpu);
+    if let Err(err) = receive(vcpu) {
+        panic!("[migration] failed to receive the VM: {}", err);
+    }
+
+    set_status(STATUS_COMPLETED);
+    smp::resume_others();
+}
@@ -0,0 +1,81 @@
+//! The guest MMIO bus: devices register their address ranges, and MMIO
+//! exits are dispatched to the device at the faulting address.
+use alloc::vec::Vec;
+use spin::RwLock;
+
+use crate::{metrics, profile};
+
+/// Handles a read at an offset from the base: (offset, width) -> value.
+pub type ReadFn = fn(u64, u64) -> u64;
+/// Handles a write at an offset from the base: (offset, value, width).
+pub type WriteFn = fn(u64, u64, u64);
+
+#[derive(Clone, Copy)]
+pub struct MmioRegion {
+    pub name: &'static str,
+    pub base: u64,
+    pub end: u64,
+    read: ReadFn,
+    write: WriteFn,
+}
+
+/// Sorted by the base address, without overlaps.
+static REGIONS: RwLock<Vec<MmioRegion>> = RwLock::new(Vec::new());
+
+/// Adds a device at `[base, end)`.
+pub fn register(name: &'static str, base: u64, end: u64, read: ReadFn, write: WriteFn) {
+    assert!(base < end, "[mmio] {}: empty range {:#x}-{:#x}", name, base, end);
+    let mut regions = REGIONS.write();
+    let index = regions.partition_point(|region| region.base < base);
+    let overlaps_prev = index > 0 && regions[index - 1].end > base;
+    let overlaps_next = index < regions.len() && regions[index].base < end;
+    if overlaps_prev || overlaps_next {
+        let other = regions[if overlaps_prev { index - 1 } else { index }];
+        panic!("[mmio] {} at {:#x}-{:#x} overlaps {} at {:#x}-{:#x}", name, base, end, other.name, other.base, other.end);
+    }
+
+    regions.insert(index, MmioRegion { name, base, end, read, write });
+}
+
+/// Removes the device at `base`. Returns false if there's none.
+pub fn unregister(base: u64) -> bool {
+    let mut regions = REGIONS.write();
+    match regions.binary_search_by_key(&base, |region| region.base) {
+        Ok(index) => {
+            regions.remove(index);
+            true
+        }
+        Err(_) => false,
+    }
+}
+
+/// All devices, sorted by the base address.
+pub fn regions() -> Vec<MmioRegion> {
+    REGIONS.read().clone()
+}
+
+/// Returns the device at a guest physical address.
+pub fn find(guest_addr: u64) -> Option<MmioRegion> {
+    let regions = REGIONS.read();
+    let index = regions.partition_point(|region| region.base <= guest_addr).checked_sub(1)?;
+    let region = regions[index];
+    (guest_addr < region.end).then_some(region)
+}
+
+/// Returns None if no device is at the address.
+pub fn read(guest_addr: u64, width: u64) -> Option<u64> {
+    // Don't hold the lock while the device handles the access.
+    let region = find(guest_addr)?;
+    metrics::record_mmio(region.name, false);
+    profile::set_device(region.name);
+    Some((region.read)(guest_addr - region.base, width))
+}
+
+/// Returns None if no device is at the address.
+pub fn write(guest_addr: u64, value: u64, width: u64) -> Option<()> {
+    let region = find(guest_addr)?;
+    metrics::record_mmio(region.name, true);
+    profile::set_device(region.name);
+    (region.write)(guest_addr - region.base, value, width);
+    Some(())
+}
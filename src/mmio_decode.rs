@@ -0,0 +1,99 @@
+//! Decodes load/store instructions which have caused guest-page faults, to
+//! emulate MMIO accesses.
+use crate::{page_walk, vcpu::VCpu};
+
+pub struct MmioAccess {
+    pub is_write: bool,
+    /// The access width in bytes.
+    pub width: u64,
+    /// Whether the loaded value is sign-extended (lb, lh, lw).
+    pub signed: bool,
+    /// rd for loads, rs2 for stores.
+    pub reg: u64,
+    /// The instruction length in bytes.
+    pub inst_len: u64,
+}
+
+/// Decodes a 32-bit load/store instruction.
+fn decode_standard(inst: u32, inst_len: u64) -> Option<MmioAccess> {
+    let funct3 = (inst >> 12) & 0x7;
+    let rd = ((inst >> 7) & 0x1f) as u64;
+    let rs2 = ((inst >> 20) & 0x1f) as u64;
+    let (is_write, width, signed, reg) = match (inst & 0x7f, funct3) {
+        (0x03, 0x0) => (false, 1, true, rd),  // lb
+        (0x03, 0x1) => (false, 2, true, rd),  // lh
+        (0x03, 0x2) => (false, 4, true, rd),  // lw
+        (0x03, 0x3) => (false, 8, false, rd), // ld
+        (0x03, 0x4) => (false, 1, false, rd), // lbu
+        (0x03, 0x5) => (false, 2, false, rd), // lhu
+        (0x03, 0x6) => (false, 4, false, rd), // lwu
+        (0x23, 0x0) => (true, 1, false, rs2), // sb
+        (0x23, 0x1) => (true, 2, false, rs2), // sh
+        (0x23, 0x2) => (true, 4, false, rs2), // sw
+        (0x23, 0x3) => (true, 8, false, rs2), // sd
+        _ => return None,
+    };
+
+    Some(MmioAccess { is_write, width, signed, reg, inst_len })
+}
+
+/// Decodes a compressed load/store instruction.
+fn decode_compressed(inst: u16) -> Option<MmioAccess> {
+    let inst = inst as u64;
+    // rd' and rs2' in C.LW, C.SW, ... are x8-x15.
+    let rd_prime = 8 + ((inst >> 2) & 0x7);
+    let rd = (inst >> 7) & 0x1f;
+    let rs2 = (inst >> 2) & 0x1f;
+    let (is_write, width, signed, reg) = match (inst & 0b11, inst >> 13) {
+        (0b00, 0b010) => (false, 4, true, rd_prime), // c.lw
+        (0b00, 0b011) => (false, 8, false, rd_prime), // c.ld
+        (0b00, 0b110) => (true, 4, false, rd_prime), // c.sw
+        (0b00, 0b111) => (true, 8, false, rd_prime), // c.sd
+        (0b10, 0b010) if rd != 0 => (false, 4, true, rd), // c.lwsp
+        (0b10, 0b011) if rd != 0 => (false, 8, false, rd), // c.ldsp
+        (0b10, 0b110) => (true, 4, false, rs2), // c.swsp
+        (0b10, 0b111) => (true, 8, false, rs2), // c.sdsp
+        _ => return None,
+    };
+
+    Some(MmioAccess { is_write, width, signed, reg, inst_len: 2 })
+}
+
+/// Decodes the faulting instruction. `htinst` has a transformed instruction
+/// if the hardware provides one, otherwise we read it from the guest memory.
+pub fn decode(vcpu: &VCpu, htinst: u64, sepc: u64) -> Option<MmioAccess> {
+    match htinst & 0b11 {
+        // A transformed standard instruction.
+        0b11 => return decode_standard(htinst as u32, 4),
+        // A transformed compressed instruction: bit 1 is cleared.
+        0b01 => return decode_standard(htinst as u32 | 0b10, 2),
+        // Zero or a pseudoinstruction: no information.
+        _ => {}
+    }
+
+    let mut bytes = [0; 4];
+    page_walk::read(vcpu, sepc, &mut bytes[..2])?;
+    let low = u16::from_le_bytes([bytes[0], bytes[1]]);
+    if low & 0b11 != 0b11 {
+        return decode_compressed(low);
+    }
+
+    page_walk::read(vcpu, sepc + 2, &mut bytes[2..])?;
+    decode_standard(u32::from_le_bytes(bytes), 4)
+}
+
+/// Sign-extends or zero-extends a loaded value.
+pub fn extend(access: &MmioAccess, value: u64) -> u64 {
+    if access.width == 8 {
+        return value;
+    }
+
+    let bits = 8 * access.width;
+    let value = value & ((1 << bits) - 1);
+    if access.signed {
+        let shift = 64 - bits;
+        (((value << shift) as i64) >> shift) as u64
+    } else {
+        value
+    }
+}
@@ -0,0 +1,769 @@
+//! A QMP-like control interface. Tools talk to us in JSON through the
+//! "monitor" port of the virtio console provided by QEMU (see run.sh):
+//!
+//! ```text
+//! $ socat - UNIX-CONNECT:monitor.sock
+//! {"QMP": {"version": {"package": "hypervisor"}, "capabilities": []}}
+//! {"execute": "query-status"}
+//! {"return": {"status": "running", "running": true}}
+//! ```
+//!
+//! Human-readable commands (`info registers`, `x/16x <gpa>`, etc.) are also
+//! available, at the console's prompt (Ctrl-A c) and in
+//! `human-monitor-command`, on top of the same commands.
+use alloc::{format, string::String, vec::Vec};
+use core::arch::asm;
+use spin::Mutex;
+
+use crate::{
+    boot_time,
+    config::{self, config},
+    console_log, core_dump, fault_inject, fault_stats,
+    guest_memory::{FB_MEMORY, GUEST_MEMORY},
+    guest_page_table::{GuestPageTable, Leaf, perms_str},
+    host_console, host_uart, hotplug, identity,
+    json::{self, Json, quote},
+    measured_boot, migration, mmio_bus, page_walk, reserved_mem, sbi, serial,
+    single_step::{Step, StepResult},
+    smp, symbols,
+    throttle::{Limits, MAX_RATE},
+    timer::{self, TIMEBASE_FREQ},
+    vcpu::VCpu,
+    virtio_balloon, virtio_blk, virtio_mem, virtio_net, vm,
+};
+
+/// `-device virtserialport,name=monitor` in run.sh.
+const PORT: &str = "monitor";
+/// x/<count>x reads up to this many words at once.
+const MAX_EXAMINE_WORDS: u64 = 1024;
+
+const HMP_HELP: &str = "\
+help                 show this help
+info status          show whether the VM is running
+info name            show the VM's name and identity (-name)
+info registers [N]   show the registers of this vCPU (or vCPU N while stopped)
+info mem             show the guest's virtual memory mappings
+info gmap            show the guest physical memory map and its stage-2 mappings
+info stage2 <gpa>    walk the stage-2 page table for a guest physical address
+info console [N]     show the last guest console output (or N lines)
+info boottime        show how long each phase of the boot took
+info throttle        show the I/O limits of virtio-blk and virtio-net
+info measurements    show the measured boot event log and PCRs
+info reserved-mem    show the regions carved out by -reserved-mem
+info memory-devices  show the memory plugged with virtio-mem
+info uart            show the ring of -async-console
+info faults          show the injected faults (-fault-inject)
+x/<count>x <gpa>     dump 32-bit words in guest physical memory
+stop                 stop the VM
+cont | c             resume the VM
+system_reset         reset the VM
+nmi [N]              force vCPU 0 (or N) into the guest kernel's trap handler
+cpu-add              add a vCPU (-smp <n>,maxcpus=<m>), started by the guest with SBI HSM
+mem-resize <size>    ask the guest to plug or unplug virtio-mem memory, e.g. mem-resize 512m
+clock_scale [F]      show or change the speed of the guest time (-clock-scale)
+throttle blk|net ... change the limits, e.g. throttle blk iops=100 bps=1048576
+fault <fault>=<v>... inject faults, e.g. fault blk-error=0.1 irq-delay=1000
+quit | q             quit";
+
+/// ABI names of x0-x31.
+const REG_NAMES: [&str; 32] = [
+    "zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2", "s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7",
+    "s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+];
+
+/// Takes a complete JSON object from the beginning of `buf`.
+fn take_object(buf: &mut Vec<u8>) -> Option<Vec<u8>> {
+    let Some(start) = buf.iter().position(|&b| b == b'{') else {
+        // Whitespace or garbage.
+        buf.clear();
+        return None;
+    };
+
+    let mut depth = 0;
+    let mut in_string = false;
+    let mut escaped = false;
+    for (i, &byte) in buf.iter().enumerate().skip(start) {
+        match (in_string, escaped, byte) {
+            (true, true, _) => escaped = false,
+            (true, false, b'\\') => escaped = true,
+            (true, false, b'"') => in_string = false,
+            (false, _, b'"') => in_string = true,
+            (false, _, b'{') => depth += 1,
+            (false, _, b'}') => {
+                depth -= 1;
+                if depth == 0 {
+                    let object = buf[start..=i].to_vec();
+                    buf.drain(..=i);
+                    return Some(object);
+                }
+            }
+            _ => {}
+        }
+    }
+
+    None
+}
+
+/// The current time in QMP's format.
+pub fn timestamp() -> String {
+    let time: u64;
+    unsafe {
+        asm!("csrr {}, time", out(reg) time);
+    }
+
+    let seconds = time / TIMEBASE_FREQ;
+    let microseconds = (time % TIMEBASE_FREQ) / (TIMEBASE_FREQ / 1_000_000);
+    format!("{{\"seconds\": {}, \"microseconds\": {}}}", seconds, microseconds)
+}
+
+/// Sends an asynchronous event, e.g. `event("SHUTDOWN", "{}")`. `data` is
+/// a JSON object.
+pub fn event(name: &str, data: &str) {
+    if !host_console::is_connected(PORT) {
+        return;
+    }
+
+    let message = format!("{{\"event\": {}, \"data\": {}, \"timestamp\": {}}}\r\n", quote(name), data, timestamp());
+    host_console::write(PORT, message.as_bytes());
+}
+
+struct Monitor {
+    /// Received bytes not parsed yet.
+    buf: Vec<u8>,
+    connected: bool,
+    /// Whether the VM is stopped by `stop`.
+    paused: bool,
+    /// The single step by `step` in progress.
+    step: Option<Step>,
+}
+
+static MONITOR: Mutex<Monitor> =
+    Mutex::new(Monitor { buf: Vec::new(), connected: false, paused: false, step: None });
+
+fn error(desc: &str) -> Result<String, String> {
+    Err(String::from(desc))
+}
+
+/// Parses a number in hex (with 0x) or decimal.
+fn parse_number(s: &str) -> Option<u64> {
+    match s.strip_prefix("0x") {
+        Some(hex) => u64::from_str_radix(hex, 16).ok(),
+        None => s.parse().ok(),
+    }
+}
+
+/// `info registers`.
+fn registers(vcpu: &VCpu) -> String {
+    let mut output = format!("CPU#{} pc={:016x}", vcpu.hart_id, vcpu.sepc);
+    if config().symbols.is_some() {
+        output.push_str(&format!(" {}", symbols::describe(vcpu.sepc)));
+    }
+    for (reg, name) in REG_NAMES.iter().enumerate() {
+        let separator = if reg % 4 == 0 { "\n" } else { " " };
+        output.push_str(&format!("{}{:<4} {:016x}", separator, name, vcpu.gpr(reg as u64)));
+    }
+
+    output
+}
+
+/// `info mem`.
+fn mappings(vcpu: &VCpu) -> String {
+    let Some(mappings) = page_walk::mappings(vcpu) else {
+        return String::from("paging is disabled");
+    };
+
+    let mut output = String::from("vaddr            paddr            size             attr");
+    for mapping in mappings {
+        let flags: String = mapping.flags_str().iter().collect();
+        let line = format!("\n{:016x} {:016x} {:016x} {}", mapping.vaddr, mapping.paddr, mapping.size, flags);
+        output.push_str(&line);
+    }
+
+    output
+}
+
+/// `info gmap`: the guest physical regions, and how the stage-2 page table
+/// of this vCPU maps them. MMIO regions are never mapped: accesses trap.
+fn gmap(vcpu: &VCpu) -> String {
+    // Contiguous pages with the same permissions.
+    let mut runs: Vec<Leaf> = Vec::new();
+    for leaf in GuestPageTable::from_hgatp(vcpu.hgatp).leaves() {
+        match runs.last_mut() {
+            Some(run)
+                if run.guest_paddr + run.size == leaf.guest_paddr
+                    && run.host_paddr + run.size == leaf.host_paddr
+                    && run.flags == leaf.flags =>
+            {
+                run.size += leaf.size
+            }
+            _ => runs.push(leaf),
+        }
+    }
+
+    // (start, end, permissions, backing)
+    let mut regions = Vec::new();
+    for run in &runs {
+        let backing = if GUEST_MEMORY.contains(run.guest_paddr) {
+            "ram"
+        } else if FB_MEMORY.contains(run.guest_paddr) {
+            "framebuffer"
+        } else {
+            "memory"
+        };
+
+        let perms: String = perms_str(run.flags).iter().collect();
+        let backing = format!("{} at host {:#x}", backing, run.host_paddr);
+        regions.push((run.guest_paddr, run.guest_paddr + run.size, perms, backing));
+    }
+
+    // The guest RAM is mapped on the first access.
+    let (ram_start, ram_end) = (GUEST_MEMORY.guest_base(), GUEST_MEMORY.guest_base() + GUEST_MEMORY.size() as u64);
+    let mut addr = ram_start;
+    for run in runs.iter().filter(|run| GUEST_MEMORY.contains(run.guest_paddr)) {
+        if addr < run.guest_paddr {
+            regions.push((addr, run.guest_paddr, String::from("---"), String::from("ram (not mapped yet)")));
+        }
+        addr = addr.max(run.guest_paddr + run.size);
+    }
+    if addr < ram_end {
+        regions.push((addr, ram_end, String::from("---"), String::from("ram (not mapped yet)")));
+    }
+
+    for region in mmio_bus::regions() {
+        regions.push((region.base, region.end, String::from("---"), format!("mmio {} (trapped)", region.name)));
+    }
+
+    regions.sort_by_key(|(start, _, _, _)| *start);
+    let mut output = String::from("gpa                               size             perm backing");
+    for (start, end, perms, backing) in regions {
+        output.push_str(&format!("\n{:016x}-{:016x} {:016x} {}  {}", start, end, end - start, perms, backing));
+    }
+
+    output
+}
+
+/// `info stage2 <gpa>`: the entries of this vCPU's stage-2 page table on the
+/// walk for `gpa`.
+fn stage2(vcpu: &VCpu, gpa: u64) -> String {
+    const PAGE_SIZES: [&str; 4] = ["4KB", "2MB", "1GB", "512GB"];
+
+    let table = GuestPageTable::from_hgatp(vcpu.hgatp);
+    let mode = match vcpu.hgatp >> 60 {
+        8 => "Sv39x4",
+        9 => "Sv48x4",
+        _ => "unknown mode",
+    };
+
+    let mut output = format!("hgatp {:#018x} ({}, root table at {:#x})", vcpu.hgatp, mode, table.root());
+    let mut host_paddr = None;
+    for step in table.walk(gpa) {
+        let desc = if !step.is_valid() {
+            String::from("invalid")
+        } else if step.is_leaf() {
+            let offset = gpa & ((4096 << (9 * step.level)) - 1);
+            host_paddr = Some(step.paddr() + offset);
+            let perms: String = perms_str(step.pte).iter().collect();
+            format!("{} page at {:#x} ({})", PAGE_SIZES[step.level], step.paddr(), perms)
+        } else {
+            format!("table at {:#x}", step.paddr())
+        };
+
+        output.push_str(&format!("\nL{} [{:3}] {:016x}  {}", step.level, step.index, step.pte, desc));
+    }
+
+    let result = match host_paddr {
+        Some(host_paddr) => format!("{:#x} -> host {:#x}", gpa, host_paddr),
+        None if GUEST_MEMORY.contains(gpa) => format!("{:#x} is not mapped: guest RAM, mapped on the first access", gpa),
+        None => match mmio_bus::find(gpa) {
+            Some(region) => format!("{:#x} is not mapped: {} (MMIO, accesses trap)", gpa, region.name),
+            None => format!("{:#x} is not mapped: no memory or device", gpa),
+        },
+    };
+    output.push('\n');
+    output.push_str(&result);
+    output
+}
+
+/// `x/<count>x <gpa>`: four words per line.
+/// The name of the ops limit, and the current limits of `device`.
+fn throttle_device(device: &str) -> Result<(&'static str, Limits), String> {
+    let (ops_name, throttle) = match device {
+        "blk" => ("iops", virtio_blk::throttle()),
+        "net" => ("pps", virtio_net::throttle()),
+        _ => return Err(format!("unknown device: {} (expected blk or net)", device)),
+    };
+
+    match throttle {
+        Some((limits, _)) => Ok((ops_name, limits)),
+        None => Err(format!("virtio-{} is not enabled", device)),
+    }
+}
+
+fn set_throttle(device: &str, limits: Limits) -> Result<(), String> {
+    if limits.ops > MAX_RATE || limits.bytes > MAX_RATE {
+        return Err(format!("the limits must be 0-{}", MAX_RATE));
+    }
+
+    match device {
+        "blk" => virtio_blk::set_throttle(limits),
+        _ => virtio_net::set_throttle(limits),
+    }
+}
+
+/// `throttle blk iops=100 bps=1048576`: the omitted limits are kept.
+fn set_throttle_hmp(device: &str, args: &[&str]) -> Result<(), String> {
+    let (ops_name, mut limits) = throttle_device(device)?;
+    for arg in args {
+        let (name, value) = arg.split_once('=').ok_or(format!("expected <name>=<value>: {}", arg))?;
+        let value = value.parse().map_err(|_| format!("invalid rate: {}", value))?;
+        match name {
+            "bps" => limits.bytes = value,
+            _ if name == ops_name => limits.ops = value,
+            _ => return Err(format!("unknown limit of {}: {} (expected {} or bps)", device, name, ops_name)),
+        }
+    }
+
+    set_throttle(device, limits)
+}
+
+/// `info throttle`.
+fn throttle_report() -> String {
+    let limit = |rate: u64| if rate == 0 { String::from("unlimited") } else { format!("{}", rate) };
+    let mut lines = Vec::new();
+    for (device, ops_name, throttle) in [("blk", "iops", virtio_blk::throttle()), ("net", "pps", virtio_net::throttle())] {
+        if let Some((limits, held)) = throttle {
+            lines.push(format!(
+                "{}: {}={} bps={} ({} held)",
+                device,
+                ops_name,
+                limit(limits.ops),
+                limit(limits.bytes),
+                held
+            ));
+        }
+    }
+
+    if lines.is_empty() {
+        return String::from("no throttled devices");
+    }
+    lines.join("\n")
+}
+
+fn set_clock_scale(scale: &str) -> Result<(), String> {
+    let (num, den) = config::parse_clock_scale(scale).ok_or(format!("invalid factor: {}", scale))?;
+    timer::set_clock_scale(num, den)
+}
+
+fn examine(spec: &str, addr: &str) -> Result<String, String> {
+    let count = match spec {
+        "" => Some(1),
+        spec => spec.strip_prefix('/').and_then(|spec| spec.strip_suffix('x')).and_then(|count| match count {
+            "" => Some(1),
+            count => count.parse().ok(),
+        }),
+    };
+
+    let (Some(count), Some(addr)) = (count, parse_number(addr)) else {
+        return error("usage: x/<count>x <gpa>");
+    };
+
+    let mut output = String::new();
+    for i in 0..count.min(MAX_EXAMINE_WORDS) {
+        let word_addr = addr.wrapping_add(i * 4);
+        let Some(word) = GUEST_MEMORY.read_u32(word_addr) else {
+            return error(&format!("cannot access guest memory at {:#x}", word_addr));
+        };
+
+        if i % 4 == 0 {
+            if i > 0 {
+                output.push('\n');
+            }
+            output.push_str(&format!("{:016x}:", word_addr));
+        }
+        output.push_str(&format!(" 0x{:08x}", word));
+    }
+
+    Ok(output)
+}
+
+impl Monitor {
+    /// Handles a command. Returns the JSON value of `return`.
+    fn execute(&mut self, vcpu: &mut VCpu, command: &str, args: Option<&Json>) -> Result<String, String> {
+        match command {
+            "qmp_capabilities" => Ok(String::from("{}")),
+            // paused-ms: the total time in `stop` so far.
+            "query-status" => {
+                let status = if self.paused { "paused" } else { "running" };
+                let paused_ms = vm::total_paused() / (TIMEBASE_FREQ / 1000);
+                Ok(format!(
+                    "{{\"status\": \"{}\", \"running\": {}, \"paused-ms\": {}}}",
+                    status, !self.paused, paused_ms
+                ))
+            }
+            "query-name" => Ok(match config().name.as_deref() {
+                Some(name) => format!("{{\"name\": {}}}", quote(name)),
+                None => String::from("{}"),
+            }),
+            // All zeros without -name, as QEMU's.
+            "query-uuid" => {
+                let uuid = identity::uuid().unwrap_or_else(|| String::from("00000000-0000-0000-0000-000000000000"));
+                Ok(format!("{{\"UUID\": \"{}\"}}", uuid))
+            }
+            "stop" => {
+                if !self.paused {
+                    vm::pause(vcpu);
+                    self.paused = true;
+                    event("STOP", "{}");
+                }
+                Ok(String::from("{}"))
+            }
+            "cont" => {
+                if self.paused {
+                    vm::resume(vcpu);
+                    self.paused = false;
+                    event("RESUME", "{}");
+                }
+                Ok(String::from("{}"))
+            }
+            // Executes one instruction on this vCPU. The result comes in
+            // a STEP_COMPLETED event.
+            "step" => {
+                if !self.paused {
+                    return error("the VM is running: use stop first");
+                }
+
+                let Some(step) = Step::start(vcpu, |_| false) else {
+                    return error(&format!("failed to decode the instruction at {:#x}", vcpu.sepc));
+                };
+
+                // The guest time runs during the step.
+                vm::thaw_time();
+                self.step = Some(step);
+                Ok(String::from("{}"))
+            }
+            "quit" => {
+                event("SHUTDOWN", "{\"guest\": false, \"reason\": \"host-qmp-quit\"}");
+                sbi::system_reset(sbi::RESET_TYPE_SHUTDOWN, sbi::RESET_REASON_NONE)
+                    .map(|_| String::from("{}"))
+                    .or_else(|err| error(&format!("SBI system reset failed (error={})", err)))
+            }
+            "system_reset" => {
+                event("RESET", "{\"guest\": false, \"reason\": \"host-qmp-system-reset\"}");
+                sbi::system_reset(sbi::RESET_TYPE_COLD_REBOOT, sbi::RESET_REASON_NONE)
+                    .map(|_| String::from("{}"))
+                    .or_else(|err| error(&format!("SBI system reset failed (error={})", err)))
+            }
+            "dump-guest-memory" => {
+                // Pause the VM while dumping unless it's already stopped.
+                if !self.paused {
+                    smp::pause_others(vcpu);
+                }
+
+                let result = core_dump::dump(vcpu);
+                if !self.paused {
+                    smp::resume_others();
+                }
+
+                result.map(|_| String::from("{}")).or_else(|err| error(&err))
+            }
+            "balloon" => {
+                let Some(value) = args.and_then(|args| args.get("value")?.as_i64()) else {
+                    return error("expected {\"value\": <bytes>}");
+                };
+
+                virtio_balloon::set_target(value.max(0) as u64)
+                    .map(|_| String::from("{}"))
+                    .or_else(|err| error(&err))
+            }
+            "query-balloon" => match virtio_balloon::actual() {
+                Some(actual) => Ok(format!("{{\"actual\": {}}}", actual)),
+                None => error("virtio-balloon is not enabled (-balloon)"),
+            },
+            "mem-resize" => {
+                let Some(size) = args.and_then(|args| args.get("size")?.as_i64()) else {
+                    return error("expected {\"size\": <bytes>}");
+                };
+
+                virtio_mem::set_requested_size(size.max(0) as u64)
+                    .map(|_| String::from("{}"))
+                    .or_else(|err| error(&err))
+            }
+            "query-memory-devices" => Ok(virtio_mem::report_json()),
+            "query-boottime" => Ok(boot_time::report_json()),
+            "query-fault-stats" if config().fault_stats => Ok(fault_stats::report_json()),
+            "query-fault-stats" => error("fault statistics are not enabled (-fault-stats)"),
+            // {"cpu-index": N} for a vCPU other than 0. See smp::inject_nmi.
+            "inject-nmi" => {
+                let id = args.and_then(|args| args.get("cpu-index")?.as_i64()).unwrap_or(0);
+                if !(0..smp::num_vcpus() as i64).contains(&id) {
+                    return error(&format!("no such vCPU: {}", id));
+                }
+
+                smp::inject_nmi(id as u64).map(|_| String::from("{}")).or_else(|err| error(err))
+            }
+            // Sends the VM to the destination connected to migration.sock. The
+            // progress comes in MIGRATION events and query-migrate.
+            "migrate" => migration::start(vcpu).map(|_| String::from("{}")).or_else(|err| error(&err)),
+            "query-migrate" => Ok(migration::query()),
+            // {"scale": "0.1"}: see -clock-scale.
+            "clock-scale" => {
+                let Some(scale) = args.and_then(|args| args.get("scale")?.as_str()) else {
+                    return error("expected \"scale\"");
+                };
+
+                set_clock_scale(scale).map(|_| String::from("{}"))
+            }
+            // {"device": "blk", "iops": N, "bps": N} or {"device": "net",
+            // "pps": N, "bps": N}. 0 for no limit, and omitted ones are kept.
+            "set-throttle" => {
+                let device = args.and_then(|args| args.get("device")?.as_str()).unwrap_or("");
+                let (ops_name, current) = throttle_device(device)?;
+                let mut limits = current;
+                if let Some(ops) = args.and_then(|args| args.get(ops_name)?.as_i64()) {
+                    limits.ops = ops.max(0) as u64;
+                }
+                if let Some(bytes) = args.and_then(|args| args.get("bps")?.as_i64()) {
+                    limits.bytes = bytes.max(0) as u64;
+                }
+
+                set_throttle(device, limits).map(|_| String::from("{}"))
+            }
+            "query-throttle" => {
+                let mut entries = Vec::new();
+                for (device, ops_name, throttle) in
+                    [("blk", "iops", virtio_blk::throttle()), ("net", "pps", virtio_net::throttle())]
+                {
+                    if let Some((limits, held)) = throttle {
+                        entries.push(format!(
+                            "\"{}\": {{\"{}\": {}, \"bps\": {}, \"held\": {}}}",
+                            device, ops_name, limits.ops, limits.bytes, held
+                        ));
+                    }
+                }
+                Ok(format!("{{{}}}", entries.join(", ")))
+            }
+            // {"lines": N} for the last N lines only.
+            "query-console" => {
+                let num_lines = args.and_then(|args| args.get("lines")?.as_i64()).map(|lines| lines.max(0) as usize);
+                Ok(format!("{{\"data\": {}}}", quote(&console_log::tail(num_lines))))
+            }
+            // Adds the next vCPU of -smp <n>,maxcpus=<m> ({"id": N} checks it's N).
+            // The guest starts it through SBI hart_start (see smp::add_vcpu).
+            "cpu-add" => {
+                let expected = args.and_then(|args| args.get("id")?.as_i64());
+                let next = smp::num_vcpus() as i64;
+                if expected.is_some_and(|id| id != next) {
+                    return error(&format!("vCPUs are added in order: the next one is {}", next));
+                }
+
+                let table = GuestPageTable::from_hgatp(vcpu.hgatp);
+                smp::add_vcpu(&table).map(|id| format!("{{\"cpu-index\": {}}}", id)).or_else(|err| error(&err))
+            }
+            // Attaches a host disk: {"driver": "virtio-blk-device", "id": ..., "serial": ...}.
+            // The serial defaults to the ID.
+            "device_add" => {
+                let Some(id) = args.and_then(|args| args.get("id")?.as_str()) else {
+                    return error("expected {\"driver\": \"virtio-blk-device\", \"id\": <id>}");
+                };
+
+                let driver = args.and_then(|args| args.get("driver")?.as_str());
+                if !matches!(driver, Some("virtio-blk-device" | "virtio-blk")) {
+                    return error("only virtio-blk-device can be hotplugged");
+                }
+
+                let serial = args.and_then(|args| args.get("serial")?.as_str()).unwrap_or(id);
+                hotplug::add(id, serial).map(|_| String::from("{}")).or_else(|err| error(&err))
+            }
+            "device_del" => {
+                let Some(id) = args.and_then(|args| args.get("id")?.as_str()) else {
+                    return error("expected {\"id\": <id>}");
+                };
+
+                hotplug::remove(id).map(|_| String::from("{}")).or_else(|err| error(&err))
+            }
+            "human-monitor-command" => {
+                let Some(line) = args.and_then(|args| args.get("command-line")?.as_str()) else {
+                    return error("expected {\"command-line\": <command>}");
+                };
+
+                Ok(quote(&self.execute_hmp(vcpu, line)))
+            }
+            _ => error(&format!("The command {} has not been found", command)),
+        }
+    }
+
+    /// Handles a human-readable command, e.g. `info registers`. Returns the
+    /// output.
+    fn execute_hmp(&mut self, vcpu: &mut VCpu, line: &str) -> String {
+        let words: Vec<&str> = line.split_whitespace().collect();
+        let result = match words.as_slice() {
+            [] => Ok(String::new()),
+            ["help" | "?"] => Ok(String::from(HMP_HELP)),
+            ["info", "status"] => match vm::paused_for() {
+                Some(ticks) => Ok(format!("VM status: paused (for {} ms)", ticks / (TIMEBASE_FREQ / 1000))),
+                None => Ok(String::from("VM status: running")),
+            },
+            ["info", "name"] => Ok(identity::report()),
+            ["info", "registers"] => Ok(registers(vcpu)),
+            ["info", "registers", id] => match parse_number(id) {
+                Some(id) if id == vcpu.hart_id => Ok(registers(vcpu)),
+                Some(id) => match smp::paused_vcpu(id) {
+                    Some(other) if self.paused => Ok(registers(other)),
+                    _ => error(&format!("vCPU {} is not stopped: use stop first", id)),
+                },
+                None => error("usage: info registers [<vcpu>]"),
+            },
+            ["info", "mem"] => Ok(mappings(vcpu)),
+            ["info", "gmap"] => Ok(gmap(vcpu)),
+            ["info", "stage2", gpa] => match parse_number(gpa) {
+                Some(gpa) => Ok(stage2(vcpu, gpa)),
+                None => error("usage: info stage2 <gpa>"),
+            },
+            ["info", "boottime"] => Ok(boot_time::report()),
+            ["info", "throttle"] => Ok(throttle_report()),
+            ["info", "measurements"] => Ok(measured_boot::report()),
+            ["info", "reserved-mem"] => Ok(reserved_mem::report()),
+            ["info", "memory-devices"] => Ok(virtio_mem::report()),
+            ["info", "uart"] => Ok(host_uart::report()),
+            ["info", "faults"] => Ok(fault_inject::report()),
+            ["info", "console"] => Ok(console_log::tail(None)),
+            ["info", "console", lines] => match lines.parse() {
+                Ok(lines) => Ok(console_log::tail(Some(lines))),
+                Err(_) => error("usage: info console [<lines>]"),
+            },
+            [command, addr] if command.starts_with('x') => examine(&command[1..], addr),
+            ["stop"] => self.execute(vcpu, "stop", None).map(|_| String::new()),
+            ["cont" | "c"] => self.execute(vcpu, "cont", None).map(|_| String::new()),
+            ["clock_scale"] => match timer::clock_scale() {
+                Some((num, den)) => Ok(format!("the guest time runs at {}/{} of the host's", num, den)),
+                None => Ok(String::from("the guest time is not scaled")),
+            },
+            ["clock_scale", scale] => set_clock_scale(scale).map(|_| String::new()),
+            ["throttle", device, limits @ ..] if !limits.is_empty() => {
+                set_throttle_hmp(device, limits).map(|_| String::new())
+            }
+            ["fault", faults @ ..] if !faults.is_empty() => fault_inject::set(&faults.join(",")).map(|_| String::new()),
+            ["mem-resize", size] => match config::parse_size(size) {
+                Some(size) => virtio_mem::set_requested_size(size as u64).map(|_| String::new()).or_else(|err| error(&err)),
+                None => error("usage: mem-resize <size>"),
+            },
+            ["cpu-add"] => self.execute(vcpu, "cpu-add", None).map(|_| format!("vCPU {} added", smp::num_vcpus() - 1)),
+            ["system_reset"] => self.execute(vcpu, "system_reset", None).map(|_| String::new()),
+            ["nmi"] => self.execute(vcpu, "inject-nmi", None).map(|_| String::new()),
+            ["nmi", id] => match parse_number(id).filter(|&id| id < smp::num_vcpus() as u64) {
+                Some(id) => smp::inject_nmi(id).map(|_| String::new()).or_else(|err| error(err)),
+                None => error("usage: nmi [<vcpu>]"),
+            },
+            ["quit" | "q"] => self.execute(vcpu, "quit", None).map(|_| String::new()),
+            _ => error(&format!("unknown command: {} (try help)", line.trim())),
+        };
+
+        result.unwrap_or_else(|err| format!("Error: {}", err))
+    }
+
+    fn handle_message(&mut self, vcpu: &mut VCpu, message: &[u8]) {
+        let request = json::parse(message);
+        let id = request.as_ref().and_then(|request| request.get("id")).map(Json::serialize);
+        let result = match request.as_ref().and_then(|request| request.get("execute")?.as_str()) {
+            Some(command) => {
+                let args = request.as_ref().and_then(|request| request.get("arguments"));
+                self.execute(vcpu, command, args)
+            }
+            None => error("expected a JSON object with \"execute\""),
+        };
+
+        let mut reply = match result {
+            Ok(value) => format!("{{\"return\": {}", value),
+            Err(desc) => format!("{{\"error\": {{\"class\": \"GenericError\", \"desc\": {}}}", quote(&desc)),
+        };
+
+        if let Some(id) = id {
+            reply.push_str(&format!(", \"id\": {}", id));
+        }
+
+        reply.push_str("}\r\n");
+        host_console::write(PORT, reply.as_bytes());
+    }
+
+    fn poll(&mut self, vcpu: &mut VCpu) {
+        if !config().monitor {
+            return;
+        }
+
+        let connected = host_console::is_connected(PORT);
+        if connected && !self.connected {
+            self.buf.clear();
+            let greeting = "{\"QMP\": {\"version\": {\"package\": \"hypervisor\"}, \"capabilities\": []}}\r\n";
+            host_console::write(PORT, greeting.as_bytes());
+        }
+        self.connected = connected;
+
+        while let Some(byte) = host_console::read(PORT) {
+            self.buf.push(byte);
+        }
+
+        while let Some(message) = take_object(&mut self.buf) {
+            self.handle_message(vcpu, &message);
+        }
+    }
+
+    /// Runs commands entered at the console's prompt.
+    fn poll_console(&mut self, vcpu: &mut VCpu) {
+        serial::handle_interrupt();
+        while let Some(line) = serial::take_command() {
+            let output = self.execute_hmp(vcpu, &line);
+            if !output.is_empty() {
+                println!("{}", output);
+            }
+            serial::prompt();
+        }
+    }
+
+    /// Keeps the VM stopped until `cont` or `step`.
+    fn wait_while_paused(&mut self, vcpu: &mut VCpu) {
+        while self.paused && self.step.is_none() {
+            self.poll(vcpu);
+            self.poll_console(vcpu);
+            core::hint::spin_loop();
+        }
+    }
+}
+
+pub fn init() {
+    assert!(host_console::has_port(PORT), "[monitor] virtio-console port \"{}\" not found", PORT);
+    info!("monitor", "ready: connect to monitor.sock");
+}
+
+/// Handles data from the monitor client.
+pub fn handle_interrupt(vcpu: &mut VCpu) {
+    let mut monitor = MONITOR.lock();
+    monitor.poll(vcpu);
+    monitor.wait_while_paused(vcpu);
+}
+
+/// Handles commands entered at the console's prompt (Ctrl-A c).
+pub fn handle_console(vcpu: &mut VCpu) {
+    let mut monitor = MONITOR.lock();
+    monitor.poll_console(vcpu);
+    monitor.wait_while_paused(vcpu);
+}
+
+/// Handles a breakpoint hit by `step`. Returns false if it's not ours.
+pub fn handle_breakpoint(vcpu: &mut VCpu) -> bool {
+    let mut monitor = MONITOR.lock();
+    let Some(step) = monitor.step.take_if(|step| step.is_done(vcpu.sepc)) else {
+        return false;
+    };
+
+    let data = match step.finish(vcpu) {
+        StepResult::Completed { pc } => format!("{{\"pc\": {}, \"trap\": null}}", pc),
+        StepResult::Trap { pc, scause, stval } => {
+            format!("{{\"pc\": {}, \"trap\": {{\"scause\": {}, \"stval\": {}}}}}", pc, scause, stval)
+        }
+    };
+
+    event("STEP_COMPLETED", &data);
+    vm::freeze_time();
+    monitor.wait_while_paused(vcpu);
+    true
+}
@@ -0,0 +1,655 @@
+//! `-nested`: exposes the H extension to the guest, to run a hypervisor (e.g.
+//! this one) inside. The CPU doesn't virtualize it for us: we trap and
+//! emulate everything, which is slow but simple.
+//!
+//! - The guest hypervisor (L1) runs in VS-mode: its accesses to the H and VS
+//!   CSRs raise virtual instruction exceptions, and we keep the values here.
+//! - Its sret into the nested guest (L2) with hstatus.SPV set traps too
+//!   (VTSR). We switch the VS CSRs to L2's, and run it on a shadow G-stage
+//!   table which maps L2's guest physical addresses to the host's directly:
+//!   L1's table (L2 to L1) composed with ours (L1 to host), filled on
+//!   guest-page faults.
+//! - L2's exceptions which L1 hasn't delegated, and L1's interrupts, exit to
+//!   L1 as traps into HS-mode: with hstatus.SPV, htval, htinst, and so on.
+//!
+//! All TLBs are flushed on each switch: L1 and L2 share VMID 0. Not
+//! supported:
+//!
+//! - hlv/hsv, vstimecmp (Sstc), and guest external interrupts (GEILEN is 0).
+//! - L1's MMIO regions mapped into L2 (device passthrough).
+//! - Remote hfence.gvma (SBI RFENCE): hfence.gvma only clears the shadow
+//!   table of the vCPU it's executed on.
+//! - Snapshots and migration.
+//! - hstatus.SPV is not cleared on traps L1 takes directly, e.g. from its
+//!   U-mode: set it before every sret into the guest, as hypervisors do.
+use core::{
+    arch::asm,
+    sync::atomic::{AtomicBool, AtomicU64, Ordering},
+};
+use spin::Mutex;
+
+use crate::{
+    guest_memory::GUEST_MEMORY,
+    guest_page_table::{GuestPageTable, PTE_R, PTE_W, PTE_X},
+    smp::{self, MAX_VCPUS},
+    timer::{self, TIMEBASE_FREQ},
+    vcpu::VCpu,
+};
+
+const PTE_V: u64 = 1 << 0;
+const PTE_U: u64 = 1 << 4;
+const PAGE_SIZE: u64 = 4096;
+
+const HSTATUS_GVA: u64 = 1 << 6;
+const HSTATUS_SPV: u64 = 1 << 7;
+const HSTATUS_SPVP: u64 = 1 << 8;
+const HSTATUS_HU: u64 = 1 << 9;
+const HSTATUS_VTVM: u64 = 1 << 20;
+const HSTATUS_VTW: u64 = 1 << 21;
+const HSTATUS_VTSR: u64 = 1 << 22;
+const HSTATUS_VSXL_64: u64 = 2 << 32;
+const HSTATUS_WRITABLE: u64 =
+    HSTATUS_GVA | HSTATUS_SPV | HSTATUS_SPVP | HSTATUS_HU | HSTATUS_VTVM | HSTATUS_VTW | HSTATUS_VTSR;
+/// The traps of L2 which L1 decides.
+const HSTATUS_TRAPS: u64 = HSTATUS_VTVM | HSTATUS_VTW | HSTATUS_VTSR;
+
+const SSTATUS_SIE: u64 = 1 << 1;
+const SSTATUS_SPIE: u64 = 1 << 5;
+const SSTATUS_SPP: u64 = 1 << 8;
+const SSTATUS_VS: u64 = 3 << 9;
+const SSTATUS_FS: u64 = 3 << 13;
+const SSTATUS_SUM: u64 = 1 << 18;
+const SSTATUS_MXR: u64 = 1 << 19;
+const SSTATUS_UXL_64: u64 = 2 << 32;
+const SSTATUS_SD: u64 = 1 << 63;
+const SSTATUS_WRITABLE: u64 =
+    SSTATUS_SIE | SSTATUS_SPIE | SSTATUS_SPP | SSTATUS_VS | SSTATUS_FS | SSTATUS_SUM | SSTATUS_MXR;
+
+const HVIP_VSSIP: u64 = 1 << 2;
+/// VSSIP, VSTIP, and VSEIP.
+const HVIP_MASK: u64 = 0x444;
+/// SSIP, STIP, and SEIP: hvip shifted right by 1.
+const SIP_MASK: u64 = 0x222;
+/// The exceptions the hypervisor can delegate (see VCpu::boot_state).
+const HEDELEG_MASK: u64 = 0xb1ff;
+const SCAUSE_INTERRUPT: u64 = 1 << 63;
+
+const CSR_VSSTATUS: u32 = 0x200;
+const CSR_VSIE: u32 = 0x204;
+const CSR_VSTVEC: u32 = 0x205;
+const CSR_VSSCRATCH: u32 = 0x240;
+const CSR_VSEPC: u32 = 0x241;
+const CSR_VSCAUSE: u32 = 0x242;
+const CSR_VSTVAL: u32 = 0x243;
+const CSR_VSIP: u32 = 0x244;
+const CSR_VSATP: u32 = 0x280;
+const CSR_HSTATUS: u32 = 0x600;
+const CSR_HEDELEG: u32 = 0x602;
+const CSR_HIDELEG: u32 = 0x603;
+const CSR_HIE: u32 = 0x604;
+const CSR_HTIMEDELTA: u32 = 0x605;
+const CSR_HCOUNTEREN: u32 = 0x606;
+const CSR_HGEIE: u32 = 0x607;
+const CSR_HENVCFG: u32 = 0x60a;
+const CSR_HTVAL: u32 = 0x643;
+const CSR_HIP: u32 = 0x644;
+const CSR_HVIP: u32 = 0x645;
+const CSR_HTINST: u32 = 0x64a;
+const CSR_HGATP: u32 = 0x680;
+const CSR_HGEIP: u32 = 0xe12;
+
+const OPCODE_SYSTEM: u32 = 0x73;
+const SRET: u32 = 0x1020_0073;
+/// hfence.* without rs1 and rs2.
+const HFENCE_MASK: u32 = 0xfe00_7fff;
+const HFENCE_VVMA: u32 = 0x2200_0073;
+const HFENCE_GVMA: u32 = 0x6200_0073;
+
+/// The VS-mode CSRs: L2's while L1 runs, and L1's while L2 runs.
+#[derive(Clone, Copy)]
+struct VsCsrs {
+    vsstatus: u64,
+    vsie: u64,
+    vstvec: u64,
+    vsscratch: u64,
+    vsepc: u64,
+    vscause: u64,
+    vstval: u64,
+    vsatp: u64,
+}
+
+impl VsCsrs {
+    const fn new() -> Self {
+        Self {
+            vsstatus: SSTATUS_UXL_64,
+            vsie: 0,
+            vstvec: 0,
+            vsscratch: 0,
+            vsepc: 0,
+            vscause: 0,
+            vstval: 0,
+            vsatp: 0,
+        }
+    }
+
+    fn read() -> Self {
+        let mut csrs = Self::new();
+        unsafe {
+            asm!("csrr {}, vsstatus", out(reg) csrs.vsstatus);
+            asm!("csrr {}, vsie", out(reg) csrs.vsie);
+            asm!("csrr {}, vstvec", out(reg) csrs.vstvec);
+            asm!("csrr {}, vsscratch", out(reg) csrs.vsscratch);
+            asm!("csrr {}, vsepc", out(reg) csrs.vsepc);
+            asm!("csrr {}, vscause", out(reg) csrs.vscause);
+            asm!("csrr {}, vstval", out(reg) csrs.vstval);
+            asm!("csrr {}, vsatp", out(reg) csrs.vsatp);
+        }
+        csrs
+    }
+
+    fn write(&self) {
+        unsafe {
+            asm!("csrw vsstatus, {}", in(reg) self.vsstatus);
+            asm!("csrw vsie, {}", in(reg) self.vsie);
+            asm!("csrw vstvec, {}", in(reg) self.vstvec);
+            asm!("csrw vsscratch, {}", in(reg) self.vsscratch);
+            asm!("csrw vsepc, {}", in(reg) self.vsepc);
+            asm!("csrw vscause, {}", in(reg) self.vscause);
+            asm!("csrw vstval, {}", in(reg) self.vstval);
+            asm!("csrw vsatp, {}", in(reg) self.vsatp);
+        }
+    }
+}
+
+struct Nested {
+    // The H-mode CSRs of L1.
+    hstatus: u64,
+    hedeleg: u64,
+    hideleg: u64,
+    hie: u64,
+    htimedelta: u64,
+    hcounteren: u64,
+    htval: u64,
+    htinst: u64,
+    hvip: u64,
+    hgatp: u64,
+    vs: VsCsrs,
+    // Ours for L1, while L2 runs.
+    l1_hstatus: u64,
+    l1_hgatp: u64,
+    l1_hedeleg: u64,
+    l1_hideleg: u64,
+    /// Our interrupts to L1 (see set_hvip).
+    l1_hvip: u64,
+    /// hgatp of the shadow table, or 0 if not allocated yet.
+    shadow: u64,
+}
+
+impl Nested {
+    const fn new() -> Self {
+        Self {
+            hstatus: HSTATUS_VSXL_64,
+            hedeleg: 0,
+            hideleg: 0,
+            hie: 0,
+            htimedelta: 0,
+            hcounteren: 0,
+            htval: 0,
+            htinst: 0,
+            hvip: 0,
+            hgatp: 0,
+            vs: VsCsrs::new(),
+            l1_hstatus: 0,
+            l1_hgatp: 0,
+            l1_hedeleg: 0,
+            l1_hideleg: 0,
+            l1_hvip: 0,
+            shadow: 0,
+        }
+    }
+
+    fn read_csr(&self, csr: u32) -> Option<u64> {
+        let value = match csr {
+            CSR_VSSTATUS => self.vs.vsstatus,
+            CSR_VSIE => self.vs.vsie,
+            CSR_VSTVEC => self.vs.vstvec,
+            CSR_VSSCRATCH => self.vs.vsscratch,
+            CSR_VSEPC => self.vs.vsepc,
+            CSR_VSCAUSE => self.vs.vscause,
+            CSR_VSTVAL => self.vs.vstval,
+            CSR_VSIP => (self.hvip >> 1) & SIP_MASK,
+            CSR_VSATP => self.vs.vsatp,
+            CSR_HSTATUS => self.hstatus,
+            CSR_HEDELEG => self.hedeleg,
+            CSR_HIDELEG => self.hideleg,
+            CSR_HIE => self.hie,
+            CSR_HTIMEDELTA => self.htimedelta,
+            CSR_HCOUNTEREN => self.hcounteren,
+            CSR_HTVAL => self.htval,
+            // No guest external interrupts: only the ones in hvip.
+            CSR_HIP | CSR_HVIP => self.hvip,
+            CSR_HTINST => self.htinst,
+            CSR_HGATP => self.hgatp,
+            CSR_HGEIE | CSR_HENVCFG | CSR_HGEIP => 0,
+            _ => return None,
+        };
+        Some(value)
+    }
+
+    /// Writes a CSR of L1. Unsupported values are ignored (WARL).
+    fn write_csr(&mut self, vcpu: &mut VCpu, csr: u32, value: u64) {
+        match csr {
+            CSR_VSSTATUS => {
+                let vsstatus = (value & SSTATUS_WRITABLE) | SSTATUS_UXL_64;
+                let dirty = vsstatus & SSTATUS_FS == SSTATUS_FS || vsstatus & SSTATUS_VS == SSTATUS_VS;
+                self.vs.vsstatus = if dirty { vsstatus | SSTATUS_SD } else { vsstatus };
+            }
+            CSR_VSIE => self.vs.vsie = value & SIP_MASK,
+            CSR_VSTVEC => self.vs.vstvec = value & !0b10,
+            CSR_VSSCRATCH => self.vs.vsscratch = value,
+            CSR_VSEPC => self.vs.vsepc = value & !1,
+            CSR_VSCAUSE => self.vs.vscause = value,
+            CSR_VSTVAL => self.vs.vstval = value,
+            // Only the software interrupt can be set through vsip and hip.
+            CSR_VSIP => self.hvip = (self.hvip & !HVIP_VSSIP) | ((value << 1) & HVIP_VSSIP),
+            CSR_VSATP if is_supported_mode(value) => self.vs.vsatp = value,
+            CSR_HSTATUS => {
+                self.hstatus = (value & HSTATUS_WRITABLE) | HSTATUS_VSXL_64;
+                self.update_vtsr(vcpu);
+            }
+            CSR_HEDELEG => self.hedeleg = value & HEDELEG_MASK,
+            CSR_HIDELEG => self.hideleg = value & HVIP_MASK,
+            CSR_HIE => self.hie = value & HVIP_MASK,
+            CSR_HTIMEDELTA => self.htimedelta = value,
+            CSR_HCOUNTEREN => self.hcounteren = value & 0xffff_ffff,
+            CSR_HTVAL => self.htval = value,
+            CSR_HIP => self.hvip = (self.hvip & !HVIP_VSSIP) | (value & HVIP_VSSIP),
+            CSR_HVIP => self.hvip = value & HVIP_MASK,
+            CSR_HTINST => self.htinst = value,
+            CSR_HGATP if is_supported_mode(value) => {
+                // VMIDLEN is 0, and the root table is 16KB-aligned.
+                let hgatp = value & (0xf << 60 | ((1 << 44) - 1) & !0b11);
+                if hgatp != self.hgatp {
+                    self.hgatp = hgatp;
+                    self.clear_shadow();
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Emulates a CSR instruction. Returns false if it's not a CSR of the H
+    /// extension we support.
+    fn emulate_csr(&mut self, vcpu: &mut VCpu, inst: u32) -> bool {
+        let csr = inst >> 20;
+        let funct3 = (inst >> 12) & 0x7;
+        let rd = ((inst >> 7) & 0x1f) as u64;
+        let rs1 = ((inst >> 15) & 0x1f) as u64;
+        let Some(old) = self.read_csr(csr) else {
+            return false;
+        };
+
+        // The immediate forms (csrrwi, ...) have a 5-bit value in rs1.
+        let operand = if funct3 & 0b100 != 0 { rs1 } else { vcpu.gpr(rs1) };
+        let new = match funct3 & 0b11 {
+            0b01 => Some(operand),
+            0b10 => (rs1 != 0).then_some(old | operand),
+            _ => (rs1 != 0).then_some(old & !operand),
+        };
+
+        if let Some(new) = new {
+            // The top 2 bits of the number are 0b11 in read-only CSRs.
+            if csr >> 10 == 0b11 {
+                return false;
+            }
+
+            self.write_csr(vcpu, csr, new);
+        }
+
+        vcpu.set_gpr(rd, old);
+        true
+    }
+
+    /// Makes L1's sret trap into us while it's going to enter L2.
+    fn update_vtsr(&self, vcpu: &mut VCpu) {
+        if self.hstatus & HSTATUS_SPV != 0 {
+            vcpu.hstatus |= HSTATUS_VTSR;
+        } else {
+            vcpu.hstatus &= !HSTATUS_VTSR;
+        }
+    }
+
+    fn clear_shadow(&mut self) {
+        if self.shadow != 0 {
+            GuestPageTable::from_hgatp(self.shadow).unmap_all();
+        }
+    }
+
+    /// Emulates sret in L1: enters L2 if hstatus.SPV is set.
+    fn sret(&mut self, vcpu: &mut VCpu) {
+        let mut vsstatus: u64;
+        let vsepc: u64;
+        unsafe {
+            asm!("csrr {}, vsstatus", out(reg) vsstatus);
+            asm!("csrr {}, vsepc", out(reg) vsepc);
+        }
+
+        // Do what the CPU does: restore the privilege mode and the
+        // interrupt-enable bit.
+        let spp = vsstatus & SSTATUS_SPP;
+        vsstatus = (vsstatus & !(SSTATUS_SIE | SSTATUS_SPP)) | ((vsstatus & SSTATUS_SPIE) >> 4) | SSTATUS_SPIE;
+        unsafe {
+            asm!("csrw vsstatus, {}", in(reg) vsstatus);
+        }
+
+        vcpu.sepc = vsepc;
+        vcpu.sstatus = (vcpu.sstatus & !SSTATUS_SPP) | spp;
+        if self.hstatus & HSTATUS_SPV != 0 {
+            self.enter(vcpu);
+        }
+    }
+
+    /// Switches from L1 to L2. vcpu.sepc is L2's pc.
+    fn enter(&mut self, vcpu: &mut VCpu) {
+        let l2 = self.vs;
+        self.vs = VsCsrs::read();
+        l2.write();
+        unsafe {
+            asm!("csrr {}, hvip", out(reg) self.l1_hvip);
+            asm!("csrw hvip, {}", in(reg) self.hvip);
+        }
+
+        if self.shadow == 0 {
+            self.shadow = GuestPageTable::new().hgatp();
+        }
+
+        self.l1_hstatus = vcpu.hstatus;
+        self.l1_hgatp = vcpu.hgatp;
+        self.l1_hedeleg = vcpu.hedeleg;
+        self.l1_hideleg = vcpu.hideleg;
+        vcpu.hstatus = (vcpu.hstatus & !HSTATUS_TRAPS) | (self.hstatus & HSTATUS_TRAPS);
+        vcpu.hgatp = self.shadow;
+        vcpu.hedeleg &= self.hedeleg;
+        vcpu.hideleg &= self.hideleg;
+        IN_L2[vcpu.hart_id as usize].store(true, Ordering::Relaxed);
+        flush_tlbs();
+        trace!("nested", "vCPU {}: entering the nested guest at {:#x}", vcpu.hart_id, vcpu.sepc);
+    }
+
+    /// Switches from L2 to L1 as a trap into HS-mode. vcpu.sepc is L2's pc.
+    fn exit(&mut self, vcpu: &mut VCpu, scause: u64, stval: u64, htval: u64, htinst: u64, gva: bool) {
+        let mut l1 = self.vs;
+        self.vs = VsCsrs::read();
+        unsafe {
+            asm!("csrr {}, hvip", out(reg) self.hvip);
+            asm!("csrw hvip, {}", in(reg) self.l1_hvip);
+        }
+
+        // Do what the CPU does on a trap: save the privilege mode and the
+        // interrupt-enable bit, and disable interrupts.
+        let from_vs = vcpu.sstatus & SSTATUS_SPP != 0;
+        let spie = (l1.vsstatus & SSTATUS_SIE) << 4;
+        l1.vsstatus &= !(SSTATUS_SIE | SSTATUS_SPIE | SSTATUS_SPP);
+        l1.vsstatus |= spie | if from_vs { SSTATUS_SPP } else { 0 };
+        l1.vsepc = vcpu.sepc;
+        l1.vscause = scause;
+        l1.vstval = stval;
+        l1.write();
+
+        self.hstatus &= !(HSTATUS_GVA | HSTATUS_SPVP);
+        self.hstatus |= HSTATUS_SPV;
+        if from_vs {
+            self.hstatus |= HSTATUS_SPVP;
+        }
+        if gva {
+            self.hstatus |= HSTATUS_GVA;
+        }
+        self.htval = htval;
+        self.htinst = htinst;
+
+        vcpu.hstatus = self.l1_hstatus;
+        vcpu.hgatp = self.l1_hgatp;
+        vcpu.hedeleg = self.l1_hedeleg;
+        vcpu.hideleg = self.l1_hideleg;
+        self.update_vtsr(vcpu);
+
+        let base = l1.vstvec & !0b11;
+        let vectored = scause & SCAUSE_INTERRUPT != 0 && l1.vstvec & 0b11 == 1;
+        vcpu.sepc = if vectored { base + 4 * (scause & !SCAUSE_INTERRUPT) } else { base };
+        vcpu.sstatus |= SSTATUS_SPP;
+        IN_L2[vcpu.hart_id as usize].store(false, Ordering::Relaxed);
+        flush_tlbs();
+        trace!("nested", "vCPU {}: exiting the nested guest (scause={:#x})", vcpu.hart_id, scause);
+    }
+
+    /// Maps the page of L2's guest physical address in the shadow table, if
+    /// L1's table allows the access. Otherwise, returns the exception to
+    /// reflect to L1.
+    fn map_shadow(&mut self, scause: u64, guest_addr: u64) -> Result<(), u64> {
+        let required = match scause {
+            20 /* instruction guest-page fault */ => PTE_X,
+            21 /* load guest-page fault */ => PTE_R,
+            _ => PTE_W,
+        };
+
+        // Our tables cover 48 bits (see GuestPageTable).
+        let Some((l1_addr, flags)) = walk(self.hgatp, guest_addr)
+            .filter(|(_, flags)| flags & required != 0 && guest_addr >> 48 == 0)
+        else {
+            return Err(scause);
+        };
+
+        // L1 maps its MMIO, which we don't pass through. L1's table is fine,
+        // so it would just retry a guest-page fault: make it an access fault.
+        if !GUEST_MEMORY.contains(l1_addr) {
+            let now = timer::now();
+            let warned_at = MMIO_WARNED_AT.load(Ordering::Relaxed);
+            if warned_at == 0 || now - warned_at >= TIMEBASE_FREQ {
+                MMIO_WARNED_AT.store(now, Ordering::Relaxed);
+                warn!("nested", "MMIO passthrough is not supported: {:#x} (L1's {:#x})", guest_addr, l1_addr);
+            }
+
+            return Err(match scause {
+                20 /* instruction guest-page fault */ => 1,
+                21 /* load guest-page fault */ => 5,
+                _ /* store/AMO guest-page fault */ => 7,
+            });
+        }
+
+        let page = guest_addr & !(PAGE_SIZE - 1);
+        let host_addr = GUEST_MEMORY.host_addr(l1_addr & !(PAGE_SIZE - 1)) as u64;
+        let mut table = GuestPageTable::from_hgatp(self.shadow);
+        table.unmap(page);
+        table.map(page, host_addr, flags);
+        flush_tlbs();
+        Ok(())
+    }
+}
+
+static STATES: [Mutex<Nested>; MAX_VCPUS] = [const { Mutex::new(Nested::new()) }; MAX_VCPUS];
+/// Whether each vCPU runs L2, for the paths on every VM exit.
+static IN_L2: [AtomicBool; MAX_VCPUS] = [const { AtomicBool::new(false) }; MAX_VCPUS];
+/// When we last warned about MMIO passthrough, to warn once a second at most.
+static MMIO_WARNED_AT: AtomicU64 = AtomicU64::new(0);
+
+/// hgatp and vsatp: Bare, Sv39(x4), or Sv48(x4).
+fn is_supported_mode(satp: u64) -> bool {
+    matches!(satp >> 60, 0 | 8 | 9)
+}
+
+fn flush_tlbs() {
+    unsafe {
+        asm!(".option push", ".option arch, +h", "hfence.gvma", "hfence.vvma", ".option pop");
+    }
+}
+
+/// Translates L2's guest physical address with L1's G-stage table. Returns
+/// L1's guest physical address and the permissions.
+fn walk(hgatp: u64, guest_addr: u64) -> Option<(u64, u64)> {
+    let levels = match hgatp >> 60 {
+        0 => return Some((guest_addr, PTE_R | PTE_W | PTE_X)), // Bare
+        8 => 3,                                                // Sv39x4
+        9 => 4,                                                // Sv48x4
+        _ => return None,
+    };
+
+    // "x4": the root table has 2 more bits of the index.
+    if guest_addr >> (12 + 9 * levels + 2) != 0 {
+        return None;
+    }
+
+    let mut table = (hgatp & ((1 << 44) - 1)) << 12;
+    for level in (0..levels).rev() {
+        let index_bits = if level == levels - 1 { 11 } else { 9 };
+        let index = (guest_addr >> (12 + 9 * level)) & ((1 << index_bits) - 1);
+        let pte = GUEST_MEMORY.load_u64(table + index * 8, Ordering::Relaxed)?;
+        if pte & PTE_V == 0 {
+            return None;
+        }
+
+        let paddr = ((pte >> 10) & ((1 << 44) - 1)) << 12;
+        if pte & (PTE_R | PTE_X) != 0 {
+            // G-stage leaves are always user pages.
+            if pte & PTE_U == 0 {
+                return None;
+            }
+
+            let offset_mask = (1 << (12 + 9 * level)) - 1;
+            return Some(((paddr & !offset_mask) | (guest_addr & offset_mask), pte & (PTE_R | PTE_W | PTE_X)));
+        }
+
+        table = paddr;
+    }
+
+    None
+}
+
+/// Whether the vCPU runs L2.
+pub fn in_nested_guest(hart_id: u64) -> bool {
+    IN_L2[hart_id as usize].load(Ordering::Relaxed)
+}
+
+/// Added to our htimedelta while the vCPU runs L2.
+pub fn time_delta(hart_id: u64) -> u64 {
+    if in_nested_guest(hart_id) { STATES[hart_id as usize].lock().htimedelta } else { 0 }
+}
+
+/// Masks our hcounteren while the vCPU runs L2.
+pub fn hcounteren(hart_id: u64) -> u64 {
+    if in_nested_guest(hart_id) { STATES[hart_id as usize].lock().hcounteren } else { u64::MAX }
+}
+
+/// Sets or clears VS-level interrupts (HVIP_*) of the vCPU on this hart.
+/// While it runs L2, they are L1's: kept until it exits to L1 (see
+/// `check_interrupts`).
+pub fn set_hvip(bits: u64, pending: bool) {
+    let hart_id = smp::current_hart_id();
+    if in_nested_guest(hart_id) {
+        let mut state = STATES[hart_id as usize].lock();
+        if pending {
+            state.l1_hvip |= bits;
+        } else {
+            state.l1_hvip &= !bits;
+        }
+        return;
+    }
+
+    unsafe {
+        if pending {
+            asm!("csrs hvip, {}", in(reg) bits);
+        } else {
+            asm!("csrc hvip, {}", in(reg) bits);
+        }
+    }
+}
+
+/// Emulates an instruction of the H extension in L1, from a virtual
+/// instruction exception. Returns false if it's not supported.
+pub fn emulate(vcpu: &mut VCpu, inst: u32, sepc: u64) -> bool {
+    let mut state = STATES[vcpu.hart_id as usize].lock();
+    match inst {
+        SRET => {
+            state.sret(vcpu);
+            return true;
+        }
+        // L2's entries are flushed on every switch.
+        inst if inst & HFENCE_MASK == HFENCE_VVMA => {}
+        inst if inst & HFENCE_MASK == HFENCE_GVMA => state.clear_shadow(),
+        // csrrw, csrrs, csrrc, and their immediate forms.
+        inst if inst & 0x7f == OPCODE_SYSTEM && matches!((inst >> 12) & 0x7, 1 | 2 | 3 | 5 | 6 | 7) => {
+            if !state.emulate_csr(vcpu, inst) {
+                return false;
+            }
+        }
+        _ => return false,
+    }
+
+    vcpu.sepc = sepc + 4;
+    true
+}
+
+/// Handles an exception from L2: fills the shadow table on guest-page faults
+/// L1's table allows, and reflects everything else to L1.
+pub fn handle_exception(vcpu: &mut VCpu, scause: u64, sepc: u64, stval: u64) {
+    let htval: u64;
+    let htinst: u64;
+    let hstatus: u64;
+    unsafe {
+        asm!("csrr {}, htval", out(reg) htval);
+        asm!("csrr {}, htinst", out(reg) htinst);
+        asm!("csrr {}, hstatus", out(reg) hstatus);
+    }
+
+    let mut state = STATES[vcpu.hart_id as usize].lock();
+    vcpu.sepc = sepc;
+    // "A guest physical address written to htval is shifted right by 2 bits"
+    let scause = if matches!(scause, 20 | 21 | 23) {
+        match state.map_shadow(scause, (htval << 2) | (stval & 0b11)) {
+            Ok(()) => return,
+            Err(scause) => scause,
+        }
+    } else {
+        scause
+    };
+
+    state.exit(vcpu, scause, stval, htval, htinst, hstatus & HSTATUS_GVA != 0);
+}
+
+/// Exits L2 if L1 has an interrupt pending: HS-mode interrupts are always
+/// enabled while in VS-mode. Call this right before returning to the guest.
+pub fn check_interrupts(vcpu: &mut VCpu) {
+    if !in_nested_guest(vcpu.hart_id) {
+        return;
+    }
+
+    let mut state = STATES[vcpu.hart_id as usize].lock();
+    let pending = (state.l1_hvip >> 1) & state.vs.vsie & SIP_MASK;
+    // In the order of priority: external, software, and timer.
+    let Some(code) = [9, 1, 5].into_iter().find(|code| pending & (1 << code) != 0) else {
+        return;
+    };
+
+    state.exit(vcpu, SCAUSE_INTERRUPT | code, 0, 0, 0, false);
+}
+
+/// Forgets the H extension state, back in L1, e.g. when the vCPU restarts.
+pub fn reset(vcpu: &mut VCpu) {
+    let mut state = STATES[vcpu.hart_id as usize].lock();
+    if in_nested_guest(vcpu.hart_id) {
+        state.vs.write();
+        unsafe {
+            asm!("csrw hvip, {}", in(reg) state.l1_hvip);
+        }
+
+        vcpu.hstatus = state.l1_hstatus;
+        vcpu.hgatp = state.l1_hgatp;
+        vcpu.hedeleg = state.l1_hedeleg;
+        vcpu.hideleg = state.l1_hideleg;
+        IN_L2[vcpu.hart_id as usize].store(false, Ordering::Relaxed);
+        flush_tlbs();
+    }
+
+    state.clear_shadow();
+    *state = Nested { shadow: state.shadow, ..Nested::new() };
+    vcpu.hstatus &= !HSTATUS_VTSR;
+}
@@ -0,0 +1,166 @@
+//! Walks the guest's page table (VS-stage) to translate guest virtual
+//! addresses, for debugging tools like the GDB stub.
+use alloc::vec::Vec;
+use core::{arch::asm, sync::atomic::Ordering};
+
+use crate::{guest_memory::GUEST_MEMORY, smp, vcpu::VCpu};
+
+const PTE_V: u64 = 1 << 0;
+const PTE_R: u64 = 1 << 1;
+const PTE_W: u64 = 1 << 2;
+const PTE_X: u64 = 1 << 3;
+const PTE_U: u64 = 1 << 4;
+
+/// Stops listing mappings beyond this, e.g. for a broken page table.
+const MAX_MAPPINGS: usize = 4096;
+
+/// Returns vsatp of the vCPU. It's in the CSR if the vCPU is the current
+/// one, otherwise it's saved in VCpu (see smp::pause_others).
+fn vsatp(vcpu: &VCpu) -> u64 {
+    if vcpu.hart_id != smp::current_hart_id() {
+        return vcpu.vsatp;
+    }
+
+    let vsatp: u64;
+    unsafe {
+        asm!("csrr {}, vsatp", out(reg) vsatp);
+    }
+    vsatp
+}
+
+/// Returns the number of page table levels in vsatp, or None if it's Bare
+/// or unsupported.
+fn levels(vsatp: u64) -> Option<u64> {
+    match vsatp >> 60 {
+        8 => Some(3), // Sv39
+        9 => Some(4), // Sv48
+        _ => None,
+    }
+}
+
+/// Translates a guest virtual address into a guest physical address.
+pub fn translate_gva(vcpu: &VCpu, guest_vaddr: u64) -> Option<u64> {
+    let vsatp = vsatp(vcpu);
+    if vsatp >> 60 == 0 {
+        return Some(guest_vaddr); // Bare
+    }
+
+    let levels = levels(vsatp)?;
+
+    // Upper bits must be copies of the most significant bit.
+    let va_bits = 12 + 9 * levels;
+    let upper = (guest_vaddr as i64) >> (va_bits - 1);
+    if upper != 0 && upper != -1 {
+        return None;
+    }
+
+    let mut table = (vsatp & ((1 << 44) - 1)) << 12;
+    for level in (0..levels).rev() {
+        let index = (guest_vaddr >> (12 + 9 * level)) & 0x1ff;
+        // The guest may update the PTE concurrently.
+        let pte = GUEST_MEMORY.load_u64(table + index * 8, Ordering::Relaxed)?;
+        if pte & PTE_V == 0 {
+            return None;
+        }
+
+        let paddr = ((pte >> 10) & ((1 << 44) - 1)) << 12;
+        if pte & (PTE_R | PTE_X) != 0 {
+            // A leaf entry, possibly a superpage.
+            let offset_mask = (1 << (12 + 9 * level)) - 1;
+            return Some((paddr & !offset_mask) | (guest_vaddr & offset_mask));
+        }
+
+        table = paddr;
+    }
+
+    None
+}
+
+/// Translates a guest virtual address into a host address.
+pub fn gva_to_host(vcpu: &VCpu, guest_vaddr: u64) -> Option<*mut u8> {
+    let guest_paddr = translate_gva(vcpu, guest_vaddr)?;
+    GUEST_MEMORY.contains(guest_paddr).then(|| GUEST_MEMORY.host_addr(guest_paddr))
+}
+
+/// Reads the guest memory at a virtual address. Returns None if any page is
+/// not mapped.
+pub fn read(vcpu: &VCpu, guest_vaddr: u64, buf: &mut [u8]) -> Option<()> {
+    for (i, byte) in buf.iter_mut().enumerate() {
+        *byte = unsafe { *gva_to_host(vcpu, guest_vaddr + i as u64)? };
+    }
+    Some(())
+}
+
+pub fn write(vcpu: &VCpu, guest_vaddr: u64, data: &[u8]) -> Option<()> {
+    for (i, byte) in data.iter().enumerate() {
+        unsafe { *gva_to_host(vcpu, guest_vaddr + i as u64)? = *byte };
+    }
+    Some(())
+}
+
+/// Contiguous pages with the same permissions.
+pub struct Mapping {
+    pub vaddr: u64,
+    pub paddr: u64,
+    pub size: u64,
+    /// PTE_R, PTE_W, PTE_X, and PTE_U.
+    pub flags: u64,
+}
+
+impl Mapping {
+    /// e.g. "rw-s" for a kernel data page.
+    pub fn flags_str(&self) -> [char; 4] {
+        [
+            if self.flags & PTE_R != 0 { 'r' } else { '-' },
+            if self.flags & PTE_W != 0 { 'w' } else { '-' },
+            if self.flags & PTE_X != 0 { 'x' } else { '-' },
+            if self.flags & PTE_U != 0 { 'u' } else { 's' },
+        ]
+    }
+}
+
+/// Lists the guest's virtual memory mappings. Returns None if paging is off.
+pub fn mappings(vcpu: &VCpu) -> Option<Vec<Mapping>> {
+    let vsatp = vsatp(vcpu);
+    let levels = levels(vsatp)?;
+    let mut mappings = Vec::new();
+    walk((vsatp & ((1 << 44) - 1)) << 12, levels, levels - 1, 0, &mut mappings);
+    Some(mappings)
+}
+
+fn walk(table: u64, levels: u64, level: u64, base: u64, mappings: &mut Vec<Mapping>) {
+    for index in 0..512 {
+        if mappings.len() >= MAX_MAPPINGS {
+            return;
+        }
+
+        let Some(pte) = GUEST_MEMORY.load_u64(table + index * 8, Ordering::Relaxed) else {
+            return;
+        };
+
+        if pte & PTE_V == 0 {
+            continue;
+        }
+
+        let vaddr = base | (index << (12 + 9 * level));
+        let paddr = ((pte >> 10) & ((1 << 44) - 1)) << 12;
+        if pte & (PTE_R | PTE_X) == 0 {
+            if level > 0 {
+                walk(paddr, levels, level - 1, vaddr, mappings);
+            }
+            continue;
+        }
+
+        // Sign-extend the most significant bit.
+        let shift = 64 - (12 + 9 * levels);
+        let vaddr = (((vaddr << shift) as i64) >> shift) as u64;
+        let size = 1 << (12 + 9 * level);
+        let flags = pte & (PTE_R | PTE_W | PTE_X | PTE_U);
+        match mappings.last_mut() {
+            Some(last) if last.vaddr + last.size == vaddr && last.paddr + last.size == paddr && last.flags == flags => {
+                last.size += size;
+            }
+            _ => mappings.push(Mapping { vaddr, paddr, size, flags }),
+        }
+    }
+}
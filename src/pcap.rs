@@ -0,0 +1,53 @@
+//! Packet capture (`-net host,pcap=<port>`): every frame through virtio-net,
+//! in both directions, goes to a port of the host virtio console in the
+//! pcap format. `PCAP=out.pcap ./run.sh` writes it to a file for Wireshark
+//! (`-chardev file,path=out.pcap -device virtserialport,name=pcap`).
+use alloc::{string::String, vec::Vec};
+use spin::Once;
+
+use crate::host_console;
+
+/// The pcap format with nanosecond timestamps.
+const PCAP_MAGIC_NS: u32 = 0xa1b2_3c4d;
+const LINKTYPE_ETHERNET: u32 = 1;
+/// Frames are truncated to this in the capture.
+const SNAPLEN: u32 = 65535;
+
+static PORT: Once<String> = Once::new();
+
+/// Writes the file header. Call this after the host console is initialized.
+pub fn init(port: &str) {
+    assert!(host_console::has_port(port), "-net: pcap: no port \"{}\" in the host virtio console", port);
+    PORT.call_once(|| String::from(port));
+
+    // struct pcap_hdr: magic, version 2.4, thiszone, sigfigs, snaplen, network
+    let mut header = Vec::with_capacity(24);
+    header.extend_from_slice(&PCAP_MAGIC_NS.to_le_bytes());
+    header.extend_from_slice(&2u16.to_le_bytes());
+    header.extend_from_slice(&4u16.to_le_bytes());
+    header.extend_from_slice(&0i32.to_le_bytes());
+    header.extend_from_slice(&0u32.to_le_bytes());
+    header.extend_from_slice(&SNAPLEN.to_le_bytes());
+    header.extend_from_slice(&LINKTYPE_ETHERNET.to_le_bytes());
+    host_console::write(port, &header);
+    info!("pcap", "capturing virtio-net frames to the \"{}\" port", port);
+}
+
+/// Records a frame sent or received by the guest, at the host's wall-clock
+/// time.
+pub fn record(frame: &[u8]) {
+    let Some(port) = PORT.get() else {
+        return;
+    };
+
+    let time = crate::host_rtc::now();
+    let len = (frame.len() as u32).min(SNAPLEN);
+    // struct pcaprec_hdr: ts_sec, ts_nsec, incl_len, orig_len
+    let mut record = Vec::with_capacity(16 + len as usize);
+    record.extend_from_slice(&((time / 1_000_000_000) as u32).to_le_bytes());
+    record.extend_from_slice(&((time % 1_000_000_000) as u32).to_le_bytes());
+    record.extend_from_slice(&len.to_le_bytes());
+    record.extend_from_slice(&(frame.len() as u32).to_le_bytes());
+    record.extend_from_slice(&frame[..len as usize]);
+    host_console::write(port, &record);
+}
@@ -0,0 +1,459 @@
+//! `-pci`: a PCI host bridge with ECAM (`pci-host-ecam-generic`, Linux's
+//! CONFIG_PCI_HOST_GENERIC), with the virtio devices as virtio-pci ones on
+//! bus 0 instead of virtio-mmio.
+//!
+//! Each function has a 32-bit memory BAR 0, allocated from the "pci-mmio"
+//! window at boot (the guest may move it), with the device's registers
+//! followed by the MSI-X table and the PBA. INTA of slot N is the PLIC source
+//! N % 4 from the "pci-ecam" IRQ. MSI-X messages are writes on the MMIO bus,
+//! where an MSI controller would be: the PLIC-only machine has none, so the
+//! guest uses INTx.
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    config::config,
+    machine,
+    mmio_bus::{self, ReadFn, WriteFn},
+    plic,
+    snapshot::{self, Reader, Section, Snapshot, Writer},
+};
+
+/// Bus 0 only.
+pub const MAX_SLOTS: usize = 32;
+const NUM_INTX_LINES: u32 = 4;
+
+const CONFIG_SPACE_SIZE: u64 = 0x1000;
+const COMMAND_MEMORY: u16 = 1 << 1;
+const COMMAND_BUS_MASTER: u16 = 1 << 2;
+const COMMAND_INTX_DISABLE: u16 = 1 << 10;
+const STATUS_INTERRUPT: u16 = 1 << 3;
+const STATUS_CAP_LIST: u16 = 1 << 4;
+
+const CAP_ID_VENDOR: u8 = 0x09;
+const CAP_ID_MSIX: u8 = 0x11;
+/// The MSI-X capability, followed by the vendor-specific ones.
+const MSIX_CAP_OFFSET: usize = 0x40;
+const MSIX_CAP_LEN: usize = 12;
+const MSIX_ENABLE: u16 = 1 << 15;
+const MSIX_FUNCTION_MASK: u16 = 1 << 14;
+const MSIX_ENTRY_SIZE: u64 = 16;
+const MSIX_VECTOR_MASKED: u32 = 1 << 0;
+/// The PBA is a u64 bitmap.
+pub const MAX_VECTORS: u16 = 64;
+
+/// What a device provides to be a PCI function.
+pub struct FunctionConfig {
+    pub vendor_id: u16,
+    pub device_id: u16,
+    pub subsystem_id: u16,
+    pub class: u32,
+    /// The size of the device's registers at the start of BAR 0.
+    pub regs_size: u64,
+    pub num_vectors: u16,
+    /// Vendor-specific capabilities: the bytes after the capability ID and
+    /// the next pointer.
+    pub capabilities: Vec<Vec<u8>>,
+    /// Accesses to the device's registers in BAR 0.
+    pub read: ReadFn,
+    pub write: WriteFn,
+}
+
+struct Function {
+    config: FunctionConfig,
+    /// The capability list from MSIX_CAP_OFFSET, without the MSI-X message
+    /// control (`msix_control`).
+    capabilities: Vec<u8>,
+    command: u16,
+    bar: u32,
+    /// The address `bar` is reset to.
+    initial_bar: u32,
+    interrupt_line: u8,
+    /// Whether the device asserts INTx.
+    intx: bool,
+    msix_control: u16,
+    /// (address low, address high, data, vector control) per vector.
+    msix_table: Vec<[u32; 4]>,
+    msix_pending: u64,
+}
+
+static FUNCTIONS: Mutex<Vec<Function>> = Mutex::new(Vec::new());
+
+impl Function {
+    fn msix_table_offset(&self) -> u64 {
+        self.config.regs_size.next_multiple_of(0x1000)
+    }
+
+    fn msix_pba_offset(&self) -> u64 {
+        self.msix_table_offset() + 0x1000
+    }
+
+    fn bar_size(&self) -> u64 {
+        (self.msix_pba_offset() + 0x1000).next_power_of_two()
+    }
+
+    fn read_config(&self, reg: usize) -> u32 {
+        let config = &self.config;
+        match reg {
+            0x00 => config.vendor_id as u32 | (config.device_id as u32) << 16,
+            0x04 => {
+                let status = STATUS_CAP_LIST | if self.intx { STATUS_INTERRUPT } else { 0 };
+                self.command as u32 | (status as u32) << 16
+            }
+            // Revision 1 (virtio 1.0 devices must have one).
+            0x08 => 1 | config.class << 8,
+            // A 32-bit memory BAR, not prefetchable.
+            0x10 => self.bar,
+            0x2c => config.vendor_id as u32 | (config.subsystem_id as u32) << 16,
+            0x34 => MSIX_CAP_OFFSET as u32,
+            // INTA.
+            0x3c => self.interrupt_line as u32 | 1 << 8,
+            MSIX_CAP_OFFSET => {
+                let control = self.msix_control | (config.num_vectors - 1);
+                CAP_ID_MSIX as u32 | (self.capabilities[1] as u32) << 8 | (control as u32) << 16
+            }
+            _ if reg >= MSIX_CAP_OFFSET && reg < MSIX_CAP_OFFSET + self.capabilities.len() => {
+                let offset = reg - MSIX_CAP_OFFSET;
+                u32::from_le_bytes(self.capabilities[offset..offset + 4].try_into().unwrap())
+            }
+            _ => 0,
+        }
+    }
+
+    /// Returns true if the INTx or MSI-X state may have changed.
+    fn write_config(&mut self, reg: usize, value: u32) -> bool {
+        match reg {
+            0x04 => {
+                self.command = value as u16 & (COMMAND_MEMORY | COMMAND_BUS_MASTER | COMMAND_INTX_DISABLE);
+                true
+            }
+            // The low bits are hardwired to zero: writing all ones reads the
+            // size.
+            0x10 => {
+                self.bar = value & !(self.bar_size() as u32 - 1);
+                false
+            }
+            0x3c => {
+                self.interrupt_line = value as u8;
+                false
+            }
+            MSIX_CAP_OFFSET => {
+                self.msix_control = (value >> 16) as u16 & (MSIX_ENABLE | MSIX_FUNCTION_MASK);
+                true
+            }
+            _ => false,
+        }
+    }
+
+    fn msix_enabled(&self) -> bool {
+        self.msix_control & MSIX_ENABLE != 0
+    }
+
+    fn vector_masked(&self, vector: usize) -> bool {
+        self.msix_control & MSIX_FUNCTION_MASK != 0 || self.msix_table[vector][3] & MSIX_VECTOR_MASKED != 0
+    }
+
+    /// Takes the pending vectors which are no longer masked.
+    fn take_unmasked(&mut self) -> Vec<(u64, u32)> {
+        if !self.msix_enabled() {
+            return Vec::new();
+        }
+
+        let mut messages = Vec::new();
+        for vector in 0..self.msix_table.len() {
+            if self.msix_pending & (1 << vector) != 0 && !self.vector_masked(vector) {
+                self.msix_pending &= !(1 << vector);
+                messages.push(self.message(vector));
+            }
+        }
+        messages
+    }
+
+    fn message(&self, vector: usize) -> (u64, u32) {
+        let [addr_low, addr_high, data, _] = self.msix_table[vector];
+        ((addr_high as u64) << 32 | addr_low as u64, data)
+    }
+}
+
+/// INTx is level-triggered and shared by every 4th slot.
+fn update_intx(functions: &[Function], line: u32) {
+    let (_, _, irq) = machine::device_region("pci-ecam");
+    let asserted = functions.iter().enumerate().any(|(slot, function)| {
+        slot as u32 % NUM_INTX_LINES == line && function.intx && function.command & COMMAND_INTX_DISABLE == 0
+    });
+    plic::set_irq_level(irq + line, asserted);
+}
+
+/// Sends MSI-X messages: memory writes from the device.
+fn send_messages(messages: Vec<(u64, u32)>) {
+    for (addr, data) in messages {
+        if mmio_bus::write(addr, data as u64, 4).is_none() {
+            warn!("pci", "no MSI controller at {:#x}: dropping an MSI-X message", addr);
+        }
+    }
+}
+
+/// Adds a function to the next slot. Returns the slot.
+pub fn add_function(config: FunctionConfig) -> usize {
+    assert!(config.num_vectors > 0 && config.num_vectors <= MAX_VECTORS);
+    let mut functions = FUNCTIONS.lock();
+    let slot = functions.len();
+    assert!(slot < MAX_SLOTS, "[pci] too many devices");
+
+    // Link the capabilities, each at a 4-byte boundary.
+    let mut capabilities = vec![0; MSIX_CAP_LEN];
+    capabilities[0] = CAP_ID_MSIX;
+    let table_offset = config.regs_size.next_multiple_of(0x1000) as u32;
+    capabilities[4..8].copy_from_slice(&table_offset.to_le_bytes());
+    capabilities[8..12].copy_from_slice(&(table_offset + 0x1000).to_le_bytes());
+    let mut prev = 0;
+    for cap in &config.capabilities {
+        let offset = capabilities.len();
+        capabilities[prev + 1] = (MSIX_CAP_OFFSET + offset) as u8;
+        capabilities.extend_from_slice(&[CAP_ID_VENDOR, 0]);
+        capabilities.extend_from_slice(cap);
+        capabilities.resize(capabilities.len().next_multiple_of(4), 0);
+        prev = offset;
+    }
+    assert!(MSIX_CAP_OFFSET + capabilities.len() <= 0x100, "[pci] capabilities too large");
+
+    let num_vectors = config.num_vectors as usize;
+    let mut function = Function {
+        config,
+        capabilities,
+        command: 0,
+        bar: 0,
+        initial_bar: 0,
+        interrupt_line: 0,
+        intx: false,
+        msix_control: 0,
+        msix_table: vec![[0, 0, 0, MSIX_VECTOR_MASKED]; num_vectors],
+        msix_pending: 0,
+    };
+
+    // Allocate BAR 0 at its natural alignment, after the others.
+    let (window, window_end, _) = machine::device_region("pci-mmio");
+    let base = functions.iter().map(|f| f.initial_bar as u64 + f.bar_size()).max().unwrap_or(window);
+    let bar = base.next_multiple_of(function.bar_size());
+    assert!(bar + function.bar_size() <= window_end, "[pci] out of the MMIO window");
+    function.bar = bar as u32;
+    function.initial_bar = bar as u32;
+
+    info!("pci", "00:{:02x}.0: {:04x}:{:04x} at {:#x}", slot, function.config.vendor_id, function.config.device_id, bar);
+    functions.push(function);
+    slot
+}
+
+/// Updates the INTx line of a function.
+pub fn set_intx(slot: usize, asserted: bool) {
+    let mut functions = FUNCTIONS.lock();
+    functions[slot].intx = asserted;
+    update_intx(&functions, slot as u32 % NUM_INTX_LINES);
+}
+
+/// Whether the driver uses MSI-X instead of INTx.
+pub fn msix_enabled(slot: usize) -> bool {
+    FUNCTIONS.lock()[slot].msix_enabled()
+}
+
+/// Sends the MSI-X message of `vector`, or keeps it pending while masked.
+pub fn send_msix(slot: usize, vector: u16) {
+    let message = {
+        let mut functions = FUNCTIONS.lock();
+        let function = &mut functions[slot];
+        let vector = vector as usize;
+        if vector >= function.msix_table.len() {
+            return;
+        }
+
+        if function.vector_masked(vector) {
+            function.msix_pending |= 1 << vector;
+            return;
+        }
+
+        function.message(vector)
+    };
+
+    send_messages(vec![message]);
+}
+
+/// The enabled BAR at a guest address: (slot, offset in the BAR).
+fn find_bar(functions: &[Function], guest_addr: u64) -> Option<(usize, u64)> {
+    functions.iter().enumerate().find_map(|(slot, function)| {
+        let bar = function.bar as u64;
+        let enabled = function.command & COMMAND_MEMORY != 0;
+        (enabled && (bar..bar + function.bar_size()).contains(&guest_addr)).then(|| (slot, guest_addr - bar))
+    })
+}
+
+fn ecam_read(offset: u64, width: u64) -> u64 {
+    let slot = (offset / (8 * CONFIG_SPACE_SIZE)) as usize;
+    let function_number = (offset / CONFIG_SPACE_SIZE) % 8;
+    let reg = (offset % CONFIG_SPACE_SIZE) as usize;
+    let functions = FUNCTIONS.lock();
+    let Some(function) = functions.get(slot).filter(|_| function_number == 0) else {
+        // No device: the vendor ID reads as 0xffff.
+        return u64::MAX >> (64 - 8 * width);
+    };
+
+    let dword = function.read_config(reg & !3) as u64;
+    (dword >> (8 * (reg & 3))) & (u64::MAX >> (64 - 8 * width))
+}
+
+fn ecam_write(offset: u64, value: u64, width: u64) {
+    let slot = (offset / (8 * CONFIG_SPACE_SIZE)) as usize;
+    let function_number = (offset / CONFIG_SPACE_SIZE) % 8;
+    let reg = (offset % CONFIG_SPACE_SIZE) as usize;
+    let mut functions = FUNCTIONS.lock();
+    let Some(function) = functions.get_mut(slot).filter(|_| function_number == 0) else {
+        return;
+    };
+
+    // Merge a partial write into the dword.
+    let shift = 8 * (reg & 3);
+    let mask = (u64::MAX >> (64 - 8 * width)) << shift;
+    let dword = function.read_config(reg & !3) as u64;
+    let dword = ((dword & !mask) | ((value << shift) & mask)) as u32;
+    if !function.write_config(reg & !3, dword) {
+        return;
+    }
+
+    let messages = function.take_unmasked();
+    update_intx(&functions, slot as u32 % NUM_INTX_LINES);
+    drop(functions);
+    send_messages(messages);
+}
+
+fn mmio_read(offset: u64, width: u64) -> u64 {
+    let (window, _, _) = machine::device_region("pci-mmio");
+    let functions = FUNCTIONS.lock();
+    let Some((slot, offset)) = find_bar(&functions, window + offset) else {
+        return u64::MAX >> (64 - 8 * width);
+    };
+
+    let function = &functions[slot];
+    let (table, pba) = (function.msix_table_offset(), function.msix_pba_offset());
+    match offset {
+        _ if offset < function.config.regs_size => {
+            // Don't hold the lock while the device handles the access.
+            let read = function.config.read;
+            drop(functions);
+            read(offset, width)
+        }
+        _ if (table..table + function.msix_table.len() as u64 * MSIX_ENTRY_SIZE).contains(&offset) => {
+            let entry = ((offset - table) / MSIX_ENTRY_SIZE) as usize;
+            let word = ((offset - table) % MSIX_ENTRY_SIZE / 4) as usize;
+            let value = function.msix_table[entry][word] as u64;
+            // The message address may be read as a u64.
+            if width == 8 && word % 2 == 0 { value | (function.msix_table[entry][word + 1] as u64) << 32 } else { value }
+        }
+        _ if offset == pba => function.msix_pending & (u64::MAX >> (64 - 8 * width)),
+        _ if offset == pba + 4 => function.msix_pending >> 32,
+        _ => 0,
+    }
+}
+
+fn mmio_write(offset: u64, value: u64, width: u64) {
+    let (window, _, _) = machine::device_region("pci-mmio");
+    let mut functions = FUNCTIONS.lock();
+    let Some((slot, offset)) = find_bar(&functions, window + offset) else {
+        return;
+    };
+
+    let function = &mut functions[slot];
+    let table = function.msix_table_offset();
+    if offset < function.config.regs_size {
+        let write = function.config.write;
+        drop(functions);
+        write(offset, value, width);
+    } else if (table..table + function.msix_table.len() as u64 * MSIX_ENTRY_SIZE).contains(&offset) {
+        let entry = ((offset - table) / MSIX_ENTRY_SIZE) as usize;
+        let word = ((offset - table) % MSIX_ENTRY_SIZE / 4) as usize;
+        function.msix_table[entry][word] = value as u32;
+        if width == 8 && word % 2 == 0 {
+            function.msix_table[entry][word + 1] = (value >> 32) as u32;
+        }
+
+        // Unmasking a vector sends its pending message.
+        let messages = function.take_unmasked();
+        drop(functions);
+        send_messages(messages);
+    }
+}
+
+impl Snapshot for Function {
+    const VERSION: u32 = 1;
+
+    fn save(&self, w: &mut Writer) {
+        w.u32(self.command as u32);
+        w.u32(self.bar);
+        w.u8(self.interrupt_line);
+        w.u8(self.intx as u8);
+        w.u32(self.msix_control as u32);
+        w.u64(self.msix_pending);
+        for entry in &self.msix_table {
+            for value in entry {
+                w.u32(*value);
+            }
+        }
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        self.command = r.u32()? as u16;
+        self.bar = r.u32()?;
+        self.interrupt_line = r.u8()?;
+        self.intx = r.u8()? != 0;
+        self.msix_control = r.u32()? as u16;
+        self.msix_pending = r.u64()?;
+        for entry in &mut self.msix_table {
+            for value in entry {
+                *value = r.u32()?;
+            }
+        }
+        Some(())
+    }
+}
+
+/// Registers the ECAM space and the MMIO window. Devices add themselves with
+/// `add_function`.
+pub fn init() {
+    let (addr, end, _) = machine::device_region("pci-ecam");
+    mmio_bus::register("pci-ecam", addr, end, ecam_read, ecam_write);
+    let (addr, end, _) = machine::device_region("pci-mmio");
+    mmio_bus::register("pci-mmio", addr, end, mmio_read, mmio_write);
+}
+
+/// Resets the functions to the state on boot. Devices reset their interrupt
+/// state by themselves.
+pub fn reset() {
+    let mut functions = FUNCTIONS.lock();
+    for function in functions.iter_mut() {
+        function.command = 0;
+        function.bar = function.initial_bar;
+        function.interrupt_line = 0;
+        function.msix_control = 0;
+        function.msix_pending = 0;
+        function.msix_table.fill([0, 0, 0, MSIX_VECTOR_MASKED]);
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    if !config().pci {
+        return;
+    }
+
+    for (slot, function) in FUNCTIONS.lock().iter().enumerate() {
+        w.section(&format!("pci{}", slot), function);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    if !config().pci {
+        return Ok(());
+    }
+
+    for (slot, function) in FUNCTIONS.lock().iter_mut().enumerate() {
+        snapshot::load_section(sections, &format!("pci{}", slot), function)?;
+    }
+    Ok(())
+}
@@ -0,0 +1,219 @@
+use alloc::string::String;
+use spin::Mutex;
+
+use crate::{
+    machine,
+    metrics, mmio_bus,
+    smp::{self, MAX_VCPUS},
+    snapshot::{self, Reader, Section, Snapshot, Writer},
+};
+
+pub const NUM_SOURCES: usize = 32; // Source 0 is reserved.
+const NUM_CONTEXTS: usize = 2 * MAX_VCPUS; // M-mode and S-mode for each hart.
+/// Priorities and thresholds are 3 bits wide (0-7).
+const PRIORITY_MASK: u32 = 0x7;
+
+struct Plic {
+    priority: [u32; NUM_SOURCES],
+    /// Sources with its interrupt line asserted.
+    level: u32,
+    pending: u32,
+    /// Sources claimed but not completed yet.
+    in_service: u32,
+    enable: [u32; NUM_CONTEXTS],
+    threshold: [u32; NUM_CONTEXTS],
+}
+
+static PLIC: Mutex<Plic> = Mutex::new(Plic {
+    priority: [0; NUM_SOURCES],
+    level: 0,
+    pending: 0,
+    in_service: 0,
+    enable: [0; NUM_CONTEXTS],
+    threshold: [0; NUM_CONTEXTS],
+});
+
+impl Plic {
+    /// Returns the pending and enabled source with the highest priority
+    /// above the threshold. Ties are broken by the lowest ID.
+    fn highest_pending(&self, context: usize) -> Option<u32> {
+        let mut best: Option<(u32, u32)> = None;
+        let mut candidates = self.pending & self.enable[context];
+        while candidates != 0 {
+            let irq = candidates.trailing_zeros();
+            candidates &= !(1 << irq);
+
+            let priority = self.priority[irq as usize];
+            if priority > self.threshold[context] && best.is_none_or(|(_, p)| priority > p) {
+                best = Some((irq, priority));
+            }
+        }
+
+        best.map(|(irq, _)| irq)
+    }
+
+    /// Asserts or de-asserts VSEIP on each hart.
+    fn update(&self) {
+        for hart_id in 0..smp::num_vcpus() {
+            let context = 2 * hart_id + 1; // S-mode
+            let asserted = self.highest_pending(context).is_some();
+            smp::set_external_interrupt(hart_id as u64, asserted);
+        }
+    }
+
+    fn claim(&mut self, context: usize) -> u32 {
+        let Some(irq) = self.highest_pending(context) else {
+            return 0;
+        };
+
+        self.pending &= !(1 << irq);
+        self.in_service |= 1 << irq;
+        self.update();
+        irq
+    }
+
+    fn complete(&mut self, context: usize, irq: u32) {
+        // "If the completion ID does not match an interrupt source that is
+        // currently enabled for the target, the completion is silently ignored."
+        if irq as usize >= NUM_SOURCES || self.enable[context] & (1 << irq) == 0 {
+            return;
+        }
+
+        self.in_service &= !(1 << irq);
+        if self.level & (1 << irq) != 0 {
+            self.pending |= 1 << irq;
+        }
+        self.update();
+    }
+}
+
+impl Snapshot for Plic {
+    const VERSION: u32 = 1;
+
+    fn save(&self, w: &mut Writer) {
+        for value in self.priority.iter().chain(&self.enable).chain(&self.threshold) {
+            w.u32(*value);
+        }
+        w.u32(self.level);
+        w.u32(self.pending);
+        w.u32(self.in_service);
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        for value in self.priority.iter_mut().chain(&mut self.enable).chain(&mut self.threshold) {
+            *value = r.u32()?;
+        }
+        self.level = r.u32()?;
+        self.pending = r.u32()?;
+        self.in_service = r.u32()?;
+        Some(())
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    w.section("plic", &*PLIC.lock());
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    let mut plic = PLIC.lock();
+    snapshot::load_section(sections, "plic", &mut *plic)?;
+    plic.update();
+    Ok(())
+}
+
+/// Resets the PLIC to the state on boot. Devices reset their interrupt
+/// lines by themselves.
+pub fn reset() {
+    let mut plic = PLIC.lock();
+    plic.priority = [0; NUM_SOURCES];
+    plic.pending = plic.level;
+    plic.in_service = 0;
+    plic.enable = [0; NUM_CONTEXTS];
+    plic.threshold = [0; NUM_CONTEXTS];
+    plic.update();
+}
+
+/// Updates the interrupt line of a device (level-triggered).
+pub fn set_irq_level(irq: u32, asserted: bool) {
+    let mut plic = PLIC.lock();
+    if asserted {
+        if plic.level & (1 << irq) == 0 {
+            metrics::record_external_interrupt(irq);
+        }
+
+        plic.level |= 1 << irq;
+        if plic.in_service & (1 << irq) == 0 {
+            plic.pending |= 1 << irq;
+        }
+    } else {
+        plic.level &= !(1 << irq);
+        plic.pending &= !(1 << irq);
+    }
+    plic.update();
+}
+
+pub fn init() {
+    let (addr, end, _) = machine::device_region("plic");
+    mmio_bus::register("plic", addr, end, mmio_read, mmio_write);
+}
+
+pub fn mmio_read(offset: u64, _width: u64) -> u64 {
+    let mut plic = PLIC.lock();
+    let value = match offset {
+        0x0..0x1000 => plic.priority.get(offset as usize / 4).copied().unwrap_or(0),
+        0x1000 => plic.pending,
+        0x2000..0x200000 => {
+            let context = (offset as usize - 0x2000) / 0x80;
+            match ((offset - 0x2000) % 0x80, plic.enable.get(context)) {
+                (0, Some(enable)) => *enable,
+                _ => 0,
+            }
+        }
+        0x200000.. => {
+            let context = (offset as usize - 0x200000) / 0x1000;
+            match (offset % 0x1000, context < NUM_CONTEXTS) {
+                (0x0, true) => plic.threshold[context],
+                (0x4, true) => plic.claim(context),
+                _ => 0,
+            }
+        }
+        _ => 0,
+    };
+
+    value as u64
+}
+
+pub fn mmio_write(offset: u64, value: u64, _width: u64) {
+    let value = value as u32;
+    let mut plic = PLIC.lock();
+    match offset {
+        // Source 0 does not exist: its priority is hardwired to zero.
+        0x4..0x1000 => {
+            if let Some(priority) = plic.priority.get_mut(offset as usize / 4) {
+                *priority = value & PRIORITY_MASK;
+                plic.update();
+            }
+        }
+        0x2000..0x200000 => {
+            let context = (offset as usize - 0x2000) / 0x80;
+            if (offset - 0x2000) % 0x80 == 0 && context < NUM_CONTEXTS {
+                plic.enable[context] = value & !1; // Source 0 does not exist.
+                plic.update();
+            }
+        }
+        0x200000.. => {
+            let context = (offset as usize - 0x200000) / 0x1000;
+            match (offset % 0x1000, context < NUM_CONTEXTS) {
+                (0x0, true) => {
+                    plic.threshold[context] = value & PRIORITY_MASK;
+                    plic.update();
+                }
+                (0x4, true) => plic.complete(context, value),
+                _ => {}
+            }
+        }
+        _ => {
+            warn!("plic", "ignore write at {:#x}", offset);
+        }
+    }
+}
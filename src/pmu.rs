@@ -0,0 +1,69 @@
+//! The SBI PMU extension for `perf` in the guest.
+//!
+//! Each vCPU has a physical hart of its own, so we pass the host's counters
+//! through: the guest configures them through OpenSBI and reads them with
+//! the counter CSRs (see hcounteren in VCpu::run). Counting only: overflow
+//! interrupts (Sscofpmf) are not forwarded, so `perf record` doesn't work.
+use core::sync::atomic::{AtomicBool, Ordering};
+
+use crate::{sbi, vcpu::VCpu};
+
+const FID_NUM_COUNTERS: u64 = 0;
+const FID_COUNTER_GET_INFO: u64 = 1;
+const FID_COUNTER_CONFIG_MATCHING: u64 = 2;
+const FID_COUNTER_START: u64 = 3;
+const FID_COUNTER_STOP: u64 = 4;
+const FID_COUNTER_FW_READ: u64 = 5;
+const FID_COUNTER_FW_READ_HI: u64 = 6;
+
+const CFG_FLAG_SET_VUINH: u64 = 1 << 3;
+const CFG_FLAG_SET_VSINH: u64 = 1 << 4;
+const CFG_FLAG_SET_UINH: u64 = 1 << 5;
+const CFG_FLAG_SET_SINH: u64 = 1 << 6;
+
+const SBI_ERR_NOT_SUPPORTED: i64 = -2;
+
+static AVAILABLE: AtomicBool = AtomicBool::new(false);
+
+pub fn init() {
+    AVAILABLE.store(sbi::has_pmu(), Ordering::Relaxed);
+}
+
+/// Whether the host firmware implements the PMU extension.
+pub fn is_available() -> bool {
+    AVAILABLE.load(Ordering::Relaxed)
+}
+
+/// The guest's U-mode and S-mode are VU-mode and VS-mode for the host, and
+/// the hypervisor itself is never counted.
+fn host_config_flags(flags: u64) -> u64 {
+    let mut host_flags = flags & !(CFG_FLAG_SET_VUINH | CFG_FLAG_SET_VSINH | CFG_FLAG_SET_UINH | CFG_FLAG_SET_SINH);
+    if flags & CFG_FLAG_SET_UINH != 0 {
+        host_flags |= CFG_FLAG_SET_VUINH;
+    }
+    if flags & CFG_FLAG_SET_SINH != 0 {
+        host_flags |= CFG_FLAG_SET_VSINH;
+    }
+
+    host_flags | CFG_FLAG_SET_UINH | CFG_FLAG_SET_SINH
+}
+
+pub fn handle_sbi_call(vcpu: &VCpu, fid: u64) -> Result<i64, i64> {
+    if !is_available() {
+        return Err(SBI_ERR_NOT_SUPPORTED);
+    }
+
+    let args = match fid {
+        FID_NUM_COUNTERS
+        | FID_COUNTER_GET_INFO
+        | FID_COUNTER_START
+        | FID_COUNTER_STOP
+        | FID_COUNTER_FW_READ
+        | FID_COUNTER_FW_READ_HI => [vcpu.a0, vcpu.a1, vcpu.a2, vcpu.a3, vcpu.a4],
+        FID_COUNTER_CONFIG_MATCHING => [vcpu.a0, vcpu.a1, host_config_flags(vcpu.a2), vcpu.a3, vcpu.a4],
+        // The snapshot shared memory and the rest.
+        _ => return Err(SBI_ERR_NOT_SUPPORTED),
+    };
+
+    sbi::pmu_call(fid, args).map(|value| value as i64)
+}
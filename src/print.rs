@@ -1,5 +1,7 @@
 use core::arch::asm;
 
+use crate::host_uart;
+
 pub fn sbi_putchar(ch: u8) {
     unsafe {
         asm!(
@@ -12,10 +14,25 @@ pub fn sbi_putchar(ch: u8) {
     }
 }
 
+/// Writes to the hypervisor's console: through the ring of `-async-console`
+/// if enabled.
+pub fn putchar(ch: u8) {
+    if host_uart::is_async() {
+        host_uart::write(&[ch]);
+    } else {
+        sbi_putchar(ch);
+    }
+}
+
 pub struct Printer;
 
 impl core::fmt::Write for Printer {
     fn write_str(&mut self, s: &str) -> core::fmt::Result {
+        if host_uart::is_async() {
+            host_uart::write(s.as_bytes());
+            return Ok(());
+        }
+
         for byte in s.bytes() {
             sbi_putchar(byte);
         }
@@ -0,0 +1,258 @@
+//! `-pprof`: a profile of the hypervisor in the pprof format, served over
+//! HTTP on the "pprof" port of the host virtio console, like `-metrics`:
+//!
+//! ```text
+//! $ socat TCP-LISTEN:6060,fork,reuseaddr UNIX-CONNECT:pprof.sock
+//! $ go tool pprof -http=: http://localhost:6060/debug/pprof/profile
+//! ```
+//!
+//! The time on each vCPU is split into the guest's and the VM exits', by
+//! exit reason and by the device which has handled it (the MMIO region, or
+//! the host device which has interrupted). Samples are labeled with
+//! `vcpu=<id>` and `dev=<device>`, so that `-tagfocus dev=virtio-blk` or
+//! `-tagroot vcpu` attributes the hypervisor's time to the guest's
+//! components. These are not sampled from stack traces: each exit is timed.
+//!
+//! The profile covers the time since the boot. For a window, take two and
+//! compare them: `go tool pprof -diff_base before.pb.gz after.pb.gz`.
+use alloc::{collections::BTreeMap, format, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::{config::config, host_console, host_rtc, smp, smp::MAX_VCPUS, timer::{ticks_to_ns, NS_PER_TICK}, trace};
+
+/// `-device virtserialport,name=pprof` in run.sh.
+const PORT: &str = "pprof";
+
+/// (vCPU, exit reason, device). The reason is None for the time in the guest.
+type Key = (u64, Option<&'static str>, Option<&'static str>);
+
+struct Profile {
+    /// (exits, ticks).
+    samples: BTreeMap<Key, (u64, u64)>,
+    /// When each vCPU entered the guest last time. 0 if not yet.
+    entered_at: [u64; MAX_VCPUS],
+    /// The device handling the current VM exit on each vCPU.
+    devices: [Option<&'static str>; MAX_VCPUS],
+    /// When the profile started, in ticks and in nanoseconds since the epoch.
+    started_at: (u64, u64),
+    /// Received bytes of the HTTP request.
+    request: Vec<u8>,
+    connected: bool,
+}
+
+static PROFILE: Mutex<Profile> = Mutex::new(Profile {
+    samples: BTreeMap::new(),
+    entered_at: [0; MAX_VCPUS],
+    devices: [None; MAX_VCPUS],
+    started_at: (0, 0),
+    request: Vec::new(),
+    connected: false,
+});
+
+pub fn init() {
+    assert!(host_console::has_port(PORT), "[pprof] virtio-console port \"{}\" not found", PORT);
+    PROFILE.lock().started_at = (trace::now(), host_rtc::now());
+    info!("pprof", "ready: connect to pprof.sock");
+}
+
+/// The VM exit being handled on this hart is for `device`, e.g. an MMIO
+/// access to "virtio-blk".
+pub fn set_device(device: &'static str) {
+    if !config().pprof {
+        return;
+    }
+
+    let vcpu_id = smp::current_hart_id() as usize;
+    if vcpu_id < MAX_VCPUS {
+        PROFILE.lock().devices[vcpu_id] = Some(device);
+    }
+}
+
+/// Records a VM exit which happened at `start`. Call this right before
+/// returning to the guest.
+pub fn record_exit(vcpu_id: u64, reason: &'static str, start: u64) {
+    if !config().pprof {
+        return;
+    }
+
+    let now = trace::now();
+    let mut profile = PROFILE.lock();
+    let vcpu = vcpu_id as usize;
+    let entered_at = core::mem::replace(&mut profile.entered_at[vcpu], now);
+    if entered_at != 0 {
+        profile.samples.entry((vcpu_id, None, None)).or_default().1 += start - entered_at;
+    }
+
+    let device = profile.devices[vcpu].take();
+    let (exits, ticks) = profile.samples.entry((vcpu_id, Some(reason), device)).or_default();
+    *exits += 1;
+    *ticks += now - start;
+}
+
+/// A protocol buffer message being encoded.
+#[derive(Default)]
+struct Proto(Vec<u8>);
+
+impl Proto {
+    fn varint(&mut self, mut value: u64) {
+        while value >= 0x80 {
+            self.0.push(value as u8 | 0x80);
+            value >>= 7;
+        }
+        self.0.push(value as u8);
+    }
+
+    fn uint(&mut self, field: u64, value: u64) {
+        self.varint(field << 3);
+        self.varint(value);
+    }
+
+    fn bytes(&mut self, field: u64, data: &[u8]) {
+        self.varint((field << 3) | 2);
+        self.varint(data.len() as u64);
+        self.0.extend_from_slice(data);
+    }
+
+    fn message(&mut self, field: u64, build: impl FnOnce(&mut Proto)) {
+        let mut message = Proto::default();
+        build(&mut message);
+        self.bytes(field, &message.0);
+    }
+}
+
+/// The string table of a profile: messages refer to strings by index.
+struct Strings(Vec<String>);
+
+impl Strings {
+    fn index(&mut self, s: &str) -> u64 {
+        let index = self.0.iter().position(|t| t == s).unwrap_or_else(|| {
+            self.0.push(String::from(s));
+            self.0.len() - 1
+        });
+        index as u64
+    }
+}
+
+impl Profile {
+    /// Encodes the profile (profile.proto in github.com/google/pprof).
+    fn encode(&self) -> Vec<u8> {
+        let mut out = Proto::default();
+        let mut strings = Strings(Vec::from([String::new()]));
+        // A function and a location of the same ID for each frame.
+        let mut frames: Vec<String> = Vec::new();
+        let mut frame = |name: &str| -> u64 {
+            let index = frames.iter().position(|f| f == name).unwrap_or_else(|| {
+                frames.push(String::from(name));
+                frames.len() - 1
+            });
+            index as u64 + 1
+        };
+
+        // sample_type: [exits, cpu].
+        for (type_, unit) in [("exits", "count"), ("cpu", "nanoseconds")] {
+            let (type_, unit) = (strings.index(type_), strings.index(unit));
+            out.message(1, |value_type| {
+                value_type.uint(1, type_);
+                value_type.uint(2, unit);
+            });
+        }
+
+        for (&(vcpu_id, reason, device), &(exits, ticks)) in &self.samples {
+            // Leaf first.
+            let locations: Vec<u64> = match reason {
+                None => Vec::from([frame("guest")]),
+                Some(reason) => device.map(&mut frame).into_iter().chain([frame(reason), frame("vm exit")]).collect(),
+            };
+            let mut labels = Vec::from([(strings.index("vcpu"), strings.index(&format!("{}", vcpu_id)))]);
+            if let Some(device) = device {
+                labels.push((strings.index("dev"), strings.index(device)));
+            }
+
+            out.message(2, |sample| {
+                for location in locations {
+                    sample.uint(1, location);
+                }
+                sample.uint(2, exits);
+                sample.uint(2, ticks_to_ns(ticks));
+                for (key, value) in labels {
+                    sample.message(3, |label| {
+                        label.uint(1, key);
+                        label.uint(2, value);
+                    });
+                }
+            });
+        }
+
+        for (i, name) in frames.iter().enumerate() {
+            let id = i as u64 + 1;
+            out.message(4, |location| {
+                location.uint(1, id);
+                location.message(4, |line| line.uint(1, id));
+            });
+            let name = strings.index(name);
+            out.message(5, |function| {
+                function.uint(1, id);
+                function.uint(2, name);
+                function.uint(3, name);
+            });
+        }
+
+        // period_type and period: a tick of the timer.
+        let (cpu, nanoseconds) = (strings.index("cpu"), strings.index("nanoseconds"));
+        for s in &strings.0 {
+            out.bytes(6, s.as_bytes());
+        }
+
+        let (started_ticks, started_ns) = self.started_at;
+        out.uint(9, started_ns);
+        out.uint(10, ticks_to_ns(trace::now() - started_ticks));
+        out.message(11, |value_type| {
+            value_type.uint(1, cpu);
+            value_type.uint(2, nanoseconds);
+        });
+        out.uint(12, NS_PER_TICK);
+        out.0
+    }
+
+    /// Replies to an HTTP request once it has been received.
+    fn poll(&mut self) {
+        let connected = host_console::is_connected(PORT);
+        if connected && !self.connected {
+            self.request.clear();
+        }
+        self.connected = connected;
+
+        while let Some(byte) = host_console::read(PORT) {
+            self.request.push(byte);
+        }
+
+        let Some(end) = self.request.windows(4).position(|window| window == b"\r\n\r\n") else {
+            return;
+        };
+
+        // `go tool pprof` asks for `/debug/pprof/profile?seconds=30`: the
+        // profile is since the boot anyway.
+        let path = self.request.strip_prefix(b"GET /debug/pprof/profile");
+        let is_profile = path.is_some_and(|rest| rest.starts_with(b" ") || rest.starts_with(b"?"));
+        self.request.drain(..end + 4);
+        let (status, content_type, body) = if is_profile {
+            ("200 OK", "application/octet-stream", self.encode())
+        } else {
+            ("404 Not Found", "text/plain", Vec::from(b"not found: try /debug/pprof/profile\n".as_slice()))
+        };
+
+        let header = format!(
+            "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+            status,
+            content_type,
+            body.len()
+        );
+        host_console::write(PORT, header.as_bytes());
+        host_console::write(PORT, &body);
+    }
+}
+
+/// Handles data from the HTTP client.
+pub fn handle_interrupt() {
+    PROFILE.lock().poll();
+}
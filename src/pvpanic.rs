@@ -0,0 +1,46 @@
+//! `-pvpanic`: QEMU's pvpanic device (`qemu,pvpanic-mmio`, Linux's
+//! CONFIG_PVPANIC_MMIO). Linux writes to it from the panic notifier, so that
+//! the crash is handled as `-on-crash` says right away, instead of after the
+//! panic message on the console.
+//!
+//! ```text
+//! read   the events supported
+//! write  1 << 0: the guest has panicked
+//!        1 << 1: the guest has panicked, and boots the kdump kernel
+//! ```
+//!
+//! The kdump kernel handles the crash by itself: it's only reported, with
+//! the GUEST_CRASHLOADED event in the monitor.
+use crate::{crash, machine, mmio_bus, monitor};
+
+const PVPANIC_PANICKED: u64 = 1 << 0;
+const PVPANIC_CRASH_LOADED: u64 = 1 << 1;
+
+pub fn init() {
+    let (addr, end, _) = machine::device_region("pvpanic");
+    mmio_bus::register("pvpanic", addr, end, mmio_read, mmio_write);
+}
+
+fn mmio_read(offset: u64, _width: u64) -> u64 {
+    if offset != 0 {
+        return 0;
+    }
+
+    PVPANIC_PANICKED | PVPANIC_CRASH_LOADED
+}
+
+fn mmio_write(offset: u64, value: u64, _width: u64) {
+    if offset != 0 {
+        return;
+    }
+
+    if value & PVPANIC_CRASH_LOADED != 0 {
+        info!("pvpanic", "the guest has panicked, and boots the kdump kernel");
+        monitor::event("GUEST_CRASHLOADED", "{\"action\": \"run\"}");
+    } else if value & PVPANIC_PANICKED != 0 {
+        // Handled before returning to the guest, on this vCPU.
+        crash::report_panic();
+    } else {
+        warn!("pvpanic", "unknown event: {:#x}", value);
+    }
+}
@@ -0,0 +1,89 @@
+//! Reserved memory (`-reserved-mem`): regions carved out of the end of the
+//! guest RAM and advertised in /reserved-memory of the device tree, e.g. for
+//! CMA, DMA pools, or the memory of a remoteproc firmware:
+//!
+//! ```text
+//! -reserved-mem cma,size=16m,align=4m,compatible=shared-dma-pool,reusable,default
+//! -reserved-mem rproc,size=8m,no-map
+//! ```
+//!
+//! The regions are placed from the top of the RAM downwards in the order
+//! given, each aligned down to its `align` (2MB by default). The initrd and
+//! the kernel go below them.
+use alloc::{format, string::String, vec::Vec};
+
+use crate::{config::config, guest_memory::GUEST_MEMORY};
+
+pub struct Region<'a> {
+    pub name: &'a str,
+    pub base: u64,
+    pub size: u64,
+    pub compatible: Option<&'a str>,
+    pub no_map: bool,
+    pub reusable: bool,
+    /// `linux,cma-default` for a reusable region, `linux,dma-default`
+    /// otherwise.
+    pub default_property: Option<&'static str>,
+}
+
+/// The regions, from the top of the RAM.
+pub fn regions() -> Vec<Region<'static>> {
+    let ram_base = GUEST_MEMORY.guest_base();
+    let mut top = ram_base + GUEST_MEMORY.size() as u64;
+    let mut regions = Vec::new();
+    for region in &config().reserved_mem {
+        let base = top.checked_sub(region.size).map(|base| base & !(region.align - 1)).filter(|&base| base > ram_base);
+        let base = base.unwrap_or_else(|| panic!("-reserved-mem: {}: doesn't fit in the guest RAM", region.name));
+        let default_property = match (region.default, region.reusable) {
+            (false, _) => None,
+            (true, true) => Some("linux,cma-default"),
+            (true, false) => Some("linux,dma-default"),
+        };
+
+        regions.push(Region {
+            name: &region.name,
+            base,
+            size: region.size,
+            compatible: region.compatible.as_deref(),
+            no_map: region.no_map,
+            reusable: region.reusable,
+            default_property,
+        });
+        top = base;
+    }
+    regions
+}
+
+/// The end of the guest RAM usable for the kernel and the initrd.
+pub fn usable_end() -> u64 {
+    let ram_end = GUEST_MEMORY.guest_base() + GUEST_MEMORY.size() as u64;
+    regions().iter().map(|region| region.base).min().unwrap_or(ram_end)
+}
+
+/// `info reserved-mem` in the monitor.
+pub fn report() -> String {
+    let regions = regions();
+    if regions.is_empty() {
+        return String::from("no reserved memory (-reserved-mem)");
+    }
+
+    let lines: Vec<String> = regions
+        .iter()
+        .map(|region| {
+            let mut flags = Vec::new();
+            flags.extend(region.compatible);
+            flags.extend(region.no_map.then_some("no-map"));
+            flags.extend(region.reusable.then_some("reusable"));
+            flags.extend(region.default_property);
+            format!(
+                "{:#012x}-{:#012x} {:>6}KB {} {}",
+                region.base,
+                region.base + region.size,
+                region.size / 1024,
+                region.name,
+                flags.join(" ")
+            )
+        })
+        .collect();
+    lines.join("\n")
+}
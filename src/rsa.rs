@@ -0,0 +1,280 @@
+//! RSA signature verification (RSASSA-PKCS1-v1_5 with SHA-256, RFC 8017),
+//! i.e. signatures from `openssl dgst -sha256 -sign key.pem`. Public keys
+//! are PEM files: `BEGIN PUBLIC KEY` (SubjectPublicKeyInfo) or `BEGIN RSA
+//! PUBLIC KEY` (PKCS#1).
+use alloc::{vec, vec::Vec};
+
+use crate::sha256::DIGEST_LEN;
+
+pub const MIN_BITS: usize = 2048;
+pub const MAX_BITS: usize = 4096;
+
+/// The DER encoding of DigestInfo { sha256, OCTET STRING (32 bytes) }
+/// without the digest.
+const SHA256_DIGEST_INFO: [u8; 19] =
+    [0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20];
+/// The OID of rsaEncryption (1.2.840.113549.1.1.1).
+const RSA_ENCRYPTION_OID: [u8; 9] = [0x2a, 0x86, 0x48, 0x86, 0xf7, 0x0d, 0x01, 0x01, 0x01];
+
+const DER_INTEGER: u8 = 0x02;
+const DER_BIT_STRING: u8 = 0x03;
+const DER_OID: u8 = 0x06;
+const DER_SEQUENCE: u8 = 0x30;
+
+fn base64_decode(text: &[u8]) -> Option<Vec<u8>> {
+    let mut out = Vec::new();
+    let mut bits = 0u32;
+    let mut num_bits = 0;
+    for &c in text {
+        let value = match c {
+            b'A'..=b'Z' => c - b'A',
+            b'a'..=b'z' => c - b'a' + 26,
+            b'0'..=b'9' => c - b'0' + 52,
+            b'+' => 62,
+            b'/' => 63,
+            b'=' | b'\r' | b'\n' | b' ' | b'\t' => continue,
+            _ => return None,
+        };
+        bits = (bits << 6) | value as u32;
+        num_bits += 6;
+        if num_bits >= 8 {
+            num_bits -= 8;
+            out.push((bits >> num_bits) as u8);
+        }
+    }
+    Some(out)
+}
+
+/// Splits a DER element off `data`. Returns (tag, contents, rest).
+fn der_element(data: &[u8]) -> Option<(u8, &[u8], &[u8])> {
+    let (&tag, data) = data.split_first()?;
+    let (&first, mut data) = data.split_first()?;
+    let len = if first < 0x80 {
+        first as usize
+    } else {
+        let num_bytes = (first & 0x7f) as usize;
+        if num_bytes == 0 || num_bytes > 4 || data.len() < num_bytes {
+            return None;
+        }
+
+        let len = data[..num_bytes].iter().fold(0, |len, &b| (len << 8) | b as usize);
+        data = &data[num_bytes..];
+        len
+    };
+
+    (data.len() >= len).then(|| (tag, &data[..len], &data[len..]))
+}
+
+fn der_expect(data: &[u8], tag: u8) -> Option<(&[u8], &[u8])> {
+    match der_element(data)? {
+        (t, contents, rest) if t == tag => Some((contents, rest)),
+        _ => None,
+    }
+}
+
+/// An unsigned big integer, least significant limb first.
+type Limbs = Vec<u64>;
+
+fn from_be_bytes(bytes: &[u8], num_limbs: usize) -> Limbs {
+    let mut limbs = vec![0; num_limbs];
+    for (i, &byte) in bytes.iter().rev().enumerate() {
+        limbs[i / 8] |= (byte as u64) << (8 * (i % 8));
+    }
+    limbs
+}
+
+fn to_be_bytes(limbs: &[u64], len: usize) -> Vec<u8> {
+    (0..len).rev().map(|i| (limbs[i / 8] >> (8 * (i % 8))) as u8).collect()
+}
+
+/// a >= b, for the same number of limbs.
+fn ge(a: &[u64], b: &[u64]) -> bool {
+    for (x, y) in a.iter().rev().zip(b.iter().rev()) {
+        if x != y {
+            return x > y;
+        }
+    }
+    true
+}
+
+/// a -= b. Returns the borrow.
+fn sub_assign(a: &mut [u64], b: &[u64]) -> bool {
+    let mut borrow = false;
+    for (x, &y) in a.iter_mut().zip(b) {
+        let (d, b1) = x.overflowing_sub(y);
+        let (d, b2) = d.overflowing_sub(borrow as u64);
+        *x = d;
+        borrow = b1 || b2;
+    }
+    borrow
+}
+
+pub struct PublicKey {
+    n: Limbs,
+    e: u64,
+    /// The length of the modulus (and signatures) in bytes.
+    len: usize,
+    /// -n^-1 mod 2^64, for the Montgomery multiplication.
+    n0_inv: u64,
+    /// R^2 mod n, where R = 2^(64 * limbs).
+    r2: Limbs,
+}
+
+impl PublicKey {
+    /// Parses a PEM file.
+    pub fn from_pem(pem: &[u8]) -> Option<PublicKey> {
+        let text = core::str::from_utf8(pem).ok()?;
+        let mut body = Vec::new();
+        let mut in_key = false;
+        for line in text.lines() {
+            let line = line.trim();
+            if line.starts_with("-----BEGIN") {
+                in_key = true;
+            } else if line.starts_with("-----END") {
+                break;
+            } else if in_key {
+                body.extend_from_slice(line.as_bytes());
+            }
+        }
+
+        PublicKey::from_der(&base64_decode(&body)?)
+    }
+
+    fn from_der(der: &[u8]) -> Option<PublicKey> {
+        let (seq, _) = der_expect(der, DER_SEQUENCE)?;
+        let rsa_public_key = match der_element(seq)? {
+            // SubjectPublicKeyInfo: SEQUENCE { AlgorithmIdentifier, BIT STRING }
+            (DER_SEQUENCE, algorithm, rest) => {
+                let (oid, _) = der_expect(algorithm, DER_OID)?;
+                if oid != RSA_ENCRYPTION_OID {
+                    return None;
+                }
+
+                let (bits, _) = der_expect(rest, DER_BIT_STRING)?;
+                // No unused bits.
+                let (&0, key) = bits.split_first()? else {
+                    return None;
+                };
+                der_expect(key, DER_SEQUENCE)?.0
+            }
+            // RSAPublicKey: SEQUENCE { INTEGER n, INTEGER e }
+            (DER_INTEGER, _, _) => seq,
+            _ => return None,
+        };
+
+        let (n, rest) = der_expect(rsa_public_key, DER_INTEGER)?;
+        let (e, _) = der_expect(rest, DER_INTEGER)?;
+        let n = &n[n.iter().position(|&b| b != 0)?..];
+        let e = &e[e.iter().position(|&b| b != 0)?..];
+        if n.len() * 8 < MIN_BITS || n.len() * 8 > MAX_BITS || e.len() > 8 || n[n.len() - 1] & 1 == 0 {
+            return None;
+        }
+
+        let len = n.len();
+        let num_limbs = len.div_ceil(8);
+        let n = from_be_bytes(n, num_limbs);
+        let e = e.iter().fold(0, |e, &b| (e << 8) | b as u64);
+
+        // Newton's iteration: each step doubles the correct low bits.
+        let mut inv = 1u64;
+        for _ in 0..6 {
+            inv = inv.wrapping_mul(2u64.wrapping_sub(n[0].wrapping_mul(inv)));
+        }
+
+        // Doubling 1 (mod n) 2 * 64 * limbs times.
+        let mut r2 = vec![0; num_limbs];
+        r2[0] = 1;
+        for _ in 0..2 * 64 * num_limbs {
+            let carry = r2[num_limbs - 1] >> 63;
+            for i in (1..num_limbs).rev() {
+                r2[i] = (r2[i] << 1) | (r2[i - 1] >> 63);
+            }
+            r2[0] <<= 1;
+            if carry != 0 || ge(&r2, &n) {
+                sub_assign(&mut r2, &n);
+            }
+        }
+
+        Some(PublicKey { n, e, len, n0_inv: inv.wrapping_neg(), r2 })
+    }
+
+    pub fn bits(&self) -> usize {
+        self.len * 8
+    }
+
+    /// a * b * R^-1 mod n (CIOS).
+    fn mont_mul(&self, a: &[u64], b: &[u64]) -> Limbs {
+        let k = self.n.len();
+        let mut t = vec![0u64; k + 2];
+        for &b in b {
+            let mut carry = 0u128;
+            for j in 0..k {
+                let sum = t[j] as u128 + a[j] as u128 * b as u128 + carry;
+                t[j] = sum as u64;
+                carry = sum >> 64;
+            }
+            let sum = t[k] as u128 + carry;
+            t[k] = sum as u64;
+            t[k + 1] = (sum >> 64) as u64;
+
+            // Add m * n so that the lowest limb is 0, and shift it out.
+            let m = t[0].wrapping_mul(self.n0_inv);
+            let mut carry = (t[0] as u128 + m as u128 * self.n[0] as u128) >> 64;
+            for j in 1..k {
+                let sum = t[j] as u128 + m as u128 * self.n[j] as u128 + carry;
+                t[j - 1] = sum as u64;
+                carry = sum >> 64;
+            }
+            let sum = t[k] as u128 + carry;
+            t[k - 1] = sum as u64;
+            t[k] = t[k + 1] + (sum >> 64) as u64;
+            t[k + 1] = 0;
+        }
+
+        let overflow = t[k] != 0;
+        t.truncate(k);
+        if overflow || ge(&t, &self.n) {
+            sub_assign(&mut t, &self.n);
+        }
+        t
+    }
+
+    /// s^e mod n.
+    fn public_op(&self, s: &[u64]) -> Limbs {
+        let s = self.mont_mul(s, &self.r2);
+        let mut x = s.clone();
+        for bit in (0..63 - self.e.leading_zeros()).rev() {
+            x = self.mont_mul(&x, &x);
+            if self.e & (1 << bit) != 0 {
+                x = self.mont_mul(&x, &s);
+            }
+        }
+
+        let mut one = vec![0; self.n.len()];
+        one[0] = 1;
+        self.mont_mul(&x, &one)
+    }
+
+    /// Whether `signature` is a valid signature of the SHA-256 `digest`.
+    pub fn verify_sha256(&self, digest: &[u8; DIGEST_LEN], signature: &[u8]) -> bool {
+        if signature.len() != self.len {
+            return false;
+        }
+
+        let s = from_be_bytes(signature, self.n.len());
+        if ge(&s, &self.n) {
+            return false;
+        }
+
+        // EM = 0x00 0x01 0xff.. 0x00 DigestInfo digest
+        let em = to_be_bytes(&self.public_op(&s), self.len);
+        let mut expected = vec![0xff; self.len];
+        expected[0] = 0x00;
+        expected[1] = 0x01;
+        let t_len = SHA256_DIGEST_INFO.len() + DIGEST_LEN;
+        expected[self.len - t_len - 1] = 0x00;
+        expected[self.len - t_len..self.len - DIGEST_LEN].copy_from_slice(&SHA256_DIGEST_INFO);
+        expected[self.len - DIGEST_LEN..].copy_from_slice(digest);
+        em == expected
+    }
+}
@@ -0,0 +1,208 @@
+//! `-rtc`: a Goldfish RTC (`google,goldfish-rtc`, Linux's
+//! CONFIG_RTC_DRV_GOLDFISH), which gives the guest the wall-clock time.
+//!
+//! The time is the host's (host_rtc.rs) plus an offset set by the guest
+//! (e.g. `hwclock -w`). Unlike the `time` CSR, which continues from the saved
+//! time in a snapshot or a migration, it stays correct across them: the
+//! guest reads it at boot (CONFIG_RTC_HCTOSYS), and the guest agent resyncs
+//! the system clock from it (`hv sync-time`) after a restore.
+//!
+//! With `-deterministic`, the host's time is replaced by one that follows
+//! the guest time (see deterministic.rs).
+//!
+//! The alarm raises the interrupt at the given RTC time (e.g. `rtcwake`). The
+//! host timer is programmed for it too (see timer::rearm).
+use alloc::string::String;
+use spin::Mutex;
+
+use crate::{
+    config::config,
+    deterministic, host_rtc, machine, mmio_bus, plic,
+    snapshot::{self, Reader, Section, Snapshot, Writer},
+    timer::{self, NO_DEADLINE, NS_PER_TICK},
+};
+
+
+const TIME_LOW: u64 = 0x00;
+const TIME_HIGH: u64 = 0x04;
+const ALARM_LOW: u64 = 0x08;
+const ALARM_HIGH: u64 = 0x0c;
+const IRQ_ENABLED: u64 = 0x10;
+const CLEAR_ALARM: u64 = 0x14;
+const ALARM_STATUS: u64 = 0x18;
+const CLEAR_INTERRUPT: u64 = 0x1c;
+
+struct Rtc {
+    /// The guest time minus the host time, in nanoseconds (wrapping).
+    offset: u64,
+    /// TIME_HIGH: latched by reading TIME_LOW, and written before TIME_LOW
+    /// to set the time.
+    time_high: u32,
+    /// The alarm time. ALARM_HIGH is written before ALARM_LOW.
+    alarm: u64,
+    /// When the alarm fires, in host time. NO_DEADLINE if not armed.
+    deadline: u64,
+    irq_enabled: bool,
+    irq_pending: bool,
+}
+
+static RTC: Mutex<Rtc> =
+    Mutex::new(Rtc { offset: 0, time_high: 0, alarm: 0, deadline: NO_DEADLINE, irq_enabled: false, irq_pending: false });
+
+impl Rtc {
+    fn now(&self) -> u64 {
+        host_time().wrapping_add(self.offset)
+    }
+
+    fn read(&mut self, offset: u64) -> u32 {
+        match offset {
+            TIME_LOW => {
+                let now = self.now();
+                self.time_high = (now >> 32) as u32;
+                now as u32
+            }
+            TIME_HIGH => self.time_high,
+            ALARM_LOW => self.alarm as u32,
+            ALARM_HIGH => (self.alarm >> 32) as u32,
+            IRQ_ENABLED => self.irq_enabled as u32,
+            ALARM_STATUS => (self.deadline != NO_DEADLINE) as u32,
+            _ => 0,
+        }
+    }
+
+    /// Arms the alarm. It fires on the next timer interrupt if the time has
+    /// already passed.
+    fn arm(&mut self) {
+        let remaining = self.alarm.saturating_sub(self.now());
+        self.deadline = timer::now() + remaining / NS_PER_TICK;
+        timer::kick();
+    }
+
+    fn update_irq(&self) {
+        let (_, _, irq) = machine::device_region("rtc");
+        plic::set_irq_level(irq, self.irq_enabled && self.irq_pending);
+    }
+
+    fn write(&mut self, offset: u64, value: u64) {
+        match offset {
+            TIME_LOW => {
+                let time = ((self.time_high as u64) << 32) | (value & 0xffff_ffff);
+                self.offset = time.wrapping_sub(host_time());
+                debug!("rtc", "the guest set the time: {} s since the epoch", time / 1_000_000_000);
+            }
+            TIME_HIGH => self.time_high = value as u32,
+            ALARM_LOW => {
+                self.alarm = (self.alarm & !0xffff_ffff) | (value & 0xffff_ffff);
+                self.arm();
+            }
+            ALARM_HIGH => self.alarm = (self.alarm & 0xffff_ffff) | (value << 32),
+            IRQ_ENABLED => {
+                self.irq_enabled = value & 1 != 0;
+                self.update_irq();
+            }
+            CLEAR_ALARM => self.deadline = NO_DEADLINE,
+            CLEAR_INTERRUPT => {
+                self.irq_pending = false;
+                self.update_irq();
+            }
+            _ => {}
+        }
+    }
+}
+
+impl Snapshot for Rtc {
+    const VERSION: u32 = 2;
+
+    fn save(&self, w: &mut Writer) {
+        // The offset, not the time: the time advances while it's saved. The
+        // alarm is in the RTC time, so it fires just after the restore if
+        // it has passed meanwhile.
+        w.u64(self.offset);
+        w.u64(self.alarm);
+        w.u32((self.deadline != NO_DEADLINE) as u32);
+        w.u32(self.irq_enabled as u32);
+        w.u32(self.irq_pending as u32);
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        self.offset = r.u64()?;
+        self.alarm = r.u64()?;
+        let armed = r.u32()? != 0;
+        self.irq_enabled = r.u32()? != 0;
+        self.irq_pending = r.u32()? != 0;
+        self.deadline = NO_DEADLINE;
+        if armed {
+            self.arm();
+        }
+        self.update_irq();
+        Some(())
+    }
+}
+
+/// The host's wall-clock time in nanoseconds since the epoch, or the
+/// deterministic one with `-deterministic`.
+pub fn host_time() -> u64 {
+    deterministic::wall_clock().unwrap_or_else(host_rtc::now)
+}
+
+pub fn init() {
+    let (addr, end, _) = machine::device_region("rtc");
+    mmio_bus::register("rtc", addr, end, mmio_read, mmio_write);
+}
+
+fn mmio_read(offset: u64, _width: u64) -> u64 {
+    RTC.lock().read(offset) as u64
+}
+
+fn mmio_write(offset: u64, value: u64, _width: u64) {
+    RTC.lock().write(offset, value);
+}
+
+/// When the alarm fires, for the host timer.
+pub fn deadline() -> u64 {
+    if !config().rtc {
+        return NO_DEADLINE;
+    }
+
+    RTC.lock().deadline
+}
+
+/// Raises the interrupt if the alarm has fired.
+pub fn poll() {
+    if !config().rtc {
+        return;
+    }
+
+    let mut rtc = RTC.lock();
+    if timer::now() < rtc.deadline {
+        return;
+    }
+
+    // Once: the driver arms it again for the next one.
+    rtc.deadline = NO_DEADLINE;
+    rtc.irq_pending = true;
+    rtc.update_irq();
+}
+
+/// Disarms the alarm for a reboot. The time is kept.
+pub fn reset() {
+    let mut rtc = RTC.lock();
+    rtc.deadline = NO_DEADLINE;
+    rtc.irq_enabled = false;
+    rtc.irq_pending = false;
+    rtc.update_irq();
+}
+
+pub fn save(w: &mut Writer) {
+    if config().rtc {
+        w.section("rtc", &*RTC.lock());
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    if !config().rtc {
+        return Ok(());
+    }
+
+    snapshot::load_section(sections, "rtc", &mut *RTC.lock())
+}
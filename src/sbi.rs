@@ -0,0 +1,72 @@
+use core::arch::asm;
+
+use crate::host_uart;
+
+const EID_BASE: u64 = 0x10;
+const EID_IPI: u64 = 0x735049;
+const EID_HSM: u64 = 0x48534d;
+const EID_SRST: u64 = 0x53525354;
+const EID_TIME: u64 = 0x54494d45;
+const EID_PMU: u64 = 0x504d55;
+
+pub const RESET_TYPE_SHUTDOWN: u64 = 0;
+pub const RESET_TYPE_COLD_REBOOT: u64 = 1;
+pub const RESET_TYPE_WARM_REBOOT: u64 = 2;
+pub const RESET_REASON_NONE: u64 = 0;
+pub const RESET_REASON_SYSTEM_FAILURE: u64 = 1;
+
+/// Calls the SBI firmware (OpenSBI) running in M-mode.
+fn sbi_call(eid: u64, fid: u64, a0: u64, a1: u64, a2: u64) -> Result<u64, i64> {
+    sbi_call5(eid, fid, [a0, a1, a2, 0, 0])
+}
+
+fn sbi_call5(eid: u64, fid: u64, args: [u64; 5]) -> Result<u64, i64> {
+    let error: i64;
+    let value: u64;
+    unsafe {
+        asm!(
+            "ecall",
+            inout("a0") args[0] => error,
+            inout("a1") args[1] => value,
+            in("a2") args[2],
+            in("a3") args[3],
+            in("a4") args[4],
+            in("a6") fid,
+            in("a7") eid,
+        );
+    }
+
+    if error == 0 { Ok(value) } else { Err(error) }
+}
+
+pub fn probe_extension(eid: u64) -> bool {
+    sbi_call(EID_BASE, 0x3, eid, 0, 0).is_ok_and(|available| available != 0)
+}
+
+pub fn has_pmu() -> bool {
+    probe_extension(EID_PMU)
+}
+
+/// Calls a function of the PMU extension on this hart.
+pub fn pmu_call(fid: u64, args: [u64; 5]) -> Result<u64, i64> {
+    sbi_call5(EID_PMU, fid, args)
+}
+
+pub fn hart_start(hart_id: u64, start_addr: u64, opaque: u64) -> Result<u64, i64> {
+    sbi_call(EID_HSM, 0x0, hart_id, start_addr, opaque)
+}
+
+/// Programs the timer interrupt. `u64::MAX` effectively disables it.
+pub fn set_timer(stime_value: u64) -> Result<u64, i64> {
+    sbi_call(EID_TIME, 0x0, stime_value, 0, 0)
+}
+
+pub fn send_ipi(hart_id: u64) -> Result<u64, i64> {
+    sbi_call(EID_IPI, 0x0, 1 /* hart_mask */, hart_id /* hart_mask_base */, 0)
+}
+
+/// Shuts down or reboots the machine. Returns only on failure.
+pub fn system_reset(reset_type: u64, reason: u64) -> Result<u64, i64> {
+    host_uart::flush();
+    sbi_call(EID_SRST, 0x0, reset_type, reason, 0)
+}
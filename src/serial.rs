@@ -0,0 +1,219 @@
+//! The guest's SBI console (`console=hvc` and `earlycon=sbi`). The output
+//! goes to the sinks given by `-serial`:
+//!
+//! - `stdio`: the hypervisor's console, prefixed by `[guest]`.
+//! - `raw`: the hypervisor's console as the guest's terminal: written as is,
+//!   not line by line, for interactive shells. QEMU puts the host terminal in
+//!   raw mode (`-serial mon:stdio`).
+//! - `port:<name>`: a port of the host virtio console. QEMU connects it to a
+//!   PTY, a TCP socket, a file, etc. (`-chardev`), and the input from it
+//!   goes to the guest.
+//!
+//! e.g. `-serial stdio,port:serial`.
+//!
+//! Keystrokes on the hypervisor's console (both `stdio` and `raw`) go to the
+//! guest, except escape sequences: Ctrl-A x quits, Ctrl-A c enters or
+//! leaves the monitor prompt (see `monitor::handle_console`), Ctrl-A h shows
+//! help, and Ctrl-A Ctrl-A sends Ctrl-A.
+use alloc::{collections::VecDeque, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    config::{SerialSink, config},
+    boot_time, console_log, crash, host_console, host_uart, monitor, print, sbi,
+};
+
+/// Ctrl-A: the prefix of escape sequences.
+const ESCAPE: u8 = 0x01;
+/// Keystrokes the guest hasn't read yet. Older ones are dropped beyond this.
+const MAX_INPUT: usize = 4096;
+/// The monitor prompt.
+const PROMPT: &str = "(hv) ";
+
+/// The output not terminated by a newline yet.
+static LINE: Mutex<Vec<u8>> = Mutex::new(Vec::new());
+
+struct Input {
+    /// Keystrokes on the hypervisor's console.
+    buf: VecDeque<u8>,
+    /// Ctrl-A has been pressed.
+    escaped: bool,
+    /// Keystrokes go to the monitor prompt instead of the guest.
+    monitor: bool,
+    /// The monitor command being typed.
+    line: Vec<u8>,
+    /// Monitor commands not executed yet.
+    commands: VecDeque<String>,
+}
+
+static INPUT: Mutex<Input> = Mutex::new(Input {
+    buf: VecDeque::new(),
+    escaped: false,
+    monitor: false,
+    line: Vec::new(),
+    commands: VecDeque::new(),
+});
+
+fn sinks() -> &'static [SerialSink] {
+    &config().serial.sinks
+}
+
+pub fn putchar(ch: u8) {
+    if sinks().iter().any(|sink| matches!(sink, SerialSink::Raw)) {
+        print::putchar(ch);
+    }
+
+    let mut line = LINE.lock();
+    line.push(ch);
+    if ch != b'\n' {
+        return;
+    }
+
+    crash::scan_console_line(&line);
+    boot_time::scan_console_line(&line);
+    console_log::record(&line);
+    for sink in sinks() {
+        match sink {
+            SerialSink::Stdio => {
+                let output = core::str::from_utf8(&line[..line.len() - 1]).unwrap_or("(not utf-8)");
+                println!("[guest] {}", output);
+            }
+            SerialSink::Port(name) => host_console::write(name, &line),
+            SerialSink::Raw => {}
+        }
+    }
+
+    line.clear();
+}
+
+/// Returns a character from the first sink with pending input.
+pub fn getchar() -> Option<u8> {
+    sinks().iter().find_map(|sink| match sink {
+        SerialSink::Stdio | SerialSink::Raw => INPUT.lock().buf.pop_front(),
+        SerialSink::Port(name) => host_console::read(name),
+    })
+}
+
+fn uses_stdio() -> bool {
+    sinks().iter().any(|sink| matches!(sink, SerialSink::Stdio | SerialSink::Raw))
+}
+
+fn quit() {
+    println!("\n[serial] Ctrl-A x: quitting");
+    monitor::event("SHUTDOWN", "{\"guest\": false, \"reason\": \"host-ui\"}");
+    if let Err(err) = sbi::system_reset(sbi::RESET_TYPE_SHUTDOWN, sbi::RESET_REASON_NONE) {
+        error!("serial", "SBI system reset failed (error={})", err);
+    }
+}
+
+/// Shows the monitor prompt.
+pub fn prompt() {
+    for &byte in PROMPT.as_bytes() {
+        print::putchar(byte);
+    }
+}
+
+/// Returns a command entered at the monitor prompt.
+pub fn take_command() -> Option<String> {
+    INPUT.lock().commands.pop_front()
+}
+
+/// Edits the command at the monitor prompt.
+fn edit_command(input: &mut Input, ch: u8) {
+    match ch {
+        b'\r' | b'\n' => {
+            print::putchar(b'\n');
+            let line = String::from_utf8_lossy(&input.line).into_owned();
+            input.line.clear();
+            input.commands.push_back(line);
+        }
+        // Backspace and Delete.
+        0x08 | 0x7f => {
+            if input.line.pop().is_some() {
+                for &byte in b"\x08 \x08" {
+                    print::putchar(byte);
+                }
+            }
+        }
+        ch if ch.is_ascii_graphic() || ch == b' ' => {
+            print::putchar(ch);
+            input.line.push(ch);
+        }
+        _ => {}
+    }
+}
+
+/// Handles keystrokes on the hypervisor's console. It's also called to poll
+/// them while the VM is stopped.
+pub fn handle_interrupt() {
+    if host_uart::irq().is_none() {
+        return;
+    }
+
+    host_uart::handle_tx_interrupt();
+
+    while let Some(ch) = host_uart::read() {
+        let mut input = INPUT.lock();
+        if !input.escaped {
+            if ch == ESCAPE {
+                input.escaped = true;
+                continue;
+            }
+
+            if input.monitor {
+                edit_command(&mut input, ch);
+                continue;
+            }
+
+            if input.buf.len() >= MAX_INPUT {
+                input.buf.pop_front();
+            }
+            input.buf.push_back(ch);
+            continue;
+        }
+
+        input.escaped = false;
+        match ch {
+            ESCAPE => input.buf.push_back(ESCAPE),
+            b'x' => {
+                drop(input);
+                quit();
+            }
+            b'c' if input.monitor => {
+                input.monitor = false;
+                input.line.clear();
+                println!("\n[serial] Ctrl-A c: back to the guest");
+            }
+            b'c' => {
+                input.monitor = true;
+                println!("\n[serial] Ctrl-A c: monitor (type help, Ctrl-A c to go back to the guest)");
+                prompt();
+            }
+            b'h' => {
+                println!("\n[serial] Ctrl-A x: quit, Ctrl-A c: monitor, Ctrl-A h: help, Ctrl-A Ctrl-A: send Ctrl-A")
+            }
+            _ => {}
+        }
+    }
+}
+
+/// Returns true if the host virtio console is needed.
+pub fn uses_ports() -> bool {
+    sinks().iter().any(|sink| matches!(sink, SerialSink::Port(_)))
+}
+
+pub fn init(hart_id: u64) {
+    for sink in sinks() {
+        if let SerialSink::Port(name) = sink {
+            assert!(host_console::has_port(name), "-serial: virtio-console port \"{}\" not found", name);
+        }
+    }
+
+    if uses_stdio() {
+        host_uart::init(hart_id);
+    }
+
+    if let Some(async_console) = &config().async_console {
+        host_uart::init_tx(async_console, hart_id);
+    }
+}
@@ -0,0 +1,199 @@
+//! Single-stepping the guest. RISC-V has no single-step in S-mode, so we
+//! put temporary breakpoints where the vCPU goes next: the next instruction,
+//! and the guest's trap vector in case the instruction traps.
+use alloc::vec::Vec;
+use core::arch::asm;
+
+use crate::{page_walk, vcpu::VCpu};
+
+const EBREAK: u32 = 0x0010_0073;
+const C_EBREAK: u16 = 0x9002;
+
+/// An `ebreak` written over a guest instruction.
+pub struct Breakpoint {
+    pub addr: u64,
+    /// 2 (c.ebreak) or 4 (ebreak).
+    pub len: usize,
+    original: [u8; 4],
+}
+
+fn sign_extend(value: u64, bits: u32) -> u64 {
+    let shift = 64 - bits;
+    (((value << shift) as i64) >> shift) as u64
+}
+
+pub fn insert_breakpoint(vcpu: &VCpu, addr: u64, len: usize) -> Option<Breakpoint> {
+    let ebreak = match len {
+        2 => C_EBREAK.to_le_bytes().to_vec(),
+        4 => EBREAK.to_le_bytes().to_vec(),
+        _ => return None,
+    };
+
+    let mut original = [0; 4];
+    page_walk::read(vcpu, addr, &mut original[..len])?;
+    page_walk::write(vcpu, addr, &ebreak)?;
+    Some(Breakpoint { addr, len, original })
+}
+
+pub fn remove_breakpoint(vcpu: &VCpu, breakpoint: &Breakpoint) {
+    page_walk::write(vcpu, breakpoint.addr, &breakpoint.original[..breakpoint.len]);
+}
+
+pub fn is_ebreak(vcpu: &VCpu, addr: u64) -> bool {
+    let mut inst = [0; 4];
+    if page_walk::read(vcpu, addr, &mut inst[..2]).is_none() {
+        return false;
+    }
+
+    if u16::from_le_bytes([inst[0], inst[1]]) == C_EBREAK {
+        return true;
+    }
+
+    page_walk::read(vcpu, addr + 2, &mut inst[2..]).is_some() && u32::from_le_bytes(inst) == EBREAK
+}
+
+/// Computes the address of the instruction executed after the current one.
+fn next_pc(vcpu: &VCpu) -> Option<u64> {
+    let pc = vcpu.sepc;
+    let mut bytes = [0; 4];
+    page_walk::read(vcpu, pc, &mut bytes[..2])?;
+
+    let low = u16::from_le_bytes([bytes[0], bytes[1]]) as u64;
+    if low & 0b11 != 0b11 {
+        return Some(next_pc_compressed(vcpu, pc, low));
+    }
+
+    page_walk::read(vcpu, pc + 2, &mut bytes[2..])?;
+    let inst = u32::from_le_bytes(bytes) as u64;
+    let rs1 = vcpu.gpr((inst >> 15) & 0x1f);
+    let rs2 = vcpu.gpr((inst >> 20) & 0x1f);
+    let next = match inst & 0x7f {
+        0x6f /* jal */ => {
+            let imm = ((inst >> 31) & 1) << 20
+                | ((inst >> 21) & 0x3ff) << 1
+                | ((inst >> 20) & 1) << 11
+                | ((inst >> 12) & 0xff) << 12;
+            pc.wrapping_add(sign_extend(imm, 21))
+        }
+        0x67 /* jalr */ => rs1.wrapping_add(sign_extend(inst >> 20, 12)) & !1,
+        0x63 /* branch */ => {
+            let taken = match (inst >> 12) & 0x7 {
+                0 => rs1 == rs2,                   // beq
+                1 => rs1 != rs2,                   // bne
+                4 => (rs1 as i64) < (rs2 as i64),  // blt
+                5 => (rs1 as i64) >= (rs2 as i64), // bge
+                6 => rs1 < rs2,                    // bltu
+                7 => rs1 >= rs2,                   // bgeu
+                _ => false,
+            };
+
+            let imm = ((inst >> 31) & 1) << 12
+                | ((inst >> 25) & 0x3f) << 5
+                | ((inst >> 8) & 0xf) << 1
+                | ((inst >> 7) & 1) << 11;
+            if taken { pc.wrapping_add(sign_extend(imm, 13)) } else { pc + 4 }
+        }
+        _ => pc + 4,
+    };
+
+    Some(next)
+}
+
+fn next_pc_compressed(vcpu: &VCpu, pc: u64, inst: u64) -> u64 {
+    let rs1 = (inst >> 7) & 0x1f;
+    let rs2 = (inst >> 2) & 0x1f;
+    match (inst & 0b11, inst >> 13) {
+        (0b01, 0b101) /* c.j */ => {
+            let imm = ((inst >> 12) & 1) << 11
+                | ((inst >> 11) & 1) << 4
+                | ((inst >> 9) & 0x3) << 8
+                | ((inst >> 8) & 1) << 10
+                | ((inst >> 7) & 1) << 6
+                | ((inst >> 6) & 1) << 7
+                | ((inst >> 3) & 0x7) << 1
+                | ((inst >> 2) & 1) << 5;
+            pc.wrapping_add(sign_extend(imm, 12))
+        }
+        (0b01, funct3 @ (0b110 | 0b111)) /* c.beqz, c.bnez */ => {
+            let is_zero = vcpu.gpr(8 + ((inst >> 7) & 0x7)) == 0;
+            let imm = ((inst >> 12) & 1) << 8
+                | ((inst >> 10) & 0x3) << 3
+                | ((inst >> 5) & 0x3) << 6
+                | ((inst >> 3) & 0x3) << 1
+                | ((inst >> 2) & 1) << 5;
+            if is_zero == (funct3 == 0b110) { pc.wrapping_add(sign_extend(imm, 9)) } else { pc + 2 }
+        }
+        (0b10, 0b100) if rs1 != 0 && rs2 == 0 /* c.jr, c.jalr */ => vcpu.gpr(rs1) & !1,
+        _ => pc + 2,
+    }
+}
+
+/// Where the vCPU has stopped after a step.
+pub enum StepResult {
+    /// The instruction has completed.
+    Completed { pc: u64 },
+    /// The instruction (or an interrupt) has trapped into the guest kernel.
+    Trap { pc: u64, scause: u64, stval: u64 },
+}
+
+/// A step in progress. The vCPU stops at one of the breakpoints.
+pub struct Step {
+    next: u64,
+    breakpoints: Vec<Breakpoint>,
+}
+
+impl Step {
+    /// Prepares to execute the instruction at the vCPU's pc. `has_breakpoint`
+    /// tells addresses with a breakpoint already: the vCPU stops there anyway.
+    pub fn start(vcpu: &VCpu, has_breakpoint: impl Fn(u64) -> bool) -> Option<Step> {
+        let next = next_pc(vcpu)?;
+        let vstvec: u64;
+        unsafe {
+            asm!("csrr {}, vstvec", out(reg) vstvec);
+        }
+
+        let mut breakpoints = Vec::new();
+        if !has_breakpoint(next) {
+            breakpoints.push(insert_breakpoint(vcpu, next, 2)?);
+        }
+
+        // Exceptions always go to the base address. If we can't stop there,
+        // we'll miss the stop when the instruction traps.
+        let trap_vector = vstvec & !0b11;
+        if trap_vector != 0 && trap_vector != next && !has_breakpoint(trap_vector) {
+            breakpoints.extend(insert_breakpoint(vcpu, trap_vector, 2));
+        }
+
+        unsafe {
+            asm!("fence.i");
+        }
+        Some(Step { next, breakpoints })
+    }
+
+    /// Whether the vCPU stopping at `pc` has completed this step.
+    pub fn is_done(&self, pc: u64) -> bool {
+        self.breakpoints.iter().any(|bp| bp.addr == pc)
+    }
+
+    /// Removes the breakpoints and tells where the vCPU has stopped.
+    pub fn finish(self, vcpu: &VCpu) -> StepResult {
+        for breakpoint in &self.breakpoints {
+            remove_breakpoint(vcpu, breakpoint);
+        }
+
+        unsafe {
+            asm!("fence.i");
+        }
+
+        if vcpu.sepc == self.next {
+            return StepResult::Completed { pc: vcpu.sepc };
+        }
+
+        let (scause, stval): (u64, u64);
+        unsafe {
+            asm!("csrr {}, vscause", out(reg) scause);
+            asm!("csrr {}, vstval", out(reg) stval);
+        }
+        StepResult::Trap { pc: vcpu.sepc, scause, stval }
+    }
+}
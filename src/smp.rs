@@ -0,0 +1,602 @@
+use alloc::{boxed::Box, format, string::String};
+use core::{
+    arch::{asm, naked_asm},
+    mem::offset_of,
+    sync::atomic::{AtomicBool, AtomicPtr, AtomicU32, AtomicU64, AtomicUsize, Ordering},
+};
+use spin::Mutex;
+
+use crate::{
+    config::config, guest_memory::GUEST_MEMORY, guest_page_table::GuestPageTable, metrics, nested, sbi, timer, trap,
+    vcpu::VCpu,
+};
+
+pub const MAX_VCPUS: usize = 8;
+
+const PENDING_IPI: u32 = 1 << 0;
+const PENDING_FENCE_I: u32 = 1 << 1;
+const PENDING_SFENCE_VMA: u32 = 1 << 2;
+const PENDING_EXTERNAL: u32 = 1 << 3;
+const PENDING_PAUSE: u32 = 1 << 4;
+const PENDING_HFENCE_GVMA: u32 = 1 << 5;
+const PENDING_NMI: u32 = 1 << 6;
+
+/// Injected by `inject_nmi`: a breakpoint exception.
+const SCAUSE_BREAKPOINT: u64 = 3;
+
+const SSTATUS_SIE: u64 = 1 << 1;
+const SSTATUS_SPP: u64 = 1 << 8;
+const SIE_SSIE: u64 = 1 << 1;
+const HVIP_VSSIP: u64 = 1 << 2;
+const HVIP_VSEIP: u64 = 1 << 10;
+
+const SUSPEND_DEFAULT_RETENTIVE: u64 = 0x0000_0000;
+const SUSPEND_DEFAULT_NON_RETENTIVE: u64 = 0x8000_0000;
+
+struct Hart {
+    /// The guest entry point and the opaque value passed to SBI hart_start.
+    start_request: Mutex<Option<(u64, u64)>>,
+    started: AtomicBool,
+    /// Set by `stop_paused_vcpus`: the vCPU stops when it's resumed.
+    stop_requested: AtomicBool,
+    /// Requests from other harts (PENDING_*) not handled yet.
+    pending: AtomicU32,
+    /// Whether the PLIC asserts the external interrupt to this hart.
+    external_interrupt: AtomicBool,
+    /// The vCPU state while it's paused by `pause_others`.
+    paused_vcpu: AtomicPtr<VCpu>,
+}
+
+impl Hart {
+    const fn new() -> Self {
+        Self {
+            start_request: Mutex::new(None),
+            started: AtomicBool::new(false),
+            stop_requested: AtomicBool::new(false),
+            pending: AtomicU32::new(0),
+            external_interrupt: AtomicBool::new(false),
+            paused_vcpu: AtomicPtr::new(core::ptr::null_mut()),
+        }
+    }
+}
+
+static HARTS: [Hart; MAX_VCPUS] = [const { Hart::new() }; MAX_VCPUS];
+/// The physical hart each vCPU runs on.
+static PHYSICAL_HART_IDS: [AtomicU64; MAX_VCPUS] = [const { AtomicU64::new(0) }; MAX_VCPUS];
+/// The vCPUs created so far: `-smp`, plus those added by `add_vcpu`.
+static NUM_VCPUS: AtomicUsize = AtomicUsize::new(1);
+/// The vCPU which has paused others by `pause_others`, or NOT_PAUSED.
+static PAUSED_BY: AtomicU64 = AtomicU64::new(NOT_PAUSED);
+const NOT_PAUSED: u64 = u64::MAX;
+
+pub enum RemoteFence {
+    FenceI,
+    SfenceVma,
+}
+
+/// Returns the ID of the vCPU running on this hart. The trap handler keeps it
+/// in `tp` while we're in the hypervisor.
+pub fn current_hart_id() -> u64 {
+    let hart_id: u64;
+    unsafe {
+        asm!("mv {}, tp", out(reg) hart_id);
+    }
+    hart_id
+}
+
+/// The number of vCPUs, including hotplugged ones. vCPU IDs are below it.
+pub fn num_vcpus() -> usize {
+    NUM_VCPUS.load(Ordering::Acquire)
+}
+
+pub fn physical_hart_id(vcpu_id: u64) -> u64 {
+    PHYSICAL_HART_IDS[vcpu_id as usize].load(Ordering::Relaxed)
+}
+
+/// vCPU 0 runs on the boot hart, which handles host interrupts. The rest run
+/// on the harts in `-cpu-affinity`, or on the other harts not taken, in order.
+/// Hotpluggable vCPUs (`maxcpus=`) get harts too.
+fn assign_harts(boot_hart_id: u64) {
+    let max_vcpus = config().max_vcpus;
+    let mut harts = [None; MAX_VCPUS];
+    harts[0] = Some(boot_hart_id);
+    for &(vcpu_id, hart_id) in &config().cpu_affinity {
+        assert!((vcpu_id as usize) < max_vcpus, "-cpu-affinity: no vCPU {} with -smp maxcpus={}", vcpu_id, max_vcpus);
+        if vcpu_id == 0 {
+            assert!(hart_id == boot_hart_id, "-cpu-affinity: vCPU 0 runs on the boot hart ({})", boot_hart_id);
+            continue;
+        }
+
+        assert!(!harts.contains(&Some(hart_id)), "-cpu-affinity: hart {} is taken", hart_id);
+        harts[vcpu_id as usize] = Some(hart_id);
+    }
+
+    let mut next = 0;
+    for vcpu_id in 0..max_vcpus {
+        if harts[vcpu_id].is_none() {
+            while harts.contains(&Some(next)) {
+                next += 1;
+            }
+
+            harts[vcpu_id] = Some(next);
+        }
+
+        PHYSICAL_HART_IDS[vcpu_id].store(harts[vcpu_id].unwrap(), Ordering::Relaxed);
+    }
+}
+
+pub fn init(boot_hart_id: u64) {
+    NUM_VCPUS.store(config().num_vcpus, Ordering::Relaxed);
+    assign_harts(boot_hart_id);
+    HARTS[0].started.store(true, Ordering::Release);
+    unsafe {
+        asm!("mv tp, zero");
+        asm!("csrs sie, {}", in(reg) SIE_SSIE);
+    }
+
+    timer::init_hart();
+}
+
+/// Boots a physical hart for the vCPU. It waits until the guest starts the
+/// vCPU through SBI HSM.
+pub fn start_secondary_hart(vcpu: &'static mut VCpu) {
+    let hart_id = physical_hart_id(vcpu.hart_id);
+    if let Err(err) = sbi::hart_start(hart_id, secondary_boot as usize as u64, vcpu as *mut VCpu as u64) {
+        panic!("failed to start hart #{} (error={}): too few harts for -smp?", hart_id, err);
+    }
+}
+
+/// CPU hotplug (`cpu-add` in the monitor): creates the next vCPU of
+/// `-smp <n>,maxcpus=<m>`, advertised as disabled in the device tree. It's
+/// STOPPED until the guest starts it through SBI hart_start, without ACPI:
+/// the guest polls hart_get_status, or is told by its agent. Linux skips
+/// disabled CPUs on boot, but the device tree has it enabled once the guest
+/// restarts. Returns its ID.
+pub fn add_vcpu(table: &GuestPageTable) -> Result<u64, String> {
+    let hart_id = num_vcpus() as u64;
+    if hart_id >= config().max_vcpus as u64 {
+        return Err(format!("all {} vCPUs are present (-smp <n>,maxcpus=<m>)", config().max_vcpus));
+    }
+
+    let vcpu = Box::leak(Box::new(VCpu::new(table, GUEST_MEMORY.guest_base())));
+    vcpu.hart_id = hart_id;
+    let physical_hart_id = physical_hart_id(hart_id);
+    sbi::hart_start(physical_hart_id, secondary_boot as usize as u64, vcpu as *mut VCpu as u64)
+        .map_err(|err| format!("failed to start hart #{} (error={}): too few harts for maxcpus?", physical_hart_id, err))?;
+
+    // hart_start from the guest and IPIs reach it from now on. It may take
+    // a while to be waiting for them: the requests stay pending until then.
+    NUM_VCPUS.store(hart_id as usize + 1, Ordering::Release);
+    info!("smp", "vCPU {} added on hart #{}", hart_id, physical_hart_id);
+    Ok(hart_id)
+}
+
+/// Sleeps until another hart sends an IPI (or another interrupt arrives).
+/// Interrupts are disabled in the hypervisor, so this doesn't trap: the
+/// caller checks what it's waiting for again.
+fn wait_for_ipi() {
+    unsafe {
+        asm!("wfi");
+        asm!("csrc sip, {}", in(reg) SIE_SSIE);
+    }
+}
+
+#[unsafe(naked)]
+extern "C" fn secondary_boot() -> ! {
+    naked_asm!(
+        // a1 is the opaque value we've passed to hart_start: a pointer to VCpu.
+        "ld sp, {host_sp_offset}(a1)",
+        "mv a0, a1",
+        "j {secondary_main}",
+        host_sp_offset = const offset_of!(VCpu, host_sp),
+        secondary_main = sym secondary_main,
+    );
+}
+
+extern "C" fn secondary_main(vcpu: *mut VCpu) -> ! {
+    let vcpu = unsafe { &mut *vcpu };
+    unsafe {
+        asm!("mv tp, {}", in(reg) vcpu.hart_id);
+        asm!("csrw stvec, {}", in(reg) trap::trap_handler as usize);
+        asm!("csrs sie, {}", in(reg) SIE_SSIE);
+    }
+
+    timer::init_hart();
+    wait_for_start(vcpu);
+}
+
+/// Waits in the STOPPED state until the guest starts this vCPU through SBI
+/// HSM, and then enters the guest.
+fn wait_for_start(vcpu: &mut VCpu) -> ! {
+    let hart = &HARTS[vcpu.hart_id as usize];
+    let (start_addr, opaque) = loop {
+        let mut request = hart.start_request.lock();
+        if let Some(request) = request.take() {
+            hart.started.store(true, Ordering::Release);
+            break request;
+        }
+
+        // Sleep instead of spinning: hart_start wakes us up. Other harts may
+        // have sent us requests before we've stopped.
+        drop(request);
+        process_pending(vcpu.hart_id);
+        handle_pause(vcpu);
+        if hart.started.load(Ordering::Acquire) {
+            // Restored by an incoming migration while paused.
+            vcpu.run();
+        }
+
+        wait_for_ipi();
+    };
+
+    enter_guest(vcpu, start_addr, opaque);
+}
+
+/// Enters the guest at `start_addr` in VS-mode with the MMU and interrupts
+/// disabled, as specified in SBI HSM.
+fn enter_guest(vcpu: &mut VCpu, start_addr: u64, opaque: u64) -> ! {
+    nested::reset(vcpu);
+    unsafe {
+        asm!("csrw vsatp, zero");
+        asm!("csrc vsstatus, {}", in(reg) SSTATUS_SIE);
+    }
+
+    vcpu.sepc = start_addr;
+    vcpu.a0 = vcpu.hart_id;
+    vcpu.a1 = opaque;
+    vcpu.run();
+}
+
+pub fn hart_start(hart_id: u64, start_addr: u64, opaque: u64) -> Result<i64, i64> {
+    if hart_id >= num_vcpus() as u64 {
+        return Err(-3); // SBI_ERR_INVALID_PARAM
+    }
+
+    let hart = &HARTS[hart_id as usize];
+    let mut request = hart.start_request.lock();
+    if hart.started.load(Ordering::Acquire) || request.is_some() {
+        return Err(-6); // SBI_ERR_ALREADY_AVAILABLE
+    }
+
+    *request = Some((start_addr, opaque));
+    sbi::send_ipi(physical_hart_id(hart_id)).expect("failed to send IPI");
+    Ok(0)
+}
+
+/// SBI hart_stop: the vCPU waits for hart_start again.
+pub fn hart_stop(vcpu: &mut VCpu) -> ! {
+    timer::set_timer(vcpu, timer::NO_DEADLINE);
+    nested::set_hvip(HVIP_VSSIP, false);
+
+    HARTS[vcpu.hart_id as usize].started.store(false, Ordering::Release);
+    wait_for_start(vcpu);
+}
+
+/// SBI hart_suspend. The hart sleeps until an interrupt arrives: it's handled
+/// when we return to the guest.
+pub fn hart_suspend(vcpu: &mut VCpu, suspend_type: u64, resume_addr: u64, opaque: u64) -> Result<i64, i64> {
+    match suspend_type {
+        SUSPEND_DEFAULT_RETENTIVE => {
+            unsafe {
+                asm!("wfi");
+            }
+            Ok(0)
+        }
+        SUSPEND_DEFAULT_NON_RETENTIVE => {
+            unsafe {
+                asm!("wfi");
+            }
+            enter_guest(vcpu, resume_addr, opaque);
+        }
+        _ => Err(-3), // SBI_ERR_INVALID_PARAM
+    }
+}
+
+pub fn hart_get_status(hart_id: u64) -> Result<i64, i64> {
+    if hart_id >= num_vcpus() as u64 {
+        return Err(-3); // SBI_ERR_INVALID_PARAM
+    }
+
+    let hart = &HARTS[hart_id as usize];
+    if hart.started.load(Ordering::Acquire) {
+        Ok(0) // STARTED
+    } else if hart.start_request.lock().is_some() {
+        Ok(2) // START_PENDING
+    } else {
+        Ok(1) // STOPPED
+    }
+}
+
+/// Returns a bitmap of started vCPUs specified by an SBI hart mask.
+fn target_harts(hart_mask: u64, hart_mask_base: u64) -> Result<u64, i64> {
+    let num_vcpus = num_vcpus() as u64;
+    let all = (1 << num_vcpus) - 1;
+    let targets = if hart_mask_base == u64::MAX {
+        all
+    } else {
+        if hart_mask_base >= num_vcpus || (hart_mask << hart_mask_base) & !all != 0 {
+            return Err(-3); // SBI_ERR_INVALID_PARAM
+        }
+
+        hart_mask << hart_mask_base
+    };
+
+    let started = (0..num_vcpus)
+        .filter(|&id| HARTS[id as usize].started.load(Ordering::Acquire))
+        .fold(0, |acc, id| acc | (1 << id));
+    Ok(targets & started)
+}
+
+fn notify(targets: u64, request: u32) {
+    let current_hart_id = current_hart_id();
+    for id in 0..num_vcpus() as u64 {
+        if targets & (1 << id) != 0 {
+            HARTS[id as usize].pending.fetch_or(request, Ordering::AcqRel);
+            if id != current_hart_id {
+                sbi::send_ipi(physical_hart_id(id)).expect("failed to send IPI");
+            }
+        }
+    }
+
+    if targets & (1 << current_hart_id) != 0 {
+        process_pending(current_hart_id);
+    }
+}
+
+pub fn send_ipi(hart_mask: u64, hart_mask_base: u64) -> Result<i64, i64> {
+    let targets = target_harts(hart_mask, hart_mask_base)?;
+    notify(targets, PENDING_IPI);
+    Ok(0)
+}
+
+pub fn remote_fence(hart_mask: u64, hart_mask_base: u64, fence: RemoteFence) -> Result<i64, i64> {
+    let targets = target_harts(hart_mask, hart_mask_base)?;
+    let request = match fence {
+        RemoteFence::FenceI => PENDING_FENCE_I,
+        // Flush the whole TLB regardless of the address range and ASID.
+        RemoteFence::SfenceVma => PENDING_SFENCE_VMA,
+    };
+
+    notify(targets, request);
+    // SBI requires remote fences to be completed before returning to the
+    // caller.
+    wait_for_completion(targets, request);
+    Ok(0)
+}
+
+/// Flushes the G-stage TLBs of all vCPUs, including stopped and paused
+/// ones, e.g. after write-protecting the guest memory.
+pub fn flush_guest_tlbs() {
+    let all = (1 << num_vcpus()) - 1;
+    notify(all, PENDING_HFENCE_GVMA);
+    wait_for_completion(all, PENDING_HFENCE_GVMA);
+}
+
+fn wait_for_completion(targets: u64, request: u32) {
+    // Keep handling our own requests too to avoid a deadlock.
+    for id in 0..num_vcpus() as u64 {
+        if targets & (1 << id) != 0 {
+            while HARTS[id as usize].pending.load(Ordering::Acquire) & request != 0 {
+                process_pending(current_hart_id());
+                core::hint::spin_loop();
+            }
+        }
+    }
+}
+
+fn process_pending(hart_id: u64) {
+    // PENDING_PAUSE and PENDING_NMI need the vCPU state: handled in
+    // handle_ipi and handle_nmi.
+    process_requests(hart_id, !(PENDING_PAUSE | PENDING_NMI));
+}
+
+fn process_requests(hart_id: u64, mask: u32) {
+    let hart = &HARTS[hart_id as usize];
+    let pending = hart.pending.load(Ordering::Acquire) & mask;
+    if pending == 0 {
+        return;
+    }
+
+    if pending & PENDING_IPI != 0 {
+        metrics::record_software_interrupt(hart_id);
+        nested::set_hvip(HVIP_VSSIP, true);
+    }
+
+    if pending & PENDING_EXTERNAL != 0 {
+        nested::set_hvip(HVIP_VSEIP, hart.external_interrupt.load(Ordering::Acquire));
+    }
+
+    unsafe {
+        if pending & PENDING_FENCE_I != 0 {
+            asm!("fence.i");
+        }
+
+        if pending & PENDING_SFENCE_VMA != 0 {
+            asm!(".option push", ".option arch, +h", "hfence.vvma", ".option pop");
+        }
+
+        if pending & PENDING_HFENCE_GVMA != 0 {
+            asm!(".option push", ".option arch, +h", "hfence.gvma", ".option pop");
+        }
+    }
+
+    hart.pending.fetch_and(!pending, Ordering::AcqRel);
+}
+
+/// Asserts or de-asserts the external interrupt (VSEIP) of a vCPU.
+pub fn set_external_interrupt(hart_id: u64, asserted: bool) {
+    let hart = &HARTS[hart_id as usize];
+    if hart.external_interrupt.swap(asserted, Ordering::AcqRel) != asserted {
+        notify(1 << hart_id, PENDING_EXTERNAL);
+    }
+}
+
+/// Makes each vCPU re-apply the external interrupt state, e.g. after
+/// restoring hvip from a snapshot.
+pub fn resync_external_interrupts() {
+    notify(target_harts(0, u64::MAX).unwrap(), PENDING_EXTERNAL);
+}
+
+/// Handles a supervisor software interrupt sent from other harts.
+pub fn handle_ipi(vcpu: &mut VCpu) {
+    unsafe {
+        asm!("csrc sip, {}", in(reg) SIE_SSIE);
+    }
+
+    process_pending(vcpu.hart_id);
+    handle_pause(vcpu);
+}
+
+/// Forces a started vCPU into the guest kernel's trap handler, e.g. to get
+/// a backtrace from a hung guest. RISC-V has no NMI for S-mode: the vCPU
+/// gets a breakpoint exception at its next VM exit in the kernel, even with
+/// interrupts disabled. Linux reports it as a kernel BUG and oopses (or
+/// panics in an interrupt or the idle task).
+///
+/// Like an NMI, it may hit the guest anywhere, e.g. right at its trap entry
+/// before the registers are saved, and break it for good.
+pub fn inject_nmi(hart_id: u64) -> Result<(), &'static str> {
+    if !is_started(hart_id) {
+        return Err("the vCPU is not started");
+    }
+
+    notify(1 << hart_id, PENDING_NMI);
+    Ok(())
+}
+
+/// Injects the exception requested by `inject_nmi` if the vCPU is in the
+/// kernel. In user mode, it would only be a SIGTRAP for the process: it's
+/// kept pending until a VM exit in the kernel. Call this right before
+/// returning to the guest.
+pub fn handle_nmi(vcpu: &mut VCpu) {
+    let hart = &HARTS[vcpu.hart_id as usize];
+    if hart.pending.load(Ordering::Acquire) & PENDING_NMI == 0 || vcpu.sstatus & SSTATUS_SPP == 0 {
+        return;
+    }
+
+    hart.pending.fetch_and(!PENDING_NMI, Ordering::AcqRel);
+    info!("smp", "vCPU {}: injecting an NMI at {:#x}", vcpu.hart_id, vcpu.sepc);
+    vcpu.inject_exception(SCAUSE_BREAKPOINT, vcpu.sepc);
+}
+
+/// Parks this hart if another one has requested through `pause_others`.
+pub fn handle_pause(vcpu: &mut VCpu) {
+    let hart = &HARTS[vcpu.hart_id as usize];
+    if hart.pending.fetch_and(!PENDING_PAUSE, Ordering::AcqRel) & PENDING_PAUSE == 0 {
+        return;
+    }
+
+    // The hart which paused us may read and modify the state.
+    vcpu.save_vs_csrs();
+    hart.paused_vcpu.store(vcpu, Ordering::Release);
+    while PAUSED_BY.load(Ordering::Acquire) != NOT_PAUSED {
+        // Remote fences must be completed even while paused. Others modify
+        // hvip: keep them pending until we restore it.
+        process_requests(vcpu.hart_id, PENDING_FENCE_I | PENDING_SFENCE_VMA | PENDING_HFENCE_GVMA);
+        wait_for_ipi();
+    }
+
+    vcpu.restore_vs_csrs();
+    timer::rearm(vcpu);
+    process_pending(vcpu.hart_id);
+    hart.paused_vcpu.store(core::ptr::null_mut(), Ordering::Release);
+
+    // The guest memory, including instructions, might have been modified.
+    unsafe {
+        asm!("fence.i");
+    }
+
+    if hart.stop_requested.swap(false, Ordering::AcqRel) {
+        hart_stop(vcpu);
+    }
+}
+
+/// Stops all other started vCPUs and waits until all of them are paused.
+/// If another hart is pausing the VM, this hart gets paused first.
+pub fn pause_others(vcpu: &mut VCpu) {
+    pause(vcpu, target_harts(0, u64::MAX).unwrap());
+}
+
+/// Like `pause_others`, but also pauses the stopped vCPUs to restore an
+/// incoming migration. Those marked by `set_started` enter the guest when
+/// resumed, and the rest keep waiting for hart_start.
+pub fn pause_all_others(vcpu: &mut VCpu) {
+    pause(vcpu, (1 << num_vcpus()) - 1);
+}
+
+fn pause(vcpu: &mut VCpu, targets: u64) {
+    let current_hart_id = current_hart_id();
+    loop {
+        match PAUSED_BY.compare_exchange(NOT_PAUSED, current_hart_id, Ordering::AcqRel, Ordering::Acquire) {
+            Ok(_) => break,
+            // Already paused by us, e.g. while single-stepping.
+            Err(id) if id == current_hart_id => return,
+            Err(_) => {
+                handle_pause(vcpu);
+                core::hint::spin_loop();
+            }
+        }
+    }
+
+    let others = targets & !(1 << current_hart_id);
+    notify(others, PENDING_PAUSE);
+
+    for id in 0..num_vcpus() as u64 {
+        if others & (1 << id) != 0 {
+            while HARTS[id as usize].paused_vcpu.load(Ordering::Acquire).is_null() {
+                // The hart might be waiting for us to complete a remote fence.
+                process_pending(current_hart_id);
+                core::hint::spin_loop();
+            }
+        }
+    }
+}
+
+pub fn resume_others() {
+    PAUSED_BY.store(NOT_PAUSED, Ordering::Release);
+    for id in 0..num_vcpus() as u64 {
+        if id != current_hart_id() && !HARTS[id as usize].paused_vcpu.load(Ordering::Acquire).is_null() {
+            sbi::send_ipi(physical_hart_id(id)).expect("failed to send IPI");
+        }
+    }
+
+    // Wait for them to leave handle_pause so that the next pause_others
+    // doesn't see stale states.
+    for hart in &HARTS[..num_vcpus()] {
+        while !hart.paused_vcpu.load(Ordering::Acquire).is_null() {
+            core::hint::spin_loop();
+        }
+    }
+}
+
+/// Puts all other vCPUs into the STOPPED state to restart the guest. They
+/// stop when `resume_others` resumes them.
+pub fn stop_paused_vcpus() {
+    for id in 0..num_vcpus() as u64 {
+        if id == current_hart_id() {
+            continue;
+        }
+
+        let hart = &HARTS[id as usize];
+        hart.start_request.lock().take();
+        if !hart.paused_vcpu.load(Ordering::Acquire).is_null() {
+            hart.stop_requested.store(true, Ordering::Release);
+        }
+    }
+}
+
+/// Returns the state of a vCPU paused by `pause_others`.
+pub fn paused_vcpu(hart_id: u64) -> Option<&'static mut VCpu> {
+    let vcpu = HARTS.get(hart_id as usize)?.paused_vcpu.load(Ordering::Acquire);
+    unsafe { vcpu.as_mut() }
+}
+
+/// Marks a vCPU paused by `pause_all_others` as started or stopped.
+pub fn set_started(hart_id: u64, started: bool) {
+    HARTS[hart_id as usize].started.store(started, Ordering::Release);
+}
+
+/// Returns true if the vCPU has been started by the guest.
+pub fn is_started(hart_id: u64) -> bool {
+    HARTS.get(hart_id as usize).is_some_and(|hart| hart.started.load(Ordering::Acquire))
+}
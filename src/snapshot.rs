@@ -0,0 +1,734 @@
+//! VM snapshots: `monitor savevm` and `monitor loadvm` in GDB, and
+//! `-loadvm` to restore one at boot.
+//!
+//! A snapshot is stored in a dedicated host disk (`serial=snapshot`):
+//!
+//! ```text
+//! header  | magic, version, flags, ID, parent ID, memory size, state size, sectors, nonce prefix
+//! state   | sections: name, version, size, data (by Snapshot::save)
+//! map     | for each 1MB of the guest RAM: a bit per stored 4KB page, and their compressed size
+//! tags    | with -snapshot-key: the tags of the state, the map, and the memory chunks
+//! memory  | the stored pages of each 1MB, compressed with zstd (from the next sector)
+//! ```
+//!
+//! Zero pages are not stored. `monitor savevm incremental` stores only the
+//! pages written since the last savevm or loadvm (its parent), tracked as in
+//! the migration, right after the parent in the disk. loadvm restores the
+//! chain: the full snapshot at the start of the disk, then each incremental
+//! one on top of it.
+//!
+//! With `-snapshot-key`, the state (chunk 0, authenticated with the header
+//! too), the map (chunk 1) and the memory (chunks 2 and later) are encrypted
+//! (see encryption.rs). Unencrypted snapshots are then refused.
+//!
+//! With `-mem-file`, the guest RAM stays in QEMU's memory file instead:
+//! savevm writes the state only and shuts down the VM so that the file
+//! keeps the memory as of the snapshot, and `-loadvm` restores it instantly.
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    aes_gcm::TAG_LEN,
+    config::config,
+    encryption::{self, NONCE_PREFIX_LEN, Tag},
+    guest_memory::GUEST_MEMORY,
+    hotplug,
+    host_blk::{HostBlk, SECTOR_SIZE, VIRTIO_BLK_S_OK, VIRTIO_BLK_T_IN, VIRTIO_BLK_T_OUT},
+    host_rtc, migration, pci, plic, rtc, sbi, smp, timer,
+    vcpu::VCpu,
+    virtio_9p, virtio_balloon, virtio_blk, virtio_console, virtio_fs, virtio_input, virtio_mem, virtio_net, virtio_rng,
+    virtio_vsock, watchdog, zstd,
+};
+
+const MAGIC: &[u8; 8] = b"HVSNAPSH";
+const FORMAT_VERSION: u32 = 3;
+/// The guest RAM is not in the snapshot but in QEMU's memory file.
+const FLAG_MEMORY_IN_FILE: u32 = 1 << 0;
+const FLAG_ENCRYPTED: u32 = 1 << 1;
+/// Only the pages written since the parent are stored.
+const FLAG_INCREMENTAL: u32 = 1 << 2;
+const HEADER_SIZE: usize = 64;
+/// `-device virtio-blk-device,serial=snapshot` in run.sh.
+const SNAPSHOT_DISK_SERIAL: &str = "snapshot";
+/// The maximum size of a disk request, and the chunks of the guest RAM in
+/// the map.
+const CHUNK_SIZE: usize = 1024 * 1024;
+const PAGE_SIZE: usize = 4096;
+const PAGES_PER_CHUNK: usize = CHUNK_SIZE / PAGE_SIZE;
+const MAP_ENTRY_SIZE: usize = PAGES_PER_CHUNK / 8 + 4;
+
+static SNAPSHOT_DISK: Mutex<Option<HostBlk>> = Mutex::new(None);
+
+/// The last snapshot saved or restored, for `savevm incremental`.
+#[derive(Clone, Copy)]
+struct Parent {
+    id: u64,
+    /// Where the next snapshot in the chain goes.
+    next_sector: u64,
+}
+
+static PARENT: Mutex<Option<Parent>> = Mutex::new(None);
+
+/// The device state serializer.
+pub trait Snapshot {
+    /// Bumped when the layout of the state changes.
+    const VERSION: u32;
+    fn save(&self, w: &mut Writer);
+    /// Returns None if the state is broken.
+    fn load(&mut self, r: &mut Reader) -> Option<()>;
+}
+
+#[derive(Default)]
+pub struct Writer {
+    buf: Vec<u8>,
+}
+
+impl Writer {
+    pub fn u8(&mut self, value: u8) {
+        self.buf.push(value);
+    }
+
+    pub fn u32(&mut self, value: u32) {
+        self.buf.extend_from_slice(&value.to_le_bytes());
+    }
+
+    pub fn u64(&mut self, value: u64) {
+        self.buf.extend_from_slice(&value.to_le_bytes());
+    }
+
+    pub fn bytes(&mut self, data: &[u8]) {
+        self.buf.extend_from_slice(data);
+    }
+
+    pub fn section<T: Snapshot>(&mut self, name: &str, state: &T) {
+        let mut w = Writer::default();
+        state.save(&mut w);
+
+        self.u8(name.len() as u8);
+        self.bytes(name.as_bytes());
+        self.u32(T::VERSION);
+        self.u32(w.buf.len() as u32);
+        self.bytes(&w.buf);
+    }
+}
+
+pub struct Reader<'a> {
+    buf: &'a [u8],
+}
+
+impl<'a> Reader<'a> {
+    pub fn bytes(&mut self, len: usize) -> Option<&'a [u8]> {
+        if self.buf.len() < len {
+            return None;
+        }
+
+        let (data, rest) = self.buf.split_at(len);
+        self.buf = rest;
+        Some(data)
+    }
+
+    pub fn u8(&mut self) -> Option<u8> {
+        Some(self.bytes(1)?[0])
+    }
+
+    pub fn u32(&mut self) -> Option<u32> {
+        Some(u32::from_le_bytes(self.bytes(4)?.try_into().unwrap()))
+    }
+
+    pub fn u64(&mut self) -> Option<u64> {
+        Some(u64::from_le_bytes(self.bytes(8)?.try_into().unwrap()))
+    }
+}
+
+struct Header {
+    /// Where the snapshot is in the disk.
+    sector: u64,
+    version: u32,
+    flags: u32,
+    /// When it was saved, in the host time.
+    id: u64,
+    /// The ID of the snapshot an incremental one is on.
+    parent: u64,
+    memory_size: usize,
+    state_size: usize,
+    /// The size of the snapshot in the disk, memory included.
+    sectors: u64,
+    nonce_prefix: [u8; NONCE_PREFIX_LEN],
+}
+
+impl Header {
+    fn encode(&self) -> Vec<u8> {
+        let mut w = Writer::default();
+        w.bytes(MAGIC);
+        w.u32(self.version);
+        w.u32(self.flags);
+        w.u64(self.id);
+        w.u64(self.parent);
+        w.u64(self.memory_size as u64);
+        w.u64(self.state_size as u64);
+        w.u64(self.sectors);
+        w.bytes(&self.nonce_prefix);
+        w.buf
+    }
+
+    /// Reads the header of the snapshot at `sector`. None if there's none.
+    fn read(disk: &mut HostBlk, sector: u64) -> Result<Option<Header>, String> {
+        if sector >= disk.capacity() {
+            return Ok(None);
+        }
+
+        let mut first_sector = vec![0u8; SECTOR_SIZE as usize];
+        disk_io(disk, VIRTIO_BLK_T_IN, sector, first_sector.as_mut_ptr(), first_sector.len())?;
+
+        let mut r = Reader { buf: &first_sector };
+        if r.bytes(MAGIC.len()) != Some(MAGIC) {
+            return Ok(None);
+        }
+
+        Ok(Some(Header {
+            sector,
+            version: r.u32().unwrap(),
+            flags: r.u32().unwrap(),
+            id: r.u64().unwrap(),
+            parent: r.u64().unwrap(),
+            memory_size: r.u64().unwrap() as usize,
+            state_size: r.u64().unwrap() as usize,
+            sectors: r.u64().unwrap(),
+            nonce_prefix: r.bytes(NONCE_PREFIX_LEN).unwrap().try_into().unwrap(),
+        }))
+    }
+}
+
+/// The pages of a chunk of the guest RAM stored in a snapshot.
+#[derive(Default)]
+struct MapEntry {
+    /// A bit per page.
+    pages: [u64; PAGES_PER_CHUNK / 64],
+    /// The size of the pages compressed, in bytes. 0 if there are none.
+    compressed_size: u32,
+}
+
+impl MapEntry {
+    fn has(&self, page: usize) -> bool {
+        self.pages[page / 64] & (1 << (page % 64)) != 0
+    }
+
+    fn num_pages(&self) -> usize {
+        self.pages.iter().map(|word| word.count_ones() as usize).sum()
+    }
+
+    fn write(&self, w: &mut Writer) {
+        for word in self.pages {
+            w.u64(word);
+        }
+        w.u32(self.compressed_size);
+    }
+
+    fn read(r: &mut Reader) -> Option<MapEntry> {
+        let mut entry = MapEntry::default();
+        for word in &mut entry.pages {
+            *word = r.u64()?;
+        }
+        entry.compressed_size = r.u32()?;
+        Some(entry)
+    }
+}
+
+/// A saved section: (name, version, data).
+pub type Section<'a> = (&'a str, u32, &'a [u8]);
+
+fn parse_sections(mut r: Reader<'_>) -> Option<Vec<Section<'_>>> {
+    let mut sections = Vec::new();
+    while !r.buf.is_empty() {
+        let name_len = r.u8()? as usize;
+        let name = core::str::from_utf8(r.bytes(name_len)?).ok()?;
+        let version = r.u32()?;
+        let len = r.u32()? as usize;
+        sections.push((name, version, r.bytes(len)?));
+    }
+    Some(sections)
+}
+
+pub fn load_section<T: Snapshot>(sections: &[Section], name: &str, state: &mut T) -> Result<(), String> {
+    let Some(&(_, version, data)) = sections.iter().find(|(n, _, _)| *n == name) else {
+        return Err(format!("{}: not in the snapshot", name));
+    };
+
+    if version != T::VERSION {
+        return Err(format!("{}: unsupported version {} (expected {})", name, version, T::VERSION));
+    }
+
+    state.load(&mut Reader { buf: data }).ok_or_else(|| format!("{}: broken state", name))
+}
+
+/// Calls `f` with each vCPU. All vCPUs except `current` must be paused.
+pub fn for_each_vcpu(current: &mut VCpu, mut f: impl FnMut(u64, &mut VCpu) -> Result<(), String>) -> Result<(), String> {
+    for hart_id in 0..smp::num_vcpus() as u64 {
+        if hart_id == current.hart_id {
+            f(hart_id, current)?;
+        } else if let Some(vcpu) = smp::paused_vcpu(hart_id) {
+            f(hart_id, vcpu)?;
+        }
+    }
+    Ok(())
+}
+
+pub fn disk_io(disk: &mut HostBlk, type_: u32, sector: u64, buf: *mut u8, len: usize) -> Result<(), String> {
+    for offset in (0..len).step_by(CHUNK_SIZE) {
+        let chunk_len = (len - offset).min(CHUNK_SIZE);
+        let chunk_sector = sector + (offset as u64) / SECTOR_SIZE;
+        let status = disk.request(type_, chunk_sector, unsafe { buf.add(offset) }, chunk_len);
+        if status != VIRTIO_BLK_S_OK {
+            return Err(format!("disk I/O error (status={})", status));
+        }
+    }
+    Ok(())
+}
+
+fn with_disk<T>(f: impl FnOnce(&mut HostBlk) -> Result<T, String>) -> Result<T, String> {
+    let mut disk = SNAPSHOT_DISK.lock();
+    if disk.is_none() {
+        *disk = HostBlk::open(SNAPSHOT_DISK_SERIAL);
+    }
+
+    match disk.as_mut() {
+        Some(disk) => f(disk),
+        None => Err(String::from("snapshot disk (serial=snapshot) not found")),
+    }
+}
+
+/// Saves the vCPUs and the devices into sections. All vCPUs except `current`
+/// must be paused.
+pub fn save_state(current: &mut VCpu) -> Result<Vec<u8>, String> {
+    if !hotplug::is_empty() {
+        return Err(String::from("hotplugged devices are not supported: use device_del first"));
+    }
+
+    if virtio_mem::plugged_size() != 0 {
+        return Err(String::from("plugged virtio-mem memory is not supported: mem-resize 0 first"));
+    }
+
+    // The H extension state of the guest is not saved.
+    if config().nested {
+        return Err(String::from("-nested is not supported"));
+    }
+
+    current.save_vs_csrs();
+    // Complete the disk requests in flight: they are not saved.
+    virtio_blk::drain();
+
+    let mut w = Writer::default();
+    for_each_vcpu(current, |hart_id, vcpu| {
+        w.section(&format!("vcpu{}", hart_id), vcpu);
+        Ok(())
+    })?;
+    timer::save(&mut w);
+    plic::save(&mut w);
+    pci::save(&mut w);
+    virtio_net::save(&mut w);
+    virtio_blk::save(&mut w);
+    virtio_console::save(&mut w);
+    virtio_9p::save(&mut w);
+    virtio_fs::save(&mut w);
+    virtio_rng::save(&mut w);
+    virtio_balloon::save(&mut w);
+    virtio_mem::save(&mut w);
+    virtio_vsock::save(&mut w);
+    virtio_input::save(&mut w);
+    watchdog::save(&mut w);
+    rtc::save(&mut w);
+    Ok(w.buf)
+}
+
+pub fn parse_state(state: &[u8]) -> Result<Vec<Section<'_>>, String> {
+    parse_sections(Reader { buf: state }).ok_or_else(|| String::from("broken snapshot"))
+}
+
+/// Checks that each vCPU in the sections is `current` or paused, before
+/// modifying anything.
+pub fn check_vcpus(current: &VCpu, sections: &[Section]) -> Result<(), String> {
+    for (name, _, _) in sections {
+        let Some(hart_id) = name.strip_prefix("vcpu").and_then(|id| id.parse::<u64>().ok()) else {
+            continue;
+        };
+
+        if hart_id != current.hart_id && smp::paused_vcpu(hart_id).is_none() {
+            return Err(format!("vCPU {} is not running", hart_id));
+        }
+    }
+    Ok(())
+}
+
+/// Restores the vCPUs and the devices. Call `check_vcpus` first. Stopped
+/// vCPUs (paused by `smp::pause_all_others`) are restored only if they are
+/// in the state.
+pub fn load_state(current: &mut VCpu, sections: &[Section]) -> Result<(), String> {
+    for_each_vcpu(current, |hart_id, vcpu| {
+        let name = format!("vcpu{}", hart_id);
+        if !smp::is_started(hart_id) && !sections.iter().any(|(n, _, _)| *n == name) {
+            return Ok(());
+        }
+
+        load_section(sections, &name, vcpu)
+    })?;
+    current.restore_vs_csrs();
+    // Before rearming the timer: the deadlines are in the guest time, and
+    // it also fires at the watchdog expiry.
+    timer::load(sections)?;
+    watchdog::load(sections)?;
+    rtc::load(sections)?;
+    timer::rearm(current);
+    plic::load(sections)?;
+    pci::load(sections)?;
+    virtio_net::load(sections)?;
+    virtio_blk::load(sections)?;
+    virtio_console::load(sections)?;
+    virtio_9p::load(sections)?;
+    virtio_fs::load(sections)?;
+    virtio_rng::load(sections)?;
+    virtio_balloon::load(sections)?;
+    virtio_mem::load(sections)?;
+    virtio_vsock::load(sections)?;
+    virtio_input::load(sections)?;
+    smp::resync_external_interrupts();
+    Ok(())
+}
+
+fn check_capacity(disk: &HostBlk, end_sector: u64) -> Result<(), String> {
+    if end_sector > disk.capacity() {
+        return Err(format!("snapshot disk is too small ({} KB)", disk.capacity() * SECTOR_SIZE / 1024));
+    }
+    Ok(())
+}
+
+/// Writes the pages to store from `sector`: the non-zero ones, or the ones
+/// written since the parent if `incremental` (zero or not). With
+/// `nonce_prefix`, each chunk is sealed into `tags`. Returns the map and
+/// where the memory ends.
+fn save_memory(
+    disk: &mut HostBlk,
+    sector: u64,
+    incremental: bool,
+    nonce_prefix: Option<&[u8; NONCE_PREFIX_LEN]>,
+    tags: &mut [Tag],
+) -> Result<(Vec<MapEntry>, u64), String> {
+    let base = GUEST_MEMORY.guest_base();
+    let mut map = Vec::new();
+    let mut pages = Vec::with_capacity(CHUNK_SIZE);
+    let mut page = [0u8; PAGE_SIZE];
+    let mut sector = sector;
+    for (i, offset) in (0..GUEST_MEMORY.size()).step_by(CHUNK_SIZE).enumerate() {
+        let mut entry = MapEntry::default();
+        pages.clear();
+        let chunk_end = (offset + CHUNK_SIZE).min(GUEST_MEMORY.size());
+        for (j, page_offset) in (offset..chunk_end).step_by(PAGE_SIZE).enumerate() {
+            let guest_addr = base + page_offset as u64;
+            if incremental && !GUEST_MEMORY.take_dirty(guest_addr) {
+                continue;
+            }
+
+            GUEST_MEMORY.read_at(guest_addr, &mut page).unwrap();
+            if !incremental && page == [0; PAGE_SIZE] {
+                continue;
+            }
+
+            entry.pages[j / 64] |= 1 << (j % 64);
+            pages.extend_from_slice(&page);
+        }
+
+        if !pages.is_empty() {
+            let mut data = zstd::compress(&pages);
+            if let Some(nonce_prefix) = nonce_prefix {
+                tags[i] = encryption::seal(nonce_prefix, 2 + i as u32, &[], &mut data);
+            }
+
+            entry.compressed_size = data.len() as u32;
+            data.resize(data.len().next_multiple_of(SECTOR_SIZE as usize), 0);
+            let end_sector = sector + data.len() as u64 / SECTOR_SIZE;
+            check_capacity(disk, end_sector)?;
+            disk_io(disk, VIRTIO_BLK_T_OUT, sector, data.as_mut_ptr(), data.len())?;
+            sector = end_sector;
+        }
+        map.push(entry);
+    }
+    Ok((map, sector))
+}
+
+/// Saves the VM, or only the pages written since the last snapshot if
+/// `incremental`. All vCPUs except `current` must be paused.
+pub fn save(current: &mut VCpu, incremental: bool) -> Result<(), String> {
+    if migration::is_active() {
+        return Err(String::from("a migration is in progress"));
+    }
+
+    let parent = *PARENT.lock();
+    if incremental && parent.is_none() {
+        return Err(String::from("no snapshot to be incremental on: savevm or loadvm first"));
+    }
+
+    let mut state = save_state(current)?;
+    // The dirty pages are taken as they are written: if this one fails, the
+    // next one is a full one.
+    *PARENT.lock() = None;
+    let encrypted = encryption::is_enabled();
+    let nonce_prefix = if encrypted { encryption::new_nonce_prefix() } else { [0; NONCE_PREFIX_LEN] };
+
+    let mut flags = 0;
+    if config().mem_file {
+        flags |= FLAG_MEMORY_IN_FILE;
+    }
+    if encrypted {
+        flags |= FLAG_ENCRYPTED;
+    }
+    if incremental {
+        flags |= FLAG_INCREMENTAL;
+    }
+
+    let parent = parent.filter(|_| incremental);
+    let mut header = Header {
+        sector: parent.map_or(0, |parent| parent.next_sector),
+        version: FORMAT_VERSION,
+        flags,
+        id: host_rtc::now(),
+        parent: parent.map_or(0, |parent| parent.id),
+        memory_size: GUEST_MEMORY.size(),
+        state_size: state.len(),
+        sectors: 0,
+        nonce_prefix,
+    };
+
+    let num_chunks = if config().mem_file { 0 } else { GUEST_MEMORY.size().div_ceil(CHUNK_SIZE) };
+    let map_len = MAP_ENTRY_SIZE * num_chunks;
+    let tags_len = if encrypted { TAG_LEN * (2 + num_chunks) } else { 0 };
+    let meta_len = (HEADER_SIZE + state.len() + map_len + tags_len).next_multiple_of(SECTOR_SIZE as usize);
+
+    with_disk(|disk| {
+        let memory_sector = header.sector + meta_len as u64 / SECTOR_SIZE;
+        check_capacity(disk, memory_sector)?;
+
+        let mut tags = vec![[0; TAG_LEN]; 2 + num_chunks];
+        // With -mem-file, the memory stays in QEMU's memory file: the map is
+        // empty.
+        let (map, end_sector) = if config().mem_file {
+            (Vec::new(), memory_sector)
+        } else {
+            save_memory(disk, memory_sector, incremental, encrypted.then_some(&nonce_prefix), &mut tags[2..])?
+        };
+        header.sectors = end_sector - header.sector;
+
+        let header_buf = header.encode();
+        let mut map_buf = Writer::default();
+        for entry in &map {
+            entry.write(&mut map_buf);
+        }
+        if encrypted {
+            tags[0] = encryption::seal(&nonce_prefix, 0, &header_buf, &mut state);
+            tags[1] = encryption::seal(&nonce_prefix, 1, &[], &mut map_buf.buf);
+        }
+
+        let mut meta = [header_buf, core::mem::take(&mut state), map_buf.buf].concat();
+        if encrypted {
+            meta.extend_from_slice(&tags.concat());
+        }
+        meta.resize(meta_len, 0);
+        disk_io(disk, VIRTIO_BLK_T_OUT, header.sector, meta.as_mut_ptr(), meta.len())
+    })?;
+
+    if config().mem_file {
+        // The guest must not touch the memory in the file anymore.
+        info!("snapshot", "saved the state: -loadvm restores it with the memory file");
+        sbi::system_reset(sbi::RESET_TYPE_SHUTDOWN, sbi::RESET_REASON_NONE)
+            .map_err(|err| format!("SBI system reset failed (error={})", err))?;
+    }
+
+    info!(
+        "snapshot",
+        "saved {} snapshot ({} KB)",
+        if incremental { "an incremental" } else { "a" },
+        header.sectors * SECTOR_SIZE / 1024
+    );
+    *PARENT.lock() = Some(Parent { id: header.id, next_sector: header.sector + header.sectors });
+    migration::track_dirty_pages(current);
+    Ok(())
+}
+
+/// Forgets the last snapshot: the next one can't be incremental. Called
+/// when something else takes the dirty log.
+pub fn forget_parent() {
+    *PARENT.lock() = None;
+}
+
+/// Restores the VM. All vCPUs except `current` must be paused.
+pub fn load(current: &mut VCpu) -> Result<(), String> {
+    load_snapshot(current, false)
+}
+
+/// Restores the VM for `-loadvm` instead of booting the kernel.
+pub fn load_at_boot(current: &mut VCpu) {
+    // The other vCPUs are restored while paused.
+    smp::pause_all_others(current);
+    if let Err(err) = load_snapshot(current, true) {
+        panic!("-loadvm: failed to restore the snapshot: {}", err);
+    }
+
+    info!("snapshot", "restored the snapshot");
+    smp::resume_others();
+}
+
+/// A snapshot read from the disk, with the state and the map decrypted.
+struct Stored {
+    header: Header,
+    state: Vec<u8>,
+    map: Vec<MapEntry>,
+    tags: Vec<Tag>,
+    memory_sector: u64,
+}
+
+fn read_snapshot(disk: &mut HostBlk, header: Header, at_boot: bool) -> Result<Stored, String> {
+    if header.version != FORMAT_VERSION {
+        return Err(format!("unsupported snapshot version {}", header.version));
+    }
+
+    let encrypted = header.flags & FLAG_ENCRYPTED != 0;
+    if encrypted != encryption::is_enabled() {
+        return Err(String::from(if encrypted {
+            "the snapshot is encrypted: restore it with -snapshot-key"
+        } else {
+            "the snapshot is not encrypted, but -snapshot-key requires it"
+        }));
+    }
+
+    let in_file = header.flags & FLAG_MEMORY_IN_FILE != 0;
+    if in_file && !(at_boot && config().mem_file) {
+        return Err(String::from("the memory is in QEMU's memory file: restore it with -mem-file -loadvm"));
+    }
+
+    if header.memory_size != GUEST_MEMORY.size() {
+        return Err(format!("memory size mismatch ({} KB in the snapshot)", header.memory_size / 1024));
+    }
+
+    let num_chunks = if in_file { 0 } else { header.memory_size.div_ceil(CHUNK_SIZE) };
+    let map_offset = HEADER_SIZE + header.state_size;
+    let tags_offset = map_offset + MAP_ENTRY_SIZE * num_chunks;
+    let tags_len = if encrypted { TAG_LEN * (2 + num_chunks) } else { 0 };
+    let mut meta = vec![0u8; (tags_offset + tags_len).next_multiple_of(SECTOR_SIZE as usize)];
+    disk_io(disk, VIRTIO_BLK_T_IN, header.sector, meta.as_mut_ptr(), meta.len())?;
+
+    let tags: Vec<Tag> =
+        meta[tags_offset..tags_offset + tags_len].chunks_exact(TAG_LEN).map(|tag| tag.try_into().unwrap()).collect();
+    if encrypted {
+        let (header_buf, rest) = meta.split_at_mut(HEADER_SIZE);
+        let (state, map) = rest.split_at_mut(header.state_size);
+        encryption::open(&header.nonce_prefix, 0, header_buf, state, &tags[0])?;
+        encryption::open(&header.nonce_prefix, 1, &[], &mut map[..tags_offset - map_offset], &tags[1])?;
+    }
+
+    let mut r = Reader { buf: &meta[map_offset..tags_offset] };
+    let map = (0..num_chunks).map(|_| MapEntry::read(&mut r).unwrap()).collect();
+    Ok(Stored {
+        memory_sector: header.sector + meta.len() as u64 / SECTOR_SIZE,
+        state: meta[HEADER_SIZE..map_offset].to_vec(),
+        header,
+        map,
+        tags,
+    })
+}
+
+/// Reads the pages written by `save_memory`. The pages not in a full
+/// snapshot are zero.
+fn restore_memory(disk: &mut HostBlk, snapshot: &Stored) -> Result<(), String> {
+    let base = GUEST_MEMORY.guest_base();
+    let header = &snapshot.header;
+    let incremental = header.flags & FLAG_INCREMENTAL != 0;
+    let mut page = [0u8; PAGE_SIZE];
+    let mut sector = snapshot.memory_sector;
+    for (i, entry) in snapshot.map.iter().enumerate() {
+        let mut pages = Vec::new();
+        if entry.compressed_size > 0 {
+            let len = entry.compressed_size as usize;
+            let mut data = vec![0u8; len.next_multiple_of(SECTOR_SIZE as usize)];
+            disk_io(disk, VIRTIO_BLK_T_IN, sector, data.as_mut_ptr(), data.len())?;
+            sector += data.len() as u64 / SECTOR_SIZE;
+            if header.flags & FLAG_ENCRYPTED != 0 {
+                encryption::open(&header.nonce_prefix, 2 + i as u32, &[], &mut data[..len], &snapshot.tags[2 + i])?;
+            }
+            pages = zstd::decompress(&data[..len]).map_err(|err| format!("memory chunk {}: {}", i, err))?;
+        }
+
+        if pages.len() != entry.num_pages() * PAGE_SIZE {
+            return Err(format!("memory chunk {}: broken map", i));
+        }
+
+        let offset = i * CHUNK_SIZE;
+        let mut stored = pages.chunks_exact(PAGE_SIZE);
+        for j in 0..(GUEST_MEMORY.size() - offset).min(CHUNK_SIZE) / PAGE_SIZE {
+            let guest_addr = base + (offset + j * PAGE_SIZE) as u64;
+            if entry.has(j) {
+                GUEST_MEMORY.write_at(guest_addr, stored.next().unwrap()).unwrap();
+            } else if !incremental {
+                // Pages which are zero already might not be allocated by
+                // QEMU yet: leave them.
+                GUEST_MEMORY.read_at(guest_addr, &mut page).unwrap();
+                if page != [0; PAGE_SIZE] {
+                    GUEST_MEMORY.write_at(guest_addr, &[0; PAGE_SIZE]).unwrap();
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+fn load_snapshot(current: &mut VCpu, at_boot: bool) -> Result<(), String> {
+    if !hotplug::is_empty() {
+        return Err(String::from("hotplugged devices are not supported: use device_del first"));
+    }
+
+    if migration::is_active() {
+        return Err(String::from("a migration is in progress"));
+    }
+
+    // The memory is not the parent's anymore, even if it fails halfway.
+    *PARENT.lock() = None;
+    let last = with_disk(|disk| {
+        let header = Header::read(disk, 0)?.ok_or_else(|| String::from("no snapshot in the disk"))?;
+        let mut chain = vec![read_snapshot(disk, header, at_boot)?];
+        if chain[0].header.flags & FLAG_INCREMENTAL != 0 {
+            return Err(String::from("broken snapshot chain: the first one is incremental"));
+        }
+
+        // The incremental ones on top of it, until one is missing or from
+        // an older chain.
+        loop {
+            let last = &chain[chain.len() - 1].header;
+            let Some(header) = Header::read(disk, last.sector + last.sectors)? else {
+                break;
+            };
+
+            if header.version != FORMAT_VERSION || header.flags & FLAG_INCREMENTAL == 0 || header.parent != last.id {
+                break;
+            }
+            chain.push(read_snapshot(disk, header, at_boot)?);
+        }
+
+        let last = &chain[chain.len() - 1];
+        let sections = parse_state(&last.state)?;
+        check_vcpus(current, &sections)?;
+
+        // The host disk must not write to the memory after we restore it.
+        virtio_blk::drain();
+        for snapshot in &chain {
+            restore_memory(disk, snapshot)?;
+        }
+        load_state(current, &sections)?;
+
+        let in_file = last.header.flags & FLAG_MEMORY_IN_FILE != 0;
+        Ok((!in_file).then_some(Parent { id: last.header.id, next_sector: last.header.sector + last.header.sectors }))
+    })?;
+
+    // The memory file is not tracked.
+    if last.is_some() {
+        *PARENT.lock() = last;
+        migration::track_dirty_pages(current);
+    }
+    Ok(())
+}
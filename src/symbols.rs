@@ -0,0 +1,157 @@
+//! Guest kernel symbols (`-symbols`): annotates guest addresses in error
+//! messages, e.g. `guest PC 0xffffffff800134aa <do_page_fault+0x3e>`. The
+//! file is a System.map, or a vmlinux (only its symbol table is read):
+//!
+//! ```text
+//! SYMBOLS=linux/System.map ./run.sh
+//! ```
+use alloc::{format, string::String, vec, vec::Vec};
+use spin::Once;
+
+use crate::{elf, host_fw_cfg};
+
+/// The size of reads from fw_cfg.
+const CHUNK_SIZE: usize = 64 * 1024;
+
+const SHT_SYMTAB: u32 = 2;
+const STT_FUNC: u8 = 2;
+const SHN_UNDEF: u16 = 0;
+/// struct Elf64_Shdr: name[4] type[4] flags[8] addr[8] offset[8] size[8]
+/// link[4] info[4] addralign[8] entsize[8]
+const SHDR_SIZE: usize = 64;
+/// struct Elf64_Sym: name[4] info[1] other[1] shndx[2] value[8] size[8]
+const SYM_SIZE: usize = 24;
+
+struct Symbol {
+    addr: u64,
+    /// 0 if unknown (System.map): up to the next symbol.
+    size: u64,
+    name: String,
+}
+
+/// Sorted by the address.
+static SYMBOLS: Once<Vec<Symbol>> = Once::new();
+
+fn read_at(name: &str, offset: usize, len: usize) -> Vec<u8> {
+    let mut buf = vec![0; len];
+    let read = host_fw_cfg::read_file_at(name, offset, buf.as_mut_ptr(), len)
+        .unwrap_or_else(|| panic!("-symbols: failed to read {} from fw_cfg", name));
+    buf.truncate(read);
+    buf
+}
+
+fn le_u16(data: &[u8], offset: usize) -> u16 {
+    u16::from_le_bytes(data[offset..offset + 2].try_into().unwrap())
+}
+
+fn le_u32(data: &[u8], offset: usize) -> u32 {
+    u32::from_le_bytes(data[offset..offset + 4].try_into().unwrap())
+}
+
+fn le_u64(data: &[u8], offset: usize) -> u64 {
+    u64::from_le_bytes(data[offset..offset + 8].try_into().unwrap())
+}
+
+/// Text symbols in a System.map: `ffffffff80000000 T _stext`.
+fn parse_system_map(line: &[u8]) -> Option<Symbol> {
+    let line = core::str::from_utf8(line).ok()?;
+    let mut fields = line.split_ascii_whitespace();
+    let addr = u64::from_str_radix(fields.next()?, 16).ok()?;
+    let type_ = fields.next()?;
+    let name = fields.next()?;
+    matches!(type_, "T" | "t" | "W" | "w").then(|| Symbol { addr, size: 0, name: String::from(name) })
+}
+
+fn load_system_map(name: &str, size: usize) -> Vec<Symbol> {
+    let mut symbols = Vec::new();
+    let mut line = Vec::new();
+    let mut offset = 0;
+    while offset < size {
+        let chunk = read_at(name, offset, CHUNK_SIZE);
+        offset += chunk.len();
+        for &byte in &chunk {
+            if byte == b'\n' {
+                symbols.extend(parse_system_map(&line));
+                line.clear();
+            } else {
+                line.push(byte);
+            }
+        }
+    }
+
+    symbols.extend(parse_system_map(&line));
+    symbols
+}
+
+/// Functions in the symbol table (.symtab) of a vmlinux.
+fn load_vmlinux(name: &str) -> Vec<Symbol> {
+    let header = read_at(name, 0, 64);
+    assert!(header.len() == 64 && header[4] == 2 && header[5] == 1, "-symbols: not a 64-bit little-endian ELF");
+    let shoff = le_u64(&header, 0x28) as usize;
+    let shnum = le_u16(&header, 0x3c) as usize;
+    let shdrs = read_at(name, shoff, shnum * SHDR_SIZE);
+    let shdr = |index: usize| &shdrs[index * SHDR_SIZE..(index + 1) * SHDR_SIZE];
+    let Some(symtab) = (0..shdrs.len() / SHDR_SIZE).map(shdr).find(|shdr| le_u32(shdr, 4) == SHT_SYMTAB) else {
+        panic!("-symbols: {} has no symbol table (stripped?)", name);
+    };
+
+    let strtab = shdr(le_u32(symtab, 40) as usize);
+    let strtab = read_at(name, le_u64(strtab, 24) as usize, le_u64(strtab, 32) as usize);
+    let symtab_offset = le_u64(symtab, 24) as usize;
+    let symtab_size = le_u64(symtab, 32) as usize;
+    let mut symbols = Vec::new();
+    let mut offset = 0;
+    while offset < symtab_size {
+        let chunk_size = (CHUNK_SIZE / SYM_SIZE * SYM_SIZE).min(symtab_size - offset);
+        let chunk = read_at(name, symtab_offset + offset, chunk_size);
+        offset += chunk_size;
+        for sym in chunk.chunks_exact(SYM_SIZE) {
+            if sym[4] & 0xf != STT_FUNC || le_u16(sym, 6) == SHN_UNDEF {
+                continue;
+            }
+
+            let start = le_u32(sym, 0) as usize;
+            let Some(len) = strtab.get(start..).and_then(|s| s.iter().position(|&c| c == 0)) else {
+                continue;
+            };
+
+            let name = String::from_utf8_lossy(&strtab[start..start + len]).into_owned();
+            symbols.push(Symbol { addr: le_u64(sym, 8), size: le_u64(sym, 16), name });
+        }
+    }
+
+    symbols
+}
+
+/// Reads the symbols from the fw_cfg file `name` (`-symbols`).
+pub fn init(name: &str) {
+    let size = host_fw_cfg::file_size(name).unwrap_or_else(|| panic!("-symbols: {} not found in fw_cfg", name));
+    let mut symbols =
+        if elf::is_elf(&read_at(name, 0, 4)) { load_vmlinux(name) } else { load_system_map(name, size) };
+    symbols.sort_by_key(|symbol| symbol.addr);
+    info!("symbols", "loaded {} symbols from {}", symbols.len(), name);
+    SYMBOLS.call_once(|| symbols);
+}
+
+/// The symbol containing `addr`, and the offset in it.
+fn lookup(addr: u64) -> Option<(&'static str, u64)> {
+    let symbols = SYMBOLS.get()?;
+    let index = symbols.partition_point(|symbol| symbol.addr <= addr).checked_sub(1)?;
+    let symbol = &symbols[index];
+    let end = match symbol.size {
+        // The last one in a System.map (e.g. _etext) has no end.
+        0 => symbols.get(index + 1)?.addr,
+        size => symbol.addr + size,
+    };
+
+    (addr < end).then(|| (symbol.name.as_str(), addr - symbol.addr))
+}
+
+/// `0xffffffff800134aa <do_page_fault+0x3e>`, or only the address if it's
+/// not in any symbol.
+pub fn describe(addr: u64) -> String {
+    match lookup(addr) {
+        Some((name, offset)) => format!("{:#x} <{}+{:#x}>", addr, name, offset),
+        None => format!("{:#x}", addr),
+    }
+}
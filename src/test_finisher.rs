@@ -0,0 +1,50 @@
+//! `-test-finisher`: a SiFive test device (`sifive,test1`) for the guest,
+//! the same as QEMU's: bare-metal tests written for QEMU virt report the
+//! result with it, and the hypervisor exits with it (see host_test.rs).
+//!
+//! ```text
+//! 0x5555               pass: exit with 0
+//! 0x3333 | code << 16  fail: exit with `code`
+//! 0x7777               reset
+//! ```
+use alloc::format;
+
+use crate::{
+    host_test::{self, FINISHER_FAIL, FINISHER_PASS, FINISHER_RESET},
+    machine, mmio_bus, monitor, sbi,
+};
+
+pub fn init() {
+    let (addr, end, _) = machine::device_region("test");
+    mmio_bus::register("test", addr, end, mmio_read, mmio_write);
+}
+
+fn mmio_read(_offset: u64, _width: u64) -> u64 {
+    0
+}
+
+fn mmio_write(offset: u64, value: u64, _width: u64) {
+    if offset != 0 {
+        return;
+    }
+
+    let code = match value as u32 & 0xffff {
+        FINISHER_PASS => 0,
+        FINISHER_FAIL => (value as u32 >> 16) & 0xffff,
+        FINISHER_RESET => {
+            info!("test", "reset requested by the guest");
+            monitor::event("SHUTDOWN", "{\"guest\": true, \"reason\": \"guest-reset\"}");
+            let result = sbi::system_reset(sbi::RESET_TYPE_COLD_REBOOT, sbi::RESET_REASON_NONE);
+            panic!("[test] failed to reset: {:?}", result);
+        }
+        _ => {
+            warn!("test", "unknown command: {:#x}", value);
+            return;
+        }
+    };
+
+    info!("test", "the guest has finished with code {}", code);
+    monitor::event("SHUTDOWN", &format!("{{\"guest\": true, \"reason\": \"guest-exit\", \"code\": {}}}", code));
+    let result = host_test::exit(code);
+    panic!("[test] failed to shut down: {:?}", result);
+}
@@ -0,0 +1,125 @@
+//! I/O throttling of virtio-blk and virtio-net, to simulate slow disks and
+//! links in tests:
+//!
+//! ```text
+//! -disk host,iops=100,bps=1048576
+//! -net host,pps=1000,bps=125000
+//! ```
+//!
+//! and at runtime with `throttle blk iops=50` in the monitor (0 for no
+//! limit). Each limit is a token bucket holding a second's worth of tokens:
+//! bursts up to the rate go through at once. A request goes through while
+//! the buckets are not empty, and may take them into debt, so that requests
+//! larger than the rate make progress too.
+//!
+//! Requests over the limits wait in the device (virtio-blk requests and
+//! virtio-net transmits) until the buckets refill. Received packets over the
+//! limits are dropped, like a policer on a link.
+use crate::timer::{self, TIMEBASE_FREQ};
+
+
+/// The highest limit (64G per second), so that a second's worth of tokens
+/// fits in the buckets.
+pub const MAX_RATE: u64 = 1 << 36;
+
+/// Requests and bytes per second. 0 means no limit.
+#[derive(Clone, Copy, Default, PartialEq, Eq)]
+pub struct Limits {
+    pub ops: u64,
+    pub bytes: u64,
+}
+
+/// Tokens are in units of 1/TIMEBASE_FREQ, i.e. the bucket refills `rate`
+/// tokens per tick.
+#[derive(Clone, Copy, Default)]
+struct Bucket {
+    rate: u64,
+    tokens: i64,
+    refilled_at: u64,
+}
+
+impl Bucket {
+    fn new(rate: u64) -> Bucket {
+        Bucket { rate, tokens: Bucket::capacity(rate), refilled_at: timer::now() }
+    }
+
+    fn capacity(rate: u64) -> i64 {
+        (rate * TIMEBASE_FREQ) as i64
+    }
+
+    fn refill(&mut self, now: u64) {
+        let elapsed = now.saturating_sub(self.refilled_at).min(TIMEBASE_FREQ);
+        self.tokens = (self.tokens + (elapsed * self.rate) as i64).min(Bucket::capacity(self.rate));
+        self.refilled_at = now;
+    }
+
+    fn is_empty(&self) -> bool {
+        self.rate != 0 && self.tokens < 0
+    }
+
+    fn take(&mut self, amount: u64) {
+        if self.rate != 0 {
+            let tokens = amount.saturating_mul(TIMEBASE_FREQ).min(i64::MAX as u64) as i64;
+            self.tokens = self.tokens.saturating_sub(tokens);
+        }
+    }
+
+    /// When the debt is paid off.
+    fn ready_at(&self) -> u64 {
+        if !self.is_empty() {
+            return self.refilled_at;
+        }
+
+        self.refilled_at + (-self.tokens) as u64 / self.rate + 1
+    }
+}
+
+#[derive(Default)]
+pub struct Throttle {
+    limits: Limits,
+    ops: Bucket,
+    bytes: Bucket,
+}
+
+impl Throttle {
+    pub fn new(limits: Limits) -> Throttle {
+        Throttle { limits, ops: Bucket::new(limits.ops), bytes: Bucket::new(limits.bytes) }
+    }
+
+    pub fn limits(&self) -> Limits {
+        self.limits
+    }
+
+    /// Changes the limits, with full buckets.
+    pub fn set_limits(&mut self, limits: Limits) {
+        *self = Throttle::new(limits);
+    }
+
+    pub fn is_enabled(&self) -> bool {
+        self.limits != Limits::default()
+    }
+
+    /// Whether a request of `len` bytes may go now. If so, it takes the
+    /// tokens for it.
+    pub fn admit(&mut self, len: u64) -> bool {
+        if !self.is_enabled() {
+            return true;
+        }
+
+        let now = timer::now();
+        self.ops.refill(now);
+        self.bytes.refill(now);
+        if self.ops.is_empty() || self.bytes.is_empty() {
+            return false;
+        }
+
+        self.ops.take(1);
+        self.bytes.take(len);
+        true
+    }
+
+    /// When the next request may go.
+    pub fn ready_at(&self) -> u64 {
+        self.ops.ready_at().max(self.bytes.ready_at())
+    }
+}
@@ -0,0 +1,266 @@
+//! Guest timer. The guest programs the next timer interrupt either by SBI
+//! set_timer, or by writing stimecmp directly if the host CPU has the Sstc
+//! extension.
+//!
+//! For SBI set_timer, we program the host timer with the same deadline
+//! and inject VSTIP when it fires. In the meantime the hart sleeps in the
+//! guest's WFI.
+//!
+//! Guest time is host time plus htimedelta: 0 unless the VM has been
+//! restored from another boot (a snapshot or a migration), or paused (see
+//! vm.rs).
+//!
+//! With `-clock-scale <factor>`, guest time runs slower or faster than host
+//! time instead, e.g. 0.1 to watch the scheduler in slow motion. The guest's
+//! time reads trap (see hcounteren) and Sstc is hidden, so that we convert
+//! every time and deadline. The RTC and the watchdog stay in host time.
+use alloc::string::String;
+use core::{
+    arch::asm,
+    sync::atomic::{AtomicBool, AtomicU64, Ordering},
+};
+use spin::RwLock;
+
+use crate::{
+    config::config,
+    cpu_quota, host_dtb, metrics, migration, nested, rtc, sbi,
+    snapshot::{self, Reader, Section, Snapshot, Writer},
+    vcpu::VCpu,
+    virtio_blk, virtio_net, watchdog,
+};
+
+const SIE_STIE: u64 = 1 << 5;
+const HVIP_VSTIP: u64 = 1 << 6;
+const HENVCFG_STCE: u64 = 1 << 63;
+const HCOUNTEREN_TM: u64 = 1 << 1;
+/// No timer interrupt.
+pub const NO_DEADLINE: u64 = u64::MAX;
+/// The frequency of the `time` CSR, advertised in the device tree.
+pub const TIMEBASE_FREQ: u64 = 10_000_000;
+pub const NS_PER_TICK: u64 = 1_000_000_000 / TIMEBASE_FREQ;
+
+static SSTC: AtomicBool = AtomicBool::new(false);
+/// htimedelta: guest time minus host time (wrapping).
+static TIME_DELTA: AtomicU64 = AtomicU64::new(0);
+/// Some if `-clock-scale` is given.
+static CLOCK: RwLock<Option<ScaledClock>> = RwLock::new(None);
+
+/// Guest time runs at `num / den` of host time from `base_host`.
+struct ScaledClock {
+    base_host: u64,
+    /// The guest time at `base_host`.
+    base_guest: u64,
+    num: u64,
+    den: u64,
+}
+
+impl ScaledClock {
+    fn guest_time(&self, host_time: u64) -> u64 {
+        let elapsed = host_time.saturating_sub(self.base_host) as u128 * self.num as u128 / self.den as u128;
+        self.base_guest.wrapping_add(elapsed as u64)
+    }
+
+    /// Rounded up, so that the deadline has passed when the timer fires.
+    fn host_time(&self, guest_time: u64) -> u64 {
+        let Some(remaining) = guest_time.checked_sub(self.base_guest) else {
+            return self.base_host;
+        };
+
+        let elapsed = (remaining as u128 * self.den as u128).div_ceil(self.num as u128);
+        (self.base_host as u128 + elapsed).min(NO_DEADLINE as u128) as u64
+    }
+
+    /// Continues from the guest time `guest_time` now.
+    fn rebase(&mut self, guest_time: u64) {
+        self.base_host = now();
+        self.base_guest = guest_time;
+    }
+}
+
+/// Converts `time` ticks into nanoseconds.
+pub fn ticks_to_ns(ticks: u64) -> u64 {
+    ticks * NS_PER_TICK
+}
+
+pub fn now() -> u64 {
+    let time: u64;
+    unsafe {
+        asm!("csrr {}, time", out(reg) time);
+    }
+    time
+}
+
+/// htimedelta for the vCPUs.
+pub fn time_delta() -> u64 {
+    TIME_DELTA.load(Ordering::Relaxed)
+}
+
+/// The time in the guest.
+pub fn guest_now() -> u64 {
+    match CLOCK.read().as_ref() {
+        Some(clock) => clock.guest_time(now()),
+        None => now().wrapping_add(time_delta()),
+    }
+}
+
+/// Makes the guest time continue from `guest_time` now. vCPUs apply it on
+/// the next VM entry.
+pub fn set_guest_time(guest_time: u64) {
+    match CLOCK.write().as_mut() {
+        Some(clock) => clock.rebase(guest_time),
+        None => TIME_DELTA.store(guest_time.wrapping_sub(now()), Ordering::Relaxed),
+    }
+}
+
+/// Converts a guest time (e.g. a deadline) into host time.
+pub fn to_host_time(deadline: u64) -> u64 {
+    if deadline == NO_DEADLINE {
+        return NO_DEADLINE;
+    }
+
+    if let Some(clock) = CLOCK.read().as_ref() {
+        return clock.host_time(deadline);
+    }
+
+    (deadline as i128 - time_delta() as i64 as i128).clamp(0, NO_DEADLINE as i128) as u64
+}
+
+/// Lets the host timer fire now, so that `rearm` programs it for the new
+/// deadlines, e.g. of a device.
+pub fn kick() {
+    sbi::set_timer(now()).expect("failed to set the host timer");
+}
+
+/// hcounteren: the guest reads the counters directly, except the time if
+/// it's scaled.
+pub fn hcounteren() -> u64 {
+    // cycle, time, instret, and hpmcounters (see pmu.rs)
+    let counters = 0xffff_ffff;
+    if CLOCK.read().is_some() { counters & !HCOUNTEREN_TM } else { counters }
+}
+
+/// The current `-clock-scale` as (numerator, denominator). None if not
+/// scaled.
+pub fn clock_scale() -> Option<(u64, u64)> {
+    CLOCK.read().as_ref().map(|clock| (clock.num, clock.den))
+}
+
+/// Changes the speed of the guest time from now on. Only with
+/// `-clock-scale`: the guest must have booted with its time reads trapped.
+/// The other vCPUs reprogram their timers on the next timer interrupt.
+pub fn set_clock_scale(num: u64, den: u64) -> Result<(), String> {
+    {
+        let mut clock = CLOCK.write();
+        let Some(clock) = clock.as_mut() else {
+            return Err(String::from("the guest time is not scaled (boot with -clock-scale)"));
+        };
+
+        let guest_time = clock.guest_time(now());
+        clock.rebase(guest_time);
+        clock.num = num;
+        clock.den = den;
+    }
+
+    info!("timer", "the guest time runs at {}/{} of the host's", num, den);
+    // rearm converts the deadline.
+    kick();
+    Ok(())
+}
+
+/// Whether the guest can use stimecmp (vstimecmp) without trapping.
+pub fn has_sstc() -> bool {
+    SSTC.load(Ordering::Relaxed)
+}
+
+/// Detects Sstc. Called once on the boot hart.
+pub fn init() {
+    let scale = config().clock_scale;
+    // vstimecmp compares with the host time plus htimedelta: it can't be
+    // scaled. A nested guest would get the interrupt of its hypervisor's
+    // vstimecmp (see nested.rs).
+    let sstc = host_dtb::has_isa_extension("sstc") && scale.is_none() && !config().nested && config().isa.has("sstc");
+    SSTC.store(sstc, Ordering::Relaxed);
+    if let Some((num, den)) = scale {
+        *CLOCK.write() = Some(ScaledClock { base_host: now(), base_guest: now(), num, den });
+        info!("timer", "the guest time runs at {}/{} of the host's", num, den);
+    }
+}
+
+/// Enables the host timer interrupt on this hart.
+pub fn init_hart() {
+    unsafe {
+        if has_sstc() {
+            asm!("csrs henvcfg, {}", in(reg) HENVCFG_STCE);
+            // vstimecmp: no interrupt until the guest sets it.
+            asm!("csrw 0x24d, {}", in(reg) NO_DEADLINE);
+        }
+
+        asm!("csrs sie, {}", in(reg) SIE_STIE);
+    }
+}
+
+/// Programs the host timer for the vCPU's deadline, or injects the timer
+/// interrupt if it has already passed.
+pub fn rearm(vcpu: &VCpu) {
+    let mut deadline = vcpu.timer_deadline;
+    if deadline != NO_DEADLINE && guest_now() >= deadline {
+        metrics::record_timer_interrupt(vcpu.hart_id);
+        nested::set_hvip(HVIP_VSTIP, true);
+        deadline = NO_DEADLINE;
+    }
+
+    // Also preempt the vCPU to check its CPU quota, the watchdog, the RTC
+    // alarm, and held virtio interrupts, and to send pages in a migration.
+    let deadline = to_host_time(deadline)
+        .min(cpu_quota::deadline(vcpu.hart_id))
+        .min(watchdog::deadline())
+        .min(rtc::deadline())
+        .min(virtio_net::deadline())
+        .min(virtio_blk::deadline())
+        .min(migration::deadline(vcpu.hart_id));
+    sbi::set_timer(deadline).expect("failed to set the host timer");
+}
+
+/// SBI set_timer: sets the next deadline and clears the pending interrupt.
+pub fn set_timer(vcpu: &mut VCpu, deadline: u64) {
+    nested::set_hvip(HVIP_VSTIP, false);
+
+    vcpu.timer_deadline = deadline;
+    rearm(vcpu);
+}
+
+/// Handles a supervisor timer interrupt: the host timer has fired.
+pub fn handle_interrupt(vcpu: &mut VCpu) {
+    watchdog::poll(vcpu);
+    rtc::poll();
+    virtio_net::poll();
+    virtio_blk::poll();
+    migration::poll(vcpu);
+    // The timer may fire a little early, or the deadline may have been moved.
+    rearm(vcpu);
+}
+
+/// The guest time in a snapshot.
+struct GuestTime;
+
+impl Snapshot for GuestTime {
+    const VERSION: u32 = 1;
+
+    fn save(&self, w: &mut Writer) {
+        w.u64(guest_now());
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        // The guest time continues from the saved one.
+        set_guest_time(r.u64()?);
+        Some(())
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    w.section("time", &GuestTime);
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    snapshot::load_section(sections, "time", &mut GuestTime)
+}
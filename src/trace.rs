@@ -0,0 +1,82 @@
+//! `-trace`: emits a JSON line for every VM exit, e.g.
+//!
+//! ```text
+//! {"vcpu": 0, "reason": "load guest-page fault", "scause": "0x15", "pc": "0xffffffff80400a2c", "addr": "0x10001070", "mmio": "virtio-net", "time": 1834413100, "ns": 18300}
+//! ```
+//!
+//! `time` is when the VM exit happened (the host time in nanoseconds), and
+//! `ns` how long it took. With `-trace-guest`, the events the guest writes
+//! into its trace buffer go in between (see guest_trace.rs).
+//!
+//! Records go to the "trace" port of the host virtio console if any
+//! (`-device virtserialport,name=trace`), otherwise to the hypervisor's console.
+use alloc::{format, string::String};
+use core::arch::asm;
+use spin::Once;
+
+use crate::{config::config, guest_trace, host_console, timer::ticks_to_ns};
+
+/// `-device virtserialport,name=trace` in run.sh.
+const PORT: &str = "trace";
+
+static USE_PORT: Once<bool> = Once::new();
+
+pub struct Exit {
+    pub scause: u64,
+    pub reason: &'static str,
+    pub pc: u64,
+    /// The guest physical address for guest-page faults.
+    pub addr: Option<u64>,
+    /// The device which handled the MMIO access.
+    pub mmio: Option<&'static str>,
+    /// When the VM exit happened (in `time` ticks).
+    pub start: u64,
+}
+
+pub fn now() -> u64 {
+    let time: u64;
+    unsafe {
+        asm!("csrr {}, time", out(reg) time);
+    }
+    time
+}
+
+pub fn init() {
+    let use_port = host_console::has_port(PORT);
+    USE_PORT.call_once(|| use_port);
+    info!("trace", "writing VM exits to {}", if use_port { "the \"trace\" port" } else { "the console" });
+}
+
+/// Records a VM exit. Call this right before returning to the guest.
+pub fn record(vcpu_id: u64, exit: &Exit) {
+    if config().trace_guest.is_some() {
+        guest_trace::drain();
+    }
+
+    let ns = ticks_to_ns(now() - exit.start);
+    let mut line = format!(
+        "{{\"vcpu\": {}, \"reason\": \"{}\", \"scause\": \"{:#x}\", \"pc\": \"{:#x}\"",
+        vcpu_id, exit.reason, exit.scause, exit.pc
+    );
+
+    if let Some(addr) = exit.addr {
+        line.push_str(&format!(", \"addr\": \"{:#x}\"", addr));
+    }
+
+    if let Some(mmio) = exit.mmio {
+        line.push_str(&format!(", \"mmio\": \"{}\"", mmio));
+    }
+
+    line.push_str(&format!(", \"time\": {}, \"ns\": {}}}", ticks_to_ns(exit.start), ns));
+    write(line);
+}
+
+/// Writes a record.
+pub fn write(mut line: String) {
+    if USE_PORT.get() == Some(&true) {
+        line.push('\n');
+        host_console::write(PORT, line.as_bytes());
+    } else {
+        println!("{}", line);
+    }
+}
@@ -1,8 +1,19 @@
 use core::{arch::naked_asm, mem::offset_of};
-use alloc::vec::Vec;
-use spin::Mutex;
+use alloc::format;
 
-use crate::{linux_loader::{PLIC_ADDR, PLIC_END}, vcpu::VCpu};
+use crate::{
+    boot_time, config::config, cpu_quota, crash, fault_stats, gdb, guest_memory::GUEST_MEMORY, host_console, host_net, host_plic, host_test, host_uart, metrics, migration,
+    guest_page_table::{GuestPageTable, PTE_R, PTE_W, PTE_X},
+    inst_emulation, monitor, mmio_bus,
+    hypercall, nested, pmu, profile,
+    mmio_decode::{self, MmioAccess},
+    sbi, serial,
+    smp::{self, RemoteFence},
+    symbols,
+    timer, trace,
+    vcpu::VCpu,
+    virtio_blk, virtio_input, virtio_net, virtio_vsock,
+};
 
 macro_rules! read_csr {
     ($csr:expr) => {{
@@ -57,6 +68,9 @@ pub extern "C" fn trap_handler() -> ! {
         "csrr t0, sscratch",
         "sd t0, {a0_offset}(a0)",
 
+        // Keep the vCPU ID in tp (see smp::current_hart_id).
+        "ld tp, {hart_id_offset}(a0)",
+
         // Switch to the hypervisor's stack.
         "ld sp, {host_sp_offset}(a0)",
 
@@ -64,6 +78,7 @@ pub extern "C" fn trap_handler() -> ! {
         "call {handle_trap}",
         handle_trap = sym handle_trap,
         host_sp_offset = const offset_of!(VCpu, host_sp),
+        hart_id_offset = const offset_of!(VCpu, hart_id),
         ra_offset = const offset_of!(VCpu, ra),
         sp_offset = const offset_of!(VCpu, sp),
         gp_offset = const offset_of!(VCpu, gp),
@@ -98,44 +113,147 @@ pub extern "C" fn trap_handler() -> ! {
     );
 }
 
-static CONSOLE_BUFFER: Mutex<Vec<u8>> = Mutex::new(Vec::new());
+/// SBI system reset from the guest. We forward it to the firmware: QEMU
+/// exits on shutdown, and a reboot restarts the whole machine including the
+/// hypervisor. If the guest has crashed, `-on-crash` decides instead.
+fn handle_system_reset(vcpu: &mut VCpu, reset_type: u64, reason: u64) -> Result<i64, i64> {
+    let type_str = match reset_type {
+        sbi::RESET_TYPE_SHUTDOWN => "shutdown",
+        sbi::RESET_TYPE_COLD_REBOOT | sbi::RESET_TYPE_WARM_REBOOT => "reboot",
+        _ => return Err(-3), // SBI_ERR_INVALID_PARAM
+    };
+
+    if reason > sbi::RESET_REASON_SYSTEM_FAILURE && reason < 0xf000_0000 {
+        return Err(-3); // SBI_ERR_INVALID_PARAM
+    }
+
+    smp::pause_others(vcpu);
+    info!("sbi", "system {} requested by the guest (reason={})", type_str, reason);
+    if config().boot_time {
+        boot_time::print_report();
+    }
+
+    if config().fault_stats {
+        fault_stats::print_report();
+    }
+
+    if reason == sbi::RESET_REASON_SYSTEM_FAILURE || crash::is_panicking() {
+        crash::handle(vcpu);
+    }
+
+    let event_reason = if reset_type == sbi::RESET_TYPE_SHUTDOWN { "guest-shutdown" } else { "guest-reset" };
+    monitor::event("SHUTDOWN", &format!("{{\"guest\": true, \"reason\": \"{}\"}}", event_reason));
+
+    let result = if reset_type == sbi::RESET_TYPE_SHUTDOWN {
+        host_test::exit(if reason == sbi::RESET_REASON_NONE { 0 } else { host_test::EXIT_FAILURE })
+    } else {
+        sbi::system_reset(reset_type, reason)
+    };
+    smp::resume_others();
+    result.map(|value| value as i64)
+}
+
+/// SBI debug console write: the buffer is in guest physical memory.
+fn handle_console_write(len: u64, addr: u64) -> Result<i64, i64> {
+    if !GUEST_MEMORY.contains_range(addr, len as usize) {
+        return Err(-3); // SBI_ERR_INVALID_PARAM
+    }
+
+    let mut buf = [0; 64];
+    for offset in (0..len).step_by(buf.len()) {
+        let chunk = &mut buf[..(len - offset).min(64) as usize];
+        GUEST_MEMORY.read_at(addr + offset, chunk).ok_or(-3i64)?;
+        for &ch in chunk.iter() {
+            serial::putchar(ch);
+        }
+    }
+    Ok(len as i64)
+}
+
+/// SBI debug console read: returns the number of bytes read without blocking.
+fn handle_console_read(len: u64, addr: u64) -> Result<i64, i64> {
+    if !GUEST_MEMORY.contains_range(addr, len as usize) {
+        return Err(-3); // SBI_ERR_INVALID_PARAM
+    }
+
+    let mut read = 0;
+    while read < len {
+        let Some(ch) = serial::getchar() else {
+            break;
+        };
+
+        GUEST_MEMORY.write_at(addr + read, &[ch]).ok_or(-3i64)?;
+        read += 1;
+    }
+    Ok(read as i64)
+}
 
 fn handle_sbi_call(vcpu: &mut VCpu) {
     let eid = vcpu.a7;
     let fid = vcpu.a6;
+    debug!("sbi", "vCPU {}: eid={:#x}, fid={:#x}, a0={:#x}", vcpu.hart_id, eid, fid, vcpu.a0);
     let result: Result<i64, i64> = match (eid, fid) {
-        // Set Timer
-        (0x00, 0x0) => {
-            println!("[sbi] WARN: set_timer is not implemented, ignoring");
+        // Set Timer (legacy and TIME extension)
+        (0x00 | 0x54494d45, 0x0) => {
+            timer::set_timer(vcpu, vcpu.a0);
             Ok(0)
         }
         // Get SBI specification version
-        (0x10, 0x0) => Ok(0),
+        (0x10, 0x0) => Ok(0x2000000), // v2.0 (Linux uses DBCN only if >= v2.0)
+        // Get SBI implementation ID/version
+        (0x10, 0x1 | 0x2) => Ok(0),
         // Probe SBI extension
-        (0x10, 0x3) => Err(-1),
+        (0x10, 0x3) => match vcpu.a0 {
+            0x735049 /* IPI */ | 0x52464e43 /* RFENCE */ | 0x48534d /* HSM */
+            | 0x53525354 /* SRST */ | 0x54494d45 /* TIME */ | 0x4442434e /* DBCN */ => Ok(1),
+            0x504d55 /* PMU */ => Ok(pmu::is_available() as i64),
+            hypercall::EID => Ok(1),
+            _ => Ok(0),
+        },
         // Get machine vendor/arch/implementation ID
         (0x10, 0x4 | 0x5 | 0x6) => Ok(0),
         // Console Putchar.
         (0x1, 0x0) => {
-            let ch = vcpu.a0 as u8;
-            let mut buffer = CONSOLE_BUFFER.lock();
-            if ch == b'\n' {
-                let output = core::str::from_utf8(&buffer).unwrap_or("(not utf-8)");
-                println!("[guest] {}", output);
-                buffer.clear();
-            } else {
-                buffer.push(ch);
-            }
+            serial::putchar(vcpu.a0 as u8);
+            Ok(0)
+        }
+        // Console Getchar. Legacy extensions return the value in a0 (-1 if none).
+        (0x2, 0x0) => Err(serial::getchar().map(|ch| ch as i64).unwrap_or(-1)),
+        // Send IPI
+        (0x735049, 0x0) => smp::send_ipi(vcpu.a0, vcpu.a1),
+        // Remote FENCE.I
+        (0x52464e43, 0x0) => smp::remote_fence(vcpu.a0, vcpu.a1, RemoteFence::FenceI),
+        // Remote SFENCE.VMA (with ASID)
+        (0x52464e43, 0x1 | 0x2) => smp::remote_fence(vcpu.a0, vcpu.a1, RemoteFence::SfenceVma),
+        // HART start
+        (0x48534d, 0x0) => smp::hart_start(vcpu.a0, vcpu.a1, vcpu.a2),
+        // HART stop
+        (0x48534d, 0x1) => smp::hart_stop(vcpu),
+        // HART get status
+        (0x48534d, 0x2) => smp::hart_get_status(vcpu.a0),
+        // HART suspend
+        (0x48534d, 0x3) => smp::hart_suspend(vcpu, vcpu.a0, vcpu.a1, vcpu.a2),
+        // System reset
+        (0x53525354, 0x0) => handle_system_reset(vcpu, vcpu.a0, vcpu.a1),
+        // Console Write
+        (0x4442434e, 0x0) => handle_console_write(vcpu.a0, vcpu.a1 | (vcpu.a2 << 32)),
+        // Console Read
+        (0x4442434e, 0x1) => handle_console_read(vcpu.a0, vcpu.a1 | (vcpu.a2 << 32)),
+        // Console Write Byte
+        (0x4442434e, 0x2) => {
+            serial::putchar(vcpu.a0 as u8);
             Ok(0)
         }
-        // Console Getchar.
-        (0x2, 0x0) => Err(-1), // Not supported
+        // Performance monitoring unit
+        (0x504d55, fid) => pmu::handle_sbi_call(vcpu, fid),
+        // Paravirtual services
+        (hypercall::EID, fid) => hypercall::handle_sbi_call(vcpu, fid),
         _ => {
-            panic!("unknown SBI call: eid={:#x}, fid={:#x}", eid, fid);
+            warn!("sbi", "unsupported SBI call: eid={:#x}, fid={:#x}", eid, fid);
+            Err(-2) // SBI_ERR_NOT_SUPPORTED
         }
     };
 
-
     match result {
         Ok(value) => {
             vcpu.a0 = 0;
@@ -147,102 +265,103 @@ fn handle_sbi_call(vcpu: &mut VCpu) {
     }
 }
 
-fn handle_mmio_write(vcpu: &mut VCpu, guest_addr: u64, reg: u64, width: u64) {
-    let value = match reg {
-        0 => 0, // x0 is hardwired to 0
-        1 => vcpu.ra,
-        2 => vcpu.sp,
-        3 => vcpu.gp,
-        4 => vcpu.tp,
-        5 => vcpu.t0,
-        6 => vcpu.t1,
-        7 => vcpu.t2,
-        8 => vcpu.s0,
-        9 => vcpu.s1,
-        10 => vcpu.a0,
-        11 => vcpu.a1,
-        12 => vcpu.a2,
-        13 => vcpu.a3,
-        14 => vcpu.a4,
-        15 => vcpu.a5,
-        16 => vcpu.a6,
-        17 => vcpu.a7,
-        18 => vcpu.s2,
-        19 => vcpu.s3,
-        20 => vcpu.s4,
-        21 => vcpu.s5,
-        22 => vcpu.s6,
-        23 => vcpu.s7,
-        24 => vcpu.s8,
-        25 => vcpu.s9,
-        26 => vcpu.s10,
-        27 => vcpu.s11,
-        28 => vcpu.t3,
-        29 => vcpu.t4,
-        30 => vcpu.t5,
-        31 => vcpu.t6,
-        _ => unreachable!(),
-    };
+fn mmio_write(guest_addr: u64, value: u64, width: u64) {
+    if mmio_bus::write(guest_addr, value, width).is_none() {
+        panic!("[MMIO]: invalid write at {:#x} (value={:#x}, width={})", guest_addr, value, width);
+    }
+}
 
-    match guest_addr {
-        PLIC_ADDR..PLIC_END => {
-            println!("[MMIO]: ignore write to PLIC at {:#x}", guest_addr);
-        }
-        _ => {
-            panic!("[MMIO]: invalid write at {:#x} (value={:#x}, width={})", guest_addr, value, width);
+fn mmio_read(guest_addr: u64, width: u64) -> u64 {
+    mmio_bus::read(guest_addr, width)
+        .unwrap_or_else(|| panic!("[MMIO]: invalid read at {:#x} (width={})", guest_addr, width))
+}
+
+/// Emulates a load/store to an MMIO device. Misaligned accesses are split
+/// into byte accesses.
+fn handle_mmio(vcpu: &mut VCpu, guest_addr: u64, access: &MmioAccess) {
+    let aligned = guest_addr % access.width == 0;
+    if access.is_write {
+        let value = vcpu.gpr(access.reg);
+        if aligned {
+            mmio_write(guest_addr, value, access.width);
+        } else {
+            for i in 0..access.width {
+                mmio_write(guest_addr + i, (value >> (8 * i)) & 0xff, 1);
+            }
         }
+    } else {
+        let value = if aligned {
+            mmio_read(guest_addr, access.width)
+        } else {
+            (0..access.width).fold(0, |value, i| value | (mmio_read(guest_addr + i, 1) & 0xff) << (8 * i))
+        };
+
+        vcpu.set_gpr(access.reg, mmio_decode::extend(access, value));
     }
 }
 
-fn handle_mmio_read(vcpu: &mut VCpu, guest_addr: u64, reg: u64, width: u64) {
-    let value = match guest_addr {
-        PLIC_ADDR..PLIC_END => {
-            println!("[MMIO]: ignore read from PLIC at {:#x}", guest_addr);
-            0
-        }
-        _ => {
-            panic!("[MMIO]: invalid read at {:#x} (width={})", guest_addr, width);
+fn handle_host_interrupt(vcpu: &mut VCpu) {
+    let hart_id = smp::physical_hart_id(smp::current_hart_id());
+    let irq = host_plic::claim(hart_id);
+    if irq == 0 {
+        return;
+    }
+
+    let mut from_console = false;
+    let mut from_uart = false;
+    if host_net::irq() == Some(irq) {
+        profile::set_device("virtio-net");
+        for frame in host_net::handle_interrupt() {
+            virtio_net::receive(&frame);
         }
-    };
+    } else if virtio_blk::host_irq() == Some(irq) {
+        profile::set_device("virtio-blk");
+        virtio_blk::handle_interrupt();
+    } else if host_console::irq() == Some(irq) {
+        profile::set_device("host-console");
+        host_console::handle_interrupt();
+        from_console = true;
+    } else if host_uart::irq() == Some(irq) {
+        profile::set_device("uart");
+        serial::handle_interrupt();
+        from_uart = true;
+    } else if virtio_input::is_host_irq(irq) {
+        profile::set_device("virtio-input");
+        virtio_input::handle_interrupt(irq);
+    } else {
+        warn!("host", "unexpected interrupt: irq={}", irq);
+    }
+
+    host_plic::complete(hart_id, irq);
 
-    match reg {
-        0 => {}, // x0 is hardwired to 0, writes are ignored
-        1 => vcpu.ra = value,
-        2 => vcpu.sp = value,
-        3 => vcpu.gp = value,
-        4 => vcpu.tp = value,
-        5 => vcpu.t0 = value,
-        6 => vcpu.t1 = value,
-        7 => vcpu.t2 = value,
-        8 => vcpu.s0 = value,
-        9 => vcpu.s1 = value,
-        10 => vcpu.a0 = value,
-        11 => vcpu.a1 = value,
-        12 => vcpu.a2 = value,
-        13 => vcpu.a3 = value,
-        14 => vcpu.a4 = value,
-        15 => vcpu.a5 = value,
-        16 => vcpu.a6 = value,
-        17 => vcpu.a7 = value,
-        18 => vcpu.s2 = value,
-        19 => vcpu.s3 = value,
-        20 => vcpu.s4 = value,
-        21 => vcpu.s5 = value,
-        22 => vcpu.s6 = value,
-        23 => vcpu.s7 = value,
-        24 => vcpu.s8 = value,
-        25 => vcpu.s9 = value,
-        26 => vcpu.s10 = value,
-        27 => vcpu.s11 = value,
-        28 => vcpu.t3 = value,
-        29 => vcpu.t4 = value,
-        30 => vcpu.t5 = value,
-        31 => vcpu.t6 = value,
-        _ => unreachable!(),
+    // This may stop the guest for a while: do it after completing the interrupt.
+    if from_console && config().gdb {
+        gdb::handle_interrupt(vcpu);
+    }
+
+    if from_console && config().monitor {
+        monitor::handle_interrupt(vcpu);
+    }
+
+    if from_uart {
+        monitor::handle_console(vcpu);
+    }
+
+    if from_console && config().metrics {
+        metrics::handle_interrupt();
+    }
+
+    if from_console && config().pprof {
+        profile::handle_interrupt();
+    }
+
+    if from_console && config().vsock.is_some() {
+        virtio_vsock::handle_interrupt();
     }
 }
 
 pub fn handle_trap(vcpu: *mut VCpu) -> ! {
+    let start = trace::now();
     let scause = read_csr!("scause");
     let sepc = read_csr!("sepc");
     let stval = read_csr!("stval");
@@ -282,44 +401,94 @@ pub fn handle_trap(vcpu: *mut VCpu) -> ! {
     };
 
     let vcpu = unsafe { &mut *vcpu };
+    trace!("vcpu", "vCPU {}: {} at {:#x} (stval={:#x})", vcpu.hart_id, scause_str, sepc, stval);
+    // Interrupts may arrive while the guest is in VU-mode: save SPP.
+    vcpu.sstatus = read_csr!("sstatus");
+    let mut fault_addr = None;
     match scause {
+        // Host interrupts are ours even while the nested guest runs.
+        _ if scause >> 63 == 0 && nested::in_nested_guest(vcpu.hart_id) => {
+            nested::handle_exception(vcpu, scause, sepc, stval);
+        }
         10 /* environment call from VS-mode */ => {
             handle_sbi_call(vcpu);
             vcpu.sepc = sepc + 4;
         }
-        21 /* load guest-page fault */ | 23 /* store/AMO guest-page fault */ => {
+        20 /* instruction guest-page fault */ | 21 /* load guest-page fault */ | 23 /* store/AMO guest-page fault */ => {
             let htinst = read_csr!("htinst");
             let htval = read_csr!("htval");
-            assert!(htinst != 0);
 
             // "A guest physical address written to htval is shifted right by 2 bits"
             let guest_addr = (htval << 2) | (stval & 0b11);
-            let is_write = scause == 23;
-            let width  = match (htinst & 0x7f, (htinst >> 12) & 0x7) {
-                (0x03, 0x0) | (0x03, 0x4) => 1, // lb, lbu
-                (0x03, 0x1) | (0x03, 0x5) => 2, // lh, lhu
-                (0x03, 0x2) | (0x03, 0x6) => 4, // lw, lwu
-                (0x03, 0x3) => 8, // ld
-                (0x23, 0x0) => 1, // sb
-                (0x23, 0x1) => 2, // sh
-                (0x23, 0x2) => 4, // sw
-                (0x23, 0x3) => 8, // sd
-                _ => 4,
-            };
-
-            if is_write {
-                let rs2 = (htinst >> 20) & 0x1f;
-                handle_mmio_write(vcpu, guest_addr, rs2, width);
+            fault_addr = Some(guest_addr);
+            if scause == 23 && migration::handle_write_fault(vcpu, guest_addr) {
+                // Write-protected for the dirty log: retry the store.
+                vcpu.sepc = sepc;
+            } else if GUEST_MEMORY.populate(&mut GuestPageTable::from_hgatp(vcpu.hgatp), guest_addr, PTE_R | PTE_W | PTE_X) {
+                // The first access to the page: retry it.
+                vcpu.sepc = sepc;
+            } else if scause == 20 {
+                panic!("trap handler: {} at guest PC {} (addr={:#x})", scause_str, symbols::describe(sepc), guest_addr);
             } else {
-                let rd = (htinst >> 7) & 0x1f;
-                handle_mmio_read(vcpu, guest_addr, rd, width);
-            }
+                let Some(access) = mmio_decode::decode(vcpu, htinst, sepc) else {
+                    panic!(
+                        "[MMIO]: unsupported instruction at guest PC {} (addr={:#x}, htinst={:#x})",
+                        symbols::describe(sepc),
+                        guest_addr,
+                        htinst
+                    );
+                };
 
-            let is_compressed = htinst & (1 << 1) == 0;
-            let inst_len = if is_compressed { 2 } else { 4 };
-            vcpu.sepc = sepc + inst_len;
+                handle_mmio(vcpu, guest_addr, &access);
+                vcpu.sepc = sepc + access.inst_len;
+            }
+        }
+        22 /* virtual instruction */ => inst_emulation::handle_virtual_instruction(vcpu, sepc, stval),
+        3 /* breakpoint */ => {
+            vcpu.sepc = sepc;
+            if !(config().monitor && monitor::handle_breakpoint(vcpu)) {
+                gdb::handle_breakpoint(vcpu);
+            }
+        }
+        // Set sepc first: the vCPU might get paused (see smp::pause_others).
+        0x8000_0000_0000_0001 /* supervisor software interrupt */ => {
+            vcpu.sepc = sepc;
+            smp::handle_ipi(vcpu);
         }
-        _ => panic!("trap handler: {} at {:#x} (stval={:#x})", scause_str, sepc, stval),
+        0x8000_0000_0000_0005 /* supervisor timer interrupt */ => {
+            vcpu.sepc = sepc;
+            timer::handle_interrupt(vcpu);
+        }
+        0x8000_0000_0000_0009 /* supervisor external interrupt */ => {
+            vcpu.sepc = sepc;
+            handle_host_interrupt(vcpu);
+        }
+        _ => panic!("trap handler: {} at guest PC {} (stval={:#x})", scause_str, symbols::describe(sepc), stval),
+    }
+
+    if crash::has_halted() {
+        crash::handle(vcpu);
+    }
+
+    if let Some(addr) = fault_addr.filter(|_| config().fault_stats) {
+        fault_stats::record(addr, trace::now() - start);
+    }
+
+    metrics::record_exit(vcpu.hart_id, scause_str, start);
+    profile::record_exit(vcpu.hart_id, scause_str, start);
+    nested::check_interrupts(vcpu);
+    smp::handle_nmi(vcpu);
+    cpu_quota::account(vcpu, start);
+    if config().trace {
+        let exit = trace::Exit {
+            scause,
+            reason: scause_str,
+            pc: sepc,
+            addr: fault_addr,
+            mmio: fault_addr.and_then(mmio_bus::find).map(|region| region.name),
+            start,
+        };
+        trace::record(vcpu.hart_id, &exit);
     }
 
     vcpu.run();
@@ -1,13 +1,26 @@
 use core::{arch::asm, mem::offset_of};
 
-use crate::{allocator::alloc_pages, guest_page_table::GuestPageTable};
+use crate::{
+    allocator::alloc_pages,
+    config::config,
+    guest_page_table::GuestPageTable,
+    nested,
+    snapshot::{Reader, Snapshot, Writer},
+    timer::{self, NO_DEADLINE},
+};
+
+const SSTATUS_SIE: u64 = 1 << 1;
+const SSTATUS_SPIE: u64 = 1 << 5;
+const SSTATUS_SPP: u64 = 1 << 8;
 
 #[derive(Debug, Default)]
 pub struct VCpu {
     pub host_sp: u64,
+    pub hart_id: u64,
     pub hstatus: u64,
     pub hgatp: u64,
     pub hedeleg: u64,
+    pub hideleg: u64,
     pub sstatus: u64,
     pub sepc: u64,
     pub ra: u64,
@@ -41,19 +54,49 @@ pub struct VCpu {
     pub t4: u64,
     pub t5: u64,
     pub t6: u64,
+    // VS-mode CSRs: only valid while the vCPU is paused (see save_vs_csrs).
+    pub vsstatus: u64,
+    pub vsie: u64,
+    pub vstvec: u64,
+    pub vsscratch: u64,
+    pub vsepc: u64,
+    pub vscause: u64,
+    pub vstval: u64,
+    pub vsatp: u64,
+    pub hvip: u64,
+    /// vstimecmp (Sstc only).
+    pub vstimecmp: u64,
+    /// The deadline set by SBI set_timer.
+    pub timer_deadline: u64,
 }
 
 impl VCpu {
     pub fn new(table: &GuestPageTable, guest_entry: u64) -> Self {
+        let stack_size = 512 * 1024;
+        let host_sp = alloc_pages(stack_size) as u64 + stack_size as u64;
+        Self::boot_state(table.hgatp(), host_sp, guest_entry)
+    }
+
+    /// Resets the vCPU to the state on boot, keeping the host stack and the
+    /// guest page table.
+    pub fn reset(&mut self, guest_entry: u64) {
+        *self = Self { hart_id: self.hart_id, ..Self::boot_state(self.hgatp, self.host_sp, guest_entry) };
+    }
+
+    fn boot_state(hgatp: u64, host_sp: u64, guest_entry: u64) -> Self {
         let mut hstatus: u64 = 0;
         hstatus |= 2 << 32; // VSXL: XLEN for VS-mode (64-bit)
         hstatus |= 1 << 7; // SPV: Supervisor Previous Virtualization mode
+        // VTW is 0: WFI in the guest halts the physical hart natively until
+        // an interrupt, including ours (e.g. the host timer), is pending.
 
         let mut hedeleg: u64 = 0;
         hedeleg |= 1 << 0; // Instruction address misaligned
         hedeleg |= 1 << 1; // Instruction access fault
         hedeleg |= 1 << 2; // Illegal instruction
-        hedeleg |= 1 << 3; // Breakpoint
+        if !config().gdb && !config().monitor {
+            hedeleg |= 1 << 3; // Breakpoint (otherwise handled by the GDB stub or `step`)
+        }
         hedeleg |= 1 << 4; // Load address misaligned
         hedeleg |= 1 << 5; // Load access fault
         hedeleg |= 1 << 6; // Store/AMO address misaligned
@@ -63,21 +106,169 @@ impl VCpu {
         hedeleg |= 1 << 13; // Load page fault
         hedeleg |= 1 << 15; // Store/AMO page fault
 
-        let sstatus: u64 = 1 << 8; // SPP: Supervisor Previous Privilege mode (VS-mode)
+        let mut hideleg: u64 = 0;
+        hideleg |= 1 << 2; // VS-level software interrupt
+        hideleg |= 1 << 6; // VS-level timer interrupt
+        hideleg |= 1 << 10; // VS-level external interrupt
+
+        let mut sstatus: u64 = SSTATUS_SPP; // SPP: Supervisor Previous Privilege mode (VS-mode)
+        sstatus |= config().isa.sstatus(); // FS and VS: Off unless the guest has F and V
 
-        let stack_size = 512 * 1024;
-        let host_sp = alloc_pages(stack_size) as u64 + stack_size as u64;
         Self {
             hstatus,
-            hgatp: table.hgatp(),
+            hgatp,
             hedeleg,
+            hideleg,
             sstatus,
             sepc: guest_entry,
             host_sp,
+            vstimecmp: NO_DEADLINE,
+            timer_deadline: NO_DEADLINE,
             ..Default::default()
         }
     }
 
+    /// Returns the general-purpose register `x<reg>`.
+    pub fn gpr(&self, reg: u64) -> u64 {
+        match reg {
+            0 => 0, // x0 is hardwired to 0
+            1 => self.ra,
+            2 => self.sp,
+            3 => self.gp,
+            4 => self.tp,
+            5 => self.t0,
+            6 => self.t1,
+            7 => self.t2,
+            8 => self.s0,
+            9 => self.s1,
+            10 => self.a0,
+            11 => self.a1,
+            12 => self.a2,
+            13 => self.a3,
+            14 => self.a4,
+            15 => self.a5,
+            16 => self.a6,
+            17 => self.a7,
+            18 => self.s2,
+            19 => self.s3,
+            20 => self.s4,
+            21 => self.s5,
+            22 => self.s6,
+            23 => self.s7,
+            24 => self.s8,
+            25 => self.s9,
+            26 => self.s10,
+            27 => self.s11,
+            28 => self.t3,
+            29 => self.t4,
+            30 => self.t5,
+            31 => self.t6,
+            _ => unreachable!(),
+        }
+    }
+
+    /// Sets the general-purpose register `x<reg>`.
+    pub fn set_gpr(&mut self, reg: u64, value: u64) {
+        match reg {
+            0 => {}, // x0 is hardwired to 0, writes are ignored
+            1 => self.ra = value,
+            2 => self.sp = value,
+            3 => self.gp = value,
+            4 => self.tp = value,
+            5 => self.t0 = value,
+            6 => self.t1 = value,
+            7 => self.t2 = value,
+            8 => self.s0 = value,
+            9 => self.s1 = value,
+            10 => self.a0 = value,
+            11 => self.a1 = value,
+            12 => self.a2 = value,
+            13 => self.a3 = value,
+            14 => self.a4 = value,
+            15 => self.a5 = value,
+            16 => self.a6 = value,
+            17 => self.a7 = value,
+            18 => self.s2 = value,
+            19 => self.s3 = value,
+            20 => self.s4 = value,
+            21 => self.s5 = value,
+            22 => self.s6 = value,
+            23 => self.s7 = value,
+            24 => self.s8 = value,
+            25 => self.s9 = value,
+            26 => self.s10 = value,
+            27 => self.s11 = value,
+            28 => self.t3 = value,
+            29 => self.t4 = value,
+            30 => self.t5 = value,
+            31 => self.t6 = value,
+            _ => unreachable!(),
+        }
+    }
+
+    /// Copies the VS-mode CSRs of this hart into the struct.
+    pub fn save_vs_csrs(&mut self) {
+        unsafe {
+            asm!("csrr {}, vsstatus", out(reg) self.vsstatus);
+            asm!("csrr {}, vsie", out(reg) self.vsie);
+            asm!("csrr {}, vstvec", out(reg) self.vstvec);
+            asm!("csrr {}, vsscratch", out(reg) self.vsscratch);
+            asm!("csrr {}, vsepc", out(reg) self.vsepc);
+            asm!("csrr {}, vscause", out(reg) self.vscause);
+            asm!("csrr {}, vstval", out(reg) self.vstval);
+            asm!("csrr {}, vsatp", out(reg) self.vsatp);
+            asm!("csrr {}, hvip", out(reg) self.hvip);
+            if timer::has_sstc() {
+                asm!("csrr {}, 0x24d", out(reg) self.vstimecmp); // vstimecmp
+            }
+        }
+    }
+
+    /// Loads the VS-mode CSRs saved by `save_vs_csrs` into this hart.
+    pub fn restore_vs_csrs(&self) {
+        unsafe {
+            asm!("csrw vsstatus, {}", in(reg) self.vsstatus);
+            asm!("csrw vsie, {}", in(reg) self.vsie);
+            asm!("csrw vstvec, {}", in(reg) self.vstvec);
+            asm!("csrw vsscratch, {}", in(reg) self.vsscratch);
+            asm!("csrw vsepc, {}", in(reg) self.vsepc);
+            asm!("csrw vscause, {}", in(reg) self.vscause);
+            asm!("csrw vstval, {}", in(reg) self.vstval);
+            asm!("csrw vsatp, {}", in(reg) self.vsatp);
+            asm!("csrw hvip, {}", in(reg) self.hvip);
+            if timer::has_sstc() {
+                asm!("csrw 0x24d, {}", in(reg) self.vstimecmp); // vstimecmp
+            }
+            asm!(".option push", ".option arch, +h", "hfence.vvma", ".option pop");
+        }
+    }
+
+    /// Forwards an exception to the guest kernel, as if the hypervisor had
+    /// delegated it.
+    pub fn inject_exception(&mut self, scause: u64, stval: u64) {
+        let vstvec: u64;
+        let mut vsstatus: u64;
+        unsafe {
+            asm!("csrr {}, vstvec", out(reg) vstvec);
+            asm!("csrr {}, vsstatus", out(reg) vsstatus);
+        }
+
+        // Do what the CPU does on a trap: save the privilege mode and the
+        // interrupt-enable bit, and disable interrupts.
+        let spie = (vsstatus & SSTATUS_SIE) << 4;
+        vsstatus &= !(SSTATUS_SIE | SSTATUS_SPIE | SSTATUS_SPP);
+        vsstatus |= spie | (self.sstatus & SSTATUS_SPP);
+        unsafe {
+            asm!("csrw vsepc, {}", in(reg) self.sepc);
+            asm!("csrw vscause, {}", in(reg) scause);
+            asm!("csrw vstval, {}", in(reg) stval);
+            asm!("csrw vsstatus, {}", in(reg) vsstatus);
+        }
+
+        self.sepc = vstvec & !0b11; // Exceptions always go to the base address.
+        self.sstatus |= SSTATUS_SPP;
+    }
+
     pub fn run(&mut self) -> ! {
         unsafe {
             asm!(
@@ -86,7 +277,9 @@ impl VCpu {
                 "csrw sscratch, {sscratch}",
                 "csrw hgatp, {hgatp}",
                 "csrw hedeleg, {hedeleg}",
+                "csrw hideleg, {hideleg}",
                 "csrw hcounteren, {hcounteren}",
+                "csrw 0x605, {htimedelta}", // htimedelta
                 "csrw sepc, {sepc}",
 
                 // Restore general-purpose registers.
@@ -128,7 +321,9 @@ impl VCpu {
                 sstatus = in(reg) self.sstatus,
                 hgatp = in(reg) self.hgatp,
                 hedeleg = in(reg) self.hedeleg,
-                hcounteren = in(reg) 0b11, /* cycle and time */
+                hideleg = in(reg) self.hideleg,
+                hcounteren = in(reg) timer::hcounteren() & nested::hcounteren(self.hart_id) & config().isa.hcounteren(),
+                htimedelta = in(reg) timer::time_delta().wrapping_add(nested::time_delta(self.hart_id)),
                 sepc = in(reg) self.sepc,
                 sscratch = in(reg) (self as *mut VCpu as usize),
                 ra_offset = const offset_of!(VCpu, ra),
@@ -168,3 +363,60 @@ impl VCpu {
         unreachable!();
     }
 }
+
+impl Snapshot for VCpu {
+    const VERSION: u32 = 2;
+
+    // The hypervisor-side fields (e.g. host_sp and hgatp) are not saved.
+    fn save(&self, w: &mut Writer) {
+        for reg in 1..32 {
+            w.u64(self.gpr(reg));
+        }
+
+        for value in [
+            self.sepc,
+            self.sstatus,
+            self.hstatus,
+            self.vsstatus,
+            self.vsie,
+            self.vstvec,
+            self.vsscratch,
+            self.vsepc,
+            self.vscause,
+            self.vstval,
+            self.vsatp,
+            self.hvip,
+            self.vstimecmp,
+            self.timer_deadline,
+        ] {
+            w.u64(value);
+        }
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        for reg in 1..32 {
+            self.set_gpr(reg, r.u64()?);
+        }
+
+        for value in [
+            &mut self.sepc,
+            &mut self.sstatus,
+            &mut self.hstatus,
+            &mut self.vsstatus,
+            &mut self.vsie,
+            &mut self.vstvec,
+            &mut self.vsscratch,
+            &mut self.vsepc,
+            &mut self.vscause,
+            &mut self.vstval,
+            &mut self.vsatp,
+            &mut self.hvip,
+            &mut self.vstimecmp,
+            &mut self.timer_deadline,
+        ] {
+            *value = r.u64()?;
+        }
+
+        Some(())
+    }
+}
@@ -0,0 +1,913 @@
+use alloc::{vec, vec::Vec};
+use core::sync::atomic::{Ordering, fence};
+
+use crate::{
+    config::config,
+    fault_inject,
+    guest_memory,
+    machine, memcheck, metrics,
+    mmio_bus::{self, ReadFn, WriteFn},
+    pci::{self, FunctionConfig},
+    plic,
+    snapshot::{Reader, Snapshot, Writer},
+    timer::{self, NO_DEADLINE, TIMEBASE_FREQ},
+    virtio_features::{self, VIRTIO_F_EVENT_IDX, VIRTIO_F_INDIRECT_DESC},
+};
+
+pub const VIRTIO_F_VERSION_1: u64 = 1 << 32;
+
+pub const VIRTIO_MAGIC: u32 = 0x74726976; // "virt"
+pub const VIRTIO_VENDOR_ID: u32 = 0x554d4551; // "QEMU"
+const QUEUE_NUM_MAX: u32 = 128;
+
+const VIRTQ_DESC_F_NEXT: u16 = 1;
+const VIRTQ_DESC_F_WRITE: u16 = 2;
+const VIRTQ_DESC_F_INDIRECT: u16 = 4;
+/// The most descriptors in an indirect table, the same as QEMU's.
+const MAX_INDIRECT_LEN: u32 = 1024;
+const VIRTQ_AVAIL_F_NO_INTERRUPT: u16 = 1;
+
+const VIRTIO_STATUS_FEATURES_OK: u32 = 8;
+
+const VIRTIO_INT_USED_RING: u32 = 1 << 0;
+const VIRTIO_INT_CONFIG: u32 = 1 << 1;
+
+/// virtio-pci (modern): the vendor ID and the device ID of device type 0.
+const VIRTIO_PCI_VENDOR_ID: u16 = 0x1af4;
+const VIRTIO_PCI_DEVICE_ID_BASE: u16 = 0x1040;
+const VIRTIO_PCI_CAP_COMMON_CFG: u8 = 1;
+const VIRTIO_PCI_CAP_NOTIFY_CFG: u8 = 2;
+const VIRTIO_PCI_CAP_ISR_CFG: u8 = 3;
+const VIRTIO_PCI_CAP_DEVICE_CFG: u8 = 4;
+/// The layout of BAR 0.
+const PCI_COMMON_CFG: u64 = 0x0000;
+const PCI_ISR_CFG: u64 = 0x1000;
+const PCI_DEVICE_CFG: u64 = 0x2000;
+const PCI_NOTIFY_CFG: u64 = 0x3000;
+const PCI_REGS_SIZE: u64 = 0x4000;
+/// Queue N is notified at PCI_NOTIFY_CFG + N * 4.
+const PCI_NOTIFY_OFF_MULTIPLIER: u32 = 4;
+/// No MSI-X vector.
+const VIRTIO_MSI_NO_VECTOR: u16 = 0xffff;
+
+/// A buffer in a descriptor chain.
+pub struct Buffer {
+    pub guest_addr: u64,
+    pub len: u32,
+    pub device_writable: bool,
+}
+
+impl Buffer {
+    /// Translates the buffer to the host memory, for devices accessing it in
+    /// place. Returns None if it's not in guest memory, or if the device
+    /// would write to a device-readable buffer. An empty buffer may be at the
+    /// end of guest memory, so it gets a dangling pointer.
+    pub fn host_addr(&self, device_write: bool) -> Option<*mut u8> {
+        if device_write && !self.device_writable {
+            return None;
+        }
+
+        if self.len == 0 {
+            return Some(core::ptr::NonNull::dangling().as_ptr());
+        }
+
+        let memory = guest_memory::ram(self.guest_addr);
+        if !memory.contains_range(self.guest_addr, self.len as usize) {
+            return None;
+        }
+
+        memcheck::check_access(self.guest_addr, self.len as usize);
+        Some(memory.host_addr(self.guest_addr))
+    }
+
+    pub fn read(&self, offset: usize, dst: &mut [u8]) {
+        assert!(offset + dst.len() <= self.len as usize);
+        // Checked in Virtqueue::pop.
+        guest_memory::ram(self.guest_addr)
+            .read_at(self.guest_addr + offset as u64, dst)
+            .expect("buffer is out of guest memory");
+    }
+
+    /// Returns None if the buffer is device-readable: the driver decides the
+    /// direction.
+    pub fn write(&self, offset: usize, src: &[u8]) -> Option<()> {
+        assert!(offset + src.len() <= self.len as usize);
+        if !self.device_writable {
+            return None;
+        }
+
+        guest_memory::ram(self.guest_addr).write_at(self.guest_addr + offset as u64, src)
+    }
+}
+
+pub struct DescChain {
+    pub head: u16,
+    pub buffers: Vec<Buffer>,
+}
+
+impl DescChain {
+    /// Concatenates the device-readable buffers.
+    pub fn read_all(&self) -> Vec<u8> {
+        let mut data = Vec::new();
+        for buffer in self.buffers.iter().filter(|b| !b.device_writable) {
+            let offset = data.len();
+            data.resize(offset + buffer.len as usize, 0);
+            buffer.read(0, &mut data[offset..]);
+        }
+        data
+    }
+
+    /// Fills the device-writable buffers with `src`. Returns the number of
+    /// bytes written.
+    pub fn write_all(&self, src: &[u8]) -> usize {
+        let mut written = 0;
+        for buffer in self.buffers.iter().filter(|b| b.device_writable) {
+            let len = (buffer.len as usize).min(src.len() - written);
+            if buffer.write(0, &src[written..written + len]).is_none() {
+                break;
+            }
+
+            written += len;
+        }
+        written
+    }
+}
+
+/// A split virtqueue.
+#[derive(Default)]
+pub struct Virtqueue {
+    pub num: u32,
+    pub ready: bool,
+    pub desc_addr: u64,
+    pub avail_addr: u64,
+    pub used_addr: u64,
+    last_avail_idx: u16,
+    /// Whether the driver has negotiated VIRTIO_F_EVENT_IDX.
+    event_idx: bool,
+    /// Whether the driver has negotiated VIRTIO_F_INDIRECT_DESC.
+    indirect: bool,
+    /// The used index when we interrupted the driver last time.
+    signalled_used_idx: u16,
+}
+
+impl Virtqueue {
+    /// Takes the next descriptor chain from the available ring. Broken chains
+    /// are dropped.
+    pub fn pop(&mut self) -> Option<DescChain> {
+        // The driver may make a queue ready without setting its size.
+        if !self.ready || self.num == 0 {
+            return None;
+        }
+
+        loop {
+            if self.event_idx {
+                // avail_event: notify us on any buffer we haven't taken. The
+                // fence orders it before reading the index, or we could miss
+                // a buffer the driver didn't notify us of.
+                let avail_event_addr = self.used_addr + 4 + 8 * self.num as u64;
+                guest_memory::ram(self.used_addr).store_u16(avail_event_addr, self.last_avail_idx, Ordering::Relaxed);
+                fence(Ordering::SeqCst);
+            }
+
+            // Acquire: the ring entry and descriptors are written before the
+            // index.
+            let avail_ring = guest_memory::ram(self.avail_addr);
+            let Some(avail_idx) = avail_ring.load_u16(self.avail_addr + 2, Ordering::Acquire) else {
+                warn!("virtio", "available ring is not in guest memory: {:#x}", self.avail_addr);
+                return None;
+            };
+
+            if self.last_avail_idx == avail_idx {
+                return None;
+            }
+
+            let ring_index = (self.last_avail_idx as u64) % self.num as u64;
+            self.last_avail_idx = self.last_avail_idx.wrapping_add(1);
+            let Some(head) = avail_ring.read_u16(self.avail_addr + 4 + 2 * ring_index) else {
+                warn!("virtio", "available ring is not in guest memory: {:#x}", self.avail_addr);
+                return None;
+            };
+
+            match self.read_chain(head) {
+                Ok(buffers) => return Some(DescChain { head, buffers }),
+                Err(reason) => warn!("virtio", "dropping a broken descriptor chain (head={}): {}", head, reason),
+            }
+        }
+    }
+
+    /// Reads the descriptors from `head`, following an indirect table.
+    /// Returns why if the chain is broken.
+    fn read_chain(&self, head: u16) -> Result<Vec<Buffer>, &'static str> {
+        let mut buffers = Vec::new();
+        let (mut table, mut table_len, mut indirect) = (self.desc_addr, self.num, false);
+        // A bit per descriptor in the table: a chain can't visit one twice.
+        let mut visited = vec![0u64; table_len.div_ceil(64) as usize];
+        let mut index = head;
+        loop {
+            if index as u32 >= table_len {
+                return Err("descriptor index out of the table");
+            }
+
+            let (word, bit) = (index as usize / 64, 1 << (index % 64));
+            if visited[word] & bit != 0 {
+                return Err("loop in the chain");
+            }
+            visited[word] |= bit;
+
+            let desc_addr = table + 16 * index as u64;
+            let memory = guest_memory::ram(desc_addr);
+            let (Some(addr), Some(len), Some(flags), Some(next)) = (
+                memory.read_u64(desc_addr),
+                memory.read_u32(desc_addr + 8),
+                memory.read_u16(desc_addr + 12),
+                memory.read_u16(desc_addr + 14),
+            ) else {
+                return Err("descriptor out of guest memory");
+            };
+
+            if !guest_memory::ram(addr).contains_range(addr, len as usize) {
+                return Err("buffer out of guest memory");
+            }
+
+            if flags & VIRTQ_DESC_F_INDIRECT != 0 {
+                // The rest of the chain is in the table, from its first
+                // descriptor.
+                if !self.indirect {
+                    return Err("indirect descriptor without VIRTIO_F_INDIRECT_DESC");
+                }
+                if indirect {
+                    return Err("nested indirect descriptor");
+                }
+                if flags & VIRTQ_DESC_F_NEXT != 0 || len == 0 || len % 16 != 0 || len / 16 > MAX_INDIRECT_LEN {
+                    return Err("invalid indirect descriptor");
+                }
+
+                (table, table_len, indirect) = (addr, len / 16, true);
+                visited = vec![0; table_len.div_ceil(64) as usize];
+                index = 0;
+                continue;
+            }
+
+            buffers.push(Buffer {
+                guest_addr: addr,
+                len,
+                device_writable: flags & VIRTQ_DESC_F_WRITE != 0,
+            });
+
+            if flags & VIRTQ_DESC_F_NEXT == 0 {
+                return Ok(buffers);
+            }
+
+            index = next;
+        }
+    }
+
+    /// Returns a descriptor chain to the driver.
+    pub fn push_used(&mut self, chain: &DescChain, written_len: u32) {
+        let used_ring = guest_memory::ram(self.used_addr);
+        let Some(used_idx) = used_ring.load_u16(self.used_addr + 2, Ordering::Relaxed) else {
+            warn!("virtio", "used ring is not in guest memory: {:#x}", self.used_addr);
+            return;
+        };
+
+        let elem_addr = self.used_addr + 4 + 8 * ((used_idx as u64) % self.num as u64);
+        if used_ring.write_u32(elem_addr, chain.head as u32).is_none()
+            || used_ring.write_u32(elem_addr + 4, written_len).is_none()
+        {
+            warn!("virtio", "used ring is not in guest memory: {:#x}", self.used_addr);
+            return;
+        }
+
+        // Release: the driver must see the element before the index.
+        used_ring.store_u16(self.used_addr + 2, used_idx.wrapping_add(1), Ordering::Release);
+    }
+
+    /// Whether the driver wants an interrupt for the buffers used since the
+    /// last one: it may suppress them with used_event (VIRTIO_F_EVENT_IDX),
+    /// or with VIRTQ_AVAIL_F_NO_INTERRUPT otherwise.
+    fn needs_interrupt(&mut self) -> bool {
+        if !self.ready || self.num == 0 {
+            return false;
+        }
+
+        // The fence orders the used index before reading the driver's
+        // suppression, like the driver does the other way around.
+        fence(Ordering::SeqCst);
+        let Some(used_idx) = guest_memory::ram(self.used_addr).load_u16(self.used_addr + 2, Ordering::Relaxed) else {
+            return false;
+        };
+
+        let old_idx = core::mem::replace(&mut self.signalled_used_idx, used_idx);
+        if used_idx == old_idx {
+            return false;
+        }
+
+        if self.event_idx {
+            let used_event_addr = self.avail_addr + 4 + 2 * self.num as u64;
+            let Some(used_event) = guest_memory::ram(self.avail_addr).load_u16(used_event_addr, Ordering::Relaxed)
+            else {
+                return true;
+            };
+
+            // vring_need_event: whether used_event is in (old_idx, used_idx].
+            used_idx.wrapping_sub(used_event).wrapping_sub(1) < used_idx.wrapping_sub(old_idx)
+        } else {
+            let flags = guest_memory::ram(self.avail_addr).load_u16(self.avail_addr, Ordering::Relaxed).unwrap_or(0);
+            flags & VIRTQ_AVAIL_F_NO_INTERRUPT == 0
+        }
+    }
+}
+
+pub trait VirtioDevice {
+    fn device_id(&self) -> u32;
+    fn device_features(&self) -> u64;
+    fn num_queues(&self) -> usize;
+    fn read_config(&self, offset: u64) -> u8;
+    /// Handles a write to the configuration space. Ignored by default.
+    fn write_config(&mut self, _offset: u64, _value: u8) {}
+    /// Resets the device-specific state. Nothing by default.
+    fn reset(&mut self) {}
+    /// The driver has accepted the features (FEATURES_OK). Ignored by
+    /// default.
+    fn set_driver_features(&mut self, _features: u64) {}
+    /// Saves the device-specific state, if any, in a snapshot.
+    fn save(&self, _w: &mut Writer) {}
+    fn load(&mut self, _r: &mut Reader) -> Option<()> {
+        Some(())
+    }
+    /// Processes the queue. Returns true if it has used some buffers.
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool;
+}
+
+enum Transport {
+    Mmio {
+        irq: u32,
+    },
+    /// The MSI-X vectors are used instead of INTx if the driver enables
+    /// MSI-X.
+    Pci {
+        slot: usize,
+        config_vector: u16,
+        queue_vectors: Vec<u16>,
+    },
+}
+
+/// Whether `notify_used_batched` may hold interrupts: the devices call
+/// `VirtioMmio::poll` on the deadline then.
+pub fn holds_interrupts() -> bool {
+    config().irq_coalesce_us != 0 || fault_inject::delays_interrupts()
+}
+
+/// The virtio-mmio transport (version 2), or the virtio-pci one (modern)
+/// with `new_pci`: registers in BAR 0.
+pub struct VirtioMmio<D: VirtioDevice> {
+    pub device: D,
+    pub queues: Vec<Virtqueue>,
+    transport: Transport,
+    status: u32,
+    interrupt_status: u32,
+    device_features_sel: u32,
+    driver_features_sel: u32,
+    driver_features: u64,
+    queue_sel: u32,
+    /// When to send the interrupt held by `notify_used_batched`.
+    batch_deadline: u64,
+}
+
+impl<D: VirtioDevice> VirtioMmio<D> {
+    pub fn new(device: D, irq: u32) -> Self {
+        let queues = (0..device.num_queues()).map(|_| Virtqueue::default()).collect();
+        Self {
+            device,
+            queues,
+            transport: Transport::Mmio { irq },
+            status: 0,
+            interrupt_status: 0,
+            device_features_sel: 0,
+            driver_features_sel: 0,
+            driver_features: 0,
+            queue_sel: 0,
+            batch_deadline: NO_DEADLINE,
+        }
+    }
+
+    /// The virtio-pci transport of the PCI function at `slot`.
+    pub fn new_pci(device: D, slot: usize) -> Self {
+        let mut mmio = Self::new(device, 0);
+        let num_queues = mmio.queues.len();
+        mmio.transport = Transport::Pci { slot, config_vector: VIRTIO_MSI_NO_VECTOR, queue_vectors: vec![VIRTIO_MSI_NO_VECTOR; num_queues] };
+        mmio
+    }
+
+    /// Resets the device, as if the driver had written 0 to the status.
+    pub fn reset(&mut self) {
+        self.device.reset();
+        let num_queues = self.queues.len();
+        self.queues = (0..num_queues).map(|_| Virtqueue::default()).collect();
+        self.status = 0;
+        self.driver_features = 0;
+        self.queue_sel = 0;
+        self.interrupt_status = 0;
+        self.batch_deadline = NO_DEADLINE;
+        if let Transport::Pci { config_vector, queue_vectors, .. } = &mut self.transport {
+            *config_vector = VIRTIO_MSI_NO_VECTOR;
+            queue_vectors.fill(VIRTIO_MSI_NO_VECTOR);
+        }
+        self.set_irq_level(false);
+    }
+
+    fn set_irq_level(&self, asserted: bool) {
+        match self.transport {
+            Transport::Mmio { irq } => plic::set_irq_level(irq, asserted),
+            Transport::Pci { slot, .. } => pci::set_intx(slot, asserted),
+        }
+    }
+
+    /// Sends the MSI-X vectors instead of the interrupt if the driver has
+    /// enabled MSI-X. Returns false if it hasn't.
+    fn send_msix(&self, vectors: &[u16]) -> bool {
+        let Transport::Pci { slot, .. } = self.transport else {
+            return false;
+        };
+
+        if !pci::msix_enabled(slot) {
+            return false;
+        }
+
+        let mut sent: Vec<u16> = Vec::new();
+        for &vector in vectors {
+            if vector != VIRTIO_MSI_NO_VECTOR && !sent.contains(&vector) {
+                pci::send_msix(slot, vector);
+                sent.push(vector);
+            }
+        }
+        true
+    }
+
+    /// Whether the driver has started to use the device.
+    pub fn is_in_use(&self) -> bool {
+        self.status != 0
+    }
+
+    /// Tells the driver that we've used buffers, unless it has suppressed
+    /// the interrupts of the queues. With MSI-X, the vectors of the queues
+    /// which need one.
+    pub fn notify_used(&mut self) {
+        let mut vectors = Vec::new();
+        for (index, queue) in self.queues.iter_mut().enumerate() {
+            if queue.needs_interrupt() {
+                vectors.push(match &self.transport {
+                    Transport::Pci { queue_vectors, .. } => queue_vectors[index],
+                    Transport::Mmio { .. } => VIRTIO_MSI_NO_VECTOR,
+                });
+            }
+        }
+
+        metrics::record_virtio_interrupt(!vectors.is_empty());
+        if vectors.is_empty() || self.send_msix(&vectors) {
+            return;
+        }
+
+        self.interrupt_status |= VIRTIO_INT_USED_RING;
+        self.set_irq_level(true);
+    }
+
+    /// `notify_used` for a busy device: with `-irq-coalesce`, the interrupt
+    /// is held for a while to cover buffers used in the meantime. `poll`
+    /// sends it.
+    pub fn notify_used_batched(&mut self) {
+        let delay = config().irq_coalesce_us.max(fault_inject::irq_delay_us(self.device.device_id()));
+        if delay == 0 {
+            self.notify_used();
+            return;
+        }
+
+        if self.batch_deadline == NO_DEADLINE {
+            self.batch_deadline = timer::now() + delay * TIMEBASE_FREQ / 1_000_000;
+            timer::kick();
+        }
+    }
+
+    /// When to call `poll`.
+    pub fn deadline(&self) -> u64 {
+        self.batch_deadline
+    }
+
+    /// Sends the interrupt held by `notify_used_batched` once it's due.
+    pub fn poll(&mut self) {
+        if timer::now() >= self.batch_deadline {
+            self.batch_deadline = NO_DEADLINE;
+            self.notify_used();
+        }
+    }
+
+    /// Tells the driver that the configuration space has changed.
+    pub fn notify_config(&mut self) {
+        if let Transport::Pci { config_vector, .. } = &self.transport {
+            if self.send_msix(&[*config_vector]) {
+                return;
+            }
+        }
+
+        self.interrupt_status |= VIRTIO_INT_CONFIG;
+        self.set_irq_level(true);
+    }
+
+    fn set_status(&mut self, value: u32) {
+        if value == 0 {
+            self.reset();
+            return;
+        }
+
+        let mut value = value;
+        if value & VIRTIO_STATUS_FEATURES_OK != 0 && self.status & VIRTIO_STATUS_FEATURES_OK == 0 {
+            if virtio_features::accept(self.device.device_id(), self.device_features(), self.driver_features) {
+                self.device.set_driver_features(self.driver_features);
+            } else {
+                // The driver reads it back and gives up.
+                value &= !VIRTIO_STATUS_FEATURES_OK;
+            }
+        }
+        self.status = value;
+    }
+
+    fn selected_queue(&mut self) -> Option<&mut Virtqueue> {
+        self.queues.get_mut(self.queue_sel as usize)
+    }
+
+    fn device_features(&self) -> u64 {
+        virtio_features::offered(self.device.device_id(), self.device.device_features())
+    }
+
+    /// The driver has negotiated the features by the time it sets up the
+    /// queues.
+    fn set_queue_ready(&mut self, value: u32) {
+        let event_idx = self.driver_features & VIRTIO_F_EVENT_IDX != 0;
+        let indirect = self.driver_features & VIRTIO_F_INDIRECT_DESC != 0;
+        if let Some(queue) = self.selected_queue() {
+            queue.ready = value == 1;
+            queue.event_idx = event_idx;
+            queue.indirect = indirect;
+        }
+    }
+
+    pub fn mmio_read(&mut self, offset: u64, width: u64) -> u64 {
+        if matches!(self.transport, Transport::Pci { .. }) {
+            return self.pci_read(offset, width);
+        }
+
+        if offset >= 0x100 {
+            let mut value = 0;
+            for i in 0..width {
+                value |= (self.device.read_config(offset - 0x100 + i) as u64) << (8 * i);
+            }
+            return value;
+        }
+
+        let value = match offset {
+            0x000 => VIRTIO_MAGIC,
+            0x004 => 2, // Version
+            0x008 => self.device.device_id(),
+            0x00c => VIRTIO_VENDOR_ID,
+            0x010 => (self.device_features() >> (32 * self.device_features_sel)) as u32,
+            0x034 => self.selected_queue().map(|_| QUEUE_NUM_MAX).unwrap_or(0),
+            0x044 => self.selected_queue().map(|q| q.ready as u32).unwrap_or(0),
+            0x060 => self.interrupt_status,
+            0x070 => self.status,
+            // SHMLen and SHMBase: -1 means no shared memory region (e.g. the
+            // DAX window of virtio-fs) for any SHMSel.
+            0x0b0 | 0x0b4 | 0x0b8 | 0x0bc => 0xffff_ffff,
+            0x0fc => 0, // ConfigGeneration
+            _ => {
+                warn!("virtio", "ignore read at {:#x}", offset);
+                0
+            }
+        };
+
+        value as u64
+    }
+
+    pub fn mmio_write(&mut self, offset: u64, value: u64, width: u64) {
+        if matches!(self.transport, Transport::Pci { .. }) {
+            self.pci_write(offset, value, width);
+            return;
+        }
+
+        if offset >= 0x100 {
+            for i in 0..width {
+                self.device.write_config(offset - 0x100 + i, (value >> (8 * i)) as u8);
+            }
+            return;
+        }
+
+        let value = value as u32;
+        match offset {
+            0x014 => self.device_features_sel = value.min(1),
+            0x020 => {
+                let shift = 32 * self.driver_features_sel;
+                self.driver_features &= !(0xffff_ffff << shift);
+                self.driver_features |= (value as u64) << shift;
+            }
+            0x024 => self.driver_features_sel = value.min(1),
+            0x030 => self.queue_sel = value,
+            0x038 => {
+                if let Some(queue) = self.selected_queue() {
+                    queue.num = value.min(QUEUE_NUM_MAX);
+                }
+            }
+            0x044 => self.set_queue_ready(value),
+            0x050 => self.notify_queue(value as usize),
+            0x064 => {
+                self.interrupt_status &= !value;
+                if self.interrupt_status == 0 {
+                    self.set_irq_level(false);
+                }
+            }
+            0x070 => self.set_status(value),
+            0x080 | 0x084 => self.set_queue_addr(0, offset & 0x4 != 0, value),
+            0x090 | 0x094 => self.set_queue_addr(1, offset & 0x4 != 0, value),
+            0x0a0 | 0x0a4 => self.set_queue_addr(2, offset & 0x4 != 0, value),
+            0x0ac => {} // SHMSel
+            _ => {
+                warn!("virtio", "ignore write at {:#x} (value={:#x})", offset, value);
+            }
+        }
+    }
+
+    fn notify_queue(&mut self, index: usize) {
+        let mut used = false;
+        if let Some(queue) = self.queues.get_mut(index) {
+            used = self.device.queue_notify(index, queue);
+        }
+
+        if used && fault_inject::irq_delay_us(self.device.device_id()) != 0 {
+            self.notify_used_batched();
+        } else if used {
+            self.notify_used();
+        }
+    }
+
+    /// Sets the low or high half of the descriptor table (0), the available
+    /// ring (1), or the used ring (2) of the selected queue.
+    fn set_queue_addr(&mut self, which: usize, high: bool, value: u32) {
+        if let Some(queue) = self.selected_queue() {
+            let addr = match which {
+                0 => &mut queue.desc_addr,
+                1 => &mut queue.avail_addr,
+                _ => &mut queue.used_addr,
+            };
+
+            if high {
+                *addr = (*addr & 0xffff_ffff) | ((value as u64) << 32);
+            } else {
+                *addr = (*addr & !0xffff_ffff) | value as u64;
+            }
+        }
+    }
+
+    fn pci_read(&mut self, offset: u64, width: u64) -> u64 {
+        match offset {
+            PCI_COMMON_CFG..PCI_ISR_CFG => self.pci_common_read(offset - PCI_COMMON_CFG) & (u64::MAX >> (64 - 8 * width)),
+            // Reading the ISR status acknowledges the interrupt.
+            PCI_ISR_CFG => {
+                let value = core::mem::take(&mut self.interrupt_status);
+                self.set_irq_level(false);
+                value as u64
+            }
+            PCI_DEVICE_CFG..PCI_NOTIFY_CFG => {
+                let mut value = 0;
+                for i in 0..width {
+                    value |= (self.device.read_config(offset - PCI_DEVICE_CFG + i) as u64) << (8 * i);
+                }
+                value
+            }
+            _ => 0,
+        }
+    }
+
+    /// struct virtio_pci_common_cfg.
+    fn pci_common_read(&mut self, offset: u64) -> u64 {
+        let Transport::Pci { config_vector, ref queue_vectors, .. } = self.transport else {
+            unreachable!();
+        };
+
+        let queue_sel = self.queue_sel as usize;
+        let queue = self.queues.get(queue_sel);
+        let value = match offset {
+            0x00 => self.device_features_sel,
+            0x04 => (self.device_features() >> (32 * self.device_features_sel)) as u32,
+            0x08 => self.driver_features_sel,
+            0x0c => (self.driver_features >> (32 * self.driver_features_sel)) as u32,
+            0x10 => config_vector as u32,
+            0x12 => self.queues.len() as u32,
+            0x14 => self.status,
+            0x15 => 0, // config_generation
+            0x16 => self.queue_sel,
+            // The maximum until the driver sets it.
+            0x18 => queue.map(|q| if q.num == 0 { QUEUE_NUM_MAX } else { q.num }).unwrap_or(0),
+            0x1a => queue_vectors.get(queue_sel).copied().unwrap_or(VIRTIO_MSI_NO_VECTOR) as u32,
+            0x1c => queue.map(|q| q.ready as u32).unwrap_or(0),
+            0x1e => self.queue_sel, // queue_notify_off
+            0x20 => queue.map(|q| q.desc_addr as u32).unwrap_or(0),
+            0x24 => queue.map(|q| (q.desc_addr >> 32) as u32).unwrap_or(0),
+            0x28 => queue.map(|q| q.avail_addr as u32).unwrap_or(0),
+            0x2c => queue.map(|q| (q.avail_addr >> 32) as u32).unwrap_or(0),
+            0x30 => queue.map(|q| q.used_addr as u32).unwrap_or(0),
+            0x34 => queue.map(|q| (q.used_addr >> 32) as u32).unwrap_or(0),
+            _ => {
+                warn!("virtio", "ignore read at common_cfg + {:#x}", offset);
+                0
+            }
+        };
+
+        value as u64
+    }
+
+    fn pci_write(&mut self, offset: u64, value: u64, width: u64) {
+        match offset {
+            PCI_COMMON_CFG..PCI_ISR_CFG => self.pci_common_write(offset - PCI_COMMON_CFG, value as u32),
+            PCI_DEVICE_CFG..PCI_NOTIFY_CFG => {
+                for i in 0..width {
+                    self.device.write_config(offset - PCI_DEVICE_CFG + i, (value >> (8 * i)) as u8);
+                }
+            }
+            PCI_NOTIFY_CFG..PCI_REGS_SIZE => {
+                self.notify_queue(((offset - PCI_NOTIFY_CFG) / PCI_NOTIFY_OFF_MULTIPLIER as u64) as usize)
+            }
+            _ => warn!("virtio", "ignore write at {:#x} (value={:#x})", offset, value),
+        }
+    }
+
+    fn pci_common_write(&mut self, offset: u64, value: u32) {
+        let num_vectors = self.queues.len() as u32 + 1;
+        // Vectors out of the MSI-X table read back as NO_VECTOR: the driver
+        // checks it.
+        let vector = if value < num_vectors { value as u16 } else { VIRTIO_MSI_NO_VECTOR };
+        let queue_sel = self.queue_sel as usize;
+        match offset {
+            0x00 => self.device_features_sel = value.min(1),
+            0x08 => self.driver_features_sel = value.min(1),
+            0x0c => {
+                let shift = 32 * self.driver_features_sel;
+                self.driver_features &= !(0xffff_ffff << shift);
+                self.driver_features |= (value as u64) << shift;
+            }
+            0x10 => {
+                if let Transport::Pci { config_vector, .. } = &mut self.transport {
+                    *config_vector = vector;
+                }
+            }
+            0x14 => self.set_status(value),
+            0x16 => self.queue_sel = value,
+            0x18 => {
+                if let Some(queue) = self.selected_queue() {
+                    queue.num = value.min(QUEUE_NUM_MAX);
+                }
+            }
+            0x1a => {
+                if let Transport::Pci { queue_vectors, .. } = &mut self.transport {
+                    if let Some(queue_vector) = queue_vectors.get_mut(queue_sel) {
+                        *queue_vector = vector;
+                    }
+                }
+            }
+            0x1c => self.set_queue_ready(value),
+            0x20 | 0x24 => self.set_queue_addr(0, offset == 0x24, value),
+            0x28 | 0x2c => self.set_queue_addr(1, offset == 0x2c, value),
+            0x30 | 0x34 => self.set_queue_addr(2, offset == 0x34, value),
+            _ => warn!("virtio", "ignore write at common_cfg + {:#x} (value={:#x})", offset, value),
+        }
+    }
+}
+
+/// struct virtio_pci_cap after cap_vndr and cap_next: a structure in BAR 0.
+fn pci_cap(cfg_type: u8, offset: u64, len: u32, extra: &[u8]) -> Vec<u8> {
+    let mut cap = vec![(16 + extra.len()) as u8, cfg_type, 0 /* bar */, 0 /* id */, 0, 0];
+    cap.extend_from_slice(&(offset as u32).to_le_bytes());
+    cap.extend_from_slice(&len.to_le_bytes());
+    cap.extend_from_slice(extra);
+    cap
+}
+
+/// Puts a device on the MMIO bus at its address in the machine (`name`), or
+/// on the PCI bus with `-pci`. `read` and `write` pass accesses to
+/// `mmio_read` and `mmio_write` of the returned transport.
+pub fn attach<D: VirtioDevice>(name: &'static str, device: D, read: ReadFn, write: WriteFn) -> VirtioMmio<D> {
+    if !config().pci {
+        let (addr, end, irq) = machine::device_region(name);
+        mmio_bus::register(name, addr, end, read, write);
+        return VirtioMmio::new(device, irq);
+    }
+
+    let device_id = device.device_id();
+    let num_queues = device.num_queues() as u32;
+    let notify_len = num_queues * PCI_NOTIFY_OFF_MULTIPLIER;
+    let slot = pci::add_function(FunctionConfig {
+        vendor_id: VIRTIO_PCI_VENDOR_ID,
+        device_id: VIRTIO_PCI_DEVICE_ID_BASE + device_id as u16,
+        subsystem_id: device_id as u16,
+        class: match device_id {
+            1 => 0x02_0000, // Ethernet controller
+            2 => 0x01_8000, // Mass storage controller
+            _ => 0xff_0000,
+        },
+        regs_size: PCI_REGS_SIZE,
+        num_vectors: num_queues as u16 + 1,
+        capabilities: vec![
+            pci_cap(VIRTIO_PCI_CAP_COMMON_CFG, PCI_COMMON_CFG, 0x38, &[]),
+            pci_cap(VIRTIO_PCI_CAP_NOTIFY_CFG, PCI_NOTIFY_CFG, notify_len, &PCI_NOTIFY_OFF_MULTIPLIER.to_le_bytes()),
+            pci_cap(VIRTIO_PCI_CAP_ISR_CFG, PCI_ISR_CFG, 4, &[]),
+            pci_cap(VIRTIO_PCI_CAP_DEVICE_CFG, PCI_DEVICE_CFG, 0x1000, &[]),
+        ],
+        read,
+        write,
+    });
+    VirtioMmio::new_pci(device, slot)
+}
+
+impl Snapshot for Virtqueue {
+    const VERSION: u32 = 2;
+
+    fn save(&self, w: &mut Writer) {
+        w.u32(self.num);
+        w.u8(self.ready as u8);
+        w.u64(self.desc_addr);
+        w.u64(self.avail_addr);
+        w.u64(self.used_addr);
+        w.u32(self.last_avail_idx as u32);
+        w.u8(self.event_idx as u8);
+        w.u8(self.indirect as u8);
+        w.u32(self.signalled_used_idx as u32);
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        self.num = r.u32()?;
+        self.ready = r.u8()? != 0;
+        self.desc_addr = r.u64()?;
+        self.avail_addr = r.u64()?;
+        self.used_addr = r.u64()?;
+        self.last_avail_idx = r.u32()? as u16;
+        self.event_idx = r.u8()? != 0;
+        self.indirect = r.u8()? != 0;
+        self.signalled_used_idx = r.u32()? as u16;
+        Some(())
+    }
+}
+
+// Backends are not saved.
+impl<D: VirtioDevice> Snapshot for VirtioMmio<D> {
+    const VERSION: u32 = 4;
+
+    fn save(&self, w: &mut Writer) {
+        w.u32(self.status);
+        w.u32(self.interrupt_status);
+        w.u32(self.device_features_sel);
+        w.u32(self.driver_features_sel);
+        w.u64(self.driver_features);
+        w.u32(self.queue_sel);
+        // Whether an interrupt is held. The deadline is the host's time.
+        w.u8((self.batch_deadline != NO_DEADLINE) as u8);
+        w.u32(self.queues.len() as u32);
+        for queue in &self.queues {
+            queue.save(w);
+        }
+
+        if let Transport::Pci { config_vector, queue_vectors, .. } = &self.transport {
+            w.u32(*config_vector as u32);
+            for vector in queue_vectors {
+                w.u32(*vector as u32);
+            }
+        }
+
+        self.device.save(w);
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        self.status = r.u32()?;
+        self.interrupt_status = r.u32()?;
+        self.device_features_sel = r.u32()?;
+        self.driver_features_sel = r.u32()?;
+        self.driver_features = r.u64()?;
+        self.queue_sel = r.u32()?;
+        self.batch_deadline = if r.u8()? != 0 { timer::now() } else { NO_DEADLINE };
+        if r.u32()? as usize != self.queues.len() {
+            return None;
+        }
+
+        for queue in &mut self.queues {
+            queue.load(r)?;
+        }
+
+        if let Transport::Pci { config_vector, queue_vectors, .. } = &mut self.transport {
+            *config_vector = r.u32()? as u16;
+            for vector in queue_vectors {
+                *vector = r.u32()? as u16;
+            }
+        }
+
+        if self.status & VIRTIO_STATUS_FEATURES_OK != 0 {
+            self.device.set_driver_features(self.driver_features);
+        }
+        self.device.load(r)
+    }
+}
@@ -0,0 +1,125 @@
+//! virtio-9p: shares a host directory with the guest.
+//!
+//! 9P messages are forwarded as is to the virtio-9p device provided by QEMU
+//! (`-fsdev local`). Mount it in the guest by:
+//!
+//! ```text
+//! mount -t 9p -o trans=virtio,version=9p2000.L <tag> /mnt
+//! ```
+use alloc::string::String;
+use spin::Mutex;
+
+use crate::{
+    config::ShareConfig,
+    host_9p::{Host9p, MAX_MSIZE, VIRTIO_9P_MOUNT_TAG},
+    monitor,
+    snapshot::{self, Section, Writer},
+    virtio::{self, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_9P: u32 = 9;
+
+const P9_TVERSION: u8 = 100;
+const P9_RLERROR: u8 = 7;
+/// EIO in Linux.
+const EIO: u32 = 5;
+
+/// Rlerror: size[4] type[1] tag[2] ecode[4]
+fn error_response(tag: [u8; 2], ecode: u32) -> [u8; 11] {
+    let mut msg = [0; 11];
+    msg[0..4].copy_from_slice(&11u32.to_le_bytes());
+    msg[4] = P9_RLERROR;
+    msg[5..7].copy_from_slice(&tag);
+    msg[7..11].copy_from_slice(&ecode.to_le_bytes());
+    msg
+}
+
+pub struct Virtio9p {
+    tag: String,
+    host: Host9p,
+}
+
+impl VirtioDevice for Virtio9p {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_9P
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1 | VIRTIO_9P_MOUNT_TAG
+    }
+
+    fn num_queues(&self) -> usize {
+        1
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_9p_config: le16 tag_len, u8 tag[tag_len]
+        let tag_len = (self.tag.len() as u16).to_le_bytes();
+        match offset {
+            0..2 => tag_len[offset as usize],
+            _ => self.tag.as_bytes().get(offset as usize - 2).copied().unwrap_or(0),
+        }
+    }
+
+    fn queue_notify(&mut self, _index: usize, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            // size[4] type[1] tag[2] ...
+            let mut msg = chain.read_all();
+            let written = if msg.len() < 7 || msg.len() > MAX_MSIZE {
+                warn!("virtio-9p", "invalid message length: {}", msg.len());
+                monitor::event("VIRTIO_ERROR", "{\"device\": \"virtio-9p\", \"desc\": \"invalid message\"}");
+                let tag = msg.get(5..7).and_then(|tag| tag.try_into().ok()).unwrap_or([0xff; 2]);
+                chain.write_all(&error_response(tag, EIO))
+            } else {
+                if msg[4] == P9_TVERSION && msg.len() >= 11 {
+                    // Tversion: size[4] type[1] tag[2] msize[4] version[s]
+                    let msize = u32::from_le_bytes(msg[7..11].try_into().unwrap());
+                    msg[7..11].copy_from_slice(&msize.min(MAX_MSIZE as u32).to_le_bytes());
+                }
+
+                chain.write_all(self.host.request(&msg))
+            };
+
+            queue.push_used(&chain, written as u32);
+            used = true;
+        }
+
+        used
+    }
+}
+
+static VIRTIO_9P: Mutex<Option<VirtioMmio<Virtio9p>>> = Mutex::new(None);
+
+pub fn init(config: &ShareConfig) {
+    let host = Host9p::open(&config.tag).expect("[virtio-9p] host virtio-9p device not found");
+    let device = Virtio9p { tag: config.tag.clone(), host };
+    *VIRTIO_9P.lock() = Some(virtio::attach("virtio-9p", device, mmio_read, mmio_write));
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_9P.lock().as_mut().expect("virtio-9p not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    VIRTIO_9P.lock().as_mut().expect("virtio-9p not initialized").mmio_write(offset, value, width)
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_9P.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_9P.lock().as_ref() {
+        w.section("virtio-9p", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    match VIRTIO_9P.lock().as_mut() {
+        Some(mmio) => snapshot::load_section(sections, "virtio-9p", mmio),
+        None => Ok(()),
+    }
+}
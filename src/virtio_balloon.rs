@@ -0,0 +1,191 @@
+//! virtio-balloon: lets the host reclaim guest memory. Set the target guest
+//! memory size with `{"execute": "balloon", "arguments": {"value": <bytes>}}`
+//! in the monitor.
+//!
+//! Pages given to the balloon by the guest are reported to the host
+//! virtio-balloon device, which discards them.
+use alloc::{format, string::String};
+use spin::Mutex;
+
+use crate::{
+    guest_memory::GUEST_MEMORY,
+    host_balloon::HostBalloon,
+    memcheck,
+    snapshot::{self, Section, Writer},
+    virtio::{self, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_BALLOON: u32 = 5;
+pub const VIRTIO_BALLOON_F_DEFLATE_ON_OOM: u64 = 1 << 2;
+const INFLATE_QUEUE: usize = 0;
+/// The balloon always uses 4KB pages regardless of the guest page size.
+const PAGE_SIZE: u64 = 4096;
+
+pub struct VirtioBalloon {
+    host: HostBalloon,
+    /// The number of pages we want in the balloon.
+    num_pages: u32,
+    /// The number of pages in the balloon, updated by the driver.
+    actual: u32,
+}
+
+impl VirtioBalloon {
+    /// Reports pages in the balloon, merging contiguous ones.
+    fn inflate(&mut self, pfns: &[u8]) {
+        let mut range: Option<(u64, u64)> = None;
+        for pfn in pfns.chunks_exact(4) {
+            let guest_addr = u32::from_le_bytes(pfn.try_into().unwrap()) as u64 * PAGE_SIZE;
+            if !GUEST_MEMORY.contains(guest_addr) {
+                warn!("virtio-balloon", "ignoring a page outside the memory: {:#x}", guest_addr);
+                continue;
+            }
+
+            memcheck::set_ballooned(guest_addr, true);
+            // The host discards it: it's no longer what a snapshot has.
+            GUEST_MEMORY.mark_dirty(guest_addr, PAGE_SIZE as usize);
+            let host_addr = GUEST_MEMORY.host_addr(guest_addr) as u64;
+            range = match range {
+                Some((start, end)) if end == host_addr => Some((start, end + PAGE_SIZE)),
+                Some((start, end)) => {
+                    self.host.report(start, (end - start) as u32);
+                    Some((host_addr, host_addr + PAGE_SIZE))
+                }
+                None => Some((host_addr, host_addr + PAGE_SIZE)),
+            };
+        }
+
+        if let Some((start, end)) = range {
+            self.host.report(start, (end - start) as u32);
+        }
+    }
+}
+
+impl VirtioDevice for VirtioBalloon {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_BALLOON
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1 | VIRTIO_BALLOON_F_DEFLATE_ON_OOM
+    }
+
+    fn num_queues(&self) -> usize {
+        2 // inflateq and deflateq
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_balloon_config: le32 num_pages, le32 actual, ...
+        match offset {
+            0..4 => self.num_pages.to_le_bytes()[offset as usize],
+            4..8 => self.actual.to_le_bytes()[offset as usize - 4],
+            _ => 0,
+        }
+    }
+
+    fn write_config(&mut self, offset: u64, value: u8) {
+        if let 4..8 = offset {
+            let mut actual = self.actual.to_le_bytes();
+            actual[offset as usize - 4] = value;
+            self.actual = u32::from_le_bytes(actual);
+        }
+    }
+
+    fn reset(&mut self) {
+        // The driver starts with an empty balloon.
+        self.actual = 0;
+        memcheck::clear_ballooned();
+    }
+
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            // Deflated pages need nothing: they're zero-filled when touched.
+            if index == INFLATE_QUEUE {
+                self.inflate(&chain.read_all());
+            } else {
+                deflate(&chain.read_all());
+            }
+
+            queue.push_used(&chain, 0);
+            used = true;
+        }
+
+        used
+    }
+}
+
+fn deflate(pfns: &[u8]) {
+    if memcheck::enabled() {
+        for pfn in pfns.chunks_exact(4) {
+            memcheck::set_ballooned(u32::from_le_bytes(pfn.try_into().unwrap()) as u64 * PAGE_SIZE, false);
+        }
+    }
+}
+
+static VIRTIO_BALLOON: Mutex<Option<VirtioMmio<VirtioBalloon>>> = Mutex::new(None);
+
+pub fn init() {
+    let host = HostBalloon::open().expect("[virtio-balloon] host virtio-balloon device not found");
+    let device = VirtioBalloon { host, num_pages: 0, actual: 0 };
+    *VIRTIO_BALLOON.lock() = Some(virtio::attach("virtio-balloon", device, mmio_read, mmio_write));
+}
+
+/// Sets the target guest memory size in bytes.
+pub fn set_target(size: u64) -> Result<(), String> {
+    let mut lock = VIRTIO_BALLOON.lock();
+    let Some(mmio) = lock.as_mut() else {
+        return Err(String::from("virtio-balloon is not enabled (-balloon)"));
+    };
+
+    let memory_size = GUEST_MEMORY.size() as u64;
+    if size == 0 || size > memory_size {
+        return Err(format!("the target must be between 1 and {} bytes", memory_size));
+    }
+
+    mmio.device.num_pages = ((memory_size - size) / PAGE_SIZE) as u32;
+    mmio.notify_config();
+    Ok(())
+}
+
+/// Returns the current guest memory size in bytes.
+pub fn actual() -> Option<u64> {
+    let lock = VIRTIO_BALLOON.lock();
+    let mmio = lock.as_ref()?;
+    Some(GUEST_MEMORY.size() as u64 - mmio.device.actual as u64 * PAGE_SIZE)
+}
+
+/// Reports host memory the guest no longer has (e.g. unplugged from
+/// virtio-mem) to the host, which discards it. Does nothing without
+/// `-balloon`.
+pub fn discard(host_addr: u64, len: u32) {
+    if let Some(mmio) = VIRTIO_BALLOON.lock().as_mut() {
+        mmio.device.host.report(host_addr, len);
+    }
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_BALLOON.lock().as_mut().expect("virtio-balloon not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    VIRTIO_BALLOON.lock().as_mut().expect("virtio-balloon not initialized").mmio_write(offset, value, width)
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_BALLOON.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_BALLOON.lock().as_ref() {
+        w.section("virtio-balloon", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    match VIRTIO_BALLOON.lock().as_mut() {
+        Some(mmio) => snapshot::load_section(sections, "virtio-balloon", mmio),
+        None => Ok(()),
+    }
+}
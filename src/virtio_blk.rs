@@ -0,0 +1,632 @@
+use alloc::{boxed::Box, collections::VecDeque, format, string::String, vec::Vec};
+use core::sync::atomic::{AtomicBool, Ordering};
+use spin::Mutex;
+
+use crate::{
+    config::{DiskBackendKind, DiskConfig},
+    cow_disk::CowBackend,
+    fault_inject::{self, Fault},
+    guest_memory,
+    host_blk::{
+        HostBlk, SECTOR_SIZE, VIRTIO_BLK_F_FLUSH, VIRTIO_BLK_ID_BYTES, VIRTIO_BLK_S_IOERR,
+        VIRTIO_BLK_S_OK, VIRTIO_BLK_S_UNSUPP, VIRTIO_BLK_T_FLUSH, VIRTIO_BLK_T_GET_ID,
+        VIRTIO_BLK_T_IN, VIRTIO_BLK_T_OUT,
+    },
+    metrics, monitor,
+    snapshot::{self, Section, Writer},
+    throttle::{Limits, Throttle},
+    timer::{self, NO_DEADLINE},
+    virtio::{self, DescChain, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_BLK: u32 = 2;
+pub const VIRTIO_BLK_F_MQ: u64 = 1 << 12;
+/// `num_queues` in `struct virtio_blk_config`.
+const CONFIG_NUM_QUEUES: u64 = 34;
+/// `-device virtio-blk-device,serial=disk` in run.sh.
+const HOST_DISK_SERIAL: &str = "disk";
+/// The overlay for `-disk cow` (`serial=overlay`).
+const OVERLAY_DISK_SERIAL: &str = "overlay";
+
+/// Where the disk contents come from.
+pub trait BlockBackend: Send {
+    /// The disk size in sectors.
+    fn capacity(&self) -> u64;
+    fn read(&mut self, sector: u64, buf: &mut [u8]) -> u8;
+    fn write(&mut self, sector: u64, buf: &[u8]) -> u8;
+    fn flush(&mut self) -> u8;
+    /// Releases the host disks. Nothing by default.
+    fn close(self: Box<Self>) {}
+    /// The host disk to read and write without waiting, if supported. The
+    /// other methods are not used for I/O then.
+    fn async_disk(&mut self) -> Option<&mut HostBlk> {
+        None
+    }
+}
+
+/// The disk provided by QEMU (`-drive`).
+struct HostBackend {
+    disk: HostBlk,
+    /// Whether requests complete by the host interrupt.
+    is_async: bool,
+}
+
+impl BlockBackend for HostBackend {
+    fn capacity(&self) -> u64 {
+        self.disk.capacity()
+    }
+
+    fn read(&mut self, sector: u64, buf: &mut [u8]) -> u8 {
+        self.disk.request(VIRTIO_BLK_T_IN, sector, buf.as_mut_ptr(), buf.len())
+    }
+
+    fn write(&mut self, sector: u64, buf: &[u8]) -> u8 {
+        self.disk.request(VIRTIO_BLK_T_OUT, sector, buf.as_ptr() as *mut u8, buf.len())
+    }
+
+    fn flush(&mut self) -> u8 {
+        self.disk.request(VIRTIO_BLK_T_FLUSH, 0, core::ptr::null_mut(), 0)
+    }
+
+    fn close(self: Box<Self>) {
+        self.disk.close();
+    }
+
+    fn async_disk(&mut self) -> Option<&mut HostBlk> {
+        self.is_async.then_some(&mut self.disk)
+    }
+}
+
+/// The disk is gone (`device_del`): an empty disk which fails all I/O.
+struct Ejected;
+
+impl BlockBackend for Ejected {
+    fn capacity(&self) -> u64 {
+        0
+    }
+
+    fn read(&mut self, _sector: u64, _buf: &mut [u8]) -> u8 {
+        VIRTIO_BLK_S_IOERR
+    }
+
+    fn write(&mut self, _sector: u64, _buf: &[u8]) -> u8 {
+        VIRTIO_BLK_S_IOERR
+    }
+
+    fn flush(&mut self) -> u8 {
+        VIRTIO_BLK_S_OK
+    }
+}
+
+/// A request processed by the host disk in the background. Each data
+/// buffer is a host request.
+struct AsyncRequest {
+    /// The queue it came from.
+    queue: usize,
+    chain: DescChain,
+    type_: u32,
+    /// The sector of the next host request.
+    sector: u64,
+    /// Host requests not submitted yet: (guest address, length) of the data
+    /// buffer. A flush has one without data.
+    ops: VecDeque<(u64, u32)>,
+    /// Host requests submitted: (ID, guest address, length).
+    in_flight: Vec<(u16, u64, u32)>,
+    status: u8,
+    written: u32,
+}
+
+impl AsyncRequest {
+    fn is_done(&self) -> bool {
+        self.in_flight.is_empty() && (self.ops.is_empty() || self.status != VIRTIO_BLK_S_OK)
+    }
+}
+
+pub struct VirtioBlk {
+    backend: Box<dyn BlockBackend>,
+    /// The number of request queues (`-disk ...,queues=<n>`). The driver
+    /// can use one per vCPU, all to the same disk.
+    num_queues: usize,
+    /// The interrupt of the host disk with asynchronous I/O.
+    host_irq: Option<u32>,
+    /// Requests in flight, in the order the driver made them available.
+    requests: VecDeque<AsyncRequest>,
+    /// `-disk ...,iops=<n>,bps=<n>`.
+    throttle: Throttle,
+    /// Requests over the throttle limits: (queue, chain).
+    held: VecDeque<(usize, DescChain)>,
+}
+
+/// Whether the device holds requests over the throttle limits: `poll`
+/// starts them once the limits allow.
+static HELD: AtomicBool = AtomicBool::new(false);
+
+/// Returns a request to the driver with the status and the number of bytes
+/// written to the data buffers.
+fn complete(queue: &mut Virtqueue, chain: &DescChain, status: u8, written: u32) {
+    let status =
+        if status == VIRTIO_BLK_S_OK && fault_inject::inject(Fault::BlkError) { VIRTIO_BLK_S_IOERR } else { status };
+    if let Some(status_buf) = chain.buffers.last().filter(|buf| buf.device_writable) {
+        status_buf.write(0, &[status]);
+    }
+
+    queue.push_used(chain, written + 1);
+}
+
+/// Reads `struct virtio_blk_req`: le32 type, le32 reserved, le64 sector.
+fn read_header(chain: &DescChain) -> Option<(u32, u64)> {
+    let header_buf = chain.buffers.first().filter(|buf| buf.len >= 16)?;
+    let mut header = [0u8; 16];
+    header_buf.read(0, &mut header);
+    let type_ = u32::from_le_bytes(header[0..4].try_into().unwrap());
+    let sector = u64::from_le_bytes(header[8..16].try_into().unwrap());
+    Some((type_, sector))
+}
+
+/// Whether `len` bytes from `sector` go beyond the end of the disk.
+fn is_out_of_range(sector: u64, len: u64, capacity: u64) -> bool {
+    sector.checked_add(len.div_ceil(SECTOR_SIZE)).is_none_or(|end| end > capacity)
+}
+
+/// The length of the data buffers, for the throttle.
+fn data_len(chain: &DescChain) -> u64 {
+    let total: u64 = chain.buffers.iter().map(|buf| buf.len as u64).sum();
+    // Minus the header and the status.
+    total.saturating_sub(17)
+}
+
+impl VirtioBlk {
+    fn new(backend: Box<dyn BlockBackend>) -> VirtioBlk {
+        VirtioBlk {
+            backend,
+            num_queues: 1,
+            host_irq: None,
+            requests: VecDeque::new(),
+            throttle: Throttle::default(),
+            held: VecDeque::new(),
+        }
+    }
+
+    /// A disk provided by QEMU, for hotplug. Requests are processed
+    /// synchronously.
+    pub fn open_host_disk(serial: &str) -> Option<VirtioBlk> {
+        let disk = HostBlk::open(serial)?;
+        Some(VirtioBlk::new(Box::new(HostBackend { disk, is_async: false })))
+    }
+
+    /// Releases the disk. The driver sees an empty disk from now on.
+    pub fn eject(&mut self) {
+        let backend = core::mem::replace(&mut self.backend, Box::new(Ejected));
+        backend.close();
+    }
+
+    /// Handles a request. Returns the status and the number of bytes written
+    /// to the data buffers.
+    fn handle_request(&mut self, chain: &DescChain) -> (u8, u32) {
+        let [_header_buf, data_bufs @ .., _status_buf] = chain.buffers.as_slice() else {
+            return (VIRTIO_BLK_S_IOERR, 0);
+        };
+
+        let Some((type_, mut sector)) = read_header(chain) else {
+            return (VIRTIO_BLK_S_IOERR, 0);
+        };
+
+        let mut written = 0;
+        match type_ {
+            VIRTIO_BLK_T_IN | VIRTIO_BLK_T_OUT => {
+                for buf in data_bufs {
+                    // "The length of data MUST be a multiple of 512 bytes"
+                    if buf.len as u64 % SECTOR_SIZE != 0 {
+                        let data = "{\"device\": \"virtio-blk\", \"desc\": \"partial-sector data buffer\"}";
+                        monitor::event("VIRTIO_ERROR", data);
+                        return (VIRTIO_BLK_S_IOERR, written);
+                    }
+
+                    if is_out_of_range(sector, buf.len as u64, self.backend.capacity()) {
+                        let data = format!(
+                            "{{\"device\": \"virtio-blk\", \"desc\": \"sector {} out of range\"}}",
+                            sector
+                        );
+                        monitor::event("VIRTIO_ERROR", &data);
+                        return (VIRTIO_BLK_S_IOERR, written);
+                    }
+
+                    // We read disk data into device-writable buffers.
+                    let Some(host_addr) = buf.host_addr(type_ == VIRTIO_BLK_T_IN) else {
+                        let data = "{\"device\": \"virtio-blk\", \"desc\": \"data buffer in the wrong direction\"}";
+                        monitor::event("VIRTIO_ERROR", data);
+                        return (VIRTIO_BLK_S_IOERR, written);
+                    };
+
+                    let data = unsafe { core::slice::from_raw_parts_mut(host_addr, buf.len as usize) };
+                    let status = if type_ == VIRTIO_BLK_T_IN {
+                        self.backend.read(sector, data)
+                    } else {
+                        self.backend.write(sector, data)
+                    };
+
+                    if status != VIRTIO_BLK_S_OK {
+                        return (status, written);
+                    }
+
+                    metrics::record_disk_io(type_ == VIRTIO_BLK_T_OUT, buf.len as u64);
+                    if type_ == VIRTIO_BLK_T_IN {
+                        guest_memory::ram(buf.guest_addr).mark_dirty(buf.guest_addr, buf.len as usize);
+                        written += buf.len;
+                    }
+                    sector += buf.len as u64 / SECTOR_SIZE;
+                }
+
+                (VIRTIO_BLK_S_OK, written)
+            }
+            VIRTIO_BLK_T_FLUSH => (self.backend.flush(), 0),
+            VIRTIO_BLK_T_GET_ID => {
+                let id = b"hypervisor-disk";
+                let Some(buf) = data_bufs.first() else {
+                    return (VIRTIO_BLK_S_IOERR, 0);
+                };
+
+                let len = id.len().min(buf.len as usize).min(VIRTIO_BLK_ID_BYTES);
+                match buf.write(0, &id[..len]) {
+                    Some(()) => (VIRTIO_BLK_S_OK, len as u32),
+                    None => (VIRTIO_BLK_S_IOERR, 0),
+                }
+            }
+            _ => (VIRTIO_BLK_S_UNSUPP, 0),
+        }
+    }
+
+    /// Makes a request from the queue `queue` processed in the background,
+    /// if the backend supports it. Otherwise, returns the chain back.
+    fn start_async(&mut self, queue: usize, chain: DescChain) -> Result<(), DescChain> {
+        let Some(disk) = self.backend.async_disk() else {
+            return Err(chain);
+        };
+
+        let (Some((type_, sector)), [_header_buf, data_bufs @ .., _status_buf]) =
+            (read_header(&chain), chain.buffers.as_slice())
+        else {
+            return Err(chain);
+        };
+
+        let ops: VecDeque<(u64, u32)> = match type_ {
+            VIRTIO_BLK_T_IN | VIRTIO_BLK_T_OUT => {
+                let len: u64 = data_bufs.iter().map(|buf| buf.len as u64).sum();
+                // Let handle_request report the error.
+                let wrong_direction = type_ == VIRTIO_BLK_T_IN && data_bufs.iter().any(|buf| !buf.device_writable);
+                let partial_sector = data_bufs.iter().any(|buf| buf.len as u64 % SECTOR_SIZE != 0);
+                if is_out_of_range(sector, len, disk.capacity()) || wrong_direction || partial_sector {
+                    return Err(chain);
+                }
+
+                data_bufs.iter().filter(|buf| buf.len > 0).map(|buf| (buf.guest_addr, buf.len)).collect()
+            }
+            VIRTIO_BLK_T_FLUSH => VecDeque::from([(0, 0)]),
+            _ => return Err(chain),
+        };
+
+        self.requests.push_back(AsyncRequest {
+            queue,
+            chain,
+            type_,
+            sector,
+            ops,
+            in_flight: Vec::new(),
+            status: VIRTIO_BLK_S_OK,
+            written: 0,
+        });
+        Ok(())
+    }
+
+    /// Submits host requests as long as the host queue has space.
+    fn submit_async(&mut self) {
+        let Some(disk) = self.backend.async_disk() else {
+            return;
+        };
+
+        for request in self.requests.iter_mut().filter(|request| request.status == VIRTIO_BLK_S_OK) {
+            while let Some(&(guest_addr, len)) = request.ops.front() {
+                let buf = if len > 0 {
+                    &[(guest_memory::ram(guest_addr).host_addr(guest_addr), len as usize)][..]
+                } else {
+                    &[]
+                };
+                let Some(id) = disk.submit(request.type_, request.sector, buf) else {
+                    return;
+                };
+
+                request.ops.pop_front();
+                request.in_flight.push((id, guest_addr, len));
+                request.sector += len as u64 / SECTOR_SIZE;
+            }
+        }
+    }
+
+    /// Takes completed host requests, and submits more.
+    fn process_async(&mut self) {
+        let Some(disk) = self.backend.async_disk() else {
+            return;
+        };
+
+        while let Some((id, status)) = disk.poll() {
+            for request in self.requests.iter_mut() {
+                let Some(index) = request.in_flight.iter().position(|&(in_flight, _, _)| in_flight == id) else {
+                    continue;
+                };
+
+                let (_, guest_addr, len) = request.in_flight.swap_remove(index);
+                if status != VIRTIO_BLK_S_OK {
+                    request.status = status;
+                } else {
+                    metrics::record_disk_io(request.type_ == VIRTIO_BLK_T_OUT, len as u64);
+                    if request.type_ == VIRTIO_BLK_T_IN {
+                        // The host has written to the guest memory.
+                        guest_memory::ram(guest_addr).mark_dirty(guest_addr, len as usize);
+                        request.written += len;
+                    }
+                }
+                break;
+            }
+        }
+
+        self.submit_async();
+    }
+
+    /// Returns the completed requests of the queue `index` to the driver.
+    /// Returns true if it has used some buffers.
+    fn complete_async(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        // Requests may complete out of order.
+        let mut used = false;
+        let mut pending = VecDeque::new();
+        while let Some(request) = self.requests.pop_front() {
+            if request.queue == index && request.is_done() {
+                complete(queue, &request.chain, request.status, request.written);
+                used = true;
+            } else {
+                pending.push_back(request);
+            }
+        }
+
+        self.requests = pending;
+        used
+    }
+
+    /// Takes completed host requests, and returns completed requests of all
+    /// queues to the driver.
+    fn process_all(&mut self, queues: &mut [Virtqueue]) -> bool {
+        self.process_async();
+        let mut used = false;
+        for (index, queue) in queues.iter_mut().enumerate() {
+            used |= self.complete_async(index, queue);
+        }
+        used
+    }
+
+    /// Starts a request in the background, or handles it now. Returns true if
+    /// it has used the buffers.
+    fn start(&mut self, index: usize, chain: DescChain, queue: &mut Virtqueue) -> bool {
+        let Err(chain) = self.start_async(index, chain) else {
+            return false;
+        };
+
+        let (status, written) = self.handle_request(&chain);
+        complete(queue, &chain, status, written);
+        true
+    }
+
+    /// Starts the held requests as long as the throttle limits allow, or
+    /// all of them with `force`.
+    fn release_held(&mut self, queues: &mut [Virtqueue], force: bool) -> bool {
+        let mut used = false;
+        while let Some((_, chain)) = self.held.front() {
+            if !force && !self.throttle.admit(data_len(chain)) {
+                break;
+            }
+
+            let (index, chain) = self.held.pop_front().unwrap();
+            used |= self.start(index, chain, &mut queues[index]);
+        }
+
+        used | self.process_all(queues)
+    }
+
+    /// Waits for the host to complete all requests in flight, including the
+    /// held ones.
+    fn drain(&mut self, queues: &mut [Virtqueue]) -> bool {
+        let mut used = self.release_held(queues, true);
+        while !self.requests.is_empty() {
+            used |= self.process_all(queues);
+            core::hint::spin_loop();
+        }
+        used
+    }
+}
+
+impl VirtioDevice for VirtioBlk {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_BLK
+    }
+
+    fn device_features(&self) -> u64 {
+        let mq = if self.num_queues > 1 { VIRTIO_BLK_F_MQ } else { 0 };
+        VIRTIO_F_VERSION_1 | VIRTIO_BLK_F_FLUSH | mq
+    }
+
+    fn num_queues(&self) -> usize {
+        self.num_queues
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_blk_config: le64 capacity, ..., le16 num_queues
+        match offset {
+            0..8 => self.backend.capacity().to_le_bytes()[offset as usize],
+            CONFIG_NUM_QUEUES..36 => (self.num_queues as u16).to_le_bytes()[(offset - CONFIG_NUM_QUEUES) as usize],
+            _ => 0,
+        }
+    }
+
+    fn reset(&mut self) {
+        self.held.clear();
+
+        // Requests are dropped, but the host may still be writing to the
+        // guest memory.
+        let Some(disk) = self.backend.async_disk() else {
+            return;
+        };
+
+        let mut in_flight: usize = self.requests.iter().map(|request| request.in_flight.len()).sum();
+        while in_flight > 0 {
+            if disk.poll().is_some() {
+                in_flight -= 1;
+            } else {
+                core::hint::spin_loop();
+            }
+        }
+        self.requests.clear();
+    }
+
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            // Over the limits (see throttle.rs), or behind a request which is.
+            if !self.held.is_empty() || !self.throttle.admit(data_len(&chain)) {
+                self.held.push_back((index, chain));
+                continue;
+            }
+
+            used |= self.start(index, chain, queue);
+        }
+
+        if !self.held.is_empty() && !HELD.swap(true, Ordering::Relaxed) {
+            timer::kick();
+        }
+
+        // Requests of the other queues complete on the host interrupt.
+        self.process_async();
+        used | self.complete_async(index, queue)
+    }
+}
+
+static VIRTIO_BLK: Mutex<Option<VirtioMmio<VirtioBlk>>> = Mutex::new(None);
+
+/// `hart_id` is the (physical) hart to take the host disk interrupts.
+pub fn init(config: &DiskConfig, hart_id: u64) {
+    let mut host_irq = None;
+    let backend: Box<dyn BlockBackend> = match config.backend {
+        DiskBackendKind::Host => {
+            let disk = HostBlk::open(HOST_DISK_SERIAL).expect("[virtio-blk] host disk not found");
+            disk.enable_interrupt(hart_id);
+            host_irq = Some(disk.irq());
+            Box::new(HostBackend { disk, is_async: true })
+        }
+        DiskBackendKind::Cow => {
+            let base = HostBlk::open(HOST_DISK_SERIAL).expect("[virtio-blk] host disk not found");
+            let overlay = HostBlk::open(OVERLAY_DISK_SERIAL).expect("[virtio-blk] overlay disk not found");
+            Box::new(CowBackend::open(base, overlay).unwrap_or_else(|err| panic!("[virtio-blk] {}", err)))
+        }
+    };
+
+    let throttle = Throttle::new(config.throttle);
+    let device = VirtioBlk { num_queues: config.queues, host_irq, throttle, ..VirtioBlk::new(backend) };
+    *VIRTIO_BLK.lock() = Some(virtio::attach("virtio-blk", device, mmio_read, mmio_write));
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_BLK.lock().as_mut().expect("virtio-blk not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    VIRTIO_BLK.lock().as_mut().expect("virtio-blk not initialized").mmio_write(offset, value, width)
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_BLK.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+/// When the held interrupt (see `-irq-coalesce`) or the held requests are
+/// due.
+pub fn deadline() -> u64 {
+    if !virtio::holds_interrupts() && !HELD.load(Ordering::Relaxed) {
+        return NO_DEADLINE;
+    }
+
+    VIRTIO_BLK.lock().as_ref().map_or(NO_DEADLINE, |mmio| {
+        let held = if mmio.device.held.is_empty() { NO_DEADLINE } else { mmio.device.throttle.ready_at() };
+        mmio.deadline().min(held)
+    })
+}
+
+pub fn poll() {
+    if !virtio::holds_interrupts() && !HELD.load(Ordering::Relaxed) {
+        return;
+    }
+
+    if let Some(mmio) = VIRTIO_BLK.lock().as_mut() {
+        if mmio.device.release_held(&mut mmio.queues, false) {
+            mmio.notify_used_batched();
+        }
+
+        HELD.store(!mmio.device.held.is_empty(), Ordering::Relaxed);
+        mmio.poll();
+    }
+}
+
+/// The throttle limits, and the number of held requests.
+pub fn throttle() -> Option<(Limits, usize)> {
+    VIRTIO_BLK.lock().as_ref().map(|mmio| (mmio.device.throttle.limits(), mmio.device.held.len()))
+}
+
+/// Changes the throttle limits at runtime.
+pub fn set_throttle(limits: Limits) -> Result<(), String> {
+    let mut lock = VIRTIO_BLK.lock();
+    let mmio = lock.as_mut().ok_or("virtio-blk is not enabled (-disk)")?;
+    mmio.device.throttle.set_limits(limits);
+    if !mmio.device.held.is_empty() {
+        // Start the held requests now if the limits allow.
+        timer::kick();
+    }
+    Ok(())
+}
+
+/// The interrupt of the host disk, if it does I/O in the background.
+pub fn host_irq() -> Option<u32> {
+    VIRTIO_BLK.lock().as_ref().and_then(|mmio| mmio.device.host_irq)
+}
+
+/// Handles completions from the host disk.
+pub fn handle_interrupt() {
+    let mut lock = VIRTIO_BLK.lock();
+    let mmio = lock.as_mut().expect("virtio-blk not initialized");
+    if let Some(disk) = mmio.device.backend.async_disk() {
+        disk.ack_interrupt();
+    }
+
+    if mmio.device.process_all(&mut mmio.queues) {
+        mmio.notify_used_batched();
+    }
+}
+
+/// Waits for the requests in flight, e.g. before saving the guest memory.
+pub fn drain() {
+    if let Some(mmio) = VIRTIO_BLK.lock().as_mut() {
+        if mmio.device.drain(&mut mmio.queues) {
+            mmio.notify_used();
+        }
+    }
+}
+
+/// Call `drain` first: requests in flight are not saved.
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_BLK.lock().as_ref() {
+        w.section("virtio-blk", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    match VIRTIO_BLK.lock().as_mut() {
+        Some(mmio) => snapshot::load_section(sections, "virtio-blk", mmio),
+        None => Ok(()),
+    }
+}
@@ -0,0 +1,239 @@
+//! virtio-console with multiple ports (`VIRTIO_CONSOLE_F_MULTIPORT`).
+//!
+//! Port 0 is a console (`/dev/hvc*`) and other ports are named channels
+//! (`/dev/vport*`, or `/dev/virtio-ports/<name>` with udev).
+use alloc::{collections::VecDeque, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    config::ConsoleConfig,
+    boot_time, console_log, crash,
+    snapshot::{self, Section, Writer},
+    virtio::{self, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_CONSOLE: u32 = 3;
+pub const VIRTIO_CONSOLE_F_MULTIPORT: u64 = 1 << 1;
+
+// Queue 0/1 are for port 0, 2/3 are for control messages, and 4/5 are for
+// port 1, and so on.
+const CONTROL_RX_QUEUE: usize = 2;
+const CONTROL_TX_QUEUE: usize = 3;
+
+const VIRTIO_CONSOLE_DEVICE_READY: u16 = 0;
+const VIRTIO_CONSOLE_DEVICE_ADD: u16 = 1;
+const VIRTIO_CONSOLE_PORT_READY: u16 = 3;
+const VIRTIO_CONSOLE_CONSOLE_PORT: u16 = 4;
+const VIRTIO_CONSOLE_PORT_OPEN: u16 = 6;
+const VIRTIO_CONSOLE_PORT_NAME: u16 = 7;
+
+/// Returns the port ID and whether it's the transmit queue.
+fn queue_to_port(index: usize) -> Option<(usize, bool)> {
+    match index {
+        0 | 1 => Some((0, index == 1)),
+        CONTROL_RX_QUEUE | CONTROL_TX_QUEUE => None,
+        _ => Some((index / 2 - 1, index % 2 == 1)),
+    }
+}
+
+/// struct virtio_console_control: le32 id, le16 event, le16 value, and data.
+fn control_message(id: usize, event: u16, value: u16, data: &[u8]) -> Vec<u8> {
+    let mut msg = Vec::with_capacity(8 + data.len());
+    msg.extend_from_slice(&(id as u32).to_le_bytes());
+    msg.extend_from_slice(&event.to_le_bytes());
+    msg.extend_from_slice(&value.to_le_bytes());
+    msg.extend_from_slice(data);
+    msg
+}
+
+struct Port {
+    name: String,
+    /// Whether it's the console (hvc0).
+    is_console: bool,
+    /// The output not terminated by a newline yet.
+    line: Vec<u8>,
+}
+
+impl Port {
+    fn write(&mut self, data: &[u8]) {
+        for &ch in data {
+            if ch == b'\n' {
+                crash::scan_console_line(&self.line);
+                if self.is_console {
+                    console_log::record(&self.line);
+                    boot_time::scan_console_line(&self.line);
+                }
+                let output = core::str::from_utf8(&self.line).unwrap_or("(not utf-8)");
+                println!("[guest:{}] {}", self.name, output);
+                self.line.clear();
+            } else {
+                self.line.push(ch);
+            }
+        }
+    }
+}
+
+pub struct VirtioConsole {
+    ports: Vec<Port>,
+    /// Control messages waiting for receive buffers in the control queue.
+    control_messages: VecDeque<Vec<u8>>,
+}
+
+impl VirtioConsole {
+    fn handle_control_message(&mut self, msg: &[u8]) {
+        if msg.len() < 8 {
+            warn!("virtio-console", "too short control message");
+            return;
+        }
+
+        let id = u32::from_le_bytes(msg[0..4].try_into().unwrap()) as usize;
+        let event = u16::from_le_bytes(msg[4..6].try_into().unwrap());
+        let value = u16::from_le_bytes(msg[6..8].try_into().unwrap());
+        match event {
+            VIRTIO_CONSOLE_DEVICE_READY if value == 1 => {
+                for id in 0..self.ports.len() {
+                    self.control_messages.push_back(control_message(id, VIRTIO_CONSOLE_DEVICE_ADD, 1, &[]));
+                }
+            }
+            VIRTIO_CONSOLE_DEVICE_READY => {
+                warn!("virtio-console", "driver failed to initialize the device");
+            }
+            VIRTIO_CONSOLE_PORT_READY if value == 1 && id < self.ports.len() => {
+                if id == 0 {
+                    self.control_messages.push_back(control_message(id, VIRTIO_CONSOLE_CONSOLE_PORT, 1, &[]));
+                } else {
+                    let name = self.ports[id].name.as_bytes();
+                    self.control_messages.push_back(control_message(id, VIRTIO_CONSOLE_PORT_NAME, 1, name));
+                }
+
+                self.control_messages.push_back(control_message(id, VIRTIO_CONSOLE_PORT_OPEN, 1, &[]));
+            }
+            // The guest opened or closed the port. We don't care.
+            VIRTIO_CONSOLE_PORT_READY | VIRTIO_CONSOLE_PORT_OPEN => {}
+            _ => {
+                warn!("virtio-console", "ignore control message: id={}, event={}", id, event);
+            }
+        }
+    }
+}
+
+impl VirtioDevice for VirtioConsole {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_CONSOLE
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1 | VIRTIO_CONSOLE_F_MULTIPORT
+    }
+
+    fn num_queues(&self) -> usize {
+        2 * (self.ports.len() + 1)
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_console_config: le16 cols, le16 rows, le32 max_nr_ports, ...
+        let max_nr_ports = (self.ports.len() as u32).to_le_bytes();
+        match offset {
+            4..8 => max_nr_ports[offset as usize - 4],
+            _ => 0,
+        }
+    }
+
+    fn reset(&mut self) {
+        self.control_messages.clear();
+        for port in &mut self.ports {
+            port.line.clear();
+        }
+    }
+
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        if index == CONTROL_TX_QUEUE {
+            let mut used = false;
+            while let Some(chain) = queue.pop() {
+                self.handle_control_message(&chain.read_all());
+                queue.push_used(&chain, 0);
+                used = true;
+            }
+
+            return used;
+        }
+
+        let Some((port, true)) = queue_to_port(index).filter(|(port, _)| *port < self.ports.len()) else {
+            // New receive buffers are available. Nothing to do.
+            return false;
+        };
+
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            self.ports[port].write(&chain.read_all());
+            queue.push_used(&chain, 0);
+            used = true;
+        }
+
+        used
+    }
+}
+
+static VIRTIO_CONSOLE: Mutex<Option<VirtioMmio<VirtioConsole>>> = Mutex::new(None);
+
+/// Sends pending control messages to the driver.
+fn flush_control_messages(mmio: &mut VirtioMmio<VirtioConsole>) {
+    let mut used = false;
+    while let Some(msg) = mmio.device.control_messages.front() {
+        let Some(chain) = mmio.queues[CONTROL_RX_QUEUE].pop() else {
+            // No receive buffers. Try again when the driver adds ones.
+            break;
+        };
+
+        let written = chain.write_all(msg);
+        mmio.queues[CONTROL_RX_QUEUE].push_used(&chain, written as u32);
+        mmio.device.control_messages.pop_front();
+        used = true;
+    }
+
+    if used {
+        mmio.notify_used();
+    }
+}
+
+pub fn init(config: &ConsoleConfig) {
+    let ports = config
+        .ports
+        .iter()
+        .enumerate()
+        .map(|(id, name)| Port { name: name.clone(), is_console: id == 0, line: Vec::new() })
+        .collect();
+
+    let device = VirtioConsole { ports, control_messages: VecDeque::new() };
+    *VIRTIO_CONSOLE.lock() = Some(virtio::attach("virtio-console", device, mmio_read, mmio_write));
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_CONSOLE.lock().as_mut().expect("virtio-console not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    let mut lock = VIRTIO_CONSOLE.lock();
+    let mmio = lock.as_mut().expect("virtio-console not initialized");
+    mmio.mmio_write(offset, value, width);
+    flush_control_messages(mmio);
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_CONSOLE.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_CONSOLE.lock().as_ref() {
+        w.section("virtio-console", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    match VIRTIO_CONSOLE.lock().as_mut() {
+        Some(mmio) => snapshot::load_section(sections, "virtio-console", mmio),
+        None => Ok(()),
+    }
+}
@@ -0,0 +1,96 @@
+//! Virtio feature negotiation: the features offered to the driver are the
+//! device's own, the transport's (EVENT_IDX and INDIRECT_DESC), minus the
+//! ones disabled on the command line, to test the guest's drivers against
+//! different combinations:
+//!
+//! ```text
+//! -device blk,disable-feature=indirect,disable-feature=flush
+//! ```
+//!
+//! The driver must accept VERSION_1 (no legacy interface), and nothing we
+//! haven't offered: otherwise FEATURES_OK doesn't stick, and the driver
+//! gives up on the device.
+use alloc::{format, string::String, vec::Vec};
+
+use crate::{
+    config::config,
+    host_9p::VIRTIO_9P_MOUNT_TAG,
+    host_blk::VIRTIO_BLK_F_FLUSH,
+    virtio::VIRTIO_F_VERSION_1,
+    virtio_balloon::VIRTIO_BALLOON_F_DEFLATE_ON_OOM,
+    virtio_blk::VIRTIO_BLK_F_MQ,
+    virtio_console::VIRTIO_CONSOLE_F_MULTIPORT,
+    virtio_net::{VIRTIO_NET_F_CTRL_VQ, VIRTIO_NET_F_MAC, VIRTIO_NET_F_MQ},
+};
+
+pub const VIRTIO_F_INDIRECT_DESC: u64 = 1 << 28;
+/// used_event and avail_event.
+pub const VIRTIO_F_EVENT_IDX: u64 = 1 << 29;
+
+/// Offered for every device by the transport.
+const TRANSPORT_FEATURES: u64 = VIRTIO_F_INDIRECT_DESC | VIRTIO_F_EVENT_IDX;
+
+const COMMON_FEATURES: &[(&str, u64)] = &[("indirect", VIRTIO_F_INDIRECT_DESC), ("event-idx", VIRTIO_F_EVENT_IDX)];
+
+/// The device types: the name in `-device`, the device ID, and the features
+/// of its own.
+const DEVICES: &[(&str, u32, &[(&str, u64)])] = &[
+    ("net", 1, &[("mac", VIRTIO_NET_F_MAC), ("ctrl-vq", VIRTIO_NET_F_CTRL_VQ), ("mq", VIRTIO_NET_F_MQ)]),
+    ("blk", 2, &[("flush", VIRTIO_BLK_F_FLUSH), ("mq", VIRTIO_BLK_F_MQ)]),
+    ("console", 3, &[("multiport", VIRTIO_CONSOLE_F_MULTIPORT)]),
+    ("rng", 4, &[]),
+    ("balloon", 5, &[("deflate-on-oom", VIRTIO_BALLOON_F_DEFLATE_ON_OOM)]),
+    ("9p", 9, &[("mount-tag", VIRTIO_9P_MOUNT_TAG)]),
+    ("input", 18, &[]),
+    ("vsock", 19, &[]),
+    ("mem", 24, &[]),
+    ("fs", 26, &[]),
+];
+
+/// Looks up a feature by the names in `-device`. Returns the device ID and
+/// the feature bit.
+pub fn lookup(device: &str, feature: &str) -> Result<(u32, u64), String> {
+    let Some((_, device_id, features)) = DEVICES.iter().find(|(name, _, _)| *name == device) else {
+        let names: Vec<&str> = DEVICES.iter().map(|(name, _, _)| *name).collect();
+        return Err(format!("unknown device: {} (expected {})", device, names.join(", ")));
+    };
+
+    match COMMON_FEATURES.iter().chain(features.iter()).find(|(name, _)| *name == feature) {
+        Some((_, bit)) => Ok((*device_id, *bit)),
+        None => {
+            let names: Vec<&str> = COMMON_FEATURES.iter().chain(features.iter()).map(|(name, _)| *name).collect();
+            Err(format!("unknown feature of {}: {} (expected {})", device, feature, names.join(", ")))
+        }
+    }
+}
+
+/// The features to offer for the device.
+pub fn offered(device_id: u32, device_features: u64) -> u64 {
+    let disabled = config()
+        .disabled_features
+        .iter()
+        .filter(|(id, _)| *id == device_id)
+        .fold(0, |mask, (_, bit)| mask | bit);
+    (device_features | TRANSPORT_FEATURES) & !disabled
+}
+
+fn device_name(device_id: u32) -> &'static str {
+    DEVICES.iter().find(|(_, id, _)| *id == device_id).map_or("unknown", |(name, _, _)| *name)
+}
+
+/// Whether the device can accept the driver's features (FEATURES_OK).
+pub fn accept(device_id: u32, offered: u64, driver_features: u64) -> bool {
+    let name = device_name(device_id);
+    if driver_features & !offered != 0 {
+        warn!("virtio", "{}: the driver accepted features we haven't offered: {:#x}", name, driver_features & !offered);
+        return false;
+    }
+
+    if driver_features & VIRTIO_F_VERSION_1 == 0 {
+        warn!("virtio", "{}: the driver doesn't support VERSION_1", name);
+        return false;
+    }
+
+    debug!("virtio", "{}: negotiated features {:#x}", name, driver_features);
+    true
+}
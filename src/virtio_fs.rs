@@ -0,0 +1,177 @@
+//! virtio-fs: shares a host directory with the guest, faster than virtio-9p.
+//!
+//! FUSE requests are forwarded to the vhost-user-fs device provided by QEMU,
+//! and served by virtiofsd on the host. The device reads and writes the
+//! guest's buffers in place (no copies), except for the requests with more
+//! buffers than the host virtqueue has descriptors. Mount it in the guest by:
+//!
+//! ```text
+//! mount -t virtiofs <tag> /mnt
+//! ```
+//!
+//! DAX (`-o dax`) is not supported: QEMU doesn't implement the shared memory
+//! window of vhost-user-fs (the cache region where virtiofsd maps files), so
+//! we don't advertise one, and the guest uses its own page cache.
+use alloc::{format, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    config::FsConfig,
+    guest_memory,
+    host_fs::{HostFs, MAX_BUFFERS, MAX_MESSAGE, TAG_LEN},
+    monitor,
+    snapshot::{self, Section, Writer},
+    virtio::{self, DescChain, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_FS: u32 = 26;
+const HIPRIO_QUEUE: usize = 0;
+
+/// struct fuse_in_header: len[4] opcode[4] unique[8] nodeid[8] uid[4]
+/// gid[4] pid[4] total_extlen[2] padding[2]
+const FUSE_IN_HEADER_LEN: usize = 40;
+/// struct fuse_out_header: len[4] error[4] unique[8]
+const FUSE_OUT_HEADER_LEN: usize = 16;
+/// EIO in Linux.
+const EIO: i32 = 5;
+
+fn error_reply(unique: u64, error: i32) -> [u8; FUSE_OUT_HEADER_LEN] {
+    let mut reply = [0; FUSE_OUT_HEADER_LEN];
+    reply[0..4].copy_from_slice(&(FUSE_OUT_HEADER_LEN as u32).to_le_bytes());
+    reply[4..8].copy_from_slice(&(-error).to_le_bytes());
+    reply[8..16].copy_from_slice(&unique.to_le_bytes());
+    reply
+}
+
+pub struct VirtioFs {
+    tag: String,
+    host: HostFs,
+}
+
+impl VirtioFs {
+    /// Replies EIO to an invalid request.
+    fn reject(&self, chain: &DescChain, desc: &str) -> usize {
+        warn!("virtio-fs", "{}", desc);
+        let data = format!("{{\"device\": \"virtio-fs\", \"desc\": \"{}\"}}", desc);
+        monitor::event("VIRTIO_ERROR", &data);
+        let msg = chain.read_all();
+        let unique = msg.get(8..16).map_or(0, |unique| u64::from_le_bytes(unique.try_into().unwrap()));
+        chain.write_all(&error_reply(unique, EIO))
+    }
+
+    /// Forwards a request on the request queue. Returns the length of the
+    /// reply.
+    fn forward(&mut self, chain: &DescChain) -> usize {
+        let readable: usize = chain.buffers.iter().filter(|b| !b.device_writable).map(|b| b.len as usize).sum();
+        let writable: usize = chain.buffers.iter().filter(|b| b.device_writable).map(|b| b.len as usize).sum();
+        if readable < FUSE_IN_HEADER_LEN {
+            return self.reject(chain, "request too short");
+        }
+
+        if chain.buffers.len() <= MAX_BUFFERS {
+            let mut bufs = Vec::new();
+            for buf in &chain.buffers {
+                let Some(host_addr) = buf.host_addr(buf.device_writable) else {
+                    return self.reject(chain, "buffer out of guest memory");
+                };
+
+                bufs.push((host_addr, buf.len, buf.device_writable));
+            }
+
+            let written = (self.host.request(&bufs) as usize).min(writable);
+            for buf in chain.buffers.iter().filter(|b| b.device_writable) {
+                guest_memory::ram(buf.guest_addr).mark_dirty(buf.guest_addr, buf.len as usize);
+            }
+            return written;
+        }
+
+        // Too many buffers for the host virtqueue.
+        if readable > MAX_MESSAGE || writable > MAX_MESSAGE {
+            return self.reject(chain, "request too large");
+        }
+
+        let msg = chain.read_all();
+        chain.write_all(self.host.request_copied(&msg, writable))
+    }
+}
+
+impl VirtioDevice for VirtioFs {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_FS
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1
+    }
+
+    fn num_queues(&self) -> usize {
+        // The high priority queue and a request queue.
+        2
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_fs_config: u8 tag[36] (NUL-padded), le32 num_request_queues
+        let offset = offset as usize;
+        match offset {
+            0..TAG_LEN => self.tag.as_bytes().get(offset).copied().unwrap_or(0),
+            _ => 1u32.to_le_bytes().get(offset - TAG_LEN).copied().unwrap_or(0),
+        }
+    }
+
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            let written = if index == HIPRIO_QUEUE {
+                // FUSE_FORGET and FUSE_INTERRUPT: no replies.
+                let msg = chain.read_all();
+                if msg.len() >= FUSE_IN_HEADER_LEN && msg.len() <= MAX_MESSAGE {
+                    self.host.request_hiprio(&msg);
+                }
+                0
+            } else {
+                self.forward(&chain)
+            };
+
+            queue.push_used(&chain, written as u32);
+            used = true;
+        }
+
+        used
+    }
+}
+
+static VIRTIO_FS: Mutex<Option<VirtioMmio<VirtioFs>>> = Mutex::new(None);
+
+pub fn init(config: &FsConfig) {
+    assert!(config.tag.len() <= TAG_LEN, "[virtio-fs] the tag is longer than {} bytes", TAG_LEN);
+    let host = HostFs::open(&config.tag).expect("[virtio-fs] host vhost-user-fs device not found");
+    let device = VirtioFs { tag: config.tag.clone(), host };
+    *VIRTIO_FS.lock() = Some(virtio::attach("virtio-fs", device, mmio_read, mmio_write));
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_FS.lock().as_mut().expect("virtio-fs not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    VIRTIO_FS.lock().as_mut().expect("virtio-fs not initialized").mmio_write(offset, value, width)
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_FS.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_FS.lock().as_ref() {
+        w.section("virtio-fs", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    match VIRTIO_FS.lock().as_mut() {
+        Some(mmio) => snapshot::load_section(sections, "virtio-fs", mmio),
+        None => Ok(()),
+    }
+}
@@ -0,0 +1,183 @@
+//! virtio-input (`-input`): the keyboard and the tablet (an absolute pointer)
+//! of QEMU's display, for the framebuffer console and interactive programs.
+//!
+//! Each device forwards a virtio-input device provided by QEMU: events from
+//! the host device go to the guest as is, and so does the configuration
+//! space, so the guest sees the same name, keys and axes.
+use alloc::{collections::VecDeque, string::String};
+use spin::Mutex;
+
+use crate::{
+    host_input::{EVENT_LEN, HostInput},
+    machine,
+    mmio_bus::{self, ReadFn, WriteFn},
+    snapshot::{self, Section, Writer},
+    virtio::{VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_INPUT: u32 = 18;
+const EVENT_QUEUE: usize = 0;
+const STATUS_QUEUE: usize = 1;
+
+/// The keyboard and the tablet, in the order of run.sh.
+pub const NUM_INPUTS: usize = 2;
+const DEVICE_SIZE: u64 = 0x1000;
+const NAMES: [&str; NUM_INPUTS] = ["virtio-input0", "virtio-input1"];
+const READS: [ReadFn; NUM_INPUTS] = [mmio_read::<0>, mmio_read::<1>];
+const WRITES: [WriteFn; NUM_INPUTS] = [mmio_write::<0>, mmio_write::<1>];
+/// Events waiting for buffers from the driver. Older ones are dropped.
+const MAX_PENDING_EVENTS: usize = 256;
+
+pub struct VirtioInput {
+    host: HostInput,
+    pending: VecDeque<[u8; EVENT_LEN]>,
+}
+
+impl VirtioInput {
+    /// Passes pending events to the driver. Returns true if it has used some
+    /// buffers.
+    fn flush(&mut self, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while !self.pending.is_empty() {
+            let Some(chain) = queue.pop() else {
+                break;
+            };
+
+            let event = self.pending.pop_front().unwrap();
+            let written = chain.write_all(&event);
+            queue.push_used(&chain, written as u32);
+            used = true;
+        }
+
+        used
+    }
+}
+
+impl VirtioDevice for VirtioInput {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_INPUT
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1
+    }
+
+    fn num_queues(&self) -> usize {
+        2
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        self.host.read_config(offset)
+    }
+
+    fn write_config(&mut self, offset: u64, value: u8) {
+        self.host.write_config(offset, value);
+    }
+
+    fn reset(&mut self) {
+        self.pending.clear();
+    }
+
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        match index {
+            EVENT_QUEUE => self.flush(queue),
+            STATUS_QUEUE => {
+                // LEDs: QEMU's display doesn't show them.
+                let mut used = false;
+                while let Some(chain) = queue.pop() {
+                    queue.push_used(&chain, 0);
+                    used = true;
+                }
+
+                used
+            }
+            _ => false,
+        }
+    }
+}
+
+static INPUTS: [Mutex<Option<VirtioMmio<VirtioInput>>>; NUM_INPUTS] = [const { Mutex::new(None) }; NUM_INPUTS];
+
+/// The address and IRQ of a device.
+pub fn device(index: usize) -> (u64, u64, u32) {
+    let (base, _, irq) = machine::device_region("virtio-input");
+    let addr = base + index as u64 * DEVICE_SIZE;
+    (addr, addr + DEVICE_SIZE, irq + index as u32)
+}
+
+pub fn init(hart_id: u64) {
+    for index in 0..NUM_INPUTS {
+        let host = HostInput::open(hart_id).expect("[virtio-input] host virtio-input devices not found");
+        let (addr, end, irq) = device(index);
+        let device = VirtioInput { host, pending: VecDeque::new() };
+        *INPUTS[index].lock() = Some(VirtioMmio::new(device, irq));
+        mmio_bus::register(NAMES[index], addr, end, READS[index], WRITES[index]);
+    }
+}
+
+fn mmio_read<const INDEX: usize>(offset: u64, width: u64) -> u64 {
+    INPUTS[INDEX].lock().as_mut().expect("virtio-input not initialized").mmio_read(offset, width)
+}
+
+fn mmio_write<const INDEX: usize>(offset: u64, value: u64, width: u64) {
+    INPUTS[INDEX].lock().as_mut().expect("virtio-input not initialized").mmio_write(offset, value, width)
+}
+
+pub fn is_host_irq(irq: u32) -> bool {
+    INPUTS.iter().any(|input| input.lock().as_ref().is_some_and(|mmio| mmio.device.host.irq() == irq))
+}
+
+/// Passes events from the host device to the guest.
+pub fn handle_interrupt(irq: u32) {
+    for input in &INPUTS {
+        let mut lock = input.lock();
+        let Some(mmio) = lock.as_mut().filter(|mmio| mmio.device.host.irq() == irq) else {
+            continue;
+        };
+
+        let events = mmio.device.host.handle_interrupt();
+        if !mmio.is_in_use() {
+            continue;
+        }
+
+        for event in events {
+            if mmio.device.pending.len() >= MAX_PENDING_EVENTS {
+                mmio.device.pending.pop_front();
+            }
+
+            mmio.device.pending.push_back(event);
+        }
+
+        if mmio.device.flush(&mut mmio.queues[EVENT_QUEUE]) {
+            mmio.notify_used();
+        }
+    }
+}
+
+pub fn reset() {
+    for input in &INPUTS {
+        if let Some(mmio) = input.lock().as_mut() {
+            mmio.reset();
+        }
+    }
+}
+
+/// Pending events are not saved.
+pub fn save(w: &mut Writer) {
+    for (index, input) in INPUTS.iter().enumerate() {
+        if let Some(mmio) = input.lock().as_ref() {
+            w.section(NAMES[index], mmio);
+        }
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    for (index, input) in INPUTS.iter().enumerate() {
+        if let Some(mmio) = input.lock().as_mut() {
+            snapshot::load_section(sections, NAMES[index], mmio)?;
+            mmio.device.pending.clear();
+        }
+    }
+
+    Ok(())
+}
@@ -0,0 +1,353 @@
+//! virtio-mem: memory hotplug. `-virtio-mem <size>[,block=<size>]` gives
+//! the guest a region of `<size>` above the RAM, of which it plugs as much
+//! as requested in the monitor:
+//!
+//! ```text
+//! {"execute": "mem-resize", "arguments": {"size": 536870912}}
+//! (hmp) mem-resize 512m
+//! (hmp) info memory-devices
+//! ```
+//!
+//! The guest plugs and unplugs the memory block by block. Plugged blocks are
+//! mapped into the guest, and unplugged ones are unmapped (and discarded by
+//! the host with `-balloon`): the guest can't access them
+//! (VIRTIO_MEM_F_UNPLUGGED_INACCESSIBLE). The host memory is allocated at
+//! boot, but QEMU doesn't allocate it until it's touched.
+//!
+//! Linux (`CONFIG_VIRTIO_MEM`) adds the plugged memory in 128MB sections:
+//! make the size a multiple of it, and online the memory with
+//! `memhp_default_state=online`. Snapshots and migration don't carry the
+//! plugged memory: `mem-resize 0` first.
+use alloc::{format, string::String, vec, vec::Vec};
+use core::ops::Range;
+use spin::Mutex;
+
+use crate::{
+    config::{VirtioMemConfig, config},
+    guest_memory::HOTPLUG_MEMORY,
+    guest_page_table::{GuestPageTable, MEGAPAGE_SIZE, PTE_R, PTE_W, PTE_X},
+    machine, smp,
+    snapshot::{self, Reader, Section, Writer},
+    virtio::{self, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+    virtio_balloon,
+};
+
+const VIRTIO_DEVICE_MEM: u32 = 24;
+/// The guest must not access unplugged memory: it's not mapped.
+const VIRTIO_MEM_F_UNPLUGGED_INACCESSIBLE: u64 = 1 << 1;
+
+const VIRTIO_MEM_REQ_PLUG: u16 = 0;
+const VIRTIO_MEM_REQ_UNPLUG: u16 = 1;
+const VIRTIO_MEM_REQ_UNPLUG_ALL: u16 = 2;
+const VIRTIO_MEM_REQ_STATE: u16 = 3;
+
+const VIRTIO_MEM_RESP_ACK: u16 = 0;
+const VIRTIO_MEM_RESP_NACK: u16 = 1;
+const VIRTIO_MEM_RESP_ERROR: u16 = 3;
+
+const VIRTIO_MEM_STATE_PLUGGED: u16 = 0;
+const VIRTIO_MEM_STATE_UNPLUGGED: u16 = 1;
+const VIRTIO_MEM_STATE_MIXED: u16 = 2;
+
+/// struct virtio_mem_req: le16 type, le16 padding[3], le64 addr, le16 nb_blocks, le16 padding[3].
+const REQUEST_SIZE: usize = 24;
+/// struct virtio_mem_resp: le16 type, le16 padding[3], le16 state.
+const RESPONSE_SIZE: usize = 10;
+
+pub struct VirtioMem {
+    block_size: u64,
+    /// The stage-2 page table of the vCPUs, into which blocks are mapped.
+    hgatp: u64,
+    /// Whether each block is plugged.
+    plugged: Vec<bool>,
+    /// How much the guest should have plugged (`mem-resize`).
+    requested_size: u64,
+    /// Blocks have been unmapped: the TLBs are flushed once the lock is
+    /// released.
+    needs_flush: bool,
+}
+
+impl VirtioMem {
+    fn region_size(&self) -> u64 {
+        self.plugged.len() as u64 * self.block_size
+    }
+
+    fn plugged_size(&self) -> u64 {
+        self.plugged.iter().filter(|&&plugged| plugged).count() as u64 * self.block_size
+    }
+
+    /// The blocks of a request. None if they're not in the region.
+    fn blocks(&self, addr: u64, nb_blocks: u16) -> Option<Range<usize>> {
+        let off = addr.checked_sub(HOTPLUG_MEMORY.guest_base())?;
+        if off % self.block_size != 0 || nb_blocks == 0 {
+            return None;
+        }
+
+        let first = (off / self.block_size) as usize;
+        let end = first + nb_blocks as usize;
+        (end <= self.plugged.len()).then_some(first..end)
+    }
+
+    /// Maps or unmaps the blocks. A block at a time: a 2MB page (with
+    /// `-hugepages`) never spans two of them.
+    fn set_plugged(&mut self, blocks: Range<usize>, plugged: bool) {
+        let mut table = GuestPageTable::from_hgatp(self.hgatp);
+        for block in blocks.clone() {
+            let off = block as u64 * self.block_size;
+            if plugged {
+                HOTPLUG_MEMORY.map_range(&mut table, off, self.block_size, PTE_R | PTE_W | PTE_X);
+            } else {
+                HOTPLUG_MEMORY.unmap_range(&mut table, off, self.block_size);
+                let host_addr = HOTPLUG_MEMORY.host_addr(HOTPLUG_MEMORY.guest_base() + off);
+                virtio_balloon::discard(host_addr as u64, self.block_size as u32);
+                self.needs_flush = true;
+            }
+        }
+
+        self.plugged[blocks].fill(plugged);
+    }
+
+    fn unplug_all(&mut self) {
+        for block in 0..self.plugged.len() {
+            if self.plugged[block] {
+                self.set_plugged(block..block + 1, false);
+            }
+        }
+    }
+
+    /// Returns the response type and, for STATE, the state of the blocks.
+    fn handle_request(&mut self, request: &[u8]) -> (u16, u16) {
+        let type_ = u16::from_le_bytes(request[0..2].try_into().unwrap());
+        let addr = u64::from_le_bytes(request[8..16].try_into().unwrap());
+        let nb_blocks = u16::from_le_bytes(request[16..18].try_into().unwrap());
+        if type_ == VIRTIO_MEM_REQ_UNPLUG_ALL {
+            self.unplug_all();
+            return (VIRTIO_MEM_RESP_ACK, 0);
+        }
+
+        let Some(blocks) = self.blocks(addr, nb_blocks) else {
+            warn!("virtio-mem", "invalid range: {:#x} ({} blocks)", addr, nb_blocks);
+            return (VIRTIO_MEM_RESP_ERROR, 0);
+        };
+
+        let num_plugged = self.plugged[blocks.clone()].iter().filter(|&&plugged| plugged).count();
+        let size = blocks.len() as u64 * self.block_size;
+        match type_ {
+            VIRTIO_MEM_REQ_PLUG if num_plugged != 0 => (VIRTIO_MEM_RESP_ERROR, 0),
+            // More than requested.
+            VIRTIO_MEM_REQ_PLUG if self.plugged_size() + size > self.requested_size => (VIRTIO_MEM_RESP_NACK, 0),
+            VIRTIO_MEM_REQ_PLUG => {
+                self.set_plugged(blocks, true);
+                (VIRTIO_MEM_RESP_ACK, 0)
+            }
+            VIRTIO_MEM_REQ_UNPLUG if num_plugged != blocks.len() => (VIRTIO_MEM_RESP_ERROR, 0),
+            VIRTIO_MEM_REQ_UNPLUG => {
+                self.set_plugged(blocks, false);
+                (VIRTIO_MEM_RESP_ACK, 0)
+            }
+            VIRTIO_MEM_REQ_STATE => {
+                let state = match num_plugged {
+                    0 => VIRTIO_MEM_STATE_UNPLUGGED,
+                    n if n == blocks.len() => VIRTIO_MEM_STATE_PLUGGED,
+                    _ => VIRTIO_MEM_STATE_MIXED,
+                };
+                (VIRTIO_MEM_RESP_ACK, state)
+            }
+            _ => {
+                warn!("virtio-mem", "unknown request type: {}", type_);
+                (VIRTIO_MEM_RESP_ERROR, 0)
+            }
+        }
+    }
+}
+
+impl VirtioDevice for VirtioMem {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_MEM
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1 | VIRTIO_MEM_F_UNPLUGGED_INACCESSIBLE
+    }
+
+    fn num_queues(&self) -> usize {
+        1 // requestq
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_mem_config: le64 block_size, le16 node_id, u8 padding[6], le64 addr,
+        // le64 region_size, le64 usable_region_size, le64 plugged_size, le64 requested_size.
+        let value = match offset / 8 {
+            0 => self.block_size,
+            2 => HOTPLUG_MEMORY.guest_base(),
+            3 | 4 => self.region_size(),
+            5 => self.plugged_size(),
+            6 => self.requested_size,
+            _ => 0,
+        };
+        value.to_le_bytes()[offset as usize % 8]
+    }
+
+    fn save(&self, w: &mut Writer) {
+        w.u64(self.requested_size);
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        // Nothing is plugged in a snapshot.
+        self.unplug_all();
+        self.requested_size = r.u64()?;
+        Some(())
+    }
+
+    fn queue_notify(&mut self, _index: usize, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            let request = chain.read_all();
+            let (type_, state) = if request.len() >= REQUEST_SIZE {
+                self.handle_request(&request)
+            } else {
+                (VIRTIO_MEM_RESP_ERROR, 0)
+            };
+
+            let mut response = [0; RESPONSE_SIZE];
+            response[0..2].copy_from_slice(&type_.to_le_bytes());
+            response[8..10].copy_from_slice(&state.to_le_bytes());
+            let written = chain.write_all(&response);
+            queue.push_used(&chain, written as u32);
+            used = true;
+        }
+
+        used
+    }
+}
+
+static VIRTIO_MEM: Mutex<Option<VirtioMmio<VirtioMem>>> = Mutex::new(None);
+
+/// Runs `f` on the device, then flushes the TLBs if blocks have been
+/// unmapped. Not with the lock held: the other vCPUs may be waiting for it
+/// instead of handling our IPI.
+fn with_device<T>(f: impl FnOnce(&mut VirtioMmio<VirtioMem>) -> T) -> Option<T> {
+    let mut lock = VIRTIO_MEM.lock();
+    let mmio = lock.as_mut()?;
+    let result = f(mmio);
+    let needs_flush = core::mem::take(&mut mmio.device.needs_flush);
+    drop(lock);
+
+    if needs_flush {
+        smp::flush_guest_tlbs();
+    }
+    Some(result)
+}
+
+/// Allocates the region above the RAM. Plugged blocks are mapped into
+/// `table`.
+pub fn init(mem: &VirtioMemConfig, table: &GuestPageTable) {
+    HOTPLUG_MEMORY.relocate(machine::virtio_mem_base());
+    let align = if config().hugepages { MEGAPAGE_SIZE as usize } else { 0x1000 };
+    HOTPLUG_MEMORY.init(mem.size, align);
+
+    let device = VirtioMem {
+        block_size: mem.block_size as u64,
+        hgatp: table.hgatp(),
+        plugged: vec![false; mem.size / mem.block_size],
+        requested_size: 0,
+        needs_flush: false,
+    };
+    *VIRTIO_MEM.lock() = Some(virtio::attach("virtio-mem", device, mmio_read, mmio_write));
+    info!(
+        "virtio-mem",
+        "{} MB at {:#x} in {} KB blocks",
+        mem.size / 1024 / 1024,
+        HOTPLUG_MEMORY.guest_base(),
+        mem.block_size / 1024
+    );
+}
+
+/// Asks the guest to plug or unplug memory until it has `size` bytes
+/// plugged.
+pub fn set_requested_size(size: u64) -> Result<(), String> {
+    with_device(|mmio| {
+        let (block_size, region_size) = (mmio.device.block_size, mmio.device.region_size());
+        if size % block_size != 0 || size > region_size {
+            return Err(format!(
+                "the size must be a multiple of {} KB up to {} MB",
+                block_size / 1024,
+                region_size / 1024 / 1024
+            ));
+        }
+
+        mmio.device.requested_size = size;
+        mmio.notify_config();
+        Ok(())
+    })
+    .unwrap_or_else(|| Err(String::from("virtio-mem is not enabled (-virtio-mem)")))
+}
+
+/// The memory plugged by the guest in bytes.
+pub fn plugged_size() -> u64 {
+    VIRTIO_MEM.lock().as_ref().map_or(0, |mmio| mmio.device.plugged_size())
+}
+
+/// `info memory-devices` in the monitor.
+pub fn report() -> String {
+    let lock = VIRTIO_MEM.lock();
+    let Some(mmio) = lock.as_ref() else {
+        return String::from("virtio-mem is not enabled (-virtio-mem)");
+    };
+
+    let device = &mmio.device;
+    format!(
+        "virtio-mem: {:#x}-{:#x}, {} KB blocks\nplugged: {} MB (requested: {} MB)",
+        HOTPLUG_MEMORY.guest_base(),
+        HOTPLUG_MEMORY.guest_base() + device.region_size(),
+        device.block_size / 1024,
+        device.plugged_size() / 1024 / 1024,
+        device.requested_size / 1024 / 1024
+    )
+}
+
+/// `query-memory-devices` in the monitor.
+pub fn report_json() -> String {
+    let lock = VIRTIO_MEM.lock();
+    let Some(mmio) = lock.as_ref() else {
+        return String::from("[]");
+    };
+
+    let device = &mmio.device;
+    format!(
+        "[{{\"type\": \"virtio-mem\", \"data\": {{\"memaddr\": {}, \"size\": {}, \"max-size\": {}, \
+         \"block-size\": {}, \"requested-size\": {}}}}}]",
+        HOTPLUG_MEMORY.guest_base(),
+        device.plugged_size(),
+        device.region_size(),
+        device.block_size,
+        device.requested_size
+    )
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_MEM.lock().as_mut().expect("virtio-mem not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    with_device(|mmio| mmio.mmio_write(offset, value, width)).expect("virtio-mem not initialized")
+}
+
+/// Unplugs all the memory, as on a power cycle. A reset by the driver keeps
+/// it plugged: the driver unplugs it when it finds `plugged_size` isn't 0.
+pub fn reset() {
+    with_device(|mmio| {
+        mmio.reset();
+        mmio.device.unplug_all();
+    });
+}
+
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_MEM.lock().as_ref() {
+        w.section("virtio-mem", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    with_device(|mmio| snapshot::load_section(sections, "virtio-mem", mmio)).unwrap_or(Ok(()))
+}
@@ -0,0 +1,367 @@
+use alloc::{boxed::Box, collections::VecDeque, string::String, vec, vec::Vec};
+use core::sync::atomic::{AtomicBool, Ordering};
+use spin::Mutex;
+
+use crate::{
+    config::{NetBackendKind, NetConfig},
+    fault_inject::{self, Fault},
+    host_net::{self, VIRTIO_NET_HDR_LEN},
+    identity, metrics, pcap,
+    snapshot::{self, Reader, Section, Writer},
+    throttle::{Limits, Throttle},
+    timer::{self, NO_DEADLINE},
+    virtio::{self, DescChain, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_NET: u32 = 1;
+pub const VIRTIO_NET_F_MAC: u64 = 1 << 5;
+pub const VIRTIO_NET_F_CTRL_VQ: u64 = 1 << 17;
+pub const VIRTIO_NET_F_MQ: u64 = 1 << 22;
+
+/// `max_virtqueue_pairs` in `struct virtio_net_config`.
+const CONFIG_MAX_VIRTQUEUE_PAIRS: u64 = 8;
+
+const VIRTIO_NET_CTRL_MQ: u8 = 4;
+const VIRTIO_NET_CTRL_MQ_VQ_PAIRS_SET: u8 = 0;
+const VIRTIO_NET_OK: u8 = 0;
+const VIRTIO_NET_ERR: u8 = 1;
+
+const ETHERTYPE_IPV4: [u8; 2] = [0x08, 0x00];
+const IPPROTO_TCP: u8 = 6;
+const IPPROTO_UDP: u8 = 17;
+
+/// Queue 2N receives and 2N + 1 transmits for the pair N.
+fn rx_queue(pair: usize) -> usize {
+    2 * pair
+}
+
+/// Where packets from the guest go.
+pub trait NetBackend: Send {
+    fn send(&mut self, frame: &[u8]);
+}
+
+/// Forwards packets to the NIC provided by QEMU.
+struct HostBackend;
+
+impl NetBackend for HostBackend {
+    fn send(&mut self, frame: &[u8]) {
+        host_net::send(frame);
+    }
+}
+
+/// With `-net ...,queues=<n>`, the driver can use a receive/transmit pair
+/// per vCPU (VIRTIO_NET_F_MQ), all to the same backend. The control queue
+/// sets the number of pairs in use.
+pub struct VirtioNet {
+    mac: [u8; 6],
+    backend: Box<dyn NetBackend>,
+    max_pairs: usize,
+    /// Whether the driver has negotiated VIRTIO_NET_F_MQ.
+    mq: bool,
+    /// The number of pairs in use.
+    curr_pairs: usize,
+    /// `-net ...,pps=<n>,bps=<n>`, for each direction.
+    tx_throttle: Throttle,
+    rx_throttle: Throttle,
+    /// Packets to transmit over the throttle limits: (queue, chain).
+    held: VecDeque<(usize, DescChain)>,
+}
+
+/// Whether the device holds packets over the throttle limits: `poll` sends
+/// them once the limits allow.
+static HELD: AtomicBool = AtomicBool::new(false);
+
+/// The length of the packet in a transmit chain, for the throttle.
+fn packet_len(chain: &DescChain) -> u64 {
+    let total: u64 = chain.buffers.iter().map(|buf| buf.len as u64).sum();
+    total.saturating_sub(VIRTIO_NET_HDR_LEN as u64)
+}
+
+/// Spreads flows over the receive queues: a hash of the IPv4 addresses and
+/// the TCP/UDP ports, so that a flow stays on a queue (and a vCPU).
+fn flow_hash(frame: &[u8]) -> Option<u32> {
+    if frame.get(12..14)? != ETHERTYPE_IPV4 {
+        return None;
+    }
+
+    let header_len = (*frame.get(14)? as usize & 0xf) * 4;
+    let protocol = *frame.get(23)?;
+    let addrs = frame.get(26..34)?;
+    let ports = match protocol {
+        IPPROTO_TCP | IPPROTO_UDP => frame.get(14 + header_len..14 + header_len + 4)?,
+        _ => &[],
+    };
+
+    // FNV-1a.
+    Some(addrs.iter().chain(ports).fold(0x811c_9dc5u32, |hash, &byte| (hash ^ byte as u32).wrapping_mul(0x0100_0193)))
+}
+
+impl VirtioNet {
+    fn ctrl_queue(&self) -> usize {
+        if self.mq { 2 * self.max_pairs } else { 2 }
+    }
+
+    /// Handles commands in the control queue: only setting the number of
+    /// pairs.
+    fn handle_ctrl(&mut self, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            // struct virtio_net_ctrl_hdr: u8 class, u8 command, then the
+            // data. The ack is in the device-writable buffer.
+            let ack = match chain.read_all().as_slice() {
+                [VIRTIO_NET_CTRL_MQ, VIRTIO_NET_CTRL_MQ_VQ_PAIRS_SET, low, high, ..] => {
+                    let pairs = u16::from_le_bytes([*low, *high]) as usize;
+                    if self.mq && (1..=self.max_pairs).contains(&pairs) {
+                        debug!("virtio-net", "using {} queue pairs", pairs);
+                        self.curr_pairs = pairs;
+                        VIRTIO_NET_OK
+                    } else {
+                        VIRTIO_NET_ERR
+                    }
+                }
+                _ => VIRTIO_NET_ERR,
+            };
+
+            let written = chain.write_all(&[ack]);
+            queue.push_used(&chain, written as u32);
+            used = true;
+        }
+
+        used
+    }
+
+    fn transmit(&mut self, chain: &DescChain, queue: &mut Virtqueue) {
+        let mut packet = chain.read_all();
+        if packet.len() > VIRTIO_NET_HDR_LEN && !fault_inject::inject(Fault::NetDrop) {
+            fault_inject::corrupt(&mut packet[VIRTIO_NET_HDR_LEN..]);
+            metrics::record_net_io(true, (packet.len() - VIRTIO_NET_HDR_LEN) as u64);
+            pcap::record(&packet[VIRTIO_NET_HDR_LEN..]);
+            self.backend.send(&packet[VIRTIO_NET_HDR_LEN..]);
+        }
+
+        queue.push_used(chain, 0);
+    }
+
+    /// Sends the held packets as long as the throttle limits allow, or all
+    /// of them with `force`.
+    fn release_held(&mut self, queues: &mut [Virtqueue], force: bool) -> bool {
+        let mut used = false;
+        while let Some((_, chain)) = self.held.front() {
+            if !force && !self.tx_throttle.admit(packet_len(chain)) {
+                break;
+            }
+
+            let (index, chain) = self.held.pop_front().unwrap();
+            self.transmit(&chain, &mut queues[index]);
+            used = true;
+        }
+        used
+    }
+}
+
+impl VirtioDevice for VirtioNet {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_NET
+    }
+
+    fn device_features(&self) -> u64 {
+        let mq = if self.max_pairs > 1 { VIRTIO_NET_F_CTRL_VQ | VIRTIO_NET_F_MQ } else { 0 };
+        VIRTIO_F_VERSION_1 | VIRTIO_NET_F_MAC | mq
+    }
+
+    fn num_queues(&self) -> usize {
+        // And the control queue.
+        if self.max_pairs > 1 { 2 * self.max_pairs + 1 } else { 2 }
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_net_config: mac[6], le16 status, le16 max_virtqueue_pairs, ...
+        match offset {
+            0..6 => self.mac[offset as usize],
+            CONFIG_MAX_VIRTQUEUE_PAIRS..10 => {
+                (self.max_pairs as u16).to_le_bytes()[(offset - CONFIG_MAX_VIRTQUEUE_PAIRS) as usize]
+            }
+            _ => 0,
+        }
+    }
+
+    fn reset(&mut self) {
+        self.mq = false;
+        self.curr_pairs = 1;
+        self.held.clear();
+    }
+
+    fn set_driver_features(&mut self, features: u64) {
+        self.mq = features & VIRTIO_NET_F_MQ != 0;
+    }
+
+    fn save(&self, w: &mut Writer) {
+        w.u32(self.curr_pairs as u32);
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        self.curr_pairs = (r.u32()? as usize).clamp(1, self.max_pairs);
+        Some(())
+    }
+
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        if self.max_pairs > 1 && index == self.ctrl_queue() {
+            return self.handle_ctrl(queue);
+        }
+
+        if index % 2 == 0 {
+            // New receive buffers are available. Nothing to do.
+            return false;
+        }
+
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            // Over the limits (see throttle.rs), or behind a packet which is.
+            if !self.held.is_empty() || !self.tx_throttle.admit(packet_len(&chain)) {
+                self.held.push_back((index, chain));
+                continue;
+            }
+
+            self.transmit(&chain, queue);
+            used = true;
+        }
+
+        if !self.held.is_empty() && !HELD.swap(true, Ordering::Relaxed) {
+            timer::kick();
+        }
+
+        used
+    }
+}
+
+static VIRTIO_NET: Mutex<Option<VirtioMmio<VirtioNet>>> = Mutex::new(None);
+
+pub fn init(config: &NetConfig) {
+    let backend = match config.backend {
+        NetBackendKind::Host => Box::new(HostBackend),
+    };
+
+    let device = VirtioNet {
+        mac: config.mac.unwrap_or_else(identity::mac),
+        backend,
+        max_pairs: config.queues,
+        mq: false,
+        curr_pairs: 1,
+        tx_throttle: Throttle::new(config.throttle),
+        rx_throttle: Throttle::new(config.throttle),
+        held: VecDeque::new(),
+    };
+    *VIRTIO_NET.lock() = Some(virtio::attach("virtio-net", device, mmio_read, mmio_write));
+}
+
+/// Delivers a packet from the backend to the guest.
+pub fn receive(frame: &[u8]) {
+    let mut lock = VIRTIO_NET.lock();
+    let Some(mmio) = lock.as_mut() else {
+        return;
+    };
+
+    let pair = match mmio.device.curr_pairs {
+        1 => 0,
+        pairs => flow_hash(frame).map_or(0, |hash| hash as usize % pairs),
+    };
+
+    // Over the limits: drop the packet.
+    if !mmio.device.rx_throttle.admit(frame.len() as u64) || fault_inject::inject(Fault::NetDrop) {
+        return;
+    }
+
+    let Some(chain) = mmio.queues[rx_queue(pair)].pop() else {
+        // No receive buffers. Drop the packet.
+        return;
+    };
+
+    let mut packet: Vec<u8> = vec![0; VIRTIO_NET_HDR_LEN];
+    packet[10..12].copy_from_slice(&1u16.to_le_bytes()); // num_buffers
+    packet.extend_from_slice(frame);
+    fault_inject::corrupt(&mut packet[VIRTIO_NET_HDR_LEN..]);
+
+    let written = chain.write_all(&packet);
+    metrics::record_net_io(false, frame.len() as u64);
+    pcap::record(&packet[VIRTIO_NET_HDR_LEN..]);
+    mmio.queues[rx_queue(pair)].push_used(&chain, written as u32);
+    mmio.notify_used_batched();
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_NET.lock().as_mut().expect("virtio-net not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    VIRTIO_NET.lock().as_mut().expect("virtio-net not initialized").mmio_write(offset, value, width)
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_NET.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+/// When the held interrupt (see `-irq-coalesce`) or the held packets are
+/// due.
+pub fn deadline() -> u64 {
+    if !virtio::holds_interrupts() && !HELD.load(Ordering::Relaxed) {
+        return NO_DEADLINE;
+    }
+
+    VIRTIO_NET.lock().as_ref().map_or(NO_DEADLINE, |mmio| {
+        let held = if mmio.device.held.is_empty() { NO_DEADLINE } else { mmio.device.tx_throttle.ready_at() };
+        mmio.deadline().min(held)
+    })
+}
+
+pub fn poll() {
+    if !virtio::holds_interrupts() && !HELD.load(Ordering::Relaxed) {
+        return;
+    }
+
+    if let Some(mmio) = VIRTIO_NET.lock().as_mut() {
+        if mmio.device.release_held(&mut mmio.queues, false) {
+            mmio.notify_used_batched();
+        }
+
+        HELD.store(!mmio.device.held.is_empty(), Ordering::Relaxed);
+        mmio.poll();
+    }
+}
+
+/// The throttle limits, and the number of held packets.
+pub fn throttle() -> Option<(Limits, usize)> {
+    VIRTIO_NET.lock().as_ref().map(|mmio| (mmio.device.tx_throttle.limits(), mmio.device.held.len()))
+}
+
+/// Changes the throttle limits at runtime.
+pub fn set_throttle(limits: Limits) -> Result<(), String> {
+    let mut lock = VIRTIO_NET.lock();
+    let mmio = lock.as_mut().ok_or("virtio-net is not enabled (-net)")?;
+    mmio.device.tx_throttle.set_limits(limits);
+    mmio.device.rx_throttle.set_limits(limits);
+    if !mmio.device.held.is_empty() {
+        // Send the held packets now if the limits allow.
+        timer::kick();
+    }
+    Ok(())
+}
+
+/// Held packets are sent first: they are not saved.
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_NET.lock().as_mut() {
+        if mmio.device.release_held(&mut mmio.queues, true) {
+            mmio.notify_used();
+        }
+
+        w.section("virtio-net", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    match VIRTIO_NET.lock().as_mut() {
+        Some(mmio) => snapshot::load_section(sections, "virtio-net", mmio),
+        None => Ok(()),
+    }
+}
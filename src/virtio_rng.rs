@@ -0,0 +1,133 @@
+//! virtio-rng: gives the guest entropy from the virtio-rng device provided
+//! by QEMU, which reads the host's random source, or from a seeded PRNG
+//! with `-deterministic` (see deterministic.rs).
+use alloc::{string::String, vec, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    config::{RngBackendKind, RngConfig},
+    deterministic::{self, Prng},
+    host_rng::{BUFFER_SIZE, HostRng},
+    snapshot::{self, Reader, Section, Writer},
+    virtio::{self, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_RNG: u32 = 4;
+
+enum Source {
+    Host(HostRng),
+    Seeded(Prng),
+}
+
+pub struct VirtioRng {
+    source: Source,
+}
+
+impl VirtioRng {
+    fn read(&mut self, len: usize) -> Vec<u8> {
+        let host = match &mut self.source {
+            Source::Host(host) => host,
+            Source::Seeded(prng) => {
+                let mut data = vec![0; len];
+                prng.fill(&mut data);
+                return data;
+            }
+        };
+
+        let mut data = Vec::with_capacity(len);
+        while data.len() < len {
+            let chunk = host.read((len - data.len()).min(BUFFER_SIZE));
+            if chunk.is_empty() {
+                break;
+            }
+
+            data.extend_from_slice(chunk);
+        }
+        data
+    }
+}
+
+impl VirtioDevice for VirtioRng {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_RNG
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1
+    }
+
+    fn num_queues(&self) -> usize {
+        1
+    }
+
+    fn read_config(&self, _offset: u64) -> u8 {
+        0 // No configuration space.
+    }
+
+    fn save(&self, w: &mut Writer) {
+        // Continues the same sequence after a restore.
+        if let Source::Seeded(prng) = &self.source {
+            prng.save(w);
+        }
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        match &mut self.source {
+            Source::Seeded(prng) => prng.load(r),
+            Source::Host(_) => Some(()),
+        }
+    }
+
+    fn queue_notify(&mut self, _index: usize, queue: &mut Virtqueue) -> bool {
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            let len: usize = chain.buffers.iter().filter(|b| b.device_writable).map(|b| b.len as usize).sum();
+            let data = self.read(len);
+            let written = chain.write_all(&data);
+            queue.push_used(&chain, written as u32);
+            used = true;
+        }
+
+        used
+    }
+}
+
+static VIRTIO_RNG: Mutex<Option<VirtioMmio<VirtioRng>>> = Mutex::new(None);
+
+pub fn init(config: &RngConfig) {
+    let source = match (deterministic::prng("virtio-rng"), &config.backend) {
+        (Some(prng), _) => Source::Seeded(prng),
+        (None, RngBackendKind::Host) => {
+            Source::Host(HostRng::open().expect("[virtio-rng] host virtio-rng device not found"))
+        }
+    };
+
+    *VIRTIO_RNG.lock() = Some(virtio::attach("virtio-rng", VirtioRng { source }, mmio_read, mmio_write));
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_RNG.lock().as_mut().expect("virtio-rng not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    VIRTIO_RNG.lock().as_mut().expect("virtio-rng not initialized").mmio_write(offset, value, width)
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_RNG.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_RNG.lock().as_ref() {
+        w.section("virtio-rng", mmio);
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    match VIRTIO_RNG.lock().as_mut() {
+        Some(mmio) => snapshot::load_section(sections, "virtio-rng", mmio),
+        None => Ok(()),
+    }
+}
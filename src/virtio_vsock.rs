@@ -0,0 +1,427 @@
+//! virtio-vsock: AF_VSOCK stream sockets between the guest and host programs
+//! without any networking (`-vsock <guest-cid>[,<port>:<console-port>...]`).
+//!
+//! We don't have a host socket layer: each vsock port is bridged to a port
+//! of the host virtio console, which QEMU connects to a UNIX socket. With
+//! `-vsock 3,1234:vsock` (see run.sh):
+//!
+//! - The guest connecting to CID 2 (the host) port 1234 talks to the program
+//!   connected to vsock.sock.
+//! - A program connecting to vsock.sock connects to port 1234 in the guest.
+//!
+//! One connection per port at a time.
+use alloc::{collections::VecDeque, string::String, vec::Vec};
+use spin::Mutex;
+
+use crate::{
+    config::VsockConfig,
+    host_console,
+    snapshot::{self, Section, Writer},
+    virtio::{self, VIRTIO_F_VERSION_1, VirtioDevice, VirtioMmio, Virtqueue},
+};
+
+const VIRTIO_DEVICE_VSOCK: u32 = 19;
+const RX_QUEUE: usize = 0;
+const TX_QUEUE: usize = 1;
+const EVENT_QUEUE: usize = 2;
+
+const VMADDR_CID_HOST: u64 = 2;
+
+const VIRTIO_VSOCK_TYPE_STREAM: u16 = 1;
+const VIRTIO_VSOCK_OP_REQUEST: u16 = 1;
+const VIRTIO_VSOCK_OP_RESPONSE: u16 = 2;
+const VIRTIO_VSOCK_OP_RST: u16 = 3;
+const VIRTIO_VSOCK_OP_SHUTDOWN: u16 = 4;
+const VIRTIO_VSOCK_OP_RW: u16 = 5;
+const VIRTIO_VSOCK_OP_CREDIT_UPDATE: u16 = 6;
+const VIRTIO_VSOCK_OP_CREDIT_REQUEST: u16 = 7;
+const VIRTIO_VSOCK_EVENT_TRANSPORT_RESET: u32 = 0;
+
+/// struct virtio_vsock_hdr.
+const HDR_LEN: usize = 44;
+/// Our receive buffer size to the guest. Data is written to the host
+/// console as soon as it arrives, so we always have room.
+const BUF_ALLOC: u32 = 256 * 1024;
+/// The maximum payload in a packet to the guest.
+const MAX_PAYLOAD: usize = 4096;
+
+#[derive(Clone, Copy)]
+struct Header {
+    src_cid: u64,
+    dst_cid: u64,
+    src_port: u32,
+    dst_port: u32,
+    len: u32,
+    type_: u16,
+    op: u16,
+    buf_alloc: u32,
+    fwd_cnt: u32,
+}
+
+impl Header {
+    fn parse(data: &[u8]) -> Option<Header> {
+        let u64_at = |offset: usize| u64::from_le_bytes(data[offset..offset + 8].try_into().unwrap());
+        let u32_at = |offset: usize| u32::from_le_bytes(data[offset..offset + 4].try_into().unwrap());
+        let u16_at = |offset: usize| u16::from_le_bytes(data[offset..offset + 2].try_into().unwrap());
+        if data.len() < HDR_LEN {
+            return None;
+        }
+
+        Some(Header {
+            src_cid: u64_at(0),
+            dst_cid: u64_at(8),
+            src_port: u32_at(16),
+            dst_port: u32_at(20),
+            len: u32_at(24),
+            type_: u16_at(28),
+            op: u16_at(30),
+            buf_alloc: u32_at(36),
+            fwd_cnt: u32_at(40),
+        })
+    }
+}
+
+#[derive(Clone, Copy, PartialEq)]
+enum State {
+    /// We've sent a request to the guest.
+    Connecting,
+    Established,
+}
+
+struct Connection {
+    state: State,
+    guest_port: u32,
+    /// Bytes we've sent to the guest.
+    tx_cnt: u32,
+    /// Bytes we've received from the guest and passed to the host.
+    fwd_cnt: u32,
+    /// The guest's receive buffer and how much of it it has consumed.
+    peer_buf_alloc: u32,
+    peer_fwd_cnt: u32,
+}
+
+impl Connection {
+    /// How many bytes the guest can receive now.
+    fn credit(&self) -> usize {
+        self.peer_buf_alloc.saturating_sub(self.tx_cnt.wrapping_sub(self.peer_fwd_cnt)) as usize
+    }
+}
+
+struct Port {
+    /// The vsock port number, both in the guest and on the host.
+    port: u32,
+    /// The host virtio console port.
+    console: String,
+    /// Whether a program is connected to the host console port.
+    host_connected: bool,
+    conn: Option<Connection>,
+}
+
+pub struct VirtioVsock {
+    guest_cid: u64,
+    ports: Vec<Port>,
+    /// Packets waiting for receive buffers.
+    packets: VecDeque<Vec<u8>>,
+    /// A transport reset event to send (after restoring a snapshot).
+    reset_event: bool,
+}
+
+impl VirtioVsock {
+    /// Queues a packet from the host to the guest.
+    fn send(&mut self, port: usize, op: u16, payload: &[u8]) {
+        let guest_cid = self.guest_cid;
+        let port = &mut self.ports[port];
+        let Some(conn) = port.conn.as_mut() else {
+            return;
+        };
+
+        let mut packet = Vec::with_capacity(HDR_LEN + payload.len());
+        packet.extend_from_slice(&VMADDR_CID_HOST.to_le_bytes());
+        packet.extend_from_slice(&guest_cid.to_le_bytes());
+        packet.extend_from_slice(&port.port.to_le_bytes());
+        packet.extend_from_slice(&conn.guest_port.to_le_bytes());
+        packet.extend_from_slice(&(payload.len() as u32).to_le_bytes());
+        packet.extend_from_slice(&VIRTIO_VSOCK_TYPE_STREAM.to_le_bytes());
+        packet.extend_from_slice(&op.to_le_bytes());
+        packet.extend_from_slice(&0u32.to_le_bytes()); // flags
+        packet.extend_from_slice(&BUF_ALLOC.to_le_bytes());
+        packet.extend_from_slice(&conn.fwd_cnt.to_le_bytes());
+        packet.extend_from_slice(payload);
+        conn.tx_cnt = conn.tx_cnt.wrapping_add(payload.len() as u32);
+        self.packets.push_back(packet);
+    }
+
+    /// Replies a reset to a packet which doesn't belong to any connection.
+    fn send_rst(&mut self, hdr: &Header) {
+        let mut packet = Vec::with_capacity(HDR_LEN);
+        packet.extend_from_slice(&hdr.dst_cid.to_le_bytes());
+        packet.extend_from_slice(&hdr.src_cid.to_le_bytes());
+        packet.extend_from_slice(&hdr.dst_port.to_le_bytes());
+        packet.extend_from_slice(&hdr.src_port.to_le_bytes());
+        packet.extend_from_slice(&0u32.to_le_bytes()); // len
+        packet.extend_from_slice(&VIRTIO_VSOCK_TYPE_STREAM.to_le_bytes());
+        packet.extend_from_slice(&VIRTIO_VSOCK_OP_RST.to_le_bytes());
+        packet.extend_from_slice(&[0; 12]); // flags, buf_alloc, fwd_cnt
+        self.packets.push_back(packet);
+    }
+
+    fn close(&mut self, port: usize, op: u16) {
+        self.send(port, op, &[]);
+        self.ports[port].conn = None;
+    }
+
+    fn handle_packet(&mut self, packet: &[u8]) {
+        let Some(hdr) = Header::parse(packet) else {
+            warn!("virtio-vsock", "too short packet");
+            return;
+        };
+
+        let index = self.ports.iter().position(|port| port.port == hdr.dst_port);
+        let index = match index {
+            _ if hdr.dst_cid != VMADDR_CID_HOST || hdr.type_ != VIRTIO_VSOCK_TYPE_STREAM => None,
+            // A new connection from the guest.
+            Some(index) if hdr.op == VIRTIO_VSOCK_OP_REQUEST && self.ports[index].conn.is_none() => {
+                self.ports[index].conn = Some(Connection {
+                    state: State::Established,
+                    guest_port: hdr.src_port,
+                    tx_cnt: 0,
+                    fwd_cnt: 0,
+                    peer_buf_alloc: hdr.buf_alloc,
+                    peer_fwd_cnt: hdr.fwd_cnt,
+                });
+                self.send(index, VIRTIO_VSOCK_OP_RESPONSE, &[]);
+                info!("virtio-vsock", "guest connected to port {}", hdr.dst_port);
+                return;
+            }
+            Some(index) if self.ports[index].conn.as_ref().is_some_and(|conn| conn.guest_port == hdr.src_port) => {
+                Some(index)
+            }
+            _ => None,
+        };
+
+        let Some(index) = index else {
+            if hdr.op != VIRTIO_VSOCK_OP_RST {
+                self.send_rst(&hdr);
+            }
+            return;
+        };
+
+        let port = &mut self.ports[index];
+        let conn = port.conn.as_mut().unwrap();
+        conn.peer_buf_alloc = hdr.buf_alloc;
+        conn.peer_fwd_cnt = hdr.fwd_cnt;
+        match hdr.op {
+            VIRTIO_VSOCK_OP_RESPONSE if conn.state == State::Connecting => {
+                conn.state = State::Established;
+                info!("virtio-vsock", "connected to guest port {}", port.port);
+            }
+            VIRTIO_VSOCK_OP_RW if conn.state == State::Established => {
+                let payload = &packet[HDR_LEN..];
+                let payload = &payload[..payload.len().min(hdr.len as usize)];
+                host_console::write(&port.console, payload);
+                conn.fwd_cnt = conn.fwd_cnt.wrapping_add(payload.len() as u32);
+                // Let the guest send more.
+                self.send(index, VIRTIO_VSOCK_OP_CREDIT_UPDATE, &[]);
+            }
+            VIRTIO_VSOCK_OP_CREDIT_REQUEST => self.send(index, VIRTIO_VSOCK_OP_CREDIT_UPDATE, &[]),
+            VIRTIO_VSOCK_OP_CREDIT_UPDATE => {}
+            VIRTIO_VSOCK_OP_SHUTDOWN => {
+                info!("virtio-vsock", "guest closed port {}", port.port);
+                self.close(index, VIRTIO_VSOCK_OP_RST);
+            }
+            VIRTIO_VSOCK_OP_RST => {
+                info!("virtio-vsock", "guest reset port {}", port.port);
+                port.conn = None;
+            }
+            _ => self.close(index, VIRTIO_VSOCK_OP_RST),
+        }
+    }
+
+    /// Connects to the guest when a host program connects, and forwards its
+    /// data as long as the guest has room.
+    fn poll_host(&mut self) {
+        for index in 0..self.ports.len() {
+            let port = &mut self.ports[index];
+            let connected = host_console::is_connected(&port.console);
+            let was_connected = port.host_connected;
+            port.host_connected = connected;
+            if connected && !was_connected && port.conn.is_none() {
+                port.conn = Some(Connection {
+                    state: State::Connecting,
+                    guest_port: port.port,
+                    tx_cnt: 0,
+                    fwd_cnt: 0,
+                    peer_buf_alloc: 0,
+                    peer_fwd_cnt: 0,
+                });
+                self.send(index, VIRTIO_VSOCK_OP_REQUEST, &[]);
+                continue;
+            }
+
+            if !connected && was_connected && port.conn.is_some() {
+                self.close(index, VIRTIO_VSOCK_OP_SHUTDOWN);
+                continue;
+            }
+
+            let Some(conn) = port.conn.as_ref().filter(|conn| conn.state == State::Established) else {
+                continue;
+            };
+
+            let mut data = Vec::new();
+            let limit = conn.credit().min(MAX_PAYLOAD);
+            while data.len() < limit {
+                let Some(byte) = host_console::read(&port.console) else {
+                    break;
+                };
+                data.push(byte);
+            }
+
+            if !data.is_empty() {
+                self.send(index, VIRTIO_VSOCK_OP_RW, &data);
+            }
+        }
+    }
+}
+
+impl VirtioDevice for VirtioVsock {
+    fn device_id(&self) -> u32 {
+        VIRTIO_DEVICE_VSOCK
+    }
+
+    fn device_features(&self) -> u64 {
+        VIRTIO_F_VERSION_1
+    }
+
+    fn num_queues(&self) -> usize {
+        3
+    }
+
+    fn read_config(&self, offset: u64) -> u8 {
+        // struct virtio_vsock_config: le64 guest_cid.
+        match offset {
+            0..8 => self.guest_cid.to_le_bytes()[offset as usize],
+            _ => 0,
+        }
+    }
+
+    fn reset(&mut self) {
+        self.packets.clear();
+        self.reset_event = false;
+        for port in &mut self.ports {
+            port.conn = None;
+        }
+    }
+
+    fn queue_notify(&mut self, index: usize, queue: &mut Virtqueue) -> bool {
+        if index != TX_QUEUE {
+            // New receive or event buffers are available.
+            return false;
+        }
+
+        let mut used = false;
+        while let Some(chain) = queue.pop() {
+            self.handle_packet(&chain.read_all());
+            queue.push_used(&chain, 0);
+            used = true;
+        }
+
+        used
+    }
+}
+
+static VIRTIO_VSOCK: Mutex<Option<VirtioMmio<VirtioVsock>>> = Mutex::new(None);
+
+/// Sends pending packets and events to the guest.
+fn flush(mmio: &mut VirtioMmio<VirtioVsock>) {
+    let mut used = false;
+    if mmio.device.reset_event {
+        if let Some(chain) = mmio.queues[EVENT_QUEUE].pop() {
+            let written = chain.write_all(&VIRTIO_VSOCK_EVENT_TRANSPORT_RESET.to_le_bytes());
+            mmio.queues[EVENT_QUEUE].push_used(&chain, written as u32);
+            mmio.device.reset_event = false;
+            used = true;
+        }
+    }
+
+    mmio.device.poll_host();
+    loop {
+        let Some(packet) = mmio.device.packets.front() else {
+            break;
+        };
+
+        let Some(chain) = mmio.queues[RX_QUEUE].pop() else {
+            // No receive buffers. Try again when the driver adds ones.
+            break;
+        };
+
+        let written = chain.write_all(packet);
+        mmio.queues[RX_QUEUE].push_used(&chain, written as u32);
+        mmio.device.packets.pop_front();
+        used = true;
+    }
+
+    if used {
+        mmio.notify_used();
+    }
+}
+
+pub fn init(config: &VsockConfig) {
+    for (_, console) in &config.ports {
+        assert!(host_console::has_port(console), "-vsock: virtio-console port \"{}\" not found", console);
+    }
+
+    let ports = config
+        .ports
+        .iter()
+        .map(|(port, console)| Port { port: *port, console: console.clone(), host_connected: false, conn: None })
+        .collect();
+
+    let device = VirtioVsock { guest_cid: config.guest_cid, ports, packets: VecDeque::new(), reset_event: false };
+    *VIRTIO_VSOCK.lock() = Some(virtio::attach("virtio-vsock", device, mmio_read, mmio_write));
+}
+
+pub fn mmio_read(offset: u64, width: u64) -> u64 {
+    VIRTIO_VSOCK.lock().as_mut().expect("virtio-vsock not initialized").mmio_read(offset, width)
+}
+
+pub fn mmio_write(offset: u64, value: u64, width: u64) {
+    let mut lock = VIRTIO_VSOCK.lock();
+    let mmio = lock.as_mut().expect("virtio-vsock not initialized");
+    mmio.mmio_write(offset, value, width);
+    if mmio.is_in_use() {
+        flush(mmio);
+    }
+}
+
+/// Handles data and connections from host programs.
+pub fn handle_interrupt() {
+    if let Some(mmio) = VIRTIO_VSOCK.lock().as_mut().filter(|mmio| mmio.is_in_use()) {
+        flush(mmio);
+    }
+}
+
+pub fn reset() {
+    if let Some(mmio) = VIRTIO_VSOCK.lock().as_mut() {
+        mmio.reset();
+    }
+}
+
+pub fn save(w: &mut Writer) {
+    if let Some(mmio) = VIRTIO_VSOCK.lock().as_ref() {
+        w.section("virtio-vsock", mmio);
+    }
+}
+
+/// Connections are not saved: the guest drops them on a transport reset.
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    let mut lock = VIRTIO_VSOCK.lock();
+    let Some(mmio) = lock.as_mut() else {
+        return Ok(());
+    };
+
+    snapshot::load_section(sections, "virtio-vsock", mmio)?;
+    mmio.device.reset();
+    mmio.device.reset_event = true;
+    flush(mmio);
+    Ok(())
+}
@@ -0,0 +1,91 @@
+//! Pausing the whole VM at a safe point, for `stop` and `cont` in the
+//! monitor:
+//!
+//! - the other vCPUs are parked at a VM exit (see smp::pause_others),
+//! - the disk requests in flight are completed, so that the host disk
+//!   doesn't write to the guest memory while it's paused,
+//! - the guest time stops: it continues from where it was on resume, so
+//!   that the guest's timers don't all expire at once and its watchdogs
+//!   don't see a stall.
+//!
+//! The guest's wall clock falls behind by the pause: NTP or the RTC fixes
+//! it. The RTC and our watchdog count in host time.
+use spin::Mutex;
+
+use crate::{smp, timer::{self, TIMEBASE_FREQ}, vcpu::VCpu, virtio_blk};
+
+
+struct State {
+    /// When the VM was paused, in host time. None if running.
+    paused_at: Option<u64>,
+    /// The guest time to continue from. None while it runs, e.g. while
+    /// single-stepping a paused VM.
+    frozen_guest_time: Option<u64>,
+    /// The sum of the pauses so far, in ticks.
+    total_paused: u64,
+}
+
+static STATE: Mutex<State> = Mutex::new(State { paused_at: None, frozen_guest_time: None, total_paused: 0 });
+
+/// Pauses the VM. `vcpu` is the current one, at a VM exit: it stays here
+/// until `resume`.
+pub fn pause(vcpu: &mut VCpu) {
+    let mut state = STATE.lock();
+    if state.paused_at.is_some() {
+        return;
+    }
+
+    smp::pause_others(vcpu);
+    virtio_blk::drain();
+    state.paused_at = Some(timer::now());
+    state.frozen_guest_time = Some(timer::guest_now());
+}
+
+/// Resumes the VM paused by `pause`. Returns how long it has been paused,
+/// in ticks.
+pub fn resume(vcpu: &VCpu) -> u64 {
+    let mut state = STATE.lock();
+    let Some(paused_at) = state.paused_at.take() else {
+        return 0;
+    };
+
+    if let Some(guest_time) = state.frozen_guest_time.take() {
+        timer::set_guest_time(guest_time);
+    }
+
+    let duration = timer::now() - paused_at;
+    state.total_paused += duration;
+    drop(state);
+
+    info!("vm", "resumed after {} ms", duration / (TIMEBASE_FREQ / 1000));
+    smp::resume_others();
+    // The others do it when they leave the pause.
+    timer::rearm(vcpu);
+    duration
+}
+
+/// Lets the guest time run while the VM is paused, e.g. for a single step
+/// on this vCPU. `freeze_time` stops it again.
+pub fn thaw_time() {
+    if let Some(guest_time) = STATE.lock().frozen_guest_time.take() {
+        timer::set_guest_time(guest_time);
+    }
+}
+
+pub fn freeze_time() {
+    let mut state = STATE.lock();
+    if state.paused_at.is_some() && state.frozen_guest_time.is_none() {
+        state.frozen_guest_time = Some(timer::guest_now());
+    }
+}
+
+/// How long the VM has been paused, in ticks. None if it's running.
+pub fn paused_for() -> Option<u64> {
+    STATE.lock().paused_at.map(|paused_at| timer::now() - paused_at)
+}
+
+/// The total time the VM has been paused, in ticks.
+pub fn total_paused() -> u64 {
+    let state = STATE.lock();
+    state.total_paused + state.paused_at.map_or(0, |paused_at| timer::now() - paused_at)
+}
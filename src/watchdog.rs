@@ -0,0 +1,192 @@
+//! `-watchdog`: a Synopsys DesignWare APB watchdog (`snps,dw-wdt`, Linux's
+//! CONFIG_DW_WATCHDOG). Once the driver enables it, it must restart the
+//! counter before it reaches zero, or we take `-watchdog-action`.
+//!
+//! No interrupt mode: it expires at the first timeout. The host timer is
+//! programmed for the expiry too (see timer::rearm), so a guest spinning
+//! with interrupts disabled is caught as well.
+use alloc::{format, string::String};
+use spin::Mutex;
+
+use crate::{
+    config::{WatchdogAction, config},
+    crash, host_test,
+    machine,
+    mmio_bus, monitor,
+    snapshot::{self, Reader, Section, Snapshot, Writer},
+    smp,
+    timer::{self, NO_DEADLINE, TIMEBASE_FREQ},
+    vcpu::VCpu,
+};
+
+/// The watchdog clock in the device tree (`clock-frequency`): timeouts from
+/// 65 ms (2^16 cycles) to 35 minutes (2^31 cycles).
+pub const CLOCK_FREQ: u64 = 1_000_000;
+
+const WDT_CR: u64 = 0x00;
+const WDT_TORR: u64 = 0x04;
+const WDT_CCVR: u64 = 0x08;
+const WDT_CRR: u64 = 0x0c;
+const WDT_COMP_PARAMS_1: u64 = 0xf4;
+const WDT_COMP_VERSION: u64 = 0xf8;
+const WDT_COMP_TYPE: u64 = 0xfc;
+
+const WDT_CR_EN: u32 = 1 << 0;
+/// The value to write to WDT_CRR to restart the counter.
+const WDT_CRR_RESTART: u64 = 0x76;
+/// Timeouts are the fixed 2^(16 + i) cycles.
+const COMP_PARAMS_1_USE_FIX_TOP: u32 = 1 << 6;
+
+struct Watchdog {
+    cr: u32,
+    torr: u32,
+    /// When the counter reaches zero. NO_DEADLINE if disabled or expired.
+    deadline: u64,
+}
+
+static WATCHDOG: Mutex<Watchdog> = Mutex::new(Watchdog { cr: 0, torr: 0, deadline: NO_DEADLINE });
+
+impl Watchdog {
+    /// `top` is the 4-bit timeout period field of WDT_TORR.
+    fn restart(&mut self, top: u32) {
+        let cycles = 1u64 << (16 + (top & 0xf));
+        self.deadline = timer::now() + cycles * (TIMEBASE_FREQ / CLOCK_FREQ);
+    }
+
+    fn read(&self, offset: u64) -> u32 {
+        match offset {
+            WDT_CR => self.cr,
+            WDT_TORR => self.torr,
+            WDT_CCVR if self.deadline != NO_DEADLINE => {
+                (self.deadline.saturating_sub(timer::now()) / (TIMEBASE_FREQ / CLOCK_FREQ)) as u32
+            }
+            WDT_COMP_PARAMS_1 => COMP_PARAMS_1_USE_FIX_TOP,
+            WDT_COMP_VERSION => 0x3130322a, // "102*"
+            WDT_COMP_TYPE => 0x44570120,
+            _ => 0,
+        }
+    }
+
+    fn write(&mut self, offset: u64, value: u64) {
+        match offset {
+            WDT_CR => {
+                let was_enabled = self.cr & WDT_CR_EN != 0;
+                // Only a reset disables it.
+                self.cr = value as u32 | (self.cr & WDT_CR_EN);
+                if !was_enabled && self.cr & WDT_CR_EN != 0 {
+                    // The first period is TOP_INIT.
+                    self.restart(self.torr >> 4);
+                }
+            }
+            WDT_TORR => self.torr = value as u32 & 0xff,
+            WDT_CRR if value == WDT_CRR_RESTART && self.cr & WDT_CR_EN != 0 => self.restart(self.torr),
+            _ => {}
+        }
+    }
+}
+
+impl Snapshot for Watchdog {
+    const VERSION: u32 = 1;
+
+    fn save(&self, w: &mut Writer) {
+        w.u32(self.cr);
+        w.u32(self.torr);
+        // Relative to now: the time doesn't advance while it's saved.
+        w.u64(if self.deadline == NO_DEADLINE { NO_DEADLINE } else { self.deadline.saturating_sub(timer::now()) });
+    }
+
+    fn load(&mut self, r: &mut Reader) -> Option<()> {
+        self.cr = r.u32()?;
+        self.torr = r.u32()?;
+        let remaining = r.u64()?;
+        self.deadline = if remaining == NO_DEADLINE { NO_DEADLINE } else { timer::now() + remaining };
+        Some(())
+    }
+}
+
+pub fn init() {
+    let (addr, end, _) = machine::device_region("watchdog");
+    mmio_bus::register("watchdog", addr, end, mmio_read, mmio_write);
+}
+
+fn mmio_read(offset: u64, _width: u64) -> u64 {
+    WATCHDOG.lock().read(offset) as u64
+}
+
+fn mmio_write(offset: u64, value: u64, _width: u64) {
+    WATCHDOG.lock().write(offset, value);
+}
+
+/// When the watchdog expires, for the host timer.
+pub fn deadline() -> u64 {
+    if !config().watchdog {
+        return NO_DEADLINE;
+    }
+
+    WATCHDOG.lock().deadline
+}
+
+/// Takes `-watchdog-action` if the watchdog has expired.
+pub fn poll(vcpu: &mut VCpu) {
+    if !config().watchdog {
+        return;
+    }
+
+    {
+        let mut watchdog = WATCHDOG.lock();
+        if timer::now() < watchdog.deadline {
+            return;
+        }
+
+        // Once: the driver has to restart it again.
+        watchdog.deadline = NO_DEADLINE;
+    }
+
+    let action = match config().watchdog_action {
+        WatchdogAction::Reset => "reset",
+        WatchdogAction::Poweroff => "poweroff",
+        WatchdogAction::Pause => "pause",
+        WatchdogAction::None => "none",
+    };
+
+    warn!("watchdog", "expired on vCPU {} (action: {})", vcpu.hart_id, action);
+    monitor::event("WATCHDOG", &format!("{{\"action\": \"{}\"}}", action));
+    match config().watchdog_action {
+        WatchdogAction::Reset => {
+            smp::pause_others(vcpu);
+            crash::reboot(vcpu, "watchdog");
+        }
+        WatchdogAction::Poweroff => {
+            monitor::event("SHUTDOWN", "{\"guest\": false, \"reason\": \"watchdog\"}");
+            let result = host_test::exit(host_test::EXIT_FAILURE);
+            panic!("[watchdog] failed to shut down: {:?}", result);
+        }
+        WatchdogAction::Pause => {
+            smp::pause_others(vcpu);
+            crash::park(vcpu);
+        }
+        WatchdogAction::None => {}
+    }
+}
+
+/// Disables the watchdog for a reboot.
+pub fn reset() {
+    let mut watchdog = WATCHDOG.lock();
+    watchdog.cr = 0;
+    watchdog.torr = 0;
+    watchdog.deadline = NO_DEADLINE;
+}
+
+pub fn save(w: &mut Writer) {
+    if config().watchdog {
+        w.section("watchdog", &*WATCHDOG.lock());
+    }
+}
+
+pub fn load(sections: &[Section]) -> Result<(), String> {
+    if !config().watchdog {
+        return Ok(());
+    }
+
+    snapshot::load_section(sections, "watchdog", &mut *WATCHDOG.lock())
+}
@@ -0,0 +1,523 @@
+//! A zstd (RFC 8878) compressor for snapshots, and a decompressor for what
+//! it writes. The compressor finds matches with a hash table, and codes
+//! them with the predefined FSE tables while the literals stay raw: not as
+//! small as `zstd -1`, but fast, and `zstd -d` reads its frames too.
+//!
+//! The decompressor takes raw, RLE and compressed blocks, with raw or RLE
+//! literals and the predefined tables. Huffman-coded literals, FSE tables
+//! in the frame, and repeated offsets are not supported.
+use alloc::{vec, vec::Vec};
+use spin::Once;
+
+const MAGIC: u32 = 0xfd2f_b528;
+const FRAME_SINGLE_SEGMENT: u8 = 1 << 5;
+const FRAME_CHECKSUM: u8 = 1 << 2;
+const MAX_BLOCK_SIZE: usize = 128 * 1024;
+const BLOCK_RAW: u32 = 0;
+const BLOCK_RLE: u32 = 1;
+const BLOCK_COMPRESSED: u32 = 2;
+const LITERALS_RAW: u8 = 0;
+const LITERALS_RLE: u8 = 1;
+/// Offsets are coded as offset + 3: 1 to 3 are the repeated offsets.
+const REPEATED_OFFSETS: u32 = 3;
+const MIN_MATCH: usize = 4;
+const HASH_BITS: u32 = 14;
+
+const LL_BASE: [u32; 36] = [
+    0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024,
+    2048, 4096, 8192, 16384, 32768, 65536,
+];
+const LL_BITS: [u8; 36] =
+    [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16];
+const ML_BASE: [u32; 53] = [
+    3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33,
+    34, 35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099, 8195, 16387, 32771, 65539,
+];
+const ML_BITS: [u8; 53] = [
+    0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3,
+    3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+];
+
+/// The predefined distributions (-1 is "less than 1").
+const LL_DISTRIBUTION: [i16; 36] =
+    [4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1];
+const ML_DISTRIBUTION: [i16; 53] = [
+    1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+    1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1,
+];
+const OF_DISTRIBUTION: [i16; 29] =
+    [1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1];
+
+type Result<T> = core::result::Result<T, &'static str>;
+
+/// An FSE table, for both directions.
+struct Fse {
+    log: u32,
+    /// (symbol, number of bits, baseline) of each state, to decode.
+    states: Vec<(u8, u8, u16)>,
+    /// The next states of the encoder, grouped by symbol.
+    next_states: Vec<u16>,
+    /// (deltaNbBits, deltaFindState) of each symbol, to encode.
+    transforms: Vec<(u32, i32)>,
+}
+
+impl Fse {
+    fn new(distribution: &[i16], log: u32) -> Fse {
+        let size = 1 << log;
+        // "Less than 1" symbols take the last states, then the others are
+        // spread over the rest.
+        let mut symbols = vec![0u8; size];
+        let mut high = size;
+        for (symbol, &p) in distribution.iter().enumerate() {
+            if p == -1 {
+                high -= 1;
+                symbols[high] = symbol as u8;
+            }
+        }
+
+        let step = (size >> 1) + (size >> 3) + 3;
+        let mut pos = 0;
+        for (symbol, &p) in distribution.iter().enumerate() {
+            for _ in 0..p.max(0) {
+                symbols[pos] = symbol as u8;
+                pos = (pos + step) & (size - 1);
+                while pos >= high {
+                    pos = (pos + step) & (size - 1);
+                }
+            }
+        }
+
+        let mut next: Vec<u32> = distribution.iter().map(|&p| p.max(1) as u32).collect();
+        let states = symbols
+            .iter()
+            .map(|&symbol| {
+                let n = next[symbol as usize];
+                next[symbol as usize] += 1;
+                let nb_bits = log - (31 - n.leading_zeros());
+                (symbol, nb_bits as u8, ((n << nb_bits) - size as u32) as u16)
+            })
+            .collect();
+
+        let mut cumul = Vec::new();
+        let mut total = 0;
+        for &p in distribution {
+            cumul.push(total);
+            total += p.max(1) as usize;
+        }
+
+        let mut next_states = vec![0u16; size];
+        for (u, &symbol) in symbols.iter().enumerate() {
+            next_states[cumul[symbol as usize]] = (size + u) as u16;
+            cumul[symbol as usize] += 1;
+        }
+
+        let mut total = 0i32;
+        let transforms = distribution
+            .iter()
+            .map(|&p| {
+                let transform = if p <= 1 {
+                    ((log << 16) - size as u32, total - 1)
+                } else {
+                    let max_bits_out = log - (31 - (p as u32 - 1).leading_zeros());
+                    ((max_bits_out << 16) - ((p as u32) << max_bits_out), total - p as i32)
+                };
+                total += p.max(1) as i32;
+                transform
+            })
+            .collect();
+
+        Fse { log, states, next_states, transforms }
+    }
+
+    /// The state to start encoding backward from, with `symbol` last.
+    fn initial_state(&self, symbol: usize) -> u32 {
+        let (delta_nb_bits, delta_find_state) = self.transforms[symbol];
+        let nb_bits = (delta_nb_bits + (1 << 15)) >> 16;
+        let value = (nb_bits << 16) - delta_nb_bits;
+        self.next_states[((value >> nb_bits) as i32 + delta_find_state) as usize] as u32
+    }
+
+    fn encode(&self, state: &mut u32, symbol: usize, w: &mut BitWriter) {
+        let (delta_nb_bits, delta_find_state) = self.transforms[symbol];
+        let nb_bits = (*state + delta_nb_bits) >> 16;
+        w.bits(*state as u64, nb_bits);
+        *state = self.next_states[((*state >> nb_bits) as i32 + delta_find_state) as usize] as u32;
+    }
+
+    fn flush(&self, state: u32, w: &mut BitWriter) {
+        w.bits(state as u64, self.log);
+    }
+}
+
+/// The literal length, match length and offset tables.
+fn tables() -> &'static [Fse; 3] {
+    static TABLES: Once<[Fse; 3]> = Once::new();
+    TABLES.call_once(|| {
+        [Fse::new(&LL_DISTRIBUTION, 6), Fse::new(&ML_DISTRIBUTION, 6), Fse::new(&OF_DISTRIBUTION, 5)]
+    })
+}
+
+#[derive(Default)]
+struct BitWriter {
+    out: Vec<u8>,
+    buf: u64,
+    count: u32,
+}
+
+impl BitWriter {
+    /// Appends the low `n` bits of `value` (up to 32).
+    fn bits(&mut self, value: u64, n: u32) {
+        self.buf |= (value & ((1 << n) - 1)) << self.count;
+        self.count += n;
+        while self.count >= 8 {
+            self.out.push(self.buf as u8);
+            self.buf >>= 8;
+            self.count -= 8;
+        }
+    }
+
+    /// Ends the stream with a 1 bit: the reader starts from there.
+    fn finish(mut self) -> Vec<u8> {
+        self.bits(1, 1);
+        if self.count > 0 {
+            self.out.push(self.buf as u8);
+        }
+        self.out
+    }
+}
+
+/// Reads a stream written by BitWriter, from the end.
+struct BackwardReader<'a> {
+    data: &'a [u8],
+    /// The number of bits left.
+    pos: usize,
+}
+
+impl<'a> BackwardReader<'a> {
+    fn new(data: &'a [u8]) -> Result<BackwardReader<'a>> {
+        let last = *data.last().ok_or("unexpected end of data")?;
+        if last == 0 {
+            return Err("no end mark in the bitstream");
+        }
+        Ok(BackwardReader { data, pos: (data.len() - 1) * 8 + (7 - last.leading_zeros() as usize) })
+    }
+
+    fn bits(&mut self, n: u32) -> Result<u32> {
+        if n as usize > self.pos {
+            return Err("bitstream overflow");
+        }
+
+        self.pos -= n as usize;
+        let mut word = 0u64;
+        for (i, &byte) in self.data[self.pos / 8..].iter().take(8).enumerate() {
+            word |= (byte as u64) << (8 * i);
+        }
+        Ok(((word >> (self.pos % 8)) & ((1 << n) - 1)) as u32)
+    }
+}
+
+fn read_u32(data: &[u8], pos: usize) -> u32 {
+    u32::from_le_bytes(data[pos..pos + 4].try_into().unwrap())
+}
+
+/// The code of `value` in a table of baselines.
+fn code(base: &[u32], value: u32) -> usize {
+    base.partition_point(|&b| b <= value) - 1
+}
+
+struct Sequence {
+    literals: u32,
+    match_len: u32,
+    offset: u32,
+}
+
+fn block_header(out: &mut Vec<u8>, last: bool, type_: u32, size: usize) {
+    let header = last as u32 | (type_ << 1) | ((size as u32) << 3);
+    out.extend_from_slice(&header.to_le_bytes()[..3]);
+}
+
+/// Encodes the sequences backward: the decoder reads them forward.
+fn encode_sequences(sequences: &[Sequence]) -> Vec<u8> {
+    let [ll, ml, of] = tables();
+    let codes = |s: &Sequence| {
+        let offset_value = s.offset + REPEATED_OFFSETS;
+        (code(&LL_BASE, s.literals), code(&ML_BASE, s.match_len), 31 - offset_value.leading_zeros() as usize)
+    };
+    let extra_bits = |w: &mut BitWriter, s: &Sequence, (ll_code, ml_code, of_code): (usize, usize, usize)| {
+        w.bits((s.literals - LL_BASE[ll_code]) as u64, LL_BITS[ll_code] as u32);
+        w.bits((s.match_len - ML_BASE[ml_code]) as u64, ML_BITS[ml_code] as u32);
+        w.bits((s.offset + REPEATED_OFFSETS - (1 << of_code)) as u64, of_code as u32);
+    };
+
+    let mut w = BitWriter::default();
+    let (last, rest) = sequences.split_last().unwrap();
+    let last_codes = codes(last);
+    let mut ml_state = ml.initial_state(last_codes.1);
+    let mut of_state = of.initial_state(last_codes.2);
+    let mut ll_state = ll.initial_state(last_codes.0);
+    extra_bits(&mut w, last, last_codes);
+    for s in rest.iter().rev() {
+        let (ll_code, ml_code, of_code) = codes(s);
+        of.encode(&mut of_state, of_code, &mut w);
+        ml.encode(&mut ml_state, ml_code, &mut w);
+        ll.encode(&mut ll_state, ll_code, &mut w);
+        extra_bits(&mut w, s, (ll_code, ml_code, of_code));
+    }
+
+    ml.flush(ml_state, &mut w);
+    of.flush(of_state, &mut w);
+    ll.flush(ll_state, &mut w);
+    w.finish()
+}
+
+/// Compresses `src[start..end]` into a block. `table` has the last position
+/// (plus 1) of each hash, so matches go back into the previous blocks too.
+fn compress_block(src: &[u8], start: usize, end: usize, table: &mut [usize], last: bool, out: &mut Vec<u8>) {
+    let block = &src[start..end];
+    if !block.is_empty() && block.iter().all(|&b| b == block[0]) {
+        block_header(out, last, BLOCK_RLE, block.len());
+        out.push(block[0]);
+        return;
+    }
+
+    let mut literals = Vec::new();
+    let mut sequences = Vec::new();
+    let mut literals_start = start;
+    let mut pos = start;
+    while pos + MIN_MATCH <= end {
+        let word = read_u32(src, pos);
+        let hash = (word.wrapping_mul(0x9e37_79b1) >> (32 - HASH_BITS)) as usize;
+        let candidate = core::mem::replace(&mut table[hash], pos + 1);
+        if candidate == 0 || read_u32(src, candidate - 1) != word {
+            pos += 1;
+            continue;
+        }
+
+        let candidate = candidate - 1;
+        let mut len = MIN_MATCH;
+        while pos + len < end && src[candidate + len] == src[pos + len] {
+            len += 1;
+        }
+
+        literals.extend_from_slice(&src[literals_start..pos]);
+        sequences.push(Sequence {
+            literals: (pos - literals_start) as u32,
+            match_len: len as u32,
+            offset: (pos - candidate) as u32,
+        });
+        pos += len;
+        literals_start = pos;
+    }
+    literals.extend_from_slice(&src[literals_start..end]);
+
+    // Raw literals, with a 1-, 2- or 3-byte header.
+    let mut compressed = Vec::new();
+    let n = literals.len();
+    match n {
+        0..32 => compressed.push((n << 3) as u8 | LITERALS_RAW),
+        32..4096 => compressed.extend_from_slice(&(((n << 4) | 0b0100) as u16).to_le_bytes()),
+        _ => compressed.extend_from_slice(&(((n << 4) | 0b1100) as u32).to_le_bytes()[..3]),
+    }
+    compressed.extend_from_slice(&literals);
+
+    let n = sequences.len();
+    match n {
+        0..128 => compressed.push(n as u8),
+        128..0x7f00 => compressed.extend_from_slice(&[((n >> 8) + 0x80) as u8, n as u8]),
+        _ => {
+            compressed.push(0xff);
+            compressed.extend_from_slice(&((n - 0x7f00) as u16).to_le_bytes());
+        }
+    }
+    if n > 0 {
+        // The predefined tables for all three.
+        compressed.push(0);
+        compressed.extend_from_slice(&encode_sequences(&sequences));
+    }
+
+    if compressed.len() < block.len() {
+        block_header(out, last, BLOCK_COMPRESSED, compressed.len());
+        out.extend_from_slice(&compressed);
+    } else {
+        block_header(out, last, BLOCK_RAW, block.len());
+        out.extend_from_slice(block);
+    }
+}
+
+/// Compresses `src` into a zstd frame.
+pub fn compress(src: &[u8]) -> Vec<u8> {
+    let mut out = Vec::from(MAGIC.to_le_bytes());
+    // Single segment: the window is the whole content, with its size in 4
+    // bytes (or 8).
+    if let Ok(size) = u32::try_from(src.len()) {
+        out.push((2 << 6) | FRAME_SINGLE_SEGMENT);
+        out.extend_from_slice(&size.to_le_bytes());
+    } else {
+        out.push((3 << 6) | FRAME_SINGLE_SEGMENT);
+        out.extend_from_slice(&(src.len() as u64).to_le_bytes());
+    }
+
+    let mut table = vec![0; 1 << HASH_BITS];
+    let mut start = 0;
+    loop {
+        let end = (start + MAX_BLOCK_SIZE).min(src.len());
+        compress_block(src, start, end, &mut table, end == src.len(), &mut out);
+        if end == src.len() {
+            return out;
+        }
+        start = end;
+    }
+}
+
+fn get(data: &[u8], start: usize, len: usize) -> Result<&[u8]> {
+    data.get(start..start + len).ok_or("unexpected end of data")
+}
+
+fn decompress_block(block: &[u8], out: &mut Vec<u8>) -> Result<()> {
+    let b0 = *block.first().ok_or("unexpected end of data")?;
+    let (header_len, size) = match (b0 >> 2) & 0b11 {
+        0 | 2 => (1, b0 as usize >> 3),
+        1 => (2, u16::from_le_bytes(get(block, 0, 2)?.try_into().unwrap()) as usize >> 4),
+        _ => {
+            let b = get(block, 0, 3)?;
+            (3, (u32::from_le_bytes([b[0], b[1], b[2], 0]) >> 4) as usize)
+        }
+    };
+
+    let rle_literals;
+    let (literals, mut pos): (&[u8], usize) = match b0 & 0b11 {
+        LITERALS_RAW => (get(block, header_len, size)?, header_len + size),
+        LITERALS_RLE => {
+            rle_literals = vec![get(block, header_len, 1)?[0]; size];
+            (&rle_literals, header_len + 1)
+        }
+        _ => return Err("Huffman-coded literals are not supported"),
+    };
+
+    let b0 = get(block, pos, 1)?[0] as usize;
+    let (num_sequences, len) = match b0 {
+        0..128 => (b0, 1),
+        128..255 => (((b0 - 0x80) << 8) + get(block, pos + 1, 1)?[0] as usize, 2),
+        _ => (u16::from_le_bytes(get(block, pos + 1, 2)?.try_into().unwrap()) as usize + 0x7f00, 3),
+    };
+    pos += len;
+    if num_sequences == 0 {
+        out.extend_from_slice(literals);
+        return Ok(());
+    }
+
+    if get(block, pos, 1)?[0] != 0 {
+        return Err("only the predefined FSE tables are supported");
+    }
+
+    let [ll, ml, of] = tables();
+    let mut r = BackwardReader::new(&block[pos + 1..])?;
+    let mut ll_state = r.bits(ll.log)? as usize;
+    let mut of_state = r.bits(of.log)? as usize;
+    let mut ml_state = r.bits(ml.log)? as usize;
+    let mut literals_pos = 0;
+    for i in 0..num_sequences {
+        let (ll_code, ll_nb_bits, ll_base) = ll.states[ll_state];
+        let (ml_code, ml_nb_bits, ml_base) = ml.states[ml_state];
+        let (of_code, of_nb_bits, of_base) = of.states[of_state];
+        let offset_value = (1 << of_code) + r.bits(of_code as u32)?;
+        let match_len = ML_BASE[ml_code as usize] + r.bits(ML_BITS[ml_code as usize] as u32)?;
+        let literals_len = LL_BASE[ll_code as usize] + r.bits(LL_BITS[ll_code as usize] as u32)?;
+        if i + 1 < num_sequences {
+            ll_state = ll_base as usize + r.bits(ll_nb_bits as u32)? as usize;
+            ml_state = ml_base as usize + r.bits(ml_nb_bits as u32)? as usize;
+            of_state = of_base as usize + r.bits(of_nb_bits as u32)? as usize;
+        }
+
+        if offset_value <= REPEATED_OFFSETS {
+            return Err("repeated offsets are not supported");
+        }
+
+        out.extend_from_slice(get(literals, literals_pos, literals_len as usize)?);
+        literals_pos += literals_len as usize;
+        let offset = (offset_value - REPEATED_OFFSETS) as usize;
+        if offset > out.len() {
+            return Err("offset out of range");
+        }
+
+        // The match may overlap with itself.
+        let from = out.len() - offset;
+        for j in 0..match_len as usize {
+            out.push(out[from + j]);
+        }
+    }
+
+    if r.pos != 0 {
+        return Err("trailing bits in the sequences");
+    }
+
+    out.extend_from_slice(literals.get(literals_pos..).ok_or("too long literals")?);
+    Ok(())
+}
+
+/// Decompresses a zstd frame written by `compress`.
+pub fn decompress(src: &[u8]) -> Result<Vec<u8>> {
+    if src.len() < 5 || read_u32(src, 0) != MAGIC {
+        return Err("not a zstd frame");
+    }
+
+    let descriptor = src[4];
+    if descriptor & 0b11 != 0 {
+        return Err("dictionaries are not supported");
+    }
+
+    let single_segment = descriptor & FRAME_SINGLE_SEGMENT != 0;
+    let mut pos = if single_segment { 5 } else { 6 };
+    let content_size_len = match descriptor >> 6 {
+        0 => single_segment as usize,
+        1 => 2,
+        2 => 4,
+        _ => 8,
+    };
+    let mut content_size = None;
+    if content_size_len > 0 {
+        let mut bytes = [0; 8];
+        bytes[..content_size_len].copy_from_slice(get(src, pos, content_size_len)?);
+        let size = u64::from_le_bytes(bytes) as usize;
+        content_size = Some(if content_size_len == 2 { size + 256 } else { size });
+        pos += content_size_len;
+    }
+
+    let mut out = Vec::with_capacity(content_size.unwrap_or(0).min(MAX_BLOCK_SIZE * 8));
+    loop {
+        let header = get(src, pos, 3)?;
+        let header = u32::from_le_bytes([header[0], header[1], header[2], 0]);
+        let size = (header >> 3) as usize;
+        pos += 3;
+        match (header >> 1) & 0b11 {
+            BLOCK_RAW => {
+                out.extend_from_slice(get(src, pos, size)?);
+                pos += size;
+            }
+            BLOCK_RLE => {
+                let byte = get(src, pos, 1)?[0];
+                out.resize(out.len() + size, byte);
+                pos += 1;
+            }
+            BLOCK_COMPRESSED => {
+                decompress_block(get(src, pos, size)?, &mut out)?;
+                pos += size;
+            }
+            _ => return Err("reserved block type"),
+        }
+
+        if header & 1 != 0 {
+            break;
+        }
+    }
+
+    // The checksum is not verified.
+    if descriptor & FRAME_CHECKSUM != 0 {
+        get(src, pos, 4)?;
+    }
+
+    if content_size.is_some_and(|size| size != out.len()) {
+        return Err("content size mismatch");
+    }
+    Ok(out)
+}